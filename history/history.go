@@ -4,6 +4,12 @@ package main
 import (
     "os"
     "fmt"
+    "compress/gzip"
+    "encoding/csv"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/url"
     "strings"
     "time"
 
@@ -16,8 +22,41 @@ var (
   timeFrame = "15Min"
   startTime = time.Date(2020, time.November, 13, 0, 0, 0, 0, time.UTC)
   endTime = time.Date(2020, time.December, 11, 0, 0, 0, 0, time.UTC)
+  // When set, history is written to this file in the backtest file format
+  // instead of printed. Files ending in .gz are gzip compressed.
+  outputFile = ""
+  // When true, the NBBO quote at the end of each bar is downloaded too, and
+  // written as bid and ask columns after the volume, so the spread-aware
+  // fills can be backtested with -backtest_bid_column=6
+  // -backtest_ask_column=7. Every quote of the period is paged through, which
+  // takes a long time for liquid symbols.
+  collectQuotes = false
+  // dataURL is the endpoint of the market data API quotes are downloaded
+  // from.
+  dataURL = "https://data.alpaca.markets/v2"
 )
 
+// barDurations are the durations of the timeFrame bars.
+var barDurations = map[string]time.Duration{
+  "1Min": time.Minute,
+  "5Min": 5 * time.Minute,
+  "15Min": 15 * time.Minute,
+  "1D": 24 * time.Hour,
+}
+
+// quote is a historical NBBO quote.
+type quote struct {
+  Time time.Time `json:"t"`
+  BidPrice float64 `json:"bp"`
+  AskPrice float64 `json:"ap"`
+}
+
+// quotesPage is a page of the quotes of a symbol.
+type quotesPage struct {
+  Quotes []quote `json:"quotes"`
+  NextPageToken *string `json:"next_page_token"`
+}
+
 func init() {
     os.Setenv(common.EnvApiKeyID, "PKMYQANTSQ1QRQW9FSO6")
     os.Setenv(common.EnvApiSecretKey, "d5T9VG79siGgofz8snYZDX85wLnVQHtPDQfvRMET")
@@ -63,6 +102,141 @@ func collectHistory(c *alpaca.Client) ([]alpaca.Bar, error) {
   return history, nil
 }
 
+// collectBarQuotes returns the last quote within each bar, keyed by the bar
+// time. Bars without a quote are left out.
+func collectBarQuotes(history []alpaca.Bar) (map[int64]quote, error) {
+  d, ok := barDurations[timeFrame]
+  if !ok {
+    return nil, fmt.Errorf("unknown bar duration of timeFrame %q", timeFrame)
+  }
+  quotes := map[int64]quote{}
+  if len(history) == 0 {
+    return quotes, nil
+  }
+  i := 0
+  var pageToken string
+  for {
+    page, err := getQuotes(pageToken)
+    if err != nil {
+      if strings.Contains(err.Error(), "too many requests") {
+        time.Sleep(time.Minute)
+        continue
+      }
+      return nil, err
+    }
+    for _, q := range page.Quotes {
+      // The bars and the quotes are both in time order.
+      for i < len(history) && !q.Time.Before(history[i].GetTime().Add(d)) {
+        i++
+      }
+      if i == len(history) {
+        return quotes, nil
+      }
+      if !q.Time.Before(history[i].GetTime()) {
+        quotes[history[i].Time] = q
+      }
+    }
+    fmt.Printf("collected quotes up to bar %v of %v\n", i, len(history))
+    if page.NextPageToken == nil || *page.NextPageToken == "" {
+      return quotes, nil
+    }
+    pageToken = *page.NextPageToken
+  }
+}
+
+// getQuotes returns the page of quotes of the stock symbol between startTime
+// and endTime after pageToken.
+func getQuotes(pageToken string) (*quotesPage, error) {
+  v := url.Values{}
+  v.Set("start", startTime.Format(time.RFC3339))
+  v.Set("end", endTime.Format(time.RFC3339))
+  v.Set("limit", "10000")
+  if pageToken != "" {
+    v.Set("page_token", pageToken)
+  }
+  req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%v/stocks/%v/quotes?%v", dataURL, stockSymbol, v.Encode()), nil)
+  if err != nil {
+    return nil, err
+  }
+  req.Header.Set("APCA-API-KEY-ID", common.Credentials().ID)
+  req.Header.Set("APCA-API-SECRET-KEY", common.Credentials().Secret)
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    return nil, fmt.Errorf("GetQuotes err: %v", err)
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode == http.StatusTooManyRequests {
+    return nil, fmt.Errorf("GetQuotes err: too many requests")
+  }
+  if resp.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("GetQuotes err: %v", resp.Status)
+  }
+  page := &quotesPage{}
+  if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+    return nil, fmt.Errorf("unable to parse quotes: %v", err)
+  }
+  return page, nil
+}
+
+// writeHistory writes the bars as CSV rows of time, open, high, low, close
+// and volume, with times in EST as the backtest expects. When quotes is not
+// nil, the bid and ask of each bar follow, and are empty for bars without a
+// quote.
+func writeHistory(filename string, history []alpaca.Bar, quotes map[int64]quote) error {
+  est, err := time.LoadLocation("America/New_York")
+  if err != nil {
+    return fmt.Errorf("unable to load EST timezone location: %v", err)
+  }
+  f, err := os.Create(filename)
+  if err != nil {
+    return fmt.Errorf("unable to create %q: %v", filename, err)
+  }
+  defer f.Close()
+
+  var out io.Writer = f
+  var gz *gzip.Writer
+  if strings.HasSuffix(filename, ".gz") {
+    gz = gzip.NewWriter(f)
+    out = gz
+  }
+  w := csv.NewWriter(out)
+  for _, h := range history {
+    row := []string{
+      h.GetTime().In(est).Format("2006-01-02 15:04:05"),
+      fmt.Sprint(h.Open),
+      fmt.Sprint(h.High),
+      fmt.Sprint(h.Low),
+      fmt.Sprint(h.Close),
+      fmt.Sprint(h.Volume),
+    }
+    if quotes != nil {
+      bid, ask := "", ""
+      if q, ok := quotes[h.Time]; ok {
+        bid, ask = fmt.Sprint(q.BidPrice), fmt.Sprint(q.AskPrice)
+      }
+      row = append(row, bid, ask)
+    }
+    if err := w.Write(row); err != nil {
+      return fmt.Errorf("unable to write %q: %v", filename, err)
+    }
+  }
+  w.Flush()
+  if err := w.Error(); err != nil {
+    return fmt.Errorf("unable to write %q: %v", filename, err)
+  }
+  // Closing the gzip writer writes the end of the archive, so a failure
+  // leaves it truncated.
+  if gz != nil {
+    if err := gz.Close(); err != nil {
+      return fmt.Errorf("unable to write %q: %v", filename, err)
+    }
+  }
+  if err := f.Close(); err != nil {
+    return fmt.Errorf("unable to write %q: %v", filename, err)
+  }
+  return nil
+}
+
 func main() {
 
   c := alpaca.NewClient(common.Credentials())
@@ -72,7 +246,28 @@ func main() {
     fmt.Printf("unable to collect history: %v\n", err)
   }
 
+  var quotes map[int64]quote
+  if collectQuotes {
+    if quotes, err = collectBarQuotes(history); err != nil {
+      fmt.Printf("unable to collect quotes: %v\n", err)
+    }
+  }
+
+  if outputFile != "" {
+    if err := writeHistory(outputFile, history, quotes); err != nil {
+      fmt.Printf("unable to write history: %v\n", err)
+      // A truncated file would be read by backtests as a shorter history.
+      os.Remove(outputFile)
+      os.Exit(1)
+    }
+    return
+  }
+
   for _, h := range history {
+    if q, ok := quotes[h.Time]; ok {
+      fmt.Printf("%v: %v (bid %v, ask %v)\n", h.Time, h.Close, q.BidPrice, q.AskPrice)
+      continue
+    }
     fmt.Printf("%v: %v\n", h.Time, h.Close)
   }
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	adaptivePolling       = flag.Bool("adaptive_polling", false, "When true and stream_bars is false, the time between actions adapts to the purchases and signals: adaptive_poll_min when an open purchase is near its stop or take profit, duration_between_action while purchases are open or a buy signal is close, and adaptive_poll_max otherwise.")
+	adaptivePollMin       = flag.Duration("adaptive_poll_min", 5*time.Second, "The time between actions when an open purchase is near its stop or take profit.")
+	adaptivePollMax       = flag.Duration("adaptive_poll_max", 2*time.Minute, "The time between actions when nothing is held and no buy signal is close, or the market is closed.")
+	adaptivePollNearLevel = flag.Float64("adaptive_poll_near_level_percent", 0.2, "An open purchase whose price is within this percentage of its stop or take profit is near it.")
+	adaptivePollNearSlope = flag.Float64("adaptive_poll_near_slope_fraction", 0.5, "A buy signal is close when the slope of the latest bars is at least this fraction of min_slope_required_to_buy.")
+)
+
+// pollState is what the time between actions is adapted to.
+type pollState int
+
+const (
+	pollIdle pollState = iota
+	pollActive
+	pollNearLevel
+)
+
+func (s pollState) String() string {
+	switch s {
+	case pollNearLevel:
+		return "a purchase is near its stop or take profit"
+	case pollActive:
+		return "purchases are open or a buy signal is close"
+	default:
+		return "nothing is held and no buy signal is close"
+	}
+}
+
+// adaptivePollingEnabled returns true if the time between actions adapts.
+// Streamed bars keep signals fresh, so the interval is left alone.
+func adaptivePollingEnabled() bool {
+	return *adaptivePolling && !*streamBars
+}
+
+// lastPollState is the state of the previous tick, so changes are logged once.
+var lastPollState = pollState(-1)
+
+// adaptivePollInterval returns the time until the next action. The interval
+// is capped so no client's close out is missed.
+func adaptivePollInterval(clients []*client, clock *alpaca.Clock) time.Duration {
+	state := pollIdle
+	if clock.IsOpen {
+		for _, c := range clients {
+			if s := c.pollState(); s > state {
+				state = s
+			}
+		}
+	}
+	if state != lastPollState {
+		log.Printf("polling every %v, %v", pollStateInterval(state), state)
+		lastPollState = state
+	}
+	d := pollStateInterval(state)
+	if closeOut := nextCloseOut(clients, clock.NextClose, time.Now()); !closeOut.IsZero() && time.Until(closeOut) < d {
+		d = time.Until(closeOut)
+	}
+	return d
+}
+
+// pollStateInterval returns the time between actions in the state.
+func pollStateInterval(s pollState) time.Duration {
+	switch s {
+	case pollNearLevel:
+		return *adaptivePollMin
+	case pollActive:
+		return *durationBetweenAction
+	default:
+		return *adaptivePollMax
+	}
+}
+
+// pollState returns the state of the client's purchases and signal.
+func (c *client) pollState() pollState {
+	var price decimal.Decimal
+	if unrealized != nil {
+		if u := unrealized.snapshot(c); u != nil && len(u.positions) > 0 {
+			price = u.positions[0].price
+		}
+	}
+	state := pollIdle
+	c.do(func() {
+		for _, p := range c.purchases {
+			if p.SellFilled() || p.BuyEndedUnsuccessfully() {
+				continue
+			}
+			state = pollActive
+			if p.SellOrder == nil || !price.IsPositive() {
+				continue
+			}
+			if nearLevel(price, p.SellOrder.LimitPrice, c.cfg.AdaptivePollNearLevel) {
+				state = pollNearLevel
+				return
+			}
+			if p.SellOrder.Legs != nil && len(*p.SellOrder.Legs) > 0 && nearLevel(price, (*p.SellOrder.Legs)[0].StopPrice, c.cfg.AdaptivePollNearLevel) {
+				state = pollNearLevel
+				return
+			}
+		}
+		if !c.retired && c.lastSlope >= c.cfg.Params.minSlope*c.cfg.AdaptivePollNearSlope {
+			state = pollActive
+		}
+	})
+	return state
+}
+
+// nearLevel returns true if the price is within percent of the level.
+func nearLevel(price decimal.Decimal, level *decimal.Decimal, percent float64) bool {
+	if level == nil || !level.IsPositive() {
+		return false
+	}
+	distance := price.Sub(*level).Abs().Div(*level).Mul(decimal.NewFromInt(100))
+	return distance.LessThanOrEqual(decimal.NewFromFloat(percent))
+}
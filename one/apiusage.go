@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	apiRateLimit     = flag.Int("alpaca_rate_limit", 200, "The number of Alpaca API calls allowed per minute.")
+	apiRateLimitWarn = flag.Float64("alpaca_rate_limit_warn", 0.8, "A warning is logged when the Alpaca API calls in a minute reach this fraction of alpaca_rate_limit.")
+)
+
+// apiPathSegment matches the path segments which name an endpoint, rather
+// than a parameter such as an order ID or symbol.
+var apiPathSegment = regexp.MustCompile(`^[a-z_:]+$`)
+
+// apiUsage counts the Alpaca API calls made each day by endpoint.
+type apiUsage struct {
+	mu          sync.Mutex
+	day         string
+	counts      map[string]int
+	minute      time.Time
+	minuteCalls int
+	peakMinute  int
+	warned      bool
+}
+
+var alpacaUsage = &apiUsage{counts: map[string]int{}}
+
+// countingTransport counts the requests made to the Alpaca API.
+type countingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Hostname(), "alpaca.markets") {
+		alpacaUsage.record(usageEndpoint(req), time.Now())
+	}
+	return t.base.RoundTrip(req)
+}
+
+// countAPIUsage counts the Alpaca API calls made by the process. The Alpaca
+// client sends every request with http.DefaultClient, and the requests it
+// does not support are sent with alpacaHTTPClient.
+func countAPIUsage() {
+	base := http.DefaultClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	http.DefaultClient.Transport = &countingTransport{base: base}
+	alpacaHTTPClient.Transport = &countingTransport{base: http.DefaultTransport}
+}
+
+// usageEndpoint returns the endpoint of the request with parameters removed,
+// e.g. "GET /v2/orders/:param".
+func usageEndpoint(req *http.Request) string {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for i, s := range segments {
+		if i > 0 && !apiPathSegment.MatchString(s) {
+			segments[i] = ":param"
+		}
+	}
+	return req.Method + " /" + strings.Join(segments, "/")
+}
+
+// record counts a call to the endpoint, warning when the calls in the current
+// minute approach the rate limit.
+func (u *apiUsage) record(endpoint string, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if day := now.In(BookkeepingTZ).Format("2006-01-02"); day != u.day {
+		if u.day != "" {
+			log.Printf("Alpaca API calls on %v: %v", u.day, u.summaryLocked())
+		}
+		u.day = day
+		u.counts = map[string]int{}
+		u.peakMinute = 0
+	}
+	u.counts[endpoint]++
+
+	if minute := now.Truncate(time.Minute); !minute.Equal(u.minute) {
+		u.minute = minute
+		u.minuteCalls = 0
+		u.warned = false
+	}
+	u.minuteCalls++
+	if u.minuteCalls > u.peakMinute {
+		u.peakMinute = u.minuteCalls
+	}
+	if !u.warned && float64(u.minuteCalls) >= *apiRateLimitWarn*float64(*apiRateLimit) {
+		u.warned = true
+		log.Printf("WARNING: %v Alpaca API calls this minute, the limit is %v. Consider streaming data instead of polling.", u.minuteCalls, *apiRateLimit)
+	}
+}
+
+// nearLimit returns true when the calls in the current minute have reached
+// alpaca_rate_limit_warn of the rate limit.
+func (u *apiUsage) nearLimit(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !now.Truncate(time.Minute).Equal(u.minute) {
+		return false
+	}
+	return float64(u.minuteCalls) >= *apiRateLimitWarn*float64(*apiRateLimit)
+}
+
+// callsThisMinute returns the number of calls made in the current minute.
+func (u *apiUsage) callsThisMinute(now time.Time) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !now.Truncate(time.Minute).Equal(u.minute) {
+		return 0
+	}
+	return u.minuteCalls
+}
+
+// apiUsageReport is the API usage of the current day.
+type apiUsageReport struct {
+	Day        string         `json:"day"`
+	Total      int            `json:"total"`
+	PeakMinute int            `json:"peak_minute"`
+	RateLimit  int            `json:"rate_limit"`
+	Endpoints  map[string]int `json:"endpoints"`
+}
+
+// report returns today's API usage.
+func (u *apiUsage) report() *apiUsageReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	r := &apiUsageReport{
+		Day:        u.day,
+		PeakMinute: u.peakMinute,
+		RateLimit:  *apiRateLimit,
+		Endpoints:  map[string]int{},
+	}
+	for e, n := range u.counts {
+		r.Endpoints[e] = n
+		r.Total += n
+	}
+	return r
+}
+
+// summaryLocked returns the counts by endpoint, most called first. u.mu must
+// be held.
+func (u *apiUsage) summaryLocked() string {
+	var endpoints []string
+	var total int
+	for e, n := range u.counts {
+		endpoints = append(endpoints, e)
+		total += n
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return u.counts[endpoints[i]] > u.counts[endpoints[j]]
+	})
+	parts := []string{fmt.Sprintf("%v total, peak %v/min", total, u.peakMinute)}
+	for _, e := range endpoints {
+		parts = append(parts, fmt.Sprintf("%v (%v)", e, u.counts[e]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// logSummary logs today's API calls.
+func (u *apiUsage) logSummary() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.day == "" {
+		return
+	}
+	log.Printf("Alpaca API calls on %v: %v", u.day, u.summaryLocked())
+}
+
+// writeAPIUsage writes today's API calls for the status page.
+func writeAPIUsage(w io.Writer) {
+	alpacaUsage.mu.Lock()
+	defer alpacaUsage.mu.Unlock()
+	fmt.Fprintf(w, "\nAlpaca API calls today (limit %v/min): %v\n", *apiRateLimit, alpacaUsage.summaryLocked())
+}
+
+// serveAPIUsage serves today's API calls as JSON.
+func serveAPIUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(alpacaUsage.report()); err != nil {
+		log.Printf("unable to encode API usage: %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	approvalNotional         = flag.Float64("approval_notional", 0, "If positive, live buy orders worth more than this many dollars are held until they are approved by hand on the dashboard, with POST /api/approvals/approve?id= (see control_token), or with \"/approve <id>\" to the approval_telegram_chat_id chat. Orders which are not approved within approval_timeout are skipped. Paper trading, backtests and protective sells never wait.")
+	approvalTimeout          = flag.Duration("approval_timeout", 2*time.Minute, "How long a buy order waits for approval before it is skipped.")
+	approvalTelegramBotToken = flag.String("approval_telegram_bot_token", "", "The token of the Telegram bot which asks for approvals in approval_telegram_chat_id, and reads the \"/approve <id>\" and \"/reject <id>\" replies.")
+	approvalTelegramChatID   = flag.String("approval_telegram_chat_id", "", "The Telegram chat which is asked for approvals. Only replies from this chat are accepted.")
+)
+
+// The states of an approval request.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalExpired  = "expired"
+)
+
+// approvalRequest is a buy order waiting for manual approval.
+type approvalRequest struct {
+	ID          int       `json:"id"`
+	Symbol      string    `json:"symbol"`
+	Strategy    string    `json:"strategy"`
+	Qty         string    `json:"qty"`
+	Price       string    `json:"price"`
+	Notional    string    `json:"notional"`
+	RequestedAt time.Time `json:"requested_at"`
+	Deadline    time.Time `json:"deadline"`
+	Status      string    `json:"status"`
+	DecidedBy   string    `json:"decided_by,omitempty"`
+}
+
+// approvalBook holds the approval requests. Decided requests are kept for
+// the dashboard until approvalHistory is reached.
+type approvalBook struct {
+	mu       sync.Mutex
+	lastID   int
+	requests []*approvalRequest
+}
+
+// approvalHistory is the number of approval requests which are kept.
+const approvalHistory = 50
+
+var approvals = &approvalBook{}
+
+// approvalRequired returns true if a buy of qty shares at price must be
+// approved by hand before it is placed.
+func (c *client) approvalRequired(qty, price decimal.Decimal) bool {
+	if c.cfg.ApprovalNotional <= 0 || c.cfg.Backtest || c.shadow || isPaperEndpoint(c.cfg.APIEndpoint) {
+		return false
+	}
+	return qty.Mul(price).GreaterThan(decimal.NewFromFloat(c.cfg.ApprovalNotional))
+}
+
+// requestApproval records a request to approve a buy of qty shares at price,
+// and asks for the approval.
+func (c *client) requestApproval(qty, price decimal.Decimal, now time.Time) *approvalRequest {
+	r := approvals.add(&approvalRequest{
+		Symbol:      c.stockSymbol,
+		Strategy:    c.strategy,
+		Qty:         qty.String(),
+		Price:       price.StringFixed(2),
+		Notional:    qty.Mul(price).StringFixed(2),
+		RequestedAt: now,
+		Deadline:    now.Add(c.cfg.ApprovalTimeout),
+		Status:      approvalPending,
+	})
+	msg := fmt.Sprintf("approval %v: buy %v %v @ ~$%v ($%v) for %v? Approve by %v, or it is skipped",
+		r.ID, r.Qty, r.Symbol, r.Price, r.Notional, r.Strategy, r.Deadline.In(EST).Format("15:04:05 MST"))
+	log.Print(msg)
+	go func() {
+		c.notifyAlert(msg)
+		sendApprovalTelegram(fmt.Sprintf("%v. Reply /approve %v or /reject %v", msg, r.ID, r.ID))
+	}()
+	return r
+}
+
+// add assigns the request an ID and records it.
+func (b *approvalBook) add(r *approvalRequest) *approvalRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	r.ID = b.lastID
+	b.requests = append(b.requests, r)
+	if len(b.requests) > approvalHistory {
+		b.requests = b.requests[len(b.requests)-approvalHistory:]
+	}
+	return r
+}
+
+// get returns a copy of the request at now, expiring it once its deadline
+// passed.
+func (b *approvalBook) get(r *approvalRequest, now time.Time) approvalRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.Status == approvalPending && now.After(r.Deadline) {
+		r.Status = approvalExpired
+	}
+	return *r
+}
+
+// decide approves or rejects the pending request with the ID.
+func (b *approvalBook) decide(id int, status, by string) (*approvalRequest, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.requests {
+		if r.ID != id {
+			continue
+		}
+		if r.Status == approvalPending && time.Now().After(r.Deadline) {
+			r.Status = approvalExpired
+		}
+		if r.Status != approvalPending {
+			return nil, fmt.Errorf("approval %v is already %v", id, r.Status)
+		}
+		r.Status = status
+		r.DecidedBy = by
+		copied := *r
+		return &copied, nil
+	}
+	return nil, fmt.Errorf("no approval %v", id)
+}
+
+// list returns copies of the requests, newest first.
+func (b *approvalBook) list() []approvalRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	list := []approvalRequest{}
+	for _, r := range b.requests {
+		if r.Status == approvalPending && now.After(r.Deadline) {
+			r.Status = approvalExpired
+		}
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return list
+}
+
+// awaitApproval checks the approval of a queued buy. It returns true once the
+// buy may be placed, and false while it waits. A buy which was rejected or not
+// approved in time is dropped.
+func (c *client) awaitApproval(in *orderIntent, now time.Time) bool {
+	r := approvals.get(in.approval, now)
+	switch r.Status {
+	case approvalApproved:
+		log.Printf("approval %v of the buy signal @ %v was given by %v", r.ID, in.signal, r.DecidedBy)
+		return true
+	case approvalPending:
+		in.notBefore = now.Add(time.Second)
+		c.orders.add(in)
+	case approvalRejected:
+		log.Printf("dropping the buy signal @ %v, approval %v was rejected by %v", in.signal, r.ID, r.DecidedBy)
+	default:
+		c.narrate(now, "skipped buying %v %v, approval %v was not given within %v", in.qty, c.stockSymbol, r.ID, c.cfg.ApprovalTimeout)
+	}
+	return false
+}
+
+// writeApprovals writes the pending approval requests for the status page.
+func writeApprovals(w io.Writer) {
+	for _, r := range approvals.list() {
+		if r.Status != approvalPending {
+			continue
+		}
+		fmt.Fprintf(w, "\nApproval %v: PENDING buy of %v %v @ ~$%v ($%v) for %v, skipped after %v. POST /api/approvals/approve?id=%v to approve.\n",
+			r.ID, r.Qty, r.Symbol, r.Price, r.Notional, r.Strategy, r.Deadline.In(EST).Format("15:04:05 MST"), r.ID)
+	}
+}
+
+// serveApprovals serves the approval requests as JSON, newest first.
+func serveApprovals(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(approvals.list()); err != nil {
+		log.Printf("unable to encode approvals: %v", err)
+	}
+}
+
+// serveApprovalDecision returns a handler which approves or rejects the
+// request with the id form value. It must be an authorized POST, see
+// authorizeControl.
+func serveApprovalDecision(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "decide an approval with a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeControl(w, r) {
+			log.Printf("refused an unauthorized decision of approval %q from %v", r.FormValue("id"), r.RemoteAddr)
+			return
+		}
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid id %q: %v", r.FormValue("id"), err), http.StatusBadRequest)
+			return
+		}
+		req, err := approvals.decide(id, status, r.RemoteAddr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("approval %v was %v from %v", id, status, r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(req); err != nil {
+			log.Printf("unable to encode approval: %v", err)
+		}
+	}
+}
+
+// approvalTelegramEnabled returns true if approvals are asked for on
+// Telegram.
+func approvalTelegramEnabled() bool {
+	return *approvalTelegramBotToken != "" && *approvalTelegramChatID != ""
+}
+
+// sendApprovalTelegram sends the message to the approval chat.
+func sendApprovalTelegram(msg string) {
+	if !approvalTelegramEnabled() {
+		return
+	}
+	b, err := json.Marshal(map[string]string{"chat_id": *approvalTelegramChatID, "text": msg})
+	if err != nil {
+		log.Printf("unable to marshal approval message: %v", err)
+		return
+	}
+	url := fmt.Sprintf("%v/bot%v/sendMessage", telegramAPI, *approvalTelegramBotToken)
+	if err := sendWebhook(url, webhookAlert, b); err != nil {
+		log.Printf("unable to send approval request to Telegram: %v", err)
+	}
+}
+
+// telegramUpdates is the response of the Telegram getUpdates method.
+type telegramUpdates struct {
+	OK     bool `json:"ok"`
+	Result []struct {
+		UpdateID int64 `json:"update_id"`
+		Message  *struct {
+			Text string `json:"text"`
+			Chat struct {
+				ID int64 `json:"id"`
+			} `json:"chat"`
+			From struct {
+				Username string `json:"username"`
+			} `json:"from"`
+		} `json:"message"`
+	} `json:"result"`
+}
+
+var approvalTelegramClient = &http.Client{Timeout: 40 * time.Second}
+
+// startApprovalBot reads the replies to the approval chat, when approvals are
+// required and asked for on Telegram.
+func startApprovalBot() {
+	if *approvalNotional <= 0 || !approvalTelegramEnabled() {
+		return
+	}
+	go func() {
+		var offset int64
+		for {
+			next, err := readApprovalReplies(offset)
+			if err != nil {
+				log.Printf("unable to read approval replies: %v", err)
+				time.Sleep(10 * time.Second)
+				continue
+			}
+			offset = next
+		}
+	}()
+}
+
+// readApprovalReplies long polls for the messages after offset, and decides
+// the approvals they reply to. It returns the offset of the next messages.
+func readApprovalReplies(offset int64) (int64, error) {
+	endpoint := fmt.Sprintf("%v/bot%v/getUpdates?timeout=30&offset=%v", telegramAPI, *approvalTelegramBotToken, offset)
+	resp, err := approvalTelegramClient.Get(endpoint)
+	if err != nil {
+		// The URL holds the token, so only the cause is returned.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return offset, err
+	}
+	defer resp.Body.Close()
+	updates := &telegramUpdates{}
+	if err := json.NewDecoder(resp.Body).Decode(updates); err != nil {
+		return offset, fmt.Errorf("unable to parse updates: %v", err)
+	}
+	if !updates.OK {
+		return offset, fmt.Errorf("getUpdates returned %v", resp.Status)
+	}
+	for _, u := range updates.Result {
+		offset = u.UpdateID + 1
+		if u.Message == nil || strconv.FormatInt(u.Message.Chat.ID, 10) != *approvalTelegramChatID {
+			continue
+		}
+		fields := strings.Fields(u.Message.Text)
+		if len(fields) != 2 {
+			continue
+		}
+		var status string
+		switch strings.SplitN(fields[0], "@", 2)[0] {
+		case "/approve":
+			status = approvalApproved
+		case "/reject":
+			status = approvalRejected
+		default:
+			continue
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			sendApprovalTelegram(fmt.Sprintf("invalid approval id %q", fields[1]))
+			continue
+		}
+		by := "telegram"
+		if u.Message.From.Username != "" {
+			by += " @" + u.Message.From.Username
+		}
+		if _, err := approvals.decide(id, status, by); err != nil {
+			sendApprovalTelegram(err.Error())
+			continue
+		}
+		log.Printf("approval %v was %v by %v", id, status, by)
+		sendApprovalTelegram(fmt.Sprintf("approval %v %v", id, status))
+	}
+	return offset, nil
+}
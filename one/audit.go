@@ -0,0 +1,295 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+// auditCommand is the command which compares the purchases in the database
+// with the order history in Alpaca and reports the records which do not add
+// up, e.g. "one audit -from 2020-12-01 -to 2020-12-31 -repair".
+const auditCommand = "audit"
+
+// The kinds of anomalies found by an audit.
+const (
+	anomalyUnsold      = "filled buy without a sell"
+	anomalyOrphanSell  = "sell without a buy"
+	anomalyDuplicateID = "duplicate client order ID"
+	anomalyQtyMismatch = "quantity mismatch"
+)
+
+// closedOrderStatuses are the statuses of orders which receive no further
+// updates.
+var closedOrderStatuses = map[string]bool{
+	filled:      true,
+	"canceled":  true,
+	"cancelled": true,
+	"expired":   true,
+	"replaced":  true,
+	"rejected":  true,
+	"stopped":   true,
+	"suspended": true,
+}
+
+// anomalyKinds are the kinds of anomalies in the order they are reported.
+var anomalyKinds = []string{anomalyUnsold, anomalyOrphanSell, anomalyDuplicateID, anomalyQtyMismatch}
+
+// anomaly is a record which does not match the order history.
+type anomaly struct {
+	kind   string
+	detail string
+	// fix describes how to fix the anomaly by hand. It is not shown when the
+	// anomaly can be repaired.
+	fix string
+	// repair fixes the purchase, which is then stored. It is nil when the
+	// anomaly cannot be repaired automatically.
+	repair   func()
+	purchase *purchase.Purchase
+}
+
+// audit reports the anomalies of the purchases bought and the sells filled
+// in the range, and repairs them when -repair is set.
+func audit(args []string) error {
+	fs := flag.NewFlagSet(auditCommand, flag.ContinueOnError)
+	from := fs.String("from", "", "The first day to audit (format: 2006-01-02).")
+	to := fs.String("to", "", "The last day to audit (format: 2006-01-02). Defaults to today.")
+	repair := fs.Bool("repair", false, "If true, the anomalies which can be fixed from the order history are repaired in the database.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("-from is required")
+	}
+	start, err := time.ParseInLocation("2006-01-02", *from, BookkeepingTZ)
+	if err != nil {
+		return fmt.Errorf("unable to parse -from: %v", err)
+	}
+	end := time.Now().In(BookkeepingTZ)
+	if *to != "" {
+		if end, err = time.ParseInLocation("2006-01-02", *to, BookkeepingTZ); err != nil {
+			return fmt.Errorf("unable to parse -to: %v", err)
+		}
+	}
+	end = time.Date(end.Year(), end.Month(), end.Day()+1, 0, 0, 0, 0, BookkeepingTZ)
+
+	// Purchases in the range may be sold after it, and sells in the range
+	// may end purchases bought before it.
+	alpacaClient := alpaca.NewClient(common.Credentials())
+	orders, err := closedOrders(alpacaClient, start.Add(-heldPurchasesLookback), minTime(end.Add(heldPurchasesLookback), time.Now()))
+	if err != nil {
+		return err
+	}
+	status := "open"
+	limit := listOrdersLimit
+	nested := true
+	open, err := alpacaClient.ListOrders(&status, nil, &limit, &nested)
+	if err != nil {
+		return fmt.Errorf("unable to list open orders: %v", err)
+	}
+	db, err := database.NewInstance(*databaseName, *instanceName)
+	if err != nil {
+		return fmt.Errorf("unable to open db: %v", err)
+	}
+	purchases, err := db.PurchasesBetween(start.Add(-heldPurchasesLookback), end.Add(heldPurchasesLookback))
+	if err != nil {
+		return err
+	}
+
+	anomalies := findAnomalies(purchases, append(orders, open...), start, end)
+	byKind := map[string][]*anomaly{}
+	for _, a := range anomalies {
+		byKind[a.kind] = append(byKind[a.kind], a)
+	}
+	var repaired, failed int
+	for _, kind := range anomalyKinds {
+		fmt.Printf("\n%v: %v\n", kind, len(byKind[kind]))
+		for _, a := range byKind[kind] {
+			fix := a.fix
+			switch {
+			case a.repair != nil && *repair:
+				a.repair()
+				if err := db.Update(a.purchase); err != nil {
+					fix = fmt.Sprintf("unable to repair: %v", err)
+					failed++
+				} else {
+					fix = "repaired"
+					repaired++
+				}
+			case a.repair != nil:
+				fix = "can be repaired with -repair"
+			}
+			fmt.Printf("  %v\n    fix: %v\n", a.detail, fix)
+		}
+	}
+	log.Printf("audited %v purchases and %v orders, found %v anomalies, repaired %v", len(purchases), len(orders)+len(open), len(anomalies), repaired)
+	if failed > 0 {
+		return fmt.Errorf("%v anomalies could not be repaired", failed)
+	}
+	return nil
+}
+
+// findAnomalies returns the anomalies of the purchases bought and the sells
+// filled in [start, end). Shadow purchases are not traded, so they are
+// skipped.
+func findAnomalies(purchases []*purchase.Purchase, orders []alpaca.Order, start, end time.Time) []*anomaly {
+	byID := map[string]*alpaca.Order{}
+	for i := range orders {
+		byID[orders[i].ID] = &orders[i]
+	}
+	inRange := func(t *time.Time) bool {
+		return t != nil && !t.Before(start) && t.Before(end)
+	}
+
+	var traded []*purchase.Purchase
+	for _, p := range purchases {
+		if !p.Shadow && p.BuyOrder != nil && p.BuyOrder.ID != "" {
+			traded = append(traded, p)
+		}
+	}
+	// The sells the order history pairs with each buy, for the purchases whose
+	// sell was never stored, e.g. when closing out.
+	paired := map[string]*alpaca.Order{}
+	for _, p := range pairOrders(orders, "") {
+		if p.SellOrder != nil {
+			paired[p.BuyOrder.ID] = p.SellOrder
+		}
+	}
+
+	var anomalies []*anomaly
+	sellIDs := map[string]bool{}
+	buys := map[string][]*purchase.Purchase{}
+	for _, p := range traded {
+		p := p
+		if p.SellOrder != nil && p.SellOrder.ID != "" {
+			sellIDs[p.SellOrder.ID] = true
+		}
+		// Either leg of a bracket buy order may be the sell.
+		if takeProfit, stopLoss := p.BracketLegs(); p.BracketEntry() {
+			sellIDs[takeProfit.ID] = true
+			sellIDs[stopLoss.ID] = true
+		}
+		if !inRange(&p.BuyOrder.SubmittedAt) {
+			continue
+		}
+		if id := p.BuyOrder.ClientOrderID; id != "" {
+			buys[id] = append(buys[id], p)
+		}
+		anomalies = append(anomalies, qtyAnomalies(p, byID)...)
+
+		if !p.BuyFilled() || p.SellFilled() {
+			continue
+		}
+		if p.SellOrder != nil && p.SellOrder.ID != "" {
+			if o, ok := byID[p.SellOrder.ID]; ok {
+				if _, sold := filledSell(o); sold || !closedOrderStatuses[o.Status] {
+					// The sell is still working, or its fill is repaired as a
+					// quantity mismatch.
+					continue
+				}
+			}
+		}
+		a := &anomaly{
+			kind:     anomalyUnsold,
+			purchase: p,
+			detail: fmt.Sprintf("purchase %d bought %v %v @ $%v on %v has no filled sell",
+				p.ID, p.BuyOrder.FilledQty, p.BuyOrder.Symbol, p.BuyOrder.FilledAvgPrice, p.BuyOrder.FilledAt.In(BookkeepingTZ)),
+			fix: "no sell in the order history ends it, check whether the position is still held",
+		}
+		if sell, ok := paired[p.BuyOrder.ID]; ok {
+			a.detail += fmt.Sprintf(", the order history pairs it with sell %v @ $%v on %v", sell.ID, sell.FilledAvgPrice, sell.FilledAt.In(BookkeepingTZ))
+			a.repair = func() { p.SellOrder = sell }
+			sellIDs[sell.ID] = true
+		}
+		anomalies = append(anomalies, a)
+	}
+
+	for _, o := range orders {
+		if o.Side != alpaca.Sell || sellIDs[o.ID] {
+			continue
+		}
+		sell, ok := filledSell(&o)
+		if !ok || !inRange(sell.FilledAt) {
+			continue
+		}
+		anomalies = append(anomalies, &anomaly{
+			kind:   anomalyOrphanSell,
+			detail: fmt.Sprintf("sell %v of %v %v @ $%v on %v is not the sell of any purchase", sell.ID, sell.FilledQty, sell.Symbol, sell.FilledAvgPrice, sell.FilledAt.In(BookkeepingTZ)),
+			fix:    "import the purchase with import-orders if its buy is missing, otherwise the position was sold outside of the trader",
+		})
+	}
+
+	var duplicated []string
+	for id, ps := range buys {
+		if len(ps) > 1 {
+			duplicated = append(duplicated, id)
+		}
+	}
+	sort.Strings(duplicated)
+	for _, id := range duplicated {
+		ps := buys[id]
+		var ids []int64
+		for _, p := range ps {
+			ids = append(ids, p.ID)
+		}
+		anomalies = append(anomalies, &anomaly{
+			kind:   anomalyDuplicateID,
+			detail: fmt.Sprintf("purchases %v share the buy client order ID %q", ids, id),
+			fix:    fmt.Sprintf("the order was stored more than once, delete all but purchase %d", ids[0]),
+		})
+	}
+	return anomalies
+}
+
+// qtyAnomalies returns the orders of the purchase whose filled quantity
+// differs from the order history, along with a sell which filled a different
+// quantity than the buy.
+func qtyAnomalies(p *purchase.Purchase, byID map[string]*alpaca.Order) []*anomaly {
+	var anomalies []*anomaly
+	if o, ok := byID[p.BuyOrder.ID]; ok && !o.FilledQty.Equal(p.BuyOrder.FilledQty) {
+		anomalies = append(anomalies, &anomaly{
+			kind:     anomalyQtyMismatch,
+			purchase: p,
+			detail:   fmt.Sprintf("purchase %d buy %v filled %v (%v), the order history has %v (%v)", p.ID, o.ID, p.BuyOrder.FilledQty, p.BuyOrder.Status, o.FilledQty, o.Status),
+			repair:   func() { p.BuyOrder = o },
+		})
+	}
+	if p.SellOrder == nil || p.SellOrder.ID == "" {
+		return anomalies
+	}
+	if o, ok := byID[p.SellOrder.ID]; ok {
+		if sell, filledNow := filledSell(o); filledNow && !p.SellFilled() {
+			anomalies = append(anomalies, &anomaly{
+				kind:     anomalyQtyMismatch,
+				purchase: p,
+				detail:   fmt.Sprintf("purchase %d sell %v is %v, the order history has it filled %v @ $%v", p.ID, o.ID, p.SellOrder.Status, sell.FilledQty, sell.FilledAvgPrice),
+				repair:   func() { p.SellOrder = sell },
+			})
+			return anomalies
+		}
+	}
+	if p.BuyFilled() && p.SellFilled() && !p.SellOrder.FilledQty.Equal(p.BuyOrder.FilledQty) {
+		anomalies = append(anomalies, &anomaly{
+			kind:     anomalyQtyMismatch,
+			purchase: p,
+			detail:   fmt.Sprintf("purchase %d bought %v but sold %v", p.ID, p.BuyOrder.FilledQty, p.SellOrder.FilledQty),
+			fix:      "check the position for leftover or missing shares",
+		})
+	}
+	return anomalies
+}
+
+// minTime returns the earlier of the times.
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
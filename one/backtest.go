@@ -3,16 +3,15 @@
 package main
 
 import (
-	"encoding/csv"
-	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
-	"os"
 	"time"
 
 	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/database"
 	"github.com/ejbrever/trader/one/purchase"
 	"github.com/shopspring/decimal"
 )
@@ -20,14 +19,32 @@ import (
 var (
 	backtestFile                  = flag.String("backtest_file", "", "The filename with ticker data to use for backtesting.")
 	backtestFileTimeBetweenAction = flag.Duration("backtest_file_duration_between_action", 60*time.Second, "The time granularity in the backtest file.")
-	backtestStartTime             = flag.String("backtest_starttime", "", "The start time of the backtest in EST (format: 2006-01-02 15:04:00).")
+	backtestStartTime             = flag.String("backtest_starttime", "", "The start time of the backtest in EST (format: 2006-01-02 15:04:00). A start time during the session begins the simulation mid-session, with the bars from earlier in the day available to the strategy.")
 	backtestStartingCash          = flag.Float64("backtest_starting_cash", 100000, "The cash on hand when the backtest starts.")
 	backtestPrintDayDetails       = flag.Bool("backtest_print_day_details", false, "When true, print the details for each day.")
 	runBacktest                   = flag.Bool("run_backtest", false, "Run a backtest simulation.")
+	backtestBidColumn             = flag.Int("backtest_bid_column", -1, "The zero based column of the bid price in the backtest file. When both bid and ask columns are set, market orders fill at the ask (buys) and bid (sells) instead of the bar high and low.")
+	backtestAskColumn             = flag.Int("backtest_ask_column", -1, "The zero based column of the ask price in the backtest file.")
+	backtestMarginInterestRate    = flag.Float64("backtest_margin_interest_rate", 0, "The annual interest rate percentage charged on a negative cash balance held overnight. Each night is charged 1/360 of the rate, as brokers do.")
+	backtestCashInterestRate      = flag.Float64("backtest_cash_interest_rate", 0, "The annual interest rate percentage earned on a positive cash balance held overnight, as a broker's cash sweep pays, so a strategy which is mostly in cash is compared fairly with buying and holding.")
+	backtestShortBorrowFeeRate    = flag.Float64("backtest_short_borrow_fee_rate", 0, "The annual fee percentage charged on the value of short positions held overnight. Each night is charged 1/360 of the rate, as brokers do.")
+	backtestLimitTouchFill        = flag.Float64("backtest_limit_touch_fill_probability", 1, "The probability that a limit buy order fills when the price only touches its limit, rather than trading through it. Orders ahead in the queue at the same price may take the fills.")
+	backtestLimitFillDecay        = flag.Float64("backtest_limit_fill_decay", 1, "The factor by which backtest_limit_touch_fill_probability is multiplied for each minute a limit buy order rests, since a resting order is increasingly left behind by the market. Repricing an order resets it.")
 )
 
 const (
-	// historyReferenceTime is a string of the datetime layout in the historical files.
+	// daysPerYearForInterest is the day count convention used by brokers when
+	// charging margin interest and borrow fees. US brokers, Alpaca included,
+	// divide the annual rate by 360 rather than 365, so a year of nights costs
+	// slightly more than the annual rate.
+	daysPerYearForInterest = 360
+	// daysPerYearForCashInterest is the day count convention of the interest
+	// paid on swept cash.
+	daysPerYearForCashInterest = 365
+)
+
+const (
+	// referenceTime is a string of the datetime layout of backtest_starttime.
 	referenceTime = "2006-01-02 15:04:05"
 
 	// filled is the order of the status filled.
@@ -43,84 +60,209 @@ type fakeStockPrice struct {
 }
 
 // newFake creates is a new() func for backtesting.
-func newFake() (*client, error) {
-	h, err := historicalData()
+func newFake(h *history, cfg ClientConfig) (*client, error) {
+	start, err := backtestStart()
 	if err != nil {
-		return nil, fmt.Errorf("unable to read history: %v", err)
+		return nil, err
 	}
+	return newFakeAt(h, cfg, start)
+}
 
-	t, err := newFakeClock(*durationBetweenAction)
+// newFakeAt creates a backtesting client whose clock starts at start.
+func newFakeAt(h *history, cfg ClientConfig, start time.Time) (*client, error) {
+	interval := cfg.DurationBetweenAction
+	if cfg.BacktestEvaluationInterval > 0 {
+		interval = cfg.BacktestEvaluationInterval
+	}
+	t, err := newFakeClockAt(start, interval)
 	if err != nil {
 		return nil, err
 	}
 
-	c, err := new(*stockSymbol, *maxConcurrentPurchases)
+	c, err := new(cfg.StockSymbol, cfg.StrategyName, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("unable to start backtesting trader-one: %v", err)
 	}
+	c.breaker = newDrawdownBreaker(c.cfg)
+	c.backtestLatencyRand = rand.New(rand.NewSource(cfg.BacktestSeed))
+	if db, ok := c.dbClient.(*database.FakeClient); ok {
+		// Rows are timestamped with the simulated time.
+		db.SetNow(func() time.Time { return t.Now })
+	}
 
 	c.backtestHistory = h
 	c.backtestClock = t
-	c.backtestCashStart = decimal.NewFromFloat(*backtestStartingCash)
-	c.backtestCashStartOfDay = decimal.NewFromFloat(*backtestStartingCash)
-	c.backtestCash = decimal.NewFromFloat(*backtestStartingCash)
+	c.lastSignal = t.Now
+	c.backtestCashStart = decimal.NewFromFloat(cfg.BacktestStartingCash)
+	c.backtestCashStartOfDay = decimal.NewFromFloat(cfg.BacktestStartingCash)
+	c.backtestCash = decimal.NewFromFloat(cfg.BacktestStartingCash)
 	c.backtestStockHeldQty = decimal.NewFromFloat(0)
+	c.backtestStopAt = backtestStopTime
 
 	return c, nil
 }
 
-func backtest() {
-	// Seed rand.
-	rand.Seed(time.Now().UnixNano())
+func backtest(cfg ClientConfig) {
+	seed := *backtestSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rand.Seed(seed)
+	cfg.BacktestSeed = seed
 
-	c, err := newFake()
+	h, err := historicalData()
+	if err != nil {
+		log.Printf("unable to read history: %v", err)
+		return
+	}
+
+	if *backtestRestartAt != "" {
+		restarts, err := parseRestartTimes(*backtestRestartAt)
+		if err != nil {
+			log.Printf("invalid backtest_restart_at: %v", err)
+			return
+		}
+		fmt.Printf("build: %v\n", currentBuildInfo())
+		fmt.Printf("seed: %v\n", seed)
+		if err := restartCheck(h, cfg, seed, restarts); err != nil {
+			log.Printf("unable to run restart check: %v", err)
+		}
+		return
+	}
+
+	if *backtestWalkForwardInSampleDays > 0 {
+		if err := walkForward(h, cfg); err != nil {
+			log.Printf("unable to run walk-forward analysis: %v", err)
+		}
+		return
+	}
+
+	if *backtestSweepMinSlopes != "" || *backtestSweepNumHistoricalBars != "" {
+		if err := sweep(h, cfg); err != nil {
+			log.Printf("unable to run sweep: %v", err)
+		}
+		return
+	}
+
+	c, err := newFake(h, cfg)
 	if err != nil {
 		log.Printf(err.Error())
 		return
 	}
 	log.Printf("backtest is beginning!")
 
+	fmt.Printf("build: %v\n", currentBuildInfo())
+	fmt.Printf("seed: %v\n", seed)
 	fmt.Printf("starting cash: %v\n", c.backtestCash.StringFixed(2))
-	trading = false
-	for c.backtestHistory.endTime.After(c.backtestClock.Now) || c.backtestHistory.endTime.Equal(c.backtestClock.Now) {
-		c.backtestClock.updateFakeClock()
-		timeUntilMarketClose := c.backtestClock.TodaysCloseTime.Sub(c.backtestClock.Now)
-		switch {
-		case timeUntilMarketClose > 0*time.Second && timeUntilMarketClose < *timeBeforeMarketCloseToSell:
-			// log.Printf("market is closing soon")
-			c.updateOrders()
-			if trading {
-				c.backtestSymbolEndOfDay = c.fakeCurrentPrice().Close
-				trading = false
-			}
-			c.closeOutTrading()
-			c.backtestClock.Now = c.backtestClock.Now.Add(*timeBeforeMarketCloseToSell)
-			continue
-		case !c.backtestClock.IsOpen:
-			// log.Printf("market is not open :(")
-			continue
-		default:
-			if !trading {
-				c.backtestSymbolStartOfDay = c.fakeCurrentPrice().Close
-				trading = true
-			}
-			c.updateOrders()
-			// log.Printf("market is open!")
-			c.run(c.backtestClock.Now)
+	c.simulate()
+	printBacktestSummary(c)
+	if cfg.BacktestOutputJSON != "" {
+		if err := writeBacktestJSON(c, seed); err != nil {
+			log.Printf("unable to write backtest result: %v", err)
 		}
 	}
+}
 
-	profitLoss := profitLossPercent(c.backtestCashStart, c.backtestCash)
-	symbolProfitLoss := profitLossPercent(c.backtestHistory.symbolStartPrice, c.backtestHistory.symbolEndPrice)
+// printBacktestSummary prints the outcome of the backtest.
+func printBacktestSummary(c *client) {
+	equity := c.backtestEquity()
+	profitLoss := profitLossPercent(c.backtestCashStart, equity)
+	symbolProfitLoss := profitLossPercent(c.backtestHistory.symbolStartPrice, c.backtestEndPrice())
+	fmt.Printf("Terminated: %v\n", c.backtestTermination())
 	fmt.Printf("Ending Cash: %v\n", c.backtestCash.StringFixed(2))
 	fmt.Printf("Ending Held Shares: %v\n", c.backtestStockHeldQty.String())
+	fmt.Printf("Ending Equity: %v\n", equity.StringFixed(2))
+	fmt.Printf("Trades: %v\n", c.backtestTrades)
+	fmt.Printf("Unprotected Purchase Minutes: %v\n", c.backtestUnprotected)
+	if c.backtestMaxVolumeShare.IsPositive() {
+		fmt.Printf("Largest Buy Of Average Bar Volume: %v%%\n", c.backtestMaxVolumeShare.StringFixed(3))
+		if c.cfg.MaxVolumePercent > 0 && c.backtestMaxVolumeShare.GreaterThan(decimal.NewFromFloat(c.cfg.MaxVolumePercent)) {
+			fmt.Printf("WARNING: a buy was larger than max_volume_percent of %v%%\n", c.cfg.MaxVolumePercent)
+		}
+	}
+	fmt.Printf("Slippage Paid: %v\n", c.backtestSlippage.StringFixed(2))
+	fmt.Printf("Commissions Paid: %v\n", c.backtestCommissions.StringFixed(2))
+	fmt.Printf("Margin Interest Paid: %v\n", c.backtestMarginInterest.StringFixed(2))
+	fmt.Printf("Cash Interest Earned: %v\n", c.backtestCashInterest.StringFixed(2))
+	fmt.Printf("Short Borrow Fees Paid: %v\n", c.backtestShortBorrowFees.StringFixed(2))
 	fmt.Printf("Profit/Loss: %v%%\n", profitLoss.StringFixed(3))
 	fmt.Printf("Symbol Profit/Loss: %v%%\n", symbolProfitLoss.StringFixed(3))
 	fmt.Printf("Algo Benefit: %v%%\n", profitLoss.Sub(symbolProfitLoss).StringFixed(3))
+	benchmarkProfitLoss := c.benchmarkProfitLoss()
+	fmt.Printf("Benchmark (%v) Profit/Loss: %v%%\n", c.benchmarkName(), benchmarkProfitLoss.StringFixed(3))
+	fmt.Printf("Excess Return: %v%%\n", profitLoss.Sub(benchmarkProfitLoss).StringFixed(3))
+	fmt.Printf("Benchmark Stats: %v\n", newBenchmarkStats(c.backtestDayReturns))
+	if c.cfg.RecordBlockedSignals {
+		blocked, err := blockedSignalsSummary(c.dbClient, time.Time{}, c.backtestClock.Now.Add(time.Minute))
+		if err != nil {
+			log.Printf("unable to summarize blocked signals: %v", err)
+		}
+		fmt.Printf("Blocked Signals: %v\n", blocked)
+	}
+	fmt.Printf("Max Adverse Excursion: %v\n", excursionSummary(append(c.backtestSold, c.purchases...)))
+}
+
+// backtestEquity returns the cash plus the value of the shares still held,
+// e.g. when holding overnight, at the last price of the backtest.
+func (c *client) backtestEquity() decimal.Decimal {
+	return c.backtestCash.Add(c.backtestStockHeldQty.Mul(c.backtestEndPrice()))
+}
+
+// simulate runs the client over the full backtest history.
+func (c *client) simulate() {
+	for c.step() {
+	}
+}
+
+// step advances the backtest by one tick. It returns false once the end of
+// the history is reached.
+func (c *client) step() bool {
+	if c.backtestClock.Now.After(c.backtestHistory.endTime) || c.backtestStopDue() {
+		return false
+	}
+	c.backtestClock.updateFakeClock()
+	timeUntilMarketClose := c.backtestClock.TodaysCloseTime.Sub(c.backtestClock.Now)
+	switch {
+	case timeUntilMarketClose > 0*time.Second && timeUntilMarketClose < c.cfg.TimeBeforeMarketCloseToSell:
+		// log.Printf("market is closing soon")
+		c.recordLowestPrice(c.fakeCurrentPrice().Low)
+		c.updateOrders()
+		if c.backtestTrading {
+			c.backtestSymbolEndOfDay = c.fakeCurrentPrice().Close
+			c.backtestTrading = false
+		}
+		c.closeOutTrading()
+		c.recordEquity()
+		c.checkBacktestStop()
+		c.backtestClock.Now = c.backtestClock.Now.Add(c.cfg.TimeBeforeMarketCloseToSell)
+	case !c.backtestClock.IsOpen:
+		// log.Printf("market is not open :(")
+	default:
+		c.maybeFakeRestart()
+		if !c.backtestTrading {
+			c.backtestSymbolStartOfDay = c.fakeCurrentPrice().Close
+			c.startBenchmarkDay()
+			c.chargeOvernightFees()
+			c.backtestTrading = true
+		}
+		c.recordLowestPrice(c.fakeCurrentPrice().Low)
+		c.updateOrders()
+		if c.breaker.enabled() {
+			equity := c.backtestCash.Add(c.backtestStockHeldQty.Mul(c.fakeCurrentPrice().Close))
+			checkDrawdown(c.breaker, []*client{c}, c.backtestClock.Now, equity)
+		}
+		// log.Printf("market is open!")
+		c.run(c.backtestClock.Now)
+		c.backtestUnprotected += len(c.boughtNotSelling())
+		c.recordEquity()
+		c.checkBacktestStop()
+	}
+	return true
 }
 
 func (c *client) endOfDayReport() {
-	if !*backtestPrintDayDetails {
+	c.recordDayReturn()
+	if !c.cfg.BacktestPrintDayDetails {
 		return
 	}
 	profitLoss := profitLossPercent(c.backtestCashStartOfDay, c.backtestCash)
@@ -130,11 +272,20 @@ func (c *client) endOfDayReport() {
 	fmt.Printf("Profit/Loss - Day: %v%%\n", profitLoss.StringFixed(3))
 	fmt.Printf("Symbol Profit/Loss - Day: %v%%\n", symbolProfitLoss.StringFixed(3))
 	fmt.Printf("Algo Benefit - Day: %v%%\n", profitLoss.Sub(symbolProfitLoss).StringFixed(3))
+	if n := len(c.backtestDayReturns); n > 0 {
+		fmt.Printf("Benchmark Profit/Loss - Day: %v%%\n", decimal.NewFromFloat(c.backtestDayReturns[n-1].benchmark).StringFixed(3))
+	}
+	fmt.Printf("Cumulative Excess Return: %v%%\n", profitLossPercent(c.backtestCashStart, c.backtestEquityClose).Sub(c.benchmarkProfitLoss()).StringFixed(3))
 	fmt.Printf("Cash: %v\n\n", c.backtestCash.StringFixed(2))
 }
 
 // fakeCurrentPrice gets the historical ticker data for the current fake time.
 func (c *client) fakeCurrentPrice() *historicalTickerData {
+	if c.cfg.BacktestFormingBars {
+		if h, ok := c.backtestHistory.runningMinute(c.backtestClock.Now); ok {
+			return h
+		}
+	}
 	t := timeToMinuteStart(c.backtestClock.Now)
 	h, ok := c.backtestHistory.epochToTickerData[t.Unix()]
 	if !ok {
@@ -156,6 +307,10 @@ type history struct {
 
 	// symbolEndPrice is the price of the symbol at the end of the backtest.
 	symbolEndPrice decimal.Decimal
+
+	// benchmark is the prices of backtest_benchmark_file, or nil when the
+	// symbol is the benchmark.
+	benchmark *benchmarkPrices
 }
 
 func newHistory() *history {
@@ -164,40 +319,127 @@ func newHistory() *history {
 	}
 }
 
+// bar aggregates the minutes in [start, start+d) into a bar. It returns false
+// if none of the minutes are in the history.
+func (h *history) bar(start time.Time, d time.Duration) (alpaca.Bar, bool) {
+	var minutes []*historicalTickerData
+	for t := start; t.Before(start.Add(d)); t = t.Add(time.Minute) {
+		if m, ok := h.epochToTickerData[t.Unix()]; ok {
+			minutes = append(minutes, m)
+		}
+	}
+	return aggregateBar(start, minutes)
+}
+
+// aggregateBar aggregates the minutes into a bar starting at start. The
+// history has no opens, so the first close is used as the open. It returns
+// false if there are no minutes.
+func aggregateBar(start time.Time, minutes []*historicalTickerData) (alpaca.Bar, bool) {
+	var high, low, close, volume decimal.Decimal
+	b := alpaca.Bar{Time: start.Unix()}
+	found := false
+	for _, m := range minutes {
+		if !found {
+			open, _ := m.Close.Float64()
+			b.Open = float32(open)
+			high, low = m.High, m.Low
+			found = true
+		}
+		high = decimal.Max(high, m.High)
+		low = decimal.Min(low, m.Low)
+		close = m.Close
+		volume = volume.Add(m.Volume)
+	}
+	if !found {
+		return alpaca.Bar{}, false
+	}
+	f, _ := high.Float64()
+	b.High = float32(f)
+	f, _ = low.Float64()
+	b.Low = float32(f)
+	f, _ = close.Float64()
+	b.Close = float32(f)
+	b.Volume = int32(volume.IntPart())
+	return b, true
+}
+
 type historicalTickerData struct {
 	High  decimal.Decimal
 	Low   decimal.Decimal
 	Close decimal.Decimal
+
+	// Volume, Bid and Ask are only set when the backtest file has them.
+	Volume decimal.Decimal
+	Bid    decimal.Decimal
+	Ask    decimal.Decimal
+
+	// Halted is true when trading is halted. Orders are rejected and resting
+	// orders are not filled.
+	Halted bool
+}
+
+// hasQuote returns true if the bid and ask are known.
+func (h *historicalTickerData) hasQuote() bool {
+	return !h.Bid.IsZero() && !h.Ask.IsZero()
+}
+
+// marketBuyPrice returns the price a market buy fills at. This is the ask
+// when known, otherwise the bar high is used to be conservative.
+func (h *historicalTickerData) marketBuyPrice() decimal.Decimal {
+	if h.hasQuote() {
+		return h.Ask
+	}
+	return h.High
+}
+
+// marketSellPrice returns the price a market sell fills at. This is the bid
+// when known, otherwise the bar low is used to be conservative.
+func (h *historicalTickerData) marketSellPrice() decimal.Decimal {
+	if h.hasQuote() {
+		return h.Bid
+	}
+	return h.Low
+}
+
+// sellTriggerPrice returns the price which sell limits and stops are
+// compared against.
+func (h *historicalTickerData) sellTriggerPrice() decimal.Decimal {
+	if h.hasQuote() {
+		return h.Bid
+	}
+	return h.Close
 }
 
 func historicalData() (*history, error) {
 	log.Printf("starting to read historical data")
-	f, err := os.Open(*backtestFile)
+	records, err := readBacktestFile(*backtestFile)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read backtest file: %v", err)
+		return nil, fmt.Errorf("unable to parse %q: %v", *backtestFile, err)
 	}
-	defer f.Close()
 
-	records, err := csv.NewReader(f).ReadAll()
+	start, err := backtestStart()
 	if err != nil {
 		return nil, err
 	}
-
+	// The history is read from the start of the day, so a backtest which
+	// starts mid-session has the bars from earlier in the day.
 	h := newHistory()
-	c, err := newFakeClock(*backtestFileTimeBetweenAction)
+	c, err := newFakeClockAt(time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, EST), *backtestFileTimeBetweenAction)
 	if err != nil {
 		return nil, err
 	}
 
+	// Once the clock passes the final record, the remaining records are all
+	// outside of the trading session.
+	lastRecordTime := records[len(records)-1].time
+
 	i := 0
-	infiniteLoopProtection := 0
+	halts := &haltDetector{}
 	var lastValidTime time.Time
 	var lastValidTimeStamp int64
-	var t time.Time
 	for i < len(records) {
-		infiniteLoopProtection++
-		if infiniteLoopProtection > 117000 { // 390 mins/day * 300 days per year
-			return nil, errors.New("infinite loop protection")
+		if c.Now.After(lastRecordTime) {
+			break
 		}
 		c.updateFakeClock()
 		if !c.IsOpen {
@@ -205,44 +447,25 @@ func historicalData() (*history, error) {
 		}
 		for j := i; j < len(records); j++ {
 			r := records[j]
-
-			// Historical data files are in EST timezone.
-			t, err = time.ParseInLocation(referenceTime, r[0], EST)
-			if err != nil {
-				return nil, fmt.Errorf("unable to read in time %q: %v", r[0], err)
-			}
+			t := r.time
 			if c.Now.After(t) {
 				i++
 				continue
 			}
 			if c.Now.Before(t) {
+				// The bar is missing, so the last bar is used until the clock
+				// reaches the next record.
 				h.epochToTickerData[c.Now.Unix()] = h.epochToTickerData[lastValidTimeStamp]
-				i++
+				halts.missing = append(halts.missing, c.Now.Unix())
 				break
 			}
 
-			// need to filter to only market open times.
-			high, err := decimal.NewFromString(r[2])
-			if err != nil {
-				return nil, fmt.Errorf("unable to convert %q to float: %v", r[2], err)
-			}
-			low, err := decimal.NewFromString(r[3])
-			if err != nil {
-				return nil, fmt.Errorf("unable to convert %q to float: %v", r[3], err)
-			}
-			close, err := decimal.NewFromString(r[4])
-			if err != nil {
-				return nil, fmt.Errorf("unable to convert %q to float: %v", r[4], err)
-			}
-			h.epochToTickerData[t.Unix()] = &historicalTickerData{
-				High:  high,
-				Low:   low,
-				Close: close,
+			halts.bar(h, lastValidTime, t, r.data)
+			h.epochToTickerData[t.Unix()] = r.data
+			if h.symbolStartPrice.IsZero() && !t.Before(start) {
+				h.symbolStartPrice = r.data.Close
 			}
-			if h.symbolStartPrice.IsZero() {
-				h.symbolStartPrice = close
-			}
-			h.symbolEndPrice = close
+			h.symbolEndPrice = r.data.Close
 			lastValidTime = t
 			lastValidTimeStamp = t.Unix()
 			i++
@@ -250,73 +473,43 @@ func historicalData() (*history, error) {
 		}
 	}
 	h.endTime = lastValidTime
+	if h.benchmark, err = loadBenchmark(); err != nil {
+		return nil, err
+	}
 	log.Printf("h.endTime: %v", h.endTime)
 	log.Printf("finished reading historical data, had %v rows", len(h.epochToTickerData))
 	return h, nil
 }
 
 // randomFillOrder returns true or false randomly to inidicate if an order
-// should be filled.
+// should be filled, in the random backtest_fill_mode.
 // This should return true 75% of the time.
 func randomFillOrder() bool {
 	return rand.Intn(99) >= 24
 }
 
-type fakeClock struct {
-	Now               time.Time
-	TodaysOpenTime    time.Time
-	TodaysCloseTime   time.Time
-	IsOpen            bool
-	TimeBetweenAction time.Duration
-}
-
-func newFakeClock(timeBetweenAction time.Duration) (*fakeClock, error) {
-	t, err := time.ParseInLocation(referenceTime, *backtestStartTime, EST)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read in start time %q: %v", *backtestStartTime, err)
-	}
-
-	return &fakeClock{
-		Now:               t.Add(-1 * timeBetweenAction), // Subtract one iteration to counteract first increase.
-		TimeBetweenAction: timeBetweenAction,
-		TodaysOpenTime:    time.Date(t.Year(), t.Month(), t.Day(), 9, 30, 0, 0, EST),
-		TodaysCloseTime:   time.Date(t.Year(), t.Month(), t.Day(), 16, 0, 0, 0, EST),
-	}, nil
-}
-
-// updateFakeClock increments the current time, determines if the market is
-// open, and updates the days open market hours if needed.
-// TODO(ejbrever) Account for days where market closes early.
-func (c *fakeClock) updateFakeClock() {
-	c.Now = c.Now.Add(c.TimeBetweenAction)
-
-	switch {
-	case c.Now.Weekday() == 0: // Sunday.
-	case c.Now.Weekday() == 6: // Saturday.
-	case c.Now.Before(c.TodaysOpenTime) || c.Now.After(c.TodaysCloseTime):
-		c.IsOpen = false
-		if c.Now.Hour() == 9 && c.Now.Minute() == 29 && c.Now.Second() == 0 {
-			c.TodaysOpenTime = time.Date(c.Now.Year(), c.Now.Month(), c.Now.Day(), 9, 30, 0, 0, EST)
-			c.TodaysCloseTime = time.Date(c.Now.Year(), c.Now.Month(), c.Now.Day(), 16, 0, 0, 0, EST)
-		}
-	default:
-		c.IsOpen = true
-	}
-}
-
-// fakeOrder is a func which is used for mocking the order() func during backtesting.
+// fakeOrder is a func which is used for mocking the order() func during
+// backtesting. A new order is given a chance to fill first, once it has
+// reached the broker.
 func (c *client) fakeOrder(id string) *alpaca.Order {
 	var o *alpaca.Order
 	var foundPurchase *purchase.Purchase
+	var twapChild bool
 	for _, p := range c.purchases {
-		if p.BuyOrder.ID == id {
-			foundPurchase = p
+		switch {
+		case p.BuyOrder.ID == id:
 			o = p.BuyOrder
-			break
+		case p.SellOrder != nil && p.SellOrder.ID == id:
+			o = p.SellOrder
+		case isTWAP(p.BuyOrder):
+			o = childOrder(p.BuyOrder, id)
+			twapChild = o != nil
+		}
+		if o == nil && isSyntheticOCO(p.SellOrder) {
+			o = childOrder(p.SellOrder, id)
 		}
-		if p.SellOrder != nil && p.SellOrder.ID == id {
+		if o != nil {
 			foundPurchase = p
-			o = p.SellOrder
 			break
 		}
 	}
@@ -325,7 +518,16 @@ func (c *client) fakeOrder(id string) *alpaca.Order {
 		panic(fmt.Sprintf("fakeOrder, could not find ID %v", id))
 	}
 
-	if o.Status != "new" {
+	if o.Status == "pending_cancel" {
+		if c.backtestClock.Now.After(o.UpdatedAt) {
+			c.fakeFinishCancel(o)
+			if o.Side == alpaca.Buy && o.Status == filled && !twapChild {
+				c.backtestTrades++
+			}
+		}
+		return o
+	}
+	if !fakeWorking(o) || c.backtestClock.Now.Before(o.SubmittedAt) {
 		return o
 	}
 
@@ -337,100 +539,354 @@ func (c *client) fakeOrder(id string) *alpaca.Order {
 		}
 	case o.Side == alpaca.Buy:
 		c.fakeBuyAttempt(o)
+		// TWAP buys are counted by updateTWAP.
+		if o.Status == filled && !twapChild {
+			c.backtestTrades++
+		}
 	default:
 		panic(fmt.Sprintf("cannot have an order that is not a buy or sell: %+v", o))
 	}
+	// The order is returned like the broker would, so fills are written to
+	// the database and survive a simulated restart.
+	return o
+}
+
+// childOrder returns the leg of the order with the ID, or nil if there is
+// none.
+func childOrder(o *alpaca.Order, id string) *alpaca.Order {
+	for i := range *o.Legs {
+		if child := &(*o.Legs)[i]; child.ID == id {
+			return child
+		}
+	}
 	return nil
 }
 
-// fakeSellAttempt attempts to fill a sell order.
+// fakeSellAttempt attempts to fill a sell order. A trailing stop follows the
+// price whether or not it fills.
 func (c *client) fakeSellAttempt(o *alpaca.Order) {
-	if !randomFillOrder() {
+	raiseTrailingStop(o, c.fakeCurrentPrice().sellTriggerPrice())
+	if c.fakeHalted() || !c.fakeFillChance() {
+		return
+	}
+	if c.cfg.BacktestFillMode == fillModePrice {
+		c.fakePriceSellAttempt(o)
 		return
 	}
 
 	p := c.fakeCurrentPrice()
+	if o.Legs == nil {
+		// The stop and take profit orders of an emulated sell.
+		c.fakeSingleSellAttempt(o, p)
+		return
+	}
 	legs := *o.Legs
+	trigger := p.sellTriggerPrice()
+	fillPrice := p.marketSellPrice()
+	qty := c.fakeFillableQty(o)
+	if !qty.IsPositive() {
+		return
+	}
 	switch {
-	case p.Close.GreaterThanOrEqual(*o.LimitPrice):
-		o.Status = filled
-		o.FilledQty = o.Qty
-		o.FilledAvgPrice = &c.fakeCurrentPrice().Low
-
-		c.backtestCash = c.backtestCash.Add(o.FilledAvgPrice.Mul(o.Qty))
-		c.backtestStockHeldQty = c.backtestStockHeldQty.Sub(o.Qty)
-	case p.Close.LessThanOrEqual(*legs[0].LimitPrice):
+	case trigger.GreaterThanOrEqual(*o.LimitPrice):
+		c.fakeFill(o, qty, fillPrice)
+	case trigger.LessThanOrEqual(*legs[0].LimitPrice):
 		// No need to do anything as the limit price was surpassed.
-	case p.Close.LessThanOrEqual(*legs[0].StopPrice):
-		o.Status = filled
-		o.FilledQty = o.Qty
-		o.FilledAvgPrice = &c.fakeCurrentPrice().Low
+	case trigger.LessThanOrEqual(*legs[0].StopPrice):
+		c.fakeMarketFill(o, qty, fillPrice)
+		// Mark the stop leg so the exit is reported as a stop.
+		if o.Status == filled {
+			legs[0].Status = filled
+		}
+		legs[0].FilledQty = legs[0].FilledQty.Add(qty)
+		legs[0].FilledAvgPrice = o.FilledAvgPrice
+	}
+}
 
-		c.backtestCash = c.backtestCash.Add(o.FilledAvgPrice.Mul(o.Qty))
-		c.backtestStockHeldQty = c.backtestStockHeldQty.Sub(o.Qty)
+// fakeSingleSellAttempt attempts to fill a market, limit, stop or trailing
+// stop sell order which is not part of an OCO order. Stops fill at market once
+// the price trades at or below them.
+func (c *client) fakeSingleSellAttempt(o *alpaca.Order, p *historicalTickerData) {
+	switch o.Type {
+	case alpaca.Limit:
+		if p.sellTriggerPrice().LessThan(*o.LimitPrice) {
+			return
+		}
+	case alpaca.Stop, alpaca.TrailingStop:
+		if p.sellTriggerPrice().GreaterThan(*o.StopPrice) {
+			return
+		}
+	}
+	qty := c.fakeFillableQty(o)
+	switch {
+	case !qty.IsPositive():
+	case o.Type == alpaca.Limit:
+		c.fakeFill(o, qty, p.marketSellPrice())
+	default:
+		c.fakeMarketFill(o, qty, p.marketSellPrice())
 	}
 }
 
 // fakeBuyAttempt attempts to fill a buy order.
 func (c *client) fakeBuyAttempt(o *alpaca.Order) {
-	if !randomFillOrder() {
+	if c.fakeHalted() || !c.fakeFillChance() {
 		return
 	}
 
-	o.Status = filled
-	o.FilledQty = o.Qty
-	o.FilledAvgPrice = &c.fakeCurrentPrice().High
+	p := c.fakeCurrentPrice()
+	fillPrice := p.marketBuyPrice()
+	if o.Type == alpaca.Limit {
+		lowest := p.Low
+		if p.hasQuote() {
+			lowest = p.Ask
+		}
+		if lowest.GreaterThan(*o.LimitPrice) {
+			// The price never dropped to the limit.
+			return
+		}
+		if lowest.Equal(*o.LimitPrice) && !c.fakeTouchFill(o) {
+			return
+		}
+		if o.LimitPrice.LessThan(fillPrice) {
+			fillPrice = *o.LimitPrice
+		}
+	}
+	qty := c.fakeFillableQty(o)
+	switch {
+	case !qty.IsPositive():
+	case o.Type == alpaca.Limit:
+		c.fakeFill(o, qty, fillPrice)
+	default:
+		c.fakeMarketFill(o, qty, fillPrice)
+	}
+}
 
-	c.backtestCash = c.backtestCash.Sub(o.FilledAvgPrice.Mul(o.Qty))
-	c.backtestStockHeldQty = c.backtestStockHeldQty.Add(o.Qty)
+// fakeTouchFill returns true if a limit buy order fills when the price only
+// touches its limit. The chance of a fill decays the longer the order rests.
+func (c *client) fakeTouchFill(o *alpaca.Order) bool {
+	minutes := c.backtestClock.Now.Sub(o.CreatedAt).Minutes()
+	probability := c.cfg.BacktestLimitTouchFill * math.Pow(c.cfg.BacktestLimitFillDecay, minutes)
+	// A certain fill draws no number, so it leaves the draws of the rest of
+	// the backtest as they were before touch fills.
+	if probability >= 1 {
+		return true
+	}
+	return rand.Float64() < probability
+}
+
+// fakeCancelOrder cancels an unfilled order, or the unfilled part of a
+// partially filled one. With broker latency the order is pending cancel until
+// the cancel reaches the broker, and it may fill first in fakeFinishCancel.
+func (c *client) fakeCancelOrder(o *alpaca.Order) {
+	arrival := c.fakeArrival()
+	if !fakeWorking(o) {
+		return
+	}
+	now := c.backtestClock.Now
+	if arrival.After(now) {
+		o.Status = "pending_cancel"
+		o.UpdatedAt = arrival
+		return
+	}
+	o.Status = "canceled"
+	o.CanceledAt = &now
 }
 
-func (c *client) fakePlaceBuyOrder(req *alpaca.PlaceOrderRequest) {
+func (c *client) fakePlaceBuyOrder(req *alpaca.PlaceOrderRequest, takeProfit *decimal.Decimal) *purchase.Purchase {
+	p := &purchase.Purchase{
+		BuyOrder:          c.fakeBuyOrder(req),
+		Strategy:          c.strategy,
+		TakeProfitPercent: takeProfit,
+	}
+	c.purchases = append(c.purchases, p)
+
+	if err := c.dbClient.Insert(p); err != nil {
+		log.Printf("unable to insert buy order in database: %v", err)
+	}
+	return p
+}
+
+// fakeBuyOrder places a buy order with the simulated broker.
+func (c *client) fakeBuyOrder(req *alpaca.PlaceOrderRequest) *alpaca.Order {
 	c.backtestOrderID++
-	c.purchases = append(c.purchases, &purchase.Purchase{
-		BuyOrder: &alpaca.Order{
-			CreatedAt: c.backtestClock.Now,
-			ID:        fmt.Sprint(c.backtestOrderID),
-			Status:    "new",
-			Qty:       decimal.NewFromFloat(*purchaseQty),
-			Side:      alpaca.Buy,
-			Type:      alpaca.Market,
-		},
-	})
+	o := &alpaca.Order{
+		CreatedAt:     c.backtestClock.Now,
+		SubmittedAt:   c.fakeArrival(),
+		ID:            fmt.Sprint(c.backtestOrderID),
+		ClientOrderID: req.ClientOrderID,
+		Symbol:        c.stockSymbol,
+		Status:        "new",
+		Qty:           req.Qty,
+		Side:          alpaca.Buy,
+		Type:          req.Type,
+		LimitPrice:    req.LimitPrice,
+	}
+	if req.OrderClass == alpaca.Bracket {
+		o.Legs = simulatedBracketLegs(req, o.ID)
+		if err := checkTicks(req.TakeProfit.LimitPrice, req.StopLoss.StopPrice, req.StopLoss.LimitPrice); err != nil {
+			log.Printf("buy order %v rejected: %v", o.ID, err)
+			o.Status = "rejected"
+			o.FailedAt = &o.CreatedAt
+		}
+	}
+	if c.fakeHalted() {
+		log.Printf("buy order %v rejected, trading is halted @ %v", o.ID, c.backtestClock.Now)
+		o.Status = "rejected"
+		o.FailedAt = &o.CreatedAt
+	}
+	if err := checkTicks(req.LimitPrice); err != nil {
+		log.Printf("buy order %v rejected: %v", o.ID, err)
+		o.Status = "rejected"
+		o.FailedAt = &o.CreatedAt
+	}
+	return o
 }
 
 func (c *client) fakePlaceSellOrder(p *purchase.Purchase, req *alpaca.PlaceOrderRequest) {
+	arrival := c.fakeArrival()
+	if c.fakeHalted() {
+		// The sell order is placed again once trading resumes.
+		log.Printf("sell order rejected, trading is halted @ %v", c.backtestClock.Now)
+		return
+	}
+	if err := checkTicks(req.TakeProfit.LimitPrice, req.StopLoss.StopPrice, req.StopLoss.LimitPrice); err != nil {
+		log.Printf("sell order rejected: %v", err)
+		return
+	}
 	c.backtestOrderID++
 	p.SellOrder = &alpaca.Order{
-		ID:         fmt.Sprint(c.backtestOrderID),
-		Status:     "new",
-		LimitPrice: req.TakeProfit.LimitPrice,
-		Qty:        decimal.NewFromFloat(*purchaseQty),
-		Side:       alpaca.Sell,
+		ID:          fmt.Sprint(c.backtestOrderID),
+		Symbol:      c.stockSymbol,
+		Status:      "new",
+		SubmittedAt: arrival,
+		LimitPrice:  req.TakeProfit.LimitPrice,
+		Qty:         req.Qty,
+		Side:        alpaca.Sell,
 		Legs: &[]alpaca.Order{{
 			StopPrice:  req.StopLoss.StopPrice,
 			LimitPrice: req.StopLoss.LimitPrice,
 		}},
 	}
+
+	if err := c.dbClient.Update(p); err != nil {
+		log.Printf("unable to update for sell order:%v\n%+v", err, p)
+	}
+}
+
+// fakeMarketSell fills a market sell order at the price of the minute in which
+// it reaches the broker. It returns an error if trading is halted.
+func (c *client) fakeMarketSell(req *alpaca.PlaceOrderRequest) (*alpaca.Order, error) {
+	arrival := c.fakeArrival()
+	if c.fakeHalted() {
+		return nil, fmt.Errorf("market sell rejected, trading is halted @ %v", c.backtestClock.Now)
+	}
+	c.backtestOrderID++
+	bar := c.fakeCurrentPrice()
+	if h, ok := c.backtestHistory.epochToTickerData[timeToMinuteStart(arrival).Unix()]; ok {
+		bar = h
+	}
+	price := bar.marketSellPrice()
+	fillPrice := c.fakeSlip(price, alpaca.Sell)
+	c.backtestSlippage = c.backtestSlippage.Add(price.Sub(fillPrice).Mul(req.Qty))
+	c.backtestCash = c.backtestCash.Add(fillPrice.Mul(req.Qty))
+	c.backtestStockHeldQty = c.backtestStockHeldQty.Sub(req.Qty)
+	c.fakeCommission(req.Qty, true)
+	return &alpaca.Order{
+		ID:             fmt.Sprint(c.backtestOrderID),
+		Symbol:         c.stockSymbol,
+		Status:         filled,
+		SubmittedAt:    arrival,
+		FilledAt:       &arrival,
+		Qty:            req.Qty,
+		FilledQty:      req.Qty,
+		FilledAvgPrice: &fillPrice,
+		Side:           alpaca.Sell,
+		Type:           alpaca.Market,
+	}, nil
 }
 
+// fakeGetAccount returns the simulated account, with the held shares valued
+// at the current close.
 func (c *client) fakeGetAccount() *alpaca.Account {
+	held := c.backtestStockHeldQty.Mul(c.fakeCurrentPrice().Close)
 	return &alpaca.Account{
-		Cash: c.backtestCash,
+		Cash:            c.backtestCash,
+		RegTBuyingPower: c.backtestCash,
+		LongMarketValue: held,
+		Equity:          c.backtestCash.Add(held),
 	}
 }
 
+// fakeGetSymbolBars returns the last numHistoricalBars complete bars of
+// bar_timeframe.
 func (c *client) fakeGetSymbolBars() []alpaca.Bar {
+	return c.fakeBars(c.cfg.Params.numHistoricalBars)
+}
+
+// fakeBars returns the last n complete bars of bar_timeframe, built from the
+// minutes of the history. With backtest_forming_bars, the last bar is the bar
+// which is still forming, unless the current time starts a bar. A bar without
+// any minutes in the history means the bars cannot be returned.
+func (c *client) fakeBars(n int) []alpaca.Bar {
+	if c.cfg.BarTimeframe == dailyTimeframe {
+		return c.fakeDailyBars(n)
+	}
+	d := timeframes[c.cfg.BarTimeframe]
+	end := timeToMinuteStart(c.backtestClock.Now).Truncate(d)
+	var forming *alpaca.Bar
+	if c.cfg.BacktestFormingBars && end.Before(c.backtestClock.Now) {
+		b, ok := c.backtestHistory.formingBar(end, c.backtestClock.Now)
+		if !ok {
+			return nil
+		}
+		forming = &b
+		n--
+	}
 	var bars []alpaca.Bar
-	for i := *numHistoricalBarsToUse; i > 0; i-- {
-		h, ok := c.backtestHistory.epochToTickerData[timeToMinuteStart(c.backtestClock.Now).Unix()-int64(i*60)]
+	for i := n; i > 0; i-- {
+		b, ok := c.backtestHistory.bar(end.Add(-time.Duration(i)*d), d)
 		if !ok {
 			return nil
 		}
-		close, _ := h.Close.Float64()
-		bars = append(bars, alpaca.Bar{
-			Close: float32(close),
-		})
+		bars = append(bars, b)
+	}
+	if forming != nil {
+		bars = append(bars, *forming)
+	}
+	return bars
+}
+
+// fakeDailyBars returns the daily bars of the last n trading sessions before
+// today, skipping days without a session. With backtest_forming_bars, the last
+// bar is today's session so far once it has opened.
+func (c *client) fakeDailyBars(n int) []alpaca.Bar {
+	now := c.backtestClock.Now.In(EST)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, EST)
+	var forming *alpaca.Bar
+	if open, _ := c.backtestClock.sessionTimes(now); c.cfg.BacktestFormingBars && c.backtestClock.isTradingDay(now) && now.After(open) {
+		b, ok := c.backtestHistory.formingBar(today, now)
+		if !ok {
+			return nil
+		}
+		forming = &b
+		n--
+	}
+	bars := make([]alpaca.Bar, n)
+	day := today
+	for i := n - 1; i >= 0; i-- {
+		if day = c.backtestClock.previousTradingDay(day); day.IsZero() {
+			return nil
+		}
+		// Days are not always 24 hours long when daylight saving time
+		// changes.
+		b, ok := c.backtestHistory.bar(day, day.AddDate(0, 0, 1).Sub(day))
+		if !ok {
+			return nil
+		}
+		bars[i] = b
+	}
+	if forming != nil {
+		bars = append(bars, *forming)
 	}
 	return bars
 }
@@ -441,19 +897,124 @@ func (c *client) fakeCloseOutTrading() {
 	if !ok {
 		panic(fmt.Sprintf("could not find data to close out @ %v", nowToMin))
 	}
-	// Sell at the lowest price since this is a market order.
-	// Might need to take off even more to be realistic.
-	c.backtestCash = c.backtestCash.Add(h.Low.Mul(c.backtestStockHeldQty))
+	for _, p := range c.purchases {
+		if p.SellFilled() {
+			c.backtestSold = append(c.backtestSold, p)
+			c.recordTrade(p, nil)
+		}
+	}
+	if c.cfg.HoldOvernight {
+		c.closeOutOvernight(c.backtestClock.Now)
+		c.endOfDayReport()
+		// Only keep the purchases which are still held.
+		var held []*purchase.Purchase
+		for _, p := range c.purchases {
+			if p.BuyFilled() && !p.SellFilled() {
+				held = append(held, p)
+			}
+		}
+		c.purchases = held
+		c.backtestCashStartOfDay = c.backtestCash
+		return
+	}
+
+	// Sell at the bid, or the lowest price if unknown, since this is a market
+	// order. Might need to take off even more to be realistic.
+	closeOut := c.fakeSlip(h.marketSellPrice(), alpaca.Sell)
+	c.backtestSlippage = c.backtestSlippage.Add(h.marketSellPrice().Sub(closeOut).Mul(c.backtestStockHeldQty))
+	c.backtestCash = c.backtestCash.Add(closeOut.Mul(c.backtestStockHeldQty))
+	if c.backtestStockHeldQty.IsPositive() {
+		c.fakeCommission(c.backtestStockHeldQty, true)
+	}
+	c.backtestStockHeldQty = decimal.NewFromFloat(0)
+	for _, p := range c.purchases {
+		if !p.SellFilled() {
+			c.recordTrade(p, &closeOut)
+		}
+	}
 
 	c.endOfDayReport()
 
-	// Zero out stock held and fake purchases.
-	c.backtestStockHeldQty = decimal.NewFromFloat(0)
+	// Zero out fake purchases.
 	c.backtestOrderID = 0
 	c.purchases = []*purchase.Purchase{}
 	c.backtestCashStartOfDay = c.backtestCash
 }
 
+// chargeOvernightFees deducts margin interest and short borrow fees, and
+// credits the interest earned on idle cash, for the nights since the previous
+// close. It is called at the start of each trading day. The charges are also
+// attributed to the purchases held overnight, so they are part of the P/L of
+// those trades.
+func (c *client) chargeOvernightFees() {
+	now := c.backtestClock.Now
+	defer func() { c.backtestLastClose = c.backtestClock.TodaysCloseTime }()
+	if c.backtestLastClose.IsZero() {
+		return
+	}
+	lastCloseDay := time.Date(c.backtestLastClose.Year(), c.backtestLastClose.Month(), c.backtestLastClose.Day(), 0, 0, 0, 0, EST)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, EST)
+	nights := decimal.NewFromInt(int64(today.Sub(lastCloseDay).Hours()/24 + 0.5))
+	if !nights.IsPositive() {
+		return
+	}
+
+	if c.backtestCash.IsNegative() {
+		interest := c.backtestCash.Neg().Mul(overnightRate(c.cfg.BacktestMarginInterestRate, nights))
+		c.backtestCash = c.backtestCash.Sub(interest)
+		c.backtestMarginInterest = c.backtestMarginInterest.Add(interest)
+		c.attributeOvernightFee("margin-interest-"+today.Format("2006-01-02"), "margin interest", interest)
+	}
+	if c.backtestCash.IsPositive() {
+		rate := decimal.NewFromFloat(c.cfg.BacktestCashInterestRate / 100 / daysPerYearForCashInterest).Mul(nights)
+		interest := c.backtestCash.Mul(rate)
+		c.backtestCash = c.backtestCash.Add(interest)
+		c.backtestCashInterest = c.backtestCashInterest.Add(interest)
+	}
+	if c.backtestStockHeldQty.IsNegative() {
+		shortValue := c.backtestStockHeldQty.Neg().Mul(c.backtestSymbolEndOfDay)
+		fee := shortValue.Mul(overnightRate(c.cfg.BacktestShortBorrowFeeRate, nights))
+		c.backtestCash = c.backtestCash.Sub(fee)
+		c.backtestShortBorrowFees = c.backtestShortBorrowFees.Add(fee)
+		c.attributeOvernightFee("short-borrow-fee-"+today.Format("2006-01-02"), "short borrow fee", fee)
+	}
+}
+
+// attributeOvernightFee splits a fee charged overnight between the purchases
+// held overnight, in proportion to their shares, as attributeFees does with
+// the fees of live trading. A fee charged while no purchase is held is only
+// deducted from the cash.
+func (c *client) attributeOvernightFee(id, description string, fee decimal.Decimal) {
+	var held []*purchase.Purchase
+	total := decimal.Zero
+	for _, p := range c.purchases {
+		if p.BuyOrder.FilledQty.IsPositive() && !p.SellFilled() {
+			held = append(held, p)
+			total = total.Add(p.BuyOrder.FilledQty)
+		}
+	}
+	// The rounding remainder goes to the last purchase so the shares add up
+	// to the fee.
+	remaining := fee
+	for i, p := range held {
+		share := remaining
+		if i < len(held)-1 {
+			share = fee.Mul(p.BuyOrder.FilledQty).Div(total).Round(4)
+		}
+		remaining = remaining.Sub(share)
+		p.Fees = append(p.Fees, purchase.Fee{ActivityID: id, Amount: share, Description: description})
+		if err := c.dbClient.UpdateFees(p); err != nil {
+			log.Printf("unable to update fees of purchase %d: %v", p.ID, err)
+		}
+	}
+}
+
+// overnightRate converts an annual rate percentage into the fraction charged
+// for the given number of nights.
+func overnightRate(annualPercent float64, nights decimal.Decimal) decimal.Decimal {
+	return decimal.NewFromFloat(annualPercent).Div(decimal.NewFromInt(100 * daysPerYearForInterest)).Mul(nights)
+}
+
 // timeToMinuteStart returns the same time provided with the seconds and ns
 // brought down to 0 which matches the historical data frequency.
 func timeToMinuteStart(t time.Time) time.Time {
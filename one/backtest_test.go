@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+func TestFakeDailyBarsSkipDaysWithoutSession(t *testing.T) {
+	now := time.Date(2021, 1, 11, 10, 0, 0, 0, EST) // A Monday.
+	clock, err := newFakeClockAt(now, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &history{epochToTickerData: map[int64]*historicalTickerData{}}
+	for day := 4; day <= 11; day++ {
+		p := decimal.NewFromInt(int64(day))
+		for _, hour := range []int{10, 15} {
+			h.epochToTickerData[time.Date(2021, 1, day, hour, 0, 0, 0, EST).Unix()] = &historicalTickerData{High: p, Low: p, Close: p}
+		}
+	}
+	c := &client{cfg: ClientConfig{Backtest: true, BarTimeframe: dailyTimeframe}, backtestClock: clock, backtestHistory: h}
+
+	bars := c.fakeBars(3)
+	if len(bars) != 3 {
+		t.Fatalf("fakeBars(3) returned %d bars, want 3", len(bars))
+	}
+	for i, day := range []int{6, 7, 8} {
+		if want := time.Date(2021, 1, day, 0, 0, 0, 0, EST).Unix(); bars[i].Time != want {
+			t.Errorf("bar %d starts at %v, want %v", i, time.Unix(bars[i].Time, 0).In(EST), time.Unix(want, 0).In(EST))
+		}
+		if bars[i].Close != float32(day) {
+			t.Errorf("bar %d closes at %v, want %v", i, bars[i].Close, day)
+		}
+	}
+
+	c.cfg.BacktestFormingBars = true
+	clock.Now = now.Add(30 * time.Minute)
+	bars = c.fakeBars(2)
+	if len(bars) != 2 || bars[0].Close != 8 || bars[1].Close != 11 {
+		t.Errorf("fakeBars(2) with forming bars = %+v, want Friday's bar and Monday's forming bar", bars)
+	}
+}
+
+func TestFakeTouchFillCertainDrawsNothing(t *testing.T) {
+	c := newBacktestTestClient(t, ClientConfig{BacktestLimitTouchFill: 1, BacktestLimitFillDecay: 1}, 10, "100", "50")
+	o := &alpaca.Order{CreatedAt: backtestTestStart}
+	c.backtestClock.Now = backtestTestStart.Add(5 * time.Minute)
+
+	rand.Seed(1)
+	want := rand.Float64()
+	rand.Seed(1)
+	if !c.fakeTouchFill(o) {
+		t.Fatal("fakeTouchFill() with a probability of 1 = false, want true")
+	}
+	if got := rand.Float64(); got != want {
+		t.Errorf("next draw after a certain touch fill = %v, want %v", got, want)
+	}
+}
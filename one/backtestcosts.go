@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestSlippageBps        = flag.Float64("backtest_slippage_bps", 0, "Backtest market fills, including stops and the close out, are this many basis points worse than the bar price: buys pay more and sells receive less. Limit fills are at their limit or better, so they are not slipped.")
+	backtestCommissionPerTrade = flag.Float64("backtest_commission_per_trade", 0, "The commission in dollars charged for each backtest order which fills, however many fills it takes.")
+	backtestCommissionPerShare = flag.Float64("backtest_commission_per_share", 0, "The commission in dollars charged for each share a backtest order fills.")
+)
+
+// validateBacktestCosts returns an error if the slippage or commissions are
+// negative.
+func validateBacktestCosts() error {
+	if *backtestSlippageBps < 0 || *backtestCommissionPerTrade < 0 || *backtestCommissionPerShare < 0 {
+		return fmt.Errorf("backtest_slippage_bps, backtest_commission_per_trade and backtest_commission_per_share cannot be negative")
+	}
+	return nil
+}
+
+// fakeSlip returns the price a market order of the side fills at when the bar
+// price is price, backtest_slippage_bps worse.
+func (c *client) fakeSlip(price decimal.Decimal, side alpaca.Side) decimal.Decimal {
+	if c.cfg.BacktestSlippageBps <= 0 {
+		return price
+	}
+	slip := price.Mul(decimal.NewFromFloat(c.cfg.BacktestSlippageBps / 10000))
+	if side == alpaca.Buy {
+		return price.Add(slip).Round(4)
+	}
+	return price.Sub(slip).Round(4)
+}
+
+// fakeMarketFill fills qty more of the order at market, slipped from the bar
+// price.
+func (c *client) fakeMarketFill(o *alpaca.Order, qty, price decimal.Decimal) {
+	slipped := c.fakeSlip(price, o.Side)
+	c.backtestSlippage = c.backtestSlippage.Add(slipped.Sub(price).Abs().Mul(qty))
+	c.fakeFill(o, qty, slipped)
+}
+
+// fakeCommission charges the commission of filling qty shares from the cash.
+// The commission per trade is charged with the first fill of an order.
+func (c *client) fakeCommission(qty decimal.Decimal, firstFill bool) {
+	commission := decimal.NewFromFloat(c.cfg.BacktestCommissionPerShare).Mul(qty)
+	if firstFill {
+		commission = commission.Add(decimal.NewFromFloat(c.cfg.BacktestCommissionPerTrade))
+	}
+	if !commission.IsPositive() {
+		return
+	}
+	c.backtestCash = c.backtestCash.Sub(commission)
+	c.backtestCommissions = c.backtestCommissions.Add(commission)
+}
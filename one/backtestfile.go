@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestFileColumns     = flag.String("backtest_file_columns", "", "A comma separated mapping of fields to columns of the backtest file, e.g. \"time=Date,close=Last\". Columns are header names or zero based indexes. Fields are time, high, low, close, volume, bid, ask and halted. Unmapped fields are found by their header name, or default to the positions of the original file format when the file has no header.")
+	backtestFileTimeFormats = flag.String("backtest_file_time_formats", "2006-01-02 15:04:05,2006-01-02T15:04:05Z07:00,2006-01-02T15:04:05,2006-01-02 15:04,01/02/2006 15:04:05,01/02/2006 15:04,unix", "A comma separated list of time layouts tried in order when parsing the backtest file. \"unix\" parses seconds since the epoch and \"unix_ms\" parses milliseconds since the epoch.")
+	backtestFileTimezone    = flag.String("backtest_file_timezone", "America/New_York", "The timezone of times in the backtest file which do not include an offset.")
+)
+
+// backtestField is a field read from each row of the backtest file.
+type backtestField string
+
+const (
+	fieldTime   backtestField = "time"
+	fieldHigh   backtestField = "high"
+	fieldLow    backtestField = "low"
+	fieldClose  backtestField = "close"
+	fieldVolume backtestField = "volume"
+	fieldBid    backtestField = "bid"
+	fieldAsk    backtestField = "ask"
+	fieldHalted backtestField = "halted"
+)
+
+var (
+	// requiredFields must be present in every backtest file.
+	requiredFields = []backtestField{fieldTime, fieldHigh, fieldLow, fieldClose}
+
+	// optionalFields are read when the backtest file has them.
+	optionalFields = []backtestField{fieldVolume, fieldBid, fieldAsk, fieldHalted}
+
+	// fieldAliases are the header names recognized for each field.
+	fieldAliases = map[backtestField][]string{
+		fieldTime:   {"time", "timestamp", "datetime", "date", "t"},
+		fieldHigh:   {"high", "h"},
+		fieldLow:    {"low", "l"},
+		fieldClose:  {"close", "last", "c"},
+		fieldVolume: {"volume", "vol", "v"},
+		fieldBid:    {"bid", "bid_price"},
+		fieldAsk:    {"ask", "ask_price"},
+		fieldHalted: {"halted", "halt"},
+	}
+
+	// headerlessColumns are the column positions of files without a header.
+	headerlessColumns = map[backtestField]int{
+		fieldTime:  0,
+		fieldHigh:  2,
+		fieldLow:   3,
+		fieldClose: 4,
+	}
+)
+
+// backtestRecord is a parsed row of the backtest file.
+type backtestRecord struct {
+	line int
+	time time.Time
+	data *historicalTickerData
+}
+
+// backtestFileParser converts the rows of a backtest file into records.
+type backtestFileParser struct {
+	columns     map[backtestField]int
+	timeFormats []string
+	location    *time.Location
+}
+
+// rowReader reads the rows of a backtest file one at a time. It returns
+// io.EOF after the last row.
+type rowReader interface {
+	Read() ([]string, error)
+}
+
+// parquetRowReader returns a rowReader for a Parquet file. It is only set when
+// built with the parquet build tag, which keeps the Parquet dependencies out
+// of the default build.
+var parquetRowReader func(filename string) (rowReader, error)
+
+var (
+	gzipMagic    = []byte{0x1f, 0x8b}
+	parquetMagic = []byte("PAR1")
+)
+
+// readBacktestFile reads and parses all rows of the backtest file. CSV files
+// may be gzip compressed, which is detected from the file contents.
+func readBacktestFile(filename string) ([]*backtestRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read backtest file: %v", err)
+	}
+	defer f.Close()
+
+	b := bufio.NewReader(f)
+	magic, _ := b.Peek(len(parquetMagic))
+	switch {
+	case bytes.Equal(magic, parquetMagic):
+		if parquetRowReader == nil {
+			return nil, fmt.Errorf("%q is a Parquet file, which requires building with -tags parquet", filename)
+		}
+		rows, err := parquetRowReader(filename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read Parquet file: %v", err)
+		}
+		return parseBacktestFile(rows)
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(b)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress backtest file: %v", err)
+		}
+		defer gz.Close()
+		return parseBacktestFile(newCSVRowReader(gz))
+	}
+	return parseBacktestFile(newCSVRowReader(b))
+}
+
+// newCSVRowReader returns a rowReader for CSV data.
+func newCSVRowReader(r io.Reader) rowReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	return reader
+}
+
+// parseBacktestFile parses the rows of a backtest file. The first row is
+// treated as a header if its time column does not parse as a time.
+func parseBacktestFile(reader rowReader) ([]*backtestRecord, error) {
+	var p *backtestFileParser
+	var records []*backtestRecord
+	for line := 1; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if p == nil {
+			if p, err = newBacktestFileParser(row); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			if p.isHeader(row) {
+				continue
+			}
+		}
+		rec, err := p.parse(row)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rec.line = line
+		if n := len(records); n > 0 && rec.time.Before(records[n-1].time) {
+			return nil, fmt.Errorf("line %d: time %v is before %v on line %d, rows must be in time order", line, rec.time, records[n-1].time, records[n-1].line)
+		}
+		records = append(records, rec)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("backtest file has no data")
+	}
+	return records, nil
+}
+
+// newBacktestFileParser returns a parser configured by flags for a file with
+// the given first row.
+func newBacktestFileParser(firstRow []string) (*backtestFileParser, error) {
+	loc, err := time.LoadLocation(*backtestFileTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load backtest_file_timezone %q: %v", *backtestFileTimezone, err)
+	}
+	p := &backtestFileParser{
+		columns:     map[backtestField]int{},
+		timeFormats: strings.Split(*backtestFileTimeFormats, ","),
+		location:    loc,
+	}
+
+	header := map[string]int{}
+	for i, name := range firstRow {
+		header[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	// Explicitly mapped columns.
+	if *backtestFileColumns != "" {
+		for _, m := range strings.Split(*backtestFileColumns, ",") {
+			kv := strings.SplitN(strings.TrimSpace(m), "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("%q is not of the form field=column", m)
+			}
+			field := backtestField(strings.ToLower(kv[0]))
+			if _, ok := fieldAliases[field]; !ok {
+				return nil, fmt.Errorf("%q is not a backtest file field", kv[0])
+			}
+			if i, err := strconv.Atoi(kv[1]); err == nil {
+				if i < 0 {
+					return nil, fmt.Errorf("column %d for field %q is negative, columns are zero based indexes", i, field)
+				}
+				p.columns[field] = i
+				continue
+			}
+			i, ok := header[strings.ToLower(kv[1])]
+			if !ok {
+				return nil, fmt.Errorf("column %q for field %q is not in the header", kv[1], field)
+			}
+			p.columns[field] = i
+		}
+	}
+
+	// Bid and ask positions may also be set by their own flags.
+	if _, ok := p.columns[fieldBid]; !ok && *backtestBidColumn >= 0 {
+		p.columns[fieldBid] = *backtestBidColumn
+	}
+	if _, ok := p.columns[fieldAsk]; !ok && *backtestAskColumn >= 0 {
+		p.columns[fieldAsk] = *backtestAskColumn
+	}
+
+	// Remaining columns are found by name. Files without a header use the
+	// positions of the original file format.
+	timeColumn, ok := p.columns[fieldTime]
+	if !ok {
+		timeColumn = headerlessColumns[fieldTime]
+	}
+	headerless := false
+	if timeColumn < len(firstRow) {
+		_, err := p.parseTime(firstRow[timeColumn])
+		headerless = err == nil
+	}
+	for _, field := range append(append([]backtestField{}, requiredFields...), optionalFields...) {
+		if _, ok := p.columns[field]; ok {
+			continue
+		}
+		if headerless {
+			if i, ok := headerlessColumns[field]; ok {
+				p.columns[field] = i
+			}
+			continue
+		}
+		for _, alias := range fieldAliases[field] {
+			if i, ok := header[alias]; ok {
+				p.columns[field] = i
+				break
+			}
+		}
+	}
+
+	for _, field := range requiredFields {
+		if _, ok := p.columns[field]; !ok {
+			return nil, fmt.Errorf("no column found for field %q, set it with backtest_file_columns", field)
+		}
+	}
+	return p, nil
+}
+
+// isHeader returns true if the row is a header rather than data.
+func (p *backtestFileParser) isHeader(row []string) bool {
+	i := p.columns[fieldTime]
+	if i >= len(row) {
+		return true
+	}
+	_, err := p.parseTime(row[i])
+	return err != nil
+}
+
+// parse converts a row into a record.
+func (p *backtestFileParser) parse(row []string) (*backtestRecord, error) {
+	v, err := p.column(row, fieldTime)
+	if err != nil {
+		return nil, err
+	}
+	t, err := p.parseTime(v)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &historicalTickerData{}
+	for _, f := range []struct {
+		field    backtestField
+		dst      *decimal.Decimal
+		optional bool
+	}{
+		{fieldHigh, &d.High, false},
+		{fieldLow, &d.Low, false},
+		{fieldClose, &d.Close, false},
+		{fieldVolume, &d.Volume, true},
+		{fieldBid, &d.Bid, true},
+		{fieldAsk, &d.Ask, true},
+	} {
+		if _, ok := p.columns[f.field]; !ok {
+			continue
+		}
+		v, err := p.column(row, f.field)
+		if err != nil {
+			return nil, err
+		}
+		if v == "" && f.optional {
+			continue
+		}
+		if *f.dst, err = decimal.NewFromString(v); err != nil {
+			return nil, fmt.Errorf("unable to convert %s %q to a number: %v", f.field, v, err)
+		}
+	}
+	if _, ok := p.columns[fieldHalted]; ok {
+		v, err := p.column(row, fieldHalted)
+		if err != nil {
+			return nil, err
+		}
+		if v != "" {
+			if d.Halted, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("unable to convert %s %q to a bool: %v", fieldHalted, v, err)
+			}
+		}
+	}
+	return &backtestRecord{time: t, data: d}, nil
+}
+
+// column returns the value of the field in the row.
+func (p *backtestFileParser) column(row []string, field backtestField) (string, error) {
+	i := p.columns[field]
+	if i >= len(row) {
+		return "", fmt.Errorf("%s column %d is missing, the row only has %d columns", field, i, len(row))
+	}
+	return strings.TrimSpace(row[i]), nil
+}
+
+// parseTime parses a time using the first matching time format.
+func (p *backtestFileParser) parseTime(v string) (time.Time, error) {
+	for _, layout := range p.timeFormats {
+		switch layout {
+		case "unix":
+			if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.Unix(sec, 0).In(p.location), nil
+			}
+			continue
+		case "unix_ms":
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.Unix(0, ms*int64(time.Millisecond)).In(p.location), nil
+			}
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, v, p.location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse time %q with any of the formats %q", v, p.timeFormats)
+}
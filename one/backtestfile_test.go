@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// setBacktestFileFlags sets the flags read by newBacktestFileParser for the
+// duration of the test.
+func setBacktestFileFlags(t *testing.T, columns, timezone string) {
+	t.Helper()
+	oldColumns, oldTimezone := *backtestFileColumns, *backtestFileTimezone
+	t.Cleanup(func() {
+		*backtestFileColumns, *backtestFileTimezone = oldColumns, oldTimezone
+	})
+	*backtestFileColumns = columns
+	if timezone != "" {
+		*backtestFileTimezone = timezone
+	}
+}
+
+func TestParseBacktestFile(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type bar struct {
+		time                time.Time
+		high, low, close, v string
+	}
+	tests := []struct {
+		name     string
+		columns  string
+		timezone string
+		file     string
+		want     []bar
+	}{
+		{
+			name: "headerless original format",
+			file: "2021-01-04 09:30:00,1,2,1,1.5\n2021-01-04 09:31:00,1,3,2,2.5\n",
+			want: []bar{
+				{time.Date(2021, 1, 4, 9, 30, 0, 0, ny), "2", "1", "1.5", "0"},
+				{time.Date(2021, 1, 4, 9, 31, 0, 0, ny), "3", "2", "2.5", "0"},
+			},
+		},
+		{
+			name: "header aliases",
+			file: "Timestamp,Open,H,L,Last,Vol\n2021-01-04 09:30:00,1,2,1,1.5,100\n",
+			want: []bar{{time.Date(2021, 1, 4, 9, 30, 0, 0, ny), "2", "1", "1.5", "100"}},
+		},
+		{
+			name:    "mapped columns",
+			columns: "time=When,close=Price,high=1,low=2",
+			file:    "When,Max,Min,Price\n2021-01-04 09:30:00,2,1,1.5\n",
+			want:    []bar{{time.Date(2021, 1, 4, 9, 30, 0, 0, ny), "2", "1", "1.5", "0"}},
+		},
+		{
+			name: "time formats",
+			file: "time,high,low,close\n2021-01-04T09:30:00-05:00,2,1,1.5\n01/04/2021 09:31,2,1,1.5\n1609770720,2,1,1.5\n",
+			want: []bar{
+				{time.Date(2021, 1, 4, 9, 30, 0, 0, ny), "2", "1", "1.5", "0"},
+				{time.Date(2021, 1, 4, 9, 31, 0, 0, ny), "2", "1", "1.5", "0"},
+				{time.Date(2021, 1, 4, 9, 32, 0, 0, ny), "2", "1", "1.5", "0"},
+			},
+		},
+		{
+			name: "optional volume left empty",
+			file: "time,high,low,close,volume\n2021-01-04 09:30:00,2,1,1.5,\n2021-01-04 09:31:00,2,1,1.5,7\n",
+			want: []bar{
+				{time.Date(2021, 1, 4, 9, 30, 0, 0, ny), "2", "1", "1.5", "0"},
+				{time.Date(2021, 1, 4, 9, 31, 0, 0, ny), "2", "1", "1.5", "7"},
+			},
+		},
+		{
+			name:     "timezone",
+			timezone: "UTC",
+			file:     "time,high,low,close\n2021-01-04 14:30:00,2,1,1.5\n",
+			want:     []bar{{time.Date(2021, 1, 4, 9, 30, 0, 0, ny), "2", "1", "1.5", "0"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setBacktestFileFlags(t, test.columns, test.timezone)
+			records, err := parseBacktestFile(newCSVRowReader(strings.NewReader(test.file)))
+			if err != nil {
+				t.Fatalf("parseBacktestFile() = %v", err)
+			}
+			if len(records) != len(test.want) {
+				t.Fatalf("parseBacktestFile() returned %d records, want %d", len(records), len(test.want))
+			}
+			for i, want := range test.want {
+				got := records[i]
+				if !got.time.Equal(want.time) {
+					t.Errorf("record %d time = %v, want %v", i, got.time, want.time)
+				}
+				for _, f := range []struct {
+					name string
+					got  decimal.Decimal
+					want string
+				}{
+					{"high", got.data.High, want.high},
+					{"low", got.data.Low, want.low},
+					{"close", got.data.Close, want.close},
+					{"volume", got.data.Volume, want.v},
+				} {
+					if !f.got.Equal(decimal.RequireFromString(f.want)) {
+						t.Errorf("record %d %s = %v, want %v", i, f.name, f.got, f.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseBacktestFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns string
+		file    string
+		want    string
+	}{
+		{
+			name:    "negative column",
+			columns: "close=-1",
+			file:    "2021-01-04 09:30:00,1,2,1,1.5\n",
+			want:    "line 1: column -1 for field \"close\" is negative",
+		},
+		{
+			name:    "unknown field",
+			columns: "open=1",
+			file:    "2021-01-04 09:30:00,1,2,1,1.5\n",
+			want:    "line 1: \"open\" is not a backtest file field",
+		},
+		{
+			name: "missing required column",
+			file: "time,high,low\n2021-01-04 09:30:00,2,1\n",
+			want: "line 1: no column found for field \"close\"",
+		},
+		{
+			name: "bad number",
+			file: "time,high,low,close\n2021-01-04 09:30:00,2,1,1.5\n2021-01-04 09:31:00,2,x,1.5\n",
+			want: "line 3: unable to convert low \"x\" to a number",
+		},
+		{
+			name: "short row",
+			file: "time,high,low,close\n2021-01-04 09:30:00,2,1\n",
+			want: "line 2: close column 3 is missing",
+		},
+		{
+			name: "bad time",
+			file: "time,high,low,close\n2021-01-04 09:30:00,2,1,1.5\nyesterday,2,1,1.5\n",
+			want: "line 3: unable to parse time \"yesterday\"",
+		},
+		{
+			name: "out of order",
+			file: "time,high,low,close\n2021-01-04 09:31:00,2,1,1.5\n2021-01-04 09:30:00,2,1,1.5\n",
+			want: "line 3: time",
+		},
+		{
+			name: "no data",
+			file: "time,high,low,close\n",
+			want: "backtest file has no data",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setBacktestFileFlags(t, test.columns, "")
+			_, err := parseBacktestFile(newCSVRowReader(strings.NewReader(test.file)))
+			if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+				t.Fatalf("parseBacktestFile() = %v, want an error starting with %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestOutputJSON = flag.String("backtest_output_json", "", "When set, the result of the backtest is also written to this file as JSON: the params, stats, trades and equity curve, for optimization tools and notebooks.")
+)
+
+// backtestResult is the JSON result of a backtest.
+type backtestResult struct {
+	Build       string            `json:"build"`
+	Seed        int64             `json:"seed"`
+	Symbol      string            `json:"symbol"`
+	Strategy    string            `json:"strategy"`
+	Start       time.Time         `json:"start"`
+	End         time.Time         `json:"end"`
+	Params      map[string]string `json:"params"` // The flags which were set.
+	Stats       backtestStats     `json:"stats"`
+	Trades      []backtestTrade   `json:"trades"`
+	EquityCurve []equityPoint     `json:"equity_curve"`
+}
+
+// backtestStats are the summary statistics of a backtest. Money is in
+// dollars and percentages are 0 to 100.
+type backtestStats struct {
+	StartingCash               float64  `json:"starting_cash"`
+	EndingCash                 float64  `json:"ending_cash"`
+	EndingHeldShares           float64  `json:"ending_held_shares"`
+	EndingEquity               float64  `json:"ending_equity"`
+	ProfitLossPercent          float64  `json:"profit_loss_percent"`
+	SymbolProfitLossPercent    float64  `json:"symbol_profit_loss_percent"`
+	AlgoBenefitPercent         float64  `json:"algo_benefit_percent"`
+	MaxDrawdownPercent         float64  `json:"max_drawdown_percent"`
+	Trades                     int      `json:"trades"`
+	Wins                       int      `json:"wins"`
+	Losses                     int      `json:"losses"`
+	WinRatePercent             float64  `json:"win_rate_percent"`
+	GrossProfit                float64  `json:"gross_profit"`
+	GrossLoss                  float64  `json:"gross_loss"`
+	ProfitFactor               *float64 `json:"profit_factor,omitempty"` // Unset without losses.
+	SlippagePaid               float64  `json:"slippage_paid"`
+	CommissionsPaid            float64  `json:"commissions_paid"`
+	MarginInterestPaid         float64  `json:"margin_interest_paid"`
+	CashInterestEarned         float64  `json:"cash_interest_earned"`
+	ShortBorrowFeesPaid        float64  `json:"short_borrow_fees_paid"`
+	UnprotectedPurchaseMinutes int      `json:"unprotected_purchase_minutes"`
+	TerminatedBy               string   `json:"terminated_by"`
+	BenchmarkSymbol            string   `json:"benchmark_symbol"`
+	BenchmarkProfitLossPercent float64  `json:"benchmark_profit_loss_percent"`
+	ExcessReturnPercent        float64  `json:"excess_return_percent"`
+	BenchmarkUpDays            int      `json:"benchmark_up_days"`
+	BenchmarkDownDays          int      `json:"benchmark_down_days"`
+	Beta                       *float64 `json:"beta,omitempty"`                 // Unset with fewer than two days.
+	AlphaPercent               *float64 `json:"alpha_percent,omitempty"`        // Annualized, unset with beta.
+	UpCapturePercent           *float64 `json:"up_capture_percent,omitempty"`   // Unset without up days.
+	DownCapturePercent         *float64 `json:"down_capture_percent,omitempty"` // Unset without down days.
+}
+
+// backtestTrade is a purchase made by the backtest. The exit is unset while
+// the purchase is still held at the end of the backtest.
+type backtestTrade struct {
+	PurchaseID                 int64      `json:"purchase_id"`
+	EntryTime                  *time.Time `json:"entry_time"`
+	EntryPrice                 float64    `json:"entry_price"`
+	Qty                        float64    `json:"qty"`
+	EntryReason                string     `json:"entry_reason,omitempty"`
+	ExitTime                   *time.Time `json:"exit_time,omitempty"`
+	ExitPrice                  *float64   `json:"exit_price,omitempty"`
+	Exit                       string     `json:"exit,omitempty"`
+	ProfitLoss                 *float64   `json:"profit_loss,omitempty"`
+	MaxAdverseExcursionPercent *float64   `json:"max_adverse_excursion_percent,omitempty"`
+}
+
+// equityPoint is the equity at a minute of the session.
+type equityPoint struct {
+	Time   time.Time `json:"time"`
+	Equity float64   `json:"equity"`
+}
+
+// recordEquity adds the current equity to the equity curve, when the result
+// is written as JSON.
+func (c *client) recordEquity() {
+	if c.cfg.BacktestOutputJSON == "" {
+		return
+	}
+	equity := c.backtestCash.Add(c.backtestStockHeldQty.Mul(c.fakeCurrentPrice().Close))
+	c.backtestEquityCurve = append(c.backtestEquityCurve, equityPoint{Time: c.backtestClock.Now, Equity: floatOf(equity)})
+}
+
+// recordTrade adds the purchase to the trades of the result, when the result
+// is written as JSON. Purchases which are not sold were closed out at the
+// price, or are still held if the price is nil.
+func (c *client) recordTrade(p *purchase.Purchase, closeOut *decimal.Decimal) {
+	if c.cfg.BacktestOutputJSON == "" || !p.BuyFilled() || p.BuyOrder.FilledAvgPrice == nil {
+		return
+	}
+	t := backtestTrade{
+		PurchaseID:  p.ID,
+		EntryTime:   p.BuyOrder.FilledAt,
+		EntryPrice:  floatOf(*p.BuyOrder.FilledAvgPrice),
+		Qty:         floatOf(p.BuyOrder.FilledQty),
+		EntryReason: p.EntryReason,
+	}
+	if mae, ok := p.MaxAdverseExcursionPercent(); ok {
+		f := floatOf(mae)
+		t.MaxAdverseExcursionPercent = &f
+	}
+	var exitPrice *decimal.Decimal
+	switch {
+	case p.SellFilled() && p.SellOrder.FilledAvgPrice != nil:
+		exitPrice = p.SellOrder.FilledAvgPrice
+		t.ExitTime = p.SellOrder.FilledAt
+		t.Exit, _ = p.ExitLeg()
+	case closeOut != nil:
+		exitPrice = closeOut
+		now := c.backtestClock.Now
+		t.ExitTime = &now
+		t.Exit = purchase.ExitCloseOut
+	}
+	if exitPrice != nil {
+		price := floatOf(*exitPrice)
+		pl := floatOf(exitPrice.Sub(*p.BuyOrder.FilledAvgPrice).Mul(p.BuyOrder.FilledQty))
+		t.ExitPrice = &price
+		t.ProfitLoss = &pl
+	}
+	c.backtestTradeLog = append(c.backtestTradeLog, t)
+}
+
+// writeBacktestJSON writes the result of the backtest to backtest_output_json.
+// The purchases of the last day which are still tracked are added to the
+// trades first.
+func writeBacktestJSON(c *client, seed int64) error {
+	for _, p := range c.purchases {
+		c.recordTrade(p, nil)
+	}
+	start, err := backtestStart()
+	if err != nil {
+		return err
+	}
+	r := &backtestResult{
+		Build:       currentBuildInfo().String(),
+		Seed:        seed,
+		Symbol:      c.stockSymbol,
+		Strategy:    c.strategy,
+		Start:       start,
+		End:         c.backtestHistory.endTime,
+		Params:      map[string]string{},
+		Trades:      c.backtestTradeLog,
+		EquityCurve: c.backtestEquityCurve,
+	}
+	flag.Visit(func(f *flag.Flag) {
+		r.Params[f.Name] = f.Value.String()
+	})
+
+	equity := c.backtestEquity()
+	profitLoss := profitLossPercent(c.backtestCashStart, equity)
+	symbolProfitLoss := profitLossPercent(c.backtestHistory.symbolStartPrice, c.backtestEndPrice())
+	s := &r.Stats
+	s.StartingCash = floatOf(c.backtestCashStart)
+	s.EndingCash = floatOf(c.backtestCash)
+	s.EndingHeldShares = floatOf(c.backtestStockHeldQty)
+	s.EndingEquity = floatOf(equity)
+	s.ProfitLossPercent = floatOf(profitLoss)
+	s.SymbolProfitLossPercent = floatOf(symbolProfitLoss)
+	s.AlgoBenefitPercent = floatOf(profitLoss.Sub(symbolProfitLoss))
+	s.Trades = c.backtestTrades
+	s.SlippagePaid = floatOf(c.backtestSlippage)
+	s.CommissionsPaid = floatOf(c.backtestCommissions)
+	s.MarginInterestPaid = floatOf(c.backtestMarginInterest)
+	s.CashInterestEarned = floatOf(c.backtestCashInterest)
+	s.ShortBorrowFeesPaid = floatOf(c.backtestShortBorrowFees)
+	s.UnprotectedPurchaseMinutes = c.backtestUnprotected
+	s.TerminatedBy = c.backtestTermination()
+	s.BenchmarkSymbol = c.benchmarkName()
+	s.BenchmarkProfitLossPercent = floatOf(c.benchmarkProfitLoss())
+	s.ExcessReturnPercent = floatOf(profitLoss.Sub(c.benchmarkProfitLoss()))
+	bench := newBenchmarkStats(c.backtestDayReturns)
+	s.BenchmarkUpDays, s.BenchmarkDownDays = bench.upDays, bench.downDays
+	s.Beta, s.AlphaPercent, s.UpCapturePercent, s.DownCapturePercent = bench.beta, bench.alpha, bench.upCapture, bench.downCapture
+	for _, t := range r.Trades {
+		switch {
+		case t.ProfitLoss == nil:
+		case *t.ProfitLoss > 0:
+			s.Wins++
+			s.GrossProfit += *t.ProfitLoss
+		default:
+			s.Losses++
+			s.GrossLoss -= *t.ProfitLoss
+		}
+	}
+	if n := s.Wins + s.Losses; n > 0 {
+		s.WinRatePercent = float64(s.Wins) / float64(n) * 100
+	}
+	if s.GrossLoss > 0 {
+		pf := s.GrossProfit / s.GrossLoss
+		s.ProfitFactor = &pf
+	}
+	var peak float64
+	for _, e := range r.EquityCurve {
+		if e.Equity > peak {
+			peak = e.Equity
+		}
+		if peak > 0 && (peak-e.Equity)/peak*100 > s.MaxDrawdownPercent {
+			s.MaxDrawdownPercent = (peak - e.Equity) / peak * 100
+		}
+	}
+
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal backtest result: %v", err)
+	}
+	if err := ioutil.WriteFile(c.cfg.BacktestOutputJSON, b, 0644); err != nil {
+		return fmt.Errorf("unable to write %q: %v", c.cfg.BacktestOutputJSON, err)
+	}
+	return nil
+}
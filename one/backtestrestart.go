@@ -0,0 +1,204 @@
+// Example command line to run:
+// go run . -run_backtest=true -backtest_file=SPY_sample.txt -backtest_starttime="2020-01-02 04:00:00" -max_concurrent_purchases=20 -purchase_quanity=10 -backtest_restart_at="2020-01-02 11:30:00,2020-01-03 14:00:00"
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+)
+
+var (
+	backtestRestartAt = flag.String("backtest_restart_at", "", "A comma separated list of times in EST (format: 2006-01-02 15:04:05) when the backtest simulates a restart of the trader during the session. The in-memory state is dropped and the purchases are reloaded from the fake database and reconciled with the simulated broker. The backtest is run once without and once with the restarts, using the same backtest_seed, and the outcomes are compared.")
+	backtestSeed      = flag.Int64("backtest_seed", 0, "The seed of the random fills of the backtest. When 0, a seed is chosen from the current time and printed.")
+)
+
+// restartCheckValue is a value of the outcome of a backtest which must be the
+// same whether or not the trader restarted.
+type restartCheckValue struct {
+	name  string
+	value string
+}
+
+// parseRestartTimes parses backtest_restart_at.
+func parseRestartTimes(s string) ([]time.Time, error) {
+	var times []time.Time
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		t, err := time.ParseInLocation(referenceTime, v, EST)
+		if err != nil {
+			return nil, fmt.Errorf("invalid restart time %q: %v", v, err)
+		}
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times, nil
+}
+
+// restartCheck runs the backtest without restarts and then with the restarts,
+// from the same seed, and reports whether the outcomes match. The summary of
+// the restarted backtest is printed as usual.
+func restartCheck(h *history, cfg ClientConfig, seed int64, restarts []time.Time) error {
+	rand.Seed(seed)
+	clean, err := newFake(h, cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("backtest is beginning without restarts")
+	clean.simulate()
+
+	rand.Seed(seed)
+	c, err := newFake(h, cfg)
+	if err != nil {
+		return err
+	}
+	c.backtestRestarts = restarts
+	log.Printf("backtest is beginning with %v restarts", len(restarts))
+	fmt.Printf("starting cash: %v\n", c.backtestCash.StringFixed(2))
+	c.simulate()
+	printBacktestSummary(c)
+	if cfg.BacktestOutputJSON != "" {
+		if err := writeBacktestJSON(c, seed); err != nil {
+			log.Printf("unable to write backtest result: %v", err)
+		}
+	}
+
+	want, got := clean.restartCheckValues(), c.restartCheckValues()
+	mismatches := 0
+	fmt.Printf("Restart Check (%v restarts):\n", len(restarts))
+	for i := range want {
+		result := "ok"
+		if want[i].value != got[i].value {
+			result = "MISMATCH"
+			mismatches++
+		}
+		fmt.Printf("  %v: without restarts %v, with restarts %v %v\n", want[i].name, want[i].value, got[i].value, result)
+	}
+	if mismatches > 0 {
+		fmt.Printf("Restart Check: %v of %v values differ\n", mismatches, len(want))
+		return nil
+	}
+	fmt.Printf("Restart Check: the restarted backtest matches\n")
+	return nil
+}
+
+// restartCheckValues returns the outcome of the backtest.
+func (c *client) restartCheckValues() []restartCheckValue {
+	held := 0
+	for _, p := range c.purchases {
+		if p.BuyFilled() && !p.SellFilled() {
+			held++
+		}
+	}
+	return []restartCheckValue{
+		{"Ending Cash", c.backtestCash.StringFixed(2)},
+		{"Ending Held Shares", c.backtestStockHeldQty.String()},
+		{"Ending Equity", c.backtestEquity().StringFixed(2)},
+		{"Trades", fmt.Sprint(c.backtestTrades)},
+		{"Purchases Sold", fmt.Sprint(len(c.backtestSold))},
+		{"Purchases Held", fmt.Sprint(held)},
+		{"Unprotected Purchase Minutes", fmt.Sprint(c.backtestUnprotected)},
+	}
+}
+
+// maybeFakeRestart simulates a restart once the clock reaches the next
+// restart time.
+func (c *client) maybeFakeRestart() {
+	if len(c.backtestRestarts) == 0 || c.backtestClock.Now.Before(c.backtestRestarts[0]) {
+		return
+	}
+	c.backtestRestarts = c.backtestRestarts[1:]
+	if err := c.fakeRestart(); err != nil {
+		log.Printf("unable to simulate a restart: %v", err)
+	}
+}
+
+// fakeRestart simulates restarting the trader. Everything held in memory is
+// lost, the purchases are reloaded from the database as new() does, and they
+// are reconciled with the orders of the simulated broker as adoptRecentOrders
+// and refreshing the orders do.
+func (c *client) fakeRestart() error {
+	now := c.backtestClock.Now
+	log.Printf("simulating a restart @ %v", now)
+
+	// The orders of the purchases are the simulated broker's orders. The
+	// legs of TWAP buys and emulated sells are orders of the broker, but the
+	// orders which hold them are only known to the trader.
+	broker := map[string]*alpaca.Order{}
+	legs := map[string]alpaca.Order{}
+	var open []alpaca.Order
+	for _, p := range c.purchases {
+		for _, o := range []*alpaca.Order{p.BuyOrder, p.SellOrder} {
+			switch {
+			case o == nil:
+			case isTWAP(o) || isSyntheticOCO(o):
+				for _, leg := range *o.Legs {
+					if leg.ID == "" {
+						continue
+					}
+					legs[leg.ID] = leg
+					if !closedOrderStatuses[leg.Status] {
+						open = append(open, leg)
+					}
+				}
+			default:
+				broker[o.ID] = o
+				if !closedOrderStatuses[o.Status] {
+					open = append(open, *o)
+				}
+			}
+		}
+	}
+
+	purchases, err := loadPurchases(c.dbClient, c.strategy, c.stockSymbol, c.cfg, now)
+	if err != nil {
+		return err
+	}
+	c.purchases = purchases
+	c.orders = newExecutionQueue()
+	c.lastSlope = 0
+	c.lastExternalReason = ""
+	c.lastSignal = now
+	c.restoreStrategyState()
+	c.flattenedFor = nil
+	c.ocoRejected = false
+	c.breaker = newDrawdownBreaker(c.cfg)
+
+	for _, p := range c.purchases {
+		p.BuyOrder = reconcileFakeOrder(p.BuyOrder, broker, legs)
+		p.SellOrder = reconcileFakeOrder(p.SellOrder, broker, legs)
+	}
+	log.Printf("reloaded %v purchases after the restart", len(c.purchases))
+	return c.adoptOrders(open)
+}
+
+// reconcileFakeOrder returns the simulated broker's order in place of the
+// stored order. The legs of TWAP buys and emulated sells are updated in
+// place.
+func reconcileFakeOrder(o *alpaca.Order, broker map[string]*alpaca.Order, legs map[string]alpaca.Order) *alpaca.Order {
+	switch {
+	case o == nil:
+		return nil
+	case isTWAP(o) || isSyntheticOCO(o):
+		for i := range *o.Legs {
+			leg := &(*o.Legs)[i]
+			if latest, ok := legs[leg.ID]; ok && leg.ID != "" {
+				*leg = latest
+			}
+		}
+		return o
+	}
+	if latest, ok := broker[o.ID]; ok {
+		return latest
+	}
+	return o
+}
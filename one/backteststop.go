@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestStopEquity    = flag.Float64("backtest_stop_equity", 0, "If positive, the backtest stops early once the equity drops below this many dollars, so sweeps do not spend time on parameters which already failed.")
+	backtestStopMaxTrades = flag.Int("backtest_stop_max_trades", 0, "If positive, the backtest stops early once this many trades were made.")
+	backtestStopAt        = flag.String("backtest_stop_at", "", "If set, the backtest stops early at this time in EST (format: 2006-01-02 15:04:05, or 2006-01-02 for the start of the day) instead of at the end of the backtest file.")
+)
+
+// endOfHistory is why a backtest which ran over all of its history stopped.
+const endOfHistory = "end of history"
+
+// backtestStopTime is the time of backtest_stop_at, or zero if it is not set.
+var backtestStopTime time.Time
+
+// parseBacktestStop parses backtest_stop_at and returns an error if the early
+// stop flags are invalid.
+func parseBacktestStop() error {
+	if *backtestStopEquity < 0 || *backtestStopMaxTrades < 0 {
+		return fmt.Errorf("backtest_stop_equity and backtest_stop_max_trades cannot be negative")
+	}
+	if *backtestStopAt == "" {
+		return nil
+	}
+	t, err := time.ParseInLocation(referenceTime, *backtestStopAt, EST)
+	if err != nil {
+		if t, err = time.ParseInLocation("2006-01-02", *backtestStopAt, EST); err != nil {
+			return fmt.Errorf("invalid backtest_stop_at %q: %v", *backtestStopAt, err)
+		}
+	}
+	backtestStopTime = t
+	return nil
+}
+
+// backtestStopDue stops the backtest once the clock reached its stop time,
+// backtest_stop_at unless it runs over a walk-forward window, even while the
+// market is closed. It returns true if the backtest stopped.
+func (c *client) backtestStopDue() bool {
+	if c.backtestTerminated != "" {
+		return true
+	}
+	if c.backtestStopAt.IsZero() || c.backtestClock.Now.Before(c.backtestStopAt) {
+		return false
+	}
+	c.stopBacktest(c.backtestHistory.priceAt(c.backtestClock.Now), "reached the stop time of %v", c.backtestStopAt.In(EST).Format(referenceTime))
+	return true
+}
+
+// checkBacktestStop stops the backtest once the equity at the current price
+// is below backtest_stop_equity or backtest_stop_max_trades were made.
+func (c *client) checkBacktestStop() {
+	price := c.fakeCurrentPrice().Close
+	equity := c.backtestCash.Add(c.backtestStockHeldQty.Mul(price))
+	switch {
+	case c.cfg.BacktestStopEquity > 0 && equity.LessThan(decimal.NewFromFloat(c.cfg.BacktestStopEquity)):
+		c.stopBacktest(price, "equity of $%v fell below backtest_stop_equity of $%v", equity.StringFixed(2), c.cfg.BacktestStopEquity)
+	case c.cfg.BacktestStopMaxTrades > 0 && c.backtestTrades >= c.cfg.BacktestStopMaxTrades:
+		c.stopBacktest(price, "reached backtest_stop_max_trades of %v", c.cfg.BacktestStopMaxTrades)
+	}
+}
+
+// stopBacktest stops the backtest early for the reason. The shares still held
+// are valued at price.
+func (c *client) stopBacktest(price decimal.Decimal, format string, a ...interface{}) {
+	c.backtestTerminated = fmt.Sprintf(format, a...) + " @ " + c.backtestClock.Now.In(EST).Format(referenceTime)
+	c.backtestStopPrice = price
+}
+
+// priceAt returns the close of the last minute of the history before t, or
+// zero if there is none within a week.
+func (h *history) priceAt(t time.Time) decimal.Decimal {
+	m := timeToMinuteStart(t)
+	for i := 0; i < 7*24*60; i++ {
+		m = m.Add(-time.Minute)
+		if d, ok := h.epochToTickerData[m.Unix()]; ok {
+			return d.Close
+		}
+	}
+	return decimal.Zero
+}
+
+// backtestEndPrice returns the price of the symbol when the backtest ended,
+// which is earlier than the end of the history if it stopped early.
+func (c *client) backtestEndPrice() decimal.Decimal {
+	if c.backtestStopPrice.IsPositive() {
+		return c.backtestStopPrice
+	}
+	return c.backtestHistory.symbolEndPrice
+}
+
+// backtestTermination returns why the backtest stopped.
+func (c *client) backtestTermination() string {
+	if c.backtestTerminated == "" {
+		return endOfHistory
+	}
+	return c.backtestTerminated
+}
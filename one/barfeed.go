@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/stream"
+)
+
+var (
+	streamBars    = flag.Bool("stream_bars", false, "If true, minute bars are streamed and kept in memory, starting with the latest bars requested at startup, so buy signals can be evaluated immediately without requesting bars each time.")
+	buyOnBarClose = flag.Bool("buy_on_bar_close", true, "If true and stream_bars is set, buy signals are evaluated as soon as a streamed bar closes, instead of waiting for the next tick. Ticks then skip buy signals whose bars were already evaluated.")
+)
+
+const (
+	// maxBarAge is the age of the start of the latest bar after which the
+	// streamed bars are considered stale and bars are requested instead. A
+	// minute bar is only streamed once its minute has ended.
+	maxBarAge = 3 * time.Minute
+
+	// feedTimeframe is the timeframe of the streamed bars.
+	feedTimeframe = "1Min"
+)
+
+// barFeed holds the latest minute bars of a symbol. It is preloaded with
+// requested bars and then kept up to date with streamed bars.
+type barFeed struct {
+	symbol string
+	size   int
+
+	mu   sync.Mutex
+	bars []alpaca.Bar
+}
+
+// barFeeds are the bar feeds by symbol. Clients trading the same symbol share
+// a feed, since a stream has a single handler.
+var (
+	barFeedsMu sync.Mutex
+	barFeeds   = map[string]*barFeed{}
+)
+
+// symbolBarFeed returns the bar feed of the symbol, or nil if its bars are
+// not streamed.
+func symbolBarFeed(symbol string) *barFeed {
+	barFeedsMu.Lock()
+	defer barFeedsMu.Unlock()
+	return barFeeds[symbol]
+}
+
+// startBarFeeds preloads and streams the bars of each client's symbol which
+// is not streamed yet. Bars are only streamed for clients using 1Min bars.
+func startBarFeeds(clients []*client) {
+	sizes := map[string]int{}
+	for _, c := range clients {
+		if c.cfg.BarTimeframe != feedTimeframe {
+			log.Printf("bars of %v are not streamed for %v, since only %v bars can be streamed", c.stockSymbol, c.strategy, feedTimeframe)
+			continue
+		}
+		if c.cfg.Params.numHistoricalBars > sizes[c.stockSymbol] {
+			sizes[c.stockSymbol] = c.cfg.Params.numHistoricalBars
+		}
+	}
+	var started []*barFeed
+	barFeedsMu.Lock()
+	for symbol, size := range sizes {
+		if _, ok := barFeeds[symbol]; ok {
+			continue
+		}
+		f := &barFeed{symbol: symbol, size: size}
+		barFeeds[symbol] = f
+		started = append(started, f)
+	}
+	barFeedsMu.Unlock()
+	for _, f := range started {
+		if err := f.preload(clients[0].alpacaClient, time.Now()); err != nil {
+			log.Printf("unable to preload bars of %v: %v", f.symbol, err)
+		}
+		if err := stream.Register(barStream(f.symbol), f.handleAgg); err != nil {
+			log.Printf("unable to stream bars of %v: %v", f.symbol, err)
+		}
+	}
+}
+
+// barStream returns the name of the stream of minute bars of the symbol.
+func barStream(symbol string) string {
+	return "AM." + symbol
+}
+
+// preload requests the latest bars.
+func (f *barFeed) preload(alpacaClient *alpaca.Client, now time.Time) error {
+	limit := f.size
+	start := now.Add(-time.Duration(f.size) * time.Minute)
+	bars, err := alpacaClient.GetSymbolBars(f.symbol, alpaca.ListBarParams{
+		Timeframe: feedTimeframe,
+		StartDt:   &start,
+		EndDt:     &now,
+		Limit:     &limit,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get bars: %v", err)
+	}
+	for _, b := range bars {
+		f.add(b)
+	}
+	log.Printf("preloaded %v bars of %v", len(bars), f.symbol)
+	return nil
+}
+
+// handleAgg adds a streamed minute bar. A bar is streamed once its minute
+// has ended, so a new latest bar is a bar close.
+func (f *barFeed) handleAgg(msg interface{}) {
+	agg, ok := msg.(alpaca.StreamAgg)
+	if !ok {
+		return
+	}
+	latest := f.add(alpaca.Bar{
+		Time:   agg.Start / 1000,
+		Open:   agg.Open,
+		High:   agg.High,
+		Low:    agg.Low,
+		Close:  agg.Close,
+		Volume: agg.Volume,
+	})
+	if latest && *buyOnBarClose {
+		barClosed(f.symbol, time.Now())
+	}
+}
+
+// add merges the bar into the feed. A bar for a minute which is already held
+// replaces it, so streamed bars take precedence over preloaded ones. It
+// returns true if the bar is the new latest bar.
+func (f *barFeed) add(b alpaca.Bar) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	latest := len(f.bars) == 0 || b.Time > f.bars[len(f.bars)-1].Time
+	i := len(f.bars)
+	for i > 0 && f.bars[i-1].Time >= b.Time {
+		i--
+	}
+	switch {
+	case i < len(f.bars) && f.bars[i].Time == b.Time:
+		f.bars[i] = b
+	default:
+		f.bars = append(f.bars, alpaca.Bar{})
+		copy(f.bars[i+1:], f.bars[i:])
+		f.bars[i] = b
+	}
+	if len(f.bars) > f.size {
+		f.bars = f.bars[len(f.bars)-f.size:]
+	}
+	return latest
+}
+
+// barClosed evaluates the buy signals of the clients trading the symbol on
+// streamed bars, at t. The evaluation is queued as the next tick of their
+// shards, so it is skipped when a tick is already waiting, which evaluates
+// the same bars.
+func barClosed(symbol string, t time.Time) {
+	if !trading {
+		return
+	}
+	clients, _ := currentSession.snapshot()
+	var streamed []*client
+	for _, c := range clients {
+		if c.stockSymbol == symbol && c.cfg.BarTimeframe == feedTimeframe {
+			streamed = append(streamed, c)
+		}
+	}
+	order, groups := byShard(streamed)
+	for _, s := range order {
+		group := groups[s]
+		run := func() {
+			for _, c := range group {
+				if c.isTrading() {
+					c.buy(t)
+				}
+			}
+		}
+		if s == nil {
+			go run()
+			continue
+		}
+		if !s.tick(run) {
+			log.Printf("%v is still busy, a tick will evaluate the bar closed @ %v", s.symbol, t)
+		}
+	}
+}
+
+// evaluatedBar returns whether the buy signal was already evaluated with the
+// streamed bars, when signals are evaluated on bar close. Otherwise the
+// latest bar is recorded as evaluated.
+func (c *client) evaluatedBar(bars []alpaca.Bar) bool {
+	if !c.cfg.BuyOnBarClose || external != nil || signals != nil || len(bars) == 0 {
+		return false
+	}
+	latest := bars[len(bars)-1].Time
+	if latest == c.barEvaluated {
+		return true
+	}
+	c.barEvaluated = latest
+	return false
+}
+
+// recent returns the latest n bars. It returns false if there are fewer than
+// n bars or the latest bar is stale.
+func (f *barFeed) recent(n int, now time.Time) ([]alpaca.Bar, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n > len(f.bars) {
+		return nil, false
+	}
+	if now.Sub(time.Unix(f.bars[len(f.bars)-1].Time, 0)) > maxBarAge {
+		return nil, false
+	}
+	bars := make([]alpaca.Bar, n)
+	copy(bars, f.bars[len(f.bars)-n:])
+	return bars, true
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestBenchmarkFile   = flag.String("backtest_benchmark_file", "", "A file of the prices of the benchmark the backtest is compared with, in the format of backtest_file, e.g. SPY while another symbol is traded. Defaults to the traded symbol.")
+	backtestBenchmarkSymbol = flag.String("backtest_benchmark_symbol", "", "The symbol of backtest_benchmark_file, shown in the reports.")
+)
+
+// tradingDaysPerYear annualizes the daily alpha.
+const tradingDaysPerYear = 252
+
+// benchmarkPrices are the closes of the benchmark, in time order.
+type benchmarkPrices struct {
+	times  []time.Time
+	closes []decimal.Decimal
+}
+
+// loadBenchmark reads backtest_benchmark_file. It returns nil when the traded
+// symbol is the benchmark.
+func loadBenchmark() (*benchmarkPrices, error) {
+	if *backtestBenchmarkFile == "" {
+		return nil, nil
+	}
+	records, err := readBacktestFile(*backtestBenchmarkFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %q: %v", *backtestBenchmarkFile, err)
+	}
+	b := &benchmarkPrices{}
+	for _, r := range records {
+		b.times = append(b.times, r.time)
+		b.closes = append(b.closes, r.data.Close)
+	}
+	return b, nil
+}
+
+// at returns the latest close at or before t. It returns false if there is
+// none.
+func (b *benchmarkPrices) at(t time.Time) (decimal.Decimal, bool) {
+	i := sort.Search(len(b.times), func(i int) bool { return b.times[i].After(t) })
+	if i == 0 {
+		return decimal.Decimal{}, false
+	}
+	return b.closes[i-1], true
+}
+
+// benchmarkName returns the name of the benchmark in the reports.
+func (c *client) benchmarkName() string {
+	switch {
+	case c.backtestHistory.benchmark == nil:
+		return c.stockSymbol
+	case c.cfg.BacktestBenchmarkSymbol != "":
+		return c.cfg.BacktestBenchmarkSymbol
+	}
+	return c.cfg.BacktestBenchmarkFile
+}
+
+// benchmarkPrice returns the price of the benchmark now, where symbolPrice is
+// the price of the traded symbol. It returns false if the benchmark has no
+// price yet.
+func (c *client) benchmarkPrice(symbolPrice decimal.Decimal) (decimal.Decimal, bool) {
+	if c.backtestHistory.benchmark == nil {
+		return symbolPrice, true
+	}
+	return c.backtestHistory.benchmark.at(c.backtestClock.Now)
+}
+
+// startBenchmarkDay records the price of the benchmark the backtest starts
+// at. It is called at the start of each trading day.
+func (c *client) startBenchmarkDay() {
+	if !c.backtestBenchmarkStart.IsZero() {
+		return
+	}
+	if price, ok := c.benchmarkPrice(c.backtestSymbolStartOfDay); ok {
+		c.backtestBenchmarkStart = price
+		c.backtestBenchmarkClose = price
+		c.backtestEquityClose = c.backtestCash
+	}
+}
+
+// recordDayReturn records the close to close returns of the equity and the
+// benchmark for the trading day. It is called at the close of each trading
+// day.
+func (c *client) recordDayReturn() {
+	price, ok := c.benchmarkPrice(c.backtestSymbolEndOfDay)
+	if !ok || c.backtestBenchmarkClose.IsZero() {
+		return
+	}
+	equity := c.backtestCash.Add(c.backtestStockHeldQty.Mul(c.backtestSymbolEndOfDay))
+	c.backtestDayReturns = append(c.backtestDayReturns, dayReturn{
+		strategy:  floatOf(profitLossPercent(c.backtestEquityClose, equity)),
+		benchmark: floatOf(profitLossPercent(c.backtestBenchmarkClose, price)),
+	})
+	c.backtestEquityClose = equity
+	c.backtestBenchmarkClose = price
+}
+
+// benchmarkProfitLoss returns the profit/loss percentage of buying and
+// holding the benchmark from the start of the backtest.
+func (c *client) benchmarkProfitLoss() decimal.Decimal {
+	if c.backtestBenchmarkStart.IsZero() {
+		return decimal.Zero
+	}
+	return profitLossPercent(c.backtestBenchmarkStart, c.backtestBenchmarkClose)
+}
+
+// dayReturn is the return of the strategy and the benchmark over a trading
+// day, in percent.
+type dayReturn struct {
+	strategy, benchmark float64
+}
+
+// benchmarkStats compare the daily returns of the strategy with those of the
+// benchmark. Returns are in percent.
+type benchmarkStats struct {
+	days, upDays, downDays int
+	// beta is the sensitivity of the strategy to the benchmark, and alpha is
+	// the annualized return of the strategy not explained by beta. They are
+	// unset with fewer than two days, or when the benchmark never moved.
+	beta, alpha *float64
+	// upCapture and downCapture are the average return of the strategy on the
+	// days the benchmark rose and fell, as a percentage of the benchmark's
+	// average return on those days. They are unset without such days.
+	upCapture, downCapture *float64
+}
+
+// newBenchmarkStats computes the stats of the daily returns.
+func newBenchmarkStats(days []dayReturn) benchmarkStats {
+	s := benchmarkStats{days: len(days)}
+	var up, down dayReturn
+	var meanS, meanB float64
+	for _, d := range days {
+		meanS += d.strategy / float64(len(days))
+		meanB += d.benchmark / float64(len(days))
+		switch {
+		case d.benchmark > 0:
+			s.upDays++
+			up.strategy += d.strategy
+			up.benchmark += d.benchmark
+		case d.benchmark < 0:
+			s.downDays++
+			down.strategy += d.strategy
+			down.benchmark += d.benchmark
+		}
+	}
+	if s.upDays > 0 {
+		capture := 100 * up.strategy / up.benchmark
+		s.upCapture = &capture
+	}
+	if s.downDays > 0 {
+		capture := 100 * down.strategy / down.benchmark
+		s.downCapture = &capture
+	}
+
+	var cov, variance float64
+	for _, d := range days {
+		cov += (d.strategy - meanS) * (d.benchmark - meanB)
+		variance += (d.benchmark - meanB) * (d.benchmark - meanB)
+	}
+	if len(days) >= 2 && variance > 0 {
+		beta := cov / variance
+		alpha := (meanS - beta*meanB) * tradingDaysPerYear
+		s.beta, s.alpha = &beta, &alpha
+	}
+	return s
+}
+
+// String returns the stats, e.g. "beta 0.42, alpha 3.100%/year, up capture
+// 38.2% (12 days), down capture 21.0% (9 days)".
+func (s benchmarkStats) String() string {
+	format := func(f *float64, layout string) string {
+		if f == nil {
+			return "n/a"
+		}
+		return fmt.Sprintf(layout, *f)
+	}
+	return fmt.Sprintf("beta %v, alpha %v, up capture %v (%v days), down capture %v (%v days)",
+		format(s.beta, "%.2f"), format(s.alpha, "%.3f%%/year"),
+		format(s.upCapture, "%.1f%%"), s.upDays, format(s.downCapture, "%.1f%%"), s.downDays)
+}
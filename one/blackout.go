@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	blackoutCalendarSource = flag.String("blackout_calendar", "", "A JSON calendar of earnings announcements and macro events, as a file or an http(s) URL. No new purchases are made of a symbol on the day of its earnings, or around macro events.")
+	macroBlackoutBefore    = flag.Duration("macro_blackout_before", 15*time.Minute, "No new purchases are made from this long before a macro event.")
+	macroBlackoutAfter     = flag.Duration("macro_blackout_after", 15*time.Minute, "No new purchases are made until this long after a macro event.")
+	flattenBeforeMacro     = flag.Bool("flatten_before_macro", false, "If true, open purchases are sold and unfilled buy orders cancelled when a macro event's blackout starts.")
+)
+
+// blackoutCalendar is the contents of the blackout calendar, e.g.
+//
+//	{
+//	  "earnings": [{"symbol": "AAPL", "date": "2020-01-28"}],
+//	  "macro": [{"name": "FOMC", "time": "2020-01-29T14:00:00-05:00"}]
+//	}
+//
+// Earnings dates are in exchange time.
+type blackoutCalendar struct {
+	Earnings []struct {
+		Symbol string `json:"symbol"`
+		Date   string `json:"date"`
+	} `json:"earnings"`
+	Macro []macroEvent `json:"macro"`
+
+	earningsDays map[string]bool // Keyed by symbol and date.
+}
+
+// macroEvent is a scheduled event which moves the whole market, e.g. an FOMC
+// announcement or CPI release.
+type macroEvent struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// blackouts is the loaded blackout calendar. It is nil when no calendar is
+// set.
+var blackouts *blackoutCalendar
+
+// loadBlackoutCalendar loads the calendar set with blackout_calendar.
+func loadBlackoutCalendar() error {
+	if *blackoutCalendarSource == "" {
+		return nil
+	}
+	b, err := readSource(*blackoutCalendarSource)
+	if err != nil {
+		return fmt.Errorf("unable to read blackout calendar: %v", err)
+	}
+	cal := &blackoutCalendar{}
+	if err := json.Unmarshal(b, cal); err != nil {
+		return fmt.Errorf("unable to parse blackout calendar: %v", err)
+	}
+	cal.earningsDays = map[string]bool{}
+	for _, e := range cal.Earnings {
+		if _, err := time.ParseInLocation("2006-01-02", e.Date, EST); err != nil {
+			return fmt.Errorf("invalid earnings date for %v: %v", e.Symbol, err)
+		}
+		cal.earningsDays[strings.ToUpper(e.Symbol)+"/"+e.Date] = true
+	}
+	blackouts = cal
+	log.Printf("loaded blackout calendar with %v earnings announcements and %v macro events", len(cal.Earnings), len(cal.Macro))
+	return nil
+}
+
+// readSource reads the contents of a file or an http(s) URL.
+func readSource(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+	resp, err := http.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v returned %v", source, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// earnings returns true if the symbol announces earnings on the day of t.
+func (b *blackoutCalendar) earnings(symbol string, t time.Time) bool {
+	return b.earningsDays[symbol+"/"+t.In(EST).Format("2006-01-02")]
+}
+
+// macroBlackout returns the macro event whose blackout t is in, if any.
+func (b *blackoutCalendar) macroBlackout(t time.Time) (macroEvent, bool) {
+	for _, e := range b.Macro {
+		if !t.Before(e.Time.Add(-*macroBlackoutBefore)) && t.Before(e.Time.Add(*macroBlackoutAfter)) {
+			return e, true
+		}
+	}
+	return macroEvent{}, false
+}
+
+// blackedOut returns the reason the client may not buy at t, or "" if it may.
+func (c *client) blackedOut(t time.Time) string {
+	if blackouts == nil {
+		return ""
+	}
+	if blackouts.earnings(c.stockSymbol, t) {
+		return fmt.Sprintf("%v announces earnings today", c.stockSymbol)
+	}
+	if e, ok := blackouts.macroBlackout(t); ok {
+		return fmt.Sprintf("%v @ %v", e.Name, e.Time.In(EST).Format("15:04 MST"))
+	}
+	return ""
+}
+
+// flattenForMacro sells open purchases and cancels unfilled buy orders once
+// when a macro event's blackout starts.
+func (c *client) flattenForMacro(t time.Time) {
+	if blackouts == nil || !c.cfg.FlattenBeforeMacro {
+		return
+	}
+	e, ok := blackouts.macroBlackout(t)
+	if !ok || c.flattenedFor[e.Time] {
+		return
+	}
+	if c.flattenedFor == nil {
+		c.flattenedFor = map[time.Time]bool{}
+	}
+	c.flattenedFor[e.Time] = true
+	log.Printf("flattening before %v @ %v", e.Name, e.Time.In(EST).Format("15:04 MST"))
+	c.flatten(t, "before "+e.Name)
+}
+
+// flatten cancels the unfilled buys and sells the held purchases at market.
+// why explains the reason in the logs.
+func (c *client) flatten(t time.Time, why string) {
+	for _, p := range c.inProgressBuyOrders() {
+		c.cancelEntry(p, t)
+	}
+	for _, p := range c.purchases {
+		if !p.BuyFilled() || p.SellFilled() {
+			continue
+		}
+		if err := c.forceExit(p, t); err != nil {
+			log.Printf("unable to sell purchase %d %v: %v", p.ID, why, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	bracketEntries = flag.Bool("bracket_entries", false, "If true, buys are placed as Alpaca bracket orders, so the take profit and stop loss legs which sell the purchase are attached when the buy is placed instead of being placed once it fills. The legs are priced from the limit price of the buy, or the latest close for market buys. Requires sell_mode=oco, and is not used for TWAP buys or while sells are emulated.")
+)
+
+// validateBracketEntries returns an error if bracket_entries cannot be used
+// with the other flags.
+func validateBracketEntries() error {
+	if *bracketEntries && *sellMode != sellModeOCO {
+		return fmt.Errorf("bracket_entries requires sell_mode=%v, not %v", sellModeOCO, *sellMode)
+	}
+	return nil
+}
+
+// bracketing returns true if buys are placed as bracket orders.
+func (c *client) bracketing() bool {
+	return c.cfg.BracketEntries && c.cfg.Params.sellMode == sellModeOCO && !c.emulatingOCO()
+}
+
+// bracketRequest makes the buy order request a bracket order, whose legs are
+// priced like the sell order placed once a buy fills, from the price the buy
+// is expected to fill at.
+func (c *client) bracketRequest(req *alpaca.PlaceOrderRequest, bars []alpaca.Bar, takeProfit *decimal.Decimal) {
+	basePrice := float64(bars[len(bars)-1].Close)
+	if req.LimitPrice != nil {
+		basePrice, _ = req.LimitPrice.Float64()
+	}
+	profitLimitPrice, stopPrice, lossLimitPrice := ocoSellPrices(basePrice, takeProfit)
+	req.OrderClass = alpaca.Bracket
+	req.TakeProfit = &alpaca.TakeProfit{
+		LimitPrice: &profitLimitPrice,
+	}
+	req.StopLoss = &alpaca.StopLoss{
+		StopPrice:  &stopPrice,
+		LimitPrice: &lossLimitPrice,
+	}
+	c.adjustOCOPrices(req, 0)
+}
+
+// syncBracketSell sets the sell order of a purchase bought with a bracket
+// order to the bracket's legs once the buy filled, and again each time the
+// buy order is updated. Simulated legs are only set once, since the simulated
+// fills are made on the sell order. It returns true if the sell order was
+// set.
+func (c *client) syncBracketSell(p *purchase.Purchase) bool {
+	if !p.BracketEntry() || !p.BuyFilled() {
+		return false
+	}
+	first := p.SellOrder == nil
+	if !first && (!p.SellingWithBracket() || c.cfg.Backtest || c.shadow) {
+		return false
+	}
+	p.SellOrder = p.BracketSellOrder()
+	if first {
+		log.Printf("bracket legs sell purchase %d:\n%+v\n", p.ID, p.SellOrder)
+		c.narrateEntry(p, *p.SellOrder.LimitPrice, *(*p.SellOrder.Legs)[0].StopPrice)
+	}
+	return true
+}
+
+// simulatedBracketLegs returns the legs of a simulated bracket buy order with
+// the ID. They are held until the buy fills.
+func simulatedBracketLegs(req *alpaca.PlaceOrderRequest, id string) *[]alpaca.Order {
+	return &[]alpaca.Order{{
+		ID:          id + "-take-profit",
+		Symbol:      *req.AssetKey,
+		Qty:         req.Qty,
+		Side:        alpaca.Sell,
+		Type:        alpaca.Limit,
+		TimeInForce: req.TimeInForce,
+		LimitPrice:  req.TakeProfit.LimitPrice,
+		Status:      ocoHeld,
+	}, {
+		ID:          id + "-stop-loss",
+		Symbol:      *req.AssetKey,
+		Qty:         req.Qty,
+		Side:        alpaca.Sell,
+		Type:        alpaca.StopLimit,
+		TimeInForce: req.TimeInForce,
+		StopPrice:   req.StopLoss.StopPrice,
+		LimitPrice:  req.StopLoss.LimitPrice,
+		Status:      ocoHeld,
+	}}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	drawdownBreakerPercent = flag.Float64("drawdown_breaker_percent", 0, "When positive, no new purchases are made for the rest of the day once the equity falls this percentage from the day's peak equity. The breaker can be reset with a POST to /api/breaker/reset, see control_token.")
+	drawdownBreakerFlatten = flag.Bool("drawdown_breaker_flatten", false, "If true, open purchases are sold at market when the drawdown breaker trips.")
+	dailyLossLimit         = flag.Float64("daily_loss_limit", 0, "When positive, no new purchases are made for the rest of the day once the equity is this many dollars below the day's first equity, which counts the realized and unrealized profit and loss of the day. The limit is reset with the drawdown breaker, with a POST to /api/breaker/reset.")
+	dailyLossFlatten       = flag.Bool("daily_loss_flatten", false, "If true, open purchases are sold at market when the daily_loss_limit is hit.")
+)
+
+// drawdownBreaker tracks the day's first and peak equity, and trips when the
+// equity falls drawdown_breaker_percent from the peak or daily_loss_limit
+// dollars below the first. Live clients share one breaker for the account,
+// and each backtest run has its own.
+type drawdownBreaker struct {
+	percent          float64
+	lossLimit        float64
+	flattenDrawdown  bool
+	flattenDailyLoss bool
+
+	mu        sync.Mutex
+	day       string
+	start     decimal.Decimal
+	peak      decimal.Decimal
+	peakAt    time.Time
+	equity    decimal.Decimal
+	tripped   bool
+	trippedAt time.Time
+	trippedBy string // The rule which tripped the breaker.
+}
+
+// breaker is the breaker of the live account. It is set up in setup.
+var breaker = &drawdownBreaker{}
+
+// newDrawdownBreaker returns a breaker with the settings of the config.
+func newDrawdownBreaker(cfg ClientConfig) *drawdownBreaker {
+	return &drawdownBreaker{
+		percent:          cfg.DrawdownBreakerPercent,
+		lossLimit:        cfg.DailyLossLimit,
+		flattenDrawdown:  cfg.DrawdownBreakerFlatten,
+		flattenDailyLoss: cfg.DailyLossFlatten,
+	}
+}
+
+// breakerState is the state of the breaker served by the control API.
+type breakerState struct {
+	Enabled         bool       `json:"enabled"`
+	Tripped         bool       `json:"tripped"`
+	TrippedAt       *time.Time `json:"tripped_at,omitempty"`
+	TrippedBy       string     `json:"tripped_by,omitempty"`
+	Equity          string     `json:"equity"`
+	PeakEquity      string     `json:"peak_equity"`
+	PeakAt          *time.Time `json:"peak_at,omitempty"`
+	DrawdownPercent string     `json:"drawdown_percent"`
+	LimitPercent    float64    `json:"limit_percent"`
+	StartEquity     string     `json:"start_equity"`
+	DayLoss         string     `json:"day_loss"`
+	DailyLossLimit  float64    `json:"daily_loss_limit"`
+}
+
+// enabled returns true if drawdown_breaker_percent or daily_loss_limit is
+// set.
+func (b *drawdownBreaker) enabled() bool {
+	return b.percent > 0 || b.lossLimit > 0
+}
+
+// update records the equity at t. It returns true if the breaker tripped.
+// The first and peak equity and the breaker are reset at the start of each
+// day.
+func (b *drawdownBreaker) update(t time.Time, equity decimal.Decimal) bool {
+	if !b.enabled() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if day := t.In(EST).Format("2006-01-02"); day != b.day {
+		b.day = day
+		b.start = equity
+		b.peak = decimal.Zero
+		b.tripped = false
+		b.trippedBy = ""
+	}
+	b.equity = equity
+	if equity.GreaterThan(b.peak) {
+		b.peak = equity
+		b.peakAt = t
+	}
+	if b.tripped {
+		return false
+	}
+	switch {
+	case b.percent > 0 && !b.drawdownLocked().LessThan(decimal.NewFromFloat(b.percent)):
+		b.trippedBy = ruleDrawdownBreaker
+	case b.lossLimit > 0 && !b.dayLossLocked().LessThan(decimal.NewFromFloat(b.lossLimit)):
+		b.trippedBy = ruleDailyLoss
+	default:
+		return false
+	}
+	b.tripped = true
+	b.trippedAt = t
+	return true
+}
+
+// dayLossLocked returns how many dollars the equity is below the day's first
+// equity. b.mu must be held.
+func (b *drawdownBreaker) dayLossLocked() decimal.Decimal {
+	if !b.start.IsPositive() {
+		return decimal.Zero
+	}
+	return b.start.Sub(b.equity)
+}
+
+// drawdownLocked returns the percentage the equity is below the peak. b.mu
+// must be held.
+func (b *drawdownBreaker) drawdownLocked() decimal.Decimal {
+	if !b.peak.IsPositive() {
+		return decimal.Zero
+	}
+	return b.peak.Sub(b.equity).Div(b.peak).Mul(decimal.NewFromInt(100))
+}
+
+// isTripped returns true if the breaker has tripped today.
+func (b *drawdownBreaker) isTripped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tripped
+}
+
+// trippedRule returns the rule which tripped the breaker today, or "" if it
+// has not tripped.
+func (b *drawdownBreaker) trippedRule() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.tripped {
+		return ""
+	}
+	return b.trippedBy
+}
+
+// reset allows purchases again. The first and peak equity are reset to the
+// current equity, so the breaker trips again if the equity falls a further
+// drawdown_breaker_percent or daily_loss_limit.
+func (b *drawdownBreaker) reset(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tripped = false
+	b.trippedBy = ""
+	b.start = b.equity
+	b.peak = b.equity
+	b.peakAt = t
+}
+
+// state returns the state of the breaker.
+func (b *drawdownBreaker) state() *breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := &breakerState{
+		Enabled:         b.enabled(),
+		Tripped:         b.tripped,
+		Equity:          b.equity.StringFixed(2),
+		PeakEquity:      b.peak.StringFixed(2),
+		DrawdownPercent: b.drawdownLocked().StringFixed(2),
+		LimitPercent:    b.percent,
+		StartEquity:     b.start.StringFixed(2),
+		DayLoss:         b.dayLossLocked().StringFixed(2),
+		DailyLossLimit:  b.lossLimit,
+	}
+	if b.tripped {
+		trippedAt := b.trippedAt
+		s.TrippedAt = &trippedAt
+		s.TrippedBy = b.trippedBy
+	}
+	if !b.peakAt.IsZero() {
+		peakAt := b.peakAt
+		s.PeakAt = &peakAt
+	}
+	return s
+}
+
+// checkDrawdown records the equity at t with the breaker, and alerts and
+// optionally flattens the clients if the breaker trips.
+func checkDrawdown(b *drawdownBreaker, clients []*client, t time.Time, equity decimal.Decimal) {
+	if !b.update(t, equity) {
+		return
+	}
+	s := b.state()
+	what := "drawdown breaker tripped"
+	msg := fmt.Sprintf("equity $%v is %v%% below the day's peak of $%v, no new purchases are made today", s.Equity, s.DrawdownPercent, s.PeakEquity)
+	flatten := b.flattenDrawdown
+	if s.TrippedBy == ruleDailyLoss {
+		what = "daily loss limit hit"
+		msg = fmt.Sprintf("equity $%v is $%v below the day's first equity of $%v, no new purchases are made today", s.Equity, s.DayLoss, s.StartEquity)
+		flatten = b.flattenDailyLoss
+	}
+	for _, c := range clients {
+		if c.shadow {
+			continue
+		}
+		if !c.cfg.Backtest {
+			go c.alert(what + ": " + msg)
+		}
+		c.narrate(t, "%v, %v", what, msg)
+		if flatten {
+			c.do(func() { c.flatten(t, "the "+what) })
+		}
+	}
+}
+
+// liveEquity returns the equity of the account.
+func liveEquity(c *client) (decimal.Decimal, error) {
+	a, err := c.alpacaClient.GetAccount()
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("unable to get account: %v", err)
+	}
+	return a.Equity, nil
+}
+
+// writeBreaker writes the state of the breaker for the status page.
+func writeBreaker(w io.Writer) {
+	s := breaker.state()
+	if !s.Enabled {
+		return
+	}
+	status := "ok"
+	if s.Tripped {
+		status = fmt.Sprintf("TRIPPED by %v @ %v, no new purchases", s.TrippedBy, s.TrippedAt.In(EST).Format("15:04 MST"))
+	}
+	fmt.Fprintf(w, "\nDrawdown breaker: %v (equity $%v, peak $%v, drawdown %v%% of %v%%, day's loss $%v of $%.2f)\n",
+		status, s.Equity, s.PeakEquity, s.DrawdownPercent, s.LimitPercent, s.DayLoss, s.DailyLossLimit)
+}
+
+// serveBreaker serves the state of the breaker as JSON.
+func serveBreaker(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(breaker.state()); err != nil {
+		log.Printf("unable to encode breaker state: %v", err)
+	}
+}
+
+// serveBreakerReset resets the breaker. It must be an authorized POST, see
+// authorizeControl.
+func serveBreakerReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "reset the breaker with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeControl(w, r) {
+		log.Printf("refused an unauthorized reset of the drawdown breaker from %v", r.RemoteAddr)
+		return
+	}
+	breaker.reset(time.Now())
+	log.Printf("drawdown breaker was reset from %v", r.RemoteAddr)
+	serveBreaker(w, r)
+}
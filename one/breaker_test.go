@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestDrawdownBreakerPerRun(t *testing.T) {
+	cfg := ClientConfig{DrawdownBreakerPercent: 1}
+	day := time.Date(2021, 1, 4, 10, 0, 0, 0, EST)
+
+	first := newDrawdownBreaker(cfg)
+	first.update(day, decimal.NewFromInt(100))
+	if !first.update(day.Add(time.Minute), decimal.NewFromInt(98)) {
+		t.Fatalf("breaker did not trip after a 2%% drawdown with drawdown_breaker_percent=1")
+	}
+	if got := first.trippedRule(); got != ruleDrawdownBreaker {
+		t.Errorf("trippedRule() = %q, want %q", got, ruleDrawdownBreaker)
+	}
+
+	// The next run of a sweep over the same day starts with its own breaker.
+	second := newDrawdownBreaker(cfg)
+	if second.update(day, decimal.NewFromInt(100)) || second.isTripped() {
+		t.Errorf("breaker of the next run is tripped by the drawdown of the previous run")
+	}
+
+	if newDrawdownBreaker(ClientConfig{}).update(day, decimal.Zero) {
+		t.Errorf("breaker tripped without drawdown_breaker_percent or daily_loss_limit")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var (
+	backtestBrokerLatency = flag.Duration("backtest_broker_latency", 0, "How long each call to the simulated broker takes to reach it in backtests, in simulated time, e.g. 50ms. Orders can only fill and cancels only take effect once the simulated clock passes the latency. Calls are instantaneous by default, which hides bugs which only appear when calls are slow, e.g. fills racing cancels.")
+	backtestBrokerJitter  = flag.Duration("backtest_broker_jitter", 0, "A random extra delay of up to this long which is added to each call to the simulated broker.")
+)
+
+// fakeLatency returns how long a call to the simulated broker takes. The
+// jitter is drawn from the client's own source so that it does not shift the
+// random fills of the backtest seed.
+func (c *client) fakeLatency() time.Duration {
+	d := c.cfg.BacktestBrokerLatency
+	if c.cfg.BacktestBrokerJitter > 0 {
+		d += time.Duration(c.backtestLatencyRand.Int63n(int64(c.cfg.BacktestBrokerJitter)))
+	}
+	return d
+}
+
+// fakeArrival returns the simulated time at which a call made now reaches the
+// broker. The simulated clock only moves between ticks, so the broker acts on
+// the call in the first tick after it.
+func (c *client) fakeArrival() time.Time {
+	return c.backtestClock.Now.Add(c.fakeLatency())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+func TestFakeLatencyInSimulatedTime(t *testing.T) {
+	c := newBacktestTestClient(t, ClientConfig{BacktestBrokerLatency: 90 * time.Second}, 10, "100", "1000")
+	start := time.Now()
+	p := c.fakePlaceBuyOrder(&alpaca.PlaceOrderRequest{Qty: decimal.NewFromInt(10), Type: alpaca.Market}, nil)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Errorf("placing an order took %v of real time, want the latency to be simulated", time.Since(start))
+	}
+
+	for _, minutes := range []int{0, 1} {
+		c.backtestClock.Now = backtestTestStart.Add(time.Duration(minutes) * time.Minute)
+		if o := c.fakeOrder(p.BuyOrder.ID); o.Status != "new" {
+			t.Fatalf("buy order is %v %v minutes after it was placed, want new until it reaches the broker", o.Status, minutes)
+		}
+	}
+	c.backtestClock.Now = backtestTestStart.Add(2 * time.Minute)
+	if o := c.fakeOrder(p.BuyOrder.ID); o.Status != filled {
+		t.Fatalf("buy order is %v once it reached the broker, want filled", o.Status)
+	}
+}
+
+func TestFakeCancelInSimulatedTime(t *testing.T) {
+	c := newBacktestTestClient(t, ClientConfig{BacktestBrokerLatency: 30 * time.Second, BacktestParticipationRate: 0.1}, 10, "100", "30")
+	p := c.fakePlaceBuyOrder(&alpaca.PlaceOrderRequest{Qty: decimal.NewFromInt(10), Type: alpaca.Market}, nil)
+	c.backtestClock.Now = backtestTestStart.Add(time.Minute)
+	c.fakeOrder(p.BuyOrder.ID)
+
+	c.fakeCancelOrder(p.BuyOrder)
+	if p.BuyOrder.Status != "pending_cancel" {
+		t.Fatalf("buy order is %v right after the cancel, want pending_cancel until it reaches the broker", p.BuyOrder.Status)
+	}
+	// The buy fills again in the minute the cancel reaches the broker.
+	c.backtestClock.Now = backtestTestStart.Add(2 * time.Minute)
+	c.fakeOrder(p.BuyOrder.ID)
+	if p.BuyOrder.Status != "canceled" || !p.BuyOrder.FilledQty.Equal(decimal.NewFromInt(6)) {
+		t.Errorf("buy order is %v with %v filled, want canceled with 6 filled before the cancel", p.BuyOrder.Status, p.BuyOrder.FilledQty)
+	}
+}
+
+func TestFakeJitterKeepsTheSeed(t *testing.T) {
+	c := newBacktestTestClient(t, ClientConfig{BacktestBrokerJitter: time.Second}, 1, "100", "1000")
+	rand.Seed(1)
+	want := rand.Int63()
+	rand.Seed(1)
+	for i := 0; i < 10; i++ {
+		if d := c.fakeLatency(); d < 0 || d >= time.Second {
+			t.Fatalf("fakeLatency() = %v, want less than the jitter of 1s", d)
+		}
+	}
+	if got := rand.Int63(); got != want {
+		t.Errorf("the latency jitter changed the random fills of the seed")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+var (
+	closeOutVerifyWindow       = flag.Duration("close_out_verify_window", 10*time.Minute, "How long to keep verifying and retrying the close out before alerting that the account is not flat.")
+	closeOutPollInterval       = flag.Duration("close_out_poll_interval", 15*time.Second, "The time between checks that the account is flat after closing out.")
+	closeOutVerifyAllPositions = flag.Bool("close_out_verify_all_positions", false, "If true, the whole account must be flat after closing out, otherwise only positions and orders in stock_symbol are checked.")
+)
+
+// residuals are the positions and orders left after closing out.
+type residuals struct {
+	positions []alpaca.Position
+	orders    []alpaca.Order
+}
+
+func (r *residuals) flat() bool {
+	return len(r.positions) == 0 && len(r.orders) == 0
+}
+
+func (r *residuals) String() string {
+	var parts []string
+	for _, p := range r.positions {
+		parts = append(parts, fmt.Sprintf("position %v x%v", p.Symbol, p.Qty))
+	}
+	for _, o := range r.orders {
+		parts = append(parts, fmt.Sprintf("%v order %q for %v (%v)", o.Side, o.ID, o.Symbol, o.Status))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// verifyFlat polls until the account is flat, retrying the cancel or close of
+// anything left over, and returns true if it is. If the account is not flat
+// within close_out_verify_window, an alert is logged and sent to webhooks.
+func (c *client) verifyFlat() bool {
+	deadline := time.Now().Add(c.cfg.CloseOutVerifyWindow)
+	for {
+		r, err := c.residuals()
+		switch {
+		case err != nil:
+			log.Printf("unable to verify close out: %v", err)
+		case r.flat():
+			log.Printf("verified account is flat after close out")
+			return true
+		default:
+			log.Printf("account is not flat after close out: %v", r)
+		}
+		if !time.Now().Before(deadline) {
+			c.alert(fmt.Sprintf("account is not flat %v after closing out: %v", c.cfg.CloseOutVerifyWindow, r))
+			return false
+		}
+		if err == nil {
+			c.retryResiduals(r)
+		}
+		time.Sleep(c.cfg.CloseOutPollInterval)
+	}
+}
+
+// residuals returns the open positions and orders which should have been
+// closed.
+func (c *client) residuals() (*residuals, error) {
+	r := &residuals{}
+	positions, err := c.alpacaClient.ListPositions()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list positions: %v", err)
+	}
+	for _, p := range positions {
+		if c.ownsSymbol(p.Symbol) && !p.Qty.IsZero() {
+			r.positions = append(r.positions, p)
+		}
+	}
+	status := "open"
+	orders, err := c.alpacaClient.ListOrders(&status, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list orders: %v", err)
+	}
+	for _, o := range orders {
+		if c.ownsSymbol(o.Symbol) {
+			r.orders = append(r.orders, o)
+		}
+	}
+	return r, nil
+}
+
+// ownsSymbol returns true if the close out is responsible for the symbol.
+func (c *client) ownsSymbol(symbol string) bool {
+	return c.cfg.CloseOutVerifyAllPositions || symbol == c.stockSymbol
+}
+
+// retryResiduals cancels the remaining orders and closes the remaining
+// positions.
+func (c *client) retryResiduals(r *residuals) {
+	for _, o := range r.orders {
+		if err := c.alpacaClient.CancelOrder(o.ID); err != nil {
+			log.Printf("unable to cancel residual order %q: %v", o.ID, err)
+		}
+	}
+	if len(r.orders) > 0 {
+		// Positions cannot be closed while orders hold the shares.
+		return
+	}
+	for _, p := range r.positions {
+		if err := c.alpacaClient.ClosePosition(p.Symbol); err != nil {
+			log.Printf("unable to close residual position in %v: %v", p.Symbol, err)
+		}
+	}
+}
+
+// recordCloseOut stores the order which closed the position since started as
+// the sell order of each purchase which was still held, so close outs are
+// reported as the exit of those purchases. Each purchase gets a copy of the
+// order with its own share of the quantity.
+func (c *client) recordCloseOut(started time.Time) {
+	var held []*purchase.Purchase
+	for _, p := range c.purchases {
+		if p.BuyFilled() && !p.SellFilled() {
+			held = append(held, p)
+		}
+	}
+	if len(held) == 0 {
+		return
+	}
+	status := "closed"
+	limit := 500
+	orders, err := c.alpacaClient.ListOrders(&status, nil, &limit, nil)
+	if err != nil {
+		log.Printf("unable to list orders to record the close out: %v", err)
+		return
+	}
+	var closeOut *alpaca.Order
+	for i := range orders {
+		o := &orders[i]
+		if o.Symbol == c.stockSymbol && o.Side == alpaca.Sell && o.Type == alpaca.Market && o.Status == filled && !o.CreatedAt.Before(started) {
+			closeOut = o
+			break
+		}
+	}
+	if closeOut == nil {
+		log.Printf("no filled close out order of %v was found, %v purchases have no sell order", c.stockSymbol, len(held))
+		return
+	}
+	for _, p := range held {
+		if p.SellOrder != nil && p.SellOrder.ID != "" {
+			p.AddReplacements(purchase.NewReplacement(p.SellOrder, closeOut.ID))
+		}
+		sell := *closeOut
+		sell.Qty, sell.FilledQty = p.BuyOrder.FilledQty, p.BuyOrder.FilledQty
+		p.SellOrder = &sell
+		if err := c.dbClient.Update(p); err != nil {
+			log.Printf("unable to update purchase with the close out:%v\n%+v", err, p)
+		}
+	}
+}
+
+// alert escalates a problem which needs attention.
+func (c *client) alert(msg string) {
+	log.Printf("ALERT: %v", msg)
+	c.notifyAlert(msg)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+// conditionsReportCommand is the command which reports the performance of
+// the trades by the market conditions of the day they were made, e.g.
+// "one conditions-report -from 2020-12-01 -vix_file vix.csv".
+const conditionsReportCommand = "conditions-report"
+
+// vixDateLayouts are the date layouts accepted in the VIX file. CBOE's VIX
+// history uses the second.
+var vixDateLayouts = []string{"2006-01-02", "01/02/2006"}
+
+// marketConditions are the conditions of a trading day.
+type marketConditions struct {
+	vix     string
+	gap     string
+	dayType string
+}
+
+// conditionsReport reports the trades stored in the database grouped by the
+// VIX level, the opening gap and whether the market trended or ranged on the
+// day of each trade.
+func conditionsReport(args []string) error {
+	fs := flag.NewFlagSet(conditionsReportCommand, flag.ContinueOnError)
+	from := fs.String("from", "", "The first day of trades to report (format: 2006-01-02).")
+	to := fs.String("to", "", "The last day of trades to report (format: 2006-01-02). Defaults to yesterday.")
+	strategy := fs.String("strategy", "", "When set, only trades of this strategy are reported.")
+	vixFile := fs.String("vix_file", "", "A CSV file of the daily VIX close with date and close columns, e.g. the VIX history from CBOE. Trades are grouped by the VIX close of the session before they were made, which was known when they were made. Trades are not grouped by VIX when unset.")
+	vixBuckets := fs.String("vix_buckets", "15,20,30", "The comma separated VIX levels at which the VIX buckets are split.")
+	marketSymbol := fs.String("market_symbol", "SPY", "The symbol whose daily bars classify the gap and day type.")
+	gapPercent := fs.Float64("gap_percent", 0.5, "The percentage the open must move from the previous close for the day to be a gap day.")
+	trendRatio := fs.Float64("trend_ratio", 0.6, "The ratio of the open to close move to the day's range at or above which the day is a trend day, otherwise it is a range day.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("-from is required")
+	}
+	start, err := time.ParseInLocation("2006-01-02", *from, EST)
+	if err != nil {
+		return fmt.Errorf("unable to parse -from: %v", err)
+	}
+	now := time.Now().In(EST)
+	last := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, EST)
+	if *to != "" {
+		if last, err = time.ParseInLocation("2006-01-02", *to, EST); err != nil {
+			return fmt.Errorf("unable to parse -to: %v", err)
+		}
+	}
+	end := last.AddDate(0, 0, 1)
+	edges, err := parseVIXBuckets(*vixBuckets)
+	if err != nil {
+		return err
+	}
+	vix := map[string]float64{}
+	if *vixFile != "" {
+		if vix, err = loadVIX(*vixFile); err != nil {
+			return err
+		}
+	}
+	var vixDays []string
+	for day := range vix {
+		vixDays = append(vixDays, day)
+	}
+	sort.Strings(vixDays)
+
+	db, err := database.NewInstance(*databaseName, *instanceName)
+	if err != nil {
+		return fmt.Errorf("unable to open db: %v", err)
+	}
+	all, err := db.PurchasesBetween(start, end)
+	if err != nil {
+		return err
+	}
+	var trades []*purchase.Purchase
+	for _, p := range all {
+		if p.Shadow || !p.BuyFilled() || !p.SellFilled() || p.BuyOrder.FilledAt == nil {
+			continue
+		}
+		if *strategy != "" && p.Strategy != *strategy {
+			continue
+		}
+		trades = append(trades, p)
+	}
+	if len(trades) == 0 {
+		fmt.Printf("no trades from %v to %v\n", start.Format("2006-01-02"), last.Format("2006-01-02"))
+		return nil
+	}
+
+	// Enough daily bars are requested to cover weekends and holidays, plus the
+	// close of the day before the first day.
+	days := int(end.Sub(start).Hours()/24) + 5
+	alpacaClient := alpaca.NewClient(common.Credentials())
+	bars, err := dailyBars(alpacaClient, []string{*marketSymbol}, days, end)
+	if err != nil {
+		return err
+	}
+	conditions := classifyDays(bars[*marketSymbol], *gapPercent, *trendRatio)
+
+	byVIX := map[string][]*purchase.Purchase{}
+	byGap := map[string][]*purchase.Purchase{}
+	byDayType := map[string][]*purchase.Purchase{}
+	for _, p := range trades {
+		day := p.BuyOrder.FilledAt.In(EST).Format("2006-01-02")
+		c, ok := conditions[day]
+		if !ok {
+			c = marketConditions{gap: "unknown", dayType: "unknown"}
+		}
+		c.vix = "unknown"
+		if level, ok := previousVIX(vix, vixDays, day); ok {
+			c.vix = vixBucket(level, edges)
+		}
+		byVIX[c.vix] = append(byVIX[c.vix], p)
+		byGap[c.gap] = append(byGap[c.gap], p)
+		byDayType[c.dayType] = append(byDayType[c.dayType], p)
+	}
+
+	fmt.Printf("%v trades from %v to %v\n", len(trades), start.Format("2006-01-02"), last.Format("2006-01-02"))
+	if *vixFile != "" {
+		writeConditionBuckets(os.Stdout, "VIX", byVIX)
+	}
+	writeConditionBuckets(os.Stdout, *marketSymbol+" opening gap", byGap)
+	writeConditionBuckets(os.Stdout, *marketSymbol+" day type", byDayType)
+	return nil
+}
+
+// classifyDays returns the conditions of each day of the daily bars, keyed by
+// date. The first bar only provides the previous close of the second.
+func classifyDays(bars []alpaca.Bar, gapPercent, trendRatio float64) map[string]marketConditions {
+	conditions := map[string]marketConditions{}
+	for i := 1; i < len(bars); i++ {
+		b, prevClose := bars[i], float64(bars[i-1].Close)
+		c := marketConditions{gap: "no gap", dayType: "range"}
+		gap := (float64(b.Open) - prevClose) / prevClose * 100
+		switch {
+		case gap >= gapPercent:
+			c.gap = "gap up"
+		case gap <= -gapPercent:
+			c.gap = "gap down"
+		}
+		if r := float64(b.High - b.Low); r > 0 && math.Abs(float64(b.Close-b.Open))/r >= trendRatio {
+			c.dayType = "trend"
+		}
+		conditions[time.Unix(b.Time, 0).In(EST).Format("2006-01-02")] = c
+	}
+	return conditions
+}
+
+// parseVIXBuckets parses the levels at which the VIX buckets are split.
+func parseVIXBuckets(s string) ([]float64, error) {
+	var edges []float64
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse VIX bucket %q: %v", f, err)
+		}
+		edges = append(edges, v)
+	}
+	sort.Float64s(edges)
+	return edges, nil
+}
+
+// vixBucket returns the name of the bucket of the VIX level, e.g. "15-20".
+func vixBucket(level float64, edges []float64) string {
+	for i, e := range edges {
+		if level < e {
+			if i == 0 {
+				return fmt.Sprintf("<%v", e)
+			}
+			return fmt.Sprintf("%v-%v", edges[i-1], e)
+		}
+	}
+	if len(edges) == 0 {
+		return "all"
+	}
+	return fmt.Sprintf(">=%v", edges[len(edges)-1])
+}
+
+// previousVIX returns the VIX close of the latest session before the day. The
+// days are the sorted dates of the closes.
+func previousVIX(vix map[string]float64, days []string, day string) (float64, bool) {
+	i := sort.SearchStrings(days, day)
+	if i == 0 {
+		return 0, false
+	}
+	return vix[days[i-1]], true
+}
+
+// loadVIX reads the daily VIX close from a CSV file, keyed by date. The date
+// and close columns are found by their header, or are the first and last
+// columns when there is no header.
+func loadVIX(name string) (map[string]float64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open VIX file: %v", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	vix := map[string]float64{}
+	dateCol, closeCol := 0, -1
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read VIX file: %v", err)
+		}
+		if line == 1 {
+			if cols, ok := vixHeader(record); ok {
+				dateCol, closeCol = cols[0], cols[1]
+				continue
+			}
+		}
+		c := closeCol
+		if c < 0 {
+			c = len(record) - 1
+		}
+		if dateCol >= len(record) || c >= len(record) {
+			return nil, fmt.Errorf("line %v of the VIX file has %v columns", line, len(record))
+		}
+		day, err := parseVIXDate(strings.TrimSpace(record[dateCol]))
+		if err != nil {
+			return nil, fmt.Errorf("line %v of the VIX file: %v", line, err)
+		}
+		level, err := strconv.ParseFloat(strings.TrimSpace(record[c]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %v of the VIX file: unable to parse close %q: %v", line, record[c], err)
+		}
+		vix[day.Format("2006-01-02")] = level
+	}
+	return vix, nil
+}
+
+// vixHeader returns the date and close columns of a header row.
+func vixHeader(record []string) ([2]int, bool) {
+	cols := [2]int{-1, -1}
+	for i, name := range record {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "date":
+			cols[0] = i
+		case "close", "vix close", "adj close":
+			if cols[1] < 0 {
+				cols[1] = i
+			}
+		}
+	}
+	return cols, cols[0] >= 0 && cols[1] >= 0
+}
+
+// parseVIXDate parses a date of the VIX file.
+func parseVIXDate(s string) (time.Time, error) {
+	for _, layout := range vixDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, EST); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse date %q", s)
+}
+
+// writeConditionBuckets writes the performance of the trades in each bucket.
+func writeConditionBuckets(w io.Writer, title string, buckets map[string][]*purchase.Purchase) {
+	var names []string
+	for name := range buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "\n%v:\n", title)
+	for _, name := range names {
+		s := newArmStats(buckets[name])
+		winRate, average := 0.0, 0.0
+		if s.trades > 0 {
+			winRate = 100 * float64(s.wins) / float64(s.trades)
+			pl, _ := s.profitLoss.Float64()
+			average = pl / float64(s.trades)
+		}
+		fmt.Fprintf(w, "  %-10v %5v trades, %5.1f%% wins, P/L $%v, $%.2f per trade\n",
+			name, s.trades, winRate, s.profitLoss.StringFixed(2), average)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestPreviousVIX(t *testing.T) {
+	vix := map[string]float64{"2021-01-04": 26.97, "2021-01-05": 25.34, "2021-01-07": 22.37}
+	days := []string{"2021-01-04", "2021-01-05", "2021-01-07"}
+	tests := []struct {
+		day    string
+		want   float64
+		wantOK bool
+	}{
+		{day: "2021-01-04"},
+		{day: "2021-01-05", want: 26.97, wantOK: true},
+		// There is no close on the 6th, so the 5th is the session before.
+		{day: "2021-01-06", want: 25.34, wantOK: true},
+		{day: "2021-01-07", want: 25.34, wantOK: true},
+		{day: "2021-01-08", want: 22.37, wantOK: true},
+	}
+	for _, test := range tests {
+		got, ok := previousVIX(vix, days, test.day)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("previousVIX(%v) = %v, %v, want %v, %v", test.day, got, ok, test.want, test.wantOK)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ClientConfig are the tunables of a client. Clients only read their config,
+// never the flags, so clients with different configs can run side by side,
+// e.g. the runs of a backtest sweep. The flags populate a config in main.
+type ClientConfig struct {
+	// Backtest is true when the client trades simulated history.
+	Backtest bool
+
+	// DatabaseName is the name of the MySQL database purchases are stored in.
+	DatabaseName string
+	// Instance is the instance whose rows of the database are used.
+	Instance string
+	// APIEndpoint is the REST API endpoint orders are placed with.
+	APIEndpoint string
+	// StockSymbol and StrategyName are the symbol and strategy of a backtest.
+	StockSymbol  string
+	StrategyName string
+
+	// Params are the tunables which determine when to buy.
+	Params strategyParams
+	// SymbolOverrides are the flag values of the config file which override
+	// the config of a symbol, by symbol. See forSymbol.
+	SymbolOverrides map[string]map[string]string
+	// BarTimeframe is the timeframe of the bars buy events are determined from.
+	BarTimeframe string
+	// BarLookback is how far back bars are requested. Zero requests just
+	// enough time for the bars.
+	BarLookback time.Duration
+	// PersistBars stores the bars of each buy signal evaluation.
+	PersistBars bool
+	// RecordBlockedSignals evaluates and records signals which were blocked.
+	RecordBlockedSignals bool
+	// BuyOnBarClose skips buy signals whose streamed bars were already
+	// evaluated when their bar closed.
+	BuyOnBarClose bool
+	// SignalSource is where buy and sell signals are read from, if set.
+	// SignalMaxAge and SignalMinConfidence filter its signals.
+	SignalSource        string
+	SignalMaxAge        time.Duration
+	SignalMinConfidence float64
+
+	// MaxConcurrentPurchases is the maximum number of open purchases.
+	MaxConcurrentPurchases int
+	// The drawdown breaker settings, see drawdownBreaker.
+	DrawdownBreakerPercent float64
+	DrawdownBreakerFlatten bool
+	DailyLossLimit         float64
+	DailyLossFlatten       bool
+	// PurchaseQty is the quantity of shares bought by each buy order.
+	PurchaseQty float64
+	// PositionSizeEquityPercent and PositionSizeDollars size each buy instead
+	// of PurchaseQty when set.
+	PositionSizeEquityPercent float64
+	PositionSizeDollars       float64
+	// MaxExposurePercent caps the long positions at a percentage of equity.
+	MaxExposurePercent float64
+	// MaxVolumePercent caps buys at a percentage of the average bar volume.
+	MaxVolumePercent float64
+	// SizeDownToBuyingPower reduces buys to what can be afforded instead of
+	// skipping them.
+	SizeDownToBuyingPower bool
+
+	// The entry order settings.
+	EntryOrderType     string
+	LimitEntryTactic   string
+	LimitEntryOffset   float64
+	LimitEntryTimeout  time.Duration
+	LimitEntryReprice  bool
+	RetryFailedEntries bool
+	BracketEntries     bool
+
+	// The emulated OCO sell settings.
+	OCOEmulation          string
+	OCOEmulationStopOrder string
+	OCOReplaceAttempts    int
+
+	// The volatility filter settings.
+	MinVolatilityPercent float64
+	MaxVolatilityPercent float64
+	VolatilityFilterBars int
+
+	// The indicator filter settings.
+	MinRSI     float64
+	MaxRSI     float64
+	RSIPeriod  int
+	MACDFilter bool
+	MACDFast   int
+	MACDSlow   int
+	MACDSignal int
+	VWAPFilter bool
+	VWAPBars   int
+
+	// DataCheckMaxDivergence is the percentage the latest bar price may
+	// differ from the secondary source before buys are paused.
+	DataCheckMaxDivergence float64
+
+	// The TWAP entry settings.
+	TWAPSlices   int
+	TWAPDuration time.Duration
+	TWAPMinQty   float64
+
+	// The exit settings.
+	BreakevenStopTrigger        float64
+	BreakevenStopOffset         float64
+	TimeBeforeMarketCloseToSell time.Duration
+	HoldOvernight               bool
+	MaxPositionAgeDays          int
+	FlattenBeforeMacro          bool
+	// FlatBy are the close out deadlines of flat_by, which override
+	// TimeBeforeMarketCloseToSell for a symbol or strategy.
+	FlatBy map[string]time.Duration
+
+	// The take profit settings.
+	TakeProfitMode               string
+	TakeProfitVolatilityMultiple float64
+	TakeProfitVolatilityBars     int
+	TakeProfitMinPercent         float64
+	TakeProfitMaxPercent         float64
+
+	// The close out verification settings.
+	CloseOutVerifyWindow       time.Duration
+	CloseOutPollInterval       time.Duration
+	CloseOutVerifyAllPositions bool
+
+	// The execution engine settings.
+	ClientOrderIDPrefix string
+	OrderInterval       time.Duration
+	OrderRetries        int
+	OrderRetryDelay     time.Duration
+	BuySignalTTL        time.Duration
+
+	// The adaptive polling settings.
+	AdaptivePollNearLevel float64
+	AdaptivePollNearSlope float64
+
+	// NarrationWebhooks sends each narration line to the webhooks.
+	NarrationWebhooks bool
+
+	// WatchOnly simulates every order and sends the buys and sells as
+	// notifications instead, to the Slack webhook and Telegram chat.
+	WatchOnly             bool
+	WatchSlackWebhookURL  string
+	WatchTelegramBotToken string
+	WatchTelegramChatID   string
+
+	// ApprovalNotional holds live buys worth more than this many dollars
+	// for manual approval, for up to ApprovalTimeout.
+	ApprovalNotional float64
+	ApprovalTimeout  time.Duration
+
+	// The promotion thresholds a strategy configuration must meet on paper
+	// before it may trade live.
+	PromotionMinPaperDays   int
+	PromotionMinWinRate     float64
+	PromotionMaxDrawdown    float64
+	PromotionMinTradesOnDay int
+
+	// The backtest settings.
+	DurationBetweenAction      time.Duration
+	BacktestStartingCash       float64
+	BacktestPrintDayDetails    bool
+	BacktestMarginInterestRate float64
+	BacktestCashInterestRate   float64
+	BacktestShortBorrowFeeRate float64
+	BacktestLimitTouchFill     float64
+	BacktestLimitFillDecay     float64
+	BacktestMaxOrdersPerTick   int
+	BacktestBrokerLatency      time.Duration
+	BacktestBrokerJitter       time.Duration
+	BacktestSeed               int64
+	BacktestRejectOCO          bool
+	BacktestOCOCancelFill      float64
+	BacktestEvaluationInterval time.Duration
+	BacktestFormingBars        bool
+	BacktestParticipationRate  float64
+	BacktestFillMode           string
+	BacktestSlippageBps        float64
+	BacktestCommissionPerTrade float64
+	BacktestCommissionPerShare float64
+	BacktestStopEquity         float64
+	BacktestStopMaxTrades      int
+	BacktestBenchmarkFile      string
+	BacktestBenchmarkSymbol    string
+	BacktestOutputJSON         string
+}
+
+// flagClientConfig returns the client config set by flags.
+func flagClientConfig() ClientConfig {
+	return ClientConfig{
+		Backtest:                     *runBacktest,
+		DatabaseName:                 *databaseName,
+		Instance:                     *instanceName,
+		APIEndpoint:                  *apiEndpoint,
+		StockSymbol:                  *stockSymbol,
+		StrategyName:                 *strategyName,
+		Params:                       flagStrategyParams(),
+		SymbolOverrides:              symbolOverrides,
+		BarTimeframe:                 *barTimeframe,
+		BarLookback:                  *barLookback,
+		PersistBars:                  *persistBars,
+		RecordBlockedSignals:         *recordBlockedSignals,
+		BuyOnBarClose:                *buyOnBarClose,
+		SignalSource:                 *signalSource,
+		SignalMaxAge:                 *signalMaxAge,
+		SignalMinConfidence:          *signalMinConfidence,
+		MaxConcurrentPurchases:       *maxConcurrentPurchases,
+		DrawdownBreakerPercent:       *drawdownBreakerPercent,
+		DrawdownBreakerFlatten:       *drawdownBreakerFlatten,
+		DailyLossLimit:               *dailyLossLimit,
+		DailyLossFlatten:             *dailyLossFlatten,
+		PurchaseQty:                  *purchaseQty,
+		PositionSizeEquityPercent:    *positionSizeEquityPercent,
+		PositionSizeDollars:          *positionSizeDollars,
+		MaxExposurePercent:           *maxExposurePercent,
+		MaxVolumePercent:             *maxVolumePercent,
+		SizeDownToBuyingPower:        *sizeDownToBuyingPower,
+		EntryOrderType:               *entryOrderType,
+		LimitEntryTactic:             *limitEntryTactic,
+		LimitEntryOffset:             *limitEntryOffset,
+		LimitEntryTimeout:            *limitEntryTimeout,
+		LimitEntryReprice:            *limitEntryReprice,
+		RetryFailedEntries:           *retryFailedEntries,
+		BracketEntries:               *bracketEntries,
+		OCOEmulation:                 *ocoEmulation,
+		OCOEmulationStopOrder:        *ocoEmulationStopOrder,
+		OCOReplaceAttempts:           *ocoReplaceAttempts,
+		MinVolatilityPercent:         *minVolatilityPercent,
+		MaxVolatilityPercent:         *maxVolatilityPercent,
+		VolatilityFilterBars:         *volatilityFilterBars,
+		MinRSI:                       *minRSI,
+		MaxRSI:                       *maxRSI,
+		RSIPeriod:                    *rsiPeriod,
+		MACDFilter:                   *macdFilter,
+		MACDFast:                     *macdFast,
+		MACDSlow:                     *macdSlow,
+		MACDSignal:                   *macdSignal,
+		VWAPFilter:                   *vwapFilter,
+		VWAPBars:                     *vwapBars,
+		DataCheckMaxDivergence:       *dataCheckMaxDivergence,
+		TWAPSlices:                   *twapSlices,
+		TWAPDuration:                 *twapDuration,
+		TWAPMinQty:                   *twapMinQty,
+		BreakevenStopTrigger:         *breakevenStopTrigger,
+		BreakevenStopOffset:          *breakevenStopOffset,
+		TimeBeforeMarketCloseToSell:  *timeBeforeMarketCloseToSell,
+		FlatBy:                       flatByDeadlines,
+		HoldOvernight:                *holdOvernight,
+		MaxPositionAgeDays:           *maxPositionAgeDays,
+		FlattenBeforeMacro:           *flattenBeforeMacro,
+		TakeProfitMode:               *takeProfitMode,
+		TakeProfitVolatilityMultiple: *takeProfitVolatilityMultiple,
+		TakeProfitVolatilityBars:     *takeProfitVolatilityBars,
+		TakeProfitMinPercent:         *takeProfitMinPercent,
+		TakeProfitMaxPercent:         *takeProfitMaxPercent,
+		CloseOutVerifyWindow:         *closeOutVerifyWindow,
+		CloseOutPollInterval:         *closeOutPollInterval,
+		CloseOutVerifyAllPositions:   *closeOutVerifyAllPositions,
+		ClientOrderIDPrefix:          *clientOrderIDPrefix,
+		OrderInterval:                *orderInterval,
+		OrderRetries:                 *orderRetries,
+		OrderRetryDelay:              *orderRetryDelay,
+		BuySignalTTL:                 *buySignalTTL,
+		AdaptivePollNearLevel:        *adaptivePollNearLevel,
+		AdaptivePollNearSlope:        *adaptivePollNearSlope,
+		NarrationWebhooks:            *narrationWebhooks,
+		WatchOnly:                    *watchOnly,
+		WatchSlackWebhookURL:         *watchSlackWebhookURL,
+		WatchTelegramBotToken:        *watchTelegramBotToken,
+		WatchTelegramChatID:          *watchTelegramChatID,
+		ApprovalNotional:             *approvalNotional,
+		ApprovalTimeout:              *approvalTimeout,
+		PromotionMinPaperDays:        *promotionMinPaperDays,
+		PromotionMinWinRate:          *promotionMinWinRate,
+		PromotionMaxDrawdown:         *promotionMaxDrawdown,
+		PromotionMinTradesOnDay:      *promotionMinTradesOnDay,
+		DurationBetweenAction:        *durationBetweenAction,
+		BacktestStartingCash:         *backtestStartingCash,
+		BacktestPrintDayDetails:      *backtestPrintDayDetails,
+		BacktestMarginInterestRate:   *backtestMarginInterestRate,
+		BacktestCashInterestRate:     *backtestCashInterestRate,
+		BacktestShortBorrowFeeRate:   *backtestShortBorrowFeeRate,
+		BacktestLimitTouchFill:       *backtestLimitTouchFill,
+		BacktestLimitFillDecay:       *backtestLimitFillDecay,
+		BacktestMaxOrdersPerTick:     *backtestMaxOrdersPerTick,
+		BacktestBrokerLatency:        *backtestBrokerLatency,
+		BacktestBrokerJitter:         *backtestBrokerJitter,
+		BacktestSeed:                 *backtestSeed,
+		BacktestRejectOCO:            *backtestRejectOCO,
+		BacktestOCOCancelFill:        *backtestOCOCancelFill,
+		BacktestEvaluationInterval:   *backtestEvaluationInterval,
+		BacktestFormingBars:          *backtestFormingBars,
+		BacktestParticipationRate:    *backtestParticipationRate,
+		BacktestFillMode:             *backtestFillMode,
+		BacktestSlippageBps:          *backtestSlippageBps,
+		BacktestCommissionPerTrade:   *backtestCommissionPerTrade,
+		BacktestCommissionPerShare:   *backtestCommissionPerShare,
+		BacktestStopEquity:           *backtestStopEquity,
+		BacktestStopMaxTrades:        *backtestStopMaxTrades,
+		BacktestBenchmarkFile:        *backtestBenchmarkFile,
+		BacktestBenchmarkSymbol:      *backtestBenchmarkSymbol,
+		BacktestOutputJSON:           *backtestOutputJSON,
+	}
+}
+
+// lookback returns how far back bars are requested to get the strategy's
+// number of bars of the bar timeframe.
+func (cfg ClientConfig) lookback() time.Duration {
+	return cfg.barsLookback(cfg.Params.numHistoricalBars)
+}
+
+// barsLookback returns how far back bars are requested to get n bars of the
+// bar timeframe. Daily bars only exist for trading sessions, so enough days
+// are requested to span the weekends and holidays between n sessions.
+func (cfg ClientConfig) barsLookback(n int) time.Duration {
+	d := time.Duration(n) * timeframes[cfg.BarTimeframe]
+	if cfg.BarTimeframe == dailyTimeframe {
+		d = time.Duration(n*7/5+5) * 24 * time.Hour
+	}
+	if cfg.BarLookback > d {
+		return cfg.BarLookback
+	}
+	return d
+}
+
+// forSymbol returns the config of a client trading the symbol, with the
+// symbol's overrides applied. The returned config has no overrides, so the
+// params of a shadow strategy or experiment arm can be set on top of it.
+func (cfg ClientConfig) forSymbol(symbol string) (ClientConfig, error) {
+	overrides := cfg.SymbolOverrides[symbol]
+	cfg.SymbolOverrides = nil
+	var names []string
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := overrides[name]
+		ok, err := cfg.Params.set(name, value)
+		if !ok {
+			switch name {
+			case "purchase_quanity":
+				cfg.PurchaseQty, err = strconv.ParseFloat(value, 64)
+			case "position_size_equity_percent":
+				cfg.PositionSizeEquityPercent, err = strconv.ParseFloat(value, 64)
+			case "position_size_dollars":
+				cfg.PositionSizeDollars, err = strconv.ParseFloat(value, 64)
+			case "max_volume_percent":
+				cfg.MaxVolumePercent, err = strconv.ParseFloat(value, 64)
+			case "max_concurrent_purchases":
+				cfg.MaxConcurrentPurchases, err = strconv.Atoi(value)
+			case "time_before_market_close_to_sell":
+				cfg.TimeBeforeMarketCloseToSell, err = time.ParseDuration(value)
+			default:
+				return cfg, fmt.Errorf("%q cannot be overridden for a symbol", name)
+			}
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("invalid override of %v for %v: %v", name, symbol, err)
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var controlToken = flag.String("control_token", "", "The shared secret which must be sent as \"Authorization: Bearer <token>\" with the POSTs which change what the trader may do, e.g. approving a held buy. When empty, these POSTs are only accepted from localhost, so put the status server behind an authenticating proxy on the same host or set a token.")
+
+// authorizeControl returns true if the request may change what the trader
+// may do. Otherwise the request is answered with an error.
+func authorizeControl(w http.ResponseWriter, r *http.Request) bool {
+	if *controlToken != "" {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token != auth && subtle.ConstantTimeCompare([]byte(token), []byte(*controlToken)) == 1 {
+			return true
+		}
+		http.Error(w, "a valid \"Authorization: Bearer <control_token>\" header is required", http.StatusUnauthorized)
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+		return true
+	}
+	http.Error(w, "only accepted from localhost unless control_token is set", http.StatusForbidden)
+	return false
+}
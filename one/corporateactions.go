@@ -0,0 +1,316 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	corporateActionInterval = flag.Duration("corporate_action_interval", time.Hour, "How often, when hold_overnight is set, the held purchases are checked for corporate actions. While the market is closed, a position whose quantity no longer matches its purchases but whose cost basis does is taken to be split, and the purchases are adjusted. The dividends paid are recorded on the purchases they were paid for, so they count towards the realized P/L. 0 disables the checks.")
+	corporateActionLookback = flag.Duration("corporate_action_lookback", 7*24*time.Hour, "How far back dividend activities are read on each check.")
+)
+
+// dividendActivityTypes are the account activity types of dividends paid in
+// cash.
+var dividendActivityTypes = []string{"DIV", "DIVCGL", "DIVCGS", "DIVNRA", "DIVROC", "DIVTXEX"}
+
+// splitCostBasisTolerance is how far apart, as a fraction, the cost basis of
+// a position and of its purchases may be for a quantity mismatch to be taken
+// as a split.
+const splitCostBasisTolerance = 0.01
+
+// startCorporateActions checks for corporate actions every
+// corporate_action_interval while purchases are held overnight.
+func startCorporateActions() {
+	if !*holdOvernight || *corporateActionInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			clients, _ := currentSession.snapshot()
+			checkCorporateActions(clients, time.Now())
+			time.Sleep(*corporateActionInterval)
+		}
+	}()
+}
+
+// checkCorporateActions adjusts the held purchases for splits while the
+// market is closed, and records the dividends paid.
+func checkCorporateActions(clients []*client, now time.Time) {
+	if len(clients) == 0 {
+		return
+	}
+	clock, err := clients[0].alpacaClient.GetClock()
+	switch {
+	case err != nil:
+		log.Printf("unable to check for splits, error checking if market is open: %v", err)
+	case !clock.IsOpen:
+		// Positions and purchases only match while no orders fill.
+		if err := adjustForSplits(clients, now); err != nil {
+			log.Printf("unable to check for splits: %v", err)
+		}
+	}
+	if err := recordDividends(clients, now); err != nil {
+		log.Printf("unable to record dividends: %v", err)
+	}
+}
+
+// heldShares are the shares of a symbol held by the purchases of the clients.
+type heldShares struct {
+	qty       decimal.Decimal
+	costBasis decimal.Decimal
+	holders   map[*client][]*purchase.Purchase
+}
+
+// adjustForSplits compares the positions of the account with the shares held
+// by the clients' purchases. A symbol whose position has a different quantity
+// but the same cost basis was split, so its purchases are adjusted to the
+// split and annotated with it.
+func adjustForSplits(clients []*client, now time.Time) error {
+	positions, err := clients[0].alpacaClient.ListPositions()
+	if err != nil {
+		return fmt.Errorf("unable to list positions: %v", err)
+	}
+	held := map[string]*heldShares{}
+	for _, c := range clients {
+		if c.shadow {
+			continue
+		}
+		c.do(func() {
+			for _, p := range heldPurchases(c.purchases) {
+				h, ok := held[c.stockSymbol]
+				if !ok {
+					h = &heldShares{holders: map[*client][]*purchase.Purchase{}}
+					held[c.stockSymbol] = h
+				}
+				qty := newPositionPL(p, decimal.Zero).qty
+				h.qty = h.qty.Add(qty)
+				h.costBasis = h.costBasis.Add(qty.Mul(*p.BuyOrder.FilledAvgPrice))
+				h.holders[c] = append(h.holders[c], p)
+			}
+		})
+	}
+	bySymbol := map[string]alpaca.Position{}
+	for _, p := range positions {
+		bySymbol[p.Symbol] = p
+	}
+	for symbol, h := range held {
+		pos, ok := bySymbol[symbol]
+		if !h.qty.IsPositive() || pos.Qty.Equal(h.qty) {
+			continue
+		}
+		if !ok || !pos.Qty.IsPositive() {
+			log.Printf("the purchases of %v hold %v shares, but the account has no position in it", symbol, h.qty)
+			continue
+		}
+		drift, _ := pos.CostBasis.Sub(h.costBasis).Abs().Div(h.costBasis).Float64()
+		if drift > splitCostBasisTolerance {
+			log.Printf("the position of %v shares of %v does not match the %v shares of its purchases, and its cost basis of $%v does not match theirs of $%v, not adjusting the purchases",
+				pos.Qty, symbol, h.qty, pos.CostBasis.StringFixed(2), h.costBasis.StringFixed(2))
+			continue
+		}
+		ratio := pos.Qty.Div(h.qty)
+		log.Printf("%v was split %v for 1, the position of %v shares was %v shares in the purchases", symbol, ratio, pos.Qty, h.qty)
+		for c, purchases := range h.holders {
+			c.do(func() {
+				for _, p := range purchases {
+					c.splitPurchase(p, ratio, now)
+				}
+			})
+		}
+	}
+	return nil
+}
+
+// splitPurchase adjusts the purchase to a split, in which each share became
+// ratio shares, and annotates it with the split. An open sell order is
+// cancelled, since it is for the shares before the split, so the sell order is
+// placed again at the adjusted quantity and prices.
+func (c *client) splitPurchase(p *purchase.Purchase, ratio decimal.Decimal, now time.Time) {
+	o := p.BuyOrder
+	before, beforePrice := o.FilledQty, *o.FilledAvgPrice
+	o.Qty = o.Qty.Mul(ratio)
+	o.FilledQty = o.FilledQty.Mul(ratio)
+	price := beforePrice.Div(ratio).Round(4)
+	o.FilledAvgPrice = &price
+	if p.LowestPrice != nil {
+		lowest := p.LowestPrice.Div(ratio).Round(4)
+		p.LowestPrice = &lowest
+	}
+	p.CorporateActions = append(p.CorporateActions, purchase.CorporateAction{
+		Type:  purchase.CorporateActionSplit,
+		Date:  now,
+		Ratio: ratio,
+		Description: fmt.Sprintf("%v for 1 split of %v, %v shares @ $%v became %v shares @ $%v",
+			ratio, c.stockSymbol, before, beforePrice, o.FilledQty, price),
+	})
+	if p.InProgressSellOrder() {
+		var err error
+		if isSyntheticOCO(p.SellOrder) {
+			err = c.cancelSyntheticOCOAndWait(p.SellOrder)
+		} else {
+			err = c.cancelAndWait(p.SellOrder.ID)
+		}
+		if err != nil {
+			c.alert(fmt.Sprintf("unable to cancel sell order %q of purchase %d for the %v split of %v: %v", p.SellOrder.ID, p.ID, ratio, c.stockSymbol, err))
+		} else {
+			p.SellOrder.Status = "canceled"
+			p.SellOrder.CanceledAt = &now
+		}
+	}
+	if err := c.dbClient.UpdateCorporateActions(p); err != nil {
+		log.Printf("unable to update corporate actions of purchase %d: %v", p.ID, err)
+	}
+	c.narrate(now, "adjusted purchase of %v %v for a %v for 1 split", before, c.stockSymbol, ratio)
+}
+
+// recordDividends reads the dividend activities within
+// corporate_action_lookback and records each one which is not yet recorded on
+// the purchases it was paid for. The dividends are stored in the database and
+// copied to the purchases the clients hold in memory.
+func recordDividends(clients []*client, now time.Time) error {
+	after := now.Add(-*corporateActionLookback)
+	types := dividendActivityTypes
+	activities, err := clients[0].alpacaClient.GetAccountActivities(nil, &alpaca.AccountActivitiesRequest{
+		ActivityTypes: &types,
+		After:         &after,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get dividend activities: %v", err)
+	}
+	if len(activities) == 0 {
+		return nil
+	}
+	db := clients[0].dbClient
+	all, err := db.PurchasesBetween(after.Add(-heldPurchasesLookback), now)
+	if err != nil {
+		return err
+	}
+	var purchases []*purchase.Purchase
+	for _, p := range all {
+		if !p.Shadow {
+			purchases = append(purchases, p)
+		}
+	}
+
+	updated := map[int64]*purchase.Purchase{}
+	for _, a := range activities {
+		if recordedDividend(purchases, a.ID) {
+			continue
+		}
+		shares := dividendShares(purchases, a)
+		if len(shares) == 0 {
+			log.Printf("unable to record dividend %q of $%v on %v, no purchases held %v: %v", a.ID, a.NetAmount, feeDay(a), a.Symbol, a.Description)
+			continue
+		}
+		for p, amount := range shares {
+			p.CorporateActions = append(p.CorporateActions, purchase.CorporateAction{
+				Type:        purchase.CorporateActionDividend,
+				Date:        a.Date,
+				ActivityID:  a.ID,
+				Amount:      amount,
+				Description: a.Description,
+			})
+			updated[p.ID] = p
+		}
+		log.Printf("recorded dividend %q of $%v on %v purchases of %v: %v", a.ID, a.NetAmount, len(shares), a.Symbol, a.Description)
+	}
+
+	for _, p := range updated {
+		if err := db.UpdateCorporateActions(p); err != nil {
+			log.Printf("unable to update corporate actions of purchase %d: %v", p.ID, err)
+		}
+	}
+	for _, c := range clients {
+		c.do(func() {
+			for _, p := range c.purchases {
+				if u, ok := updated[p.ID]; ok {
+					p.CorporateActions = u.CorporateActions
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// recordedDividend returns true if the dividend of the activity is recorded
+// on any of the purchases.
+func recordedDividend(purchases []*purchase.Purchase, activityID string) bool {
+	for _, p := range purchases {
+		if p.HasCorporateAction(activityID) {
+			return true
+		}
+	}
+	return false
+}
+
+// dividendShares splits the dividend of the activity between the purchases of
+// its symbol which held shares at the start of its day, in proportion to
+// their shares. A dividend is often paid after the shares were sold, so a
+// dividend without such purchases is split between the purchases of the
+// symbol held overnight within corporate_action_lookback before it instead.
+func dividendShares(purchases []*purchase.Purchase, a alpaca.AccountActivity) map[*purchase.Purchase]decimal.Decimal {
+	day := a.Date
+	if day.IsZero() {
+		day = a.TransactionTime
+	}
+	day = day.In(EST)
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, EST)
+	heldSince := func(p *purchase.Purchase, since time.Time) bool {
+		if p.BuyOrder == nil || p.BuyOrder.Symbol != a.Symbol || p.BuyOrder.FilledAt == nil || !p.BuyOrder.FilledQty.IsPositive() {
+			return false
+		}
+		bought := p.BuyOrder.FilledAt.In(EST)
+		if !bought.Before(start) {
+			return false
+		}
+		if !p.SellFilled() || p.SellOrder.FilledAt == nil {
+			return true
+		}
+		sold := p.SellOrder.FilledAt.In(EST)
+		return !sold.Before(since) && sold.Format("2006-01-02") != bought.Format("2006-01-02")
+	}
+	qty := map[*purchase.Purchase]decimal.Decimal{}
+	for _, p := range purchases {
+		if heldSince(p, start) {
+			qty[p] = p.BuyOrder.FilledQty
+		}
+	}
+	if len(qty) == 0 {
+		for _, p := range purchases {
+			if heldSince(p, start.Add(-*corporateActionLookback)) {
+				qty[p] = p.BuyOrder.FilledQty
+			}
+		}
+	}
+	total := decimal.Zero
+	for _, q := range qty {
+		total = total.Add(q)
+	}
+	if !total.IsPositive() {
+		return nil
+	}
+
+	// The rounding remainder goes to the last purchase so the shares add up
+	// to the dividend.
+	shares := map[*purchase.Purchase]decimal.Decimal{}
+	remaining := a.NetAmount
+	i := 0
+	for p, q := range qty {
+		i++
+		if i == len(qty) {
+			shares[p] = remaining
+			break
+		}
+		share := a.NetAmount.Mul(q).Div(total).Round(4)
+		shares[p] = share
+		remaining = remaining.Sub(share)
+	}
+	return shares
+}
@@ -23,6 +23,42 @@ func dsn(dbName string) string {
     return fmt.Sprintf("%s:%s@tcp(%s)/%s", username, password, hostname, dbName)
 }
 
+// addColumn adds a column to an existing table if it does not already exist.
+func addColumn(db *sql.DB, table, column, definition string) error {
+    ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancelFunc()
+    var count int
+    err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.COLUMNS
+      WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND COLUMN_NAME = ?`, dbName, table, column).Scan(&count)
+    if err != nil {
+        return err
+    }
+    if count > 0 {
+        return nil
+    }
+    _, err = db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+    return err
+}
+
+// addToPrimaryKey makes the column the first column of the primary key of an
+// existing table, followed by the columns of the current key, if it is not
+// already part of the key.
+func addToPrimaryKey(db *sql.DB, table, column, key string) error {
+    ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancelFunc()
+    var count int
+    err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.KEY_COLUMN_USAGE
+      WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY' AND COLUMN_NAME = ?`, dbName, table, column).Scan(&count)
+    if err != nil {
+        return err
+    }
+    if count > 0 {
+        return nil
+    }
+    _, err = db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DROP PRIMARY KEY, ADD PRIMARY KEY (%s, %s)", table, column, key))
+    return err
+}
+
 func main() {
     db, err := sql.Open("mysql", dsn(""))
     if err != nil {
@@ -49,8 +85,16 @@ func main() {
 
     query := `CREATE TABLE IF NOT EXISTS trader_one(
       id int primary key auto_increment,
+      instance varchar(64) not null default 'default',
+      strategy varchar(64) not null default '',
+      shadow bool not null default false,
       buy_order json,
       sell_order json,
+      replacements json,
+      lowest_price decimal(12,4),
+      take_profit_percent decimal(8,4),
+      fees json,
+      corporate_actions json,
       created_at datetime default CURRENT_TIMESTAMP,
       updated_at datetime default CURRENT_TIMESTAMP
     )`
@@ -62,6 +106,155 @@ func main() {
       return
     }
 
+    // Add columns which were introduced after the table was first created.
+    if err := addColumn(db, "trader_one", "instance", "varchar(64) not null default 'default' after id"); err != nil {
+      log.Printf("unable to add instance column: %v", err)
+      return
+    }
+    if err := addColumn(db, "trader_one", "strategy", "varchar(64) not null default '' after instance"); err != nil {
+      log.Printf("unable to add strategy column: %v", err)
+      return
+    }
+    if err := addColumn(db, "trader_one", "shadow", "bool not null default false after strategy"); err != nil {
+      log.Printf("unable to add shadow column: %v", err)
+      return
+    }
+    if err := addColumn(db, "trader_one", "replacements", "json after sell_order"); err != nil {
+      log.Printf("unable to add replacements column: %v", err)
+      return
+    }
+    if err := addColumn(db, "trader_one", "lowest_price", "decimal(12,4) after replacements"); err != nil {
+      log.Printf("unable to add lowest_price column: %v", err)
+      return
+    }
+    if err := addColumn(db, "trader_one", "take_profit_percent", "decimal(8,4) after lowest_price"); err != nil {
+      log.Printf("unable to add take_profit_percent column: %v", err)
+      return
+    }
+    if err := addColumn(db, "trader_one", "fees", "json after take_profit_percent"); err != nil {
+      log.Printf("unable to add fees column: %v", err)
+      return
+    }
+    if err := addColumn(db, "trader_one", "corporate_actions", "json after fees"); err != nil {
+      log.Printf("unable to add corporate_actions column: %v", err)
+      return
+    }
+
+    query = `CREATE TABLE IF NOT EXISTS heartbeats(
+      instance varchar(64) not null default 'default',
+      name varchar(64),
+      trading bool,
+      open_purchases int,
+      breaker_tripped bool not null default false,
+      updated_at datetime default CURRENT_TIMESTAMP,
+      primary key (instance, name)
+    )`
+    ctx, cancelFunc = context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancelFunc()
+    _, err = db.ExecContext(ctx, query)
+    if err != nil {
+      log.Printf("unable to create heartbeats table: %v", err)
+      return
+    }
+    if err := addColumn(db, "heartbeats", "breaker_tripped", "bool not null default false after open_purchases"); err != nil {
+      log.Printf("unable to add breaker_tripped column: %v", err)
+      return
+    }
+    if err := addColumn(db, "heartbeats", "instance", "varchar(64) not null default 'default' first"); err != nil {
+      log.Printf("unable to add heartbeats instance column: %v", err)
+      return
+    }
+    if err := addToPrimaryKey(db, "heartbeats", "instance", "name"); err != nil {
+      log.Printf("unable to add instance to the heartbeats primary key: %v", err)
+      return
+    }
+
+    query = `CREATE TABLE IF NOT EXISTS paper_days(
+      instance varchar(64) not null default 'default',
+      config varchar(128),
+      date date,
+      trades int,
+      wins int,
+      profit_loss double,
+      max_drawdown double,
+      primary key (instance, config, date)
+    )`
+    ctx, cancelFunc = context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancelFunc()
+    _, err = db.ExecContext(ctx, query)
+    if err != nil {
+      log.Printf("unable to create paper_days table: %v", err)
+      return
+    }
+    if err := addColumn(db, "paper_days", "instance", "varchar(64) not null default 'default' first"); err != nil {
+      log.Printf("unable to add paper_days instance column: %v", err)
+      return
+    }
+    if err := addToPrimaryKey(db, "paper_days", "instance", "config, date"); err != nil {
+      log.Printf("unable to add instance to the paper_days primary key: %v", err)
+      return
+    }
+
+    query = `CREATE TABLE IF NOT EXISTS bars(
+      id bigint primary key auto_increment,
+      symbol varchar(16),
+      timeframe varchar(16),
+      evaluated_at datetime,
+      bar_time datetime,
+      open float,
+      high float,
+      low float,
+      close float,
+      volume int,
+      index symbol_bar_time (symbol, bar_time)
+    )`
+    ctx, cancelFunc = context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancelFunc()
+    _, err = db.ExecContext(ctx, query)
+    if err != nil {
+      log.Printf("unable to create bars table: %v", err)
+      return
+    }
+
+    query = `CREATE TABLE IF NOT EXISTS blocked_signals(
+      id bigint primary key auto_increment,
+      instance varchar(64) not null default 'default',
+      evaluated_at datetime,
+      strategy varchar(64),
+      symbol varchar(16),
+      rule varchar(64),
+      detail varchar(255),
+      price double,
+      index evaluated_at (evaluated_at)
+    )`
+    ctx, cancelFunc = context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancelFunc()
+    _, err = db.ExecContext(ctx, query)
+    if err != nil {
+      log.Printf("unable to create blocked_signals table: %v", err)
+      return
+    }
+    if err := addColumn(db, "blocked_signals", "instance", "varchar(64) not null default 'default' after id"); err != nil {
+      log.Printf("unable to add blocked_signals instance column: %v", err)
+      return
+    }
+
+    query = `CREATE TABLE IF NOT EXISTS strategy_state(
+      instance varchar(64) not null default 'default',
+      strategy varchar(64),
+      symbol varchar(16),
+      state json,
+      updated_at datetime default CURRENT_TIMESTAMP,
+      primary key (instance, strategy, symbol)
+    )`
+    ctx, cancelFunc = context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancelFunc()
+    _, err = db.ExecContext(ctx, query)
+    if err != nil {
+      log.Printf("unable to create strategy_state table: %v", err)
+      return
+    }
+
     db.SetMaxOpenConns(3)
     db.SetMaxIdleConns(5)
     db.SetConnMaxLifetime(time.Minute * 5)
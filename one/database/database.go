@@ -5,11 +5,14 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
 	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
 
 	// MySQL package.
 	_ "github.com/go-sql-driver/mysql"
@@ -20,53 +23,185 @@ const (
 	password = "password"
 	hostname = "127.0.0.1:3306"
 	dbName   = "one"
+
+	// DefaultInstance is the instance of traders which do not name one, and of
+	// the rows stored before instances were recorded.
+	DefaultInstance = "default"
+	// AllInstances is the instance of a client which reads the rows of every
+	// instance, e.g. for a cross-instance view. It cannot store rows.
+	AllInstances = "*"
 )
 
+// ErrNotFound is returned when a requested purchase does not exist.
+var ErrNotFound = errors.New("purchase not found")
+
 // Client defines all funcs needed for the database client.
 type Client interface {
 	Insert(p *purchase.Purchase) error
+	Purchase(id int64) (*purchase.Purchase, error)
 	Purchases(yearDay int, tz *time.Location) ([]*purchase.Purchase, error)
+	PurchasesBetween(start, end time.Time) ([]*purchase.Purchase, error)
 	Update(p *purchase.Purchase) error
+	UpdateFees(p *purchase.Purchase) error
+	UpdateCorporateActions(p *purchase.Purchase) error
+	Heartbeat(name string) (*Heartbeat, error)
+	Heartbeats() ([]*Heartbeat, error)
+	UpdateHeartbeat(h *Heartbeat) error
+	PaperDays(config string) ([]*PaperDay, error)
+	UpdatePaperDay(d *PaperDay) error
+	InsertBars(bars []*Bar) error
+	Bars(symbol string, start, end time.Time) ([]*Bar, error)
+	InsertBlockedSignal(s *BlockedSignal) error
+	BlockedSignals(start, end time.Time) ([]*BlockedSignal, error)
+	StrategyState(strategy, symbol string) (*StrategyState, error)
+	UpdateStrategyState(s *StrategyState) error
+}
+
+// Bar is a bar of market data as seen by a trader when evaluating a signal.
+// The same bar is stored for every evaluation it was used in, since a bar can
+// change while it is forming or when the data is later revised.
+type Bar struct {
+	Symbol      string
+	Timeframe   string
+	EvaluatedAt time.Time // EvaluatedAt is when the trader used the bar.
+	alpaca.Bar
+}
+
+// BlockedSignal is a buy signal which was not acted on because a rule, such as
+// a risk limit or a cash check, blocked it.
+type BlockedSignal struct {
+	Time     time.Time // Time is when the signal was evaluated.
+	Strategy string    // Strategy is the strategy which generated the signal.
+	Symbol   string    // Symbol is the symbol which would have been bought.
+	Rule     string    // Rule is the rule which blocked the signal.
+	Detail   string    // Detail explains why the rule blocked the signal.
+	Price    float64   // Price is the latest close when the signal was evaluated.
+}
+
+// StrategyState is the memory a strategy keeps for a symbol across ticks, e.g.
+// how many bars in a row it signalled a buy, so it survives a restart.
+type StrategyState struct {
+	Strategy string    // Strategy is the strategy which keeps the state.
+	Symbol   string    // Symbol is the symbol the state is about.
+	Time     time.Time // Time is when the state was stored.
+	State    []byte    // State is the state serialized by the strategy, as JSON.
+}
+
+// PaperDay summarizes a day of paper trading by a strategy configuration. It
+// is used to decide if a configuration may be promoted to live trading.
+type PaperDay struct {
+	Config      string    // Config identifies the strategy configuration.
+	Date        time.Time // Date is the trading day, at midnight UTC.
+	Trades      int       // Trades is the number of completed purchases.
+	Wins        int       // Wins is the number of purchases which did not lose money.
+	ProfitLoss  float64   // ProfitLoss is the realized profit or loss in dollars.
+	MaxDrawdown float64   // MaxDrawdown is the largest drop in cumulative realized P/L in dollars.
 }
 
-// MySQLClient manages interactions with the database.
+// WinRate returns the percentage of trades which were wins.
+func (d *PaperDay) WinRate() float64 {
+	if d.Trades == 0 {
+		return 0
+	}
+	return 100 * float64(d.Wins) / float64(d.Trades)
+}
+
+// Heartbeat is the latest status reported by a running trader. It is updated
+// every tick so external monitoring can detect when a trader stops running.
+type Heartbeat struct {
+	Instance       string    // Instance is the instance of the trader.
+	Name           string    // Name identifies the trader reporting the heartbeat.
+	Time           time.Time // Time is when the heartbeat was reported.
+	Trading        bool      // Trading is true when the trader is trading.
+	OpenPurchases  int       // OpenPurchases is the number of in progress purchases.
+	BreakerTripped bool      // BreakerTripped is true when the drawdown breaker has stopped new purchases.
+}
+
+// MySQLClient manages interactions with the database. The rows it reads and
+// stores are those of its instance, so several traders, e.g. on different
+// machines or with different strategies, can share a database. Bars are market
+// data, so they are shared by every instance.
 type MySQLClient struct {
-	db *sql.DB
+	db       *sql.DB
+	instance string
 }
 
 // New creates a new database client that is connected to the database.
 func New() (*MySQLClient, error) {
-	db, err := open()
+	return NewNamed(dbName)
+}
+
+// NewNamed creates a new database client that is connected to the named
+// database, e.g. to keep paper and live purchases apart.
+func NewNamed(name string) (*MySQLClient, error) {
+	return NewInstance(name, DefaultInstance)
+}
+
+// NewInstance creates a new database client that is connected to the named
+// database and reads and stores the rows of the instance. A client of
+// AllInstances reads the rows of every instance.
+func NewInstance(name, instance string) (*MySQLClient, error) {
+	if instance == "" {
+		return nil, fmt.Errorf("the instance cannot be empty")
+	}
+	db, err := open(name)
 	if err != nil {
 		return nil, err
 	}
 	return &MySQLClient{
-		db: db,
+		db:       db,
+		instance: instance,
 	}, err
 }
 
+// scope returns the condition which limits a query to the client's instance,
+// and its args.
+func (c *MySQLClient) scope() (string, []interface{}) {
+	if c.instance == AllInstances {
+		return "TRUE", nil
+	}
+	return "instance = ?", []interface{}{c.instance}
+}
+
+// writable returns an error if the client cannot store rows, since it reads
+// every instance.
+func (c *MySQLClient) writable() error {
+	if c.instance == AllInstances {
+		return fmt.Errorf("rows cannot be stored by a client of all instances")
+	}
+	return nil
+}
+
 // Insert inserts purchase data into the table.
 func (c *MySQLClient) Insert(p *purchase.Purchase) error {
 	if p.ID != 0 {
 		return fmt.Errorf("purchase cannot have a preexisting ID")
 	}
+	if err := c.writable(); err != nil {
+		return err
+	}
 
-	var err error
-	var buyBytes, sellBytes []byte
-	if p.BuyOrder != nil {
-		buyBytes, err = json.Marshal(p.BuyOrder)
-		if err != nil {
-			return fmt.Errorf("unable to marshal buy order: %v", err)
-		}
+	buyBytes, sellBytes, err := marshalOrders(p)
+	if err != nil {
+		return err
 	}
-	if p.SellOrder != nil {
-		sellBytes, err = json.Marshal(p.SellOrder)
-		if err != nil {
-			return fmt.Errorf("unable to marshal sell order: %v", err)
-		}
+
+	replacementBytes, err := marshalReplacements(p)
+	if err != nil {
+		return err
+	}
+
+	feeBytes, err := marshalFees(p)
+	if err != nil {
+		return err
+	}
+
+	actionBytes, err := marshalCorporateActions(p)
+	if err != nil {
+		return err
 	}
 
-	query := `INSERT INTO trader_one(buy_order, sell_order) VALUES (?, ?)`
+	query := `INSERT INTO trader_one(instance, strategy, shadow, buy_order, sell_order, replacements, lowest_price, take_profit_percent, fees, corporate_actions) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFunc()
 	stmt, err := c.db.PrepareContext(ctx, query)
@@ -75,7 +210,7 @@ func (c *MySQLClient) Insert(p *purchase.Purchase) error {
 	}
 	defer stmt.Close()
 
-	res, err := stmt.ExecContext(ctx, jsonString(buyBytes), jsonString(sellBytes))
+	res, err := stmt.ExecContext(ctx, c.instance, p.Strategy, p.Shadow, jsonString(buyBytes), jsonString(sellBytes), string(replacementBytes), lowestPrice(p), takeProfitPercent(p), string(feeBytes), string(actionBytes))
 	if err != nil {
 		return fmt.Errorf("unable to insert row: %v", err)
 	}
@@ -84,6 +219,48 @@ func (c *MySQLClient) Insert(p *purchase.Purchase) error {
 		return fmt.Errorf("unable to find new ID: %v", err)
 	}
 	p.ID = id
+	p.Instance = c.instance
+	return nil
+}
+
+// Import inserts a purchase which was made at createdAt, e.g. when rebuilding
+// the purchases from the broker's order history.
+func (c *MySQLClient) Import(p *purchase.Purchase, createdAt time.Time) error {
+	if p.ID != 0 {
+		return fmt.Errorf("purchase cannot have a preexisting ID")
+	}
+	if err := c.writable(); err != nil {
+		return err
+	}
+	buyBytes, sellBytes, err := marshalOrders(p)
+	if err != nil {
+		return err
+	}
+	replacementBytes, err := marshalReplacements(p)
+	if err != nil {
+		return err
+	}
+	feeBytes, err := marshalFees(p)
+	if err != nil {
+		return err
+	}
+	actionBytes, err := marshalCorporateActions(p)
+	if err != nil {
+		return err
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	res, err := c.db.ExecContext(ctx, `INSERT INTO trader_one(instance, strategy, shadow, buy_order, sell_order, replacements, lowest_price, take_profit_percent, fees, corporate_actions, created_at, updated_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, c.instance, p.Strategy, p.Shadow, jsonString(buyBytes), jsonString(sellBytes), string(replacementBytes), lowestPrice(p), takeProfitPercent(p), string(feeBytes), string(actionBytes), createdAt.UTC(), createdAt.UTC())
+	if err != nil {
+		return fmt.Errorf("unable to import row: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("unable to find new ID: %v", err)
+	}
+	p.ID = id
+	p.Instance = c.instance
 	return nil
 }
 
@@ -92,6 +269,9 @@ func (c *MySQLClient) Update(p *purchase.Purchase) error {
 	if p.ID == 0 {
 		return fmt.Errorf("purchase must have a preexisting ID")
 	}
+	if err := c.writable(); err != nil {
+		return err
+	}
 
 	buyBytes, err := json.Marshal(p.BuyOrder)
 	if err != nil {
@@ -103,13 +283,20 @@ func (c *MySQLClient) Update(p *purchase.Purchase) error {
 		return fmt.Errorf("unable to marshal sell order: %v", err)
 	}
 
+	replacementBytes, err := marshalReplacements(p)
+	if err != nil {
+		return err
+	}
+
 	query := `UPDATE trader_one
   SET
     buy_order = ?,
     sell_order = ?,
+    replacements = ?,
+    lowest_price = ?,
     updated_at = NOW()
   WHERE
-    id = ?`
+    id = ? AND instance = ?`
 	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFunc()
 	stmt, err := c.db.PrepareContext(ctx, query)
@@ -118,55 +305,395 @@ func (c *MySQLClient) Update(p *purchase.Purchase) error {
 	}
 	defer stmt.Close()
 
-	_, err = stmt.ExecContext(ctx, jsonString(buyBytes), jsonString(sellBytes), p.ID)
+	_, err = stmt.ExecContext(ctx, jsonString(buyBytes), jsonString(sellBytes), string(replacementBytes), lowestPrice(p), p.ID, c.instance)
 	if err != nil {
 		return fmt.Errorf("unable to update row: %v", err)
 	}
 	return nil
 }
 
+// UpdateFees updates the fees of the purchase. The fees are attributed from
+// the account activities apart from the trading, so Update leaves them alone.
+func (c *MySQLClient) UpdateFees(p *purchase.Purchase) error {
+	if p.ID == 0 {
+		return fmt.Errorf("purchase must have a preexisting ID")
+	}
+	if err := c.writable(); err != nil {
+		return err
+	}
+	feeBytes, err := marshalFees(p)
+	if err != nil {
+		return err
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	if _, err := c.db.ExecContext(ctx, `UPDATE trader_one SET fees = ?, updated_at = NOW() WHERE id = ? AND instance = ?`, string(feeBytes), p.ID, c.instance); err != nil {
+		return fmt.Errorf("unable to update fees: %v", err)
+	}
+	return nil
+}
+
+// UpdateCorporateActions updates the corporate actions of the purchase along
+// with its orders, which a split adjusts.
+func (c *MySQLClient) UpdateCorporateActions(p *purchase.Purchase) error {
+	if p.ID == 0 {
+		return fmt.Errorf("purchase must have a preexisting ID")
+	}
+	if err := c.writable(); err != nil {
+		return err
+	}
+	buyBytes, sellBytes, err := marshalOrders(p)
+	if err != nil {
+		return err
+	}
+	actionBytes, err := marshalCorporateActions(p)
+	if err != nil {
+		return err
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	if _, err := c.db.ExecContext(ctx, `UPDATE trader_one SET buy_order = ?, sell_order = ?, corporate_actions = ?, updated_at = NOW() WHERE id = ? AND instance = ?`,
+		jsonString(buyBytes), jsonString(sellBytes), string(actionBytes), p.ID, c.instance); err != nil {
+		return fmt.Errorf("unable to update corporate actions: %v", err)
+	}
+	return nil
+}
+
+// purchaseColumns are the columns of the trader_one table read by
+// scanPurchase.
+const purchaseColumns = `id, instance, created_at, strategy, shadow, buy_order, sell_order, replacements, lowest_price, take_profit_percent, fees, corporate_actions`
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPurchase reads a purchase selected with purchaseColumns. The time the
+// purchase was created is also returned.
+func scanPurchase(s scanner) (*purchase.Purchase, time.Time, error) {
+	p := &purchase.Purchase{}
+	var buyOrderJSON, sellOrderJSON string
+	var replacementsJSON, lowest, takeProfit, feesJSON, actionsJSON sql.NullString
+	var createdAt time.Time
+	if err := s.Scan(&p.ID, &p.Instance, &createdAt, &p.Strategy, &p.Shadow, &buyOrderJSON, &sellOrderJSON, &replacementsJSON, &lowest, &takeProfit, &feesJSON, &actionsJSON); err != nil {
+		return nil, time.Time{}, err
+	}
+	p.BuyOrder = &alpaca.Order{}
+	p.SellOrder = &alpaca.Order{}
+	if err := json.Unmarshal([]byte(buyOrderJSON), p.BuyOrder); err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to unmarshal %q: %v", buyOrderJSON, err)
+	}
+	if err := json.Unmarshal([]byte(sellOrderJSON), p.SellOrder); err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to unmarshal %q: %v", sellOrderJSON, err)
+	}
+	// Rows stored before replacements were recorded have none.
+	if replacementsJSON.Valid {
+		if err := json.Unmarshal([]byte(replacementsJSON.String), &p.Replacements); err != nil {
+			return nil, time.Time{}, fmt.Errorf("unable to unmarshal %q: %v", replacementsJSON.String, err)
+		}
+	}
+	if lowest.Valid {
+		d, err := decimal.NewFromString(lowest.String)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("unable to parse lowest price %q: %v", lowest.String, err)
+		}
+		p.LowestPrice = &d
+	}
+	if takeProfit.Valid {
+		d, err := decimal.NewFromString(takeProfit.String)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("unable to parse take profit percent %q: %v", takeProfit.String, err)
+		}
+		p.TakeProfitPercent = &d
+	}
+	// Rows stored before fees were recorded have none.
+	if feesJSON.Valid {
+		if err := json.Unmarshal([]byte(feesJSON.String), &p.Fees); err != nil {
+			return nil, time.Time{}, fmt.Errorf("unable to unmarshal %q: %v", feesJSON.String, err)
+		}
+	}
+	// Rows stored before corporate actions were recorded have none.
+	if actionsJSON.Valid {
+		if err := json.Unmarshal([]byte(actionsJSON.String), &p.CorporateActions); err != nil {
+			return nil, time.Time{}, fmt.Errorf("unable to unmarshal %q: %v", actionsJSON.String, err)
+		}
+	}
+	return p, createdAt, nil
+}
+
+// Purchase retrieves the purchase with the given ID.
+func (c *MySQLClient) Purchase(id int64) (*purchase.Purchase, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	cond, args := c.scope()
+	row := c.db.QueryRowContext(ctx,
+		`SELECT `+purchaseColumns+` FROM trader_one WHERE id = ? AND `+cond, append([]interface{}{id}, args...)...)
+	p, _, err := scanPurchase(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get purchase %d: %v", id, err)
+	}
+	return p, nil
+}
+
 // Purchases retrieves all purchases stored in the database for a given year day.
-// The server is in UTC, however the timezone will be specified so PST can be used.
+// The server is in UTC, so the timezone of the day is specified.
 func (c *MySQLClient) Purchases(yearDay int, tz *time.Location) ([]*purchase.Purchase, error) {
-	results, err := c.db.Query(`SELECT id, created_at, buy_order, sell_order FROM trader_one`)
+	cond, args := c.scope()
+	results, err := c.db.Query(`SELECT `+purchaseColumns+` FROM trader_one WHERE `+cond, args...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get purchases from table: %v", err)
 	}
+	defer results.Close()
 
 	var purchases []*purchase.Purchase
 	for results.Next() {
-		var id int64
-		var buyOrderJSON, sellOrderJSON string
-		var createdAt time.Time
-		err = results.Scan(&id, &createdAt, &buyOrderJSON, &sellOrderJSON)
+		p, createdAt, err := scanPurchase(results)
 		if err != nil {
 			return nil, fmt.Errorf("unable to scan row: %v", err)
 		}
 		if yearDay != createdAt.In(tz).YearDay() {
 			continue
 		}
-		sellOrder := &alpaca.Order{}
-		buyOrder := &alpaca.Order{}
-		if err = json.Unmarshal([]byte(buyOrderJSON), buyOrder); err != nil {
-			return nil, fmt.Errorf("unable to unmarshal %q: %v", buyOrderJSON, err)
-		}
-		if err = json.Unmarshal([]byte(sellOrderJSON), sellOrder); err != nil {
-			return nil, fmt.Errorf("unable to unmarshal %q: %v", sellOrderJSON, err)
+		purchases = append(purchases, p)
+	}
+	return purchases, nil
+}
+
+// PurchasesBetween retrieves all purchases created in [start, end), ordered
+// by ID.
+func (c *MySQLClient) PurchasesBetween(start, end time.Time) ([]*purchase.Purchase, error) {
+	cond, args := c.scope()
+	results, err := c.db.Query(`SELECT `+purchaseColumns+` FROM trader_one
+  WHERE created_at >= ? AND created_at < ? AND `+cond+` ORDER BY id`, append([]interface{}{start.UTC(), end.UTC()}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get purchases from table: %v", err)
+	}
+	defer results.Close()
+
+	var purchases []*purchase.Purchase
+	for results.Next() {
+		p, _, err := scanPurchase(results)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan row: %v", err)
 		}
-		purchases = append(purchases, &purchase.Purchase{
-			ID:        id,
-			BuyOrder:  buyOrder,
-			SellOrder: sellOrder,
-		})
+		purchases = append(purchases, p)
 	}
 	return purchases, nil
 }
 
-// open opens the database.
-func open() (*sql.DB, error) {
-	db, err := sql.Open("mysql", dsn(dbName))
+// Heartbeat retrieves the latest heartbeat for the named trader. A client of
+// all instances gets the most recent heartbeat of any instance.
+func (c *MySQLClient) Heartbeat(name string) (*Heartbeat, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	h := &Heartbeat{Name: name}
+	cond, args := c.scope()
+	err := c.db.QueryRowContext(ctx,
+		`SELECT instance, updated_at, trading, open_purchases, breaker_tripped FROM heartbeats WHERE name = ? AND `+cond+` ORDER BY updated_at DESC LIMIT 1`, append([]interface{}{name}, args...)...,
+	).Scan(&h.Instance, &h.Time, &h.Trading, &h.OpenPurchases, &h.BreakerTripped)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no heartbeat for %q: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get heartbeat for %q: %v", name, err)
+	}
+	return h, nil
+}
+
+// Heartbeats retrieves the latest heartbeat of every trader, ordered by
+// instance and name.
+func (c *MySQLClient) Heartbeats() ([]*Heartbeat, error) {
+	cond, args := c.scope()
+	results, err := c.db.Query(`SELECT instance, name, updated_at, trading, open_purchases, breaker_tripped
+  FROM heartbeats WHERE `+cond+` ORDER BY instance, name`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get heartbeats from table: %v", err)
+	}
+	defer results.Close()
+
+	var heartbeats []*Heartbeat
+	for results.Next() {
+		h := &Heartbeat{}
+		if err := results.Scan(&h.Instance, &h.Name, &h.Time, &h.Trading, &h.OpenPurchases, &h.BreakerTripped); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %v", err)
+		}
+		heartbeats = append(heartbeats, h)
+	}
+	return heartbeats, nil
+}
+
+// UpdateHeartbeat stores the heartbeat, replacing any previous heartbeat with
+// the same name.
+func (c *MySQLClient) UpdateHeartbeat(h *Heartbeat) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	query := `INSERT INTO heartbeats(instance, name, trading, open_purchases, breaker_tripped, updated_at)
+  VALUES (?, ?, ?, ?, ?, ?)
+  ON DUPLICATE KEY UPDATE
+    trading = VALUES(trading),
+    open_purchases = VALUES(open_purchases),
+    breaker_tripped = VALUES(breaker_tripped),
+    updated_at = VALUES(updated_at)`
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("unable to prepare SQL statement: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, c.instance, h.Name, h.Trading, h.OpenPurchases, h.BreakerTripped, h.Time.UTC())
+	if err != nil {
+		return fmt.Errorf("unable to update heartbeat: %v", err)
+	}
+	return nil
+}
+
+// PaperDays retrieves all recorded paper trading days for a configuration,
+// ordered by date.
+func (c *MySQLClient) PaperDays(config string) ([]*PaperDay, error) {
+	cond, args := c.scope()
+	results, err := c.db.Query(`SELECT date, trades, wins, profit_loss, max_drawdown
+  FROM paper_days WHERE config = ? AND `+cond+` ORDER BY date`, append([]interface{}{config}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get paper days from table: %v", err)
+	}
+	defer results.Close()
+
+	var days []*PaperDay
+	for results.Next() {
+		d := &PaperDay{Config: config}
+		if err := results.Scan(&d.Date, &d.Trades, &d.Wins, &d.ProfitLoss, &d.MaxDrawdown); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %v", err)
+		}
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+// UpdatePaperDay stores the paper trading day, replacing any previous record
+// for the same configuration and date.
+func (c *MySQLClient) UpdatePaperDay(d *PaperDay) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	query := `INSERT INTO paper_days(instance, config, date, trades, wins, profit_loss, max_drawdown)
+  VALUES (?, ?, ?, ?, ?, ?, ?)
+  ON DUPLICATE KEY UPDATE
+    trades = VALUES(trades),
+    wins = VALUES(wins),
+    profit_loss = VALUES(profit_loss),
+    max_drawdown = VALUES(max_drawdown)`
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("unable to prepare SQL statement: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, c.instance, d.Config, d.Date, d.Trades, d.Wins, d.ProfitLoss, d.MaxDrawdown)
+	if err != nil {
+		return fmt.Errorf("unable to update paper day: %v", err)
+	}
+	return nil
+}
+
+// InsertBars stores bars seen by the trader.
+func (c *MySQLClient) InsertBars(bars []*Bar) error {
+	if len(bars) == 0 {
+		return nil
+	}
+	query := `INSERT INTO bars(symbol, timeframe, evaluated_at, bar_time, open, high, low, close, volume)
+  VALUES ` + strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?, ?, ?, ?, ?), ", len(bars)), ", ")
+	var args []interface{}
+	for _, b := range bars {
+		args = append(args, b.Symbol, b.Timeframe, b.EvaluatedAt.UTC(), b.GetTime().UTC(),
+			b.Open, b.High, b.Low, b.Close, b.Volume)
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	if _, err := c.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("unable to insert bars: %v", err)
+	}
+	return nil
+}
+
+// Bars retrieves the stored bars of a symbol with a bar time in [start, end],
+// ordered by bar time and then by when they were evaluated.
+func (c *MySQLClient) Bars(symbol string, start, end time.Time) ([]*Bar, error) {
+	results, err := c.db.Query(`SELECT timeframe, evaluated_at, bar_time, open, high, low, close, volume
+  FROM bars
+  WHERE symbol = ? AND bar_time BETWEEN ? AND ?
+  ORDER BY bar_time, evaluated_at`, symbol, start.UTC(), end.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get bars from table: %v", err)
+	}
+	defer results.Close()
+
+	var bars []*Bar
+	for results.Next() {
+		b := &Bar{Symbol: symbol}
+		var barTime time.Time
+		err := results.Scan(&b.Timeframe, &b.EvaluatedAt, &barTime,
+			&b.Open, &b.High, &b.Low, &b.Close, &b.Volume)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan row: %v", err)
+		}
+		b.Time = barTime.Unix()
+		bars = append(bars, b)
+	}
+	return bars, nil
+}
+
+// InsertBlockedSignal stores a blocked buy signal.
+func (c *MySQLClient) InsertBlockedSignal(s *BlockedSignal) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	_, err := c.db.ExecContext(ctx, `INSERT INTO blocked_signals(instance, evaluated_at, strategy, symbol, rule, detail, price)
+  VALUES (?, ?, ?, ?, ?, ?, ?)`, c.instance, s.Time.UTC(), s.Strategy, s.Symbol, s.Rule, s.Detail, s.Price)
+	if err != nil {
+		return fmt.Errorf("unable to insert blocked signal: %v", err)
+	}
+	return nil
+}
+
+// BlockedSignals retrieves the blocked buy signals evaluated in [start, end),
+// ordered by when they were evaluated.
+func (c *MySQLClient) BlockedSignals(start, end time.Time) ([]*BlockedSignal, error) {
+	cond, args := c.scope()
+	results, err := c.db.Query(`SELECT evaluated_at, strategy, symbol, rule, detail, price
+  FROM blocked_signals
+  WHERE evaluated_at >= ? AND evaluated_at < ? AND `+cond+`
+  ORDER BY evaluated_at`, append([]interface{}{start.UTC(), end.UTC()}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get blocked signals from table: %v", err)
+	}
+	defer results.Close()
+
+	var signals []*BlockedSignal
+	for results.Next() {
+		s := &BlockedSignal{}
+		if err := results.Scan(&s.Time, &s.Strategy, &s.Symbol, &s.Rule, &s.Detail, &s.Price); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %v", err)
+		}
+		signals = append(signals, s)
+	}
+	return signals, nil
+}
+
+// open opens the named database.
+func open(name string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn(name))
 	if err != nil {
-		return nil, fmt.Errorf("unable to open database %q: %v", dbName, err)
+		return nil, fmt.Errorf("unable to open database %q: %v", name, err)
 	}
 	return db, nil
 }
@@ -175,6 +702,81 @@ func dsn(dbName string) string {
 	return fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true", username, password, hostname, dbName)
 }
 
+// marshalOrders returns the JSON encoding of the purchase orders. A nil order
+// is encoded as a nil slice.
+func marshalOrders(p *purchase.Purchase) ([]byte, []byte, error) {
+	var err error
+	var buyBytes, sellBytes []byte
+	if p.BuyOrder != nil {
+		buyBytes, err = json.Marshal(p.BuyOrder)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to marshal buy order: %v", err)
+		}
+	}
+	if p.SellOrder != nil {
+		sellBytes, err = json.Marshal(p.SellOrder)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to marshal sell order: %v", err)
+		}
+	}
+	return buyBytes, sellBytes, nil
+}
+
+// marshalReplacements encodes the purchase's replacements as a JSON array.
+func marshalReplacements(p *purchase.Purchase) ([]byte, error) {
+	if p.Replacements == nil {
+		return []byte("[]"), nil
+	}
+	b, err := json.Marshal(p.Replacements)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal replacements: %v", err)
+	}
+	return b, nil
+}
+
+// marshalFees returns the purchase's fees for the fees column.
+func marshalFees(p *purchase.Purchase) ([]byte, error) {
+	if p.Fees == nil {
+		return []byte("[]"), nil
+	}
+	b, err := json.Marshal(p.Fees)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal fees: %v", err)
+	}
+	return b, nil
+}
+
+// marshalCorporateActions returns the purchase's corporate actions for the
+// corporate_actions column.
+func marshalCorporateActions(p *purchase.Purchase) ([]byte, error) {
+	if p.CorporateActions == nil {
+		return []byte("[]"), nil
+	}
+	b, err := json.Marshal(p.CorporateActions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal corporate actions: %v", err)
+	}
+	return b, nil
+}
+
+// lowestPrice returns the purchase's lowest price for the lowest_price
+// column, which is NULL until a price is recorded.
+func lowestPrice(p *purchase.Purchase) interface{} {
+	if p.LowestPrice == nil {
+		return nil
+	}
+	return p.LowestPrice.String()
+}
+
+// takeProfitPercent returns the purchase's take profit percentage for the
+// take_profit_percent column, which is NULL for the flat take profit.
+func takeProfitPercent(p *purchase.Purchase) interface{} {
+	if p.TakeProfitPercent == nil {
+		return nil
+	}
+	return p.TakeProfitPercent.String()
+}
+
 // jsonString returns a string that will be accepted by the database.
 func jsonString(b []byte) string {
 	s := string(b)
@@ -183,3 +785,49 @@ func jsonString(b []byte) string {
 	}
 	return s
 }
+
+// StrategyState retrieves the state the strategy stored for the symbol.
+func (c *MySQLClient) StrategyState(strategy, symbol string) (*StrategyState, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	s := &StrategyState{Strategy: strategy, Symbol: symbol}
+	var state string
+	cond, args := c.scope()
+	err := c.db.QueryRowContext(ctx,
+		`SELECT updated_at, state FROM strategy_state WHERE strategy = ? AND symbol = ? AND `+cond+` ORDER BY updated_at DESC LIMIT 1`, append([]interface{}{strategy, symbol}, args...)...,
+	).Scan(&s.Time, &state)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no state of %v for %v: %w", strategy, symbol, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get state of %v for %v: %v", strategy, symbol, err)
+	}
+	s.State = []byte(state)
+	return s, nil
+}
+
+// UpdateStrategyState stores the state, replacing any previous state of the
+// strategy for the symbol.
+func (c *MySQLClient) UpdateStrategyState(s *StrategyState) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	query := `INSERT INTO strategy_state(instance, strategy, symbol, state, updated_at)
+  VALUES (?, ?, ?, ?, ?)
+  ON DUPLICATE KEY UPDATE
+    state = VALUES(state),
+    updated_at = VALUES(updated_at)`
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("unable to prepare SQL statement: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, c.instance, s.Strategy, s.Symbol, string(s.State), s.Time.UTC())
+	if err != nil {
+		return fmt.Errorf("unable to update strategy state: %v", err)
+	}
+	return nil
+}
@@ -1,30 +1,428 @@
 package database
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
 	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
 )
 
-// FakeClient mocks interactions with the database.
-type FakeClient struct{}
+// FakeClient is an in-memory database used for testing, backtests and dry
+// runs. Its rows are those of DefaultInstance. It is safe for concurrent use.
+type FakeClient struct {
+	mu         sync.Mutex
+	nextID     int64
+	rows       map[int64]*fakeRow
+	heartbeats map[string]Heartbeat
+	paperDays  map[string]map[time.Time]PaperDay
+	bars       []Bar
+	blocked    []BlockedSignal
+	states     map[string]StrategyState
+	now        func() time.Time
+}
+
+// fakeRow mirrors a row of the trader_one table. Orders are stored as JSON so
+// callers only see changes which have been written with Insert or Update.
+type fakeRow struct {
+	strategy     string
+	shadow       bool
+	createdAt    time.Time
+	updatedAt    time.Time
+	buyOrder     []byte
+	sellOrder    []byte
+	replacements []byte
+	lowestPrice  *decimal.Decimal
+	takeProfit   *decimal.Decimal
+	fees         []byte
+	actions      []byte
+}
 
 // NewFake returns a FakeClient for testing.
 func NewFake() (*FakeClient, error) {
-	return &FakeClient{}, nil
+	return &FakeClient{
+		rows:       map[int64]*fakeRow{},
+		heartbeats: map[string]Heartbeat{},
+		paperDays:  map[string]map[time.Time]PaperDay{},
+		states:     map[string]StrategyState{},
+		now:        time.Now,
+	}, nil
 }
 
-// Insert returns a fake Insert func for testing.
+// SetNow sets the func used to timestamp rows. This allows backtests to store
+// rows using the simulated time.
+func (f *FakeClient) SetNow(now func() time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+}
+
+// Insert stores the purchase and assigns it a new ID.
 func (f *FakeClient) Insert(p *purchase.Purchase) error {
+	if p.ID != 0 {
+		return fmt.Errorf("purchase cannot have a preexisting ID")
+	}
+	buyBytes, sellBytes, err := marshalOrders(p)
+	if err != nil {
+		return err
+	}
+	replacementBytes, err := marshalReplacements(p)
+	if err != nil {
+		return err
+	}
+	feeBytes, err := marshalFees(p)
+	if err != nil {
+		return err
+	}
+	actionBytes, err := marshalCorporateActions(p)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	now := f.now()
+	f.rows[f.nextID] = &fakeRow{
+		strategy:     p.Strategy,
+		shadow:       p.Shadow,
+		createdAt:    now,
+		updatedAt:    now,
+		buyOrder:     buyBytes,
+		sellOrder:    sellBytes,
+		replacements: replacementBytes,
+		lowestPrice:  p.LowestPrice,
+		takeProfit:   p.TakeProfitPercent,
+		fees:         feeBytes,
+		actions:      actionBytes,
+	}
+	p.ID = f.nextID
+	p.Instance = DefaultInstance
+	return nil
+}
+
+// Update updates a previously inserted purchase.
+func (f *FakeClient) Update(p *purchase.Purchase) error {
+	if p.ID == 0 {
+		return fmt.Errorf("purchase must have a preexisting ID")
+	}
+	buyBytes, sellBytes, err := marshalOrders(p)
+	if err != nil {
+		return err
+	}
+	replacementBytes, err := marshalReplacements(p)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.rows[p.ID]
+	if !ok {
+		return fmt.Errorf("unable to update row %d: %w", p.ID, ErrNotFound)
+	}
+	r.buyOrder = buyBytes
+	r.sellOrder = sellBytes
+	r.replacements = replacementBytes
+	r.lowestPrice = p.LowestPrice
+	r.updatedAt = f.now()
+	return nil
+}
+
+// UpdateFees updates the fees of a previously inserted purchase.
+func (f *FakeClient) UpdateFees(p *purchase.Purchase) error {
+	if p.ID == 0 {
+		return fmt.Errorf("purchase must have a preexisting ID")
+	}
+	feeBytes, err := marshalFees(p)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.rows[p.ID]
+	if !ok {
+		return fmt.Errorf("unable to update row %d: %w", p.ID, ErrNotFound)
+	}
+	r.fees = feeBytes
+	r.updatedAt = f.now()
+	return nil
+}
+
+// UpdateCorporateActions updates the corporate actions and orders of a
+// previously inserted purchase.
+func (f *FakeClient) UpdateCorporateActions(p *purchase.Purchase) error {
+	if p.ID == 0 {
+		return fmt.Errorf("purchase must have a preexisting ID")
+	}
+	buyBytes, sellBytes, err := marshalOrders(p)
+	if err != nil {
+		return err
+	}
+	actionBytes, err := marshalCorporateActions(p)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.rows[p.ID]
+	if !ok {
+		return fmt.Errorf("unable to update row %d: %w", p.ID, ErrNotFound)
+	}
+	r.buyOrder = buyBytes
+	r.sellOrder = sellBytes
+	r.actions = actionBytes
+	r.updatedAt = f.now()
 	return nil
 }
 
-// Purchases returns a fake Purchases func for testing.
+// Purchase returns the purchase with the given ID.
+func (f *FakeClient) Purchase(id int64) (*purchase.Purchase, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.rows[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return r.purchase(id)
+}
+
+// Purchases retrieves all purchases created on a given year day in the
+// provided timezone, ordered by ID.
 func (f *FakeClient) Purchases(yearDay int, tz *time.Location) ([]*purchase.Purchase, error) {
-	return nil, nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []int64
+	for id, r := range f.rows {
+		if yearDay != r.createdAt.In(tz).YearDay() {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var purchases []*purchase.Purchase
+	for _, id := range ids {
+		p, err := f.rows[id].purchase(id)
+		if err != nil {
+			return nil, err
+		}
+		purchases = append(purchases, p)
+	}
+	return purchases, nil
 }
 
-// Update returns a fake Update func for testing.
-func (f *FakeClient) Update(p *purchase.Purchase) error {
+// PurchasesBetween retrieves all purchases created in [start, end), ordered
+// by ID.
+func (f *FakeClient) PurchasesBetween(start, end time.Time) ([]*purchase.Purchase, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []int64
+	for id, r := range f.rows {
+		if r.createdAt.Before(start) || !r.createdAt.Before(end) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var purchases []*purchase.Purchase
+	for _, id := range ids {
+		p, err := f.rows[id].purchase(id)
+		if err != nil {
+			return nil, err
+		}
+		purchases = append(purchases, p)
+	}
+	return purchases, nil
+}
+
+// Heartbeat retrieves the latest heartbeat for the named trader.
+func (f *FakeClient) Heartbeat(name string) (*Heartbeat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, ok := f.heartbeats[name]
+	if !ok {
+		return nil, fmt.Errorf("no heartbeat for %q: %w", name, ErrNotFound)
+	}
+	return &h, nil
+}
+
+// Heartbeats retrieves the latest heartbeat of every trader, ordered by name.
+func (f *FakeClient) Heartbeats() ([]*Heartbeat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var heartbeats []*Heartbeat
+	for _, h := range f.heartbeats {
+		h := h
+		heartbeats = append(heartbeats, &h)
+	}
+	sort.Slice(heartbeats, func(i, j int) bool { return heartbeats[i].Name < heartbeats[j].Name })
+	return heartbeats, nil
+}
+
+// UpdateHeartbeat stores the heartbeat, replacing any previous heartbeat with
+// the same name.
+func (f *FakeClient) UpdateHeartbeat(h *Heartbeat) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored := *h
+	stored.Instance = DefaultInstance
+	f.heartbeats[h.Name] = stored
+	return nil
+}
+
+// PaperDays retrieves all recorded paper trading days for a configuration,
+// ordered by date.
+func (f *FakeClient) PaperDays(config string) ([]*PaperDay, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var days []*PaperDay
+	for _, d := range f.paperDays[config] {
+		d := d
+		days = append(days, &d)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date.Before(days[j].Date) })
+	return days, nil
+}
+
+// UpdatePaperDay stores the paper trading day, replacing any previous record
+// for the same configuration and date.
+func (f *FakeClient) UpdatePaperDay(d *PaperDay) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paperDays[d.Config] == nil {
+		f.paperDays[d.Config] = map[time.Time]PaperDay{}
+	}
+	f.paperDays[d.Config][d.Date] = *d
+	return nil
+}
+
+// InsertBars stores bars seen by the trader.
+func (f *FakeClient) InsertBars(bars []*Bar) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, b := range bars {
+		f.bars = append(f.bars, *b)
+	}
+	return nil
+}
+
+// Bars retrieves the stored bars of a symbol with a bar time in [start, end],
+// ordered by bar time and then by when they were evaluated.
+func (f *FakeClient) Bars(symbol string, start, end time.Time) ([]*Bar, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var bars []*Bar
+	for _, b := range f.bars {
+		t := b.GetTime()
+		if b.Symbol != symbol || t.Before(start) || t.After(end) {
+			continue
+		}
+		b := b
+		bars = append(bars, &b)
+	}
+	sort.SliceStable(bars, func(i, j int) bool {
+		if bars[i].Time != bars[j].Time {
+			return bars[i].Time < bars[j].Time
+		}
+		return bars[i].EvaluatedAt.Before(bars[j].EvaluatedAt)
+	})
+	return bars, nil
+}
+
+// InsertBlockedSignal stores a blocked buy signal.
+func (f *FakeClient) InsertBlockedSignal(s *BlockedSignal) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blocked = append(f.blocked, *s)
 	return nil
 }
+
+// BlockedSignals retrieves the blocked buy signals evaluated in [start, end),
+// ordered by when they were evaluated.
+func (f *FakeClient) BlockedSignals(start, end time.Time) ([]*BlockedSignal, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var signals []*BlockedSignal
+	for _, s := range f.blocked {
+		if s.Time.Before(start) || !s.Time.Before(end) {
+			continue
+		}
+		s := s
+		signals = append(signals, &s)
+	}
+	sort.SliceStable(signals, func(i, j int) bool {
+		return signals[i].Time.Before(signals[j].Time)
+	})
+	return signals, nil
+}
+
+// StrategyState retrieves the state the strategy stored for the symbol.
+func (f *FakeClient) StrategyState(strategy, symbol string) (*StrategyState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.states[strategy+"/"+symbol]
+	if !ok {
+		return nil, fmt.Errorf("no state of %v for %v: %w", strategy, symbol, ErrNotFound)
+	}
+	s.State = append([]byte(nil), s.State...)
+	return &s, nil
+}
+
+// UpdateStrategyState stores the state, replacing any previous state of the
+// strategy for the symbol.
+func (f *FakeClient) UpdateStrategyState(s *StrategyState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored := *s
+	stored.State = append([]byte(nil), s.State...)
+	f.states[s.Strategy+"/"+s.Symbol] = stored
+	return nil
+}
+
+// purchase returns a new copy of the purchase stored in the row.
+func (r *fakeRow) purchase(id int64) (*purchase.Purchase, error) {
+	p := &purchase.Purchase{ID: id, Instance: DefaultInstance, Strategy: r.strategy, Shadow: r.shadow}
+	var err error
+	if p.BuyOrder, err = unmarshalOrder(r.buyOrder); err != nil {
+		return nil, err
+	}
+	if p.SellOrder, err = unmarshalOrder(r.sellOrder); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(r.replacements, &p.Replacements); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal replacements: %v", err)
+	}
+	if r.lowestPrice != nil {
+		lowest := *r.lowestPrice
+		p.LowestPrice = &lowest
+	}
+	if r.takeProfit != nil {
+		takeProfit := *r.takeProfit
+		p.TakeProfitPercent = &takeProfit
+	}
+	if err := json.Unmarshal(r.fees, &p.Fees); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal fees: %v", err)
+	}
+	if err := json.Unmarshal(r.actions, &p.CorporateActions); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal corporate actions: %v", err)
+	}
+	return p, nil
+}
+
+// unmarshalOrder decodes an order encoded by marshalOrders.
+func unmarshalOrder(b []byte) (*alpaca.Order, error) {
+	if b == nil {
+		return nil, nil
+	}
+	o := &alpaca.Order{}
+	if err := json.Unmarshal(b, o); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal %q: %v", b, err)
+	}
+	return o, nil
+}
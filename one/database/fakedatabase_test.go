@@ -0,0 +1,220 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+// newFakeAt returns a FakeClient whose rows are timestamped with *now.
+func newFakeAt(t *testing.T, now *time.Time) *FakeClient {
+	t.Helper()
+	f, err := NewFake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetNow(func() time.Time { return *now })
+	return f
+}
+
+// newPurchase returns a purchase with a buy order of the ID.
+func newPurchase(buyID string) *purchase.Purchase {
+	return &purchase.Purchase{Strategy: "slope", BuyOrder: &alpaca.Order{ID: buyID, Qty: decimal.NewFromInt(1)}}
+}
+
+func TestFakeInsertAssignsIDs(t *testing.T) {
+	now := time.Now()
+	f := newFakeAt(t, &now)
+	for want := int64(1); want <= 3; want++ {
+		p := newPurchase("buy")
+		if err := f.Insert(p); err != nil {
+			t.Fatalf("Insert() = %v", err)
+		}
+		if p.ID != want || p.Instance != DefaultInstance {
+			t.Errorf("Insert() assigned ID %v of instance %q, want %v of %q", p.ID, p.Instance, want, DefaultInstance)
+		}
+	}
+	if err := f.Insert(&purchase.Purchase{ID: 7, BuyOrder: &alpaca.Order{}}); err == nil {
+		t.Error("Insert() of a purchase with an ID = nil, want an error")
+	}
+	if err := f.Update(newPurchase("buy")); err == nil {
+		t.Error("Update() of a purchase without an ID = nil, want an error")
+	}
+	missing := newPurchase("buy")
+	missing.ID = 99
+	for name, update := range map[string]func(*purchase.Purchase) error{
+		"Update":                 f.Update,
+		"UpdateFees":             f.UpdateFees,
+		"UpdateCorporateActions": f.UpdateCorporateActions,
+	} {
+		if err := update(missing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%v() of a missing purchase = %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestFakePurchasesByDate(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2021, 1, 4, 23, 0, 0, 0, ny)
+	f := newFakeAt(t, &now)
+	created := []time.Time{
+		time.Date(2021, 1, 4, 9, 30, 0, 0, ny),
+		time.Date(2021, 1, 4, 23, 0, 0, 0, ny), // Jan 5 in UTC.
+		time.Date(2021, 1, 5, 9, 30, 0, 0, ny),
+	}
+	for _, t0 := range created {
+		now = t0
+		if err := f.Insert(newPurchase("buy")); err != nil {
+			t.Fatalf("Insert() = %v", err)
+		}
+	}
+
+	ids := func(purchases []*purchase.Purchase, err error) []int64 {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, p := range purchases {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+	tests := []struct {
+		name string
+		got  []int64
+		want []int64
+	}{
+		{"day in New York", ids(f.Purchases(4, ny)), []int64{1, 2}},
+		{"day in UTC", ids(f.Purchases(5, time.UTC)), []int64{2, 3}},
+		{"day without purchases", ids(f.Purchases(6, ny)), nil},
+		{"between includes the start", ids(f.PurchasesBetween(created[0], created[2])), []int64{1, 2}},
+		{"between excludes the end", ids(f.PurchasesBetween(created[1], created[2])), []int64{2}},
+	}
+	for _, test := range tests {
+		if len(test.got) != len(test.want) {
+			t.Errorf("%v: got IDs %v, want %v", test.name, test.got, test.want)
+			continue
+		}
+		for i := range test.got {
+			if test.got[i] != test.want[i] {
+				t.Errorf("%v: got IDs %v, want %v", test.name, test.got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFakeLookups(t *testing.T) {
+	now := time.Now()
+	f := newFakeAt(t, &now)
+	p := newPurchase("buy")
+	if err := f.Insert(p); err != nil {
+		t.Fatalf("Insert() = %v", err)
+	}
+
+	// Callers only see what was written.
+	p.BuyOrder.Status = "filled"
+	got, err := f.Purchase(p.ID)
+	if err != nil {
+		t.Fatalf("Purchase() = %v", err)
+	}
+	if got.BuyOrder.ID != "buy" || got.BuyOrder.Status != "" || got.Strategy != "slope" {
+		t.Errorf("Purchase() = buy %q with status %q of %q, want buy \"buy\" as inserted by \"slope\"", got.BuyOrder.ID, got.BuyOrder.Status, got.Strategy)
+	}
+	if err := f.Update(p); err != nil {
+		t.Fatalf("Update() = %v", err)
+	}
+	if got, _ := f.Purchase(p.ID); got.BuyOrder.Status != "filled" {
+		t.Errorf("Purchase() after Update() has status %q, want filled", got.BuyOrder.Status)
+	}
+	if _, err := f.Purchase(99); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Purchase() of a missing ID = %v, want ErrNotFound", err)
+	}
+
+	if _, err := f.Heartbeat("one"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Heartbeat() before any heartbeat = %v, want ErrNotFound", err)
+	}
+	if err := f.UpdateHeartbeat(&Heartbeat{Name: "one", OpenPurchases: 2}); err != nil {
+		t.Fatalf("UpdateHeartbeat() = %v", err)
+	}
+	if h, err := f.Heartbeat("one"); err != nil || h.OpenPurchases != 2 || h.Instance != DefaultInstance {
+		t.Errorf("Heartbeat() = %+v, %v, want the stored heartbeat of %q", h, err, DefaultInstance)
+	}
+
+	if _, err := f.StrategyState("slope", "SPY"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("StrategyState() before any state = %v, want ErrNotFound", err)
+	}
+	state := []byte("state")
+	if err := f.UpdateStrategyState(&StrategyState{Strategy: "slope", Symbol: "SPY", State: state}); err != nil {
+		t.Fatalf("UpdateStrategyState() = %v", err)
+	}
+	state[0] = 'X'
+	if s, err := f.StrategyState("slope", "SPY"); err != nil || string(s.State) != "state" {
+		t.Errorf("StrategyState() = %q, %v, want the stored \"state\"", s.State, err)
+	}
+
+	bar := func(minute int64) *Bar {
+		return &Bar{Symbol: "SPY", Bar: alpaca.Bar{Time: time.Date(2021, 1, 4, 14, 30, 0, 0, time.UTC).Unix() + minute*60}}
+	}
+	if err := f.InsertBars([]*Bar{bar(2), bar(0), bar(1), {Symbol: "QQQ", Bar: bar(1).Bar}}); err != nil {
+		t.Fatalf("InsertBars() = %v", err)
+	}
+	bars, err := f.Bars("SPY", bar(0).GetTime(), bar(1).GetTime())
+	if err != nil || len(bars) != 2 || bars[0].Time != bar(0).Time || bars[1].Time != bar(1).Time {
+		t.Errorf("Bars() = %v bars, %v, want the 2 SPY bars in the inclusive range in order", len(bars), err)
+	}
+}
+
+func TestFakeConcurrentUse(t *testing.T) {
+	f, err := NewFake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers, perWriter = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				p := newPurchase("buy")
+				if err := f.Insert(p); err != nil {
+					t.Error(err)
+					return
+				}
+				p.BuyOrder.Status = "filled"
+				if err := f.Update(p); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := f.Purchases(time.Now().YearDay(), time.Local); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	purchases, err := f.PurchasesBetween(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purchases) != writers*perWriter {
+		t.Fatalf("%v purchases stored, want %v", len(purchases), writers*perWriter)
+	}
+	for i, p := range purchases {
+		if p.ID != int64(i+1) || p.BuyOrder.Status != "filled" {
+			t.Errorf("purchase %d has ID %v and status %q, want ID %v and filled", i, p.ID, p.BuyOrder.Status, i+1)
+		}
+	}
+}
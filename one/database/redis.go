@@ -0,0 +1,192 @@
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+// LiveState is the live state of a trader instance which is published to
+// Redis, so a dashboard on another host can show it without polling the
+// database.
+type LiveState struct {
+	Instance  string               `json:"instance"`
+	Time      time.Time            `json:"time"`
+	Heartbeat *Heartbeat           `json:"heartbeat"`
+	Purchases []*purchase.Purchase `json:"purchases"` // Purchases are the purchases of the trading day, including shadow purchases.
+	Signals   []*Signal            `json:"signals"`   // Signals are the latest buy signals, oldest first.
+	Narration []string             `json:"narration"` // Narration is the latest lines of narration, oldest first.
+}
+
+// Signal is a buy signal evaluated by a trader.
+type Signal struct {
+	Time     time.Time `json:"time"`
+	Strategy string    `json:"strategy"`
+	Symbol   string    `json:"symbol"`
+	Decision string    `json:"decision"` // Decision is "buy", or "blocked" when a rule blocked the buy.
+	Detail   string    `json:"detail"`
+	Price    float64   `json:"price"`
+}
+
+// RedisState publishes and reads the live state of an instance in Redis. The
+// state is stored at "<prefix>:<instance>:state" and is also published on the
+// channel of the same name, and each signal is published on
+// "<prefix>:<instance>:signals". It is safe for concurrent use.
+type RedisState struct {
+	addr     string
+	password string
+	prefix   string
+	instance string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedisState returns a RedisState for the instance using the Redis server
+// at addr. It connects on first use, and again after a failure.
+func NewRedisState(addr, password, prefix, instance string) *RedisState {
+	return &RedisState{addr: addr, password: password, prefix: prefix, instance: instance}
+}
+
+// stateKey returns the key of the instance's state.
+func (s *RedisState) stateKey() string {
+	return fmt.Sprintf("%v:%v:state", s.prefix, s.instance)
+}
+
+// PublishState stores the state, which expires after ttl so a trader which
+// stops is not shown as live, and publishes it to subscribers.
+func (s *RedisState) PublishState(state *LiveState, ttl time.Duration) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("unable to marshal live state: %v", err)
+	}
+	if _, err := s.do("SET", s.stateKey(), string(b), "PX", strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+		return fmt.Errorf("unable to store live state: %v", err)
+	}
+	if _, err := s.do("PUBLISH", s.stateKey(), string(b)); err != nil {
+		return fmt.Errorf("unable to publish live state: %v", err)
+	}
+	return nil
+}
+
+// PublishSignal publishes the signal to subscribers.
+func (s *RedisState) PublishSignal(signal *Signal) error {
+	b, err := json.Marshal(signal)
+	if err != nil {
+		return fmt.Errorf("unable to marshal signal: %v", err)
+	}
+	if _, err := s.do("PUBLISH", fmt.Sprintf("%v:%v:signals", s.prefix, s.instance), string(b)); err != nil {
+		return fmt.Errorf("unable to publish signal: %v", err)
+	}
+	return nil
+}
+
+// State returns the latest state published by the instance. ErrNotFound is
+// returned when there is none, e.g. since the trader stopped.
+func (s *RedisState) State() (*LiveState, error) {
+	reply, err := s.do("GET", s.stateKey())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get live state: %v", err)
+	}
+	if reply == nil {
+		return nil, fmt.Errorf("no live state of instance %q: %w", s.instance, ErrNotFound)
+	}
+	state := &LiveState{}
+	if err := json.Unmarshal(reply, state); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal live state: %v", err)
+	}
+	return state, nil
+}
+
+// do sends the command and returns its reply, which is nil for a nil reply.
+// The connection is closed after an error, so the next command reconnects.
+func (s *RedisState) do(args ...string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := s.roundTrip(args)
+	if _, ok := err.(redisError); err != nil && !ok {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return reply, err
+}
+
+// connect connects to the server and authenticates.
+func (s *RedisState) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("unable to connect to redis at %v: %v", s.addr, err)
+	}
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+	if s.password == "" {
+		return nil
+	}
+	if _, err := s.roundTrip([]string{"AUTH", s.password}); err != nil {
+		conn.Close()
+		s.conn = nil
+		return fmt.Errorf("unable to authenticate with redis: %v", err)
+	}
+	return nil
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// roundTrip writes the command in the Redis protocol and reads its reply.
+func (s *RedisState) roundTrip(args []string) ([]byte, error) {
+	s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(s.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("unsupported redis reply %q", line)
+}
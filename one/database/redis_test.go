@@ -0,0 +1,295 @@
+package database
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server which speaks enough of the protocol for
+// RedisState. Every command it reads is recorded.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	commands [][]string
+	conns    int
+	// dropNext closes the connection instead of replying to the next command.
+	dropNext bool
+}
+
+// newFakeRedis starts a fakeRedis which requires the password, unless it is
+// empty.
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, values: map[string]string{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// state returns a RedisState of the instance "one" using the server.
+func (f *fakeRedis) state(password string) *RedisState {
+	return NewRedisState(f.ln.Addr().String(), password, "trader", "one")
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		drop := f.dropNext
+		f.dropNext = false
+		f.mu.Unlock()
+		if drop {
+			return
+		}
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			if len(args) == 2 && args[1] == f.password {
+				authed = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SET":
+			f.mu.Lock()
+			f.values[args[1]] = args[2]
+			f.mu.Unlock()
+			reply = "+OK\r\n"
+		case cmd == "GET":
+			f.mu.Lock()
+			v, ok := f.values[args[1]]
+			f.mu.Unlock()
+			reply = "$-1\r\n"
+			if ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			}
+		case cmd == "PUBLISH":
+			reply = ":0\r\n"
+		default:
+			reply = fmt.Sprintf("-ERR unknown command '%v'\r\n", args[0])
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("command is not an array: %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("argument is not a bulk string: %q", line)
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if string(buf[size:]) != "\r\n" {
+			return nil, fmt.Errorf("bulk string of %v bytes is not terminated", size)
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// sent returns the commands the server has read.
+func (f *fakeRedis) sent() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.commands...)
+}
+
+// connections returns the number of connections the server has accepted.
+func (f *fakeRedis) connections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns
+}
+
+func TestRedisStatePublishAndRead(t *testing.T) {
+	f := newFakeRedis(t, "")
+	s := f.state("")
+	want := &LiveState{
+		Instance:  "one",
+		Time:      time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC),
+		Narration: []string{"bought 10 AAPL\r\n@ 100", "sold"},
+	}
+	if err := s.PublishState(want, 90*time.Second); err != nil {
+		t.Fatalf("PublishState() = %v", err)
+	}
+	sent := f.sent()
+	if len(sent) != 2 {
+		t.Fatalf("PublishState() sent %v commands, want SET and PUBLISH", len(sent))
+	}
+	set, publish := sent[0], sent[1]
+	if len(set) != 5 || set[0] != "SET" || set[1] != "trader:one:state" || set[3] != "PX" || set[4] != "90000" {
+		t.Errorf("PublishState() stored the state with %q, want SET trader:one:state <state> PX 90000", set)
+	}
+	if len(publish) != 3 || publish[0] != "PUBLISH" || publish[1] != "trader:one:state" || publish[2] != set[2] {
+		t.Errorf("PublishState() published %q, want the stored state on trader:one:state", publish)
+	}
+
+	got, err := s.State()
+	if err != nil {
+		t.Fatalf("State() = %v", err)
+	}
+	if got.Instance != want.Instance || !got.Time.Equal(want.Time) || len(got.Narration) != 2 || got.Narration[0] != want.Narration[0] {
+		t.Errorf("State() = %+v, want %+v", got, want)
+	}
+	if n := f.connections(); n != 1 {
+		t.Errorf("the commands used %v connections, want 1", n)
+	}
+}
+
+func TestRedisStateReadsLargeValues(t *testing.T) {
+	f := newFakeRedis(t, "")
+	s := f.state("")
+	// The reply is larger than the reader's buffer.
+	line := strings.Repeat("x", 10000)
+	if err := s.PublishState(&LiveState{Narration: []string{line}}, time.Minute); err != nil {
+		t.Fatalf("PublishState() = %v", err)
+	}
+	got, err := s.State()
+	if err != nil {
+		t.Fatalf("State() = %v", err)
+	}
+	if len(got.Narration) != 1 || got.Narration[0] != line {
+		t.Errorf("State() read narration of %v lines, want the line of %v bytes", len(got.Narration), len(line))
+	}
+}
+
+func TestRedisStateNotFound(t *testing.T) {
+	f := newFakeRedis(t, "")
+	if _, err := f.state("").State(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("State() without a state = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRedisStatePublishSignal(t *testing.T) {
+	f := newFakeRedis(t, "")
+	if err := f.state("").PublishSignal(&Signal{Symbol: "AAPL", Decision: "buy"}); err != nil {
+		t.Fatalf("PublishSignal() = %v", err)
+	}
+	sent := f.sent()
+	if len(sent) != 1 || sent[0][0] != "PUBLISH" || sent[0][1] != "trader:one:signals" || !strings.Contains(sent[0][2], `"symbol":"AAPL"`) {
+		t.Errorf("PublishSignal() sent %q, want the signal published on trader:one:signals", sent)
+	}
+}
+
+func TestRedisStateAuthenticates(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	if err := f.state("secret").PublishSignal(&Signal{}); err != nil {
+		t.Fatalf("PublishSignal() with the password = %v", err)
+	}
+	if sent := f.sent(); len(sent) != 2 || sent[0][0] != "AUTH" || sent[0][1] != "secret" {
+		t.Errorf("sent %q, want AUTH before the command", sent)
+	}
+
+	if err := f.state("wrong").PublishSignal(&Signal{}); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("PublishSignal() with the wrong password = %v, want the WRONGPASS error", err)
+	}
+}
+
+func TestRedisStateKeepsConnectionAfterErrorReply(t *testing.T) {
+	f := newFakeRedis(t, "")
+	s := f.state("")
+	_, err := s.do("NOSUCHCOMMAND")
+	if _, ok := err.(redisError); !ok {
+		t.Fatalf("do() of an unknown command = %v, want a redisError", err)
+	}
+	if err := s.PublishSignal(&Signal{}); err != nil {
+		t.Fatalf("PublishSignal() after an error reply = %v", err)
+	}
+	if n := f.connections(); n != 1 {
+		t.Errorf("the commands used %v connections, want 1", n)
+	}
+}
+
+func TestRedisStateReconnectsAfterFailure(t *testing.T) {
+	f := newFakeRedis(t, "")
+	s := f.state("")
+	f.mu.Lock()
+	f.dropNext = true
+	f.mu.Unlock()
+	if err := s.PublishSignal(&Signal{}); err == nil {
+		t.Fatal("PublishSignal() with the connection dropped = nil, want an error")
+	}
+	if err := s.PublishSignal(&Signal{}); err != nil {
+		t.Fatalf("PublishSignal() after the connection dropped = %v", err)
+	}
+	if n := f.connections(); n != 2 {
+		t.Errorf("the commands used %v connections, want 2", n)
+	}
+}
+
+func TestRedisStateFramesValuesByLength(t *testing.T) {
+	f := newFakeRedis(t, "")
+	s := f.state("")
+	// Values may hold the protocol's line ending.
+	want := "+OK\r\n$3\r\n"
+	if _, err := s.do("SET", "key", want); err != nil {
+		t.Fatalf("do(SET) = %v", err)
+	}
+	got, err := s.do("GET", "key")
+	if err != nil {
+		t.Fatalf("do(GET) = %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("do(GET) = %q, want %q", got, want)
+	}
+}
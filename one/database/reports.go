@@ -0,0 +1,154 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Report is a canned read-only SQL report of the completed purchases. Only
+// these reports can be run, so no SQL is taken from the user.
+type Report struct {
+	Name        string
+	Description string
+	// query selects the report's rows from the trades common table, which
+	// tradesQuery defines.
+	query string
+}
+
+// ReportResult is the table of a report.
+type ReportResult struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// tradesQuery defines the trades common table: the completed purchases which
+// were traded and bought in [start, end), with their realized profit/loss
+// before fees. The hour is that of the buy fill in the time zone argument,
+// which needs the MySQL time zone tables, and is in UTC without them. The
+// %v is replaced by the instance condition.
+const tradesQuery = `WITH trades AS (
+  SELECT id, strategy, symbol, bought_at, sold_at,
+    HOUR(COALESCE(CONVERT_TZ(bought_at, '+00:00', ?), bought_at)) AS hour,
+    (sell_price - buy_price) * qty AS pl
+  FROM (
+    SELECT id, strategy,
+      JSON_UNQUOTE(JSON_EXTRACT(buy_order, '$.symbol')) AS symbol,
+      STR_TO_DATE(LEFT(JSON_UNQUOTE(JSON_EXTRACT(buy_order, '$.filled_at')), 19), '%%Y-%%m-%%dT%%H:%%i:%%s') AS bought_at,
+      STR_TO_DATE(LEFT(JSON_UNQUOTE(JSON_EXTRACT(sell_order, '$.filled_at')), 19), '%%Y-%%m-%%dT%%H:%%i:%%s') AS sold_at,
+      CAST(JSON_UNQUOTE(JSON_EXTRACT(buy_order, '$.filled_avg_price')) AS DECIMAL(12,4)) AS buy_price,
+      CAST(JSON_UNQUOTE(JSON_EXTRACT(sell_order, '$.filled_avg_price')) AS DECIMAL(12,4)) AS sell_price,
+      CAST(JSON_UNQUOTE(JSON_EXTRACT(sell_order, '$.filled_qty')) AS DECIMAL(12,4)) AS qty
+    FROM trader_one
+    WHERE NOT shadow AND %v
+      AND created_at >= ? AND created_at < ?
+      AND JSON_UNQUOTE(JSON_EXTRACT(buy_order, '$.status')) = 'filled'
+      AND JSON_UNQUOTE(JSON_EXTRACT(sell_order, '$.status')) = 'filled'
+  ) AS filled
+)
+`
+
+// Reports are the canned reports, by name.
+var Reports = map[string]*Report{
+	"pl_by_symbol": {
+		Name:        "pl_by_symbol",
+		Description: "The trades, wins and realized P/L of each symbol, worst first.",
+		query: `SELECT symbol, COUNT(*) AS trades, SUM(pl >= 0) AS wins,
+  ROUND(SUM(pl), 2) AS pl, ROUND(AVG(pl), 2) AS avg_pl
+FROM trades GROUP BY symbol ORDER BY SUM(pl)`,
+	},
+	"pl_by_strategy": {
+		Name:        "pl_by_strategy",
+		Description: "The trades, wins and realized P/L of each strategy, worst first.",
+		query: `SELECT strategy, COUNT(*) AS trades, SUM(pl >= 0) AS wins,
+  ROUND(SUM(pl), 2) AS pl, ROUND(AVG(pl), 2) AS avg_pl
+FROM trades GROUP BY strategy ORDER BY SUM(pl)`,
+	},
+	"pl_by_day": {
+		Name:        "pl_by_day",
+		Description: "The trades, wins and realized P/L of each day the trades were sold on, in UTC.",
+		query: `SELECT DATE(sold_at) AS day, COUNT(*) AS trades, SUM(pl >= 0) AS wins,
+  ROUND(SUM(pl), 2) AS pl
+FROM trades GROUP BY DATE(sold_at) ORDER BY day`,
+	},
+	"losing_hours": {
+		Name:        "losing_hours",
+		Description: "The 10 hours of the day, by buy fill, with the largest realized loss.",
+		query: `SELECT hour, COUNT(*) AS trades, SUM(pl < 0) AS losses, ROUND(SUM(pl), 2) AS pl
+FROM trades GROUP BY hour HAVING SUM(pl) < 0 ORDER BY SUM(pl) LIMIT 10`,
+	},
+	"losing_streaks": {
+		Name:        "losing_streaks",
+		Description: "The 5 longest streaks of consecutive losing trades, in the order they were sold.",
+		query: `SELECT MIN(sold_at) AS first_sold, MAX(sold_at) AS last_sold, COUNT(*) AS losses, ROUND(SUM(pl), 2) AS pl
+FROM (
+  SELECT sold_at, pl, SUM(pl >= 0) OVER (ORDER BY sold_at, id) AS streak
+  FROM trades
+) AS ordered
+WHERE pl < 0 GROUP BY streak ORDER BY losses DESC, SUM(pl) LIMIT 5`,
+	},
+}
+
+// ReportNames returns the names of the reports, sorted.
+func ReportNames() []string {
+	var names []string
+	for name := range Reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RunReport runs the named report over the trades bought in [start, end), in
+// a read-only transaction. The hours of the report are in the time zone.
+func (c *MySQLClient) RunReport(name string, start, end time.Time, tz *time.Location) (*ReportResult, error) {
+	report, ok := Reports[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown report %q, the reports are %v", name, strings.Join(ReportNames(), ", "))
+	}
+	cond, scopeArgs := c.scope()
+	query := fmt.Sprintf(tradesQuery, cond) + report.query
+	args := append([]interface{}{tz.String()}, scopeArgs...)
+	args = append(args, start.UTC(), end.UTC())
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+	tx, err := c.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("unable to begin read-only transaction: %v", err)
+	}
+	defer tx.Rollback()
+	results, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to run report %q: %v", name, err)
+	}
+	defer results.Close()
+
+	columns, err := results.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get columns of report %q: %v", name, err)
+	}
+	r := &ReportResult{Columns: columns}
+	for results.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := results.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %v", err)
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			row[i] = v.String
+		}
+		r.Rows = append(r.Rows, row)
+	}
+	if err := results.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read report %q: %v", name, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	dataCheckURL           = flag.String("data_check_url", "", "If set, the latest bar price of a symbol is cross-checked against the price from this secondary source before each buy, e.g. https://cloud.iexapis.com/stable/stock/{symbol}/quote?token=... for IEX. {symbol} is replaced by the symbol. The response is JSON, an object or an array whose first element is used.")
+	dataCheckPriceField    = flag.String("data_check_price_field", "latestPrice", "The field of the data_check_url response holding the price.")
+	dataCheckMaxDivergence = flag.Float64("data_check_max_divergence_percent", 1, "Buys of a symbol are paused, with an alert, while its latest bar price and the data_check_url price differ by more than this percentage, so bad feed data does not trigger trades. They resume once the prices agree again.")
+	dataCheckInterval      = flag.Duration("data_check_interval", time.Minute, "How long a data_check_url price is reused before it is requested again.")
+)
+
+// ruleDataCheck blocks buys of a symbol whose prices diverge.
+const ruleDataCheck = "data_check"
+
+var dataCheckClient = &http.Client{Timeout: 10 * time.Second}
+
+// dataChecker cross-checks the prices of the primary data feed against a
+// secondary source. It is shared by the clients, so a symbol traded by several
+// strategies is requested once per data_check_interval.
+type dataChecker struct {
+	mu     sync.Mutex
+	quotes map[string]secondaryQuote
+	paused map[string]dataCheckPause
+}
+
+// secondaryQuote is a price read from the secondary source.
+type secondaryQuote struct {
+	price decimal.Decimal
+	at    time.Time
+}
+
+// dataCheckPause is a symbol whose buys are paused since its prices diverged.
+type dataCheckPause struct {
+	Symbol         string    `json:"symbol"`
+	Since          time.Time `json:"since"`
+	PrimaryPrice   string    `json:"primary_price"`
+	SecondaryPrice string    `json:"secondary_price"`
+	Percent        string    `json:"divergence_percent"`
+}
+
+var dataCheck = &dataChecker{
+	quotes: map[string]secondaryQuote{},
+	paused: map[string]dataCheckPause{},
+}
+
+// dataCheckEnabled returns true if prices are cross-checked.
+func dataCheckEnabled() bool {
+	return *dataCheckURL != ""
+}
+
+// validateDataCheck returns an error if the data check flags are invalid.
+func validateDataCheck() error {
+	if !dataCheckEnabled() {
+		return nil
+	}
+	if !strings.Contains(*dataCheckURL, "{symbol}") {
+		return fmt.Errorf("data_check_url must contain {symbol}")
+	}
+	if *dataCheckMaxDivergence <= 0 {
+		return fmt.Errorf("data_check_max_divergence_percent must be positive")
+	}
+	return nil
+}
+
+// dataCheckBlock returns the data_check rule if the latest close of the bars
+// diverges from the secondary price of the symbol, or nil if buying is
+// allowed. Buying is allowed when the secondary price cannot be read, since
+// the secondary source is less reliable than the primary feed. Backtests are
+// not checked.
+func (c *client) dataCheckBlock(t time.Time, bars []alpaca.Bar) *entryBlock {
+	if !dataCheckEnabled() || c.cfg.Backtest {
+		return nil
+	}
+	primary := decimal.NewFromFloat32(bars[len(bars)-1].Close)
+	secondary, err := dataCheck.secondaryPrice(c.stockSymbol, t)
+	if err != nil {
+		log.Printf("unable to cross-check the price of %v, not pausing buys: %v", c.stockSymbol, err)
+		return nil
+	}
+	pct := primary.Sub(secondary).Abs().Div(secondary).Mul(decimal.NewFromInt(100))
+	if pct.LessThanOrEqual(decimal.NewFromFloat(c.cfg.DataCheckMaxDivergence)) {
+		if dataCheck.resume(c.stockSymbol) {
+			log.Printf("buys of %v resumed, the latest bar price $%v agrees with the secondary price $%v", c.stockSymbol, primary, secondary)
+			c.narrate(t, "resumed buying %v as its prices agree again", c.stockSymbol)
+		}
+		return nil
+	}
+	p := dataCheckPause{
+		Symbol:         c.stockSymbol,
+		Since:          t,
+		PrimaryPrice:   primary.String(),
+		SecondaryPrice: secondary.String(),
+		Percent:        pct.StringFixed(2),
+	}
+	if dataCheck.pause(p) {
+		go c.alert(fmt.Sprintf("buys of %v paused, the latest bar price $%v differs from the secondary price $%v by %v%%, over %v%%",
+			c.stockSymbol, primary, secondary, p.Percent, c.cfg.DataCheckMaxDivergence))
+	}
+	return &entryBlock{ruleDataCheck, fmt.Sprintf("latest bar price $%v differs from the secondary price $%v by %v%%", primary, secondary, p.Percent)}
+}
+
+// secondaryPrice returns the price of the symbol from the secondary source. It
+// is requested again once the price read last is data_check_interval old.
+func (d *dataChecker) secondaryPrice(symbol string, t time.Time) (decimal.Decimal, error) {
+	d.mu.Lock()
+	q, ok := d.quotes[symbol]
+	d.mu.Unlock()
+	if ok && t.Sub(q.at) < *dataCheckInterval {
+		return q.price, nil
+	}
+	price, err := fetchSecondaryPrice(symbol)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	d.mu.Lock()
+	d.quotes[symbol] = secondaryQuote{price: price, at: t}
+	d.mu.Unlock()
+	return price, nil
+}
+
+// fetchSecondaryPrice requests the price of the symbol from data_check_url.
+func fetchSecondaryPrice(symbol string) (decimal.Decimal, error) {
+	url := strings.Replace(*dataCheckURL, "{symbol}", symbol, -1)
+	resp, err := dataCheckClient.Get(url)
+	if err != nil {
+		// The URL may hold a token, so it is not logged.
+		return decimal.Zero, fmt.Errorf("unable to request secondary price: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decimal.Zero, fmt.Errorf("secondary source returned %v", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("unable to read secondary price: %v", err)
+	}
+	return parseSecondaryPrice(b, *dataCheckPriceField)
+}
+
+// parseSecondaryPrice returns the price held by the field of the JSON object,
+// or of the first element of the JSON array.
+func parseSecondaryPrice(b []byte, field string) (decimal.Decimal, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		var arr []map[string]interface{}
+		if err := json.Unmarshal(b, &arr); err != nil {
+			return decimal.Zero, fmt.Errorf("unable to parse secondary price: %v", err)
+		}
+		if len(arr) == 0 {
+			return decimal.Zero, fmt.Errorf("secondary source returned no prices")
+		}
+		obj = arr[0]
+	}
+	var price decimal.Decimal
+	switch v := obj[field].(type) {
+	case float64:
+		price = decimal.NewFromFloat(v)
+	case string:
+		var err error
+		if price, err = decimal.NewFromString(v); err != nil {
+			return decimal.Zero, fmt.Errorf("invalid secondary price %q: %v", v, err)
+		}
+	default:
+		return decimal.Zero, fmt.Errorf("secondary source returned no %q price", field)
+	}
+	if !price.IsPositive() {
+		return decimal.Zero, fmt.Errorf("invalid secondary price %v", price)
+	}
+	return price, nil
+}
+
+// pause pauses the buys of the symbol. It returns false if they were already
+// paused.
+func (d *dataChecker) pause(p dataCheckPause) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.paused[p.Symbol]; ok {
+		return false
+	}
+	d.paused[p.Symbol] = p
+	return true
+}
+
+// resume resumes the buys of the symbol. It returns false if they were not
+// paused.
+func (d *dataChecker) resume(symbol string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.paused[symbol]; !ok {
+		return false
+	}
+	delete(d.paused, symbol)
+	return true
+}
+
+// pausedSymbol returns the pause of the symbol, if its buys are paused.
+func (d *dataChecker) pausedSymbol(symbol string) (dataCheckPause, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.paused[symbol]
+	return p, ok
+}
+
+// pauses returns the paused symbols, in order.
+func (d *dataChecker) pauses() []dataCheckPause {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var pauses []dataCheckPause
+	for _, p := range d.paused {
+		pauses = append(pauses, p)
+	}
+	sort.Slice(pauses, func(i, j int) bool { return pauses[i].Symbol < pauses[j].Symbol })
+	return pauses
+}
+
+// writeDataCheck writes the symbols whose buys are paused for the status page.
+func writeDataCheck(w io.Writer) {
+	for _, p := range dataCheck.pauses() {
+		fmt.Fprintf(w, "\nData check: %v PAUSED @ %v, no new purchases (bar price $%v, secondary price $%v, %v%% apart)\n",
+			p.Symbol, p.Since.In(EST).Format("15:04 MST"), p.PrimaryPrice, p.SecondaryPrice, p.Percent)
+	}
+}
+
+// serveDataCheck serves the symbols whose buys are paused as JSON.
+func serveDataCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	pauses := dataCheck.pauses()
+	if pauses == nil {
+		pauses = []dataCheckPause{}
+	}
+	if err := json.NewEncoder(w).Encode(pauses); err != nil {
+		log.Printf("unable to encode data check pauses: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	entryOrderType    = flag.String("entry_order_type", "market", "The order type used to buy, either \"market\" or \"limit\".")
+	limitEntryTactic  = flag.String("limit_entry_tactic", "midpoint", "How limit buy orders are priced: \"join_bid\" (at the bid), \"midpoint\" (between the bid and ask), \"last_close_offset\" (the last bar close minus limit_entry_offset) or \"marketable\" (the ask plus limit_entry_offset).")
+	limitEntryOffset  = flag.Float64("limit_entry_offset", 0.01, "The offset in dollars used by the last_close_offset and marketable limit entry tactics.")
+	limitEntryTimeout = flag.Duration("limit_entry_timeout", 30*time.Second, "How long a limit buy order may remain unfilled before it is repriced or cancelled.")
+	limitEntryReprice = flag.Bool("limit_entry_reprice", true, "If true, limit buy orders unfilled after limit_entry_timeout are repriced, otherwise they are cancelled.")
+)
+
+// quote is the latest market prices of a symbol.
+type quote struct {
+	bid  decimal.Decimal
+	ask  decimal.Decimal
+	last decimal.Decimal
+}
+
+// latestQuote returns the latest quote for the symbol. Backtests without
+// quote data use the current bar close for every price.
+func (c *client) latestQuote() (*quote, error) {
+	if c.cfg.Backtest {
+		h := c.fakeCurrentPrice()
+		if h.hasQuote() {
+			return &quote{bid: h.Bid, ask: h.Ask, last: h.Close}, nil
+		}
+		return &quote{bid: h.Close, ask: h.Close, last: h.Close}, nil
+	}
+	q, err := c.alpacaClient.GetLastQuote(c.stockSymbol)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get last quote: %v", err)
+	}
+	last, err := c.latestPrice()
+	if err != nil {
+		return nil, err
+	}
+	return &quote{
+		bid:  decimal.NewFromFloat32(q.Last.BidPrice),
+		ask:  decimal.NewFromFloat32(q.Last.AskPrice),
+		last: last,
+	}, nil
+}
+
+// entryLimitPrice returns the limit price of a buy order using the
+// limit_entry_tactic.
+func (c *client) entryLimitPrice(q *quote, lastClose decimal.Decimal) (decimal.Decimal, error) {
+	offset := decimal.NewFromFloat(c.cfg.LimitEntryOffset)
+	var price decimal.Decimal
+	switch c.cfg.LimitEntryTactic {
+	case "join_bid":
+		price = q.bid
+	case "midpoint":
+		price = q.bid.Add(q.ask).Div(decimal.NewFromInt(2))
+	case "last_close_offset":
+		price = lastClose.Sub(offset)
+	case "marketable":
+		price = q.ask.Add(offset)
+	default:
+		return decimal.Decimal{}, fmt.Errorf("unknown limit_entry_tactic %q", c.cfg.LimitEntryTactic)
+	}
+	if !price.IsPositive() {
+		return decimal.Decimal{}, fmt.Errorf("invalid limit price $%v from quote %+v", price, q)
+	}
+	// A marketable limit is rounded up so it still crosses the ask.
+	return roundToTick(price, c.cfg.LimitEntryTactic == "marketable"), nil
+}
+
+// limitEntryRequest converts the buy order request into a limit order priced
+// from the latest quote.
+func (c *client) limitEntryRequest(req *alpaca.PlaceOrderRequest, bars []alpaca.Bar) error {
+	q, err := c.latestQuote()
+	if err != nil {
+		return err
+	}
+	price, err := c.entryLimitPrice(q, decimal.NewFromFloat32(bars[len(bars)-1].Close))
+	if err != nil {
+		return err
+	}
+	req.Type = alpaca.Limit
+	req.LimitPrice = &price
+	return nil
+}
+
+// handleStaleLimitEntries reprices, or cancels, limit buy orders which have
+// not been filled within limit_entry_timeout.
+func (c *client) handleStaleLimitEntries(now time.Time) {
+	for _, p := range c.inProgressBuyOrders() {
+		o := p.BuyOrder
+		if o.Type != alpaca.Limit || now.Sub(o.CreatedAt) < c.cfg.LimitEntryTimeout {
+			continue
+		}
+		if !c.cfg.LimitEntryReprice {
+			c.cancelEntry(p, now)
+		} else if err := c.repriceEntry(p, now); err != nil {
+			log.Printf("unable to reprice buy order %q: %v", o.ID, err)
+			continue
+		}
+		if err := c.dbClient.Update(p); err != nil {
+			log.Printf("unable to update buy order:%v\n%+v", err, p)
+		}
+	}
+}
+
+// cancelEntry cancels an unfilled buy order.
+func (c *client) cancelEntry(p *purchase.Purchase, now time.Time) {
+	o := p.BuyOrder
+	p.CanceledByTrader = true
+	if isTWAP(o) {
+		log.Printf("cancelling the unfilled child orders of TWAP buy order %q", o.ID)
+		c.cancelTWAP(o, now)
+		// The totals of a TWAP buy are only known to the trader, and the
+		// order is not refreshed once it has ended.
+		if err := c.dbClient.Update(p); err != nil {
+			log.Printf("unable to update buy order:%v\n%+v", err, p)
+		}
+		return
+	}
+	log.Printf("cancelling unfilled limit buy order %q @ $%v", o.ID, o.LimitPrice)
+	if c.cfg.Backtest {
+		c.fakeCancelOrder(o)
+		return
+	}
+	if c.shadow {
+		o.Status = "canceled"
+		o.CanceledAt = &now
+		return
+	}
+	if err := c.alpacaClient.CancelOrder(o.ID); err != nil {
+		log.Printf("unable to cancel %q: %v", o.ID, err)
+	}
+}
+
+// repriceEntry replaces the limit price of the purchase's unfilled buy order
+// using the latest quote. The order is updated in place.
+func (c *client) repriceEntry(p *purchase.Purchase, now time.Time) error {
+	o := p.BuyOrder
+	q, err := c.latestQuote()
+	if err != nil {
+		return err
+	}
+	price, err := c.entryLimitPrice(q, q.last)
+	if err != nil {
+		return err
+	}
+	log.Printf("repricing unfilled limit buy order %q from $%v to $%v", o.ID, o.LimitPrice, price)
+	if c.cfg.Backtest || c.shadow {
+		o.LimitPrice = &price
+		o.CreatedAt = now
+		return nil
+	}
+	replaced, err := c.alpacaClient.ReplaceOrder(o.ID, alpaca.ReplaceOrderRequest{
+		LimitPrice:  &price,
+		TimeInForce: o.TimeInForce,
+	})
+	if err != nil {
+		return err
+	}
+	p.AddReplacements(purchase.NewReplacement(o, replaced.ID))
+	*o = *replaced
+	return nil
+}
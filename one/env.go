@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	configFile  = flag.String("config", "", "A JSON or YAML (.yaml or .yml) config file of flag values, per-symbol overrides and named environment profiles, selected with -env. Flags set on the command line override the file.")
+	environment = flag.String("env", "", "The environment profile from the config file to run with, e.g. \"paper\", \"live\" or \"backtest\". Flags set on the command line override the profile.")
+)
+
+// symbolOverrides are the per-symbol overrides of the config file, by symbol.
+var symbolOverrides map[string]map[string]string
+
+// config is the contents of the config file, e.g.
+//
+//	{
+//	  "flags": {
+//	    "purchase_quanity": 10,
+//	    "max_concurrent_purchases": 5,
+//	    "min_slope_required_to_buy": 1.3,
+//	    "time_before_market_close_to_sell": "10m"
+//	  },
+//	  "symbols": {
+//	    "TSLA": {"purchase_quanity": 2, "min_slope_required_to_buy": 2.5}
+//	  },
+//	  "environments": {
+//	    "paper": {
+//	      "api_endpoint": "https://paper-api.alpaca.markets",
+//	      "api_key_id": "...",
+//	      "api_secret_key": "...",
+//	      "db_name": "one_paper",
+//	      "webhook_urls": "https://hooks.example.com/paper"
+//	    },
+//	    "backtest": {
+//	      "flags": {"backtest_file": "SPY.csv.gz"}
+//	    }
+//	  }
+//	}
+//
+// or the same in YAML. Flags are set by their flag name. A profile's flags
+// override the top level flags. The strategy flags, purchase_quanity, the
+// position size flags, max_volume_percent and max_concurrent_purchases may be
+// overridden for a symbol.
+type config struct {
+	Flags        map[string]flagValue            `json:"flags"`
+	Symbols      map[string]map[string]flagValue `json:"symbols"`
+	Environments map[string]*environmentProfile  `json:"environments"`
+}
+
+// environmentProfile bundles the settings of an environment. Any other flag
+// may be set in Flags.
+type environmentProfile struct {
+	APIEndpoint  string               `json:"api_endpoint"`
+	APIKeyID     string               `json:"api_key_id"`
+	APISecretKey string               `json:"api_secret_key"`
+	DBName       string               `json:"db_name"`
+	WebhookURLs  string               `json:"webhook_urls"`
+	Flags        map[string]flagValue `json:"flags"`
+}
+
+// flagValue is the value of a flag in the config file, which may be written
+// as a string, a number or a bool.
+type flagValue string
+
+func (v *flagValue) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case string:
+		*v = flagValue(value)
+	case bool, float64:
+		*v = flagValue(b)
+	default:
+		return fmt.Errorf("flag values must be a string, number or bool, not %s", b)
+	}
+	return nil
+}
+
+// flagStrings returns the values of the flags as strings.
+func flagStrings(flags map[string]flagValue) map[string]string {
+	values := map[string]string{}
+	for name, value := range flags {
+		values[name] = string(value)
+	}
+	return values
+}
+
+// flagValues returns the flags set by the profile.
+func (p *environmentProfile) flagValues(env string) map[string]string {
+	values := flagStrings(p.Flags)
+	for name, value := range map[string]string{
+		"api_endpoint":   p.APIEndpoint,
+		"api_key_id":     p.APIKeyID,
+		"api_secret_key": p.APISecretKey,
+		"db_name":        p.DBName,
+		"webhook_urls":   p.WebhookURLs,
+	} {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	if env == "backtest" {
+		values["run_backtest"] = "true"
+	}
+	return values
+}
+
+// readConfig reads and validates the config file. YAML files are converted to
+// JSON, and unknown fields are rejected so a misspelt setting is not ignored.
+func readConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config: %v", err)
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		if b, err = yamlToJSON(b); err != nil {
+			return nil, fmt.Errorf("unable to parse config: %v", err)
+		}
+	}
+	cfg := &config{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config: %v", err)
+	}
+
+	for name := range cfg.Flags {
+		if err := checkConfigFlag(name); err != nil {
+			return nil, err
+		}
+	}
+	for env, profile := range cfg.Environments {
+		for name := range profile.flagValues(env) {
+			if err := checkConfigFlag(name); err != nil {
+				return nil, fmt.Errorf("environment %q: %v", env, err)
+			}
+		}
+	}
+	for symbol, flags := range cfg.Symbols {
+		if symbol != strings.ToUpper(symbol) {
+			return nil, fmt.Errorf("symbol %q must be upper case", symbol)
+		}
+		// Applying the overrides to an empty config validates them.
+		if _, err := (ClientConfig{SymbolOverrides: map[string]map[string]string{symbol: flagStrings(flags)}}).forSymbol(symbol); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// checkConfigFlag returns an error if the flag cannot be set by the config
+// file.
+func checkConfigFlag(name string) error {
+	switch {
+	case name == "config" || name == "env":
+		return fmt.Errorf("-%v cannot be set in the config file", name)
+	case flag.Lookup(name) == nil:
+		return fmt.Errorf("unknown flag %q", name)
+	}
+	return nil
+}
+
+// loadConfig sets the flags from the config file and the profile selected
+// with -env, and keeps the per-symbol overrides for the clients. Flags which
+// were set on the command line are left as they are. Backtests and live
+// trading load their config the same way.
+func loadConfig() error {
+	if *configFile == "" {
+		if *environment != "" {
+			return fmt.Errorf("-env=%v requires -config", *environment)
+		}
+		return nil
+	}
+	cfg, err := readConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	values := flagStrings(cfg.Flags)
+	if *environment != "" {
+		profile, ok := cfg.Environments[*environment]
+		if !ok {
+			return fmt.Errorf("environment %q is not in %v", *environment, *configFile)
+		}
+		for name, value := range profile.flagValues(*environment) {
+			values[name] = value
+		}
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, values[name]); err != nil {
+			return fmt.Errorf("unable to set -%v from %v: %v", name, *configFile, err)
+		}
+	}
+
+	for symbol, flags := range cfg.Symbols {
+		if symbolOverrides == nil {
+			symbolOverrides = map[string]map[string]string{}
+		}
+		symbolOverrides[symbol] = flagStrings(flags)
+	}
+
+	if *environment == "" {
+		log.Printf("loaded config %v", *configFile)
+		return nil
+	}
+	if err := checkEnvironment(*environment); err != nil {
+		return err
+	}
+	log.Printf("running in environment %q", *environment)
+	return nil
+}
+
+// checkEnvironment guards against an environment trading on the wrong
+// endpoint, e.g. a paper profile which was edited to use live credentials.
+func checkEnvironment(env string) error {
+	switch env {
+	case "paper":
+		if !isPaperEndpoint(*apiEndpoint) {
+			return fmt.Errorf("environment %q must use a paper endpoint, not %q", env, *apiEndpoint)
+		}
+	case "live":
+		if isPaperEndpoint(*apiEndpoint) {
+			return fmt.Errorf("environment %q must not use the paper endpoint %q", env, *apiEndpoint)
+		}
+		if *runBacktest {
+			return fmt.Errorf("environment %q cannot run a backtest", env)
+		}
+	}
+	return nil
+}
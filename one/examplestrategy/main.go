@@ -0,0 +1,95 @@
+// examplestrategy is a reference external strategy for trader-one, run with
+// -strategy_command=examplestrategy and -num_historical_bars_to_use greater
+// than -long_bars. It buys when the short moving average of the closes
+// crosses above the long moving average, and sells the open purchases when it
+// crosses back below.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+var (
+	shortBars = flag.Int("short_bars", 5, "The number of bars in the short moving average.")
+	longBars  = flag.Int("long_bars", 20, "The number of bars in the long moving average.")
+)
+
+// request is sent by trader-one each time a buy signal is evaluated.
+type request struct {
+	Symbol        string     `json:"symbol"`
+	Bars          []bar      `json:"bars"`
+	OpenPurchases []position `json:"open_purchases"`
+}
+
+type bar struct {
+	Time  int64   `json:"t"`
+	Close float64 `json:"c"`
+}
+
+type position struct {
+	ID    int64  `json:"id"`
+	Qty   string `json:"qty"`
+	Price string `json:"price"`
+}
+
+// decision is the reply to a request.
+type decision struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+func main() {
+	flag.Parse()
+	// Logs go to stderr, since stdout is only for decisions.
+	log.SetOutput(os.Stderr)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	out := json.NewEncoder(os.Stdout)
+	for scanner.Scan() {
+		var req request
+		d := decision{Action: "hold"}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			log.Printf("unable to parse request: %v", err)
+		} else {
+			d = decide(&req)
+		}
+		if err := out.Encode(d); err != nil {
+			log.Fatalf("unable to write decision: %v", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("unable to read requests: %v", err)
+	}
+}
+
+// decide compares the moving averages of the latest and the previous bar.
+func decide(req *request) decision {
+	n := len(req.Bars)
+	if n < *longBars+1 {
+		return decision{Action: "hold", Reason: fmt.Sprintf("%v bars is not enough", n)}
+	}
+	short, long := average(req.Bars, *shortBars), average(req.Bars, *longBars)
+	prevShort, prevLong := average(req.Bars[:n-1], *shortBars), average(req.Bars[:n-1], *longBars)
+	switch {
+	case len(req.OpenPurchases) == 0 && prevShort <= prevLong && short > long:
+		return decision{Action: "buy", Reason: fmt.Sprintf("%v-bar average %.2f crossed above %v-bar average %.2f", *shortBars, short, *longBars, long)}
+	case len(req.OpenPurchases) > 0 && prevShort >= prevLong && short < long:
+		return decision{Action: "sell", Reason: fmt.Sprintf("%v-bar average %.2f crossed below %v-bar average %.2f", *shortBars, short, *longBars, long)}
+	}
+	return decision{Action: "hold"}
+}
+
+// average returns the average close of the last n bars.
+func average(bars []bar, n int) float64 {
+	var sum float64
+	for _, b := range bars[len(bars)-n:] {
+		sum += b.Close
+	}
+	return sum / float64(n)
+}
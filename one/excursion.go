@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+// recordLowestPrice records the price for each purchase which holds shares,
+// so its maximum adverse excursion is known when it is sold. The lowest price
+// is stored with the purchase's next update.
+func (c *client) recordLowestPrice(price decimal.Decimal) {
+	for _, p := range heldPurchases(c.purchases) {
+		p.RecordPrice(price)
+	}
+}
+
+// excursionSummary describes the distribution of the maximum adverse
+// excursion of the sold purchases as a percentage of the buy price, overall
+// and for winners and losers, e.g.
+// "all: 40 trades, median 0.12%, p75 0.25%, p90 0.40%, max 0.90%; winners: ...".
+// A stop tighter than most winners' excursion would have stopped them out.
+func excursionSummary(purchases []*purchase.Purchase) string {
+	var all, winners, losers []decimal.Decimal
+	for _, p := range purchases {
+		if !p.BuyFilled() || !p.SellFilled() {
+			continue
+		}
+		mae, ok := p.MaxAdverseExcursionPercent()
+		if !ok {
+			continue
+		}
+		all = append(all, mae)
+		if p.RealizedProfitLoss().IsPositive() {
+			winners = append(winners, mae)
+		} else {
+			losers = append(losers, mae)
+		}
+	}
+	return fmt.Sprintf("all: %v; winners: %v; losers: %v",
+		distribution(all), distribution(winners), distribution(losers))
+}
+
+// distribution describes the percentiles of the percentages.
+func distribution(percents []decimal.Decimal) string {
+	if len(percents) == 0 {
+		return "0 trades"
+	}
+	sort.Slice(percents, func(i, j int) bool { return percents[i].LessThan(percents[j]) })
+	percentile := func(p int) decimal.Decimal {
+		return percents[(len(percents)-1)*p/100]
+	}
+	return fmt.Sprintf("%v trades, median %v%%, p75 %v%%, p90 %v%%, max %v%%",
+		len(percents), percentile(50).StringFixed(2), percentile(75).StringFixed(2),
+		percentile(90).StringFixed(2), percents[len(percents)-1].StringFixed(2))
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	orderInterval   = flag.Duration("order_interval", 0, "The minimum time between orders placed by the execution engine. Queued orders wait their turn, highest priority first.")
+	orderRetries    = flag.Int("order_retries", 2, "The number of times an order which could not be placed is retried.")
+	orderRetryDelay = flag.Duration("order_retry_delay", 2*time.Second, "How long to wait before retrying an order which could not be placed.")
+	buySignalTTL    = flag.Duration("buy_signal_ttl", 30*time.Second, "A queued buy which could not be placed this long after its signal is dropped, since the price has moved on.")
+
+	backtestMaxOrdersPerTick = flag.Int("backtest_max_orders_per_tick", 0, "When positive, at most this many orders are placed each minute of a backtest, and the rest wait for the next minute. This simulates API throttling.")
+)
+
+// Order priorities, most urgent first.
+const (
+	// priorityProtect places the sell order of a filled buy, which is
+	// unprotected until it is placed.
+	priorityProtect = iota
+	// priorityBuy places the buy order of a buy signal.
+	priorityBuy
+)
+
+// orderIntent is an order the signals decided to place, waiting in the
+// execution queue.
+type orderIntent struct {
+	priority int
+	queuedAt time.Time
+
+	// purchase is the purchase to place a sell order for.
+	purchase *purchase.Purchase
+
+	// The buy signal to place a buy order for.
+	bars   []alpaca.Bar
+	qty    decimal.Decimal
+	signal time.Time
+	reason string
+
+	attempts  int
+	notBefore time.Time
+
+	// retryOf is the purchase whose failed buy order the buy retries.
+	retryOf *purchase.Purchase
+
+	// approval is the manual approval the buy waits for, if it needs one.
+	approval *approvalRequest
+}
+
+// executionQueue holds the orders waiting to be placed. The signals add
+// orders to it every tick, and the execution engine places them in order of
+// priority, retrying and spacing them out as needed.
+type executionQueue struct {
+	mu        sync.Mutex
+	intents   []*orderIntent
+	wake      chan struct{}
+	started   sync.Once
+	lastOrder time.Time
+}
+
+func newExecutionQueue() *executionQueue {
+	return &executionQueue{wake: make(chan struct{}, 1)}
+}
+
+// add queues the intent, unless the same order is already queued.
+func (q *executionQueue) add(in *orderIntent) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, queued := range q.intents {
+		if in.purchase != nil && queued.purchase == in.purchase {
+			return false
+		}
+		if in.retryOf != nil {
+			if queued.retryOf == in.retryOf {
+				return false
+			}
+			continue
+		}
+		if in.priority == priorityBuy && queued.priority == priorityBuy && queued.retryOf == nil && queued.signal.Equal(in.signal) {
+			return false
+		}
+	}
+	q.intents = append(q.intents, in)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pendingBuys returns the number of queued buys.
+func (q *executionQueue) pendingBuys() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, in := range q.intents {
+		if in.priority == priorityBuy {
+			n++
+		}
+	}
+	return n
+}
+
+// dropBuys removes the queued buys. It returns the number removed.
+func (q *executionQueue) dropBuys() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var kept []*orderIntent
+	for _, in := range q.intents {
+		if in.priority != priorityBuy {
+			kept = append(kept, in)
+		}
+	}
+	n := len(q.intents) - len(kept)
+	q.intents = kept
+	return n
+}
+
+// next removes and returns the most urgent intent which is due at now. Intents
+// of the same priority are placed in the order they were queued. Buys are
+// skipped unless buys is true. nil is returned if no intent is due.
+func (q *executionQueue) next(now time.Time, buys bool) *orderIntent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	sort.SliceStable(q.intents, func(i, j int) bool {
+		return q.intents[i].priority < q.intents[j].priority
+	})
+	for i, in := range q.intents {
+		if in.notBefore.After(now) || (!buys && in.priority == priorityBuy) {
+			continue
+		}
+		q.intents = append(q.intents[:i], q.intents[i+1:]...)
+		return in
+	}
+	return nil
+}
+
+// throttle returns how long to wait before the next order may be placed,
+// given the minimum interval between orders.
+func (q *executionQueue) throttle(now time.Time, interval time.Duration) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lastOrder.Add(interval).Sub(now)
+}
+
+// placed records that an order was attempted at now.
+func (q *executionQueue) placed(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lastOrder = now
+}
+
+// enqueue adds the intent to the client's execution queue. The execution
+// engine is started with the first intent, except in backtests where the
+// queue is drained at the end of each tick.
+func (c *client) enqueue(in *orderIntent) {
+	in.queuedAt = c.now()
+	if !c.orders.add(in) {
+		return
+	}
+	if !c.cfg.Backtest {
+		c.orders.started.Do(func() { go c.execute() })
+	}
+}
+
+// execute is the execution engine. It places the queued orders as they come
+// due, waiting order_interval between orders. While the API calls approach
+// the rate limit, only protective sells are placed, so the calls left are not
+// spent on new entries while filled buys are unprotected. The intent is taken
+// from the queue on the client's shard, so a tick never sees a buy which is
+// neither queued nor one of the purchases, and cannot exceed
+// max_concurrent_purchases.
+func (c *client) execute() {
+	for {
+		if wait := c.orders.throttle(time.Now(), c.cfg.OrderInterval); wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+		var in *orderIntent
+		c.do(func() {
+			now := time.Now()
+			if in = c.orders.next(now, !alpacaUsage.nearLimit(now)); in != nil {
+				c.place(in, now)
+			}
+		})
+		if in == nil {
+			// Wait for a new intent, or for a retry to come due.
+			select {
+			case <-c.orders.wake:
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// drainOrders places every queued order which is due at now, without waiting
+// between orders, up to backtest_max_orders_per_tick. Backtests drain the
+// queue at the end of each tick.
+func (c *client) drainOrders(now time.Time) {
+	for n := 0; c.cfg.BacktestMaxOrdersPerTick <= 0 || n < c.cfg.BacktestMaxOrdersPerTick; n++ {
+		in := c.orders.next(now, true)
+		if in == nil {
+			return
+		}
+		c.place(in, now)
+	}
+}
+
+// place places the order of the intent. An order which could not be placed is
+// queued again to be retried after order_retry_delay.
+func (c *client) place(in *orderIntent, now time.Time) {
+	var ok bool
+	switch in.priority {
+	case priorityProtect:
+		p := in.purchase
+		if !p.BuyFilled() || !p.NotSelling() {
+			// The purchase was sold or protected since it was queued.
+			return
+		}
+		c.orders.placed(now)
+		ok = c.placeSellOrder(p)
+	case priorityBuy:
+		// An approved buy is placed however long the approval took.
+		if in.approval != nil && !c.awaitApproval(in, now) {
+			return
+		}
+		if age := now.Sub(in.signal); in.approval == nil && age > c.cfg.BuySignalTTL {
+			log.Printf("dropping the buy signal @ %v which could not be placed for %v", in.signal, age.Round(time.Second))
+			return
+		}
+		if kill.isEngaged() {
+			log.Printf("dropping the buy signal @ %v, the kill switch is engaged", in.signal)
+			return
+		}
+		// The arm had the turn when the signal was queued, but another of its
+		// signals may have been placed since.
+		if c.experiment != nil && in.retryOf == nil && !c.experiment.hasTurn(c.strategy) {
+			log.Printf("dropping the buy signal @ %v, it is not the turn of arm %v", in.signal, c.strategy)
+			return
+		}
+		price := decimal.NewFromFloat32(in.bars[len(in.bars)-1].Close)
+		if in.approval == nil && c.approvalRequired(in.qty, price) {
+			in.approval = c.requestApproval(in.qty, price, now)
+			in.notBefore = now.Add(time.Second)
+			c.orders.add(in)
+			return
+		}
+		c.orders.placed(now)
+		if p := c.placeBuyOrder(in.bars, in.qty, in.signal); p != nil {
+			p.EntryReason = in.reason
+			p.EntryBars = in.bars
+			p.EntryRetry = in.retryOf != nil
+			ok = true
+			// The turn only passes once the arm has bought, so a signal which
+			// is dropped or fails to place does not cost the arm its turn. A
+			// retry replaces a buy which already passed it.
+			if c.experiment != nil && in.retryOf == nil {
+				c.experiment.nextTurn()
+			}
+		}
+	}
+	if ok {
+		if wait := now.Sub(in.queuedAt); wait > time.Second {
+			log.Printf("order placed %v after it was queued", wait.Round(time.Millisecond))
+		}
+		return
+	}
+	in.attempts++
+	if in.attempts > c.cfg.OrderRetries {
+		log.Printf("giving up placing an order after %v attempts", in.attempts)
+		return
+	}
+	in.notBefore = now.Add(c.cfg.OrderRetryDelay)
+	c.orders.add(in)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var queueTime = time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC)
+
+// fillQueue queues the buys before the protective sells, so that the sells
+// only come first by their priority. The purchases of the sells have no buy
+// order, so place drops them without placing an order.
+func fillQueue(q *executionQueue, buys, sells int) {
+	for i := 0; i < buys; i++ {
+		q.add(&orderIntent{priority: priorityBuy, signal: queueTime.Add(time.Duration(i) * time.Minute)})
+	}
+	for i := 0; i < sells; i++ {
+		q.add(&orderIntent{priority: priorityProtect, purchase: &purchase.Purchase{}})
+	}
+}
+
+// queued returns the number of queued sells and buys.
+func queued(q *executionQueue) (sells, buys int) {
+	buys = q.pendingBuys()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.intents) - buys, buys
+}
+
+func TestNextPlacesProtectiveSellsFirst(t *testing.T) {
+	q := newExecutionQueue()
+	fillQueue(q, 2, 2)
+	var got []int
+	for in := q.next(queueTime, true); in != nil; in = q.next(queueTime, true) {
+		got = append(got, in.priority)
+	}
+	want := []int{priorityProtect, priorityProtect, priorityBuy, priorityBuy}
+	if len(got) != len(want) {
+		t.Fatalf("next returned priorities %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("next returned priorities %v, want %v", got, want)
+		}
+	}
+}
+
+func TestNextNearRateLimit(t *testing.T) {
+	u := &apiUsage{minute: queueTime.Truncate(time.Minute), minuteCalls: *apiRateLimit}
+	if !u.nearLimit(queueTime) {
+		t.Fatalf("nearLimit(%v) = false after %v calls, want true", queueTime, *apiRateLimit)
+	}
+	q := newExecutionQueue()
+	fillQueue(q, 3, 2)
+	for i := 0; i < 2; i++ {
+		in := q.next(queueTime, !u.nearLimit(queueTime))
+		if in == nil || in.priority != priorityProtect {
+			t.Fatalf("next #%d near the rate limit = %+v, want a protective sell", i, in)
+		}
+	}
+	if in := q.next(queueTime, !u.nearLimit(queueTime)); in != nil {
+		t.Fatalf("next near the rate limit = %+v, want no buy", in)
+	}
+	if sells, buys := queued(q); sells != 0 || buys != 3 {
+		t.Fatalf("queued %v sells and %v buys near the rate limit, want 0 and 3", sells, buys)
+	}
+
+	// The calls are counted per minute, so the buys are placed in the next.
+	later := queueTime.Add(time.Minute)
+	if in := q.next(later, !u.nearLimit(later)); in == nil || in.priority != priorityBuy {
+		t.Fatalf("next in the following minute = %+v, want a buy", in)
+	}
+}
+
+func TestDrainOrdersPerTickCap(t *testing.T) {
+	c := &client{
+		cfg:    ClientConfig{Backtest: true, BacktestMaxOrdersPerTick: 2},
+		orders: newExecutionQueue(),
+	}
+	fillQueue(c.orders, 3, 3)
+	c.drainOrders(queueTime)
+	if sells, buys := queued(c.orders); sells != 1 || buys != 3 {
+		t.Fatalf("queued %v sells and %v buys after draining 2 orders, want 1 and 3", sells, buys)
+	}
+}
+
+func TestPlacedBuyPassesExperimentTurn(t *testing.T) {
+	c := newBacktestTestClient(t, ClientConfig{BuySignalTTL: time.Hour, OrderRetries: 1}, 10, "100", "50")
+	c.strategy = "one/a"
+	c.experiment = &experiment{arms: []string{"one/a", "one/b"}, alternate: true}
+	buy := func(signal time.Time) *orderIntent {
+		return &orderIntent{
+			priority: priorityBuy,
+			bars:     []alpaca.Bar{{Close: 100}},
+			qty:      decimal.NewFromInt(1),
+			signal:   signal,
+			queuedAt: signal,
+		}
+	}
+
+	c.place(buy(backtestTestStart), backtestTestStart)
+	if len(c.purchases) != 1 {
+		t.Fatalf("placing the buy signal made %v purchases, want 1", len(c.purchases))
+	}
+	if c.experiment.hasTurn("one/a") {
+		t.Error("arm one/a still has the turn after it bought")
+	}
+
+	// A second signal queued while the arm had the turn is dropped.
+	c.place(buy(backtestTestStart.Add(time.Minute)), backtestTestStart.Add(time.Minute))
+	if len(c.purchases) != 1 {
+		t.Errorf("placing a buy signal without the turn made %v purchases, want 1", len(c.purchases))
+	}
+	if !c.experiment.hasTurn("one/b") {
+		t.Error("arm one/b lost the turn to a dropped signal")
+	}
+}
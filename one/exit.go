@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	breakevenStopTrigger = flag.Float64("breakeven_stop_trigger", 0, "When positive, the stop of a sell order is moved to breakeven once the price is this percent above the buy price.")
+	breakevenStopOffset  = flag.Float64("breakeven_stop_offset", 0.01, "The amount in dollars above the buy price the breakeven stop is placed at.")
+)
+
+// tightenStops moves the stop of each open sell order to breakeven once the
+// purchase has gained breakeven_stop_trigger percent.
+func (c *client) tightenStops() {
+	if c.cfg.BreakevenStopTrigger <= 0 {
+		return
+	}
+	var q *quote
+	for _, p := range c.inProgressSellOrders() {
+		stop, ok := c.breakevenStop(p)
+		if !ok {
+			continue
+		}
+		cost := *p.BuyOrder.FilledAvgPrice
+		trigger := cost.Mul(decimal.NewFromFloat(1 + c.cfg.BreakevenStopTrigger/100))
+		if q == nil {
+			var err error
+			if q, err = c.latestQuote(); err != nil {
+				log.Printf("unable to check for breakeven stops: %v", err)
+				return
+			}
+		}
+		if q.last.LessThan(trigger) {
+			continue
+		}
+		if err := c.replaceStop(p, stop); err != nil {
+			log.Printf("unable to move stop of sell order %q to breakeven: %v", p.SellOrder.ID, err)
+			continue
+		}
+		if err := c.dbClient.Update(p); err != nil {
+			log.Printf("unable to update for breakeven stop:%v\n%+v", err, p)
+		}
+		c.narrate(c.now(), "moved stop of %v %v to breakeven $%v after the price reached $%v", p.BuyOrder.FilledQty, c.stockSymbol, stop.StringFixed(2), q.last.StringFixed(2))
+	}
+}
+
+// breakevenStop returns the breakeven stop price of the purchase. It returns
+// false if the purchase has no stop leg or its stop is already at or above
+// breakeven.
+func (c *client) breakevenStop(p *purchase.Purchase) (decimal.Decimal, bool) {
+	if p.BuyOrder.FilledAvgPrice == nil || p.SellOrder.Legs == nil || len(*p.SellOrder.Legs) == 0 {
+		return decimal.Decimal{}, false
+	}
+	leg := (*p.SellOrder.Legs)[0]
+	if leg.StopPrice == nil {
+		return decimal.Decimal{}, false
+	}
+	stop := p.BuyOrder.FilledAvgPrice.Add(decimal.NewFromFloat(c.cfg.BreakevenStopOffset))
+	stop = roundToTick(stop, true)
+	if leg.StopPrice.GreaterThanOrEqual(stop) {
+		return decimal.Decimal{}, false
+	}
+	return stop, true
+}
+
+// replaceStop replaces the stop leg of the purchase's sell order. The stop's
+// limit price keeps its distance below the stop price.
+func (c *client) replaceStop(p *purchase.Purchase, stop decimal.Decimal) error {
+	leg := &(*p.SellOrder.Legs)[0]
+	var limit *decimal.Decimal
+	if leg.LimitPrice != nil {
+		l := roundToTick(stop.Sub(leg.StopPrice.Sub(*leg.LimitPrice)), false)
+		limit = &l
+	}
+	log.Printf("moving stop of sell order %q from $%v to breakeven $%v", p.SellOrder.ID, leg.StopPrice, stop)
+	if isSyntheticOCO(p.SellOrder) && leg.Status != ocoHeld {
+		return fmt.Errorf("the stop of emulated sell order %q already traded", p.SellOrder.ID)
+	}
+	if c.cfg.Backtest || c.shadow || isSyntheticOCO(p.SellOrder) {
+		// The stop of an emulated sell is held locally.
+		leg.StopPrice = &stop
+		leg.LimitPrice = limit
+		return nil
+	}
+	replaced, err := c.alpacaClient.ReplaceOrder(leg.ID, alpaca.ReplaceOrderRequest{
+		StopPrice:   &stop,
+		LimitPrice:  limit,
+		TimeInForce: leg.TimeInForce,
+	})
+	if err != nil {
+		return err
+	}
+	p.AddReplacements(purchase.NewReplacement(leg, replaced.ID))
+	*leg = *replaced
+	return nil
+}
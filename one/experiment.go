@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	experimentArmB       = flag.String("experiment_arm_b", "", "When set, an A/B experiment is run. Arm A uses the strategy flags and arm B overrides them with this comma separated list, e.g. \"min_slope_required_to_buy=1.5,num_historical_bars_to_use=5\".")
+	experimentAllocation = flag.String("experiment_allocation", "alternate", "How the arms of an experiment share trading. With \"alternate\" the arms take turns acting on buy signals, with \"split\" each arm acts on all of its signals. Either way each arm gets half of max_concurrent_purchases.")
+)
+
+// experiment coordinates the arms of a live A/B strategy experiment.
+type experiment struct {
+	mu        sync.Mutex
+	arms      []string
+	turn      int
+	alternate bool
+}
+
+// hasTurn returns true if the arm may act on its next buy signal.
+func (e *experiment) hasTurn(arm string) bool {
+	if !e.alternate {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.arms[e.turn] == arm
+}
+
+// nextTurn passes the turn to the next arm.
+func (e *experiment) nextTurn() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.turn = (e.turn + 1) % len(e.arms)
+}
+
+// newExperimentClients returns a client for each arm of the experiment. Each
+// arm's purchases are tagged with the strategy name suffixed by the arm.
+func newExperimentClients(cfg ClientConfig) ([]*client, error) {
+	if cfg.Backtest {
+		return nil, fmt.Errorf("experiments cannot be run as a backtest")
+	}
+	var alternate bool
+	switch *experimentAllocation {
+	case "alternate":
+		alternate = true
+	case "split":
+	default:
+		return nil, fmt.Errorf("unknown experiment_allocation %q", *experimentAllocation)
+	}
+	cfg, err := cfg.forSymbol(*stockSymbol)
+	if err != nil {
+		return nil, err
+	}
+	// The arms split the concurrent purchases, and an arm with none never
+	// trades.
+	if cfg.MaxConcurrentPurchases < 2 {
+		return nil, fmt.Errorf("an experiment needs max_concurrent_purchases of at least 2 to split between its arms, not %v", cfg.MaxConcurrentPurchases)
+	}
+	paramsA := cfg.Params
+	paramsB, err := parseStrategyParams(paramsA, *experimentArmB)
+	if err != nil {
+		return nil, fmt.Errorf("invalid experiment_arm_b: %v", err)
+	}
+
+	e := &experiment{
+		arms:      []string{*strategyName + "/A", *strategyName + "/B"},
+		alternate: alternate,
+	}
+	var clients []*client
+	for i, params := range []strategyParams{paramsA, paramsB} {
+		armCfg := cfg
+		armCfg.Params = params
+		armCfg.MaxConcurrentPurchases = cfg.MaxConcurrentPurchases / 2
+		c, err := new(*stockSymbol, e.arms[i], armCfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.checkPromotion(); err != nil {
+			return nil, err
+		}
+		c.experiment = e
+		clients = append(clients, c)
+		log.Printf("experiment arm %v: %+v", e.arms[i], params)
+	}
+	return clients, nil
+}
+
+// parseStrategyParams returns base with the overrides applied. Overrides are
+// a comma separated list of flag=value pairs.
+func parseStrategyParams(base strategyParams, overrides string) (strategyParams, error) {
+	params := base
+	for _, o := range strings.Split(overrides, ",") {
+		kv := strings.SplitN(strings.TrimSpace(o), "=", 2)
+		if len(kv) != 2 {
+			return params, fmt.Errorf("%q is not of the form flag=value", o)
+		}
+		ok, err := params.set(kv[0], kv[1])
+		if !ok {
+			return params, fmt.Errorf("%q is not a strategy flag", kv[0])
+		}
+		if err != nil {
+			return params, err
+		}
+	}
+	return params, nil
+}
+
+// set sets the param of the strategy flag to the value. False is returned if
+// the flag is not a strategy flag.
+func (p *strategyParams) set(name, value string) (bool, error) {
+	var err error
+	switch name {
+	case "num_historical_bars_to_use":
+		p.numHistoricalBars, err = strconv.Atoi(value)
+	case "all_sequential_increases_to_buy":
+		p.allSequentialIncreases, err = strconv.ParseBool(value)
+	case "min_slope_required_to_buy":
+		p.minSlope, err = strconv.ParseFloat(value, 64)
+	case "sell_mode":
+		p.sellMode = value
+		if value != sellModeOCO && value != sellModeTrailingStop && value != sellModeEmulatedTrailingStop {
+			err = fmt.Errorf("unknown sell mode")
+		}
+	case "trailing_stop_percent":
+		p.trailingStopPercent, err = strconv.ParseFloat(value, 64)
+		if err == nil && (p.trailingStopPercent <= 0 || p.trailingStopPercent >= 100) {
+			err = fmt.Errorf("must be between 0 and 100")
+		}
+	case "min_signal_streak":
+		p.minSignalStreak, err = strconv.Atoi(value)
+		if err == nil && p.minSignalStreak < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid value for %q: %v", name, err)
+	}
+	return true, nil
+}
+
+// armStats are the statistics of the completed purchases of an arm.
+type armStats struct {
+	trades     int
+	wins       int
+	profitLoss decimal.Decimal
+}
+
+// newArmStats computes the statistics for the given purchases.
+func newArmStats(purchases []*purchase.Purchase) armStats {
+	var s armStats
+	for _, p := range purchases {
+		if !p.BuyFilled() || !p.SellFilled() {
+			continue
+		}
+		s.trades++
+		pl := p.RealizedProfitLoss()
+		if !pl.IsNegative() {
+			s.wins++
+		}
+		s.profitLoss = s.profitLoss.Add(pl)
+	}
+	return s
+}
+
+// logExperimentReport logs a comparison of the arms of the experiment.
+func logExperimentReport(clients []*client) {
+	log.Printf("strategy comparison:")
+	for _, c := range clients {
+		var s armStats
+		c.do(func() { s = newArmStats(c.purchases) })
+		winRate := 0.0
+		if s.trades > 0 {
+			winRate = 100 * float64(s.wins) / float64(s.trades)
+		}
+		log.Printf("  %v: %v trades, %v wins (%.1f%%), P/L $%v",
+			c.strategy, s.trades, s.wins, winRate, s.profitLoss.StringFixed(2))
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/trader/indicators"
+)
+
+// explainCommand is the command which explains the buy decision of the
+// configured strategy at a time, e.g.
+// "one -min_slope_required_to_buy=0.05 explain -time "2024-05-03 10:31" -symbol SPY".
+// The strategy flags go before the command.
+const explainCommand = "explain"
+
+// explainTimeLayouts are the layouts accepted by -time, in EST.
+var explainTimeLayouts = []string{"2006-01-02 15:04", "2006-01-02 15:04:05"}
+
+// explainCondition is a condition of the buy decision.
+type explainCondition struct {
+	name  string
+	value string
+	pass  bool
+}
+
+// explain prints each condition of the buy decision at a time, answering
+// "why no trade here?" without running a backtest. The state of a running
+// trader, such as its open purchases and the drawdown breaker, is unknown, so
+// only the strategy and the rules which depend on the time are explained.
+func explain(args []string) error {
+	fs := flag.NewFlagSet(explainCommand, flag.ContinueOnError)
+	at := fs.String("time", "", "The time to explain in EST (format: 2006-01-02 15:04).")
+	symbol := fs.String("symbol", *stockSymbol, "The symbol to explain. Defaults to stock_symbol.")
+	source := fs.String("source", "auto", "Where the bars are loaded from: \"storage\" (the bars stored with persist_bars, as the trader saw them at the time), \"api\" (the Alpaca data API) or \"auto\" (storage, and the API when too few bars are stored).")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *at == "" || *symbol == "" {
+		return fmt.Errorf("-time and -symbol are required")
+	}
+	if *strategyCommand != "" {
+		return fmt.Errorf("the decisions of strategy_command cannot be explained")
+	}
+	var t time.Time
+	var err error
+	for _, layout := range explainTimeLayouts {
+		if t, err = time.ParseInLocation(layout, *at, EST); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse -time: %v", err)
+	}
+	if err := loadBlackoutCalendar(); err != nil {
+		return err
+	}
+
+	cfg, err := flagClientConfig().forSymbol(strings.ToUpper(*symbol))
+	if err != nil {
+		return err
+	}
+	c := &client{stockSymbol: strings.ToUpper(*symbol), strategy: *strategyName, cfg: cfg}
+	n := cfg.Params.numHistoricalBars
+	if cfg.VolatilityFilterBars+1 > n {
+		n = cfg.VolatilityFilterBars + 1
+	}
+	if cfg.indicatorFilterBars() > n {
+		n = cfg.indicatorFilterBars()
+	}
+	bars, from, err := explainBars(c, *source, t, n)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("explaining the %v strategy for %v @ %v with %v %v bars from %v\n", c.strategy, c.stockSymbol, t.Format("2006-01-02 15:04:05 MST"), len(bars), cfg.BarTimeframe, from)
+	conditions, err := c.explainConditions(t, bars)
+	if err != nil {
+		return err
+	}
+	writeExplanation(os.Stdout, conditions)
+	return nil
+}
+
+// explainBars returns up to n bars of the symbol which started before t.
+// The source of the bars is also returned.
+func explainBars(c *client, source string, t time.Time, n int) ([]alpaca.Bar, string, error) {
+	lookback := c.cfg.barsLookback(n)
+	switch source {
+	case "storage", "auto":
+		bars, err := explainStoredBars(c, t.Add(-lookback), t)
+		switch {
+		case err != nil && source == "storage":
+			return nil, "", err
+		case err != nil:
+			log.Printf("unable to load the stored bars, using the data API: %v", err)
+		case source == "storage" || len(bars) >= c.cfg.Params.numHistoricalBars:
+			return lastBars(bars, n), "storage", nil
+		}
+	case "api":
+	default:
+		return nil, "", fmt.Errorf("unknown -source %q", source)
+	}
+
+	alpacaClient := alpaca.NewClient(common.Credentials())
+	startDt := t.Add(-lookback)
+	limit := n + 1
+	bars, err := alpacaClient.GetSymbolBars(c.stockSymbol, alpaca.ListBarParams{
+		Timeframe: c.cfg.BarTimeframe,
+		StartDt:   &startDt,
+		EndDt:     &t,
+		Limit:     &limit,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to get bars: %v", err)
+	}
+	// The bar starting at t was not known at t.
+	var before []alpaca.Bar
+	for _, b := range bars {
+		if time.Unix(b.Time, 0).Before(t) {
+			before = append(before, b)
+		}
+	}
+	return lastBars(before, n), "the data API", nil
+}
+
+// explainStoredBars returns the stored bars of the client's symbol in the
+// range as the trader saw them at end.
+func explainStoredBars(c *client, start, end time.Time) ([]alpaca.Bar, error) {
+	db, err := database.NewInstance(c.cfg.DatabaseName, c.cfg.Instance)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open db: %v", err)
+	}
+	return storedBarsAsOf(db, c.stockSymbol, c.cfg.BarTimeframe, start, end)
+}
+
+// storedBarsAsOf returns the stored bars of the symbol and timeframe in the
+// range as the trader last saw them at or before end. A bar which was still
+// forming is returned as it was then.
+func storedBarsAsOf(db database.Client, symbol, timeframe string, start, end time.Time) ([]alpaca.Bar, error) {
+	stored, err := db.Bars(symbol, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get stored bars of %v: %v", symbol, err)
+	}
+	var bars []alpaca.Bar
+	for _, b := range stored {
+		if b.Timeframe != timeframe || b.EvaluatedAt.After(end) {
+			continue
+		}
+		// The bars are ordered by bar time and then by evaluation.
+		if n := len(bars); n > 0 && bars[n-1].Time == b.Time {
+			bars[n-1] = b.Bar
+			continue
+		}
+		bars = append(bars, b.Bar)
+	}
+	return bars, nil
+}
+
+// lastBars returns the last n of the bars.
+func lastBars(bars []alpaca.Bar, n int) []alpaca.Bar {
+	if len(bars) > n {
+		return bars[len(bars)-n:]
+	}
+	return bars
+}
+
+// explainConditions evaluates each condition of the buy decision at t, as
+// buy and buyEvent do. All of them are evaluated, even after one fails.
+func (c *client) explainConditions(t time.Time, bars []alpaca.Bar) ([]explainCondition, error) {
+	var conditions []explainCondition
+	add := func(name string, pass bool, format string, a ...interface{}) {
+		conditions = append(conditions, explainCondition{name: name, value: fmt.Sprintf(format, a...), pass: pass})
+	}
+
+	reason := c.blackedOut(t)
+	add(ruleBlackout, reason == "", "%v", valueOr(reason, "none"))
+
+	all := bars
+	bars = lastBars(bars, c.cfg.Params.numHistoricalBars)
+	add("bars", len(bars) >= c.cfg.Params.numHistoricalBars, "%v of %v", len(bars), c.cfg.Params.numHistoricalBars)
+	if len(bars) < 2 {
+		return conditions, nil
+	}
+
+	if c.cfg.SignalSource != "" {
+		f := &signalFeed{}
+		if err := f.load(c.cfg.SignalSource); err != nil {
+			return nil, err
+		}
+		s, ok := f.next(c.stockSymbol, time.Time{}, t)
+		if !ok {
+			add("signal", false, "none at or before %v", t.Format("15:04:05"))
+			return conditions, nil
+		}
+		add("signal", s.Side == signalBuy, "%v @ %v %v", s.Side, s.Time.In(EST).Format("15:04:05"), s.Reason)
+		add("signal_max_age", t.Sub(s.Time) <= c.cfg.SignalMaxAge, "%v old, at most %v", t.Sub(s.Time), c.cfg.SignalMaxAge)
+		add("signal_min_confidence", s.Confidence >= c.cfg.SignalMinConfidence, "%.2f ≥ %v", s.Confidence, c.cfg.SignalMinConfidence)
+	} else {
+		first, last := bars[0].Close, bars[len(bars)-1].Close
+		add("last close ≥ first close", last >= first, "%.2f vs %.2f", last, first)
+		m, ok := indicators.LeastSquaresSlope(bars)
+		add("min_slope_required_to_buy", ok && m >= c.cfg.Params.minSlope, "slope %.4f, at least %v", m, c.cfg.Params.minSlope)
+		if c.cfg.Params.allSequentialIncreases {
+			value, pass := "every close increases", true
+			for i := 1; i < len(bars) && pass; i++ {
+				if bars[i].Close <= bars[i-1].Close {
+					value = fmt.Sprintf("close %.2f @ %v after %.2f", bars[i].Close, time.Unix(bars[i].Time, 0).In(EST).Format("15:04"), bars[i-1].Close)
+					pass = false
+				}
+			}
+			add("all_sequential_increases_to_buy", pass, "%v", value)
+		}
+	}
+
+	// The volatility filter would request more bars when there are too few,
+	// so it is only evaluated when all of them were loaded.
+	if c.cfg.MinVolatilityPercent > 0 || c.cfg.MaxVolatilityPercent > 0 {
+		v, ok := indicators.Volatility(lastBars(all, c.cfg.VolatilityFilterBars+1), 0)
+		if len(all) < c.cfg.VolatilityFilterBars+1 || !ok {
+			add(ruleVolatility, true, "unable to measure, not filtered")
+		} else if block := c.volatilityBlock(all); block != nil {
+			add(ruleVolatility, false, "%v", block.detail)
+		} else {
+			add(ruleVolatility, true, "%.4f%%", v*100)
+		}
+	}
+	if n := c.cfg.indicatorFilterBars(); n > 0 {
+		for _, f := range c.indicatorFilters(lastBars(all, n)) {
+			if len(all) < n || !f.measured {
+				add(ruleIndicators, true, "unable to measure the %v, not filtered", f.name)
+				continue
+			}
+			add(ruleIndicators, f.pass, "%v", f.detail)
+		}
+	}
+	return conditions, nil
+}
+
+// writeExplanation writes the conditions and the resulting decision.
+func writeExplanation(w io.Writer, conditions []explainCondition) {
+	var failed []string
+	for _, c := range conditions {
+		result := "pass"
+		if !c.pass {
+			result = "FAIL"
+			failed = append(failed, c.name)
+		}
+		fmt.Fprintf(w, "  %-4v  %-32v %v\n", result, c.name, c.value)
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(w, "decision: no buy, failed %v\n", strings.Join(failed, ", "))
+		return
+	}
+	fmt.Fprintf(w, "decision: buy\n")
+}
+
+// valueOr returns s, or def when s is empty.
+func valueOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+var (
+	strategyCommand = flag.String("strategy_command", "", "When set, buy and sell decisions are made by this external strategy process instead of the slope strategy, e.g. \"python3 strategy.py\". See externalstrategy.go for the protocol and examplestrategy for a reference strategy.")
+	strategyTimeout = flag.Duration("strategy_timeout", 5*time.Second, "How long to wait for a decision from the external strategy. A strategy which does not reply in time or exits is killed, an alert is sent and it is started again for the next request.")
+)
+
+// An external strategy is a process which reads requests from stdin and
+// writes decisions to stdout, one JSON object per line. Each time a buy
+// signal is evaluated, the strategy is sent the latest bars and the open
+// purchases of the symbol:
+//
+//	{"symbol": "SPY", "strategy": "slope", "time": "2020-01-02T10:31:00-05:00",
+//	 "bars": [{"t": 1577979000, "o": 300.1, "h": 300.4, "l": 300.0, "c": 300.3, "v": 1200}],
+//	 "open_purchases": [{"id": 12, "qty": "10", "price": "299.80"}]}
+//
+// and replies with a decision:
+//
+//	{"action": "buy", "reason": "breakout above 300.25"}
+//
+// The action is "buy" to buy, "sell" to sell all open purchases at market, or
+// "hold" to do nothing. Anything the strategy writes to stderr is logged.
+//
+// A strategy which needs memory, e.g. the highest price since it bought,
+// replies with it as any JSON value in "state". The latest state is sent with
+// each request of the symbol, and is stored in the database so it is sent
+// again after a restart:
+//
+//	{"action": "hold", "state": {"highest": 301.2}}
+const (
+	strategyBuy  = "buy"
+	strategySell = "sell"
+	strategyHold = "hold"
+)
+
+// strategyRequest is sent to the external strategy.
+type strategyRequest struct {
+	Symbol        string             `json:"symbol"`
+	Strategy      string             `json:"strategy"`
+	Time          time.Time          `json:"time"`
+	Bars          []alpaca.Bar       `json:"bars"`
+	OpenPurchases []strategyPosition `json:"open_purchases"`
+	State         json.RawMessage    `json:"state,omitempty"`
+}
+
+// strategyPosition is an open purchase sent to the external strategy.
+type strategyPosition struct {
+	ID    int64  `json:"id"`
+	Qty   string `json:"qty"`
+	Price string `json:"price"`
+}
+
+// strategyDecision is the reply of the external strategy.
+type strategyDecision struct {
+	Action string          `json:"action"`
+	Reason string          `json:"reason"`
+	State  json.RawMessage `json:"state,omitempty"`
+}
+
+// errStrategyFailed is returned when the running external strategy stopped
+// replying or exited.
+var errStrategyFailed = errors.New("external strategy failed")
+
+// externalStrategy runs the external strategy process. Requests are made one
+// at a time. A process which fails is killed and a new one is started for
+// the next request.
+type externalStrategy struct {
+	mu      sync.Mutex
+	command string
+	proc    *strategyProcess
+}
+
+// strategyProcess is a running process of the external strategy.
+type strategyProcess struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	decisions chan strategyDecision
+	// done is closed once the process is stopped, so a reply it sends
+	// late is dropped instead of blocking.
+	done chan struct{}
+}
+
+// external is the running external strategy. It is nil unless
+// strategy_command is set.
+var external *externalStrategy
+
+// startExternalStrategy starts the strategy_command process, if set.
+func startExternalStrategy() error {
+	if *strategyCommand == "" {
+		return nil
+	}
+	s := &externalStrategy{command: *strategyCommand}
+	if err := s.start(); err != nil {
+		return err
+	}
+	external = s
+	return nil
+}
+
+// start starts a process of the strategy.
+func (s *externalStrategy) start() error {
+	args := strings.Fields(s.command)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("unable to connect to external strategy: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("unable to connect to external strategy: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start external strategy: %v", err)
+	}
+	p := &strategyProcess{
+		cmd:       cmd,
+		stdin:     stdin,
+		decisions: make(chan strategyDecision, 1),
+		done:      make(chan struct{}),
+	}
+	go p.read(stdout)
+	s.proc = p
+	log.Printf("started external strategy %q", s.command)
+	return nil
+}
+
+// read passes the decisions written by the process to decide.
+func (p *strategyProcess) read(stdout io.Reader) {
+	defer close(p.decisions)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var d strategyDecision
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			log.Printf("unable to parse external strategy decision %q: %v", scanner.Text(), err)
+			d = strategyDecision{Action: strategyHold}
+		}
+		select {
+		case p.decisions <- d:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// stop kills the process and waits for it in the background.
+func (p *strategyProcess) stop() {
+	close(p.done)
+	p.cmd.Process.Kill()
+	go p.cmd.Wait()
+}
+
+// decide sends the request to the strategy and returns its decision. If the
+// strategy exits or does not reply within strategy_timeout, it is killed,
+// since its replies could no longer be matched to requests, and it is started
+// again for the next request.
+func (s *externalStrategy) decide(req *strategyRequest) (*strategyDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.proc == nil {
+		if err := s.start(); err != nil {
+			return nil, err
+		}
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal strategy request: %v", err)
+	}
+	if _, err := s.proc.stdin.Write(append(b, '\n')); err != nil {
+		return nil, s.fail("is not running: %v", err)
+	}
+	select {
+	case d, ok := <-s.proc.decisions:
+		if !ok {
+			return nil, s.fail("exited")
+		}
+		switch d.Action {
+		case strategyBuy, strategySell, strategyHold:
+		default:
+			return nil, fmt.Errorf("unknown external strategy action %q", d.Action)
+		}
+		return &d, nil
+	case <-time.After(*strategyTimeout):
+		return nil, s.fail("did not reply within %v", *strategyTimeout)
+	}
+}
+
+// fail stops the failed process, so a new one is started for the next
+// request, and returns why it failed.
+func (s *externalStrategy) fail(format string, args ...interface{}) error {
+	s.proc.stop()
+	s.proc = nil
+	return fmt.Errorf("%w: it %v, restarting it", errStrategyFailed, fmt.Sprintf(format, args...))
+}
+
+// externalDecision asks the external strategy whether to buy at t. Open
+// purchases are sold when it decides to sell.
+func (c *client) externalDecision(t time.Time, bars []alpaca.Bar) bool {
+	req := &strategyRequest{
+		Symbol:   c.stockSymbol,
+		Strategy: c.strategy,
+		Time:     t,
+		Bars:     bars,
+	}
+	for _, p := range c.purchases {
+		if !p.BuyFilled() || p.SellFilled() {
+			continue
+		}
+		req.OpenPurchases = append(req.OpenPurchases, strategyPosition{
+			ID:    p.ID,
+			Qty:   p.BuyOrder.FilledQty.String(),
+			Price: p.BuyOrder.FilledAvgPrice.String(),
+		})
+	}
+	state, _ := c.state.(*externalState)
+	if state != nil {
+		req.State = state.state
+	}
+	d, err := external.decide(req)
+	if errors.Is(err, errStrategyFailed) {
+		go c.alert(fmt.Sprintf("no decision for %v @ %v: %v", c.stockSymbol, t, err))
+		return false
+	}
+	if err != nil {
+		log.Printf("unable to get external strategy decision @ %v: %v", t, err)
+		return false
+	}
+	if state != nil && d.State != nil {
+		state.state = d.State
+	}
+	c.lastExternalReason = d.Reason
+	switch d.Action {
+	case strategyBuy:
+		return true
+	case strategySell:
+		c.sellAllAtMarket(t, "external strategy", d.Reason)
+	}
+	return false
+}
+
+// sellAllAtMarket sells the open purchases at market, unless they are already
+// being sold at market. who is what decided to sell.
+func (c *client) sellAllAtMarket(t time.Time, who, reason string) {
+	var held []*purchase.Purchase
+	for _, p := range c.purchases {
+		if !p.BuyFilled() || p.SellFilled() {
+			continue
+		}
+		if p.SellOrder != nil && p.SellOrder.Type == alpaca.Market {
+			// Already being sold at market.
+			continue
+		}
+		held = append(held, p)
+	}
+	log.Printf("%v decided to sell %v purchases of %v: %v", who, len(held), c.stockSymbol, reason)
+	for _, p := range held {
+		if err := c.forceExit(p, t); err != nil {
+			log.Printf("unable to sell purchase %d for the %v: %v", p.ID, who, err)
+		}
+	}
+}
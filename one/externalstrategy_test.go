@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestStrategy returns an external strategy running the shell script.
+func newTestStrategy(t *testing.T, script string) *externalStrategy {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "strategy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "strategy.sh")
+	if err := ioutil.WriteFile(path, []byte("cd "+dir+"\n"+script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := *strategyTimeout
+	*strategyTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { *strategyTimeout = old })
+	s := &externalStrategy{command: "sh " + path}
+	if err := s.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if s.proc != nil {
+			s.proc.stop()
+		}
+	})
+	return s
+}
+
+func TestExternalStrategyRestartsAfterTimeout(t *testing.T) {
+	// The first process replies too late, the next ones reply at once.
+	s := newTestStrategy(t, `
+while read line; do
+	if [ ! -e started ]; then
+		touch started
+		sleep 1
+	fi
+	echo '{"action": "buy"}'
+done
+`)
+	if _, err := s.decide(&strategyRequest{Symbol: "SPY"}); !errors.Is(err, errStrategyFailed) {
+		t.Fatalf("decide() = %v, want the strategy to fail by not replying", err)
+	}
+	for i := 0; i < 2; i++ {
+		d, err := s.decide(&strategyRequest{Symbol: "SPY"})
+		if err != nil || d.Action != strategyBuy {
+			t.Fatalf("decide() after the restart = %+v, %v, want buy", d, err)
+		}
+	}
+}
+
+func TestExternalStrategyRestartsAfterExit(t *testing.T) {
+	s := newTestStrategy(t, `
+read line
+echo '{"action": "hold"}'
+`)
+	if d, err := s.decide(&strategyRequest{Symbol: "SPY"}); err != nil || d.Action != strategyHold {
+		t.Fatalf("decide() = %+v, %v, want hold", d, err)
+	}
+	if _, err := s.decide(&strategyRequest{Symbol: "SPY"}); !errors.Is(err, errStrategyFailed) {
+		t.Fatalf("decide() after the strategy exited = %v, want it to fail", err)
+	}
+	if d, err := s.decide(&strategyRequest{Symbol: "SPY"}); err != nil || d.Action != strategyHold {
+		t.Fatalf("decide() after the restart = %+v, %v, want hold", d, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	backtestSession  = flag.String("backtest_session", "rth", "The trading session simulated by backtests. One of \"rth\" (regular equity hours), \"extended\" (equity pre and post market hours) or \"crypto\" (24/7).")
+	backtestHolidays = flag.String("backtest_holidays", "", "A comma separated list of dates (format: 2006-01-02) when the market is closed during backtests.")
+)
+
+// session describes when a market is open.
+type session struct {
+	// open and close are the offsets from midnight when trading starts and
+	// ends.
+	open  time.Duration
+	close time.Duration
+
+	// weekdays are the days of the week with trading.
+	weekdays map[time.Weekday]bool
+
+	// location is the timezone of the open and close offsets.
+	location *time.Location
+}
+
+var (
+	mondayToFriday = map[time.Weekday]bool{
+		time.Monday:    true,
+		time.Tuesday:   true,
+		time.Wednesday: true,
+		time.Thursday:  true,
+		time.Friday:    true,
+	}
+
+	everyDay = map[time.Weekday]bool{
+		time.Sunday:    true,
+		time.Monday:    true,
+		time.Tuesday:   true,
+		time.Wednesday: true,
+		time.Thursday:  true,
+		time.Friday:    true,
+		time.Saturday:  true,
+	}
+)
+
+// sessionTemplate returns the session with the given name.
+func sessionTemplate(name string) (*session, error) {
+	switch name {
+	case "rth":
+		return &session{
+			open:     9*time.Hour + 30*time.Minute,
+			close:    16 * time.Hour,
+			weekdays: mondayToFriday,
+			location: EST,
+		}, nil
+	case "extended":
+		return &session{
+			open:     4 * time.Hour,
+			close:    20 * time.Hour,
+			weekdays: mondayToFriday,
+			location: EST,
+		}, nil
+	case "crypto":
+		return &session{
+			open:     0,
+			close:    24 * time.Hour,
+			weekdays: everyDay,
+			location: time.UTC,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown session %q", name)
+}
+
+// fakeClock simulates the market clock for a trading session.
+type fakeClock struct {
+	Now               time.Time
+	TodaysOpenTime    time.Time
+	TodaysCloseTime   time.Time
+	IsOpen            bool
+	TimeBetweenAction time.Duration
+
+	session  *session
+	holidays map[string]bool // Holidays are keyed by date, e.g. 2006-01-02.
+}
+
+// backtestStart returns the time of backtest_starttime.
+func backtestStart() (time.Time, error) {
+	t, err := time.ParseInLocation(referenceTime, *backtestStartTime, EST)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to read in start time %q: %v", *backtestStartTime, err)
+	}
+	return t, nil
+}
+
+// newFakeClockAt returns a clock whose first tick is at t.
+func newFakeClockAt(t time.Time, timeBetweenAction time.Duration) (*fakeClock, error) {
+	s, err := sessionTemplate(*backtestSession)
+	if err != nil {
+		return nil, err
+	}
+	holidays := map[string]bool{}
+	for _, d := range strings.Split(*backtestHolidays, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			return nil, fmt.Errorf("invalid holiday %q: %v", d, err)
+		}
+		holidays[d] = true
+	}
+
+	c := &fakeClock{
+		Now:               t.Add(-1 * timeBetweenAction), // Subtract one iteration to counteract first increase.
+		TimeBetweenAction: timeBetweenAction,
+		session:           s,
+		holidays:          holidays,
+	}
+	c.TodaysOpenTime, c.TodaysCloseTime = c.sessionTimes(t)
+	return c, nil
+}
+
+// isTradingDay returns true if there is a session on the day of t.
+func (c *fakeClock) isTradingDay(t time.Time) bool {
+	t = t.In(c.session.location)
+	return c.session.weekdays[t.Weekday()] && !c.holidays[t.Format("2006-01-02")]
+}
+
+// previousTradingDay returns the midnight in EST of the last trading day
+// before the day of t, or the zero time if there was none in the last year.
+func (c *fakeClock) previousTradingDay(t time.Time) time.Time {
+	t = t.In(EST)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, EST)
+	for i := 0; i < 366; i++ {
+		day = day.AddDate(0, 0, -1)
+		if c.isTradingDay(day.Add(12 * time.Hour)) {
+			return day
+		}
+	}
+	return time.Time{}
+}
+
+// sessionTimes returns the open and close times of the session on the day
+// of t.
+func (c *fakeClock) sessionTimes(t time.Time) (time.Time, time.Time) {
+	t = t.In(c.session.location)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, c.session.location)
+	return midnight.Add(c.session.open), midnight.Add(c.session.close)
+}
+
+// updateFakeClock increments the current time, determines if the market is
+// open, and updates the days open market hours if needed. The open market
+// hours are kept from the previous trading day on days without a session.
+// TODO(ejbrever) Account for days where market closes early.
+func (c *fakeClock) updateFakeClock() {
+	c.Now = c.Now.Add(c.TimeBetweenAction)
+
+	if !c.isTradingDay(c.Now) {
+		c.IsOpen = false
+		return
+	}
+	c.TodaysOpenTime, c.TodaysCloseTime = c.sessionTimes(c.Now)
+	c.IsOpen = !c.Now.Before(c.TodaysOpenTime) && !c.Now.After(c.TodaysCloseTime)
+}
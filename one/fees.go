@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	feeRefreshInterval = flag.Duration("fee_refresh_interval", 15*time.Minute, "How often the fee activities of the account, e.g. SEC and TAF fees, are read and attributed to the purchases so their realized profit/loss includes fees. 0 disables fee attribution.")
+	feeLookback        = flag.Duration("fee_lookback", 72*time.Hour, "How far back fee activities are read on each refresh, since fees are often posted after the day of the trade.")
+)
+
+// feeActivityType is the account activity type of fees and commissions
+// charged in dollars.
+const feeActivityType = "FEE"
+
+// startFeeAttribution attributes the account's fees to purchases every
+// fee_refresh_interval.
+func startFeeAttribution() {
+	if *feeRefreshInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			clients, _ := currentSession.snapshot()
+			if err := attributeFees(clients, time.Now()); err != nil {
+				log.Printf("unable to attribute fees: %v", err)
+			}
+			time.Sleep(*feeRefreshInterval)
+		}
+	}()
+}
+
+// attributeFees reads the fee activities within fee_lookback and attributes
+// each one which is not yet attributed to the purchases it was charged for.
+// The fees are stored in the database and copied to the purchases the
+// clients hold in memory.
+func attributeFees(clients []*client, now time.Time) error {
+	if len(clients) == 0 {
+		return nil
+	}
+	after := now.Add(-*feeLookback)
+	types := []string{feeActivityType}
+	activities, err := clients[0].alpacaClient.GetAccountActivities(nil, &alpaca.AccountActivitiesRequest{
+		ActivityTypes: &types,
+		After:         &after,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get fee activities: %v", err)
+	}
+	if len(activities) == 0 {
+		return nil
+	}
+	db := clients[0].dbClient
+	all, err := db.PurchasesBetween(after.Add(-heldPurchasesLookback), now)
+	if err != nil {
+		return err
+	}
+	var purchases []*purchase.Purchase
+	for _, p := range all {
+		if !p.Shadow {
+			purchases = append(purchases, p)
+		}
+	}
+
+	updated := map[int64]*purchase.Purchase{}
+	for _, a := range activities {
+		if a.ActivityType != feeActivityType || attributed(purchases, a.ID) {
+			continue
+		}
+		shares := feeShares(purchases, a)
+		if len(shares) == 0 {
+			log.Printf("unable to attribute fee %q of $%v on %v, no matching purchases: %v", a.ID, a.NetAmount.Neg(), feeDay(a), a.Description)
+			continue
+		}
+		for p, amount := range shares {
+			p.Fees = append(p.Fees, purchase.Fee{ActivityID: a.ID, Amount: amount, Description: a.Description})
+			updated[p.ID] = p
+		}
+		log.Printf("attributed fee %q of $%v to %v purchases: %v", a.ID, a.NetAmount.Neg(), len(shares), a.Description)
+	}
+
+	for _, p := range updated {
+		if err := db.UpdateFees(p); err != nil {
+			log.Printf("unable to update fees of purchase %d: %v", p.ID, err)
+		}
+	}
+	for _, c := range clients {
+		c.do(func() {
+			for _, p := range c.purchases {
+				if u, ok := updated[p.ID]; ok {
+					p.Fees = u.Fees
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// attributed returns true if the fee of the activity is attributed to any of
+// the purchases.
+func attributed(purchases []*purchase.Purchase, activityID string) bool {
+	for _, p := range purchases {
+		if p.HasFee(activityID) {
+			return true
+		}
+	}
+	return false
+}
+
+// feeDay returns the trading day the fee was charged for.
+func feeDay(a alpaca.AccountActivity) string {
+	if !a.Date.IsZero() {
+		return a.Date.Format("2006-01-02")
+	}
+	return a.TransactionTime.In(EST).Format("2006-01-02")
+}
+
+// feeShares splits the fee of the activity between the purchases of its
+// symbol sold on its day, in proportion to the shares sold, since the SEC and
+// TAF fees are charged on sales. A fee with no sales is split between the
+// purchases bought on the day instead. Fees without a symbol are split between
+// every symbol's purchases.
+func feeShares(purchases []*purchase.Purchase, a alpaca.AccountActivity) map[*purchase.Purchase]decimal.Decimal {
+	day := feeDay(a)
+	match := func(o *alpaca.Order) bool {
+		return o != nil && o.Status == "filled" && o.FilledAt != nil &&
+			o.FilledAt.In(EST).Format("2006-01-02") == day &&
+			(a.Symbol == "" || o.Symbol == a.Symbol)
+	}
+	qty := map[*purchase.Purchase]decimal.Decimal{}
+	for _, p := range purchases {
+		if match(p.SellOrder) {
+			qty[p] = p.SellOrder.FilledQty
+		}
+	}
+	if len(qty) == 0 {
+		for _, p := range purchases {
+			if match(p.BuyOrder) {
+				qty[p] = p.BuyOrder.FilledQty
+			}
+		}
+	}
+	total := decimal.Zero
+	for _, q := range qty {
+		total = total.Add(q)
+	}
+	if !total.IsPositive() {
+		return nil
+	}
+
+	// Fees are negative amounts of cash. The rounding remainder goes to the
+	// last purchase so the shares add up to the fee.
+	fee := a.NetAmount.Neg()
+	shares := map[*purchase.Purchase]decimal.Decimal{}
+	remaining := fee
+	i := 0
+	for p, q := range qty {
+		i++
+		if i == len(qty) {
+			shares[p] = remaining
+			break
+		}
+		share := fee.Mul(q).Div(total).Round(4)
+		shares[p] = share
+		remaining = remaining.Sub(share)
+	}
+	return shares
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestFillMode = flag.String("backtest_fill_mode", fillModePrice, "How backtest orders fill. \"price\" fills market orders immediately, and limit and stop orders only once the bar's high or low, or the quote, crosses their price, so a backtest is reproducible. \"random\" is the legacy mode, which skips 75% of the chances an order has to fill at random.")
+)
+
+// The backtest fill modes.
+const (
+	fillModePrice  = "price"
+	fillModeRandom = "random"
+)
+
+// validateFillMode returns an error if backtest_fill_mode is unknown.
+func validateFillMode() error {
+	switch *backtestFillMode {
+	case fillModePrice, fillModeRandom:
+		return nil
+	}
+	return fmt.Errorf("unknown backtest_fill_mode %q", *backtestFillMode)
+}
+
+// fakeFillChance returns true if an order has a chance to fill now. In the
+// random fill mode, most chances are skipped.
+func (c *client) fakeFillChance() bool {
+	if c.cfg.BacktestFillMode == fillModeRandom {
+		return randomFillOrder()
+	}
+	return true
+}
+
+// fakePriceSellAttempt fills a sell order once the price crosses it. A bar
+// which crosses both the take profit and the stop of an OCO order is taken to
+// hit the stop, since the order of the prices within the bar is unknown.
+func (c *client) fakePriceSellAttempt(o *alpaca.Order) {
+	p := c.fakeCurrentPrice()
+	qty := c.fakeFillableQty(o)
+	if !qty.IsPositive() {
+		return
+	}
+	if o.Legs == nil {
+		switch o.Type {
+		case alpaca.Limit:
+			if price, ok := p.sellLimitFill(*o.LimitPrice); ok {
+				c.fakeFill(o, qty, price)
+			}
+		case alpaca.Stop, alpaca.TrailingStop:
+			if price, ok := p.sellStopFill(*o.StopPrice); ok {
+				c.fakeMarketFill(o, qty, price)
+			}
+		default:
+			c.fakeMarketFill(o, qty, p.marketSellPrice())
+		}
+		return
+	}
+
+	legs := *o.Legs
+	if price, ok := p.sellStopFill(*legs[0].StopPrice); ok {
+		limit := legs[0].LimitPrice
+		switch {
+		case limit == nil:
+			c.fakeMarketFill(o, qty, price)
+		case price.GreaterThanOrEqual(*limit):
+			c.fakeFill(o, qty, price)
+		default:
+			// The price fell through the stop limit, which only fills if the
+			// bar traded back up to it.
+			if price, ok = p.sellLimitFill(*limit); !ok {
+				return
+			}
+			c.fakeFill(o, qty, price)
+		}
+		// Mark the stop leg so the exit is reported as a stop.
+		if o.Status == filled {
+			legs[0].Status = filled
+		}
+		legs[0].FilledQty = legs[0].FilledQty.Add(qty)
+		legs[0].FilledAvgPrice = o.FilledAvgPrice
+		return
+	}
+	if price, ok := p.sellLimitFill(*o.LimitPrice); ok {
+		c.fakeFill(o, qty, price)
+	}
+}
+
+// sellLimitFill returns the price a sell limit fills at, or false if the bid,
+// or the bar high without a quote, did not reach the limit.
+func (h *historicalTickerData) sellLimitFill(limit decimal.Decimal) (decimal.Decimal, bool) {
+	if h.hasQuote() {
+		return h.Bid, h.Bid.GreaterThanOrEqual(limit)
+	}
+	return decimal.Max(limit, h.Low), h.High.GreaterThanOrEqual(limit)
+}
+
+// sellStopFill returns the price a sell stop fills at, or false if the bid,
+// or the bar low without a quote, did not reach the stop. Without a quote, the
+// stop fills at its price, or at the bar high if the whole bar was below it.
+func (h *historicalTickerData) sellStopFill(stop decimal.Decimal) (decimal.Decimal, bool) {
+	if h.hasQuote() {
+		return h.Bid, h.Bid.LessThanOrEqual(stop)
+	}
+	return decimal.Min(stop, h.High), h.Low.LessThanOrEqual(stop)
+}
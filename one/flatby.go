@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	flatBy = flag.String("flat_by", "", "Comma separated close out deadlines which override time_before_market_close_to_sell for a symbol, a strategy or a strategy of a symbol, e.g. \"SPY=30m,IWM=2h,SPY/momentum=45m\". A strategy of a symbol takes precedence over the strategy, which takes precedence over the symbol.")
+)
+
+// flatByDeadlines are the deadlines of flat_by, by symbol, strategy or
+// symbol/strategy. They are set by init.
+var flatByDeadlines map[string]time.Duration
+
+// parseFlatBy parses flat_by.
+func parseFlatBy(s string) (map[string]time.Duration, error) {
+	deadlines := map[string]time.Duration{}
+	if s == "" {
+		return deadlines, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), "=")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not of the form name=duration", entry)
+		}
+		if _, ok := deadlines[parts[0]]; ok {
+			return nil, fmt.Errorf("%q is repeated", parts[0])
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration of %v: %v", parts[0], err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("the duration of %v must be positive", parts[0])
+		}
+		deadlines[parts[0]] = d
+	}
+	return deadlines, nil
+}
+
+// timeBeforeMarketCloseToSell returns how long before the market close the
+// strategy trading the symbol closes out.
+func (cfg ClientConfig) timeBeforeMarketCloseToSell(symbol, strategy string) time.Duration {
+	for _, name := range []string{symbol + "/" + strategy, strategy, symbol} {
+		if d, ok := cfg.FlatBy[name]; ok {
+			return d
+		}
+	}
+	return cfg.TimeBeforeMarketCloseToSell
+}
+
+// closeOutDue returns whether the client must be flat at now, given the next
+// market close.
+func (c *client) closeOutDue(nextClose, now time.Time) bool {
+	return nextClose.Sub(now) < c.cfg.TimeBeforeMarketCloseToSell
+}
+
+// dueForCloseOut splits the clients into those which must be flat at now and
+// those which are still trading.
+func dueForCloseOut(clients []*client, nextClose, now time.Time) (due, open []*client) {
+	for _, c := range clients {
+		if c.closeOutDue(nextClose, now) {
+			due = append(due, c)
+		} else {
+			open = append(open, c)
+		}
+	}
+	return due, open
+}
+
+// nextCloseOut returns the earliest close out after now, or zero if every
+// client is due.
+func nextCloseOut(clients []*client, nextClose, now time.Time) time.Time {
+	var next time.Time
+	for _, c := range clients {
+		closeOut := nextClose.Add(-c.cfg.TimeBeforeMarketCloseToSell)
+		if closeOut.After(now) && (next.IsZero() || closeOut.Before(next)) {
+			next = closeOut
+		}
+	}
+	return next
+}
+
+// finalCloseOut returns when the last of the clients closes out.
+func finalCloseOut(clients []*client, nextClose time.Time) time.Time {
+	var last time.Time
+	for _, c := range clients {
+		if closeOut := nextClose.Add(-c.cfg.TimeBeforeMarketCloseToSell); closeOut.After(last) {
+			last = closeOut
+		}
+	}
+	return last
+}
+
+// closeOutEarly flattens the client once its close out is due while other
+// clients are still trading. The account is closed out as a whole once every
+// client is due, so only the client's own purchases are sold here.
+func (c *client) closeOutEarly(nextClose, now time.Time) {
+	if c.closedOutFor.Equal(nextClose) {
+		return
+	}
+	c.closedOutFor = nextClose
+	log.Printf("%v of %v is flat by %v before the close", c.strategy, c.stockSymbol, c.cfg.TimeBeforeMarketCloseToSell)
+	if c.cfg.HoldOvernight {
+		c.closeOutOvernight(now)
+		return
+	}
+	c.flatten(now, "at its close out")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestEvaluationInterval = flag.Duration("backtest_evaluation_interval", 0, "The simulated time between evaluations of the strategy in backtests, e.g. 15s. Defaults to duration_between_action.")
+	backtestFormingBars        = flag.Bool("backtest_forming_bars", false, "If true, backtests evaluated more often than the bar timeframe see the bar which is still forming, with its running high, low and close, as the live trader does. The prices orders fill at are also those seen so far. Within a minute of the history, the price is assumed to move from the previous close to the low, the high and the close for a rising minute, and to the high, the low and the close for a falling one.")
+)
+
+// runningMinute returns the minute of the history containing t as it was
+// known at t, with the high, low, close and volume seen so far. At the start of
+// a minute the previous minute is complete and is returned. It returns false
+// if the minute is not in the history.
+func (h *history) runningMinute(t time.Time) (*historicalTickerData, bool) {
+	start := timeToMinuteStart(t)
+	prev, hasPrev := h.epochToTickerData[start.Add(-time.Minute).Unix()]
+	if start.Equal(t) {
+		return prev, hasPrev
+	}
+	m, ok := h.epochToTickerData[start.Unix()]
+	if !ok {
+		return nil, false
+	}
+
+	open := m.Close
+	if hasPrev {
+		open = prev.Close
+	}
+	path := []decimal.Decimal{open, m.Low, m.High, m.Close}
+	if m.Close.LessThan(open) {
+		path = []decimal.Decimal{open, m.High, m.Low, m.Close}
+	}
+	// The path has three legs of equal duration.
+	elapsed := decimal.NewFromInt(int64(t.Sub(start))).Div(decimal.NewFromInt(int64(time.Minute)))
+	pos := elapsed.Mul(decimal.NewFromInt(int64(len(path) - 1)))
+	leg := int(pos.IntPart())
+	price := path[leg].Add(path[leg+1].Sub(path[leg]).Mul(pos.Sub(decimal.NewFromInt(int64(leg)))))
+
+	running := *m
+	running.High, running.Low, running.Close = price, price, price
+	for _, p := range path[:leg+1] {
+		running.High = decimal.Max(running.High, p)
+		running.Low = decimal.Min(running.Low, p)
+	}
+	running.Volume = m.Volume.Mul(elapsed).Floor()
+	return &running, true
+}
+
+// formingBar returns the bar starting at start as it was known at now, from
+// the complete minutes before now and the running minute. It returns false if
+// none of the minutes are in the history.
+func (h *history) formingBar(start, now time.Time) (alpaca.Bar, bool) {
+	var minutes []*historicalTickerData
+	current := timeToMinuteStart(now)
+	for t := start; t.Before(current); t = t.Add(time.Minute) {
+		if m, ok := h.epochToTickerData[t.Unix()]; ok {
+			minutes = append(minutes, m)
+		}
+	}
+	if current.Before(now) {
+		if m, ok := h.runningMinute(now); ok {
+			minutes = append(minutes, m)
+		}
+	}
+	return aggregateBar(start, minutes)
+}
@@ -4,10 +4,19 @@ go 1.15
 
 replace github.com/alpacahq/alpaca-trade-api-go => /Users/ejbrever/go/src/github.com/alpacahq/alpaca-trade-api-go
 
+// The trader is built against the database and purchase packages in this tree,
+// which change together with it.
+replace github.com/ejbrever/trader/one/database => ./database
+
+replace github.com/ejbrever/trader/one/purchase => ./purchase
+
 require (
 	github.com/alpacahq/alpaca-trade-api-go v1.7.0
 	github.com/ejbrever/trader/one/database v0.0.0-20201227054747-65bc78f24917
 	github.com/ejbrever/trader/one/purchase v0.0.0-20201226023622-b703b0666599
 	github.com/go-sql-driver/mysql v1.5.0
+	github.com/gorilla/websocket v1.4.0
 	github.com/shopspring/decimal v1.2.0
+	github.com/xitongsys/parquet-go v1.5.5-0.20201110004701-b09c49d6d457
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 )
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestDetectHalts     = flag.Bool("backtest_detect_halts", false, "If true, gaps of missing bars in the backtest file after which the price moved beyond the limit up/limit down band are simulated as trading halts, in addition to rows marked in a halted column.")
+	backtestHaltMinMinutes  = flag.Int("backtest_halt_min_minutes", 5, "The number of consecutive missing bars detected as a halt. A limit up/limit down pause lasts at least 5 minutes.")
+	backtestLULDBandPercent = flag.Float64("backtest_luld_band_percent", 5, "The percentage price move across a gap of missing bars for it to be detected as a halt.")
+)
+
+// haltDetector finds halts from gaps of missing bars while the backtest file
+// is read.
+type haltDetector struct {
+	// missing are the epoch timestamps of the bars missing since the last
+	// bar. They are filled with the last bar.
+	missing []int64
+}
+
+// bar records that a bar was read. If it follows a gap of missing bars on the
+// same day with a price move beyond the band, the missing bars are marked as
+// halted.
+func (d *haltDetector) bar(h *history, last time.Time, t time.Time, data *historicalTickerData) {
+	missing := d.missing
+	d.missing = nil
+	if !*backtestDetectHalts || len(missing) < *backtestHaltMinMinutes || last.IsZero() {
+		return
+	}
+	if last.In(EST).YearDay() != t.In(EST).YearDay() {
+		// Missing bars at the open are not a halt.
+		return
+	}
+	before := h.epochToTickerData[last.Unix()]
+	if before.Close.IsZero() {
+		return
+	}
+	move := data.Close.Sub(before.Close).Div(before.Close).Abs().Mul(decimal.NewFromInt(100))
+	if move.LessThan(decimal.NewFromFloat(*backtestLULDBandPercent)) {
+		return
+	}
+	for _, ts := range missing {
+		halted := *before
+		halted.Halted = true
+		h.epochToTickerData[ts] = &halted
+	}
+	log.Printf("detected a halt from %v to %v, the price moved %v%% across %v missing bars", time.Unix(missing[0], 0).In(EST), t, move.StringFixed(2), len(missing))
+}
+
+// fakeHalted returns true if trading is halted at the current fake time.
+func (c *client) fakeHalted() bool {
+	return c.fakeCurrentPrice().Halted
+}
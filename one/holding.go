@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+var (
+	holdOvernight      = flag.Bool("hold_overnight", false, "If true, filled purchases are held overnight with their sell orders instead of being closed out before market close. Unfilled buy orders are still cancelled.")
+	maxPositionAgeDays = flag.Int("max_position_age_days", 0, "When positive and hold_overnight is set, purchases held over more than this many market closes are sold at the close out regardless of P/L.")
+)
+
+const (
+	// heldPurchasesLookback is how far back purchases still held overnight are
+	// loaded from at startup.
+	heldPurchasesLookback = 30 * 24 * time.Hour
+
+	// cancelWaitTimeout is how long to wait for an order to be cancelled before
+	// selling the shares it held.
+	cancelWaitTimeout = 10 * time.Second
+)
+
+// purchasesHeldOvernight returns the strategy's purchases of the symbol from
+// previous days which were bought and were not sold before today. Those sold
+// today are kept, like the purchases made today, until the close.
+func purchasesHeldOvernight(db database.Client, strategy, symbol string, now time.Time) ([]*purchase.Purchase, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, BookkeepingTZ)
+	all, err := db.PurchasesBetween(today.Add(-heldPurchasesLookback), today)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get purchases held overnight: %v", err)
+	}
+	var held []*purchase.Purchase
+	for _, p := range all {
+		if p.Strategy != strategy || p.BuyOrder.Symbol != symbol || !p.BuyFilled() {
+			continue
+		}
+		if p.SellFilled() && (p.SellOrder.FilledAt == nil || p.SellOrder.FilledAt.Before(today)) {
+			continue
+		}
+		if p.BuyOrder.FilledAt != nil {
+			p.TradingDaysHeld = tradingDaysBetween(*p.BuyOrder.FilledAt, now)
+		}
+		held = append(held, p)
+	}
+	return held, nil
+}
+
+// tradingDaysBetween returns the number of weekdays from the day of start up
+// to, but not including, the day of end. Market holidays are not excluded.
+func tradingDaysBetween(start, end time.Time) int {
+	start, end = start.In(EST), end.In(EST)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, EST)
+	last := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, EST)
+	var days int
+	for ; day.Before(last); day = day.AddDate(0, 0, 1) {
+		if day.Weekday() != time.Saturday && day.Weekday() != time.Sunday {
+			days++
+		}
+	}
+	return days
+}
+
+// closeOutOvernight ends the trading day while holding purchases overnight.
+// Unfilled buy orders are cancelled, and the shares of those partially filled
+// get a sell order to hold them with. Purchases which have been held over more
+// than max_position_age_days market closes are sold.
+func (c *client) closeOutOvernight(now time.Time) {
+	for _, p := range c.inProgressBuyOrders() {
+		if !p.BuyOrder.FilledQty.IsPositive() || c.cfg.Backtest || c.shadow || isTWAP(p.BuyOrder) {
+			c.cancelEntry(p, now)
+		} else if err := c.cancelEntryAndWait(p); err != nil {
+			log.Printf("unable to cancel partially filled buy order %q, its %v shares are not protected: %v", p.BuyOrder.ID, p.BuyOrder.FilledQty, err)
+			continue
+		}
+		if !p.BuyFilled() || !p.NotSelling() {
+			continue
+		}
+		log.Printf("holding the %v shares of partially filled buy order %q overnight", p.BuyOrder.FilledQty, p.BuyOrder.ID)
+		if !c.placeSellOrder(p) {
+			log.Printf("unable to place the sell order of purchase %d, its %v shares are not protected", p.ID, p.BuyOrder.FilledQty)
+		}
+	}
+	for _, p := range c.purchases {
+		if !p.BuyFilled() || p.SellFilled() {
+			continue
+		}
+		p.TradingDaysHeld++
+		if c.cfg.MaxPositionAgeDays <= 0 || p.TradingDaysHeld <= c.cfg.MaxPositionAgeDays {
+			continue
+		}
+		log.Printf("purchase %d has been held over %v market closes, selling it", p.ID, p.TradingDaysHeld)
+		if err := c.forceExit(p, now); err != nil {
+			log.Printf("unable to sell purchase %d which is past max_position_age_days: %v", p.ID, err)
+		}
+	}
+}
+
+// forceExit replaces the purchase's sell order with a market sell order.
+func (c *client) forceExit(p *purchase.Purchase, now time.Time) error {
+	req := &alpaca.PlaceOrderRequest{
+		AssetKey:      &c.stockSymbol,
+		Qty:           p.BuyOrder.FilledQty,
+		Side:          alpaca.Sell,
+		Type:          alpaca.Market,
+		TimeInForce:   alpaca.Day,
+		ClientOrderID: c.sellClientOrderID(p),
+	}
+	var o *alpaca.Order
+	var err error
+	switch {
+	case c.cfg.Backtest:
+		o, err = c.fakeMarketSell(req)
+	case c.shadow:
+		o, err = c.shadowPlaceOrder(req)
+	default:
+		if isSyntheticOCO(p.SellOrder) && p.InProgressSellOrder() {
+			if err := c.cancelSyntheticOCOAndWait(p.SellOrder); err != nil {
+				return err
+			}
+		} else if p.SellOrder != nil && p.InProgressSellOrder() {
+			if err := c.cancelAndWait(p.SellOrder.ID); err != nil {
+				return err
+			}
+		}
+		o, err = c.placeOrder(req)
+	}
+	if err != nil {
+		return err
+	}
+	p.SellOrder = o
+	if err := c.dbClient.Update(p); err != nil {
+		log.Printf("unable to update for forced sell order:%v\n%+v", err, p)
+	}
+	c.narrate(now, "selling %v %v at market", req.Qty, c.stockSymbol)
+	return nil
+}
+
+// cancelEntryAndWait cancels the purchase's buy order and waits until the
+// cancel is done, so the final filled quantity is known.
+func (c *client) cancelEntryAndWait(p *purchase.Purchase) error {
+	p.CanceledByTrader = true
+	cancelErr := c.cancelAndWait(p.BuyOrder.ID)
+	o, err := c.alpacaClient.GetOrder(p.BuyOrder.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get order %q: %v", p.BuyOrder.ID, err)
+	}
+	p.BuyOrder = o
+	if err := c.dbClient.Update(p); err != nil {
+		log.Printf("unable to update buy order:%v\n%+v", err, p)
+	}
+	// An order which filled before it was cancelled is sold like any other.
+	if cancelErr != nil && !p.BuyFilled() {
+		return cancelErr
+	}
+	return nil
+}
+
+// cancelAndWait cancels the order and waits until the cancel is done, so the
+// shares it held can be sold.
+func (c *client) cancelAndWait(id string) error {
+	if err := c.alpacaClient.CancelOrder(id); err != nil {
+		return fmt.Errorf("unable to cancel %q: %v", id, err)
+	}
+	deadline := time.Now().Add(cancelWaitTimeout)
+	for time.Now().Before(deadline) {
+		o, err := c.alpacaClient.GetOrder(id)
+		switch {
+		case err != nil || o == nil:
+		case o.Status == filled:
+			return fmt.Errorf("order %q was filled before it was cancelled", id)
+		case o.Status == "canceled" || o.Status == "cancelled" || o.Status == "expired":
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("order %q was not cancelled within %v", id, cancelWaitTimeout)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+func TestCloseOutOvernightProtectsPartialBuy(t *testing.T) {
+	c := newBacktestTestClient(t, ClientConfig{HoldOvernight: true, BacktestParticipationRate: 0.1}, 1, "100", "50")
+	p := c.fakePlaceBuyOrder(&alpaca.PlaceOrderRequest{Qty: decimal.NewFromInt(10), Type: alpaca.Market}, nil)
+	c.fakeOrder(p.BuyOrder.ID)
+	if !p.BuyOrder.FilledQty.Equal(decimal.NewFromInt(5)) {
+		t.Fatalf("buy order filled %v, want 5", p.BuyOrder.FilledQty)
+	}
+
+	c.closeOutOvernight(c.backtestClock.Now)
+	if p.BuyOrder.Status != "canceled" {
+		t.Errorf("buy order is %v after the close out, want canceled", p.BuyOrder.Status)
+	}
+	if p.SellOrder == nil {
+		t.Fatalf("no sell order holds the %v shares of the partial buy overnight", p.BuyOrder.FilledQty)
+	}
+	if !p.SellOrder.Qty.Equal(p.BuyOrder.FilledQty) {
+		t.Errorf("sell order quantity = %v, want the %v filled shares", p.SellOrder.Qty, p.BuyOrder.FilledQty)
+	}
+}
+
+func TestOvernightFeesAreAttributedToHeldPurchases(t *testing.T) {
+	c := newBacktestTestClient(t, ClientConfig{HoldOvernight: true, BacktestMarginInterestRate: 3.6}, 1, "100", "50")
+	var held []*purchase.Purchase
+	for _, qty := range []int64{10, 30} {
+		p := c.fakePlaceBuyOrder(&alpaca.PlaceOrderRequest{Qty: decimal.NewFromInt(qty), Type: alpaca.Market}, nil)
+		c.fakeOrder(p.BuyOrder.ID)
+		held = append(held, p)
+	}
+	c.backtestCash = decimal.NewFromInt(-10000)
+	c.backtestLastClose = backtestTestStart.AddDate(0, 0, -1)
+	c.chargeOvernightFees()
+
+	// A night of 3.6% on $10,000 is $1 at 360 days a year.
+	if !c.backtestMarginInterest.Equal(decimal.NewFromInt(1)) {
+		t.Fatalf("margin interest = %v, want 1", c.backtestMarginInterest)
+	}
+	for i, want := range []string{"0.25", "0.75"} {
+		if got := held[i].TotalFees(); !got.Equal(decimal.RequireFromString(want)) {
+			t.Errorf("fees of the purchase of %v shares = %v, want %v", held[i].BuyOrder.FilledQty, got, want)
+		}
+	}
+}
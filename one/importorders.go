@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// importOrdersCommand is the command which backfills purchases from the
+	// order history, e.g. "one import-orders -from 2020-12-01 -to 2020-12-31".
+	importOrdersCommand = "import-orders"
+
+	// listOrdersLimit is the most orders returned by a single request.
+	listOrdersLimit = 500
+)
+
+// importOrders backfills the purchases in the database from the closed
+// orders in Alpaca. Buys are paired with the sells which followed them.
+// Purchases whose buy order is already in the database are skipped.
+func importOrders(args []string) error {
+	fs := flag.NewFlagSet(importOrdersCommand, flag.ContinueOnError)
+	from := fs.String("from", "", "The first day to import orders from (format: 2006-01-02).")
+	to := fs.String("to", "", "The last day to import orders from (format: 2006-01-02). Defaults to today.")
+	symbol := fs.String("symbol", "", "When set, only orders of this symbol are imported.")
+	strategy := fs.String("strategy", *strategyName, "The strategy recorded on the imported purchases.")
+	dryRun := fs.Bool("dry_run", false, "If true, the purchases are logged instead of stored.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("-from is required")
+	}
+	start, err := time.ParseInLocation("2006-01-02", *from, BookkeepingTZ)
+	if err != nil {
+		return fmt.Errorf("unable to parse -from: %v", err)
+	}
+	end := time.Now().In(BookkeepingTZ)
+	if *to != "" {
+		if end, err = time.ParseInLocation("2006-01-02", *to, BookkeepingTZ); err != nil {
+			return fmt.Errorf("unable to parse -to: %v", err)
+		}
+	}
+	end = time.Date(end.Year(), end.Month(), end.Day()+1, 0, 0, 0, 0, BookkeepingTZ)
+
+	alpacaClient := alpaca.NewClient(common.Credentials())
+	orders, err := closedOrders(alpacaClient, start, end)
+	if err != nil {
+		return err
+	}
+	if *symbol != "" {
+		var kept []alpaca.Order
+		for _, o := range orders {
+			if o.Symbol == *symbol {
+				kept = append(kept, o)
+			}
+		}
+		orders = kept
+	}
+	purchases := pairOrders(orders, *strategy)
+
+	db, err := database.NewInstance(*databaseName, *instanceName)
+	if err != nil {
+		return fmt.Errorf("unable to open db: %v", err)
+	}
+	// Purchases may be stored until their sell fills, which can be later than
+	// the end of the range when holding overnight.
+	existing, err := db.PurchasesBetween(start.Add(-heldPurchasesLookback), end.Add(heldPurchasesLookback))
+	if err != nil {
+		return err
+	}
+	stored := map[string]bool{}
+	for _, p := range existing {
+		if p.BuyOrder != nil {
+			stored[p.BuyOrder.ID] = true
+		}
+	}
+
+	var imported, skipped int
+	for _, p := range purchases {
+		if stored[p.BuyOrder.ID] {
+			skipped++
+			continue
+		}
+		sold := "not sold"
+		if p.SellOrder != nil {
+			sold = fmt.Sprintf("sold @ $%v", p.SellOrder.FilledAvgPrice)
+		}
+		log.Printf("importing %v %v bought @ $%v on %v, %v", p.BuyOrder.FilledQty, p.BuyOrder.Symbol, p.BuyOrder.FilledAvgPrice, p.BuyOrder.FilledAt.In(BookkeepingTZ), sold)
+		if *dryRun {
+			continue
+		}
+		if err := db.Import(p, *p.BuyOrder.FilledAt); err != nil {
+			return fmt.Errorf("unable to import buy order %q: %v", p.BuyOrder.ID, err)
+		}
+		imported++
+	}
+	log.Printf("imported %v purchases from %v orders, skipped %v already in the database", imported, len(orders), skipped)
+	return nil
+}
+
+// closedOrders returns the closed orders submitted in [start, end), oldest
+// first. Orders are listed newest first, so pages are requested back from the
+// end until the start is reached.
+func closedOrders(alpacaClient *alpaca.Client, start, end time.Time) ([]alpaca.Order, error) {
+	status := "closed"
+	limit := listOrdersLimit
+	nested := true
+	until := end
+	seen := map[string]bool{}
+	var orders []alpaca.Order
+	for {
+		page, err := alpacaClient.ListOrders(&status, &until, &limit, &nested)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list closed orders: %v", err)
+		}
+		oldest := until
+		for _, o := range page {
+			if seen[o.ID] {
+				continue
+			}
+			seen[o.ID] = true
+			if o.SubmittedAt.Before(oldest) {
+				oldest = o.SubmittedAt
+			}
+			if !o.SubmittedAt.Before(start) && o.SubmittedAt.Before(end) {
+				orders = append(orders, o)
+			}
+		}
+		if len(page) < limit || !oldest.After(start) || !oldest.Before(until) {
+			break
+		}
+		until = oldest
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].SubmittedAt.Before(orders[j].SubmittedAt)
+	})
+	return orders, nil
+}
+
+// pairOrders pairs each filled buy with the first filled sell of the same
+// symbol which followed it. A bracket buy is sold by its leg which filled, as
+// the trader stores it. A bracket sell ends the earliest open purchase of the
+// same quantity. Any other sell, e.g. the market sell when closing out, ends
+// the earliest open purchases up to its quantity.
+func pairOrders(orders []alpaca.Order, strategy string) []*purchase.Purchase {
+	var purchases []*purchase.Purchase
+	open := map[string][]*purchase.Purchase{}
+	for i := range orders {
+		o := &orders[i]
+		if o.Side == alpaca.Buy {
+			if o.Status != filled || o.FilledAt == nil {
+				continue
+			}
+			p := &purchase.Purchase{BuyOrder: o, Strategy: strategy}
+			purchases = append(purchases, p)
+			if sell := p.BracketSellOrder(); sell != nil && sell.Status == filled {
+				p.SellOrder = sell
+				continue
+			}
+			open[o.Symbol] = append(open[o.Symbol], p)
+			continue
+		}
+		sell, ok := filledSell(o)
+		if !ok {
+			continue
+		}
+		var remaining []*purchase.Purchase
+		qty := sell.FilledQty
+		for _, p := range open[o.Symbol] {
+			switch {
+			case p.BuyOrder.FilledAt.After(*sell.FilledAt) || !qty.IsPositive():
+				remaining = append(remaining, p)
+			case sell.Legs != nil:
+				if !p.BuyOrder.FilledQty.Equal(qty) {
+					remaining = append(remaining, p)
+					continue
+				}
+				p.SellOrder = sell
+				qty = decimal.Zero
+			case p.BuyOrder.FilledQty.GreaterThan(qty):
+				remaining = append(remaining, p)
+			default:
+				s := *sell
+				s.Qty = p.BuyOrder.FilledQty
+				s.FilledQty = p.BuyOrder.FilledQty
+				p.SellOrder = &s
+				qty = qty.Sub(p.BuyOrder.FilledQty)
+			}
+		}
+		open[o.Symbol] = remaining
+	}
+	return purchases
+}
+
+// filledSell returns the sell order if it or one of its legs filled. When a
+// leg filled, its fill is copied to the order, which is how the trader stores
+// a bracket sell ended by its stop.
+func filledSell(o *alpaca.Order) (*alpaca.Order, bool) {
+	if o.Status == filled && o.FilledAt != nil {
+		return o, true
+	}
+	if o.Legs == nil {
+		return nil, false
+	}
+	for _, leg := range *o.Legs {
+		if leg.Status == filled && leg.FilledAt != nil {
+			s := *o
+			s.Status = filled
+			s.FilledQty = leg.FilledQty
+			s.FilledAvgPrice = leg.FilledAvgPrice
+			s.FilledAt = leg.FilledAt
+			return &s, true
+		}
+	}
+	return nil, false
+}
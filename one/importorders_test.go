@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+func TestPairOrdersBracketEntry(t *testing.T) {
+	at := func(minute int) *time.Time {
+		t := backtestTestStart.Add(time.Duration(minute) * time.Minute)
+		return &t
+	}
+	price := func(p string) *decimal.Decimal {
+		d := decimal.RequireFromString(p)
+		return &d
+	}
+	ten := decimal.NewFromInt(10)
+	orders := []alpaca.Order{
+		{
+			// A bracket buy sold by its stop loss leg.
+			ID: "bracket", Symbol: "SPY", Side: alpaca.Buy, Status: filled, Qty: ten, FilledQty: ten, FilledAvgPrice: price("100"), FilledAt: at(0),
+			Legs: &[]alpaca.Order{
+				{ID: "tp", Symbol: "SPY", Side: alpaca.Sell, Type: alpaca.Limit, Status: "canceled", Qty: ten, LimitPrice: price("101")},
+				{ID: "sl", Symbol: "SPY", Side: alpaca.Sell, Type: alpaca.Stop, Status: filled, Qty: ten, FilledQty: ten, FilledAvgPrice: price("99"), FilledAt: at(5), StopPrice: price("99")},
+			},
+		},
+		{
+			// A bracket buy whose legs were cancelled before the close out.
+			ID: "closed-out", Symbol: "SPY", Side: alpaca.Buy, Status: filled, Qty: ten, FilledQty: ten, FilledAvgPrice: price("100"), FilledAt: at(1),
+			Legs: &[]alpaca.Order{
+				{ID: "tp2", Symbol: "SPY", Side: alpaca.Sell, Type: alpaca.Limit, Status: "canceled", Qty: ten, LimitPrice: price("101")},
+				{ID: "sl2", Symbol: "SPY", Side: alpaca.Sell, Type: alpaca.Stop, Status: "canceled", Qty: ten, StopPrice: price("99")},
+			},
+		},
+		{ID: "market", Symbol: "SPY", Side: alpaca.Sell, Type: alpaca.Market, Status: filled, Qty: ten, FilledQty: ten, FilledAvgPrice: price("100.5"), FilledAt: at(10)},
+	}
+
+	purchases := pairOrders(orders, "slope")
+	if len(purchases) != 2 {
+		t.Fatalf("pairOrders() = %v purchases, want 2", len(purchases))
+	}
+	if p := purchases[0]; p.SellOrder == nil || !p.SellFilled() || !p.SellOrder.FilledAvgPrice.Equal(decimal.RequireFromString("99")) {
+		t.Errorf("bracket buy is sold by %+v, want its stop loss leg filled @ $99", p.SellOrder)
+	}
+	if p := purchases[1]; p.SellOrder == nil || p.SellOrder.ID != "market" {
+		t.Errorf("bracket buy whose legs were cancelled is sold by %+v, want the market sell", p.SellOrder)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/trader/indicators"
+)
+
+var (
+	minRSI     = flag.Float64("min_rsi", 0, "When positive, buy signals are skipped while the RSI of the closes is below this value, from 0 to 100.")
+	maxRSI     = flag.Float64("max_rsi", 0, "When positive, buy signals are skipped while the RSI of the closes is above this value, from 0 to 100, e.g. 70 to not buy overbought symbols.")
+	rsiPeriod  = flag.Int("rsi_period", 14, "The number of bar changes the RSI is measured over.")
+	macdFilter = flag.Bool("macd_filter", false, "If true, buy signals are skipped unless the MACD of the closes is above its signal line.")
+	macdFast   = flag.Int("macd_fast", 12, "The number of bars of the fast EMA of the MACD.")
+	macdSlow   = flag.Int("macd_slow", 26, "The number of bars of the slow EMA of the MACD.")
+	macdSignal = flag.Int("macd_signal", 9, "The number of bars of the EMA of the MACD signal line.")
+	vwapFilter = flag.Bool("vwap_filter", false, "If true, buy signals are skipped unless the latest close is above the VWAP of the last vwap_bars bars.")
+	vwapBars   = flag.Int("vwap_bars", 30, "The number of bars the VWAP of vwap_filter is measured over.")
+)
+
+// ruleIndicators blocks buys which the indicator filters do not allow.
+const ruleIndicators = "indicator_filter"
+
+// validateIndicatorFilter returns an error if the indicator filter flags are
+// invalid.
+func validateIndicatorFilter() error {
+	if *minRSI < 0 || *maxRSI > 100 || (*maxRSI > 0 && *minRSI > *maxRSI) {
+		return fmt.Errorf("min_rsi and max_rsi must be from 0 to 100, and min_rsi cannot be above max_rsi")
+	}
+	if *rsiPeriod < 1 || *vwapBars < 1 {
+		return fmt.Errorf("rsi_period and vwap_bars must be at least 1")
+	}
+	if *macdFast < 1 || *macdSignal < 1 || *macdFast >= *macdSlow {
+		return fmt.Errorf("macd_fast and macd_signal must be at least 1, and macd_fast must be less than macd_slow")
+	}
+	return nil
+}
+
+// indicatorFilterBars returns the number of bars the indicator filters
+// measure, or 0 if none are enabled.
+func (cfg ClientConfig) indicatorFilterBars() int {
+	n := 0
+	if cfg.MinRSI > 0 || cfg.MaxRSI > 0 {
+		n = cfg.RSIPeriod + 1
+	}
+	if cfg.MACDFilter && cfg.MACDSlow+cfg.MACDSignal-1 > n {
+		n = cfg.MACDSlow + cfg.MACDSignal - 1
+	}
+	if cfg.VWAPFilter && cfg.VWAPBars > n {
+		n = cfg.VWAPBars
+	}
+	return n
+}
+
+// indicatorBlock returns the indicator_filter rule if an indicator of the
+// recent bars does not allow buying, or nil if buying is allowed. An
+// indicator which cannot be measured does not filter the buy.
+func (c *client) indicatorBlock(bars []alpaca.Bar) *entryBlock {
+	n := c.cfg.indicatorFilterBars()
+	if n == 0 {
+		return nil
+	}
+	recent := c.volatilityBars(bars, n)
+	for _, f := range c.indicatorFilters(recent) {
+		if !f.measured {
+			log.Printf("unable to measure the %v of %v, not filtering the buy signal", f.name, c.stockSymbol)
+			continue
+		}
+		if !f.pass {
+			return &entryBlock{ruleIndicators, f.detail}
+		}
+	}
+	return nil
+}
+
+// indicatorFilter is the result of an indicator filter.
+type indicatorFilter struct {
+	name     string
+	measured bool
+	pass     bool
+	detail   string
+}
+
+// indicatorFilters evaluates each enabled indicator filter on the bars.
+func (c *client) indicatorFilters(bars []alpaca.Bar) []indicatorFilter {
+	var filters []indicatorFilter
+	if c.cfg.MinRSI > 0 || c.cfg.MaxRSI > 0 {
+		rsi, ok := indicators.RSI(bars, c.cfg.RSIPeriod)
+		f := indicatorFilter{name: "RSI", measured: ok, pass: true, detail: fmt.Sprintf("RSI of %.2f", rsi)}
+		switch {
+		case c.cfg.MinRSI > 0 && rsi < c.cfg.MinRSI:
+			f.pass, f.detail = false, fmt.Sprintf("RSI of %.2f is below %v", rsi, c.cfg.MinRSI)
+		case c.cfg.MaxRSI > 0 && rsi > c.cfg.MaxRSI:
+			f.pass, f.detail = false, fmt.Sprintf("RSI of %.2f is above %v", rsi, c.cfg.MaxRSI)
+		}
+		filters = append(filters, f)
+	}
+	if c.cfg.MACDFilter {
+		m, ok := indicators.MACD(bars, c.cfg.MACDFast, c.cfg.MACDSlow, c.cfg.MACDSignal)
+		f := indicatorFilter{name: "MACD", measured: ok, pass: m.MACD > m.Signal}
+		f.detail = fmt.Sprintf("MACD of %.4f is above its signal of %.4f", m.MACD, m.Signal)
+		if !f.pass {
+			f.detail = fmt.Sprintf("MACD of %.4f is not above its signal of %.4f", m.MACD, m.Signal)
+		}
+		filters = append(filters, f)
+	}
+	if c.cfg.VWAPFilter {
+		recent := lastBars(bars, c.cfg.VWAPBars)
+		vwap, ok := indicators.VWAP(recent)
+		var close float64
+		if len(recent) > 0 {
+			close = float64(recent[len(recent)-1].Close)
+		}
+		f := indicatorFilter{name: "VWAP", measured: ok && len(recent) == c.cfg.VWAPBars, pass: close > vwap}
+		f.detail = fmt.Sprintf("close of %.2f is above the VWAP of %.2f", close, vwap)
+		if !f.pass {
+			f.detail = fmt.Sprintf("close of %.2f is not above the VWAP of %.2f", close, vwap)
+		}
+		filters = append(filters, f)
+	}
+	return filters
+}
@@ -0,0 +1,75 @@
+package indicators
+
+import "github.com/alpacahq/alpaca-trade-api-go/alpaca"
+
+// RSI returns the relative strength index of the closes of the bars, from 0
+// to 100, over period changes. The average gains and losses are smoothed as
+// Wilder did, so all of the bars count. It returns false if there are fewer
+// than period+1 bars.
+func RSI(bars []alpaca.Bar, period int) (float64, bool) {
+	closes := Closes(bars)
+	if period < 1 || len(closes) < period+1 {
+		return 0, false
+	}
+	var gain, loss float64
+	for i := 1; i < len(closes); i++ {
+		change := closes[i] - closes[i-1]
+		var up, down float64
+		if change > 0 {
+			up = change
+		} else {
+			down = -change
+		}
+		if i <= period {
+			gain += up / float64(period)
+			loss += down / float64(period)
+			continue
+		}
+		gain = (gain*float64(period-1) + up) / float64(period)
+		loss = (loss*float64(period-1) + down) / float64(period)
+	}
+	if loss == 0 {
+		if gain == 0 {
+			return 50, true
+		}
+		return 100, true
+	}
+	return 100 - 100/(1+gain/loss), true
+}
+
+// MACDValue is the moving average convergence divergence of the latest bar.
+type MACDValue struct {
+	// MACD is the fast EMA of the closes less the slow EMA.
+	MACD float64
+	// Signal is the EMA of the MACD.
+	Signal float64
+	// Histogram is the MACD less the signal.
+	Histogram float64
+}
+
+// MACD returns the moving average convergence divergence of the closes of the
+// bars, e.g. with the usual periods of 12, 26 and 9 bars. It returns false if
+// there are fewer than slow+signal-1 bars.
+func MACD(bars []alpaca.Bar, fast, slow, signal int) (MACDValue, bool) {
+	if fast < 1 || fast >= slow || signal < 1 {
+		return MACDValue{}, false
+	}
+	closes := Closes(bars)
+	fastEMA, slowEMA := EMA(closes, fast), EMA(closes, slow)
+	if slowEMA == nil {
+		return MACDValue{}, false
+	}
+	// The fast EMA starts slow-fast bars before the slow one.
+	fastEMA = fastEMA[slow-fast:]
+	macd := make([]float64, len(slowEMA))
+	for i := range slowEMA {
+		macd[i] = fastEMA[i] - slowEMA[i]
+	}
+	signalEMA := EMA(macd, signal)
+	if signalEMA == nil {
+		return MACDValue{}, false
+	}
+	v := MACDValue{MACD: macd[len(macd)-1], Signal: signalEMA[len(signalEMA)-1]}
+	v.Histogram = v.MACD - v.Signal
+	return v, true
+}
@@ -0,0 +1,69 @@
+package indicators
+
+import "testing"
+
+func TestRSI(t *testing.T) {
+	tests := []struct {
+		name   string
+		closes []float32
+		period int
+		want   float64
+		wantOK bool
+	}{
+		{name: "only gains", closes: []float32{1, 2, 3}, period: 2, want: 100, wantOK: true},
+		{name: "only losses", closes: []float32{3, 2, 1}, period: 2, want: 0, wantOK: true},
+		{name: "flat", closes: []float32{2, 2, 2}, period: 2, want: 50, wantOK: true},
+		// The first two changes average to a gain and loss of 0.5, which the
+		// gain of the third change smooths to 0.75 and 0.25.
+		{name: "smoothed", closes: []float32{1, 2, 1, 2}, period: 2, want: 75, wantOK: true},
+		{name: "fewer than period+1 bars", closes: []float32{1, 2}, period: 2},
+		{name: "single bar", closes: []float32{1}, period: 1},
+		{name: "no period", closes: []float32{1, 2, 3}, period: 0},
+	}
+	for _, test := range tests {
+		got, ok := RSI(closeBars(test.closes...), test.period)
+		if ok != test.wantOK || !near(got, test.want) {
+			t.Errorf("%v: RSI() = %v, %v, want %v, %v", test.name, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestMACD(t *testing.T) {
+	tests := []struct {
+		name               string
+		closes             []float32
+		fast, slow, signal int
+		want               MACDValue
+		wantOK             bool
+	}{
+		{
+			name:   "steady trend",
+			closes: []float32{1, 2, 3, 4, 5},
+			fast:   2,
+			slow:   3,
+			signal: 2,
+			want:   MACDValue{MACD: 0.5, Signal: 0.5},
+			wantOK: true,
+		},
+		{
+			// The fast EMA is 1.5, 2.5, 3.5, 5.1667 and the slow EMA 2, 3,
+			// 4.5, so the MACD is 0.5, 0.5, 0.6667 and its signal 0.5, 0.6111.
+			name:   "accelerating",
+			closes: []float32{1, 2, 3, 4, 6},
+			fast:   2,
+			slow:   3,
+			signal: 2,
+			want:   MACDValue{MACD: 2.0 / 3, Signal: 11.0 / 18, Histogram: 1.0 / 18},
+			wantOK: true,
+		},
+		{name: "fewer than slow+signal-1 bars", closes: []float32{1, 2, 3}, fast: 2, slow: 3, signal: 2},
+		{name: "single bar", closes: []float32{1}, fast: 2, slow: 3, signal: 2},
+		{name: "fast not faster than slow", closes: []float32{1, 2, 3, 4, 5}, fast: 3, slow: 3, signal: 2},
+	}
+	for _, test := range tests {
+		got, ok := MACD(closeBars(test.closes...), test.fast, test.slow, test.signal)
+		if ok != test.wantOK || !near(got.MACD, test.want.MACD) || !near(got.Signal, test.want.Signal) || !near(got.Histogram, test.want.Histogram) {
+			t.Errorf("%v: MACD() = %+v, %v, want %+v, %v", test.name, got, ok, test.want, test.wantOK)
+		}
+	}
+}
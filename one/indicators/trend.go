@@ -0,0 +1,65 @@
+package indicators
+
+import "github.com/alpacahq/alpaca-trade-api-go/alpaca"
+
+// Closes returns the closes of the bars.
+func Closes(bars []alpaca.Bar) []float64 {
+	closes := make([]float64, len(bars))
+	for i, b := range bars {
+		closes[i] = float64(b.Close)
+	}
+	return closes
+}
+
+// LeastSquaresSlope returns the slope of the closes of the bars, using least
+// squares regression. The slope is the change in price per bar. It returns
+// false if there are fewer than two bars, which have no slope.
+func LeastSquaresSlope(bars []alpaca.Bar) (float64, bool) {
+	if len(bars) < 2 {
+		return 0, false
+	}
+	var sumX, sumY, sumX2, sumXY float64
+	for xInt, bar := range bars {
+		x := float64(xInt)
+		y := float64(bar.Close)
+		sumX += x
+		sumY += y
+		sumX2 += x * x
+		sumXY += x * y
+	}
+	n := float64(len(bars))
+	return (n*sumXY - sumX*sumY) / (n*sumX2 - sumX*sumX), true
+}
+
+// EMA returns the exponential moving average of the values over period
+// values, the first for the window ending at values[period-1], which is
+// seeded with the simple average of the window. Nothing is returned if there
+// are fewer than period values.
+func EMA(values []float64, period int) []float64 {
+	if period < 1 || len(values) < period {
+		return nil
+	}
+	k := 2 / float64(period+1)
+	ema := []float64{Mean(values[:period])}
+	for _, v := range values[period:] {
+		last := ema[len(ema)-1]
+		ema = append(ema, last+k*(v-last))
+	}
+	return ema
+}
+
+// VWAP returns the volume weighted average price of the bars, weighting the
+// typical price, the average of the high, low and close, of each bar by its
+// volume. It returns false if the bars have no volume.
+func VWAP(bars []alpaca.Bar) (float64, bool) {
+	var value, volume float64
+	for _, b := range bars {
+		typical := (float64(b.High) + float64(b.Low) + float64(b.Close)) / 3
+		value += typical * float64(b.Volume)
+		volume += float64(b.Volume)
+	}
+	if volume <= 0 {
+		return 0, false
+	}
+	return value / volume, true
+}
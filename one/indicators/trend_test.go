@@ -0,0 +1,107 @@
+package indicators
+
+import (
+	"math"
+	"testing"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+)
+
+// closeBars returns bars with the closes.
+func closeBars(closes ...float32) []alpaca.Bar {
+	bars := make([]alpaca.Bar, len(closes))
+	for i, c := range closes {
+		bars[i] = alpaca.Bar{Time: int64(i * 60), High: c, Low: c, Close: c}
+	}
+	return bars
+}
+
+// near returns true if the values are equal within the precision of the
+// float32 prices of the bars.
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-4
+}
+
+func TestLeastSquaresSlope(t *testing.T) {
+	tests := []struct {
+		name   string
+		closes []float32
+		want   float64
+		wantOK bool
+	}{
+		{name: "no bars"},
+		{name: "single bar", closes: []float32{5}},
+		{name: "two bars", closes: []float32{1, 3}, want: 2, wantOK: true},
+		{name: "rising", closes: []float32{1, 3, 5}, want: 2, wantOK: true},
+		{name: "falling", closes: []float32{5, 4, 3}, want: -1, wantOK: true},
+		{name: "flat", closes: []float32{4, 4, 4}, want: 0, wantOK: true},
+		{name: "noisy", closes: []float32{1, 2, 2, 3}, want: 0.6, wantOK: true},
+	}
+	for _, test := range tests {
+		got, ok := LeastSquaresSlope(closeBars(test.closes...))
+		if ok != test.wantOK || !near(got, test.want) {
+			t.Errorf("%v: LeastSquaresSlope() = %v, %v, want %v, %v", test.name, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestEMA(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		period int
+		want   []float64
+	}{
+		{name: "seeded with the simple average", values: []float64{1, 2, 3, 4, 5}, period: 3, want: []float64{2, 3, 4}},
+		{name: "one window", values: []float64{1, 2, 3}, period: 3, want: []float64{2}},
+		{name: "period of one", values: []float64{1, 4, 2}, period: 1, want: []float64{1, 4, 2}},
+		{name: "fewer values than the period", values: []float64{1, 2}, period: 3},
+		{name: "no period", values: []float64{1, 2}, period: 0},
+	}
+	for _, test := range tests {
+		got := EMA(test.values, test.period)
+		if len(got) != len(test.want) {
+			t.Errorf("%v: EMA() = %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if !near(got[i], test.want[i]) {
+				t.Errorf("%v: EMA() = %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestVWAP(t *testing.T) {
+	tests := []struct {
+		name   string
+		bars   []alpaca.Bar
+		want   float64
+		wantOK bool
+	}{
+		{name: "no bars"},
+		{
+			name:   "single bar",
+			bars:   []alpaca.Bar{{High: 3, Low: 1, Close: 2, Volume: 100}},
+			want:   2,
+			wantOK: true,
+		},
+		{
+			name: "weighted by volume",
+			bars: []alpaca.Bar{
+				{High: 3, Low: 1, Close: 2, Volume: 100},
+				{High: 6, Low: 3, Close: 3, Volume: 300},
+			},
+			want:   3.5,
+			wantOK: true,
+		},
+		{name: "no volume", bars: closeBars(1, 2, 3)},
+	}
+	for _, test := range tests {
+		got, ok := VWAP(test.bars)
+		if ok != test.wantOK || !near(got, test.want) {
+			t.Errorf("%v: VWAP() = %v, %v, want %v, %v", test.name, got, ok, test.want, test.wantOK)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Package indicators computes statistics of bars which strategies and reports
+// build on.
+package indicators
+
+import (
+	"math"
+	"sort"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+)
+
+// TradingDaysPerYear is the number of trading days used to annualize daily
+// statistics.
+const TradingDaysPerYear = 252
+
+// Returns returns the return from each bar's close to the next. Nothing is
+// returned if a close is not positive.
+func Returns(bars []alpaca.Bar) []float64 {
+	var returns []float64
+	for i := 1; i < len(bars); i++ {
+		if bars[i-1].Close <= 0 {
+			return nil
+		}
+		returns = append(returns, float64(bars[i].Close)/float64(bars[i-1].Close)-1)
+	}
+	return returns
+}
+
+// Mean returns the mean of the values, or zero if there are none.
+func Mean(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+// StdDev returns the sample standard deviation of the values. It returns false
+// if there are fewer than two values.
+func StdDev(xs []float64) (float64, bool) {
+	if len(xs) < 2 {
+		return 0, false
+	}
+	mean := Mean(xs)
+	var sumSquares float64
+	for _, x := range xs {
+		sumSquares += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(sumSquares / float64(len(xs)-1)), true
+}
+
+// Volatility returns the standard deviation of the returns of the bars. When
+// periodsPerYear is positive, the volatility is annualized from bars which
+// are that many periods a year apart, e.g. TradingDaysPerYear for daily bars.
+// It returns false if there are fewer than two returns.
+func Volatility(bars []alpaca.Bar, periodsPerYear float64) (float64, bool) {
+	v, ok := StdDev(Returns(bars))
+	if !ok {
+		return 0, false
+	}
+	if periodsPerYear > 0 {
+		v *= math.Sqrt(periodsPerYear)
+	}
+	return v, true
+}
+
+// RollingVolatility returns the volatility of each window of bars, the first
+// for the window ending at bars[window-1]. The window includes window-1
+// returns.
+func RollingVolatility(bars []alpaca.Bar, window int, periodsPerYear float64) []float64 {
+	var vols []float64
+	for end := window; end <= len(bars); end++ {
+		v, ok := Volatility(bars[end-window:end], periodsPerYear)
+		if !ok {
+			v = math.NaN()
+		}
+		vols = append(vols, v)
+	}
+	return vols
+}
+
+// Beta returns the beta of the asset's returns against the benchmark's
+// returns. The bars are matched by time, so bars missing from either are
+// skipped. It returns false if there are fewer than two matched returns or the
+// benchmark did not move.
+func Beta(asset, benchmark []alpaca.Bar) (float64, bool) {
+	a, b := AlignedReturns(asset, benchmark)
+	return beta(a, b)
+}
+
+// Correlation returns the correlation of the asset's returns with the
+// benchmark's returns. The bars are matched by time as in Beta. It returns
+// false if there are fewer than two matched returns or either did not move.
+func Correlation(asset, benchmark []alpaca.Bar) (float64, bool) {
+	a, b := AlignedReturns(asset, benchmark)
+	return correlation(a, b)
+}
+
+// RollingBeta returns the beta of each window of matched bars, the first for
+// the window ending at the window-th matched bar. Windows without a beta are
+// NaN.
+func RollingBeta(asset, benchmark []alpaca.Bar, window int) []float64 {
+	return rolling(asset, benchmark, window, beta)
+}
+
+// RollingCorrelation returns the correlation of each window of matched bars
+// as in RollingBeta.
+func RollingCorrelation(asset, benchmark []alpaca.Bar, window int) []float64 {
+	return rolling(asset, benchmark, window, correlation)
+}
+
+// AlignedReturns returns the returns of the asset and the benchmark between
+// the consecutive times which both have a bar.
+func AlignedReturns(asset, benchmark []alpaca.Bar) ([]float64, []float64) {
+	a, b := alignBars(asset, benchmark)
+	return Returns(a), Returns(b)
+}
+
+// BetaOf returns the beta of the returns against the benchmark returns, which
+// must be the same length.
+func BetaOf(returns, benchmark []float64) (float64, bool) {
+	return beta(returns, benchmark)
+}
+
+// CorrelationOf returns the correlation of the returns with the benchmark
+// returns, which must be the same length.
+func CorrelationOf(returns, benchmark []float64) (float64, bool) {
+	return correlation(returns, benchmark)
+}
+
+// alignBars returns the bars of the asset and the benchmark at the times
+// which both have a bar, ordered by time.
+func alignBars(asset, benchmark []alpaca.Bar) ([]alpaca.Bar, []alpaca.Bar) {
+	byTime := map[int64]alpaca.Bar{}
+	for _, b := range benchmark {
+		byTime[b.Time] = b
+	}
+	sorted := append([]alpaca.Bar(nil), asset...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time < sorted[j].Time })
+	var a, b []alpaca.Bar
+	for _, bar := range sorted {
+		if m, ok := byTime[bar.Time]; ok {
+			a = append(a, bar)
+			b = append(b, m)
+		}
+	}
+	return a, b
+}
+
+// rolling applies f to the returns of each window of matched bars.
+func rolling(asset, benchmark []alpaca.Bar, window int, f func(a, b []float64) (float64, bool)) []float64 {
+	a, b := alignBars(asset, benchmark)
+	var values []float64
+	for end := window; end <= len(a); end++ {
+		v, ok := f(Returns(a[end-window:end]), Returns(b[end-window:end]))
+		if !ok {
+			v = math.NaN()
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// covariance returns the sample covariance of the values, which must be the
+// same length.
+func covariance(a, b []float64) (float64, bool) {
+	if len(a) < 2 || len(a) != len(b) {
+		return 0, false
+	}
+	meanA, meanB := Mean(a), Mean(b)
+	var sum float64
+	for i := range a {
+		sum += (a[i] - meanA) * (b[i] - meanB)
+	}
+	return sum / float64(len(a)-1), true
+}
+
+func beta(a, b []float64) (float64, bool) {
+	cov, ok := covariance(a, b)
+	if !ok {
+		return 0, false
+	}
+	sd, _ := StdDev(b)
+	if sd == 0 {
+		return 0, false
+	}
+	return cov / (sd * sd), true
+}
+
+func correlation(a, b []float64) (float64, bool) {
+	cov, ok := covariance(a, b)
+	if !ok {
+		return 0, false
+	}
+	sdA, _ := StdDev(a)
+	sdB, _ := StdDev(b)
+	if sdA == 0 || sdB == 0 {
+		return 0, false
+	}
+	return cov / (sdA * sdB), true
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// killSwitch stops trading by hand. While it is engaged no new purchases are
+// made, but the open purchases are still protected and sold by their sell
+// orders. It stays engaged until it is released.
+type killSwitch struct {
+	mu        sync.Mutex
+	engaged   bool
+	engagedAt time.Time
+	reason    string
+}
+
+var kill = &killSwitch{}
+
+// killSwitchState is the state of the kill switch served by the control API.
+type killSwitchState struct {
+	Engaged   bool       `json:"engaged"`
+	EngagedAt *time.Time `json:"engaged_at,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+}
+
+// engage engages the kill switch at t. It returns false if it was already
+// engaged.
+func (k *killSwitch) engage(t time.Time, reason string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.engaged {
+		return false
+	}
+	k.engaged = true
+	k.engagedAt = t
+	k.reason = reason
+	return true
+}
+
+// release allows trading again.
+func (k *killSwitch) release() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.engaged = false
+	k.reason = ""
+}
+
+// isEngaged returns true if the kill switch is engaged.
+func (k *killSwitch) isEngaged() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.engaged
+}
+
+// state returns the state of the kill switch.
+func (k *killSwitch) state() *killSwitchState {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s := &killSwitchState{Engaged: k.engaged, Reason: k.reason}
+	if k.engaged {
+		engagedAt := k.engagedAt
+		s.EngagedAt = &engagedAt
+	}
+	return s
+}
+
+// engageKillSwitch stops trading, cancels the unfilled buy orders of the
+// clients and drops their queued buys. The open purchases are sold at market
+// when flatten is set.
+func engageKillSwitch(clients []*client, t time.Time, reason string, flatten bool) {
+	if !kill.engage(t, reason) {
+		return
+	}
+	msg := fmt.Sprintf("kill switch engaged: %v", reason)
+	log.Print(msg)
+	for _, c := range clients {
+		if c.shadow {
+			continue
+		}
+		go c.alert(msg)
+		c.do(func() {
+			c.narrate(t, "%v, no new purchases are made", msg)
+			for _, p := range c.inProgressBuyOrders() {
+				c.cancelEntry(p, t)
+			}
+			if n := c.orders.dropBuys(); n > 0 {
+				log.Printf("dropped %v queued buys of %v", n, c.stockSymbol)
+			}
+			if flatten {
+				c.flatten(t, "as the kill switch was engaged")
+			}
+		})
+	}
+}
+
+// writeKillSwitch writes the state of the kill switch for the status page.
+func writeKillSwitch(w io.Writer) {
+	s := kill.state()
+	if !s.Engaged {
+		return
+	}
+	fmt.Fprintf(w, "\nKill switch: ENGAGED @ %v, no new purchases (%v)\n",
+		s.EngagedAt.In(EST).Format("15:04 MST"), s.Reason)
+}
+
+// serveKillSwitch serves the state of the kill switch as JSON.
+func serveKillSwitch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(kill.state()); err != nil {
+		log.Printf("unable to encode kill switch state: %v", err)
+	}
+}
+
+// serveKillSwitchEngage engages the kill switch. It must be an authorized
+// POST, see authorizeControl, with an optional reason and flatten=true to also
+// sell the open purchases at market.
+func serveKillSwitchEngage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "engage the kill switch with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeControl(w, r) {
+		log.Printf("refused an unauthorized engage of the kill switch from %v", r.RemoteAddr)
+		return
+	}
+	flatten := false
+	if v := r.FormValue("flatten"); v != "" {
+		var err error
+		if flatten, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid flatten %q: %v", v, err), http.StatusBadRequest)
+			return
+		}
+	}
+	reason := r.FormValue("reason")
+	if reason == "" {
+		reason = "engaged by hand from " + r.RemoteAddr
+	}
+	clients, _ := currentSession.snapshot()
+	engageKillSwitch(clients, time.Now(), reason, flatten)
+	serveKillSwitch(w, r)
+}
+
+// serveKillSwitchRelease releases the kill switch. It must be an authorized
+// POST, see authorizeControl.
+func serveKillSwitchRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "release the kill switch with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeControl(w, r) {
+		log.Printf("refused an unauthorized release of the kill switch from %v", r.RemoteAddr)
+		return
+	}
+	kill.release()
+	log.Printf("kill switch was released from %v", r.RemoteAddr)
+	serveKillSwitch(w, r)
+}
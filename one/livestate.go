@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+var (
+	redisAddr      = flag.String("redis_addr", "", "When set, the live state of the trader (its heartbeat, today's purchases, the latest buy signals and the narration) is published to the Redis server at this address, e.g. \"localhost:6379\", so a dashboard on another host can read it without polling the database.")
+	redisPassword  = flag.String("redis_password", "", "The password of the Redis server at redis_addr.")
+	redisKeyPrefix = flag.String("redis_key_prefix", "trader", "The prefix of the Redis keys and channels the live state is published to. Should match the dashboard's redis_key_prefix.")
+	redisStateTTL  = flag.Duration("redis_state_ttl", 2*time.Minute, "How long the published live state is kept without being refreshed, after which the dashboard no longer shows the trader as live.")
+)
+
+// liveSignals is the number of the latest buy signals in the live state.
+const liveSignals = 50
+
+// liveState publishes the live state to Redis. It is nil unless redis_addr is
+// set.
+var liveState *database.RedisState
+
+// signalLog keeps the latest buy signals for the live state.
+type signalLog struct {
+	mu      sync.Mutex
+	signals []*database.Signal
+}
+
+var recentSignals = &signalLog{}
+
+// startLiveState starts publishing the live state when redis_addr is set.
+func startLiveState(cfg ClientConfig) {
+	if *redisAddr == "" || cfg.Backtest {
+		return
+	}
+	liveState = database.NewRedisState(*redisAddr, *redisPassword, *redisKeyPrefix, cfg.Instance)
+	log.Printf("publishing the live state to redis at %v", *redisAddr)
+}
+
+// publishSignal adds the buy signal to the live state and publishes it.
+// decision is "buy", or "blocked" when a rule blocked the buy.
+func (c *client) publishSignal(t time.Time, price float32, decision, detail string) {
+	if liveState == nil {
+		return
+	}
+	s := &database.Signal{
+		Time:     t,
+		Strategy: c.strategy,
+		Symbol:   c.stockSymbol,
+		Decision: decision,
+		Detail:   detail,
+		Price:    float64(price),
+	}
+	recentSignals.mu.Lock()
+	recentSignals.signals = append(recentSignals.signals, s)
+	if len(recentSignals.signals) > liveSignals {
+		recentSignals.signals = recentSignals.signals[len(recentSignals.signals)-liveSignals:]
+	}
+	recentSignals.mu.Unlock()
+	go func() {
+		if err := liveState.PublishSignal(s); err != nil {
+			log.Printf("unable to publish signal: %v", err)
+		}
+	}()
+}
+
+// publishLiveState publishes the heartbeat, the purchases of the clients, the
+// latest signals and the narration.
+func publishLiveState(clients []*client, h *database.Heartbeat) {
+	if liveState == nil {
+		return
+	}
+	state := &database.LiveState{
+		Instance:  clients[0].cfg.Instance,
+		Time:      h.Time,
+		Heartbeat: h,
+	}
+	for _, c := range clients {
+		// The purchases are copied while the client is not changing them.
+		var b []byte
+		var err error
+		c.do(func() { b, err = json.Marshal(c.purchases) })
+		var purchases []*purchase.Purchase
+		if err == nil {
+			err = json.Unmarshal(b, &purchases)
+		}
+		if err != nil {
+			log.Printf("unable to copy the purchases of %v for the live state: %v", c.strategy, err)
+			continue
+		}
+		state.Purchases = append(state.Purchases, purchases...)
+	}
+	recentSignals.mu.Lock()
+	state.Signals = append([]*database.Signal{}, recentSignals.signals...)
+	recentSignals.mu.Unlock()
+	state.Narration = narration.latest(*narrationLines)
+	if err := liveState.PublishState(state, *redisStateTTL); err != nil {
+		log.Printf("unable to publish live state: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	narrationLines    = flag.Int("narration_lines", 200, "The number of narration lines kept for the status page.")
+	narrationWebhooks = flag.Bool("narration_webhooks", false, "If true, each narration line is also sent to the webhooks as a narration event.")
+)
+
+const (
+	webhookNarration = "narration"
+
+	// statusNarrationLines is the number of narration lines shown on the
+	// status page. All kept lines are served at /narration.
+	statusNarrationLines = 20
+)
+
+// narrator keeps the latest narration lines, which describe what the trader
+// did and why in plain words.
+type narrator struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+var narration = &narrator{}
+
+// add keeps the line, dropping the oldest lines beyond narration_lines.
+func (n *narrator) add(line string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lines = append(n.lines, line)
+	if len(n.lines) > *narrationLines {
+		n.lines = n.lines[len(n.lines)-*narrationLines:]
+	}
+}
+
+// latest returns up to the latest max lines, oldest first.
+func (n *narrator) latest(max int) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	lines := n.lines
+	if len(lines) > max {
+		lines = lines[len(lines)-max:]
+	}
+	return append([]string{}, lines...)
+}
+
+// narrate records a line of narration at t, e.g.
+// "10:31 bought 10 SPY @ 452.10 because slope 1.70 ≥ 1.30".
+func (c *client) narrate(t time.Time, format string, args ...interface{}) {
+	line := t.In(EST).Format("15:04") + " " + fmt.Sprintf(format, args...)
+	if c.shadow {
+		line += " (shadow " + c.strategy + ")"
+	}
+	narration.add(line)
+	log.Printf("narration: %v", line)
+	if c.cfg.NarrationWebhooks && webhooksEnabled() {
+		go sendWebhooks(&webhookEvent{
+			Type:     webhookNarration,
+			Time:     t,
+			Symbol:   c.stockSymbol,
+			Strategy: c.strategy,
+			Shadow:   c.shadow,
+			Message:  line,
+		})
+	}
+}
+
+// now returns the current time, which is the simulated time in backtests.
+func (c *client) now() time.Time {
+	if c.cfg.Backtest {
+		return c.backtestClock.Now
+	}
+	return time.Now()
+}
+
+// entryReason explains the buy signal of the latest evaluated bars.
+func (c *client) entryReason() string {
+	if external != nil || signals != nil {
+		if c.lastExternalReason == "" {
+			return "the external strategy decided to buy"
+		}
+		return c.lastExternalReason
+	}
+	reason := fmt.Sprintf("slope %.2f ≥ %.2f", c.lastSlope, c.cfg.Params.minSlope)
+	if c.cfg.Params.allSequentialIncreases {
+		reason += " and every bar rose"
+	}
+	return reason
+}
+
+// narrateEntry narrates a filled buy and the bracket placed to sell it.
+func (c *client) narrateEntry(p *purchase.Purchase, takeProfit, stop decimal.Decimal) {
+	t := c.now()
+	if p.BuyOrder.FilledAt != nil {
+		t = *p.BuyOrder.FilledAt
+	}
+	reason := ""
+	if p.EntryReason != "" {
+		reason = " because " + p.EntryReason
+	}
+	exit := fmt.Sprintf("bracket %v/%v", takeProfit.StringFixed(2), stop.StringFixed(2))
+	if takeProfit.IsZero() {
+		exit = fmt.Sprintf("trailing stop from %v", stop.StringFixed(2))
+	}
+	c.narrate(t, "bought %v %v @ %v%v; %v",
+		p.BuyOrder.FilledQty, c.stockSymbol, p.BuyOrder.FilledAvgPrice.StringFixed(2), reason, exit)
+	c.watchEntry(p, takeProfit, stop)
+}
+
+// narrateExit narrates a filled sell.
+func (c *client) narrateExit(p *purchase.Purchase) {
+	t := c.now()
+	if p.SellOrder.FilledAt != nil {
+		t = *p.SellOrder.FilledAt
+	}
+	leg, _ := p.ExitLeg()
+	line := fmt.Sprintf("sold %v %v @ %v (%v), P/L $%v",
+		p.SellOrder.FilledQty, c.stockSymbol, p.SellOrder.FilledAvgPrice.StringFixed(2), leg, p.RealizedProfitLoss().StringFixed(2))
+	if d := p.TimeInTrade(); d > 0 {
+		line += fmt.Sprintf(" after %v", d.Round(time.Second))
+	}
+	c.narrate(t, "%v", line)
+	c.watchExit(p)
+}
+
+// writeNarration writes the latest narration lines for the status page.
+func writeNarration(w io.Writer, max int) {
+	lines := narration.latest(max)
+	fmt.Fprintf(w, "\nNarration:\n")
+	if len(lines) == 0 {
+		fmt.Fprintf(w, "  nothing has happened yet\n")
+	}
+	for _, l := range lines {
+		fmt.Fprintf(w, "  %v\n", l)
+	}
+}
+
+// serveNarration serves all kept narration lines.
+func serveNarration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeNarration(w, *narrationLines)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ocoEmulation          = flag.String("oco_emulation", "auto", "When sell orders are emulated locally instead of placed as OCO orders: \"auto\" (once Alpaca rejects the OCO order class for the symbol), \"always\" or \"never\". An emulated sell places the take profit limit order and watches the price, and once the stop trades it cancels the limit and sells with oco_emulation_stop_order.")
+	ocoEmulationStopOrder = flag.String("oco_emulation_stop_order", "market", "The order an emulated sell places once its stop trades: \"market\" or \"limit\" (at the stop's limit price).")
+
+	backtestRejectOCO     = flag.Bool("backtest_reject_oco", false, "If true, the simulated broker rejects OCO orders, so backtests use emulated sells with oco_emulation set to auto.")
+	backtestOCOCancelFill = flag.Float64("backtest_oco_cancel_fill", 0, "The chance, from 0 to 1, that the take profit order of an emulated sell fills while it is being cancelled, half the time only partially. This simulates the race between the cancel and a fill.")
+)
+
+const (
+	// syntheticOCOIDPrefix is the prefix of the ID of an emulated sell order.
+	// The order is not known to Alpaca, its stop and take profit orders are.
+	syntheticOCOIDPrefix = "oco-"
+	// ocoHeld is the status of the stop of an emulated sell while the take
+	// profit order is working.
+	ocoHeld = "held"
+	// ocoTriggered is the status of the stop of an emulated sell after the
+	// stop traded, while the take profit order is being cancelled.
+	ocoTriggered = "triggered"
+)
+
+// isSyntheticOCO returns true if the order is an emulated sell order, whose
+// stop and take profit orders are stored as its legs, in that order.
+func isSyntheticOCO(o *alpaca.Order) bool {
+	return o != nil && strings.HasPrefix(o.ID, syntheticOCOIDPrefix)
+}
+
+// emulatingOCO returns true if sell orders are emulated. Shadow orders are
+// simulated locally already.
+func (c *client) emulatingOCO() bool {
+	if c.shadow {
+		return false
+	}
+	switch c.cfg.OCOEmulation {
+	case "always":
+		return true
+	case "auto":
+		return c.ocoRejected
+	}
+	return false
+}
+
+// rejectsOCO returns true if the error is Alpaca refusing the OCO order class.
+func rejectsOCO(err error) bool {
+	apiErr, ok := err.(*alpaca.APIError)
+	if !ok {
+		return false
+	}
+	msg := strings.ToLower(apiErr.Message)
+	return strings.Contains(msg, "oco") || strings.Contains(msg, "order class") || strings.Contains(msg, "order_class")
+}
+
+// fallBackToSyntheticOCO emulates the OCO sell order which Alpaca rejected,
+// and keeps emulating the client's sells when oco_emulation is auto.
+func (c *client) fallBackToSyntheticOCO(p *purchase.Purchase, req *alpaca.PlaceOrderRequest, err error) bool {
+	if c.cfg.OCOEmulation != "auto" {
+		log.Printf("unable to place sell order, OCO orders are rejected and oco_emulation is %q: %v", c.cfg.OCOEmulation, err)
+		return false
+	}
+	log.Printf("OCO orders are rejected for %v, emulating sells from now on: %v", c.stockSymbol, err)
+	c.ocoRejected = true
+	return c.placeSyntheticOCO(p, req)
+}
+
+// placeSyntheticOCO emulates the OCO sell order request. Only the take profit
+// limit order is placed, the stop is held locally until it trades.
+func (c *client) placeSyntheticOCO(p *purchase.Purchase, req *alpaca.PlaceOrderRequest) bool {
+	takeProfit, err := c.placeSellChild(&alpaca.PlaceOrderRequest{
+		AssetKey:      req.AssetKey,
+		Qty:           req.Qty,
+		Side:          alpaca.Sell,
+		Type:          alpaca.Limit,
+		LimitPrice:    req.TakeProfit.LimitPrice,
+		TimeInForce:   req.TimeInForce,
+		ClientOrderID: req.ClientOrderID + "-tp",
+	})
+	if err != nil {
+		log.Printf("unable to place take profit order of emulated sell: %v", err)
+		return false
+	}
+	now := c.now()
+	legs := []alpaca.Order{
+		{
+			ClientOrderID: req.ClientOrderID + "-sl",
+			Symbol:        c.stockSymbol,
+			Side:          alpaca.Sell,
+			Type:          alpaca.StopLimit,
+			TimeInForce:   req.TimeInForce,
+			Qty:           req.Qty,
+			StopPrice:     req.StopLoss.StopPrice,
+			LimitPrice:    req.StopLoss.LimitPrice,
+			Status:        ocoHeld,
+			CreatedAt:     now,
+		},
+		*takeProfit,
+	}
+	p.SellOrder = &alpaca.Order{
+		ID:            syntheticOCOIDPrefix + req.ClientOrderID,
+		ClientOrderID: req.ClientOrderID,
+		Symbol:        c.stockSymbol,
+		Side:          alpaca.Sell,
+		Type:          alpaca.Limit,
+		TimeInForce:   req.TimeInForce,
+		Qty:           req.Qty,
+		LimitPrice:    req.TakeProfit.LimitPrice,
+		StopPrice:     req.StopLoss.StopPrice,
+		Status:        "new",
+		CreatedAt:     now,
+		SubmittedAt:   now,
+		Legs:          &legs,
+	}
+	log.Printf("emulated sell order placed, take profit order %q @ $%v, stop held @ $%v", takeProfit.ID, req.TakeProfit.LimitPrice, req.StopLoss.StopPrice)
+	c.narrateEntry(p, *req.TakeProfit.LimitPrice, *req.StopLoss.StopPrice)
+
+	if err := c.dbClient.Update(p); err != nil {
+		log.Printf("unable to update for sell order:%v\n%+v", err, p)
+	}
+	return true
+}
+
+// placeSellChild places a stop or take profit order of an emulated sell.
+func (c *client) placeSellChild(req *alpaca.PlaceOrderRequest) (*alpaca.Order, error) {
+	if c.cfg.Backtest {
+		return c.fakeSellOrder(req)
+	}
+	return c.placeOrder(req)
+}
+
+// updateSyntheticOCO refreshes the stop and take profit orders of the
+// emulated sell order and triggers the stop once it trades, then updates the
+// totals of the order.
+//
+// The stop is only placed once the take profit order has ended, since both
+// working at once could sell the shares twice. If the take profit order fills
+// while it is being cancelled, the stop only sells what is left.
+func (c *client) updateSyntheticOCO(o *alpaca.Order, now time.Time) {
+	stop, takeProfit := &(*o.Legs)[0], &(*o.Legs)[1]
+	c.refreshSellChild(takeProfit)
+	if stop.ID != "" {
+		c.refreshSellChild(stop)
+	}
+
+	if stop.Status == ocoHeld {
+		switch {
+		case closedOrderStatuses[takeProfit.Status]:
+			stop.Status = "canceled"
+			stop.CanceledAt = &now
+		case c.isTrading() && c.stopTraded(stop):
+			log.Printf("stop of emulated sell order %q traded @ $%v, cancelling take profit order %q", o.ID, stop.StopPrice, takeProfit.ID)
+			stop.Status = ocoTriggered
+			c.cancelSellChild(takeProfit)
+			c.refreshSellChild(takeProfit)
+		}
+	}
+	if stop.Status == ocoTriggered {
+		if closedOrderStatuses[takeProfit.Status] {
+			c.placeStop(o, now)
+		} else {
+			log.Printf("waiting for take profit order %q to be cancelled, it is %q", takeProfit.ID, takeProfit.Status)
+		}
+	}
+	syntheticOCOTotals(o, now)
+}
+
+// refreshSellChild updates the stop or take profit order with its latest
+// details, unless it has ended. The stop price is kept, since the order
+// placed for the stop has none.
+func (c *client) refreshSellChild(child *alpaca.Order) {
+	if child.ID == "" || closedOrderStatuses[child.Status] {
+		return
+	}
+	latest, _ := c.order(child.ID)
+	if latest == nil {
+		return
+	}
+	stopPrice := child.StopPrice
+	*child = *latest
+	if child.StopPrice == nil {
+		child.StopPrice = stopPrice
+	}
+}
+
+// cancelSellChild requests that the order is cancelled. The request may lose
+// the race with a fill, which refreshSellChild picks up.
+func (c *client) cancelSellChild(child *alpaca.Order) {
+	if c.cfg.Backtest {
+		c.fakeRequestCancel(child)
+		return
+	}
+	if err := c.alpacaClient.CancelOrder(child.ID); err != nil {
+		log.Printf("unable to cancel %q: %v", child.ID, err)
+	}
+}
+
+// stopTraded returns true if the price traded at or through the stop.
+func (c *client) stopTraded(stop *alpaca.Order) bool {
+	var price decimal.Decimal
+	if c.cfg.Backtest {
+		price = c.fakeCurrentPrice().sellTriggerPrice()
+	} else {
+		var err error
+		if price, err = c.latestPrice(); err != nil {
+			log.Printf("unable to check the stop of an emulated sell: %v", err)
+			return false
+		}
+	}
+	return price.LessThanOrEqual(*stop.StopPrice)
+}
+
+// placeStop places the order which sells the shares the take profit order did
+// not. If it cannot be placed, it is tried again on the next update.
+func (c *client) placeStop(o *alpaca.Order, now time.Time) {
+	stop, takeProfit := &(*o.Legs)[0], &(*o.Legs)[1]
+	remaining := o.Qty.Sub(takeProfit.FilledQty)
+	if !remaining.IsPositive() {
+		log.Printf("take profit order %q filled before it was cancelled, the stop is not needed", takeProfit.ID)
+		stop.Status = "canceled"
+		stop.CanceledAt = &now
+		return
+	}
+	req := &alpaca.PlaceOrderRequest{
+		AssetKey:      &c.stockSymbol,
+		Qty:           remaining,
+		Side:          alpaca.Sell,
+		Type:          alpaca.Market,
+		TimeInForce:   alpaca.Day,
+		ClientOrderID: stop.ClientOrderID,
+	}
+	if c.cfg.OCOEmulationStopOrder == "limit" && stop.LimitPrice != nil {
+		req.Type = alpaca.Limit
+		req.LimitPrice = stop.LimitPrice
+	}
+	placed, err := c.placeSellChild(req)
+	if err != nil {
+		log.Printf("unable to place stop order %q of emulated sell, trying again: %v", stop.ClientOrderID, err)
+		return
+	}
+	log.Printf("stop order %q placed for %v shares of emulated sell %q", placed.ID, remaining, o.ID)
+	stopPrice := stop.StopPrice
+	*stop = *placed
+	stop.StopPrice = stopPrice
+}
+
+// cancelSyntheticOCOAndWait cancels the working stop and take profit orders
+// of the emulated sell order and waits until they are cancelled.
+func (c *client) cancelSyntheticOCOAndWait(o *alpaca.Order) error {
+	for i := range *o.Legs {
+		child := &(*o.Legs)[i]
+		switch {
+		case child.Status == ocoHeld || child.Status == ocoTriggered:
+			child.Status = "canceled"
+		case closedOrderStatuses[child.Status]:
+		default:
+			if err := c.cancelAndWait(child.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syntheticOCOTotals sets the status, filled quantity and average fill price
+// of the emulated sell order from its stop and take profit orders.
+func syntheticOCOTotals(o *alpaca.Order, now time.Time) {
+	filledQty := decimal.Zero
+	cost := decimal.Zero
+	working := false
+	var filledAt *time.Time
+	for _, child := range *o.Legs {
+		if !closedOrderStatuses[child.Status] {
+			working = true
+		}
+		if !child.FilledQty.IsPositive() || child.FilledAvgPrice == nil {
+			continue
+		}
+		filledQty = filledQty.Add(child.FilledQty)
+		cost = cost.Add(child.FilledAvgPrice.Mul(child.FilledQty))
+		if child.FilledAt != nil && (filledAt == nil || child.FilledAt.After(*filledAt)) {
+			filledAt = child.FilledAt
+		}
+	}
+	o.FilledQty = filledQty
+	o.FilledAvgPrice = nil
+	if filledQty.IsPositive() {
+		avg := cost.Div(filledQty).Round(4)
+		o.FilledAvgPrice = &avg
+	}
+	switch {
+	case filledQty.GreaterThanOrEqual(o.Qty):
+		o.Status = filled
+		if filledAt == nil {
+			filledAt = &now
+		}
+		o.FilledAt = filledAt
+	case working && filledQty.IsPositive():
+		o.Status = "partially_filled"
+	case working:
+		o.Status = "new"
+	default:
+		o.Status = "canceled"
+		o.CanceledAt = &now
+	}
+	o.UpdatedAt = now
+}
+
+// validateOCOEmulation returns an error if the OCO emulation flags are not
+// valid.
+func validateOCOEmulation() error {
+	switch *ocoEmulation {
+	case "auto", "always", "never":
+	default:
+		return fmt.Errorf("unknown oco_emulation %q", *ocoEmulation)
+	}
+	if *ocoEmulationStopOrder != "market" && *ocoEmulationStopOrder != "limit" {
+		return fmt.Errorf("unknown oco_emulation_stop_order %q", *ocoEmulationStopOrder)
+	}
+	return nil
+}
+
+// fakeSellOrder places a sell order with the simulated broker, which fills it
+// in fakeSellAttempt.
+func (c *client) fakeSellOrder(req *alpaca.PlaceOrderRequest) (*alpaca.Order, error) {
+	arrival := c.fakeArrival()
+	if c.fakeHalted() {
+		return nil, fmt.Errorf("sell order rejected, trading is halted @ %v", c.backtestClock.Now)
+	}
+	if err := checkTicks(req.LimitPrice, req.StopPrice); err != nil {
+		return nil, fmt.Errorf("sell order rejected: %v", err)
+	}
+	c.backtestOrderID++
+	o := &alpaca.Order{
+		ID:            fmt.Sprint(c.backtestOrderID),
+		ClientOrderID: req.ClientOrderID,
+		Symbol:        c.stockSymbol,
+		CreatedAt:     c.backtestClock.Now,
+		SubmittedAt:   arrival,
+		Status:        "new",
+		Qty:           req.Qty,
+		Side:          alpaca.Sell,
+		Type:          req.Type,
+		LimitPrice:    req.LimitPrice,
+		StopPrice:     req.StopPrice,
+		TrailPercent:  req.TrailPercent,
+	}
+	raiseTrailingStop(o, c.fakeCurrentPrice().sellTriggerPrice())
+	return o, nil
+}
+
+// fakeRequestCancel asks the simulated broker to cancel the order. The cancel
+// is done by the first fakeOrder after it reaches the broker in a later
+// minute, which may fill the order first with a chance of
+// backtest_oco_cancel_fill.
+func (c *client) fakeRequestCancel(o *alpaca.Order) {
+	arrival := c.fakeArrival()
+	if fakeWorking(o) {
+		o.Status = "pending_cancel"
+		o.UpdatedAt = arrival
+	}
+}
+
+// fakeFinishCancel cancels an order which is pending cancel, unless it fills
+// in the race with the cancel. A buy may fill until the cancel reaches the
+// broker.
+func (c *client) fakeFinishCancel(o *alpaca.Order) {
+	now := c.backtestClock.Now
+	if o.Side == alpaca.Buy {
+		c.fakeBuyAttempt(o)
+		if o.Status == filled {
+			return
+		}
+	}
+	if rand.Float64() < c.cfg.BacktestOCOCancelFill && o.LimitPrice != nil {
+		qty := o.Qty.Sub(o.FilledQty)
+		if half := qty.Div(decimal.NewFromInt(2)).Floor(); rand.Intn(2) == 0 && half.IsPositive() {
+			qty = half
+		}
+		log.Printf("order %v filled %v of %v while it was being cancelled", o.ID, qty, o.Qty)
+		c.fakeFill(o, qty, *o.LimitPrice)
+		if o.Status == filled {
+			return
+		}
+	}
+	o.Status = "canceled"
+	o.CanceledAt = &now
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+// newSyntheticOCOTestClient returns a trading backtest client holding 10
+// shares bought @ $100, with an emulated sell taking profit @ $101 and
+// stopping @ $99. The price in each minute is given by prices.
+func newSyntheticOCOTestClient(t *testing.T, cfg ClientConfig, prices ...string) (*client, *purchase.Purchase) {
+	t.Helper()
+	c := newBacktestTestClient(t, cfg, len(prices), "100", "1000")
+	for i, price := range prices {
+		m := c.backtestHistory.epochToTickerData[backtestTestStart.Add(time.Duration(i)*time.Minute).Unix()]
+		m.High = decimal.RequireFromString(price)
+		m.Low = m.High
+		m.Close = m.High
+	}
+	c.backtestTrading = true
+	c.backtestStockHeldQty = decimal.NewFromInt(10)
+	bought := decimal.NewFromInt(100)
+	p := &purchase.Purchase{BuyOrder: &alpaca.Order{
+		ID:             "buy",
+		Status:         filled,
+		Side:           alpaca.Buy,
+		Qty:            decimal.NewFromInt(10),
+		FilledQty:      decimal.NewFromInt(10),
+		FilledAvgPrice: &bought,
+	}}
+	c.purchases = append(c.purchases, p)
+	takeProfit, stop := decimal.NewFromInt(101), decimal.NewFromInt(99)
+	if !c.placeSyntheticOCO(p, &alpaca.PlaceOrderRequest{
+		Qty:           decimal.NewFromInt(10),
+		ClientOrderID: "sell",
+		TakeProfit:    &alpaca.TakeProfit{LimitPrice: &takeProfit},
+		StopLoss:      &alpaca.StopLoss{StopPrice: &stop},
+	}) {
+		t.Fatal("placeSyntheticOCO() = false")
+	}
+	return c, p
+}
+
+// updateSyntheticOCOAt updates the emulated sell in the minute.
+func updateSyntheticOCOAt(c *client, p *purchase.Purchase, minute int) {
+	c.backtestClock.Now = backtestTestStart.Add(time.Duration(minute) * time.Minute)
+	c.updateSyntheticOCO(p.SellOrder, c.backtestClock.Now)
+}
+
+func TestSyntheticOCOTakeProfitFillsDuringCancel(t *testing.T) {
+	// The take profit order fills in full or in half while it is cancelled,
+	// depending on the seed.
+	for seed := int64(1); seed <= 8; seed++ {
+		rand.Seed(seed)
+		c, p := newSyntheticOCOTestClient(t, ClientConfig{BacktestOCOCancelFill: 1}, "100", "98", "98", "98")
+		stop, takeProfit := &(*p.SellOrder.Legs)[0], &(*p.SellOrder.Legs)[1]
+		updateSyntheticOCOAt(c, p, 1)
+		if stop.Status != ocoTriggered || takeProfit.Status != "pending_cancel" {
+			t.Fatalf("seed %v: stop is %v and take profit is %v once the stop traded, want %v and pending_cancel", seed, stop.Status, takeProfit.Status, ocoTriggered)
+		}
+		updateSyntheticOCOAt(c, p, 2)
+		updateSyntheticOCOAt(c, p, 3)
+
+		if p.SellOrder.Status != filled || !p.SellOrder.FilledQty.Equal(decimal.NewFromInt(10)) {
+			t.Errorf("seed %v: emulated sell is %v with %v filled, want filled with 10", seed, p.SellOrder.Status, p.SellOrder.FilledQty)
+		}
+		if !c.backtestStockHeldQty.IsZero() {
+			t.Errorf("seed %v: %v shares are held after the sell, want 0", seed, c.backtestStockHeldQty)
+		}
+		if takeProfit.FilledQty.Equal(decimal.NewFromInt(10)) && stop.Status != "canceled" {
+			t.Errorf("seed %v: stop is %v after the take profit order filled in full, want canceled", seed, stop.Status)
+		}
+	}
+}
+
+func TestSyntheticOCOPartialTakeProfitBeforeStop(t *testing.T) {
+	c, p := newSyntheticOCOTestClient(t, ClientConfig{BacktestParticipationRate: 0.003}, "100", "101", "98", "98", "98", "98", "98")
+	stop, takeProfit := &(*p.SellOrder.Legs)[0], &(*p.SellOrder.Legs)[1]
+	updateSyntheticOCOAt(c, p, 1)
+	if takeProfit.Status != "partially_filled" || !takeProfit.FilledQty.Equal(decimal.NewFromInt(3)) {
+		t.Fatalf("take profit order is %v with %v filled, want partially_filled with 3", takeProfit.Status, takeProfit.FilledQty)
+	}
+	updateSyntheticOCOAt(c, p, 2)
+	updateSyntheticOCOAt(c, p, 3)
+	if !stop.Qty.Equal(decimal.NewFromInt(7)) {
+		t.Fatalf("stop order is for %v shares, want the 7 the take profit order did not sell", stop.Qty)
+	}
+	for minute := 4; minute < 7 && p.SellOrder.Status != filled; minute++ {
+		updateSyntheticOCOAt(c, p, minute)
+	}
+	if p.SellOrder.Status != filled || !p.SellOrder.FilledQty.Equal(decimal.NewFromInt(10)) {
+		t.Errorf("emulated sell is %v with %v filled, want filled with 10", p.SellOrder.Status, p.SellOrder.FilledQty)
+	}
+	if !c.backtestStockHeldQty.IsZero() {
+		t.Errorf("%v shares are held after the sell, want 0", c.backtestStockHeldQty)
+	}
+}
+
+func TestSyntheticOCOStopTradesWhileNotTrading(t *testing.T) {
+	c, p := newSyntheticOCOTestClient(t, ClientConfig{}, "100", "98", "98")
+	stop, takeProfit := &(*p.SellOrder.Legs)[0], &(*p.SellOrder.Legs)[1]
+	c.backtestTrading = false
+	updateSyntheticOCOAt(c, p, 1)
+	if stop.Status != ocoHeld || takeProfit.Status != "new" {
+		t.Fatalf("stop is %v and take profit is %v after the stop traded while not trading, want %v and new", stop.Status, takeProfit.Status, ocoHeld)
+	}
+
+	c.backtestTrading = true
+	updateSyntheticOCOAt(c, p, 2)
+	if stop.Status != ocoTriggered {
+		t.Errorf("stop is %v once trading resumed, want %v", stop.Status, ocoTriggered)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ocoReplaceAttempts = flag.Int("oco_replace_attempts", 2, "How many times a sell OCO order which Alpaca rejects for its prices is placed again, with the take profit and stop each moved a further tick away from the market.")
+)
+
+// rejectsOrderPrices returns true if the error is Alpaca rejecting the prices
+// of an order, e.g. sub-penny prices or a limit inside the spread.
+func rejectsOrderPrices(err error) bool {
+	apiErr, ok := err.(*alpaca.APIError)
+	if !ok {
+		return false
+	}
+	msg := strings.ToLower(apiErr.Message)
+	for _, s := range []string{"price", "increment", "sub-penny", "tick"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// adjustOCOPrices rounds the prices of the sell OCO order request to their
+// tick size, and moves the take profit above the ask and the stop below the
+// bid, since Alpaca rejects prices inside the spread. The prices are moved a
+// further widen ticks away from the market, for orders placed again after a
+// rejection. The stop limit keeps its distance below the stop. The
+// adjustments made are logged.
+func (c *client) adjustOCOPrices(req *alpaca.PlaceOrderRequest, widen int) {
+	takeProfit := roundToTick(*req.TakeProfit.LimitPrice, true)
+	stop := roundToTick(*req.StopLoss.StopPrice, false)
+	if q, err := c.latestQuote(); err != nil {
+		log.Printf("unable to check the sell order prices against the quote, only rounding them: %v", err)
+	} else {
+		if min := q.ask.Add(tickSize(q.ask)); takeProfit.LessThan(min) {
+			takeProfit = roundToTick(min, true)
+		}
+		if max := q.bid.Sub(tickSize(q.bid)); stop.GreaterThan(max) {
+			stop = roundToTick(max, false)
+		}
+	}
+	if widen > 0 {
+		takeProfit = takeProfit.Add(tickSize(takeProfit).Mul(decimal.NewFromInt(int64(widen))))
+		stop = stop.Sub(tickSize(stop).Mul(decimal.NewFromInt(int64(widen))))
+	}
+
+	var changes []string
+	if !takeProfit.Equal(*req.TakeProfit.LimitPrice) {
+		changes = append(changes, fmt.Sprintf("take profit $%v to $%v", req.TakeProfit.LimitPrice, takeProfit))
+	}
+	if !stop.Equal(*req.StopLoss.StopPrice) {
+		changes = append(changes, fmt.Sprintf("stop $%v to $%v", req.StopLoss.StopPrice, stop))
+	}
+	if req.StopLoss.LimitPrice != nil {
+		limit := roundToTick(stop.Sub(req.StopLoss.StopPrice.Sub(*req.StopLoss.LimitPrice)), false)
+		if !limit.Equal(*req.StopLoss.LimitPrice) {
+			changes = append(changes, fmt.Sprintf("stop limit $%v to $%v", req.StopLoss.LimitPrice, limit))
+		}
+		req.StopLoss.LimitPrice = &limit
+	}
+	req.TakeProfit.LimitPrice = &takeProfit
+	req.StopLoss.StopPrice = &stop
+	if len(changes) > 0 {
+		log.Printf("adjusted the sell order prices of %v: %v", c.stockSymbol, strings.Join(changes, ", "))
+	}
+}
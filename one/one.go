@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
@@ -13,79 +17,280 @@ import (
 	"github.com/ejbrever/trader/one/database"
 	"github.com/ejbrever/trader/one/purchase"
 	"github.com/shopspring/decimal"
+	"github.com/trader/indicators"
 )
 
 var (
 	apiEndpoint                 = flag.String("api_endpoint", "https://paper-api.alpaca.markets", "The REST API endpoint for Alpaca.")
 	apiKeyID                    = flag.String("api_key_id", "", "The Alpaca API Key ID.")
 	apiSecretKey                = flag.String("api_secret_key", "", "The Alpaca API Secret Key.")
+	databaseName                = flag.String("db_name", "one", "The name of the MySQL database purchases are stored in.")
+	instanceName                = flag.String("instance", database.DefaultInstance, "The name of this trader instance. Instances sharing a database, e.g. on different machines or with different strategies, each read and store only their own purchases, heartbeats, paper days and blocked signals. Bars are shared.")
 	durationBetweenAction       = flag.Duration("duration_between_action", 30*time.Second, "The time between each attempt to buy or sell.")
 	durationToRun               = flag.Duration("duration_to_run", 10*time.Second, "The time that the job should run.")
 	maxConcurrentPurchases      = flag.Int("max_concurrent_purchases", 0, "The maximum number of allowed purchases at a given time.")
 	purchaseQty                 = flag.Float64("purchase_quanity", 0, "Quantity of shares to purchase with each buy order.")
+	sizeDownToBuyingPower       = flag.Bool("size_down_to_buying_power", true, "If true, buy orders are reduced to the quantity the account can afford. Otherwise buys which cannot be afforded in full are skipped.")
 	stockSymbol                 = flag.String("stock_symbol", "", "The stock to buy an sell.")
-	timeBeforeMarketCloseToSell = flag.Duration("time_before_market_close_to_sell", 1*time.Hour, "The time before market close that all positions should be closed out.")
+	timeBeforeMarketCloseToSell = flag.Duration("time_before_market_close_to_sell", 1*time.Hour, "The time before market close that all positions should be closed out. flat_by and a symbol override in the config file can set it per symbol or strategy.")
 	numHistoricalBarsToUse      = flag.Int("num_historical_bars_to_use", 3, "The number of historical bars to request when determining if now is a buy event.")
+	barTimeframe                = flag.String("bar_timeframe", "1Min", "The timeframe of the bars used to determine buy events, one of 1Min, 5Min, 15Min or 1D.")
+	barLookback                 = flag.Duration("bar_lookback", 0, "How far back bars are requested when determining if now is a buy event. Defaults to num_historical_bars_to_use bars of bar_timeframe. A longer lookback still finds enough bars when some are missing, e.g. minutes without trades.")
 	allSequentialIncreasesToBuy = flag.Bool("all_sequential_increases_to_buy", false, "If true, all historical bars must increase sequentially to initiate a buy event.")
 	minSlopeRequiredToBuy       = flag.Float64("min_slope_required_to_buy", 1.3, "The minumun slope of the trend line required to initiate a buy event.")
+	port                        = flag.String("port", "", "The port for the status webserver. Defaults to the PORT env variable, or 8081 if unset.")
+	persistBars                 = flag.Bool("persist_bars", true, "If true, the bars used for each buy signal evaluation are stored in the database so decisions can be audited later.")
+	strategyName                = flag.String("strategy", "slope", "The name of the strategy. It is recorded on every purchase so purchases from concurrently running strategies can be told apart.")
+	retryFailedEntries          = flag.Bool("retry_failed_entries", false, "If true, a buy order which is rejected or cancelled by anything other than the trader is retried once.")
+	bindAddress                 = flag.String("bind_address", "", "The address for the status webserver to bind to. Binds to all addresses when empty.")
+	bookkeepingTimezone         = flag.String("bookkeeping_timezone", "America/New_York", "The timezone whose midnight starts a new day for bookkeeping, e.g. which purchases are today's, daily summaries and daily limits. Defaults to exchange time.")
 )
 
+const (
+	// heartbeatName is the name used when reporting heartbeats.
+	heartbeatName = "trader-one"
+
+	// maxReplacements is the most replacements of an order which are followed,
+	// in case the replacements loop.
+	maxReplacements = 20
+)
+
+// dailyTimeframe is the timeframe of bars which each span a trading session.
+const dailyTimeframe = "1D"
+
+// timeframes are the supported bar timeframes and their durations.
+var timeframes = map[string]time.Duration{
+	"1Min":         time.Minute,
+	"5Min":         5 * time.Minute,
+	"15Min":        15 * time.Minute,
+	dailyTimeframe: 24 * time.Hour,
+}
+
 var (
 	// EST is the timezone for Eastern time.
 	EST *time.Location
 
-	// PST is the timezone for Pacific time.
-	PST *time.Location
+	// BookkeepingTZ is the timezone of the day boundary used for bookkeeping.
+	BookkeepingTZ *time.Location
 
 	// Is trading currently allowed by the algorithm?
 	trading bool
 )
 
 type client struct {
-	concurrentPurchases int
-	alpacaClient        *alpaca.Client
-	dbClient            database.Client // This is an interface.
-	purchases           []*purchase.Purchase
-	stockSymbol         string
+	cfg          ClientConfig
+	alpacaClient *alpaca.Client
+	dbClient     database.Client // This is an interface.
+	purchases    []*purchase.Purchase
+	stockSymbol  string
+	strategy     string
+	experiment   *experiment // Only set when running an A/B experiment.
+
+	// retired is true when the symbol was removed from the watchlist. Open
+	// purchases are still sold, but no new purchases are made.
+	retired bool
+
+	// lastSlope is the slope of the latest evaluated bars.
+	lastSlope float64
+
+	// orders are the orders waiting to be placed by the execution engine.
+	orders *executionQueue
+
+	// shard runs the client's work. It is nil in backtests.
+	shard *shard
+
+	// breaker stops new purchases after a drawdown. Live clients share the
+	// breaker of the account, and each backtest run has its own.
+	breaker *drawdownBreaker
+
+	// ordersPolledAt is when the in-progress orders were last requested
+	// while their updates are streamed.
+	ordersPolledAt time.Time
+
+	// lastExternalReason is the reason given by the external strategy for its
+	// latest decision, or the latest signal of the signal source.
+	lastExternalReason string
+
+	// lastSignal is the time of the latest signal of the signal source which
+	// was evaluated.
+	lastSignal time.Time
+
+	// state is the memory of the strategy, and savedState is the state as it
+	// was last stored. state is nil for strategies which keep none.
+	state      strategyState
+	savedState []byte
+
+	// closedOutFor is the market close the client was closed out early for,
+	// since its close out deadline is earlier than another client's.
+	closedOutFor time.Time
+
+	// barEvaluated is the start of the latest streamed bar a buy signal was
+	// evaluated with, in Unix seconds.
+	barEvaluated int64
+
+	// flattenedFor are the times of the macro events the client has already
+	// flattened before.
+	flattenedFor map[time.Time]bool
+
+	// ocoRejected is true once Alpaca rejected an OCO sell order, after which
+	// sells are emulated when oco_emulation is auto.
+	ocoRejected bool
+
+	// shadow is true when orders are simulated locally instead of placed.
+	shadow        bool
+	shadowOrderID int
 
 	// The following struct items are relevant when running backtests.
 	backtestHistory          *history
 	backtestClock            *fakeClock
 	backtestOrderID          int
+	backtestLatencyRand      *rand.Rand // The source of the simulated broker latency.
+	backtestTrades           int
 	backtestStockHeldQty     decimal.Decimal
 	backtestCash             decimal.Decimal
 	backtestCashStart        decimal.Decimal
 	backtestCashStartOfDay   decimal.Decimal
 	backtestSymbolEndOfDay   decimal.Decimal
 	backtestSymbolStartOfDay decimal.Decimal
+	backtestLastClose        time.Time
+	backtestMarginInterest   decimal.Decimal
+	backtestCashInterest     decimal.Decimal
+	backtestShortBorrowFees  decimal.Decimal
+	backtestSlippage         decimal.Decimal
+	backtestCommissions      decimal.Decimal
+	backtestSold             []*purchase.Purchase // Purchases sold on previous days.
+	backtestUnprotected      int                  // Minutes purchases were held without a sell order.
+	backtestTrading          bool                 // Whether the simulated market is open for trading.
+	backtestRestarts         []time.Time          // The times of the restarts still to simulate.
+	backtestTradeLog         []backtestTrade      // The trades of backtest_output_json.
+	backtestEquityCurve      []equityPoint        // The equity curve of backtest_output_json.
+	backtestBenchmarkStart   decimal.Decimal      // The price of the benchmark at the start.
+	backtestBenchmarkClose   decimal.Decimal      // The price of the benchmark at the last close.
+	backtestEquityClose      decimal.Decimal      // The equity at the last close.
+	backtestDayReturns       []dayReturn          // The daily returns compared with the benchmark.
+	backtestMaxVolumeShare   decimal.Decimal      // The largest buy as a percentage of the average bar volume.
+	backtestTerminated       string               // Why the backtest stopped early, if it did.
+	backtestStopPrice        decimal.Decimal      // The price of the symbol when the backtest stopped early.
+	backtestStopAt           time.Time            // When the backtest stops, or zero to run to the end of the history.
+
+	// backtestParticipated is the quantity filled in the minute starting at
+	// backtestParticipationMinute, in Unix seconds.
+	backtestParticipated        decimal.Decimal
+	backtestParticipationMinute int64
+}
+
+// strategyParams are the tunables which determine when to buy, and how to
+// sell.
+type strategyParams struct {
+	numHistoricalBars      int
+	allSequentialIncreases bool
+	minSlope               float64
+	sellMode               string
+	trailingStopPercent    float64
+	minSignalStreak        int
+}
+
+// flagStrategyParams returns the strategy params set by flags.
+func flagStrategyParams() strategyParams {
+	return strategyParams{
+		numHistoricalBars:      *numHistoricalBarsToUse,
+		allSequentialIncreases: *allSequentialIncreasesToBuy,
+		minSlope:               *minSlopeRequiredToBuy,
+		sellMode:               *sellMode,
+		trailingStopPercent:    *trailingStopPercent,
+		minSignalStreak:        *minSignalStreak,
+	}
 }
 
-func new(stockSymbol string, concurrentPurchases int) (*client, error) {
+func new(stockSymbol, strategy string, cfg ClientConfig) (*client, error) {
 	var purchases []*purchase.Purchase
 	var alpacaClient *alpaca.Client
 	var db database.Client
 	var err error
+	if cfg, err = cfg.forSymbol(stockSymbol); err != nil {
+		return nil, err
+	}
+	cfg.TimeBeforeMarketCloseToSell = cfg.timeBeforeMarketCloseToSell(stockSymbol, strategy)
+	// Watch-only clients simulate their orders as shadow strategies do.
+	if cfg.WatchOnly {
+		if cfg.Backtest {
+			return nil, fmt.Errorf("watch_only cannot be run as a backtest")
+		}
+		strategy += watchStrategySuffix
+	}
 	switch {
-	case *runBacktest:
+	case cfg.Backtest:
 		db, _ = database.NewFake()
 	default:
 		alpacaClient = alpaca.NewClient(common.Credentials())
-		db, err = database.New()
+		db, err = database.NewInstance(cfg.DatabaseName, cfg.Instance)
 		if err != nil {
 			return nil, fmt.Errorf("unable to open db: %v", err)
 		}
-		purchases, err = db.Purchases(time.Now().In(PST).YearDay(), PST)
+		if purchases, err = loadPurchases(db, strategy, stockSymbol, cfg, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	c := &client{
+		cfg:          cfg,
+		alpacaClient: alpacaClient,
+		dbClient:     db,
+		purchases:    purchases,
+		stockSymbol:  stockSymbol,
+		strategy:     strategy,
+		shadow:       cfg.WatchOnly,
+		orders:       newExecutionQueue(),
+		breaker:      breaker,
+		// Signals from before the start are not acted on, since they may
+		// have been acted on before a restart.
+		lastSignal: time.Now(),
+	}
+	c.restoreStrategyState()
+	return c, nil
+}
+
+// loadPurchases returns the strategy's purchases of the symbol made on the
+// day of now, after those held overnight when hold_overnight is set. Buys
+// which ended without filling are left out, since the client dropped them
+// once they ended and must not retry them again.
+func loadPurchases(db database.Client, strategy, stockSymbol string, cfg ClientConfig, now time.Time) ([]*purchase.Purchase, error) {
+	now = now.In(BookkeepingTZ)
+	allPurchases, err := db.Purchases(now.YearDay(), BookkeepingTZ)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get all purchases: %v", err)
+	}
+	var purchases []*purchase.Purchase
+	// Purchases made by other strategies or of other symbols are managed
+	// by their own clients.
+	for _, p := range allPurchases {
+		if p.Strategy != strategy || p.BuyOrder == nil || p.BuyOrder.Symbol != stockSymbol {
+			continue
+		}
+		if p.BuyEndedUnsuccessfully() && !p.BuyOrder.FilledQty.IsPositive() {
+			continue
+		}
+		purchases = append(purchases, p)
+	}
+	if cfg.HoldOvernight {
+		held, err := purchasesHeldOvernight(db, strategy, stockSymbol, now)
 		if err != nil {
-			return nil, fmt.Errorf("unable to get all purchases: %v", err)
+			return nil, err
 		}
+		purchases = append(held, purchases...)
+	}
+	return purchases, nil
+}
+
+// isTrading returns true if trading is currently allowed by the algorithm.
+// Each backtest client simulates its own market.
+func (c *client) isTrading() bool {
+	if c.cfg.Backtest {
+		return c.backtestTrading
 	}
-	return &client{
-		concurrentPurchases: concurrentPurchases,
-		alpacaClient:        alpacaClient,
-		dbClient:            db,
-		purchases:           purchases,
-		stockSymbol:         stockSymbol,
-	}, nil
+	// A client which closed out before the others stops trading until the
+	// market closes. The kill switch stops new purchases at once, before the
+	// main loop next sets trading.
+	return trading && !kill.isEngaged() && !c.closedOutFor.After(time.Now())
 }
 
 // boughtNotSelling returns a slice of purchases that have been bought and
@@ -148,21 +353,44 @@ func (c *client) inProgressSellOrders() []*purchase.Purchase {
 
 func (c *client) run(t time.Time) {
 	c.cancelOutdatedOrders()
-	c.buy(t)
+	c.flattenForMacro(t)
+	// Filled buys are protected before new buys are made, since orders are
+	// placed in the order they are queued when throttled.
 	c.sell()
+	c.buy(t)
+	if c.cfg.Backtest {
+		c.drainOrders(t)
+	}
+	c.tightenStops()
+	c.trailStops()
 }
 
 // cancelOutdatedOrders cancels all buy orders that have been outstanding for
 // more than 5 mins.
 func (c *client) cancelOutdatedOrders() {
 	now := time.Now()
-	if *runBacktest {
+	if c.cfg.Backtest {
 		now = c.backtestClock.Now
-		// TODO(ejbrever) Implement the cancel order fake.
+	}
+	if c.cfg.EntryOrderType == "limit" {
+		c.handleStaleLimitEntries(now)
+	}
+	if c.shadow {
+		// Shadow market buy orders are filled immediately.
 		return
 	}
 	for _, o := range c.inProgressBuyOrders() {
+		// TWAP buys are spread over twap_duration, and their child orders are
+		// market orders.
+		if isTWAP(o.BuyOrder) {
+			continue
+		}
 		if now.Sub(o.BuyOrder.CreatedAt) > 5*time.Minute {
+			o.CanceledByTrader = true
+			if c.cfg.Backtest {
+				c.fakeCancelOrder(o.BuyOrder)
+				continue
+			}
 			if err := c.alpacaClient.CancelOrder(o.BuyOrder.ID); err != nil {
 				log.Printf("unable to cancel %q: %v", o.BuyOrder.ID, err)
 			}
@@ -170,41 +398,41 @@ func (c *client) cancelOutdatedOrders() {
 	}
 }
 
-// sell initiates sell orders for all needed purchases.
+// sell queues sell orders for all needed purchases.
 func (c *client) sell() {
 	boughtNotSelling := c.boughtNotSelling()
 	if len(boughtNotSelling) == 0 {
 		return
 	}
 	for _, p := range boughtNotSelling {
-		c.placeSellOrder(p)
+		c.enqueue(&orderIntent{priority: priorityProtect, purchase: p})
 	}
 }
 
-func (c *client) placeSellOrder(p *purchase.Purchase) {
+// placeSellOrder places the bracket sell order of the purchase. It returns
+// false if the order could not be placed.
+func (c *client) placeSellOrder(p *purchase.Purchase) bool {
 	// TODO(ejbrever) for debugging, remove this.
 	log.Printf("BuyOrder before p.BuyFilledAvgPriceFloat: %+v", p.BuyOrder)
 	basePrice := float64(p.BuyFilledAvgPriceFloat())
 	if basePrice == 0 {
 		log.Printf(
 			"filledAvgPrice cannot be 0 for order:\nBuyOrder: %+v\n", p.BuyOrder)
-		return
+		return false
 	}
-	// Take a profit as soon as 0.2% profit can be achieved.
-	profitLimitPrice := decimal.NewFromFloat(basePrice * 1.002)
-	// Sell is 0.12% lower than base price (i.e. AvgFillPrice).
-	stopPrice := decimal.NewFromFloat(basePrice - basePrice*.0012)
-	// Set a limit on the sell price at 0.17% lower than the base price.
-	lossLimitPrice := decimal.NewFromFloat(basePrice - basePrice*.0017)
+	if c.cfg.Params.sellMode != sellModeOCO {
+		return c.placeTrailingStop(p, decimal.NewFromFloat(basePrice))
+	}
+	profitLimitPrice, stopPrice, lossLimitPrice := ocoSellPrices(basePrice, p.TakeProfitPercent)
 
-	var err error
 	req := &alpaca.PlaceOrderRequest{
-		Side:        alpaca.Sell,
-		AssetKey:    &c.stockSymbol,
-		Type:        alpaca.Limit,
-		Qty:         decimal.NewFromFloat(*purchaseQty),
-		TimeInForce: alpaca.GTC,
-		OrderClass:  alpaca.Oco,
+		Side:          alpaca.Sell,
+		AssetKey:      &c.stockSymbol,
+		Type:          alpaca.Limit,
+		Qty:           p.BuyOrder.FilledQty,
+		TimeInForce:   alpaca.GTC,
+		OrderClass:    alpaca.Oco,
+		ClientOrderID: c.sellClientOrderID(p),
 		TakeProfit: &alpaca.TakeProfit{
 			LimitPrice: &profitLimitPrice,
 		},
@@ -213,49 +441,155 @@ func (c *client) placeSellOrder(p *purchase.Purchase) {
 			LimitPrice: &lossLimitPrice,
 		},
 	}
-	if *runBacktest {
+	c.adjustOCOPrices(req, 0)
+	profitLimitPrice, stopPrice = *req.TakeProfit.LimitPrice, *req.StopLoss.StopPrice
+	if c.emulatingOCO() {
+		return c.placeSyntheticOCO(p, req)
+	}
+	if c.cfg.Backtest {
+		if c.cfg.BacktestRejectOCO {
+			return c.fallBackToSyntheticOCO(p, req, &alpaca.APIError{Code: 42210000, Message: "order class oco is not supported"})
+		}
+		previous := p.SellOrder
 		c.fakePlaceSellOrder(p, req)
-		return
+		if p.SellOrder == previous {
+			return false
+		}
+		c.narrateEntry(p, profitLimitPrice, stopPrice)
+		return true
+	}
+	place := func() (*alpaca.Order, error) {
+		if c.shadow {
+			return c.shadowPlaceOrder(req)
+		}
+		return c.placeOrder(req)
 	}
-	sellOrder, err := c.alpacaClient.PlaceOrder(*req)
+	sellOrder, err := place()
+	if err != nil && rejectsOCO(err) {
+		return c.fallBackToSyntheticOCO(p, req, err)
+	}
+	// Rather than leaving the purchase unprotected until the next tick, the
+	// order is placed again with its prices moved away from the market.
+	clientOrderID := req.ClientOrderID
+	for attempt := 1; err != nil && rejectsOrderPrices(err) && attempt <= c.cfg.OCOReplaceAttempts; attempt++ {
+		log.Printf("sell order rejected for its prices, placing it again (attempt %v of %v): %v", attempt, c.cfg.OCOReplaceAttempts, err)
+		c.adjustOCOPrices(req, attempt)
+		req.ClientOrderID = fmt.Sprintf("%v-r%d", clientOrderID, attempt)
+		sellOrder, err = place()
+	}
+	profitLimitPrice, stopPrice = *req.TakeProfit.LimitPrice, *req.StopLoss.StopPrice
 	if err != nil {
 		log.Printf("unable to place sell order: %v\npurchase:\nbuy:%+v\nsell:%+v\n",
 			err, p.BuyOrder, p.SellOrder)
-		return
+		return false
 	}
 	p.SellOrder = sellOrder
 	log.Printf("sell order placed:\n%+v\n", p.SellOrder)
+	c.narrateEntry(p, profitLimitPrice, stopPrice)
 
 	if err := c.dbClient.Update(p); err != nil {
 		log.Printf("unable to update for sell order:%v\n%+v", err, p)
 	}
+	return true
+}
+
+// ocoSellPrices returns the take profit limit, the stop and the stop limit of
+// the bracket which sells shares bought at basePrice. takeProfit is the take
+// profit percentage chosen at entry, or nil for the flat take profit.
+func ocoSellPrices(basePrice float64, takeProfit *decimal.Decimal) (profitLimitPrice, stopPrice, lossLimitPrice decimal.Decimal) {
+	// Take a profit as soon as 0.2% profit can be achieved, unless a take
+	// profit was chosen at entry.
+	profitLimitPrice = decimal.NewFromFloat(basePrice * 1.002)
+	if takeProfit != nil {
+		profitLimitPrice = decimal.NewFromFloat(basePrice).Mul(decimal.NewFromInt(1).Add(takeProfit.Div(decimal.NewFromInt(100))))
+	}
+	// Sell is 0.12% lower than base price (i.e. AvgFillPrice).
+	stopPrice = decimal.NewFromFloat(basePrice - basePrice*.0012)
+	// Set a limit on the sell price at 0.17% lower than the base price.
+	lossLimitPrice = decimal.NewFromFloat(basePrice - basePrice*.0017)
+	return profitLimitPrice, stopPrice, lossLimitPrice
 }
 
 // Buy side: Look at most recent three 1 minute bars. If positive direction, buy.
 func (c *client) buy(t time.Time) {
-	if len(c.inProgressPurchases()) >= c.concurrentPurchases {
-		log.Printf("allowable purchases used @ %v\n", t)
+	if c.retired {
+		return
+	}
+	if c.experiment != nil && !c.experiment.hasTurn(c.strategy) {
+		return
+	}
+	block := c.entryBlocked(t)
+	if block != nil {
+		log.Printf("not buying, blocked by %v: %v @ %v", block.rule, block.detail, t)
+		// The external strategy and signal source are still asked, since
+		// they may decide to sell.
+		if !c.cfg.RecordBlockedSignals && external == nil && signals == nil {
+			return
+		}
+	}
+	bars, ok := c.buyEvent(t)
+	c.saveStrategyState()
+	if !ok {
+		return
+	}
+	if block != nil {
+		c.recordBlockedSignal(t, bars[len(bars)-1].Close, block)
 		return
 	}
-	if !c.buyEvent(t) {
+	if block = c.volatilityBlock(bars); block != nil {
+		log.Printf("not buying, blocked by %v: %v @ %v", block.rule, block.detail, t)
+		c.recordBlockedSignal(t, bars[len(bars)-1].Close, block)
 		return
 	}
-	c.placeBuyOrder()
+	if block = c.indicatorBlock(bars); block != nil {
+		log.Printf("not buying, blocked by %v: %v @ %v", block.rule, block.detail, t)
+		c.recordBlockedSignal(t, bars[len(bars)-1].Close, block)
+		return
+	}
+	if block = c.dataCheckBlock(t, bars); block != nil {
+		log.Printf("not buying, blocked by %v: %v @ %v", block.rule, block.detail, t)
+		c.recordBlockedSignal(t, bars[len(bars)-1].Close, block)
+		return
+	}
+	qty, block := c.buyQty(bars)
+	if block != nil {
+		c.recordBlockedSignal(t, bars[len(bars)-1].Close, block)
+		return
+	}
+	c.publishSignal(t, bars[len(bars)-1].Close, "buy", c.entryReason())
+	c.enqueue(&orderIntent{
+		priority: priorityBuy,
+		bars:     bars,
+		qty:      qty,
+		signal:   t,
+		reason:   c.entryReason(),
+	})
 }
 
-// buyEvent determines if this time is a buy event.
-func (c *client) buyEvent(t time.Time) bool {
-	limit := *numHistoricalBarsToUse
+// buyEvent determines if this time is a buy event. The bars used to make the
+// decision are returned.
+func (c *client) buyEvent(t time.Time) ([]alpaca.Bar, bool) {
+	limit := c.cfg.Params.numHistoricalBars
 	endDt := time.Now()
-	startDt := endDt.Add(time.Duration(-1**numHistoricalBarsToUse) * time.Minute)
+	startDt := endDt.Add(-c.cfg.lookback())
 	var bars []alpaca.Bar
 	var err error
+	var streamed bool
+	if f := symbolBarFeed(c.stockSymbol); f != nil && c.cfg.BarTimeframe == feedTimeframe {
+		bars, streamed = f.recent(limit, endDt)
+	}
 	switch {
-	case *runBacktest:
+	case c.cfg.Backtest:
 		bars = c.fakeGetSymbolBars()
+	case streamed:
+		// The streamed bars are fresh, so there is no need to request them.
+		if c.evaluatedBar(bars) {
+			log.Printf("buy signal already evaluated for the bar @ %v", time.Unix(bars[len(bars)-1].Time, 0))
+			return nil, false
+		}
 	default:
 		bars, err = c.alpacaClient.GetSymbolBars(c.stockSymbol, alpaca.ListBarParams{
-			Timeframe: "1Min",
+			Timeframe: c.cfg.BarTimeframe,
 			StartDt:   &startDt,
 			EndDt:     &endDt,
 			Limit:     &limit,
@@ -263,42 +597,47 @@ func (c *client) buyEvent(t time.Time) bool {
 	}
 	if err != nil {
 		log.Printf("GetSymbolBars err @ %v: %v\n", t, err)
-		return false
+		return nil, false
+	}
+	if c.cfg.PersistBars && !c.cfg.Backtest {
+		c.storeBars(bars, t)
 	}
-	if len(bars) < *numHistoricalBarsToUse {
+	currentSession.signalEvaluated()
+	if len(bars) < c.cfg.Params.numHistoricalBars {
 		log.Printf(
 			"did not return at least %v bars, so cannot proceed @ %v\ngot: %+v",
-			*numHistoricalBarsToUse,
+			c.cfg.Params.numHistoricalBars,
 			t,
 			bars,
 		)
-		return false
+		return nil, false
 	}
-	var a *alpaca.Account
-	switch {
-	case *runBacktest:
-		a = c.fakeGetAccount()
-	default:
-		a, err = c.alpacaClient.GetAccount()
-		if err != nil {
-			log.Printf("unable to get account details to check for needed cash: %v", err)
-			return false
+	if external != nil {
+		if !c.externalDecision(t, bars) {
+			return nil, false
 		}
+		return bars, true
 	}
-	// neededCash is the amount of money needed to perform a purchase, with an
-	// extra 20% buffer.
-	neededCash := bars[0].Close * float32(*purchaseQty) * 1.2
-	if a.Cash.LessThan(decimal.NewFromFloat32(neededCash)) {
-		log.Printf("not enough cash to perform a trade, have %%%v, need %%%v", a.Cash, neededCash)
-		return false
+	if signals != nil {
+		if !c.signalDecision(t) {
+			return nil, false
+		}
+		return bars, true
+	}
+	if !c.signalStreakHeld(bars, c.slopeSignal(bars)) {
+		return nil, false
 	}
+	return bars, true
+}
 
+// slopeSignal returns true if the slope strategy signals a buy on the bars.
+func (c *client) slopeSignal(bars []alpaca.Bar) bool {
 	if !c.barsImprovementSlope(bars) {
 		log.Printf("slope did not meet requirements")
 		return false
 	}
 
-	if *allSequentialIncreasesToBuy && !c.allPositiveImprovements(bars) {
+	if c.cfg.Params.allSequentialIncreases && !c.allPositiveImprovements(bars) {
 		log.Printf("non-positive improvements")
 		return false
 	}
@@ -326,45 +665,121 @@ func (c *client) barsImprovementSlope(bars []alpaca.Bar) bool {
 		return false
 	}
 
-	var sumX, sumY, sumX2, sumXY float64
-	for xInt, bar := range bars {
-		x := float64(xInt)
-		y := float64(bar.Close)
-		sumX += x
-		sumY += y
-		sumX2 += x * x
-		sumXY += x * y
+	m, ok := indicators.LeastSquaresSlope(bars)
+	if !ok {
+		return false
 	}
-	n := float64(len(bars))
-	m := (n*sumXY - sumX*sumY) / (n*sumX2 - sumX*sumX)
 	log.Printf("slope: %.2f", m)
-	return m >= *minSlopeRequiredToBuy
+	c.lastSlope = m
+	return m >= c.cfg.Params.minSlope
 }
 
-func (c *client) placeBuyOrder() {
+// buyQty returns the quantity to buy at the latest close of the bars, sized by
+// positionSize. The quantity is reduced to what the cash and buying power of
+// the account allow, so the order is not rejected. The rule blocking the buy
+// is returned if it should be skipped.
+func (c *client) buyQty(bars []alpaca.Bar) (decimal.Decimal, *entryBlock) {
+	price := bars[len(bars)-1].Close
+	var a *alpaca.Account
+	switch {
+	case c.cfg.Backtest:
+		a = c.fakeGetAccount()
+	default:
+		var err error
+		a, err = c.alpacaClient.GetAccount()
+		if err != nil {
+			log.Printf("unable to get account details to check for needed cash: %v", err)
+			return decimal.Zero, &entryBlock{ruleAccountUnavailable, err.Error()}
+		}
+	}
+	available := a.Cash
+	if a.RegTBuyingPower.LessThan(available) {
+		available = a.RegTBuyingPower
+	}
+	rule := ruleBuyingPower
+	// Every trade is a day trade, which pattern day traders are limited to
+	// their day trading buying power for.
+	if a.PatternDayTrader && a.DaytradingBuyingPower.LessThan(available) {
+		available = a.DaytradingBuyingPower
+		rule = rulePatternDayTrader
+	}
+
+	want, block := c.positionSize(a, bars)
+	if block != nil {
+		log.Printf("not buying, %v", block.detail)
+		return decimal.Zero, block
+	}
+	// neededCash is the amount of money needed per share, with an extra 20%
+	// buffer.
+	neededCash := decimal.NewFromFloat32(price * 1.2)
+	if !available.LessThan(want.Mul(neededCash)) {
+		return want, nil
+	}
+	affordable := available.Div(neededCash).Floor()
+	if !c.cfg.SizeDownToBuyingPower || !affordable.IsPositive() {
+		log.Printf("not enough buying power to perform a trade, have $%v (cash $%v, reg T $%v, day trading $%v), need $%v",
+			available, a.Cash, a.RegTBuyingPower, a.DaytradingBuyingPower, want.Mul(neededCash).StringFixed(2))
+		return decimal.Zero, &entryBlock{rule, fmt.Sprintf("have $%v, need $%v", available, want.Mul(neededCash).StringFixed(2))}
+	}
+	log.Printf("sizing buy down from %v to %v shares to fit buying power of $%v", want, affordable, available)
+	return affordable, nil
+}
+
+// placeBuyOrder places the buy order of the buy signal at t. nil is returned
+// if the order could not be placed.
+func (c *client) placeBuyOrder(bars []alpaca.Bar, qty decimal.Decimal, t time.Time) *purchase.Purchase {
 	req := &alpaca.PlaceOrderRequest{
-		AccountID:   "",
-		AssetKey:    &c.stockSymbol,
-		Qty:         decimal.NewFromFloat(*purchaseQty),
-		Side:        alpaca.Buy,
-		Type:        alpaca.Market,
-		TimeInForce: alpaca.Day,
+		AccountID:     "",
+		AssetKey:      &c.stockSymbol,
+		Qty:           qty,
+		Side:          alpaca.Buy,
+		Type:          alpaca.Market,
+		TimeInForce:   alpaca.Day,
+		ClientOrderID: c.buyClientOrderID(t),
+	}
+	if c.cfg.EntryOrderType == "limit" {
+		if err := c.limitEntryRequest(req, bars); err != nil {
+			log.Printf("unable to price limit buy order: %v", err)
+			return nil
+		}
 	}
+	takeProfit := c.takeProfitPercent(bars)
+	if c.useTWAP(req) {
+		return c.startTWAP(req, takeProfit)
+	}
+	if c.bracketing() {
+		c.bracketRequest(req, bars, takeProfit)
+	}
+	return c.submitBuyOrder(req, takeProfit)
+}
+
+// submitBuyOrder places the buy order and stores the new purchase with its
+// take profit percentage, which is nil for the flat take profit. nil is
+// returned if the order could not be placed.
+func (c *client) submitBuyOrder(req *alpaca.PlaceOrderRequest, takeProfit *decimal.Decimal) *purchase.Purchase {
 	var err error
 	var o *alpaca.Order
 	switch {
-	case *runBacktest:
-		c.fakePlaceBuyOrder(req)
-		return
+	case c.cfg.Backtest:
+		return c.fakePlaceBuyOrder(req, takeProfit)
+	case c.shadow:
+		o, err = c.shadowPlaceOrder(req)
+		if err != nil {
+			log.Printf("unable to place shadow buy order: %v", err)
+			return nil
+		}
 	default:
-		o, err = c.alpacaClient.PlaceOrder(*req)
+		o, err = c.placeOrder(req)
 		if err != nil {
 			log.Printf("unable to place buy order: %v", err)
-			return
+			return nil
 		}
 	}
 	p := &purchase.Purchase{
-		BuyOrder: o,
+		BuyOrder:          o,
+		Strategy:          c.strategy,
+		Shadow:            c.shadow,
+		TakeProfitPercent: takeProfit,
 	}
 	c.purchases = append(c.purchases, p)
 	log.Printf("buy order placed:\n%+v", o)
@@ -372,98 +787,307 @@ func (c *client) placeBuyOrder() {
 	if err := c.dbClient.Insert(p); err != nil {
 		log.Printf("unable to insert buy order in database: %v", err)
 	}
+	return p
+}
+
+// endFailedEntries removes purchases whose buy order ended without any fill,
+// which frees their concurrency slot. The final state of the order has
+// already been stored by updateOrders. Failed entries are retried once when
+// retry_failed_entries is set.
+func (c *client) endFailedEntries() {
+	var kept, failed []*purchase.Purchase
+	for _, p := range c.purchases {
+		if !p.BuyEndedUnsuccessfully() || p.BuyOrder.FilledQty.IsPositive() {
+			kept = append(kept, p)
+			continue
+		}
+		log.Printf("buy order %q of purchase %d ended with status %q", p.BuyOrder.ID, p.ID, p.BuyOrder.Status)
+		c.narrate(c.now(), "buy of %v %v was %v", p.BuyOrder.Qty, c.stockSymbol, p.BuyOrder.Status)
+		failed = append(failed, p)
+	}
+	c.purchases = kept
+
+	for _, p := range failed {
+		if !c.cfg.RetryFailedEntries || p.EntryRetry || p.CanceledByTrader || !c.isTrading() {
+			continue
+		}
+		if len(p.EntryBars) == 0 {
+			log.Printf("not retrying failed buy order %q, the bars of its buy signal are not known", p.BuyOrder.ID)
+			continue
+		}
+		now := c.now()
+		if block := c.entryBlocked(now); block != nil {
+			log.Printf("not retrying failed buy order %q, blocked by %v: %v", p.BuyOrder.ID, block.rule, block.detail)
+			continue
+		}
+		log.Printf("retrying failed buy order %q", p.BuyOrder.ID)
+		// The retry is placed by the execution engine like any other buy, so
+		// it is throttled and gets the entry order type, TWAP and bracket.
+		c.enqueue(&orderIntent{
+			priority: priorityBuy,
+			bars:     p.EntryBars,
+			qty:      p.BuyOrder.Qty,
+			signal:   now,
+			reason:   p.EntryReason,
+			retryOf:  p,
+		})
+	}
 }
 
 // closeOutTrading closes out all trading for the day.
 func (c *client) closeOutTrading() {
-	if *runBacktest {
+	if c.cfg.Backtest {
 		c.fakeCloseOutTrading()
 		return
 	}
+	if c.cfg.HoldOvernight {
+		c.closeOutOvernight(time.Now())
+		log.Printf("My trading is over for a bit, open purchases are held overnight.")
+		c.recordPaperDay(time.Now().In(BookkeepingTZ))
+		return
+	}
+	if c.shadow {
+		c.shadowCloseOutTrading()
+		return
+	}
+	started := time.Now()
 	if err := c.alpacaClient.CancelAllOrders(); err != nil {
 		log.Printf("unable to cancel all orders: %v\n", err)
 	}
 	if err := c.alpacaClient.CloseAllPositions(); err != nil {
 		log.Printf("unable to close all positions: %v\n", err)
 	}
+	flat := c.verifyFlat()
+	c.recordCloseOut(started)
 	log.Printf("My trading is over for a bit and all trading is closed out!")
+	// Until the account is flat the close out orders may not have filled, so
+	// the day would be recorded without their trades.
+	if !flat {
+		log.Printf("not recording the paper day of %v, the close out was not verified", c.configID())
+		return
+	}
+	c.recordPaperDay(time.Now().In(BookkeepingTZ))
 }
 
 // order returns details for a given order. If the order was replaced, it
-// returns details for the new order.
-func (c *client) order(id string) *alpaca.Order {
-	if *runBacktest {
-		return c.fakeOrder(id)
+// returns details for the latest order in the chain of replacements, along
+// with the replacements which were followed.
+func (c *client) order(id string) (*alpaca.Order, []purchase.Replacement) {
+	if c.cfg.Backtest {
+		return c.fakeOrder(id), nil
+	}
+	if c.shadow {
+		return c.shadowOrder(id), nil
 	}
 	order, err := c.alpacaClient.GetOrder(id)
 	if err != nil {
 		log.Printf("GetOrder %q error: %v", id, err)
-		return nil
+		return nil, nil
 	}
 	if order == nil {
-		return nil
+		return nil, nil
 	}
-	if order.ReplacedBy != nil {
-		replacedOrder, err := c.alpacaClient.GetOrder(*order.ReplacedBy)
+	var chain []purchase.Replacement
+	seen := map[string]bool{order.ID: true}
+	for order.ReplacedBy != nil {
+		next := *order.ReplacedBy
+		if seen[next] || len(chain) >= maxReplacements {
+			log.Printf("stopped following replacements of %q at %q after %v replacements", id, order.ID, len(chain))
+			break
+		}
+		seen[next] = true
+		replacedOrder, err := c.alpacaClient.GetOrder(next)
 		if err != nil {
-			log.Printf("Replaced GetOrder %q (original ID: %q) error: %v", *order.ReplacedBy, id, err)
-			return nil
+			log.Printf("Replaced GetOrder %q (original ID: %q) error: %v", next, id, err)
+			return nil, nil
 		}
 		if replacedOrder == nil {
-			return nil
+			return nil, nil
 		}
+		chain = append(chain, purchase.NewReplacement(order, next))
 		order = replacedOrder
 	}
-	return order
+	return order, chain
 }
 
 // updateOrders updates all in progress orders with their latest details.
+// Orders whose updates are streamed are only requested while the stream is
+// disconnected.
 func (c *client) updateOrders() {
+	c.updateOrdersFrom(nil)
+}
+
+// updateOrdersFrom updates all in progress orders from the snapshot, and
+// requests those missing from it.
+func (c *client) updateOrdersFrom(orders orderSnapshot) {
+	poll := c.pollOrders()
 	for _, o := range c.inProgressBuyOrders() {
-		order := c.order(o.BuyOrder.ID)
-		if order == nil {
+		wasFilled := o.BuyFilled()
+		switch {
+		case isTWAP(o.BuyOrder):
+			c.updateTWAP(o.BuyOrder, c.now())
+		case !poll:
 			continue
+		default:
+			order, chain := c.orderFrom(orders, o.BuyOrder.ID)
+			if order == nil {
+				continue
+			}
+			o.BuyOrder = order
+			o.AddReplacements(chain...)
 		}
-		o.BuyOrder = order
-		if err := c.dbClient.Update(o); err != nil {
-			log.Printf("unable to update buy order:%v\n%+v", err, o)
-		}
+		c.buyOrderUpdated(o, wasFilled)
 	}
+	c.endFailedEntries()
 	for _, o := range c.inProgressSellOrders() {
-		order := c.order(o.SellOrder.ID)
-		if order == nil {
+		wasFilled := o.SellFilled()
+		switch {
+		case isSyntheticOCO(o.SellOrder):
+			c.updateSyntheticOCO(o.SellOrder, c.now())
+		case !poll:
 			continue
+		case o.SellingWithBracket() && !c.cfg.Backtest && !c.shadow:
+			// The legs are updated with the bracket buy order.
+			order, chain := c.orderFrom(orders, o.BuyOrder.ID)
+			if order == nil {
+				continue
+			}
+			o.BuyOrder = order
+			o.AddReplacements(chain...)
+			c.syncBracketSell(o)
+		default:
+			order, chain := c.orderFrom(orders, o.SellOrder.ID)
+			if order == nil {
+				continue
+			}
+			o.SellOrder = order
+			o.AddReplacements(chain...)
 		}
-		o.SellOrder = order
-		if err := c.dbClient.Update(o); err != nil {
-			log.Printf("unable to update sell order:%v\n%+v", err, o)
+		c.sellOrderUpdated(o, wasFilled)
+	}
+}
+
+// buyOrderUpdated stores the purchase after its buy order was updated, and
+// notifies when the order filled.
+func (c *client) buyOrderUpdated(o *purchase.Purchase, wasFilled bool) {
+	sellWasFilled, bracketSell := o.SellFilled(), c.syncBracketSell(o)
+	if err := c.dbClient.Update(o); err != nil {
+		log.Printf("unable to update buy order:%v\n%+v", err, o)
+	}
+	if !wasFilled && o.BuyFilled() {
+		c.notifyFill(webhookBuyFilled, o, o.BuyOrder)
+	}
+	if bracketSell {
+		c.sellOrderUpdated(o, sellWasFilled)
+	}
+}
+
+// sellOrderUpdated stores the purchase after its sell order was updated, and
+// completes the trade when the order filled.
+func (c *client) sellOrderUpdated(o *purchase.Purchase, wasFilled bool) {
+	order := o.SellOrder
+	if o.SellFilled() && order.FilledAvgPrice != nil {
+		o.RecordPrice(*order.FilledAvgPrice)
+	}
+	if err := c.dbClient.Update(o); err != nil {
+		log.Printf("unable to update sell order:%v\n%+v", err, o)
+	}
+	if !wasFilled && o.SellFilled() {
+		c.notifyFill(webhookSellFilled, o, order)
+		c.logTrade(o)
+		c.narrateExit(o)
+	}
+}
+
+// storeBars stores the bars used to evaluate a signal at time t.
+func (c *client) storeBars(bars []alpaca.Bar, t time.Time) {
+	var stored []*database.Bar
+	for _, b := range bars {
+		stored = append(stored, &database.Bar{
+			Symbol:      c.stockSymbol,
+			Timeframe:   c.cfg.BarTimeframe,
+			EvaluatedAt: t,
+			Bar:         b,
+		})
+	}
+	if err := c.dbClient.InsertBars(stored); err != nil {
+		log.Printf("unable to store bars: %v", err)
+	}
+}
+
+// heartbeat reports that the trader is alive along with its current state.
+func heartbeat(clients []*client, t time.Time) {
+	var openPurchases int
+	for _, c := range clients {
+		if c.shadow {
+			continue
 		}
+		c.do(func() { openPurchases += len(c.inProgressPurchases()) })
 	}
+	h := &database.Heartbeat{
+		Instance:       clients[0].cfg.Instance,
+		Name:           heartbeatName,
+		Time:           t,
+		Trading:        trading,
+		OpenPurchases:  openPurchases,
+		BreakerTripped: breaker.isTripped(),
+	}
+	if err := clients[0].dbClient.UpdateHeartbeat(h); err != nil {
+		log.Printf("unable to update heartbeat: %v", err)
+	}
+	publishLiveState(clients, h)
 }
 
 // startWebserver starts a web server to display job information.
 func startWebserver() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", serveHTTP)
+	mux.HandleFunc("/api/version", serveVersion)
+	mux.HandleFunc("/api/usage", serveAPIUsage)
+	mux.HandleFunc("/narration", serveNarration)
+	mux.HandleFunc("/api/breaker", serveBreaker)
+	mux.HandleFunc("/api/breaker/reset", serveBreakerReset)
+	mux.HandleFunc("/api/kill", serveKillSwitch)
+	mux.HandleFunc("/api/kill/engage", serveKillSwitchEngage)
+	mux.HandleFunc("/api/kill/release", serveKillSwitchRelease)
+	mux.HandleFunc("/api/risk", serveRisk)
+	mux.HandleFunc("/api/rebalance", serveRebalance)
+	mux.HandleFunc("/api/datacheck", serveDataCheck)
+	mux.HandleFunc("/api/approvals", serveApprovals)
+	mux.HandleFunc("/api/approvals/approve", serveApprovalDecision(approvalApproved))
+	mux.HandleFunc("/api/approvals/reject", serveApprovalDecision(approvalRejected))
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8081"
-		log.Printf("defaulting to port %s", port)
+	p := *port
+	if p == "" {
+		p = os.Getenv("PORT")
+	}
+	if p == "" {
+		p = "8081"
+		log.Printf("defaulting to port %s", p)
 	}
 
-	log.Printf("listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, mux); err != nil {
+	addr := net.JoinHostPort(*bindAddress, p)
+	l, err := listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", addr)
+	if err := http.Serve(l, mux); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func serveHTTP(w http.ResponseWriter, r *http.Request) {
-	if trading {
-		fmt.Fprintf(w, "Trader One is running and trading!\n\n")
-	} else {
-		fmt.Fprintf(w, "Trader One is running, but not currently trading.\n\n")
+// listen announces on the address, returning a clear error when the address
+// is already in use (e.g. by the dashboard webserver on the same host).
+func listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("%s is already in use by another process, choose a different port with -port", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %v", addr, err)
 	}
+	return l, nil
 }
 
 func setupLogging() *os.File {
@@ -485,25 +1109,124 @@ func closeLogging(f *os.File) {
 }
 
 func main() {
+	setup()
+	switch flag.Arg(0) {
+	case importOrdersCommand:
+		if err := importOrders(flag.Args()[1:]); err != nil {
+			log.Printf("unable to import orders: %v", err)
+			os.Exit(1)
+		}
+		return
+	case validateCommand:
+		if err := validateProfitLoss(flag.Args()[1:]); err != nil {
+			log.Printf("unable to validate profit/loss: %v", err)
+			os.Exit(1)
+		}
+		return
+	case conditionsReportCommand:
+		if err := conditionsReport(flag.Args()[1:]); err != nil {
+			log.Printf("unable to report conditions: %v", err)
+			os.Exit(1)
+		}
+		return
+	case riskReportCommand:
+		if err := riskReport(flag.Args()[1:]); err != nil {
+			log.Printf("unable to report risk: %v", err)
+			os.Exit(1)
+		}
+		return
+	case auditCommand:
+		if err := audit(flag.Args()[1:]); err != nil {
+			log.Printf("unable to audit: %v", err)
+			os.Exit(1)
+		}
+		return
+	case explainCommand:
+		if err := explain(flag.Args()[1:]); err != nil {
+			log.Printf("unable to explain: %v", err)
+			os.Exit(1)
+		}
+		return
+	case queryCommand:
+		if err := runQuery(flag.Args()[1:]); err != nil {
+			log.Printf("unable to run query: %v", err)
+			os.Exit(1)
+		}
+		return
+	case shardBenchmarkCommand:
+		if err := shardBenchmark(flag.Args()[1:]); err != nil {
+			log.Printf("unable to run shard benchmark: %v", err)
+			os.Exit(1)
+		}
+		return
+	case rebalanceCommand:
+		if err := rebalance(flag.Args()[1:]); err != nil {
+			log.Printf("unable to rebalance: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	go startWebserver()
 
 	f := setupLogging()
 	defer closeLogging(f)
 
-	if *runBacktest {
-		backtest()
+	fmt.Println(currentBuildInfo())
+	log.Printf("starting %v", currentBuildInfo())
+
+	if err := loadBlackoutCalendar(); err != nil {
+		log.Printf("unable to start trader-one: %v", err)
+		return
+	}
+	if err := startExternalStrategy(); err != nil {
+		log.Printf("unable to start trader-one: %v", err)
+		return
+	}
+	if err := startSignalSource(); err != nil {
+		log.Printf("unable to start trader-one: %v", err)
+		return
+	}
+	cfg := flagClientConfig()
+	if cfg.Backtest {
+		backtest(cfg)
 		return
 	}
 
-	c, err := new(*stockSymbol, *maxConcurrentPurchases)
+	countAPIUsage()
+	clients, err := newClients(cfg)
 	if err != nil {
 		log.Printf("unable to start trader-one: %v", err)
 		return
 	}
+	assignShards(clients)
+	currentSession.setClients(clients)
+	startTradeUpdates(clients)
+	startUnrealizedPL(clients)
+	startWebhookDigest()
+	startFeeAttribution()
+	startCorporateActions()
+	startApprovalBot()
+	startLiveState(cfg)
+	if *streamBars {
+		startBarFeeds(clients)
+	}
+	if err := startTradeLog(clients[0].dbClient); err != nil {
+		log.Printf("unable to start trade log: %v", err)
+	}
+	if *adaptivePolling && *streamBars {
+		log.Printf("adaptive_polling is ignored, since bars are streamed")
+	}
 	log.Printf("trader one is now online!")
 
 	ticker := time.NewTicker(*durationBetweenAction)
 	defer ticker.Stop()
+	var refreshWatchlistC <-chan time.Time
+	if *watchlistName != "" && *watchlistRefreshInterval > 0 {
+		refresh := time.NewTicker(*watchlistRefreshInterval)
+		defer refresh.Stop()
+		refreshWatchlistC = refresh.C
+	}
 	done := make(chan bool)
 	go func() {
 		time.Sleep(*durationToRun)
@@ -512,37 +1235,155 @@ func main() {
 	for {
 		select {
 		case <-done:
-			c.closeOutTrading()
+			closeOutTrading(clients)
 			return
+		case <-refreshWatchlistC:
+			clients = refreshWatchlist(clients, cfg)
+			assignShards(clients)
+			currentSession.setClients(clients)
+			unrealized.setClients(clients)
+			if tradeUpdates != nil {
+				tradeUpdates.setClients(clients)
+			}
+			if *streamBars {
+				startBarFeeds(clients)
+			}
 		case t := <-ticker.C:
-			clock, err := c.alpacaClient.GetClock()
+			heartbeat(clients, t)
+			clock, err := clients[0].alpacaClient.GetClock()
 			if err != nil {
 				log.Printf("error checking if market is open: %v", err)
 				continue
 			}
-			c.updateOrders()
-			switch {
-			case clock.NextClose.Sub(time.Now()) < *timeBeforeMarketCloseToSell:
-				log.Printf("market is closing soon")
+			currentSession.setNextClose(clock.NextClose)
+			if adaptivePollingEnabled() {
+				ticker.Reset(adaptivePollInterval(clients, clock))
+			}
+			orders := listOrderSnapshot(clients)
+			eachClient(clients, func(c *client) { c.updateOrdersFrom(orders) })
+			if breaker.enabled() && clock.IsOpen {
+				if equity, err := liveEquity(clients[0]); err != nil {
+					log.Printf("unable to check drawdown: %v", err)
+				} else {
+					checkDrawdown(breaker, clients, t, equity)
+				}
+			}
+			if !clock.IsOpen {
 				trading = false
-				c.closeOutTrading()
-				time.Sleep(*timeBeforeMarketCloseToSell)
+				log.Printf("market is not open :(")
 				continue
-			case !clock.IsOpen:
+			}
+			// Each client closes out at its own deadline. The account is
+			// closed out once every client is due.
+			due, open := dueForCloseOut(clients, clock.NextClose, time.Now())
+			if len(open) == 0 {
+				log.Printf("market is closing soon")
 				trading = false
-				log.Printf("market is not open :(")
+				closeOutTrading(clients)
+				time.Sleep(time.Until(clock.NextClose))
 				continue
-			default:
-				trading = true
+			}
+			eachClient(due, func(c *client) { c.closeOutEarly(clock.NextClose, time.Now()) })
+			// The clients still run while the kill switch is engaged, so the
+			// open purchases are protected, but they make no new purchases.
+			trading = !kill.isEngaged()
+			if trading {
 				log.Printf("market is open!")
+			} else {
+				log.Printf("market is open, but the kill switch is engaged")
 			}
-			go c.run(t)
+			tickClients(open, t)
 		}
 	}
 }
 
-func init() {
+// newClients returns the clients to trade with. There is a single client
+// unless an A/B experiment is being run, in which case there is one per arm.
+func newClients(cfg ClientConfig) ([]*client, error) {
+	if cfg.WatchOnly && (*shadowParams != "" || *experimentArmB != "") {
+		return nil, fmt.Errorf("watch_only cannot be run with shadow_params or an experiment")
+	}
+	var clients []*client
+	switch {
+	case *watchlistName != "":
+		var err error
+		clients, err = newWatchlistClients(cfg)
+		if err != nil {
+			return nil, err
+		}
+	case *screenerUniverse != "":
+		var err error
+		clients, err = newScreenedClients(cfg)
+		if err != nil {
+			return nil, err
+		}
+	case *experimentArmB != "":
+		var err error
+		clients, err = newExperimentClients(cfg)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		c, err := new(*stockSymbol, *strategyName, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.checkPromotion(); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	for _, c := range clients {
+		if err := c.adoptRecentOrders(); err != nil {
+			log.Printf("unable to adopt orders for %v: %v", c.strategy, err)
+		}
+	}
+	if *shadowParams != "" {
+		c, err := newShadowClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+// closeOutTrading closes out trading for all clients.
+func closeOutTrading(clients []*client) {
+	eachClient(clients, func(c *client) {
+		c.closeOutTrading()
+		c.notifyDaySummary()
+		log.Printf("max adverse excursion today of %v: %v", c.strategy, excursionSummary(c.purchases))
+	})
+	// The fills since the last digest are sent before trading ends.
+	sendDigest(clients, time.Now())
+	if len(clients) > 1 {
+		logExperimentReport(clients)
+	}
+	alpacaUsage.logSummary()
+	if clients[0].cfg.RecordBlockedSignals {
+		now := time.Now().In(BookkeepingTZ)
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, BookkeepingTZ)
+		blocked, err := blockedSignalsSummary(clients[0].dbClient, today, now)
+		if err != nil {
+			log.Printf("unable to summarize blocked signals: %v", err)
+		} else {
+			log.Printf("blocked signals today: %v", blocked)
+		}
+	}
+	// The day summaries and alerts are delivered in the background, so a slow
+	// webhook does not hold up the close out of the other clients.
+	webhookSends.Wait()
+}
+
+// setup parses and checks the flags. It is called by main rather than run as
+// an init function, so the flags are left to the test binary in tests.
+func setup() {
 	flag.Parse()
+	if err := loadConfig(); err != nil {
+		fmt.Printf("unable to load config: %v", err)
+		os.Exit(1)
+	}
 
 	os.Setenv("TZ", "America/Los_Angeles")
 	os.Setenv(common.EnvApiKeyID, *apiKeyID)
@@ -553,9 +1394,62 @@ func init() {
 	alpaca.SetBaseUrl(*apiEndpoint)
 
 	var err error
-	PST, err = time.LoadLocation("America/Los_Angeles")
+	BookkeepingTZ, err = time.LoadLocation(*bookkeepingTimezone)
 	if err != nil {
-		fmt.Printf("unable to load PST timezone location: %v", err)
+		fmt.Printf("unable to load bookkeeping timezone location: %v", err)
+		os.Exit(1)
+	}
+
+	if _, ok := timeframes[*barTimeframe]; !ok {
+		fmt.Printf("unknown bar_timeframe %q", *barTimeframe)
+		os.Exit(1)
+	}
+	if *takeProfitMode != "flat" && *takeProfitMode != takeProfitVolatility {
+		fmt.Printf("unknown take_profit_mode %q", *takeProfitMode)
+		os.Exit(1)
+	}
+	if err := validateOCOEmulation(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := validateSellMode(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := validatePositionSizing(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := validateBracketEntries(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := validateFillMode(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := validateBacktestCosts(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := validateIndicatorFilter(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := validateDataCheck(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *minSignalStreak < 1 {
+		fmt.Printf("min_signal_streak must be at least 1, not %v", *minSignalStreak)
+		os.Exit(1)
+	}
+	if flatByDeadlines, err = parseFlatBy(*flatBy); err != nil {
+		fmt.Printf("invalid flat_by: %v", err)
+		os.Exit(1)
+	}
+	if *twapSlices > 1 && *entryOrderType != "market" {
+		fmt.Printf("twap_slices requires the market entry_order_type, not %q", *entryOrderType)
 		os.Exit(1)
 	}
 
@@ -564,4 +1458,10 @@ func init() {
 		fmt.Printf("unable to load EST timezone location: %v", err)
 		os.Exit(1)
 	}
+	// backtest_stop_at is in EST.
+	if err := parseBacktestStop(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	breaker = newDrawdownBreaker(flagClientConfig())
 }
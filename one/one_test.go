@@ -0,0 +1,21 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain loads the timezones which main loads in setup.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	var err error
+	if EST, err = time.LoadLocation("America/New_York"); err != nil {
+		fmt.Printf("unable to load EST timezone location: %v", err)
+		os.Exit(1)
+	}
+	BookkeepingTZ = EST
+	os.Exit(m.Run())
+}
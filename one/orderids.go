@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+var (
+	clientOrderIDPrefix = flag.String("client_order_id_prefix", "t1", "The prefix of the client order IDs given to every order. On startup, open orders and the day's filled orders with this prefix which are missing from the database are adopted rather than placed again.")
+)
+
+// orderIDPrefix returns the prefix of the client order IDs of the client's
+// orders. The strategy and symbol are hashed since client order IDs are
+// limited to 48 characters.
+func (c *client) orderIDPrefix() string {
+	sum := sha256.Sum256([]byte(c.strategy + "/" + c.stockSymbol))
+	return fmt.Sprintf("%s-%x-", c.cfg.ClientOrderIDPrefix, sum[:4])
+}
+
+// buyClientOrderID returns the client order ID of a buy order placed for the
+// buy signal at time t. The same signal always gets the same ID, so a request
+// which is sent twice cannot create two orders.
+func (c *client) buyClientOrderID(t time.Time) string {
+	return fmt.Sprintf("%sb%d", c.orderIDPrefix(), t.Unix())
+}
+
+// sellClientOrderID returns the client order ID of the next sell order of the
+// purchase. The purchase ID is included so the order can be matched to its
+// purchase after a restart. The same sell always gets the same ID, so a
+// request which is sent twice cannot create two orders. A sell which replaces
+// an earlier one, e.g. a forced exit, is told apart by the earlier order,
+// since client order IDs cannot be reused.
+func (c *client) sellClientOrderID(p *purchase.Purchase) string {
+	id := fmt.Sprintf("%ss%d", c.orderIDPrefix(), p.ID)
+	if p.SellOrder != nil {
+		sum := sha256.Sum256([]byte(p.SellOrder.ID))
+		id += fmt.Sprintf("-%x", sum[:4])
+	}
+	return id
+}
+
+// placeOrder places the order. If placing the order fails, the order is
+// looked up by its client order ID, since the request may have reached the
+// broker even though the response did not make it back.
+func (c *client) placeOrder(req *alpaca.PlaceOrderRequest) (*alpaca.Order, error) {
+	o, err := c.alpacaClient.PlaceOrder(*req)
+	if err == nil || req.ClientOrderID == "" {
+		return o, err
+	}
+	existing, lookupErr := c.alpacaClient.GetOrderByClientOrderID(req.ClientOrderID)
+	if lookupErr != nil || existing == nil {
+		return nil, err
+	}
+	log.Printf("adopting order %q which already exists after placing it failed: %v", req.ClientOrderID, err)
+	return existing, nil
+}
+
+// adoptRecentOrders adds the client's open orders, and the orders it filled
+// today, which are missing from its purchases. This happens when the trader
+// stops between placing an order and storing it, and a market order has
+// usually filled by the time it restarts.
+func (c *client) adoptRecentOrders() error {
+	status := "all"
+	limit := 500
+	nested := true
+	orders, err := c.alpacaClient.ListOrders(&status, nil, &limit, &nested)
+	if err != nil {
+		return fmt.Errorf("unable to list orders: %v", err)
+	}
+	now := time.Now().In(BookkeepingTZ)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, BookkeepingTZ)
+	var recent []alpaca.Order
+	for _, o := range orders {
+		// Earlier days' purchases which are no longer held are not loaded,
+		// so their orders would look missing.
+		if closedOrderStatuses[o.Status] && o.CreatedAt.Before(today) {
+			continue
+		}
+		recent = append(recent, o)
+	}
+	return c.adoptOrders(recent)
+}
+
+// adoptOrders adopts the orders which were placed by the client but are not
+// part of its purchases. Closed orders are only adopted when they filled.
+func (c *client) adoptOrders(orders []alpaca.Order) error {
+	known := map[string]bool{}
+	byID := map[int64]*purchase.Purchase{}
+	for _, p := range c.purchases {
+		byID[p.ID] = p
+		for _, o := range []*alpaca.Order{p.BuyOrder, p.SellOrder} {
+			if o == nil {
+				continue
+			}
+			known[o.ID] = true
+			// TWAP buys and emulated sells are made of the orders in their
+			// legs.
+			if o.Legs != nil {
+				for _, leg := range *o.Legs {
+					known[leg.ID] = true
+				}
+			}
+		}
+	}
+
+	prefix := c.orderIDPrefix()
+	for i := range orders {
+		o := &orders[i]
+		if known[o.ID] || o.Symbol != c.stockSymbol || !strings.HasPrefix(o.ClientOrderID, prefix) {
+			continue
+		}
+		if closedOrderStatuses[o.Status] && !o.FilledQty.IsPositive() {
+			continue
+		}
+		suffix := strings.TrimPrefix(o.ClientOrderID, prefix)
+		switch {
+		case o.Side == alpaca.Buy && strings.HasPrefix(suffix, "b"):
+			p := &purchase.Purchase{
+				BuyOrder: o,
+				Strategy: c.strategy,
+			}
+			if err := c.dbClient.Insert(p); err != nil {
+				return fmt.Errorf("unable to insert adopted buy order %q: %v", o.ClientOrderID, err)
+			}
+			c.purchases = append(c.purchases, p)
+			log.Printf("adopted %v buy order %q as purchase %d", o.Status, o.ClientOrderID, p.ID)
+		case o.Side == alpaca.Sell && strings.HasPrefix(suffix, "s"):
+			id, err := strconv.ParseInt(strings.SplitN(suffix[1:], "-", 2)[0], 10, 64)
+			if err != nil {
+				log.Printf("unable to read purchase ID of sell order %q: %v", o.ClientOrderID, err)
+				continue
+			}
+			p, ok := byID[id]
+			if !ok || !p.NotSelling() {
+				log.Printf("%v sell order %q does not match a purchase which is not selling", o.Status, o.ClientOrderID)
+				continue
+			}
+			p.SellOrder = o
+			if err := c.dbClient.Update(p); err != nil {
+				return fmt.Errorf("unable to update purchase %d with adopted sell order %q: %v", p.ID, o.ClientOrderID, err)
+			}
+			log.Printf("adopted %v sell order %q for purchase %d", o.Status, o.ClientOrderID, p.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+func TestSellClientOrderID(t *testing.T) {
+	c := &client{cfg: ClientConfig{ClientOrderIDPrefix: "t1"}, strategy: "one", stockSymbol: "AAPL"}
+	p := &purchase.Purchase{ID: 7}
+	first := c.sellClientOrderID(p)
+	if again := c.sellClientOrderID(p); again != first {
+		t.Errorf("sellClientOrderID() = %q then %q, want the same ID for a retry", first, again)
+	}
+	p.SellOrder = &alpaca.Order{ID: "1", ClientOrderID: first, Status: "canceled"}
+	if next := c.sellClientOrderID(p); next == first {
+		t.Errorf("sellClientOrderID() = %q for the sell which replaces %q, want a new ID", next, first)
+	}
+	if len(first) > 48 {
+		t.Errorf("sellClientOrderID() = %q is longer than 48 characters", first)
+	}
+}
+
+func TestAdoptOrders(t *testing.T) {
+	c := newBacktestTestClient(t, ClientConfig{ClientOrderIDPrefix: "t1"}, 1, "100", "50")
+	prefix := c.orderIDPrefix()
+	held := &purchase.Purchase{BuyOrder: &alpaca.Order{ID: "1", Symbol: "AAPL", Status: filled, FilledQty: decimal.NewFromInt(5)}}
+	if err := c.dbClient.Insert(held); err != nil {
+		t.Fatal(err)
+	}
+	c.purchases = []*purchase.Purchase{held}
+
+	orders := []alpaca.Order{
+		// A market buy which filled before it was stored.
+		{ID: "2", ClientOrderID: prefix + "b100", Symbol: "AAPL", Side: alpaca.Buy, Status: filled, FilledQty: decimal.NewFromInt(3)},
+		// A buy which was cancelled before it filled has nothing to adopt.
+		{ID: "3", ClientOrderID: prefix + "b200", Symbol: "AAPL", Side: alpaca.Buy, Status: "canceled"},
+		// The sell of the held purchase which filled before it was stored.
+		{ID: "4", ClientOrderID: c.sellClientOrderID(held), Symbol: "AAPL", Side: alpaca.Sell, Status: filled, FilledQty: decimal.NewFromInt(5)},
+		// An order of another client.
+		{ID: "5", ClientOrderID: "t1-00000000-b300", Symbol: "AAPL", Side: alpaca.Buy, Status: "new"},
+	}
+	if err := c.adoptOrders(orders); err != nil {
+		t.Fatalf("adoptOrders() = %v", err)
+	}
+	if len(c.purchases) != 2 || c.purchases[1].BuyOrder.ID != "2" {
+		t.Fatalf("adoptOrders() left %d purchases, want the held one and the filled buy", len(c.purchases))
+	}
+	if held.SellOrder == nil || held.SellOrder.ID != "4" {
+		t.Errorf("sell order of the held purchase = %+v, want the filled sell", held.SellOrder)
+	}
+}
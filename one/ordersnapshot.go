@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+var (
+	batchOrderUpdates = flag.Bool("batch_order_updates", true, "If true, the in-progress orders of every client are updated from a single request each tick, which lists the orders submitted since the oldest of them, instead of a request per order. Orders missing from the list are requested on their own.")
+)
+
+// orderSnapshot are the orders listed for a tick, by ID. Orders are listed
+// with their legs.
+type orderSnapshot map[string]*alpaca.Order
+
+// listOrderSnapshot lists the orders submitted since the oldest order of the
+// clients which would otherwise be requested on its own. It returns nil when
+// batch_order_updates is not set, there are no such orders, or the orders
+// cannot be listed.
+func listOrderSnapshot(clients []*client) orderSnapshot {
+	if !*batchOrderUpdates {
+		return nil
+	}
+	var mu sync.Mutex
+	var oldest time.Time
+	eachClient(clients, func(c *client) {
+		if t, ok := c.oldestPolledOrder(); ok {
+			mu.Lock()
+			if oldest.IsZero() || t.Before(oldest) {
+				oldest = t
+			}
+			mu.Unlock()
+		}
+	})
+	if oldest.IsZero() {
+		return nil
+	}
+	orders, err := ordersSubmittedAfter(oldest.Add(-time.Minute))
+	if err != nil {
+		log.Printf("unable to list orders, requesting them one by one: %v", err)
+		return nil
+	}
+	snapshot := orderSnapshot{}
+	for i := range orders {
+		snapshot[orders[i].ID] = &orders[i]
+	}
+	return snapshot
+}
+
+// ordersSubmittedAfter lists the orders submitted after t, oldest first, up to
+// the most Alpaca lists at once.
+func ordersSubmittedAfter(t time.Time) ([]alpaca.Order, error) {
+	q := url.Values{}
+	q.Set("status", "all")
+	q.Set("after", t.UTC().Format(time.RFC3339))
+	q.Set("direction", "asc")
+	q.Set("limit", fmt.Sprint(listOrdersLimit))
+	q.Set("nested", "true")
+	var orders []alpaca.Order
+	if err := getAlpacaAPI("/v2/orders?"+q.Encode(), &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// oldestPolledOrder returns when the oldest in-progress order which is
+// requested each tick was created. It returns false if there is none.
+func (c *client) oldestPolledOrder() (time.Time, bool) {
+	if c.cfg.Backtest || c.shadow || c.streamCurrent() {
+		return time.Time{}, false
+	}
+	var orders []*alpaca.Order
+	for _, p := range c.inProgressBuyOrders() {
+		if !isTWAP(p.BuyOrder) {
+			orders = append(orders, p.BuyOrder)
+		}
+	}
+	for _, p := range c.inProgressSellOrders() {
+		if !isSyntheticOCO(p.SellOrder) {
+			orders = append(orders, p.SellOrder)
+		}
+	}
+	var oldest time.Time
+	for _, o := range orders {
+		if oldest.IsZero() || o.CreatedAt.Before(oldest) {
+			oldest = o.CreatedAt
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// orderFrom returns the order from the snapshot, following its replacements
+// like order does. The order is requested on its own when it or one of its
+// replacements is missing from the snapshot.
+func (c *client) orderFrom(orders orderSnapshot, id string) (*alpaca.Order, []purchase.Replacement) {
+	order, ok := orders[id]
+	if !ok || c.cfg.Backtest || c.shadow {
+		return c.order(id)
+	}
+	var chain []purchase.Replacement
+	for order.ReplacedBy != nil {
+		next, ok := orders[*order.ReplacedBy]
+		if !ok || len(chain) >= maxReplacements {
+			return c.order(id)
+		}
+		chain = append(chain, purchase.NewReplacement(order, next.ID))
+		order = next
+	}
+	latest := *order
+	return &latest, chain
+}
@@ -0,0 +1,79 @@
+//go:build parquet
+// +build parquet
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func init() {
+	parquetRowReader = newParquetRowReader
+}
+
+// parquetRows holds the rows of a Parquet file. The first row is the header
+// of column names.
+type parquetRows struct {
+	rows [][]string
+	next int
+}
+
+// Read returns the next row.
+func (p *parquetRows) Read() ([]string, error) {
+	if p.next >= len(p.rows) {
+		return nil, io.EOF
+	}
+	p.next++
+	return p.rows[p.next-1], nil
+}
+
+// newParquetRowReader reads all rows of a flat Parquet file. Values are
+// converted to strings so they are parsed the same as CSV files.
+func newParquetRowReader(filename string) (rowReader, error) {
+	f, err := local.NewLocalFileReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pr, err := reader.NewParquetColumnReader(f, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.ReadStop()
+
+	var header []string
+	for _, e := range pr.Footer.GetSchema()[1:] {
+		if e.GetNumChildren() > 0 {
+			return nil, fmt.Errorf("nested column %q is not supported", e.GetName())
+		}
+		header = append(header, e.GetName())
+	}
+
+	numRows := pr.GetNumRows()
+	rows := make([][]string, numRows+1)
+	rows[0] = header
+	for i := range rows[1:] {
+		rows[i+1] = make([]string, len(header))
+	}
+	for col := range header {
+		values, _, _, err := pr.ReadColumnByIndex(int64(col), numRows)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read column %q: %v", header[col], err)
+		}
+		for i, v := range values {
+			switch v := v.(type) {
+			case nil:
+			case []byte:
+				rows[i+1][col] = string(v)
+			default:
+				rows[i+1][col] = fmt.Sprint(v)
+			}
+		}
+	}
+	return &parquetRows{rows: rows}, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestParticipationRate = flag.Float64("backtest_participation_rate", 0, "The largest share, from 0 to 1, of the volume of each minute the backtest orders of a symbol may fill, so an order which is large compared to the volume is only partially filled, and fills over several minutes. 0 fills orders whole, as do minutes without volume in the backtest file.")
+)
+
+// fakeFillableQty returns how much of the unfilled quantity of the order the
+// simulated market fills now, in whole shares. It is less than all of it when
+// the orders of the client would trade more than backtest_participation_rate
+// of the minute's volume.
+func (c *client) fakeFillableQty(o *alpaca.Order) decimal.Decimal {
+	remaining := o.Qty.Sub(o.FilledQty)
+	volume := c.fakeCurrentPrice().Volume
+	if c.cfg.BacktestParticipationRate <= 0 || !volume.IsPositive() {
+		return remaining
+	}
+	c.fakeParticipationMinute()
+	available := volume.Mul(decimal.NewFromFloat(c.cfg.BacktestParticipationRate)).Floor().Sub(c.backtestParticipated)
+	return decimal.Max(decimal.Min(remaining, available), decimal.Zero)
+}
+
+// fakeParticipationMinute starts counting the quantity filled in a new minute
+// once the minute changed.
+func (c *client) fakeParticipationMinute() {
+	minute := timeToMinuteStart(c.backtestClock.Now).Unix()
+	if minute != c.backtestParticipationMinute {
+		c.backtestParticipationMinute = minute
+		c.backtestParticipated = decimal.Zero
+	}
+}
+
+// fakeFill fills qty more of the order at price, and settles it in the
+// simulated account. The fill price is averaged with the earlier fills of the
+// order, which stays partially filled until all of it is filled.
+func (c *client) fakeFill(o *alpaca.Order, qty, price decimal.Decimal) {
+	now := c.backtestClock.Now
+	avg := price
+	if o.FilledQty.IsPositive() && o.FilledAvgPrice != nil {
+		cost := o.FilledAvgPrice.Mul(o.FilledQty).Add(price.Mul(qty))
+		avg = cost.Div(o.FilledQty.Add(qty)).Round(4)
+	}
+	c.fakeCommission(qty, o.FilledQty.IsZero())
+	o.FilledQty = o.FilledQty.Add(qty)
+	o.FilledAvgPrice = &avg
+	o.FilledAt = &now
+	o.Status = filled
+	if o.FilledQty.LessThan(o.Qty) {
+		o.Status = "partially_filled"
+		log.Printf("order %v filled %v of %v @ $%v, %v filled so far", o.ID, qty, o.Qty, price, o.FilledQty)
+	}
+
+	c.fakeParticipationMinute()
+	c.backtestParticipated = c.backtestParticipated.Add(qty)
+	if o.Side == alpaca.Buy {
+		c.backtestCash = c.backtestCash.Sub(price.Mul(qty))
+		c.backtestStockHeldQty = c.backtestStockHeldQty.Add(qty)
+		return
+	}
+	c.backtestCash = c.backtestCash.Add(price.Mul(qty))
+	c.backtestStockHeldQty = c.backtestStockHeldQty.Sub(qty)
+}
+
+// fakeWorking returns true if the simulated broker may still fill the order.
+func fakeWorking(o *alpaca.Order) bool {
+	return o.Status == "new" || o.Status == "partially_filled"
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/shopspring/decimal"
+)
+
+var backtestTestStart = time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC)
+
+// newBacktestTestClient returns a backtest client whose history has a bar
+// with the price and volume in each of the minutes from the start.
+func newBacktestTestClient(t *testing.T, cfg ClientConfig, minutes int, price, volume string) *client {
+	t.Helper()
+	db, err := database.NewFake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &history{epochToTickerData: map[int64]*historicalTickerData{}}
+	for i := 0; i < minutes; i++ {
+		p := decimal.RequireFromString(price)
+		h.epochToTickerData[backtestTestStart.Add(time.Duration(i)*time.Minute).Unix()] = &historicalTickerData{
+			High:   p,
+			Low:    p,
+			Close:  p,
+			Volume: decimal.RequireFromString(volume),
+		}
+	}
+	cfg.Backtest = true
+	cfg.Params.sellMode = sellModeOCO
+	return &client{
+		cfg:                 cfg,
+		dbClient:            db,
+		stockSymbol:         "AAPL",
+		orders:              newExecutionQueue(),
+		breaker:             newDrawdownBreaker(cfg),
+		backtestHistory:     h,
+		backtestClock:       &fakeClock{Now: backtestTestStart},
+		backtestLatencyRand: rand.New(rand.NewSource(1)),
+	}
+}
+
+func TestCancelledPartialBuyIsSold(t *testing.T) {
+	c := newBacktestTestClient(t, ClientConfig{BacktestParticipationRate: 0.1}, 10, "100", "50")
+	p := c.fakePlaceBuyOrder(&alpaca.PlaceOrderRequest{Qty: decimal.NewFromInt(10), Type: alpaca.Market}, nil)
+	c.fakeOrder(p.BuyOrder.ID)
+	if p.BuyOrder.Status != "partially_filled" || !p.BuyOrder.FilledQty.Equal(decimal.NewFromInt(5)) {
+		t.Fatalf("buy order is %v with %v filled, want partially_filled with 5 filled", p.BuyOrder.Status, p.BuyOrder.FilledQty)
+	}
+
+	// The rest of the buy is cancelled once it is outdated.
+	c.backtestClock.Now = backtestTestStart.Add(6 * time.Minute)
+	c.cancelOutdatedOrders()
+	if p.BuyOrder.Status != "canceled" {
+		t.Fatalf("buy order is %v after it is outdated, want canceled", p.BuyOrder.Status)
+	}
+	c.endFailedEntries()
+	if len(c.purchases) != 1 {
+		t.Fatalf("the cancelled partial buy was dropped, %d purchases are left", len(c.purchases))
+	}
+
+	c.sell()
+	c.drainOrders(c.backtestClock.Now)
+	if p.SellOrder == nil {
+		t.Fatalf("no sell order was placed for the %v shares of the cancelled partial buy", p.BuyOrder.FilledQty)
+	}
+	if !p.SellOrder.Qty.Equal(p.BuyOrder.FilledQty) {
+		t.Errorf("sell order quantity = %v, want the %v filled shares", p.SellOrder.Qty, p.BuyOrder.FilledQty)
+	}
+}
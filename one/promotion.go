@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+var (
+	promotionMinPaperDays   = flag.Int("promotion_min_paper_days", 5, "The number of qualifying paper trading days a strategy configuration needs before it may trade with a live endpoint. A configuration is the strategy name, the symbol and the values of num_historical_bars_to_use, all_sequential_increases_to_buy, min_slope_required_to_buy, sell_mode, trailing_stop_percent and min_signal_streak. Zero disables the check.")
+	promotionMinWinRate     = flag.Float64("promotion_min_win_rate", 50, "The minimum win rate percentage of a qualifying paper trading day.")
+	promotionMaxDrawdown    = flag.Float64("promotion_max_drawdown", 100, "The maximum drawdown in dollars of realized P/L of a qualifying paper trading day.")
+	promotionMinTradesOnDay = flag.Int("promotion_min_trades_on_day", 1, "The minimum number of completed trades of a qualifying paper trading day.")
+)
+
+// isPaperEndpoint returns true if the API endpoint is for paper trading.
+func isPaperEndpoint(endpoint string) bool {
+	return strings.Contains(endpoint, "paper-api")
+}
+
+// configIDParams are the strategy params which identify a configuration, by
+// flag name. A change to the value of any of them, or to the symbol, is a new
+// configuration which must be paper traded again. The sizing, exit and risk
+// settings are not part of it.
+//
+// A param which is at its flag default is left out of the ID, so a param can
+// be appended here without changing the IDs of the existing configurations.
+// Changing the default of one of these flags changes the IDs of the
+// configurations which used it.
+var configIDParams = []string{
+	"num_historical_bars_to_use",
+	"all_sequential_increases_to_buy",
+	"min_slope_required_to_buy",
+	"sell_mode",
+	"trailing_stop_percent",
+	"min_signal_streak",
+}
+
+// configID identifies the strategy configuration of the client, see
+// configIDParams.
+func (c *client) configID() string {
+	values := c.cfg.Params.named()
+	parts := []string{c.stockSymbol}
+	for _, name := range configIDParams {
+		if f := flag.Lookup(name); f != nil && f.DefValue == values[name] {
+			continue
+		}
+		parts = append(parts, name+"="+values[name])
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, ";")))
+	return fmt.Sprintf("%s:%x", c.strategy, sum[:8])
+}
+
+// named returns the params by flag name, formatted as their flags format
+// their defaults.
+func (p strategyParams) named() map[string]string {
+	return map[string]string{
+		"num_historical_bars_to_use":      strconv.Itoa(p.numHistoricalBars),
+		"all_sequential_increases_to_buy": strconv.FormatBool(p.allSequentialIncreases),
+		"min_slope_required_to_buy":       strconv.FormatFloat(p.minSlope, 'g', -1, 64),
+		"sell_mode":                       p.sellMode,
+		"trailing_stop_percent":           strconv.FormatFloat(p.trailingStopPercent, 'g', -1, 64),
+		"min_signal_streak":               strconv.Itoa(p.minSignalStreak),
+	}
+}
+
+// recordPaperDay stores a summary of today's paper trading. Nothing is
+// recorded when trading live or in shadow mode.
+func (c *client) recordPaperDay(now time.Time) {
+	if !isPaperEndpoint(c.cfg.APIEndpoint) || c.shadow {
+		return
+	}
+	d := newPaperDay(c.configID(), now, c.purchases)
+	if err := c.dbClient.UpdatePaperDay(d); err != nil {
+		log.Printf("unable to record paper day: %v", err)
+		return
+	}
+	log.Printf("recorded paper day for %v: %+v", c.configID(), d)
+}
+
+// newPaperDay summarizes the completed purchases made on the day of now.
+func newPaperDay(config string, now time.Time, purchases []*purchase.Purchase) *database.PaperDay {
+	var sold []*purchase.Purchase
+	for _, p := range purchases {
+		if p.BuyFilled() && p.SellFilled() && p.SellOrder.FilledAt != nil {
+			sold = append(sold, p)
+		}
+	}
+	sort.Slice(sold, func(i, j int) bool {
+		return sold[i].SellOrder.FilledAt.Before(*sold[j].SellOrder.FilledAt)
+	})
+
+	d := &database.PaperDay{
+		Config: config,
+		Date:   time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC),
+	}
+	var peak float64
+	for _, p := range sold {
+		pl, _ := p.RealizedProfitLoss().Float64()
+		d.Trades++
+		if pl >= 0 {
+			d.Wins++
+		}
+		d.ProfitLoss += pl
+		if d.ProfitLoss > peak {
+			peak = d.ProfitLoss
+		}
+		if peak-d.ProfitLoss > d.MaxDrawdown {
+			d.MaxDrawdown = peak - d.ProfitLoss
+		}
+	}
+	return d
+}
+
+// qualifies returns true if the paper trading day meets the promotion
+// thresholds.
+func (c *client) qualifies(d *database.PaperDay) bool {
+	return d.Trades >= c.cfg.PromotionMinTradesOnDay &&
+		d.WinRate() >= c.cfg.PromotionMinWinRate &&
+		d.MaxDrawdown <= c.cfg.PromotionMaxDrawdown
+}
+
+// checkPromotion returns an error if the client's strategy configuration has
+// not been promoted to live trading by accumulating enough qualifying paper
+// trading days. Watch-only clients place no orders, so they need no promotion.
+func (c *client) checkPromotion() error {
+	if isPaperEndpoint(c.cfg.APIEndpoint) || c.cfg.PromotionMinPaperDays == 0 || c.cfg.WatchOnly {
+		return nil
+	}
+	days, err := c.dbClient.PaperDays(c.configID())
+	if err != nil {
+		return fmt.Errorf("unable to get paper trading days: %v", err)
+	}
+	var qualifying int
+	for _, d := range days {
+		if c.qualifies(d) {
+			qualifying++
+		}
+	}
+	if qualifying < c.cfg.PromotionMinPaperDays {
+		return fmt.Errorf(
+			"strategy configuration %v has %v of %v required qualifying paper trading days (of %v paper days), so cannot trade live",
+			c.configID(), qualifying, c.cfg.PromotionMinPaperDays, len(days))
+	}
+	log.Printf("strategy configuration %v is promoted with %v qualifying paper trading days", c.configID(), qualifying)
+	return nil
+}
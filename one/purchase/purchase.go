@@ -5,27 +5,30 @@ import (
   "time"
 
 	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
 )
 
 var (
 	// orderCompletedStates are states when an order receives no further updates.
 	orderCompletedStates = map[string]bool{
 		"filled": true,
+		"canceled": true,
 		"cancelled": true,
 		"expired": true,
-		"stopped ": true,
-		"rejected ": true,
-		"suspended ": true,
+		"stopped": true,
+		"rejected": true,
+		"suspended": true,
 	}
 
 	// endedUnsuccessfullyStates are the states when an order was not filled and
 	// will receive no further updates.
 	endedUnsuccessfullyStates = map[string]bool{
+		"canceled": true,
 		"cancelled": true,
 		"expired": true,
-		"stopped ": true,
-		"rejected ": true,
-		"suspended ": true,
+		"stopped": true,
+		"rejected": true,
+		"suspended": true,
 	}
 
 	// inProgressStates are states when an order is in-progress or filled.
@@ -33,19 +36,93 @@ var (
 		"new": true,
 		"partially_filled": true,
 		"done_for_day": true,
-		"accepted ": true,
-		"pending_new ": true,
+		"accepted": true,
+		"pending_new": true,
 		"accepted_for_bidding": true,
 		"calculated": true,
+		"held": true,
 	}
 )
 
+// The legs of a sell order which can end a purchase.
+const (
+	ExitTakeProfit   = "take-profit"
+	ExitStop         = "stop"
+	ExitTrailingStop = "trailing-stop"
+	ExitCloseOut     = "close-out"
+	ExitUnknown      = "unknown"
+)
+
+// Replacement records an order which was replaced by another order, e.g. when
+// the stop of a sell order is moved.
+type Replacement struct {
+	OrderID    string           `json:"order_id"`
+	ReplacedBy string           `json:"replaced_by"`
+	Side       alpaca.Side      `json:"side"`
+	ReplacedAt *time.Time       `json:"replaced_at"`
+	LimitPrice *decimal.Decimal `json:"limit_price"`
+	StopPrice  *decimal.Decimal `json:"stop_price"`
+}
+
+// NewReplacement returns the replacement of the order by the order with the
+// ID replacedBy.
+func NewReplacement(o *alpaca.Order, replacedBy string) Replacement {
+	return Replacement{
+		OrderID:    o.ID,
+		ReplacedBy: replacedBy,
+		Side:       o.Side,
+		ReplacedAt: o.ReplacedAt,
+		LimitPrice: o.LimitPrice,
+		StopPrice:  o.StopPrice,
+	}
+}
+
+// Fee is a fee or commission charged by the broker which was attributed to a
+// purchase, e.g. a share of the SEC and TAF fees on the day's sells.
+type Fee struct {
+	ActivityID  string          `json:"activity_id"` // ActivityID is the account activity which charged the fee.
+	Amount      decimal.Decimal `json:"amount"`      // Amount is the share of the fee in dollars, positive for a charge.
+	Description string          `json:"description"`
+}
+
+// The types of corporate actions.
+const (
+	CorporateActionDividend = "dividend"
+	CorporateActionSplit    = "split"
+)
+
+// CorporateAction is a dividend or split of the symbol while the purchase's
+// shares were held, which adjusted its bookkeeping.
+type CorporateAction struct {
+	Type        string          `json:"type"`                  // Type is CorporateActionDividend or CorporateActionSplit.
+	Date        time.Time       `json:"date"`                  // Date is when the action took effect.
+	ActivityID  string          `json:"activity_id,omitempty"` // ActivityID is the account activity which paid a dividend.
+	Amount      decimal.Decimal `json:"amount"`                // Amount is the share of a dividend in dollars.
+	Ratio       decimal.Decimal `json:"ratio"`                 // Ratio is the number of shares each share became in a split.
+	Description string          `json:"description"`
+}
+
 // Purchase stores information related to a purchase.
 type Purchase struct {
   ID int64  // ID is a unique ID of Purchase and is stored in the database.
 	BuyOrder  *alpaca.Order
 	SellOrder *alpaca.Order
 	SellFilledYearDay int  // The day of the year that the sale is made.
+	Instance string  // Instance identifies the trader instance which made the purchase.
+	Strategy string  // Strategy identifies the strategy which made the purchase.
+	Shadow bool  // Shadow is true when the purchase was simulated and not traded.
+	Replacements []Replacement  // Replacements are the purchase's orders which were replaced, oldest first.
+	LowestPrice *decimal.Decimal  // LowestPrice is the lowest price seen while the shares were held.
+	TakeProfitPercent *decimal.Decimal  // TakeProfitPercent is the take profit above the buy price chosen at entry, in percent. It is nil for the flat take profit.
+	Fees []Fee  // Fees are the fees and commissions attributed to the purchase from the account activities.
+	CorporateActions []CorporateAction  // CorporateActions are the dividends and splits while the shares were held.
+
+	// The following are only tracked in memory.
+	EntryRetry bool  // EntryRetry is true when the purchase retries a failed buy order.
+	CanceledByTrader bool  // CanceledByTrader is true when the trader cancelled the buy order.
+	TradingDaysHeld int  // TradingDaysHeld is the number of market closes the purchase was held over.
+	EntryReason string  // EntryReason explains the buy signal which made the purchase.
+	EntryBars []alpaca.Bar  // EntryBars are the bars of the buy signal which made the purchase, used to retry a failed buy.
 }
 
 // SellFilled returns true when the sell order if filled.
@@ -56,12 +133,17 @@ func (p *Purchase) SellFilled() bool {
 	return p.SellOrder.Status == "filled"
 }
 
-// BuyFilled returns true when the full quantity is bought and order if filled.
+// BuyFilled returns true when the buy order is filled, or ended after it was
+// partially filled, e.g. it was cancelled. Either way FilledQty shares are
+// held and must be sold.
 func (p *Purchase) BuyFilled() bool {
 	if p.BuyOrder == nil {
 		return false
 	}
-	return p.BuyOrder.Status == "filled"
+	if p.BuyOrder.Status == "filled" {
+		return true
+	}
+	return orderCompletedStates[p.BuyOrder.Status] && p.BuyOrder.FilledQty.IsPositive()
 }
 
 // SellHasStatus returns true when the sell order has the provided status.
@@ -80,6 +162,15 @@ func (p *Purchase) BuyHasStatus(s string) bool {
 	return p.BuyOrder.Status == s
 }
 
+// BuyEndedUnsuccessfully returns true when the buy order will receive no
+// further updates and bought nothing, e.g. it was rejected or cancelled.
+func (p *Purchase) BuyEndedUnsuccessfully() bool {
+	if p.BuyOrder == nil {
+		return false
+	}
+	return endedUnsuccessfullyStates[p.BuyOrder.Status] && !p.BuyOrder.FilledQty.IsPositive()
+}
+
 // BuyInitiatedAndNotFilled returns true when the buy order is created and not
 // yet filled.
 func (p *Purchase) BuyInitiatedAndNotFilled() bool {
@@ -111,7 +202,7 @@ func (p *Purchase) SellInProgress() bool {
 	return inProgressStates[p.SellOrder.Status]
 }
 
-// GetSellFilledYearDay returns the year day in PST that the sell was filled.
+// GetSellFilledYearDay returns the year day in tz that the sell was filled.
 func (p *Purchase) GetSellFilledYearDay(tz *time.Location) int {
 	if p.SellFilledYearDay == 0 {
 		p.SellFilledYearDay = p.SellOrder.FilledAt.In(tz).YearDay()
@@ -131,6 +222,62 @@ func (p *Purchase) SoldFilledAvgPriceFloat() float64 {
 	return f
 }
 
+// RealizedProfitLoss returns the profit or loss of a purchase whose buy and
+// sell orders are both filled, after the fees attributed to it and with the
+// dividends paid while it was held. Otherwise zero is returned.
+func (p *Purchase) RealizedProfitLoss() decimal.Decimal {
+	if !p.BuyFilled() || !p.SellFilled() {
+		return decimal.Zero
+	}
+	if p.BuyOrder.FilledAvgPrice == nil || p.SellOrder.FilledAvgPrice == nil {
+		return decimal.Zero
+	}
+	return p.SellOrder.FilledAvgPrice.Sub(*p.BuyOrder.FilledAvgPrice).Mul(p.SellOrder.FilledQty).Sub(p.TotalFees()).Add(p.TotalDividends())
+}
+
+// TotalFees returns the sum of the fees attributed to the purchase.
+func (p *Purchase) TotalFees() decimal.Decimal {
+	total := decimal.Zero
+	for _, f := range p.Fees {
+		total = total.Add(f.Amount)
+	}
+	return total
+}
+
+// HasFee returns true if the fee of the account activity was attributed to
+// the purchase.
+func (p *Purchase) HasFee(activityID string) bool {
+	for _, f := range p.Fees {
+		if f.ActivityID == activityID {
+			return true
+		}
+	}
+	return false
+}
+
+// TotalDividends returns the sum of the dividends paid while the purchase was
+// held.
+func (p *Purchase) TotalDividends() decimal.Decimal {
+	total := decimal.Zero
+	for _, a := range p.CorporateActions {
+		if a.Type == CorporateActionDividend {
+			total = total.Add(a.Amount)
+		}
+	}
+	return total
+}
+
+// HasCorporateAction returns true if the dividend of the account activity was
+// recorded for the purchase.
+func (p *Purchase) HasCorporateAction(activityID string) bool {
+	for _, a := range p.CorporateActions {
+		if a.ActivityID == activityID {
+			return true
+		}
+	}
+	return false
+}
+
 // InProgressBuyOrder determines if the buy order is still open and in progress.
 func (p *Purchase) InProgressBuyOrder() bool {
 	if p.BuyOrder == nil {
@@ -149,10 +296,179 @@ func (p *Purchase) InProgressSellOrder() bool {
 }
 
 // NotSelling determines if the sell order is *not* in progress. This would be
-// because an order has not been created or an order ended unsuccessfully.
+// because an order has not been created or an order ended unsuccessfully. The
+// legs of a bracket buy order are its sell order until they end.
 func (p *Purchase) NotSelling() bool {
 	if p.SellOrder == nil {
+		if sell := p.BracketSellOrder(); sell != nil {
+			return endedUnsuccessfullyStates[sell.Status]
+		}
 		return true
 	}
 	return endedUnsuccessfullyStates[p.SellOrder.Status]
 }
+
+// BracketEntry returns true when the buy order is a bracket order, whose take
+// profit and stop loss legs sell the purchase once the buy fills. A buy order
+// only has legs when it is a bracket order.
+func (p *Purchase) BracketEntry() bool {
+	takeProfit, stopLoss := p.BracketLegs()
+	return takeProfit != nil && stopLoss != nil
+}
+
+// BracketLegs returns the take profit and stop loss legs of the buy order.
+// Either is nil when the buy order has no such leg.
+func (p *Purchase) BracketLegs() (takeProfit, stopLoss *alpaca.Order) {
+	if p.BuyOrder == nil || p.BuyOrder.Legs == nil {
+		return nil, nil
+	}
+	for i := range *p.BuyOrder.Legs {
+		leg := &(*p.BuyOrder.Legs)[i]
+		switch leg.Type {
+		case alpaca.Limit:
+			takeProfit = leg
+		case alpaca.Stop, alpaca.StopLimit:
+			stopLoss = leg
+		}
+	}
+	return takeProfit, stopLoss
+}
+
+// BracketSellOrder returns the legs of the bracket buy order in the shape of
+// an OCO sell order: the take profit leg, with the stop loss leg as its only
+// leg. The legs are held until the buy fills, and the sell order is filled
+// once either leg filled. nil is returned if the buy order is not a bracket
+// order.
+func (p *Purchase) BracketSellOrder() *alpaca.Order {
+	if !p.BracketEntry() {
+		return nil
+	}
+	takeProfit, stopLoss := p.BracketLegs()
+	sell, stop := *takeProfit, *stopLoss
+	if p.BuyFilled() {
+		// The legs are working once the buy filled, even before their
+		// statuses are refreshed.
+		for _, leg := range []*alpaca.Order{&sell, &stop} {
+			if leg.Status == "held" {
+				leg.Status = "new"
+			}
+		}
+	}
+	if stop.Status == "filled" {
+		sell.Status = stop.Status
+		sell.FilledQty = stop.FilledQty
+		sell.FilledAvgPrice = stop.FilledAvgPrice
+		sell.FilledAt = stop.FilledAt
+	}
+	sell.Legs = &[]alpaca.Order{stop}
+	return &sell
+}
+
+// SellingWithBracket returns true when the sell order is the legs of the
+// bracket buy order, as returned by BracketSellOrder.
+func (p *Purchase) SellingWithBracket() bool {
+	if !p.BracketEntry() || p.SellOrder == nil {
+		return false
+	}
+	takeProfit, _ := p.BracketLegs()
+	return p.SellOrder.ID == takeProfit.ID
+}
+
+// ExitLeg returns which leg of the sell order ended the purchase and the price
+// the leg intended to sell at. The intended price is nil for close outs, since
+// they are market orders.
+func (p *Purchase) ExitLeg() (string, *decimal.Decimal) {
+	if p.SellOrder == nil {
+		return ExitUnknown, nil
+	}
+	if p.SellOrder.Legs != nil {
+		for _, leg := range *p.SellOrder.Legs {
+			if leg.Status == "filled" && leg.StopPrice != nil {
+				return ExitStop, leg.StopPrice
+			}
+		}
+	}
+	switch {
+	case p.SellOrder.Type == alpaca.Market:
+		return ExitCloseOut, nil
+	case p.SellOrder.Status == "filled" && (p.SellOrder.Type == alpaca.TrailingStop || p.SellOrder.Type == alpaca.Stop):
+		// Stop sell orders are only placed by the trailing stop sell modes.
+		return ExitTrailingStop, p.SellOrder.StopPrice
+	case p.SellOrder.Status == "filled" && p.SellOrder.LimitPrice != nil:
+		return ExitTakeProfit, p.SellOrder.LimitPrice
+	}
+	return ExitUnknown, nil
+}
+
+// ExitSlippage returns how much better per share the sell filled than the
+// price intended by its exit leg. It returns false when the leg had no
+// intended price.
+func (p *Purchase) ExitSlippage() (decimal.Decimal, bool) {
+	_, intended := p.ExitLeg()
+	if intended == nil || !p.SellFilled() || p.SellOrder.FilledAvgPrice == nil {
+		return decimal.Zero, false
+	}
+	return p.SellOrder.FilledAvgPrice.Sub(*intended), true
+}
+
+// TimeInTrade returns the time between the buy and sell fills. Zero is
+// returned unless both orders have filled.
+func (p *Purchase) TimeInTrade() time.Duration {
+	if p.BuyOrder == nil || p.SellOrder == nil || p.BuyOrder.FilledAt == nil || p.SellOrder.FilledAt == nil {
+		return 0
+	}
+	return p.SellOrder.FilledAt.Sub(*p.BuyOrder.FilledAt)
+}
+
+// AddReplacements records replacements which are not already recorded. It
+// returns true if any were added.
+func (p *Purchase) AddReplacements(rs ...Replacement) bool {
+	known := map[string]bool{}
+	for _, r := range p.Replacements {
+		known[r.OrderID] = true
+	}
+	added := false
+	for _, r := range rs {
+		if known[r.OrderID] {
+			continue
+		}
+		known[r.OrderID] = true
+		p.Replacements = append(p.Replacements, r)
+		added = true
+	}
+	return added
+}
+
+// RecordPrice records a price seen while the shares are held. It returns true
+// if the price is the lowest seen.
+func (p *Purchase) RecordPrice(price decimal.Decimal) bool {
+	if p.LowestPrice != nil && !price.LessThan(*p.LowestPrice) {
+		return false
+	}
+	p.LowestPrice = &price
+	return true
+}
+
+// MaxAdverseExcursion returns how far per share the price fell below the buy
+// fill price while the shares were held. It returns false when no price was
+// recorded.
+func (p *Purchase) MaxAdverseExcursion() (decimal.Decimal, bool) {
+	if p.LowestPrice == nil || p.BuyOrder == nil || p.BuyOrder.FilledAvgPrice == nil {
+		return decimal.Zero, false
+	}
+	mae := p.BuyOrder.FilledAvgPrice.Sub(*p.LowestPrice)
+	if mae.IsNegative() {
+		return decimal.Zero, true
+	}
+	return mae, true
+}
+
+// MaxAdverseExcursionPercent returns the maximum adverse excursion as a
+// percentage of the buy fill price.
+func (p *Purchase) MaxAdverseExcursionPercent() (decimal.Decimal, bool) {
+	mae, ok := p.MaxAdverseExcursion()
+	if !ok || p.BuyOrder.FilledAvgPrice.IsZero() {
+		return decimal.Zero, false
+	}
+	return mae.Div(*p.BuyOrder.FilledAvgPrice).Mul(decimal.NewFromInt(100)), true
+}
@@ -0,0 +1,35 @@
+package purchase
+
+import (
+	"testing"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+)
+
+func TestBuyStatus(t *testing.T) {
+	tests := []struct {
+		status              string
+		endedUnsuccessfully bool
+		inProgress          bool
+	}{
+		{status: "new", inProgress: true},
+		{status: "accepted", inProgress: true},
+		{status: "pending_new", inProgress: true},
+		{status: "partially_filled", inProgress: true},
+		{status: "filled"},
+		{status: "canceled", endedUnsuccessfully: true},
+		{status: "expired", endedUnsuccessfully: true},
+		{status: "stopped", endedUnsuccessfully: true},
+		{status: "rejected", endedUnsuccessfully: true},
+		{status: "suspended", endedUnsuccessfully: true},
+	}
+	for _, test := range tests {
+		p := &Purchase{BuyOrder: &alpaca.Order{Status: test.status}}
+		if got := p.BuyEndedUnsuccessfully(); got != test.endedUnsuccessfully {
+			t.Errorf("BuyEndedUnsuccessfully() with status %q = %v, want %v", test.status, got, test.endedUnsuccessfully)
+		}
+		if got := p.BuyInProgress(); got != test.inProgress {
+			t.Errorf("BuyInProgress() with status %q = %v, want %v", test.status, got, test.inProgress)
+		}
+	}
+}
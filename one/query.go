@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ejbrever/trader/one/database"
+)
+
+// queryCommand is the command which runs a canned SQL report of the trades in
+// the database, e.g. "one query -report losing_hours -from 2020-12-01".
+// Only the reports in database.Reports can be run.
+const queryCommand = "query"
+
+// runQuery runs a canned report and writes it as a table or as CSV.
+func runQuery(args []string) error {
+	fs := flag.NewFlagSet(queryCommand, flag.ContinueOnError)
+	report := fs.String("report", "", "The report to run: "+strings.Join(database.ReportNames(), ", ")+".")
+	from := fs.String("from", "", "The first day of trades to report (format: 2006-01-02). Defaults to 30 days ago.")
+	to := fs.String("to", "", "The last day of trades to report (format: 2006-01-02). Defaults to today.")
+	format := fs.String("format", "table", "The output format: \"table\" or \"csv\".")
+	list := fs.Bool("list", false, "If true, the reports are listed instead of run.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *list {
+		for _, name := range database.ReportNames() {
+			fmt.Printf("%v: %v\n", name, database.Reports[name].Description)
+		}
+		return nil
+	}
+	if *report == "" {
+		return fmt.Errorf("-report is required, see -list")
+	}
+	if *format != "table" && *format != "csv" {
+		return fmt.Errorf("unknown -format %q", *format)
+	}
+	now := time.Now().In(EST)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, EST)
+	start, last := today.AddDate(0, 0, -30), today
+	var err error
+	if *from != "" {
+		if start, err = time.ParseInLocation("2006-01-02", *from, EST); err != nil {
+			return fmt.Errorf("unable to parse -from: %v", err)
+		}
+	}
+	if *to != "" {
+		if last, err = time.ParseInLocation("2006-01-02", *to, EST); err != nil {
+			return fmt.Errorf("unable to parse -to: %v", err)
+		}
+	}
+	if last.Before(start) {
+		return fmt.Errorf("-to is before -from")
+	}
+
+	db, err := database.NewInstance(*databaseName, *instanceName)
+	if err != nil {
+		return fmt.Errorf("unable to open db: %v", err)
+	}
+	r, err := db.RunReport(*report, start, last.AddDate(0, 0, 1), EST)
+	if err != nil {
+		return err
+	}
+	if *format == "csv" {
+		return writeReportCSV(os.Stdout, r)
+	}
+	fmt.Printf("%v from %v to %v: %v\n", *report, start.Format("2006-01-02"), last.Format("2006-01-02"), database.Reports[*report].Description)
+	writeReportTable(os.Stdout, r)
+	return nil
+}
+
+// writeReportTable writes the report as aligned columns.
+func writeReportTable(w io.Writer, r *database.ReportResult) {
+	if len(r.Rows) == 0 {
+		fmt.Fprintf(w, "no rows\n")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(r.Columns, "\t"))
+	for _, row := range r.Rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+}
+
+// writeReportCSV writes the report as CSV with a header row.
+func writeReportCSV(w io.Writer, r *database.ReportResult) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(r.Columns); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(r.Rows); err != nil {
+		return fmt.Errorf("unable to write csv: %v", err)
+	}
+	return nil
+}
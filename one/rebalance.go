@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/shopspring/decimal"
+)
+
+// rebalanceCommand is the command which keeps the account at target weights
+// across a list of symbols, as a passive companion to the intraday strategy,
+// e.g. "one rebalance -targets SPY=60,TLT=30,GLD=10 -every weekly -band 5".
+// The intraday strategy closes out every position of its account, so the
+// rebalancer is run with an account of its own, e.g. with its own -env
+// profile.
+const rebalanceCommand = "rebalance"
+
+// rebalanceStrategy is the strategy name the rebalancer stores its state
+// under, for its portfolio rather than a symbol.
+const (
+	rebalanceStrategy = "rebalance"
+	rebalanceSymbol   = "portfolio"
+)
+
+// rebalancer keeps the account at the target weights. A symbol's weight is
+// the value of its position as a percentage of the managed equity.
+type rebalancer struct {
+	alpacaClient *alpaca.Client
+	dbClient     database.Client
+
+	// targets are the target weights in percent, by symbol.
+	targets map[string]float64
+	symbols []string
+	// every is "daily" or "weekly". Weekly rebalances are checked on the
+	// first trading day on or after weekday.
+	every   string
+	weekday time.Weekday
+	// band is how many percentage points a weight may drift from its target
+	// before the portfolio is rebalanced.
+	band float64
+	// allocation is the percentage of the account equity which is managed.
+	allocation float64
+	afterOpen  time.Duration
+	dryRun     bool
+
+	mu    sync.Mutex
+	state rebalanceState
+}
+
+// rebalanceState is the outcome of the latest successful rebalance check,
+// and the error of a later failed attempt. It is stored in the database, so
+// the schedule is kept across restarts.
+type rebalanceState struct {
+	Checked time.Time          `json:"checked"`
+	Equity  string             `json:"equity"`
+	Weights map[string]float64 `json:"weights"`
+	Drifted bool               `json:"drifted"`
+	Orders  []rebalanceOrder   `json:"orders,omitempty"`
+	// Attempted is the time of the latest check, and Error its error when it
+	// failed. A failed check does not advance Checked, so it is retried.
+	Attempted time.Time `json:"attempted,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// rebalanceOrder is an order placed to move a symbol to its target weight.
+type rebalanceOrder struct {
+	Symbol  string `json:"symbol"`
+	Side    string `json:"side"`
+	Qty     string `json:"qty"`
+	Price   string `json:"price"`
+	OrderID string `json:"order_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// currentRebalancer is the rebalancer shown by the status webserver, or nil
+// when trading intraday.
+var currentRebalancer *rebalancer
+
+// rebalance runs the rebalancing mode until it is stopped, or checks once
+// with -once.
+func rebalance(args []string) error {
+	fs := flag.NewFlagSet(rebalanceCommand, flag.ContinueOnError)
+	targets := fs.String("targets", "", "The comma separated target weights in percent of the managed equity, e.g. \"SPY=60,TLT=30,GLD=10\". Whatever is left over is held as cash.")
+	every := fs.String("every", "weekly", "How often the weights are checked, \"daily\" or \"weekly\".")
+	weekday := fs.String("weekday", "Monday", "The weekday weekly checks are made on. A holiday moves the check to the next trading day.")
+	band := fs.Float64("band", 5, "How many percentage points a weight may drift from its target before the portfolio is rebalanced.")
+	allocation := fs.Float64("allocation", 100, "The percentage of the account equity which is managed.")
+	afterOpen := fs.Duration("after_open", 30*time.Minute, "How long after the market opens the weights are checked, so the opening prices have settled.")
+	interval := fs.Duration("interval", time.Minute, "How often the market clock is checked.")
+	dryRun := fs.Bool("dry_run", false, "If true, the orders are logged but not placed.")
+	once := fs.Bool("once", false, "If true, the weights are checked now, whatever the schedule, and the command exits.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	weights, err := parseTargetWeights(*targets)
+	if err != nil {
+		return fmt.Errorf("invalid -targets: %v", err)
+	}
+	if *every != "daily" && *every != "weekly" {
+		return fmt.Errorf("unknown -every %q", *every)
+	}
+	day, err := parseWeekday(*weekday)
+	if err != nil {
+		return err
+	}
+	if *band <= 0 {
+		return fmt.Errorf("-band must be positive")
+	}
+	if *allocation <= 0 || *allocation > 100 {
+		return fmt.Errorf("-allocation must be between 0 and 100")
+	}
+	db, err := database.NewInstance(*databaseName, *instanceName)
+	if err != nil {
+		return fmt.Errorf("unable to open db: %v", err)
+	}
+	r := &rebalancer{
+		alpacaClient: alpaca.NewClient(common.Credentials()),
+		dbClient:     db,
+		targets:      weights,
+		every:        *every,
+		weekday:      day,
+		band:         *band,
+		allocation:   *allocation,
+		afterOpen:    *afterOpen,
+		dryRun:       *dryRun,
+	}
+	for symbol := range weights {
+		r.symbols = append(r.symbols, symbol)
+	}
+	sort.Strings(r.symbols)
+	r.restore()
+	if *once {
+		return r.check(time.Now())
+	}
+
+	currentRebalancer = r
+	go startWebserver()
+	log.Printf("rebalancing %v %v with a band of %v points", *every, *targets, *band)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for t := range ticker.C {
+		if !r.due(t) {
+			continue
+		}
+		clock, err := r.alpacaClient.GetClock()
+		if err != nil {
+			log.Printf("error checking if market is open: %v", err)
+			continue
+		}
+		open := time.Date(t.In(EST).Year(), t.In(EST).Month(), t.In(EST).Day(), 9, 30, 0, 0, EST)
+		if !clock.IsOpen || t.Before(open.Add(r.afterOpen)) {
+			continue
+		}
+		if kill.isEngaged() {
+			log.Printf("not rebalancing, the kill switch is engaged")
+			continue
+		}
+		if err := r.check(t); err != nil {
+			log.Printf("unable to rebalance: %v", err)
+		}
+	}
+	return nil
+}
+
+// parseTargetWeights parses the target weights of -targets.
+func parseTargetWeights(s string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	var total float64
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), "=")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not of the form symbol=percent", entry)
+		}
+		symbol := strings.ToUpper(parts[0])
+		if _, ok := weights[symbol]; ok {
+			return nil, fmt.Errorf("%q is repeated", symbol)
+		}
+		w, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("the weight of %v must be a positive percentage", symbol)
+		}
+		weights[symbol] = w
+		total += w
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("the weights add up to %v%%, more than 100%%", total)
+	}
+	return weights, nil
+}
+
+// parseWeekday parses the name of a weekday.
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), s) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", s)
+}
+
+// restore restores the state of the latest check from the database.
+func (r *rebalancer) restore() {
+	stored, err := r.dbClient.StrategyState(rebalanceStrategy, rebalanceSymbol)
+	if errors.Is(err, database.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("unable to restore the rebalance state: %v", err)
+		return
+	}
+	if err := json.Unmarshal(stored.State, &r.state); err != nil {
+		log.Printf("unable to restore the rebalance state %q: %v", stored.State, err)
+	}
+}
+
+// due returns true if the weights have not been checked yet in the current
+// period at t.
+func (r *rebalancer) due(t time.Time) bool {
+	t = t.In(EST)
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, EST)
+	if r.every == "weekly" {
+		back := (int(t.Weekday()) - int(r.weekday) + 7) % 7
+		start = start.AddDate(0, 0, -back)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state.Checked.Before(start)
+}
+
+// check compares the weights of the account with the targets at t, and
+// rebalances every symbol to its target once any weight drifted by more than
+// the band. The check only counts as done for the period once it completes,
+// so a failed check is retried on the next tick.
+func (r *rebalancer) check(t time.Time) error {
+	s := rebalanceState{Checked: t, Weights: map[string]float64{}, Attempted: t}
+	if err := r.rebalance(&s, t); err != nil {
+		r.mu.Lock()
+		failed := r.state
+		r.mu.Unlock()
+		failed.Attempted = t
+		failed.Error = err.Error()
+		r.store(&failed)
+		return err
+	}
+	r.store(&s)
+	return nil
+}
+
+// rebalance records the weights at t in s, and places the orders to move
+// them to their targets when they drifted. Sells are placed before buys.
+// The buys are sized down to the cash the account has before the sells, as
+// a buy placed against the proceeds of an unfilled sell can be rejected. A
+// weight left outside the band is rebalanced by a later check.
+func (r *rebalancer) rebalance(s *rebalanceState, t time.Time) error {
+	a, err := r.alpacaClient.GetAccount()
+	if err != nil {
+		return fmt.Errorf("unable to get account: %v", err)
+	}
+	positions, err := r.alpacaClient.ListPositions()
+	if err != nil {
+		return fmt.Errorf("unable to list positions: %v", err)
+	}
+	held := map[string]alpaca.Position{}
+	for _, p := range positions {
+		held[p.Symbol] = p
+	}
+	equity := a.Equity.Mul(decimal.NewFromFloat(r.allocation / 100))
+	s.Equity = equity.StringFixed(2)
+	if !equity.IsPositive() {
+		return fmt.Errorf("the account has no equity to rebalance")
+	}
+
+	var sells, buys []rebalanceOrder
+	for _, symbol := range r.symbols {
+		p := held[symbol]
+		weight, _ := p.MarketValue.Div(equity).Mul(decimal.NewFromInt(100)).Float64()
+		s.Weights[symbol] = math.Round(weight*100) / 100
+		if math.Abs(weight-r.targets[symbol]) > r.band {
+			s.Drifted = true
+		}
+		price := p.CurrentPrice
+		if !price.IsPositive() {
+			trade, err := r.alpacaClient.GetLastTrade(symbol)
+			if err != nil {
+				return fmt.Errorf("unable to get last trade of %v: %v", symbol, err)
+			}
+			price = decimal.NewFromFloat32(trade.Last.Price)
+		}
+		target := equity.Mul(decimal.NewFromFloat(r.targets[symbol] / 100))
+		qty := target.Sub(p.MarketValue).Div(price).Truncate(0)
+		switch {
+		case qty.IsPositive():
+			buys = append(buys, rebalanceOrder{Symbol: symbol, Side: string(alpaca.Buy), Qty: qty.String(), Price: price.String()})
+		case qty.IsNegative():
+			sells = append(sells, rebalanceOrder{Symbol: symbol, Side: string(alpaca.Sell), Qty: qty.Neg().String(), Price: price.String()})
+		}
+	}
+	log.Printf("rebalance check: weights %v of equity $%v, targets %v", s.Weights, s.Equity, r.targets)
+	if !s.Drifted {
+		log.Printf("every weight is within %v points of its target, not rebalancing", r.band)
+		return nil
+	}
+
+	cash := decimal.Min(a.Cash, a.RegTBuyingPower)
+	for i, o := range buys {
+		qty, _ := decimal.NewFromString(o.Qty)
+		price, _ := decimal.NewFromString(o.Price)
+		if fits := decimal.Max(cash.Div(price).Floor(), decimal.Zero); fits.LessThan(qty) {
+			log.Printf("sizing the rebalance buy of %v down from %v to %v shares to fit the cash of $%v", o.Symbol, qty, fits, cash.StringFixed(2))
+			qty = fits
+			buys[i].Qty = qty.String()
+		}
+		cash = cash.Sub(qty.Mul(price))
+	}
+	for _, o := range append(sells, buys...) {
+		if o.Qty == "0" {
+			continue
+		}
+		s.Orders = append(s.Orders, r.place(o, t))
+	}
+	return nil
+}
+
+// place places the market order of the rebalance, unless it is a dry run.
+func (r *rebalancer) place(o rebalanceOrder, t time.Time) rebalanceOrder {
+	log.Printf("rebalancing: %v %v %v @ ~$%v", o.Side, o.Qty, o.Symbol, o.Price)
+	if r.dryRun {
+		return o
+	}
+	qty, _ := decimal.NewFromString(o.Qty)
+	req := alpaca.PlaceOrderRequest{
+		AssetKey:      &o.Symbol,
+		Qty:           qty,
+		Side:          alpaca.Side(o.Side),
+		Type:          alpaca.Market,
+		TimeInForce:   alpaca.Day,
+		ClientOrderID: fmt.Sprintf("%v-%v-%v-%v", rebalanceStrategy, o.Symbol, o.Side, t.Unix()),
+	}
+	placed, err := r.alpacaClient.PlaceOrder(req)
+	if err != nil {
+		log.Printf("unable to place rebalance order: %v", err)
+		o.Error = err.Error()
+		return o
+	}
+	o.OrderID = placed.ID
+	return o
+}
+
+// store records the outcome of a check, and stores it in the database.
+func (r *rebalancer) store(s *rebalanceState) {
+	r.mu.Lock()
+	r.state = *s
+	r.mu.Unlock()
+	b, err := json.Marshal(s)
+	if err != nil {
+		log.Printf("unable to serialize the rebalance state: %v", err)
+		return
+	}
+	if err := r.dbClient.UpdateStrategyState(&database.StrategyState{
+		Strategy: rebalanceStrategy,
+		Symbol:   rebalanceSymbol,
+		Time:     s.Attempted,
+		State:    b,
+	}); err != nil {
+		log.Printf("unable to store the rebalance state: %v", err)
+	}
+}
+
+// writeRebalance writes the latest rebalance check for the status page.
+func (r *rebalancer) writeRebalance(w io.Writer) {
+	r.mu.Lock()
+	s := r.state
+	r.mu.Unlock()
+	fmt.Fprintf(w, "\nRebalancing %v, band of %v points\n", r.every, r.band)
+	if s.Error != "" {
+		fmt.Fprintf(w, "Last attempt: %v failed: %v\n", s.Attempted.In(EST).Format("2006-01-02 15:04 MST"), s.Error)
+	}
+	if s.Checked.IsZero() {
+		fmt.Fprintf(w, "Not checked yet\n")
+		return
+	}
+	fmt.Fprintf(w, "Checked: %v, equity $%v\n", s.Checked.In(EST).Format("2006-01-02 15:04 MST"), s.Equity)
+	for _, symbol := range r.symbols {
+		fmt.Fprintf(w, "  %v: %v%% (target %v%%)\n", symbol, s.Weights[symbol], r.targets[symbol])
+	}
+	for _, o := range s.Orders {
+		status := o.OrderID
+		if o.Error != "" {
+			status = "failed: " + o.Error
+		}
+		fmt.Fprintf(w, "  %v %v %v @ ~$%v %v\n", o.Side, o.Qty, o.Symbol, o.Price, status)
+	}
+}
+
+// serveRebalance serves the latest rebalance check as JSON.
+func serveRebalance(w http.ResponseWriter, r *http.Request) {
+	if currentRebalancer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	currentRebalancer.mu.Lock()
+	s := currentRebalancer.state
+	currentRebalancer.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.Printf("unable to encode rebalance state: %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// pdtDayTrades is the number of day trades in five business days which an
+// account may make before it is flagged as a pattern day trader.
+const pdtDayTrades = 3
+
+// riskControl is the state of a control which stops new purchases.
+type riskControl struct {
+	// Name is the flag or rule of the control.
+	Name string `json:"name"`
+	// Scope is the strategy and symbol the control applies to, or empty when
+	// it applies to the account.
+	Scope string `json:"scope,omitempty"`
+	Used  string `json:"used"`
+	// Limit is empty when no limit is set, in which case the control only
+	// reports.
+	Limit string `json:"limit,omitempty"`
+	// PercentUsed is how much of the limit is used.
+	PercentUsed float64 `json:"percent_used"`
+	// Halted is true when the control is stopping new purchases.
+	Halted bool   `json:"halted"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// riskStatus is the state of every risk control.
+type riskStatus struct {
+	Time     time.Time     `json:"time"`
+	Halted   bool          `json:"halted"`
+	Controls []riskControl `json:"controls"`
+}
+
+// add adds the control, marking the status halted if it is.
+func (s *riskStatus) add(rc riskControl) {
+	s.Controls = append(s.Controls, rc)
+	if rc.Halted {
+		s.Halted = true
+	}
+}
+
+// currentRisk returns the state of the risk controls of the clients. Shadow
+// clients do not trade, so they are left out.
+func currentRisk(clients []*client, now time.Time) *riskStatus {
+	s := &riskStatus{Time: now}
+
+	b := breaker.state()
+	k := kill.state()
+	killControl := riskControl{Name: ruleKillSwitch, Used: "released", Halted: k.Engaged}
+	if k.Engaged {
+		killControl.Used = "engaged"
+		killControl.Detail = fmt.Sprintf("since %v, %v", k.EngagedAt.In(EST).Format("15:04 MST"), k.Reason)
+	}
+	s.add(killControl)
+
+	daily := riskControl{
+		Name:   ruleDrawdownBreaker,
+		Used:   b.DrawdownPercent + "%",
+		Halted: b.Tripped && b.TrippedBy == ruleDrawdownBreaker,
+		Detail: fmt.Sprintf("equity $%v, peak $%v", b.Equity, b.PeakEquity),
+	}
+	if b.LimitPercent > 0 {
+		daily.Limit = fmt.Sprintf("%v%%", b.LimitPercent)
+		drawdown, _ := decimal.NewFromString(b.DrawdownPercent)
+		daily.PercentUsed = percentOf(floatOf(drawdown), b.LimitPercent)
+	}
+	s.add(daily)
+	loss := riskControl{
+		Name:   ruleDailyLoss,
+		Used:   "$" + b.DayLoss,
+		Halted: b.Tripped && b.TrippedBy == ruleDailyLoss,
+		Detail: fmt.Sprintf("equity $%v, day's first equity $%v", b.Equity, b.StartEquity),
+	}
+	if b.DailyLossLimit > 0 {
+		loss.Limit = fmt.Sprintf("$%.2f", b.DailyLossLimit)
+		dayLoss, _ := decimal.NewFromString(b.DayLoss)
+		loss.PercentUsed = percentOf(floatOf(dayLoss), b.DailyLossLimit)
+	}
+	s.add(loss)
+
+	var trades int
+	realized := decimal.Zero
+	exposure := decimal.Zero
+	for _, c := range clients {
+		if c.shadow {
+			continue
+		}
+		scope := fmt.Sprintf("%v %v", c.strategy, c.stockSymbol)
+		var open int
+		var blackout string
+		c.do(func() {
+			st := newArmStats(c.purchases)
+			trades += st.trades
+			realized = realized.Add(st.profitLoss)
+			open = len(c.inProgressPurchases()) + c.orders.pendingBuys()
+			for _, p := range heldPurchases(c.purchases) {
+				pos := newPositionPL(p, *p.BuyOrder.FilledAvgPrice)
+				exposure = exposure.Add(pos.cost.Mul(pos.qty))
+			}
+			blackout = c.blackedOut(now)
+		})
+		s.add(riskControl{
+			Name:        ruleConcurrentPurchases,
+			Scope:       scope,
+			Used:        fmt.Sprint(open),
+			Limit:       fmt.Sprint(c.cfg.MaxConcurrentPurchases),
+			PercentUsed: percentOf(float64(open), float64(c.cfg.MaxConcurrentPurchases)),
+			Halted:      open >= c.cfg.MaxConcurrentPurchases,
+		})
+		if blackout != "" {
+			s.add(riskControl{Name: ruleBlackout, Scope: scope, Used: "blacked out", Halted: true, Detail: blackout})
+		}
+		if p, ok := dataCheck.pausedSymbol(c.stockSymbol); ok {
+			s.add(riskControl{Name: ruleDataCheck, Scope: scope, Used: "paused", Halted: true,
+				Detail: fmt.Sprintf("bar price $%v, secondary price $%v, %v%% apart", p.PrimaryPrice, p.SecondaryPrice, p.Percent)})
+		}
+		if *maxUnrealizedLoss > 0 {
+			s.add(unrealizedLossControl(c, scope))
+		}
+	}
+	s.add(riskControl{
+		Name:   "trades_today",
+		Used:   fmt.Sprint(trades),
+		Detail: fmt.Sprintf("realized P/L $%v", realized.StringFixed(2)),
+	})
+
+	exposureControl := riskControl{Name: "exposure", Used: "$" + exposure.StringFixed(2)}
+	pdt := riskControl{Name: rulePatternDayTrader}
+	if len(clients) > 0 {
+		a, err := clients[0].alpacaClient.GetAccount()
+		if err != nil {
+			exposureControl.Detail = fmt.Sprintf("unable to get account: %v", err)
+			pdt.Detail = exposureControl.Detail
+		} else {
+			// Purchases are limited by the buying power, see buyQty.
+			available := a.Cash
+			if a.RegTBuyingPower.LessThan(available) {
+				available = a.RegTBuyingPower
+			}
+			if a.PatternDayTrader && a.DaytradingBuyingPower.LessThan(available) {
+				available = a.DaytradingBuyingPower
+			}
+			limit := exposure.Add(available)
+			exposureControl.Detail = fmt.Sprintf("$%v of buying power left, equity $%v", available.StringFixed(2), a.Equity.StringFixed(2))
+			// Buys are also sized down to max_exposure_percent, see
+			// positionSize.
+			if *maxExposurePercent > 0 {
+				if capped := a.Equity.Mul(decimal.NewFromFloat(*maxExposurePercent / 100)); capped.LessThan(limit) {
+					limit = capped
+					exposureControl.Detail += fmt.Sprintf(", capped at %v%% of equity", *maxExposurePercent)
+				}
+			}
+			exposureControl.Limit = "$" + limit.StringFixed(2)
+			exposureControl.PercentUsed = percentOf(floatOf(exposure), floatOf(limit))
+			pdt.Used = fmt.Sprint(a.DaytradeCount)
+			pdt.Limit = fmt.Sprint(pdtDayTrades)
+			pdt.PercentUsed = percentOf(float64(a.DaytradeCount), pdtDayTrades)
+			pdt.Detail = "day trades in the last 5 business days"
+			if a.PatternDayTrader {
+				pdt.Detail += fmt.Sprintf(", flagged as a pattern day trader, limited to $%v of day trading buying power", a.DaytradingBuyingPower.StringFixed(2))
+			}
+		}
+	}
+	s.add(exposureControl)
+	s.add(pdt)
+
+	apiControl := riskControl{
+		Name:   "alpaca_rate_limit",
+		Limit:  fmt.Sprint(*apiRateLimit),
+		Halted: alpacaUsage.nearLimit(now),
+		Detail: "orders wait while near the limit",
+	}
+	calls := alpacaUsage.callsThisMinute(now)
+	apiControl.Used = fmt.Sprint(calls)
+	apiControl.PercentUsed = percentOf(float64(calls), float64(*apiRateLimit))
+	s.add(apiControl)
+	return s
+}
+
+// unrealizedLossControl returns the state of the unrealized loss limit of the
+// client's worst open purchase.
+func unrealizedLossControl(c *client, scope string) riskControl {
+	rc := riskControl{
+		Name:   ruleUnrealizedLoss,
+		Scope:  scope,
+		Used:   "$0.00",
+		Limit:  fmt.Sprintf("$%.2f", *maxUnrealizedLoss),
+		Halted: unrealized != nil && unrealized.overLossLimit(c),
+	}
+	if unrealized == nil {
+		return rc
+	}
+	u := unrealized.snapshot(c)
+	if u == nil {
+		rc.Detail = "not computed yet"
+		return rc
+	}
+	worst := decimal.Zero
+	for _, pos := range u.positions {
+		if pos.pl.LessThan(worst) {
+			worst = pos.pl
+			rc.Detail = fmt.Sprintf("purchase %d", pos.purchase.ID)
+		}
+	}
+	rc.Used = "$" + worst.Neg().StringFixed(2)
+	rc.PercentUsed = percentOf(floatOf(worst.Neg()), *maxUnrealizedLoss)
+	return rc
+}
+
+// percentOf returns used as a percentage of limit, or zero without a limit.
+func percentOf(used, limit float64) float64 {
+	if limit <= 0 {
+		return 0
+	}
+	return float64(int(used/limit*1000+0.5)) / 10
+}
+
+// floatOf returns the decimal as a float.
+func floatOf(d decimal.Decimal) float64 {
+	f, _ := d.Float64()
+	return f
+}
+
+// writeRisk writes the state of the risk controls for the status page.
+func writeRisk(w io.Writer, clients []*client) {
+	s := currentRisk(clients, time.Now())
+	status := "ok"
+	if s.Halted {
+		status = "HALTED, no new purchases"
+	}
+	fmt.Fprintf(w, "\nRisk limits: %v\n", status)
+	for _, rc := range s.Controls {
+		name := rc.Name
+		if rc.Scope != "" {
+			name += " (" + rc.Scope + ")"
+		}
+		line := fmt.Sprintf("  %v: %v", name, rc.Used)
+		if rc.Limit != "" {
+			line += fmt.Sprintf(" of %v (%v%%)", rc.Limit, rc.PercentUsed)
+		}
+		if rc.Halted {
+			line += " HALTED"
+		}
+		if rc.Detail != "" {
+			line += ", " + rc.Detail
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// serveRisk serves the state of the risk controls as JSON.
+func serveRisk(w http.ResponseWriter, r *http.Request) {
+	clients, _ := currentSession.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentRisk(clients, time.Now())); err != nil {
+		log.Printf("unable to encode risk status: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+	"github.com/trader/indicators"
+)
+
+// riskReportCommand is the command which reports the risk-adjusted
+// performance of the trades in the database, along with the volatility and
+// beta of the symbols traded, e.g.
+// "one risk-report -from 2020-12-01 -benchmark SPY".
+const riskReportCommand = "risk-report"
+
+// minutesPerTradingDay is the length of the regular session, used to
+// annualize the volatility of intraday bars.
+const minutesPerTradingDay = 390
+
+// riskReport reports the risk-adjusted performance of the trades in the range.
+func riskReport(args []string) error {
+	fs := flag.NewFlagSet(riskReportCommand, flag.ContinueOnError)
+	from := fs.String("from", "", "The first day of trades to report (format: 2006-01-02).")
+	to := fs.String("to", "", "The last day of trades to report (format: 2006-01-02). Defaults to yesterday.")
+	strategy := fs.String("strategy", "", "When set, only trades of this strategy are reported.")
+	benchmark := fs.String("benchmark", "SPY", "The symbol the beta and correlation are measured against.")
+	capital := fs.Float64("capital", 100000, "The capital the daily returns are measured against.")
+	timeframe := fs.String("timeframe", "1Min", "The timeframe of the stored bars the volatility of each symbol is measured from.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("-from is required")
+	}
+	if *capital <= 0 {
+		return fmt.Errorf("-capital must be positive")
+	}
+	barDuration, ok := timeframes[*timeframe]
+	if !ok {
+		return fmt.Errorf("unknown -timeframe %q", *timeframe)
+	}
+	start, err := time.ParseInLocation("2006-01-02", *from, EST)
+	if err != nil {
+		return fmt.Errorf("unable to parse -from: %v", err)
+	}
+	now := time.Now().In(EST)
+	last := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, EST)
+	if *to != "" {
+		if last, err = time.ParseInLocation("2006-01-02", *to, EST); err != nil {
+			return fmt.Errorf("unable to parse -to: %v", err)
+		}
+	}
+	end := last.AddDate(0, 0, 1)
+
+	db, err := database.NewInstance(*databaseName, *instanceName)
+	if err != nil {
+		return fmt.Errorf("unable to open db: %v", err)
+	}
+	all, err := db.PurchasesBetween(start, end)
+	if err != nil {
+		return err
+	}
+	byDay := map[string][]*purchase.Purchase{}
+	symbols := map[string]bool{}
+	for _, p := range all {
+		if p.Shadow || !p.BuyFilled() || !p.SellFilled() || p.SellOrder.FilledAt == nil {
+			continue
+		}
+		if *strategy != "" && p.Strategy != *strategy {
+			continue
+		}
+		day := p.SellOrder.FilledAt.In(EST).Format("2006-01-02")
+		byDay[day] = append(byDay[day], p)
+		symbols[p.BuyOrder.Symbol] = true
+	}
+	if len(byDay) == 0 {
+		fmt.Printf("no trades from %v to %v\n", start.Format("2006-01-02"), last.Format("2006-01-02"))
+		return nil
+	}
+
+	// The benchmark's daily closes come from the stored bars when the trader
+	// stored them, and from Alpaca otherwise. The close of the day before the
+	// first day gives the first day's return.
+	benchmarkBars, err := storedBars(db, *benchmark, *timeframe, start.AddDate(0, 0, -5), end)
+	if err != nil {
+		return err
+	}
+	daily := dailyCloses(benchmarkBars)
+	if len(daily) < 2 {
+		days := int(end.Sub(start).Hours()/24) + 5
+		bars, err := dailyBars(alpaca.NewClient(common.Credentials()), []string{*benchmark}, days, end)
+		if err != nil {
+			return err
+		}
+		daily = bars[*benchmark]
+	}
+
+	fmt.Printf("risk-adjusted performance from %v to %v\n", start.Format("2006-01-02"), last.Format("2006-01-02"))
+	writeRiskAdjusted(os.Stdout, byDay, daily, *benchmark, *capital, start)
+
+	var names []string
+	for s := range symbols {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	periodsPerYear := indicators.TradingDaysPerYear * float64(minutesPerTradingDay) / barDuration.Minutes()
+	if barDuration >= 24*time.Hour {
+		periodsPerYear = indicators.TradingDaysPerYear
+	}
+	fmt.Printf("\nsymbols, from the stored %v bars:\n", *timeframe)
+	for _, s := range names {
+		bars, err := storedBars(db, s, *timeframe, start, end)
+		if err != nil {
+			return err
+		}
+		line := fmt.Sprintf("  %-6v %6v bars", s, len(bars))
+		if v, ok := indicators.Volatility(bars, periodsPerYear); ok {
+			line += fmt.Sprintf(", annualized volatility %.1f%%", v*100)
+		}
+		if b, ok := indicators.Beta(bars, benchmarkBars); ok {
+			line += fmt.Sprintf(", beta %.2f", b)
+		}
+		if c, ok := indicators.Correlation(bars, benchmarkBars); ok {
+			line += fmt.Sprintf(", correlation %.2f", c)
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// writeRiskAdjusted writes the volatility, Sharpe ratio, drawdown, beta and
+// correlation of the daily returns of the trades. Each day the benchmark
+// traded is a day of returns, including days without trades.
+func writeRiskAdjusted(w io.Writer, byDay map[string][]*purchase.Purchase, benchmark []alpaca.Bar, symbol string, capital float64, start time.Time) {
+	var days []string
+	benchmarkReturns := map[string]float64{}
+	for i := 1; i < len(benchmark); i++ {
+		day := time.Unix(benchmark[i].Time, 0).In(EST)
+		if day.Before(start) || benchmark[i-1].Close <= 0 {
+			continue
+		}
+		d := day.Format("2006-01-02")
+		days = append(days, d)
+		benchmarkReturns[d] = float64(benchmark[i].Close)/float64(benchmark[i-1].Close) - 1
+	}
+	// Trades on days the benchmark has no bar for are still counted.
+	for d := range byDay {
+		if _, ok := benchmarkReturns[d]; !ok {
+			days = append(days, d)
+		}
+	}
+	sort.Strings(days)
+
+	var returns, matched, matchedBenchmark []float64
+	total := decimal.Zero
+	var peak, maxDrawdown float64
+	var trades int
+	for _, d := range days {
+		s := newArmStats(byDay[d])
+		trades += s.trades
+		total = total.Add(s.profitLoss)
+		pl, _ := s.profitLoss.Float64()
+		r := pl / capital
+		returns = append(returns, r)
+		if b, ok := benchmarkReturns[d]; ok {
+			matched = append(matched, r)
+			matchedBenchmark = append(matchedBenchmark, b)
+		}
+		cumulative, _ := total.Float64()
+		peak = math.Max(peak, cumulative)
+		maxDrawdown = math.Max(maxDrawdown, peak-cumulative)
+	}
+
+	fmt.Fprintf(w, "  %v trades over %v days, P/L $%v, %.3f%% of $%v\n", trades, len(days), total.StringFixed(2), floatOf(total)/capital*100, capital)
+	mean := indicators.Mean(returns)
+	fmt.Fprintf(w, "  mean daily return %.4f%%\n", mean*100)
+	if sd, ok := indicators.StdDev(returns); ok {
+		annualized := sd * math.Sqrt(indicators.TradingDaysPerYear)
+		fmt.Fprintf(w, "  daily volatility %.4f%%, annualized %.2f%%\n", sd*100, annualized*100)
+		if sd > 0 {
+			fmt.Fprintf(w, "  Sharpe ratio %.2f (annualized, no risk free rate)\n", mean/sd*math.Sqrt(indicators.TradingDaysPerYear))
+		}
+	}
+	fmt.Fprintf(w, "  max drawdown $%.2f, %.3f%%\n", maxDrawdown, maxDrawdown/capital*100)
+	if b, ok := indicators.BetaOf(matched, matchedBenchmark); ok {
+		fmt.Fprintf(w, "  beta to %v %.3f\n", symbol, b)
+	}
+	if c, ok := indicators.CorrelationOf(matched, matchedBenchmark); ok {
+		fmt.Fprintf(w, "  correlation with %v %.3f\n", symbol, c)
+	}
+}
+
+// storedBars returns the stored bars of the symbol and timeframe in the
+// range. The same bar is stored each time it is evaluated, so only the latest
+// evaluation of each bar is kept.
+func storedBars(db database.Client, symbol, timeframe string, start, end time.Time) ([]alpaca.Bar, error) {
+	stored, err := db.Bars(symbol, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get stored bars of %v: %v", symbol, err)
+	}
+	var bars []alpaca.Bar
+	for _, b := range stored {
+		if b.Timeframe != timeframe {
+			continue
+		}
+		// The bars are ordered by bar time and then by evaluation.
+		if n := len(bars); n > 0 && bars[n-1].Time == b.Time {
+			bars[n-1] = b.Bar
+			continue
+		}
+		bars = append(bars, b.Bar)
+	}
+	return bars, nil
+}
+
+// dailyCloses returns a bar for each day of the bars, whose close is the
+// close of the day's last bar and whose time is the start of the day.
+func dailyCloses(bars []alpaca.Bar) []alpaca.Bar {
+	var daily []alpaca.Bar
+	var lastDay string
+	for _, b := range bars {
+		t := time.Unix(b.Time, 0).In(EST)
+		day := t.Format("2006-01-02")
+		if day != lastDay {
+			start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, EST)
+			daily = append(daily, alpaca.Bar{Time: start.Unix(), Open: b.Open, High: b.High, Low: b.Low})
+			lastDay = day
+		}
+		d := &daily[len(daily)-1]
+		d.Close = b.Close
+		d.Volume += b.Volume
+		if b.High > d.High {
+			d.High = b.High
+		}
+		if b.Low < d.Low {
+			d.Low = b.Low
+		}
+	}
+	return daily
+}
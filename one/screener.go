@@ -0,0 +1,250 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+)
+
+var (
+	screenerUniverse  = flag.String("screener_universe", "", "When set, a comma separated list of symbols which is screened before the open. The top screener_top_n symbols are traded instead of stock_symbol, each by its own client with the same strategy.")
+	screenerTopN      = flag.Int("screener_top_n", 3, "The number of symbols selected by the screener.")
+	screenerRankBy    = flag.String("screener_rank_by", "volume,gap,atr", "The comma separated criteria the screener ranks symbols by: volume (previous day volume), gap (absolute gap % from the previous close) and atr (average true range as a % of the previous close). A symbol's score is the sum of its rank for each criterion.")
+	screenerATRDays   = flag.Int("screener_atr_days", 14, "The number of days the average true range is computed over.")
+	screenerMinPrice  = flag.Float64("screener_min_price", 5, "Symbols whose previous close is below this price are not selected.")
+	screenerMaxPrice  = flag.Float64("screener_max_price", 0, "When positive, symbols whose previous close is above this price are not selected.")
+	screenerMinVolume = flag.Int("screener_min_volume", 1000000, "Symbols whose previous day volume is below this are not selected.")
+)
+
+const (
+	// dayTimeframe is the timeframe of the bars used by the screener.
+	dayTimeframe = "1D"
+
+	// maxBarsSymbols is the maximum number of symbols bars can be requested
+	// for at once.
+	maxBarsSymbols = 200
+)
+
+// screenerCriteria are the criteria symbols can be ranked by, and how each
+// criterion's value is read from a candidate. Larger values rank higher.
+var screenerCriteria = map[string]func(*candidate) float64{
+	"volume": func(c *candidate) float64 { return float64(c.volume) },
+	"gap":    func(c *candidate) float64 { return math.Abs(c.gapPercent) },
+	"atr":    func(c *candidate) float64 { return c.atrPercent },
+}
+
+// candidate is a symbol being screened.
+type candidate struct {
+	symbol     string
+	prevClose  float64
+	volume     int32
+	gapPercent float64
+	atrPercent float64
+	ranks      map[string]int
+	score      int
+}
+
+func (c *candidate) String() string {
+	var ranks []string
+	for _, name := range rankCriteria() {
+		ranks = append(ranks, fmt.Sprintf("%v #%v", name, c.ranks[name]))
+	}
+	return fmt.Sprintf("%v: previous close %.2f, volume %v, gap %+.2f%%, ATR %.2f%% (%v, score %v)",
+		c.symbol, c.prevClose, c.volume, c.gapPercent, c.atrPercent, strings.Join(ranks, ", "), c.score)
+}
+
+// newScreenedClients returns a client for each symbol selected by the
+// screener.
+func newScreenedClients(cfg ClientConfig) ([]*client, error) {
+	if *watchlistName != "" || *experimentArmB != "" || cfg.Backtest {
+		return nil, fmt.Errorf("the screener cannot be run with a watchlist, an experiment or a backtest")
+	}
+	symbols, err := screen(alpaca.NewClient(common.Credentials()), parseSymbols(*screenerUniverse), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var clients []*client
+	for _, s := range symbols {
+		c, err := newSymbolClient(s, cfg)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+// rankCriteria returns the criteria set with screener_rank_by.
+func rankCriteria() []string {
+	var names []string
+	for _, name := range strings.Split(*screenerRankBy, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseSymbols returns the symbols of a comma separated list.
+func parseSymbols(list string) []string {
+	var symbols []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.ToUpper(strings.TrimSpace(s)); s != "" {
+			symbols = append(symbols, s)
+		}
+	}
+	return symbols
+}
+
+// screen ranks the universe and returns the top screener_top_n symbols. The
+// selection and the reason for it are logged.
+func screen(alpacaClient *alpaca.Client, universe []string, now time.Time) ([]string, error) {
+	for _, name := range rankCriteria() {
+		if _, ok := screenerCriteria[name]; !ok {
+			return nil, fmt.Errorf("unknown screener criterion %q", name)
+		}
+	}
+	bars, err := dailyBars(alpacaClient, universe, *screenerATRDays+1, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*candidate
+	excluded := map[string][]string{}
+	for _, symbol := range universe {
+		c, reason := newCandidate(symbol, bars[symbol])
+		if reason == "" {
+			c.gapPercent, reason = gapPercent(alpacaClient, c)
+		}
+		if reason != "" {
+			excluded[reason] = append(excluded[reason], symbol)
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+	for reason, symbols := range excluded {
+		log.Printf("screener excluded %v: %v", strings.Join(symbols, ", "), reason)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no symbols passed the screener")
+	}
+
+	rankCandidates(candidates)
+	if len(candidates) > *screenerTopN {
+		candidates = candidates[:*screenerTopN]
+	}
+	var symbols []string
+	for i, c := range candidates {
+		log.Printf("screener selected #%v %v", i+1, c)
+		symbols = append(symbols, c.symbol)
+	}
+	return symbols, nil
+}
+
+// dailyBars returns the latest n completed daily bars of each symbol. Today's
+// bar is left out since it is incomplete.
+func dailyBars(alpacaClient *alpaca.Client, symbols []string, n int, now time.Time) (map[string][]alpaca.Bar, error) {
+	today := time.Date(now.In(EST).Year(), now.In(EST).Month(), now.In(EST).Day(), 0, 0, 0, 0, EST)
+	limit := n + 1
+	bars := map[string][]alpaca.Bar{}
+	for i := 0; i < len(symbols); i += maxBarsSymbols {
+		end := i + maxBarsSymbols
+		if end > len(symbols) {
+			end = len(symbols)
+		}
+		got, err := alpacaClient.ListBars(symbols[i:end], alpaca.ListBarParams{
+			Timeframe: dayTimeframe,
+			EndDt:     &now,
+			Limit:     &limit,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get daily bars: %v", err)
+		}
+		for symbol, b := range got {
+			if len(b) > 0 && !time.Unix(b[len(b)-1].Time, 0).Before(today) {
+				b = b[:len(b)-1]
+			}
+			if len(b) > n {
+				b = b[len(b)-n:]
+			}
+			bars[symbol] = b
+		}
+	}
+	return bars, nil
+}
+
+// newCandidate returns the candidate for the symbol's daily bars, or the
+// reason it is excluded.
+func newCandidate(symbol string, bars []alpaca.Bar) (*candidate, string) {
+	if len(bars) < 2 {
+		return nil, "not enough daily bars"
+	}
+	prev := bars[len(bars)-1]
+	c := &candidate{
+		symbol:    symbol,
+		prevClose: float64(prev.Close),
+		volume:    prev.Volume,
+	}
+	switch {
+	case c.prevClose < *screenerMinPrice:
+		return nil, fmt.Sprintf("previous close below %v", *screenerMinPrice)
+	case *screenerMaxPrice > 0 && c.prevClose > *screenerMaxPrice:
+		return nil, fmt.Sprintf("previous close above %v", *screenerMaxPrice)
+	case int(c.volume) < *screenerMinVolume:
+		return nil, fmt.Sprintf("previous day volume below %v", *screenerMinVolume)
+	}
+	c.atrPercent = averageTrueRange(bars) / c.prevClose * 100
+	return c, ""
+}
+
+// averageTrueRange returns the average true range of the bars. The first bar
+// only provides the close for the second bar's true range.
+func averageTrueRange(bars []alpaca.Bar) float64 {
+	var sum float64
+	for i := 1; i < len(bars); i++ {
+		high, low, prevClose := float64(bars[i].High), float64(bars[i].Low), float64(bars[i-1].Close)
+		sum += math.Max(high-low, math.Max(math.Abs(high-prevClose), math.Abs(low-prevClose)))
+	}
+	return sum / float64(len(bars)-1)
+}
+
+// gapPercent returns the percentage the latest trade price has moved from the
+// previous close, or the reason it is unavailable.
+func gapPercent(alpacaClient *alpaca.Client, c *candidate) (float64, string) {
+	t, err := alpacaClient.GetLastTrade(c.symbol)
+	if err != nil || t == nil {
+		return 0, "no latest trade"
+	}
+	return (float64(t.Last.Price) - c.prevClose) / c.prevClose * 100, ""
+}
+
+// rankCandidates ranks the candidates by each criterion and sorts them by the
+// sum of their ranks, best first.
+func rankCandidates(candidates []*candidate) {
+	for _, name := range rankCriteria() {
+		value := screenerCriteria[name]
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return value(candidates[i]) > value(candidates[j])
+		})
+		for i, c := range candidates {
+			if c.ranks == nil {
+				c.ranks = map[string]int{}
+			}
+			c.ranks[name] = i + 1
+			c.score += i + 1
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score < candidates[j].score
+		}
+		return candidates[i].volume > candidates[j].volume
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	shadowParams = flag.String("shadow_params", "", "When set, a shadow strategy evaluates signals on live data alongside the trading strategy and simulates its fills locally instead of placing orders. The shadow strategy overrides the strategy flags with this comma separated list, e.g. \"min_slope_required_to_buy=1.0\".")
+)
+
+// newShadowClient returns a client which computes signals from live data but
+// simulates its orders. Its hypothetical purchases are stored with the
+// strategy name suffixed by "/shadow".
+func newShadowClient(cfg ClientConfig) (*client, error) {
+	if cfg.Backtest {
+		return nil, fmt.Errorf("shadow strategies cannot be run as a backtest")
+	}
+	cfg, err := cfg.forSymbol(*stockSymbol)
+	if err != nil {
+		return nil, err
+	}
+	params, err := parseStrategyParams(cfg.Params, *shadowParams)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shadow_params: %v", err)
+	}
+	cfg.Params = params
+	c, err := new(*stockSymbol, *strategyName+"/shadow", cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.shadow = true
+	log.Printf("shadow strategy %v: %+v", c.strategy, params)
+	return c, nil
+}
+
+// latestPrice returns the price of the latest trade of the symbol.
+func (c *client) latestPrice() (decimal.Decimal, error) {
+	t, err := c.alpacaClient.GetLastTrade(c.stockSymbol)
+	if err != nil {
+		return decimal.Decimal{}, fmt.Errorf("unable to get last trade: %v", err)
+	}
+	return decimal.NewFromFloat32(t.Last.Price), nil
+}
+
+// shadowPlaceOrder simulates placing an order. Orders are filled using the
+// latest trade price.
+func (c *client) shadowPlaceOrder(req *alpaca.PlaceOrderRequest) (*alpaca.Order, error) {
+	price, err := c.latestPrice()
+	if err != nil {
+		return nil, err
+	}
+	c.shadowOrderID++
+	now := time.Now()
+	o := &alpaca.Order{
+		ID:           fmt.Sprintf("shadow-%v-%v", now.Unix(), c.shadowOrderID),
+		CreatedAt:    now,
+		SubmittedAt:  now,
+		Symbol:       *req.AssetKey,
+		Qty:          req.Qty,
+		Side:         req.Side,
+		Type:         req.Type,
+		TimeInForce:  req.TimeInForce,
+		LimitPrice:   req.LimitPrice,
+		StopPrice:    req.StopPrice,
+		TrailPercent: req.TrailPercent,
+		Status:       "new",
+	}
+	if req.OrderClass == alpaca.Bracket {
+		o.Legs = simulatedBracketLegs(req, o.ID)
+	}
+	if req.OrderClass == alpaca.Oco {
+		o.LimitPrice = req.TakeProfit.LimitPrice
+		o.Legs = &[]alpaca.Order{{
+			Side:       req.Side,
+			Type:       alpaca.StopLimit,
+			StopPrice:  req.StopLoss.StopPrice,
+			LimitPrice: req.StopLoss.LimitPrice,
+			Status:     "held",
+		}}
+	}
+	shadowFill(o, price, now)
+	return o, nil
+}
+
+// shadowOrder is used in place of order() for shadow strategies. Unfilled
+// orders are checked against the latest trade price.
+func (c *client) shadowOrder(id string) *alpaca.Order {
+	for _, p := range c.purchases {
+		var o *alpaca.Order
+		switch {
+		case p.BuyOrder != nil && p.BuyOrder.ID == id:
+			o = p.BuyOrder
+		case p.SellOrder != nil && p.SellOrder.ID == id:
+			o = p.SellOrder
+		default:
+			continue
+		}
+		if o.Status != "new" {
+			return o
+		}
+		price, err := c.latestPrice()
+		if err != nil {
+			log.Printf("unable to check shadow order %q: %v", id, err)
+			return nil
+		}
+		shadowFill(o, price, time.Now())
+		return o
+	}
+	log.Printf("unable to find shadow order %q", id)
+	return nil
+}
+
+// shadowFill fills the order if it would have been filled at the price.
+// Market orders always fill and limit buys fill at or below their limit. OCO
+// sells fill when the price reaches the take profit limit or the stop price,
+// unless the price is already beyond the stop's limit. Stop and trailing stop
+// sells fill at or below their stop, after a trailing stop follows the price.
+func shadowFill(o *alpaca.Order, price decimal.Decimal, now time.Time) {
+	raiseTrailingStop(o, price)
+	switch {
+	case o.Type == alpaca.Market:
+	case o.Side == alpaca.Sell && o.StopPrice != nil && (o.Type == alpaca.Stop || o.Type == alpaca.TrailingStop):
+		if price.GreaterThan(*o.StopPrice) {
+			return
+		}
+	case o.Side == alpaca.Buy && o.LimitPrice != nil && price.LessThanOrEqual(*o.LimitPrice):
+	case o.Side == alpaca.Sell && o.LimitPrice != nil && price.GreaterThanOrEqual(*o.LimitPrice):
+	case o.Side == alpaca.Sell && o.Legs != nil && len(*o.Legs) > 0:
+		stop := &(*o.Legs)[0]
+		if price.GreaterThan(*stop.StopPrice) || price.LessThan(*stop.LimitPrice) {
+			return
+		}
+		stop.Status = filled
+		stop.FilledQty = o.Qty
+		stop.FilledAvgPrice = &price
+		stop.FilledAt = &now
+	default:
+		return
+	}
+	o.Status = filled
+	o.FilledQty = o.Qty
+	o.FilledAvgPrice = &price
+	o.FilledAt = &now
+}
+
+// shadowCloseOutTrading simulates selling every open shadow purchase at the
+// latest price.
+func (c *client) shadowCloseOutTrading() {
+	price, err := c.latestPrice()
+	if err != nil {
+		log.Printf("unable to close out shadow trading: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, p := range c.purchases {
+		if !p.BuyFilled() || p.SellFilled() {
+			continue
+		}
+		c.shadowOrderID++
+		p.SellOrder = &alpaca.Order{
+			ID:        fmt.Sprintf("shadow-%v-%v", now.Unix(), c.shadowOrderID),
+			CreatedAt: now,
+			Symbol:    c.stockSymbol,
+			Qty:       p.BuyOrder.FilledQty,
+			Side:      alpaca.Sell,
+			Type:      alpaca.Market,
+			Status:    "new",
+		}
+		shadowFill(p.SellOrder, price, now)
+		c.watchExit(p)
+		if err := c.dbClient.Update(p); err != nil {
+			log.Printf("unable to update shadow close out:%v\n%+v", err, p)
+		}
+	}
+	log.Printf("shadow trading for %v is closed out", c.strategy)
+}
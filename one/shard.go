@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// shard runs all work on the clients trading a symbol on its own goroutine.
+// A client's purchases are only touched by its shard, so they need no locks,
+// and a symbol with slow orders does not hold up the other symbols.
+type shard struct {
+	symbol string
+
+	// work are functions which must run on the shard. The caller waits for
+	// them to finish.
+	work chan func()
+
+	// ticks holds the next tick of the clients. A tick waits for the
+	// previous one to finish, and a tick is skipped if one is still waiting.
+	ticks chan func()
+}
+
+// shards are the shards by symbol. They are only created and assigned by the
+// main goroutine.
+var shards = map[string]*shard{}
+
+func newShard(symbol string) *shard {
+	s := &shard{
+		symbol: symbol,
+		work:   make(chan func()),
+		ticks:  make(chan func(), 1),
+	}
+	go s.run()
+	return s
+}
+
+// run runs the work and ticks of the shard as they arrive.
+func (s *shard) run() {
+	for {
+		select {
+		case f := <-s.work:
+			f()
+		case f := <-s.ticks:
+			f()
+		}
+	}
+}
+
+// do runs f on the shard and waits for it to finish.
+func (s *shard) do(f func()) {
+	done := make(chan struct{})
+	s.work <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+}
+
+// tick queues f as the next tick. It returns false if the previous tick has
+// not started yet, in which case f is dropped.
+func (s *shard) tick(f func()) bool {
+	select {
+	case s.ticks <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// assignShards gives each client the shard of its symbol, starting shards
+// for new symbols.
+func assignShards(clients []*client) {
+	for _, c := range clients {
+		if c.shard != nil {
+			continue
+		}
+		s, ok := shards[c.stockSymbol]
+		if !ok {
+			s = newShard(c.stockSymbol)
+			shards[c.stockSymbol] = s
+		}
+		c.shard = s
+	}
+}
+
+// do runs f on the client's shard and waits for it to finish. Clients without
+// a shard, e.g. in backtests, run f directly.
+func (c *client) do(f func()) {
+	if c.shard == nil {
+		f()
+		return
+	}
+	c.shard.do(f)
+}
+
+// byShard groups the clients by their shard, keeping the order of the
+// clients of each shard.
+func byShard(clients []*client) ([]*shard, map[*shard][]*client) {
+	var order []*shard
+	groups := map[*shard][]*client{}
+	for _, c := range clients {
+		if _, ok := groups[c.shard]; !ok {
+			order = append(order, c.shard)
+		}
+		groups[c.shard] = append(groups[c.shard], c)
+	}
+	return order, groups
+}
+
+// eachClient runs f for every client on its shard. The shards run f in
+// parallel, and eachClient returns once all of them are done.
+func eachClient(clients []*client, f func(c *client)) {
+	order, groups := byShard(clients)
+	var wg sync.WaitGroup
+	for _, s := range order {
+		group := groups[s]
+		wg.Add(1)
+		go func(s *shard) {
+			defer wg.Done()
+			run := func() {
+				for _, c := range group {
+					f(c)
+				}
+			}
+			if s == nil {
+				run()
+				return
+			}
+			s.do(run)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// tickClients runs the clients at t on their shards without waiting for them.
+// A shard whose previous tick is still waiting skips this one.
+func tickClients(clients []*client, t time.Time) {
+	order, groups := byShard(clients)
+	for _, s := range order {
+		group := groups[s]
+		run := func() {
+			for _, c := range group {
+				c.run(t)
+			}
+		}
+		if s == nil {
+			go run()
+			continue
+		}
+		if !s.tick(run) {
+			log.Printf("%v is still busy, skipping the tick @ %v", s.symbol, t)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// shardBenchmarkCommand is the command which measures how many symbols can be
+// traded by running many simulated symbols over the backtest file, once one
+// symbol at a time and once with a shard per symbol, e.g.
+// "one -backtest_file=SPY_sample.txt -backtest_starttime="2020-01-02 04:00:00" -purchase_quanity=10 shard-benchmark -symbols 100".
+// BenchmarkShards runs the same comparison on a generated day, e.g.
+// "go test -run none -bench Shards -cpu 1,4".
+const shardBenchmarkCommand = "shard-benchmark"
+
+// shardBenchmark runs the benchmark and prints the throughput of each run.
+func shardBenchmark(args []string) error {
+	fs := flag.NewFlagSet(shardBenchmarkCommand, flag.ContinueOnError)
+	symbols := fs.Int("symbols", 100, "The number of simulated symbols. Every symbol trades the history of the backtest file.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	h, err := historicalData()
+	if err != nil {
+		return fmt.Errorf("unable to read history: %v", err)
+	}
+	// The clients log every tick, which would dominate the measurement.
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	start, err := backtestStart()
+	if err != nil {
+		return err
+	}
+	cfg := flagClientConfig()
+	cfg.Backtest = true
+
+	clients, err := newShardBenchmarkClients(h, cfg, start, *symbols)
+	if err != nil {
+		return err
+	}
+	begin := time.Now()
+	ticks := stepUnsharded(clients)
+	printShardBenchmark("one goroutine", *symbols, ticks, time.Since(begin))
+
+	if clients, err = newShardBenchmarkClients(h, cfg, start, *symbols); err != nil {
+		return err
+	}
+	begin = time.Now()
+	ticks = stepSharded(clients)
+	printShardBenchmark("a shard per symbol", *symbols, ticks, time.Since(begin))
+	return nil
+}
+
+// newShardBenchmarkClients returns a backtest client for each of the
+// simulated symbols, which all trade the history from start.
+func newShardBenchmarkClients(h *history, cfg ClientConfig, start time.Time, symbols int) ([]*client, error) {
+	var clients []*client
+	for i := 0; i < symbols; i++ {
+		c, err := newFakeAt(h, cfg, start)
+		if err != nil {
+			return nil, err
+		}
+		c.stockSymbol = fmt.Sprintf("SIM%03d", i)
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+// stepUnsharded steps the clients one at a time until the history ends and
+// returns the number of ticks.
+func stepUnsharded(clients []*client) int {
+	ticks := 0
+	for stepped := true; stepped; ticks++ {
+		stepped = false
+		for _, c := range clients {
+			if c.step() {
+				stepped = true
+			}
+		}
+	}
+	return ticks
+}
+
+// stepSharded steps each client on its own shard, all in parallel, until the
+// history ends and returns the number of ticks.
+func stepSharded(clients []*client) int {
+	var symbolShards []*shard
+	for _, c := range clients {
+		symbolShards = append(symbolShards, newShard(c.stockSymbol))
+	}
+	ticks := 0
+	for stepped := true; stepped; ticks++ {
+		var mu sync.Mutex
+		stepped = false
+		var wg sync.WaitGroup
+		for i, c := range clients {
+			wg.Add(1)
+			go func(s *shard, c *client) {
+				defer wg.Done()
+				s.do(func() {
+					if c.step() {
+						mu.Lock()
+						stepped = true
+						mu.Unlock()
+					}
+				})
+			}(symbolShards[i], c)
+		}
+		wg.Wait()
+	}
+	return ticks
+}
+
+// printShardBenchmark prints the throughput of a benchmark run.
+func printShardBenchmark(name string, symbols, ticks int, elapsed time.Duration) {
+	fmt.Printf("%v: %v ticks of %v symbols in %v, %.0f symbol ticks/s\n",
+		name, ticks, symbols, elapsed.Round(time.Millisecond), float64(ticks*symbols)/elapsed.Seconds())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// shardBenchmarkHistory returns a trading day of minutes whose price walks
+// randomly from $100.
+func shardBenchmarkHistory(start time.Time) *history {
+	r := rand.New(rand.NewSource(1))
+	h := newHistory()
+	price := 100.0
+	for t := start; t.Before(start.Add(390 * time.Minute)); t = t.Add(time.Minute) {
+		price += r.Float64() - 0.5
+		h.epochToTickerData[t.Unix()] = &historicalTickerData{
+			High:   decimal.NewFromFloat(price + 0.05).Round(2),
+			Low:    decimal.NewFromFloat(price - 0.05).Round(2),
+			Close:  decimal.NewFromFloat(price).Round(2),
+			Volume: decimal.NewFromInt(10000),
+		}
+		h.endTime = t
+	}
+	return h
+}
+
+// BenchmarkShards steps 100 simulated symbols through a trading day one at a
+// time and with a shard per symbol, as the shard-benchmark command does.
+func BenchmarkShards(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	const symbols = 100
+	start := time.Date(2021, 1, 4, 9, 30, 0, 0, EST)
+	h := shardBenchmarkHistory(start)
+	cfg := flagClientConfig()
+	cfg.Backtest = true
+
+	for _, run := range []struct {
+		name string
+		step func([]*client) int
+	}{
+		{"unsharded", stepUnsharded},
+		{"sharded", stepSharded},
+	} {
+		b.Run(run.name, func(b *testing.B) {
+			b.StopTimer()
+			symbolTicks := 0
+			var elapsed time.Duration
+			for i := 0; i < b.N; i++ {
+				clients, err := newShardBenchmarkClients(h, cfg, start, symbols)
+				if err != nil {
+					b.Fatal(err)
+				}
+				begin := time.Now()
+				b.StartTimer()
+				symbolTicks += run.step(clients) * symbols
+				b.StopTimer()
+				elapsed += time.Since(begin)
+			}
+			b.ReportMetric(float64(symbolTicks)/elapsed.Seconds(), "symbol-ticks/s")
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+var (
+	sheetsSpreadsheetID = flag.String("sheets_spreadsheet_id", "", "When set, each completed trade is appended to this Google Sheet.")
+	sheetsSheetName     = flag.String("sheets_sheet_name", "Trades", "The name of the sheet within the spreadsheet which trades are appended to.")
+	sheetsCredentials   = flag.String("sheets_credentials_file", "", "The JSON key file of the Google service account used to write to the sheet. The spreadsheet must be shared with the service account's email.")
+	sheetsBackfillSince = flag.String("sheets_backfill_since", "", "When set (format: 2006-01-02), trades completed since this date which are missing from the sheet are appended from the database at startup.")
+)
+
+const (
+	sheetsScope = "https://www.googleapis.com/auth/spreadsheets"
+	sheetsAPI   = "https://sheets.googleapis.com/v4/spreadsheets/"
+)
+
+// sheetsHeader is the first row of the trade log. The purchase ID is the
+// first column so backfills can skip trades which are already logged.
+var sheetsHeader = []string{"Purchase ID", "Strategy", "Symbol", "Qty", "Bought At", "Buy Price", "Sold At", "Sell Price", "Profit/Loss"}
+
+// serviceAccount is the subset of a Google service account key file needed
+// to request access tokens.
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// sheetsClient appends rows to a Google Sheet as a service account.
+type sheetsClient struct {
+	spreadsheetID string
+	sheet         string
+	account       *serviceAccount
+	key           *rsa.PrivateKey
+	httpClient    *http.Client
+	api           string
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+
+	// appendMu orders the appends, so the header is only written once.
+	appendMu      sync.Mutex
+	headerChecked bool
+}
+
+var tradeLog *sheetsClient
+
+// newSheetsClient returns a client configured by flags, or nil if the trade
+// log is not enabled.
+func newSheetsClient() (*sheetsClient, error) {
+	if *sheetsSpreadsheetID == "" || *runBacktest {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(*sheetsCredentials)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sheets credentials: %v", err)
+	}
+	a := &serviceAccount{}
+	if err := json.Unmarshal(b, a); err != nil {
+		return nil, fmt.Errorf("unable to parse sheets credentials: %v", err)
+	}
+	if a.TokenURI == "" {
+		a.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(a.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("sheets credentials have no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse sheets private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("sheets private key is not an RSA key")
+	}
+	return &sheetsClient{
+		spreadsheetID: *sheetsSpreadsheetID,
+		sheet:         *sheetsSheetName,
+		account:       a,
+		key:           key,
+		httpClient:    &http.Client{Timeout: 30 * time.Second},
+		api:           sheetsAPI,
+	}, nil
+}
+
+// startTradeLog enables the trade log and backfills it if requested.
+func startTradeLog(db database.Client) error {
+	s, err := newSheetsClient()
+	if err != nil || s == nil {
+		return err
+	}
+	tradeLog = s
+	if *sheetsBackfillSince == "" {
+		return nil
+	}
+	since, err := time.ParseInLocation("2006-01-02", *sheetsBackfillSince, BookkeepingTZ)
+	if err != nil {
+		return fmt.Errorf("invalid sheets_backfill_since: %v", err)
+	}
+	go func() {
+		if err := s.backfill(db, since, time.Now()); err != nil {
+			log.Printf("unable to backfill trade log: %v", err)
+		}
+	}()
+	return nil
+}
+
+// logTrade appends the completed purchase to the trade log, if enabled.
+// Shadow purchases are never logged since they are not real trades.
+func (c *client) logTrade(p *purchase.Purchase) {
+	if tradeLog == nil || c.shadow {
+		return
+	}
+	go func() {
+		if err := tradeLog.appendTrades([][]string{tradeRow(p)}); err != nil {
+			log.Printf("unable to log trade %d to sheet: %v", p.ID, err)
+		}
+	}()
+}
+
+// backfill appends the trades completed in [start, end) which are missing
+// from the sheet.
+func (s *sheetsClient) backfill(db database.Client, start, end time.Time) error {
+	purchases, err := db.PurchasesBetween(start, end)
+	if err != nil {
+		return err
+	}
+	logged, err := s.loggedIDs()
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, p := range purchases {
+		if p.Shadow || !p.BuyFilled() || !p.SellFilled() || logged[p.ID] {
+			continue
+		}
+		rows = append(rows, tradeRow(p))
+	}
+	if len(rows) == 0 {
+		log.Printf("trade log backfill found no missing trades")
+		return nil
+	}
+	if err := s.appendTrades(rows); err != nil {
+		return err
+	}
+	log.Printf("trade log backfill appended %d trades", len(rows))
+	return nil
+}
+
+// tradeRow returns the trade log row of a completed purchase. Prices which
+// are not known are left empty, along with the profit/loss.
+func tradeRow(p *purchase.Purchase) []string {
+	row := []string{
+		strconv.FormatInt(p.ID, 10),
+		p.Strategy,
+		p.BuyOrder.Symbol,
+		p.SellOrder.FilledQty.String(),
+		"",
+		"",
+		"",
+		"",
+		"",
+	}
+	if p.BuyOrder.FilledAvgPrice != nil {
+		row[5] = p.BuyOrder.FilledAvgPrice.StringFixed(2)
+	}
+	if p.SellOrder.FilledAvgPrice != nil {
+		row[7] = p.SellOrder.FilledAvgPrice.StringFixed(2)
+	}
+	if p.BuyOrder.FilledAvgPrice != nil && p.SellOrder.FilledAvgPrice != nil {
+		row[8] = p.RealizedProfitLoss().StringFixed(2)
+	}
+	if p.BuyOrder.FilledAt != nil {
+		row[4] = p.BuyOrder.FilledAt.In(EST).Format("2006-01-02 15:04:05")
+	}
+	if p.SellOrder.FilledAt != nil {
+		row[6] = p.SellOrder.FilledAt.In(EST).Format("2006-01-02 15:04:05")
+	}
+	return row
+}
+
+// loggedIDs returns the purchase IDs already in the sheet.
+func (s *sheetsClient) loggedIDs() (map[int64]bool, error) {
+	var resp struct {
+		Values [][]string `json:"values"`
+	}
+	if err := s.do(http.MethodGet, s.valuesURL(s.sheet+"!A:A", ""), nil, &resp); err != nil {
+		return nil, err
+	}
+	ids := map[int64]bool{}
+	for _, row := range resp.Values {
+		if len(row) == 0 {
+			continue
+		}
+		if id, err := strconv.ParseInt(row[0], 10, 64); err == nil {
+			ids[id] = true
+		} else if row[0] == sheetsHeader[0] {
+			// No purchase has ID 0, so it marks that the header exists.
+			ids[0] = true
+		}
+	}
+	return ids, nil
+}
+
+// appendTrades appends the trade rows, after the header if the sheet is
+// empty.
+func (s *sheetsClient) appendTrades(rows [][]string) error {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	if !s.headerChecked {
+		logged, err := s.loggedIDs()
+		if err != nil {
+			return err
+		}
+		if len(logged) == 0 {
+			rows = append([][]string{sheetsHeader}, rows...)
+		}
+		s.headerChecked = true
+	}
+	return s.append(rows)
+}
+
+// append appends rows after the last row of the sheet.
+func (s *sheetsClient) append(rows [][]string) error {
+	body, err := json.Marshal(map[string][][]string{"values": rows})
+	if err != nil {
+		return err
+	}
+	u := s.valuesURL(s.sheet+"!A1", ":append?valueInputOption=USER_ENTERED&insertDataOption=INSERT_ROWS")
+	return s.do(http.MethodPost, u, body, nil)
+}
+
+// valuesURL returns the URL of the values API for a range.
+func (s *sheetsClient) valuesURL(rng, suffix string) string {
+	return s.api + url.PathEscape(s.spreadsheetID) + "/values/" + url.PathEscape(rng) + suffix
+}
+
+// do makes an authorized request to the Sheets API and decodes the JSON
+// response into out, if it is non-nil.
+func (s *sheetsClient) do(method, u string, body []byte, out interface{}) error {
+	token, err := s.token()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sheets API returned %v: %s", resp.Status, b)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// token returns an access token, requesting a new one when the previous token
+// is about to expire.
+func (s *sheetsClient) token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessToken != "" && time.Now().Before(s.expiry.Add(-time.Minute)) {
+		return s.accessToken, nil
+	}
+
+	assertion, err := s.signedJWT(time.Now())
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.httpClient.PostForm(s.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to request access token: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("access token request returned %v: %s", resp.Status, b)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return "", fmt.Errorf("unable to parse access token: %v", err)
+	}
+	s.accessToken = t.AccessToken
+	s.expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	return s.accessToken, nil
+}
+
+// signedJWT returns the JWT used to request an access token for the service
+// account.
+func (s *sheetsClient) signedJWT(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.account.ClientEmail,
+		"scope": sheetsScope,
+		"aud":   s.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign JWT: %v", err)
+	}
+	return strings.Join([]string{unsigned, enc.EncodeToString(sig)}, "."), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+// fakeSheets is a token endpoint and Sheets API which checks the service
+// account's JWT and the access token.
+type fakeSheets struct {
+	t   *testing.T
+	key *rsa.PublicKey
+
+	mu       sync.Mutex
+	tokens   int
+	rows     [][]string
+	appended [][][]string
+}
+
+func (f *fakeSheets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/token" {
+		f.tokens++
+		if got := r.FormValue("grant_type"); got != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			f.t.Errorf("grant_type = %q, want the JWT bearer grant", got)
+		}
+		f.checkJWT(r.FormValue("assertion"), "http://"+r.Host+"/token")
+		w.Write([]byte(`{"access_token": "token", "expires_in": 3600, "token_type": "Bearer"}`))
+		return
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer token" {
+		f.t.Errorf("Authorization = %q, want the access token", got)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/values/Trades!A:A"):
+		var ids [][]string
+		for _, row := range f.rows {
+			ids = append(ids, row[:1])
+		}
+		json.NewEncoder(w).Encode(map[string][][]string{"values": ids})
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/values/Trades!A1:append"):
+		var body struct {
+			Values [][]string `json:"values"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			f.t.Errorf("unable to decode append: %v", err)
+		}
+		f.rows = append(f.rows, body.Values...)
+		f.appended = append(f.appended, body.Values)
+		w.Write([]byte(`{}`))
+	default:
+		f.t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	}
+}
+
+// checkJWT checks the signature and claims of the service account's JWT.
+func (f *fakeSheets) checkJWT(jwt, aud string) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		f.t.Errorf("JWT %q does not have 3 parts", jwt)
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		f.t.Errorf("unable to decode JWT signature: %v", err)
+		return
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(f.key, crypto.SHA256, sum[:], sig); err != nil {
+		f.t.Errorf("JWT signature does not verify: %v", err)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		f.t.Errorf("unable to decode JWT claims: %v", err)
+		return
+	}
+	var claims struct {
+		Iss   string `json:"iss"`
+		Scope string `json:"scope"`
+		Aud   string `json:"aud"`
+		Iat   int64  `json:"iat"`
+		Exp   int64  `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		f.t.Errorf("unable to parse JWT claims: %v", err)
+	}
+	if claims.Iss != "trader@example.iam.gserviceaccount.com" || claims.Scope != sheetsScope || claims.Aud != aud || claims.Exp-claims.Iat != 3600 {
+		f.t.Errorf("JWT claims = %+v, want the service account, sheets scope and token URI for an hour", claims)
+	}
+}
+
+// newTestSheetsClient returns a sheets client made from a service account key
+// file whose token URI and API are served by a fakeSheets.
+func newTestSheetsClient(t *testing.T) (*sheetsClient, *fakeSheets) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSheets{t: t, key: &key.PublicKey}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	dir, err := ioutil.TempDir("", "sheets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	credentials, err := json.Marshal(serviceAccount{
+		ClientEmail: "trader@example.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    server.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "credentials.json")
+	if err := ioutil.WriteFile(path, credentials, 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldID, oldCredentials := *sheetsSpreadsheetID, *sheetsCredentials
+	t.Cleanup(func() { *sheetsSpreadsheetID, *sheetsCredentials = oldID, oldCredentials })
+	*sheetsSpreadsheetID, *sheetsCredentials = "sheet", path
+
+	s, err := newSheetsClient()
+	if err != nil {
+		t.Fatalf("newSheetsClient() = %v", err)
+	}
+	s.api = server.URL + "/v4/spreadsheets/"
+	return s, f
+}
+
+func TestSheetsAppendTrades(t *testing.T) {
+	s, f := newTestSheetsClient(t)
+	for _, row := range [][]string{{"1", "slope"}, {"2", "slope"}} {
+		if err := s.appendTrades([][]string{row}); err != nil {
+			t.Fatalf("appendTrades() = %v", err)
+		}
+	}
+	if len(f.appended) != 2 || len(f.appended[0]) != 2 || f.appended[0][0][0] != sheetsHeader[0] || len(f.appended[1]) != 1 {
+		t.Errorf("appended %v, want the header before the first trade of the empty sheet only", f.appended)
+	}
+	if f.tokens != 1 {
+		t.Errorf("%v access tokens were requested, want 1 which is reused", f.tokens)
+	}
+}
+
+func TestTradeRowWithoutPrices(t *testing.T) {
+	bought := decimal.RequireFromString("100")
+	p := &purchase.Purchase{
+		ID:        3,
+		BuyOrder:  &alpaca.Order{Status: filled, Symbol: "SPY", FilledQty: decimal.NewFromInt(10), FilledAvgPrice: &bought},
+		SellOrder: &alpaca.Order{Status: filled, FilledQty: decimal.NewFromInt(10)},
+	}
+	row := tradeRow(p)
+	if row[5] != "100.00" || row[7] != "" || row[8] != "" {
+		t.Errorf("tradeRow() = %q, want the buy price and no sell price or profit/loss", row)
+	}
+}
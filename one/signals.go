@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ejbrever/trader/one/database"
+)
+
+var (
+	recordBlockedSignals = flag.Bool("record_blocked_signals", false, "If true, buy signals are evaluated even when a rule such as max_concurrent_purchases would block the purchase, and signals which are blocked are stored with the blocking rule. This requests bars every tick unless stream_bars is set.")
+)
+
+// Rules which block a buy signal.
+const (
+	ruleConcurrentPurchases = "max_concurrent_purchases"
+	ruleBlackout            = "blackout"
+	ruleUnrealizedLoss      = "max_unrealized_loss_per_position"
+	ruleBuyingPower         = "buying_power"
+	rulePatternDayTrader    = "pattern_day_trader"
+	ruleAccountUnavailable  = "account_unavailable"
+	ruleDrawdownBreaker     = "drawdown_breaker"
+	ruleDailyLoss           = "daily_loss_limit"
+	ruleKillSwitch          = "kill_switch"
+	ruleVolatility          = "volatility_filter"
+	rulePositionSize        = "position_size"
+	ruleMaxExposure         = "max_exposure"
+	ruleMaxVolume           = "max_volume_percent"
+)
+
+// entryBlock is a rule which blocked a buy.
+type entryBlock struct {
+	rule   string
+	detail string
+}
+
+// entryBlocked returns the rule blocking a buy at t, or nil if buying is
+// allowed. The cash check is made separately once the price is known.
+func (c *client) entryBlocked(t time.Time) *entryBlock {
+	// Queued buys count, since they will be placed.
+	if n := len(c.inProgressPurchases()) + c.orders.pendingBuys(); n >= c.cfg.MaxConcurrentPurchases {
+		return &entryBlock{ruleConcurrentPurchases, fmt.Sprintf("%v of %v purchases in progress", n, c.cfg.MaxConcurrentPurchases)}
+	}
+	if reason := c.blackedOut(t); reason != "" {
+		return &entryBlock{ruleBlackout, reason}
+	}
+	if kill.isEngaged() {
+		return &entryBlock{ruleKillSwitch, "the kill switch is engaged"}
+	}
+	switch c.breaker.trippedRule() {
+	case ruleDrawdownBreaker:
+		return &entryBlock{ruleDrawdownBreaker, "the drawdown breaker tripped"}
+	case ruleDailyLoss:
+		return &entryBlock{ruleDailyLoss, "the daily loss limit was hit"}
+	}
+	if unrealized != nil && unrealized.overLossLimit(c) {
+		return &entryBlock{ruleUnrealizedLoss, "a purchase is over the unrealized loss limit"}
+	}
+	return nil
+}
+
+// recordBlockedSignal publishes a buy signal which was blocked to the live
+// state, and stores it when record_blocked_signals is set.
+func (c *client) recordBlockedSignal(t time.Time, price float32, b *entryBlock) {
+	c.publishSignal(t, price, "blocked", b.rule+": "+b.detail)
+	if !c.cfg.RecordBlockedSignals {
+		return
+	}
+	s := &database.BlockedSignal{
+		Time:     t,
+		Strategy: c.strategy,
+		Symbol:   c.stockSymbol,
+		Rule:     b.rule,
+		Detail:   b.detail,
+		Price:    float64(price),
+	}
+	if err := c.dbClient.InsertBlockedSignal(s); err != nil {
+		log.Printf("unable to record blocked signal: %v", err)
+	}
+	c.narrate(t, "did not buy %v although %v, blocked by %v: %v", c.stockSymbol, c.entryReason(), b.rule, b.detail)
+}
+
+// blockedSignalsSummary returns the number of blocked signals in [start, end)
+// by rule, e.g. "max_concurrent_purchases 12, buying_power 3".
+func blockedSignalsSummary(db database.Client, start, end time.Time) (string, error) {
+	signals, err := db.BlockedSignals(start, end)
+	if err != nil {
+		return "", err
+	}
+	counts := map[string]int{}
+	var rules []string
+	for _, s := range signals {
+		if counts[s.Rule] == 0 {
+			rules = append(rules, s.Rule)
+		}
+		counts[s.Rule]++
+	}
+	if len(rules) == 0 {
+		return "none", nil
+	}
+	sort.Slice(rules, func(i, j int) bool { return counts[rules[i]] > counts[rules[j]] })
+	var parts []string
+	for _, r := range rules {
+		parts = append(parts, fmt.Sprintf("%v %v", r, counts[r]))
+	}
+	return strings.Join(parts, ", "), nil
+}
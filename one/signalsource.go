@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	signalSource        = flag.String("signal_source", "", "When set, buy and sell signals are read from this file or http(s) URL instead of being computed by the slope strategy, e.g. the output of an external model. The entries still use the execution, brackets and risk controls of the trader. See signalsource.go for the format.")
+	signalSourceRefresh = flag.Duration("signal_source_refresh", 15*time.Second, "How often the signal_source is read again for new signals. Backtests read it once.")
+	signalMaxAge        = flag.Duration("signal_max_age", time.Minute, "A signal older than this when it is evaluated is ignored.")
+	signalMinConfidence = flag.Float64("signal_min_confidence", 0, "Buy signals with a lower confidence are ignored. Sell signals are always acted on.")
+)
+
+// The signal source holds JSON signals, either one per line or as an array:
+//
+//	{"time": "2020-01-02T10:31:00-05:00", "symbol": "SPY", "side": "buy",
+//	 "confidence": 0.82, "reason": "model v3 breakout"}
+//
+// A buy signal is a buy of the symbol, sized and protected like the buys of
+// the slope strategy. A sell signal sells the open purchases of the symbol at
+// market. Each signal is acted on once, at the first evaluation within
+// signal_max_age of its time.
+const (
+	signalBuy  = "buy"
+	signalSell = "sell"
+)
+
+// externalSignal is a signal read from the signal source.
+type externalSignal struct {
+	Time       time.Time `json:"time"`
+	Symbol     string    `json:"symbol"`
+	Side       string    `json:"side"`
+	Confidence float64   `json:"confidence"`
+	Reason     string    `json:"reason"`
+}
+
+// signalFeed holds the signals of the signal source, ordered by time.
+type signalFeed struct {
+	mu       sync.Mutex
+	bySymbol map[string][]externalSignal
+}
+
+// signals is the signal feed. It is nil unless signal_source is set.
+var signals *signalFeed
+
+// startSignalSource reads the signal_source, if set, and reads it again
+// every signal_source_refresh outside of backtests.
+func startSignalSource() error {
+	if *signalSource == "" {
+		return nil
+	}
+	if *strategyCommand != "" {
+		return fmt.Errorf("signal_source and strategy_command cannot both be set")
+	}
+	f := &signalFeed{}
+	if err := f.load(*signalSource); err != nil {
+		return err
+	}
+	signals = f
+	if *runBacktest {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(*signalSourceRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := f.load(*signalSource); err != nil {
+				log.Printf("unable to refresh signals, keeping the previous ones: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// load replaces the signals with those read from the source.
+func (f *signalFeed) load(source string) error {
+	b, err := readSource(source)
+	if err != nil {
+		return fmt.Errorf("unable to read signal source: %v", err)
+	}
+	parsed, err := parseSignals(b)
+	if err != nil {
+		return fmt.Errorf("unable to parse signal source: %v", err)
+	}
+	bySymbol := map[string][]externalSignal{}
+	for _, s := range parsed {
+		bySymbol[s.Symbol] = append(bySymbol[s.Symbol], s)
+	}
+	for _, l := range bySymbol {
+		sort.SliceStable(l, func(i, j int) bool { return l[i].Time.Before(l[j].Time) })
+	}
+	f.mu.Lock()
+	f.bySymbol = bySymbol
+	f.mu.Unlock()
+	log.Printf("loaded %v signals for %v symbols from %v", len(parsed), len(bySymbol), source)
+	return nil
+}
+
+// parseSignals parses the JSON signals, which are either one per line or in
+// arrays. Invalid signals are logged and skipped.
+func parseSignals(b []byte) ([]externalSignal, error) {
+	var parsed []externalSignal
+	d := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var raw json.RawMessage
+		if err := d.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var batch []externalSignal
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			if err := json.Unmarshal(raw, &batch); err != nil {
+				return nil, err
+			}
+		} else {
+			var s externalSignal
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return nil, err
+			}
+			batch = append(batch, s)
+		}
+		for _, s := range batch {
+			s.Symbol = strings.ToUpper(s.Symbol)
+			s.Side = strings.ToLower(s.Side)
+			switch {
+			case s.Time.IsZero() || s.Symbol == "":
+				log.Printf("skipping signal without a time or symbol: %+v", s)
+			case s.Side != signalBuy && s.Side != signalSell:
+				log.Printf("skipping signal with unknown side %q: %+v", s.Side, s)
+			default:
+				parsed = append(parsed, s)
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// next returns the latest signal of the symbol which is after after and not
+// after t. The signals skipped over are older and are never acted on.
+func (f *signalFeed) next(symbol string, after, t time.Time) (externalSignal, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l := f.bySymbol[symbol]
+	i := sort.Search(len(l), func(i int) bool { return l[i].Time.After(t) })
+	if i == 0 || !l[i-1].Time.After(after) {
+		return externalSignal{}, false
+	}
+	return l[i-1], true
+}
+
+// signalDecision returns true if there is a buy signal for the symbol at t.
+// Open purchases are sold when the signal is to sell.
+func (c *client) signalDecision(t time.Time) bool {
+	s, ok := signals.next(c.stockSymbol, c.lastSignal, t)
+	if !ok {
+		return false
+	}
+	c.lastSignal = s.Time
+	if age := t.Sub(s.Time); age > c.cfg.SignalMaxAge {
+		log.Printf("ignoring %v signal of %v @ %v, it is %v old", s.Side, c.stockSymbol, s.Time, age)
+		return false
+	}
+	reason := fmt.Sprintf("%v signal @ %v with confidence %.2f", s.Side, s.Time.In(EST).Format("15:04:05"), s.Confidence)
+	if s.Reason != "" {
+		reason += ": " + s.Reason
+	}
+	c.lastExternalReason = reason
+	switch {
+	case s.Side == signalSell:
+		c.sellAllAtMarket(t, "signal source", reason)
+		return false
+	case s.Confidence < c.cfg.SignalMinConfidence:
+		log.Printf("ignoring %v, below signal_min_confidence %v", reason, c.cfg.SignalMinConfidence)
+		return false
+	}
+	return true
+}
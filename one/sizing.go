@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	positionSizeEquityPercent = flag.Float64("position_size_equity_percent", 0, "If set, each buy is sized to this percentage of the account equity at the latest bar price, in whole shares, instead of purchase_quanity. Can be set per symbol in the config file.")
+	positionSizeDollars       = flag.Float64("position_size_dollars", 0, "If set, each buy is sized to this many dollars at the latest bar price, in whole shares, instead of purchase_quanity. Can be set per symbol in the config file.")
+	maxExposurePercent        = flag.Float64("max_exposure_percent", 0, "If set, buys are sized down so the long positions of the account, including the buy, are worth at most this percentage of the account equity. Buys are skipped once no whole share fits.")
+	maxVolumePercent          = flag.Float64("max_volume_percent", 0, "If set, buys are sized down to at most this percentage of the average volume of the bars the buy was decided on, so positions which would move the price or fail to fill in thinly traded symbols are not taken. Buys are skipped once no whole share fits. Can be set per symbol in the config file.")
+)
+
+// validatePositionSizing returns an error if the position sizing flags are
+// invalid.
+func validatePositionSizing() error {
+	if *positionSizeEquityPercent < 0 || *positionSizeDollars < 0 || *maxExposurePercent < 0 || *maxVolumePercent < 0 {
+		return fmt.Errorf("position_size_equity_percent, position_size_dollars, max_exposure_percent and max_volume_percent cannot be negative")
+	}
+	if *positionSizeEquityPercent > 0 && *positionSizeDollars > 0 {
+		return fmt.Errorf("only one of position_size_equity_percent and position_size_dollars can be set")
+	}
+	return nil
+}
+
+// positionSize returns the number of shares a buy at the latest close of the
+// bars is sized to, before the buying power is checked. The rule blocking the
+// buy is returned if no whole share can be bought.
+func (c *client) positionSize(a *alpaca.Account, bars []alpaca.Bar) (decimal.Decimal, *entryBlock) {
+	price := decimal.NewFromFloat32(bars[len(bars)-1].Close)
+	var qty decimal.Decimal
+	switch {
+	case c.cfg.PositionSizeEquityPercent > 0:
+		dollars := a.Equity.Mul(decimal.NewFromFloat(c.cfg.PositionSizeEquityPercent / 100))
+		qty = dollars.Div(price).Floor()
+		if !qty.IsPositive() {
+			return decimal.Zero, &entryBlock{rulePositionSize, fmt.Sprintf("%v%% of equity $%v does not buy a share at $%v", c.cfg.PositionSizeEquityPercent, a.Equity.StringFixed(2), price)}
+		}
+	case c.cfg.PositionSizeDollars > 0:
+		qty = decimal.NewFromFloat(c.cfg.PositionSizeDollars).Div(price).Floor()
+		if !qty.IsPositive() {
+			return decimal.Zero, &entryBlock{rulePositionSize, fmt.Sprintf("$%v does not buy a share at $%v", c.cfg.PositionSizeDollars, price)}
+		}
+	default:
+		qty = decimal.NewFromFloat(c.cfg.PurchaseQty)
+	}
+	if c.cfg.MaxExposurePercent > 0 {
+		limit := a.Equity.Mul(decimal.NewFromFloat(c.cfg.MaxExposurePercent / 100))
+		room := limit.Sub(a.LongMarketValue)
+		if !room.IsPositive() || room.Div(price).Floor().IsZero() {
+			return decimal.Zero, &entryBlock{ruleMaxExposure, fmt.Sprintf("long positions of $%v leave no room for a share at $%v under $%v", a.LongMarketValue.StringFixed(2), price, limit.StringFixed(2))}
+		}
+		if fits := room.Div(price).Floor(); fits.LessThan(qty) {
+			log.Printf("sizing buy down from %v to %v shares to keep exposure under $%v", qty, fits, limit.StringFixed(2))
+			qty = fits
+		}
+	}
+	volume := averageVolume(bars)
+	if c.cfg.MaxVolumePercent > 0 && volume.IsPositive() {
+		fits := volume.Mul(decimal.NewFromFloat(c.cfg.MaxVolumePercent / 100)).Floor()
+		if !fits.IsPositive() {
+			return decimal.Zero, &entryBlock{ruleMaxVolume, fmt.Sprintf("%v%% of the average bar volume of %v is less than a share", c.cfg.MaxVolumePercent, volume.StringFixed(0))}
+		}
+		if fits.LessThan(qty) {
+			log.Printf("sizing buy down from %v to %v shares, %v%% of the average bar volume of %v", qty, fits, c.cfg.MaxVolumePercent, volume.StringFixed(0))
+			qty = fits
+		}
+	}
+	if c.cfg.Backtest && volume.IsPositive() {
+		c.recordVolumeShare(qty.Div(volume).Mul(decimal.NewFromInt(100)))
+	}
+	return qty, nil
+}
+
+// averageVolume returns the average volume of the bars. It is zero when the
+// volume is unknown.
+func averageVolume(bars []alpaca.Bar) decimal.Decimal {
+	var total int64
+	for _, b := range bars {
+		total += int64(b.Volume)
+	}
+	if len(bars) == 0 {
+		return decimal.Zero
+	}
+	return decimal.NewFromInt(total).Div(decimal.NewFromInt(int64(len(bars))))
+}
+
+// recordVolumeShare records the largest share of the average bar volume a
+// backtest buy was sized to, in percent, so the backtest shows whether
+// max_volume_percent held.
+func (c *client) recordVolumeShare(percent decimal.Decimal) {
+	if percent.GreaterThan(c.backtestMaxVolumeShare) {
+		c.backtestMaxVolumeShare = percent
+	}
+}
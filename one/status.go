@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionStatus is the state of the trading session shown by the status
+// webserver.
+type sessionStatus struct {
+	mu       sync.Mutex
+	clients  []*client
+	closeOut time.Time
+
+	// signalsEvaluated is the number of buy signals evaluated. It is updated
+	// atomically.
+	signalsEvaluated int64
+}
+
+var currentSession = &sessionStatus{}
+
+// setClients sets the clients whose purchases are shown.
+func (s *sessionStatus) setClients(clients []*client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients = clients
+}
+
+// setNextClose records the next market close, from which the time of the
+// close out of the account is derived.
+func (s *sessionStatus) setNextClose(nextClose time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeOut = finalCloseOut(s.clients, nextClose)
+}
+
+// signalEvaluated counts a buy signal evaluation.
+func (s *sessionStatus) signalEvaluated() {
+	atomic.AddInt64(&s.signalsEvaluated, 1)
+}
+
+// snapshot returns the clients and the time of the close out.
+func (s *sessionStatus) snapshot() ([]*client, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clients, s.closeOut
+}
+
+// serveHTTP serves the live stats of the trading session.
+func serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if trading {
+		fmt.Fprintf(w, "Trader One is running and trading!\n\n")
+	} else {
+		fmt.Fprintf(w, "Trader One is running, but not currently trading.\n\n")
+	}
+
+	clients, closeOut := currentSession.snapshot()
+	fmt.Fprintf(w, "Signals evaluated: %v\n", atomic.LoadInt64(&currentSession.signalsEvaluated))
+	switch until := time.Until(closeOut); {
+	case closeOut.IsZero():
+		fmt.Fprintf(w, "Close out: unknown\n")
+	case until > 0:
+		fmt.Fprintf(w, "Close out: in %v (%v)\n", until.Round(time.Second), closeOut.In(EST).Format("15:04 MST"))
+	default:
+		fmt.Fprintf(w, "Close out: passed\n")
+	}
+	writeKillSwitch(w)
+	writeBreaker(w)
+	writeDataCheck(w)
+	writeApprovals(w)
+	if currentRebalancer != nil {
+		currentRebalancer.writeRebalance(w)
+	}
+	writeRisk(w, clients)
+	for _, c := range clients {
+		c.do(func() { c.writeSessionStats(w) })
+	}
+	writeNarration(w, statusNarrationLines)
+	writeAPIUsage(w)
+}
+
+// writeSessionStats writes the realized P/L of today's completed purchases
+// and the unrealized P/L of the open purchases.
+func (c *client) writeSessionStats(w io.Writer) {
+	name := c.strategy
+	if c.shadow {
+		name += " (shadow)"
+	}
+	s := newArmStats(c.purchases)
+	fmt.Fprintf(w, "\n%v\n", name)
+	fmt.Fprintf(w, "Realized P/L today: $%v (%v trades, %v wins)\n", s.profitLoss.StringFixed(2), s.trades, s.wins)
+
+	open := c.inProgressPurchases()
+	fmt.Fprintf(w, "Open purchases: %v/%v\n", len(open), c.cfg.MaxConcurrentPurchases)
+	for _, p := range open {
+		if p.BuyOrder.FilledQty.IsZero() {
+			fmt.Fprintf(w, "  %d: buying %v %v (%v)\n", p.ID, p.BuyOrder.Qty, p.BuyOrder.Symbol, p.BuyOrder.Status)
+		}
+	}
+	if unrealized == nil {
+		return
+	}
+	u := unrealized.snapshot(c)
+	if u == nil {
+		fmt.Fprintf(w, "Unrealized P/L: not computed yet\n")
+		return
+	}
+	for _, pos := range u.positions {
+		fmt.Fprintf(w, "  %d: %v %v @ $%v, now $%v, unrealized P/L $%v\n",
+			pos.purchase.ID, pos.qty, pos.symbol, pos.cost.StringFixed(2), pos.price.StringFixed(2), pos.pl.StringFixed(2))
+	}
+	for _, symbol := range u.symbols() {
+		fmt.Fprintf(w, "Unrealized P/L of %v: $%v\n", symbol, u.bySymbol[symbol].StringFixed(2))
+	}
+	fmt.Fprintf(w, "Unrealized P/L: $%v (as of %v ago)\n", u.total.StringFixed(2), time.Since(u.time).Round(time.Second))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/database"
+)
+
+var (
+	minSignalStreak = flag.Int("min_signal_streak", 1, "The number of bars in a row the slope strategy must signal a buy on before it buys. The streak is stored in the database, so it is kept across restarts. Can be set per strategy in shadow_params and experiments.")
+)
+
+// strategyState is the memory a strategy keeps for its symbol across ticks.
+// It is stored after each evaluation which changes it, and restored when the
+// trader restarts.
+type strategyState interface {
+	// marshalState serializes the state as JSON.
+	marshalState() ([]byte, error)
+	// unmarshalState restores the state serialized by marshalState.
+	unmarshalState(b []byte) error
+}
+
+// newStrategyState returns the empty state of the strategy making the
+// decisions. The signal source keeps no state.
+func newStrategyState() strategyState {
+	switch {
+	case external != nil:
+		return &externalState{}
+	case signals != nil:
+		return nil
+	}
+	return &slopeState{}
+}
+
+// slopeState is the state of the slope strategy.
+type slopeState struct {
+	// SignalStreak is the number of bars in a row the strategy signalled a
+	// buy on, up to the bar starting at LastBar, in Unix seconds.
+	SignalStreak int   `json:"signal_streak"`
+	LastBar      int64 `json:"last_bar"`
+}
+
+func (s *slopeState) marshalState() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+func (s *slopeState) unmarshalState(b []byte) error {
+	return json.Unmarshal(b, s)
+}
+
+// externalState is the state of the external strategy. It is whatever the
+// strategy last replied with, and is sent back with each request.
+type externalState struct {
+	state json.RawMessage
+}
+
+func (s *externalState) marshalState() ([]byte, error) {
+	return s.state, nil
+}
+
+func (s *externalState) unmarshalState(b []byte) error {
+	if !json.Valid(b) {
+		return fmt.Errorf("invalid JSON %q", b)
+	}
+	s.state = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// restoreStrategyState restores the state the client's strategy stored
+// before a restart. The strategy starts from an empty state when none was
+// stored or it cannot be read.
+func (c *client) restoreStrategyState() {
+	c.state = newStrategyState()
+	c.savedState = nil
+	if c.state == nil {
+		return
+	}
+	stored, err := c.dbClient.StrategyState(c.strategy, c.stockSymbol)
+	if errors.Is(err, database.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("unable to restore strategy state, starting without it: %v", err)
+		return
+	}
+	if err := c.state.unmarshalState(stored.State); err != nil {
+		log.Printf("unable to restore strategy state %q, starting without it: %v", stored.State, err)
+		c.state = newStrategyState()
+		return
+	}
+	c.savedState = stored.State
+	log.Printf("restored strategy state of %v for %v from %v: %s", c.strategy, c.stockSymbol, stored.Time, stored.State)
+}
+
+// saveStrategyState stores the state of the client's strategy if it changed
+// since it was last stored.
+func (c *client) saveStrategyState() {
+	if c.state == nil {
+		return
+	}
+	b, err := c.state.marshalState()
+	if err != nil {
+		log.Printf("unable to serialize strategy state: %v", err)
+		return
+	}
+	if len(b) == 0 || bytes.Equal(b, c.savedState) {
+		return
+	}
+	if err := c.dbClient.UpdateStrategyState(&database.StrategyState{
+		Strategy: c.strategy,
+		Symbol:   c.stockSymbol,
+		Time:     c.now(),
+		State:    b,
+	}); err != nil {
+		log.Printf("unable to store strategy state: %v", err)
+		return
+	}
+	c.savedState = b
+}
+
+// signalStreakHeld records whether the slope strategy signalled a buy on the
+// latest of the bars, and returns whether it has signalled one on
+// min_signal_streak bars in a row. A bar is counted once however often it is
+// evaluated, and a gap of more than a bar ends the streak.
+func (c *client) signalStreakHeld(bars []alpaca.Bar, signal bool) bool {
+	s, ok := c.state.(*slopeState)
+	if !ok {
+		return signal
+	}
+	if !signal {
+		s.SignalStreak, s.LastBar = 0, 0
+		return false
+	}
+	latest := bars[len(bars)-1].Time
+	switch gap := time.Duration(latest-s.LastBar) * time.Second; {
+	case s.LastBar == latest:
+	case s.LastBar == 0 || gap < 0 || gap > timeframes[c.cfg.BarTimeframe]:
+		s.SignalStreak, s.LastBar = 1, latest
+	default:
+		s.SignalStreak, s.LastBar = s.SignalStreak+1, latest
+	}
+	if s.SignalStreak < c.cfg.Params.minSignalStreak {
+		log.Printf("buy signalled on %v of %v bars in a row", s.SignalStreak, c.cfg.Params.minSignalStreak)
+		return false
+	}
+	return true
+}
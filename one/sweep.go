@@ -0,0 +1,249 @@
+// Example command line to run:
+// go run . -run_backtest=true -backtest_file=SPY_sample.txt -backtest_starttime="2020-01-02 04:00:00" -max_concurrent_purchases=20 -purchase_quanity=10 -backtest_sweep_min_slopes=0.5,1,1.3,2 -backtest_sweep_num_historical_bars=2,3,4,5
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestSweepMinSlopes         = flag.String("backtest_sweep_min_slopes", "", "A comma separated list of min_slope_required_to_buy values. When this or backtest_sweep_num_historical_bars is set, the backtest is run for every combination and a grid of the results is written instead of the normal summary.")
+	backtestSweepNumHistoricalBars = flag.String("backtest_sweep_num_historical_bars", "", "A comma separated list of num_historical_bars_to_use values to sweep.")
+	backtestSweepOutput            = flag.String("backtest_sweep_output", "sweep", "The filename prefix of the sweep results. The grid is written to <prefix>.csv and the heatmap to <prefix>.html.")
+)
+
+// sweepResult is the outcome of a single backtest in a sweep.
+type sweepResult struct {
+	profitLoss decimal.Decimal
+	trades     int
+}
+
+// sweepGrid holds the results of a parameter sweep. results is indexed by
+// [numHistoricalBars index][minSlope index].
+type sweepGrid struct {
+	minSlopes         []float64
+	numHistoricalBars []int
+	results           [][]sweepResult
+}
+
+// newSweepGrid returns an empty grid of the swept strategy params. A param
+// which is not swept keeps its value from base.
+func newSweepGrid(base ClientConfig) (*sweepGrid, error) {
+	g := &sweepGrid{
+		minSlopes:         []float64{base.Params.minSlope},
+		numHistoricalBars: []int{base.Params.numHistoricalBars},
+	}
+	var err error
+	if *backtestSweepMinSlopes != "" {
+		if g.minSlopes, err = parseFloats(*backtestSweepMinSlopes); err != nil {
+			return nil, fmt.Errorf("invalid backtest_sweep_min_slopes: %v", err)
+		}
+	}
+	if *backtestSweepNumHistoricalBars != "" {
+		if g.numHistoricalBars, err = parseInts(*backtestSweepNumHistoricalBars); err != nil {
+			return nil, fmt.Errorf("invalid backtest_sweep_num_historical_bars: %v", err)
+		}
+	}
+	return g, nil
+}
+
+// sweep runs the backtest for each combination of the swept strategy params
+// and writes the results as a CSV grid and an HTML heatmap.
+func sweep(h *history, base ClientConfig) error {
+	g, err := newSweepGrid(base)
+	if err != nil {
+		return err
+	}
+
+	for _, bars := range g.numHistoricalBars {
+		var row []sweepResult
+		for _, slope := range g.minSlopes {
+			cfg := base
+			cfg.Params.numHistoricalBars = bars
+			cfg.Params.minSlope = slope
+			c, err := newFake(h, cfg)
+			if err != nil {
+				return err
+			}
+			log.Printf("sweep is running num_historical_bars_to_use=%v min_slope_required_to_buy=%v", bars, slope)
+			c.simulate()
+			r := sweepResult{
+				profitLoss: profitLossPercent(c.backtestCashStart, c.backtestEquity()),
+				trades:     c.backtestTrades,
+			}
+			fmt.Printf("num_historical_bars_to_use=%v min_slope_required_to_buy=%v Profit/Loss: %v%% Trades: %v Terminated: %v\n", bars, slope, r.profitLoss.StringFixed(3), r.trades, c.backtestTermination())
+			row = append(row, r)
+		}
+		g.results = append(g.results, row)
+	}
+
+	if err := g.writeCSV(*backtestSweepOutput + ".csv"); err != nil {
+		return err
+	}
+	return g.writeHeatmap(*backtestSweepOutput + ".html")
+}
+
+// writeCSV writes a row for each num_historical_bars_to_use value and a pair
+// of P/L and trade count columns for each min_slope_required_to_buy value.
+func (g *sweepGrid) writeCSV(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create %q: %v", filename, err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	header := []string{"num_historical_bars_to_use"}
+	for _, slope := range g.minSlopes {
+		s := strconv.FormatFloat(slope, 'f', -1, 64)
+		header = append(header, "pl_pct_slope_"+s, "trades_slope_"+s)
+	}
+	if err := w.Write(header); err != nil {
+		return fmt.Errorf("unable to write %q: %v", filename, err)
+	}
+	for i, bars := range g.numHistoricalBars {
+		record := []string{strconv.Itoa(bars)}
+		for _, r := range g.results[i] {
+			record = append(record, r.profitLoss.StringFixed(3), strconv.Itoa(r.trades))
+		}
+		if err := w.Write(record); err != nil {
+			return fmt.Errorf("unable to write %q: %v", filename, err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("unable to write %q: %v", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write %q: %v", filename, err)
+	}
+	log.Printf("wrote sweep grid to %v", filename)
+	return nil
+}
+
+// heatmapTemplate renders the sweep grid as an HTML table. Each cell is
+// colored green for a profit and red for a loss, scaled by its magnitude.
+var heatmapTemplate = template.Must(template.New("heatmap").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Slope threshold sensitivity</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 6px 10px; text-align: center; }
+td small { color: #333; }
+</style>
+</head>
+<body>
+<h1>Slope threshold sensitivity</h1>
+<table>
+<tr><th>num_historical_bars_to_use \ min_slope_required_to_buy</th>{{range .MinSlopes}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr><th>{{.NumHistoricalBars}}</th>{{range .Cells}}<td style="background-color: {{.Color}}">{{.ProfitLoss}}%<br><small>{{.Trades}} trades</small></td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type heatmapCell struct {
+	ProfitLoss string
+	Trades     int
+	Color      template.CSS
+}
+
+type heatmapRow struct {
+	NumHistoricalBars int
+	Cells             []heatmapCell
+}
+
+// writeHeatmap renders the P/L of the grid as a heatmap.
+func (g *sweepGrid) writeHeatmap(filename string) error {
+	var maxAbs float64
+	for _, row := range g.results {
+		for _, r := range row {
+			pl, _ := r.profitLoss.Float64()
+			maxAbs = math.Max(maxAbs, math.Abs(pl))
+		}
+	}
+
+	var rows []heatmapRow
+	for i, bars := range g.numHistoricalBars {
+		row := heatmapRow{NumHistoricalBars: bars}
+		for _, r := range g.results[i] {
+			pl, _ := r.profitLoss.Float64()
+			row.Cells = append(row.Cells, heatmapCell{
+				ProfitLoss: r.profitLoss.StringFixed(3),
+				Trades:     r.trades,
+				Color:      heatColor(pl, maxAbs),
+			})
+		}
+		rows = append(rows, row)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create %q: %v", filename, err)
+	}
+	defer f.Close()
+	err = heatmapTemplate.Execute(f, struct {
+		MinSlopes []float64
+		Rows      []heatmapRow
+	}{g.minSlopes, rows})
+	if err != nil {
+		return fmt.Errorf("unable to write %q: %v", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write %q: %v", filename, err)
+	}
+	log.Printf("wrote sweep heatmap to %v", filename)
+	return nil
+}
+
+// heatColor returns the cell color for a P/L relative to the largest P/L
+// magnitude in the grid.
+func heatColor(pl, maxAbs float64) template.CSS {
+	alpha := 0.0
+	if maxAbs > 0 {
+		alpha = math.Abs(pl) / maxAbs
+	}
+	if pl < 0 {
+		return template.CSS(fmt.Sprintf("rgba(220, 50, 47, %.2f)", alpha))
+	}
+	return template.CSS(fmt.Sprintf("rgba(40, 160, 60, %.2f)", alpha))
+}
+
+// parseFloats parses a comma separated list of floats.
+func parseFloats(s string) ([]float64, error) {
+	var floats []float64
+	for _, v := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		floats = append(floats, f)
+	}
+	return floats, nil
+}
+
+// parseInts parses a comma separated list of ints.
+func parseInts(s string) ([]int, error) {
+	var ints []int
+	for _, v := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, i)
+	}
+	return ints, nil
+}
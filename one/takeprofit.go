@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+	"github.com/trader/indicators"
+)
+
+var (
+	takeProfitMode               = flag.String("take_profit_mode", "flat", "How the take profit of a purchase is chosen. One of \"flat\" (0.2% above the buy price) or \"volatility\" (take_profit_volatility_multiple times the standard deviation of the returns of the last take_profit_volatility_bars bars, chosen at entry).")
+	takeProfitVolatilityMultiple = flag.Float64("take_profit_volatility_multiple", 2, "The multiple of the standard deviation of bar returns which is taken as profit in the volatility take_profit_mode.")
+	takeProfitVolatilityBars     = flag.Int("take_profit_volatility_bars", 20, "The number of bar returns the volatility is measured over.")
+	takeProfitMinPercent         = flag.Float64("take_profit_min_percent", 0.1, "The smallest take profit percentage in the volatility take_profit_mode.")
+	takeProfitMaxPercent         = flag.Float64("take_profit_max_percent", 1, "The largest take profit percentage in the volatility take_profit_mode.")
+)
+
+// takeProfitVolatility is the take_profit_mode which scales the take profit
+// with the volatility.
+const takeProfitVolatility = "volatility"
+
+// takeProfitPercent returns the take profit percentage of a purchase entered
+// on the bars. nil is returned for the flat take profit, including when the
+// volatility cannot be measured.
+func (c *client) takeProfitPercent(bars []alpaca.Bar) *decimal.Decimal {
+	if c.cfg.TakeProfitMode != takeProfitVolatility {
+		return nil
+	}
+	stddev, ok := indicators.Volatility(c.volatilityBars(bars, c.cfg.TakeProfitVolatilityBars+1), 0)
+	if !ok {
+		log.Printf("unable to measure the volatility of %v, using the flat take profit", c.stockSymbol)
+		return nil
+	}
+	pct := c.cfg.TakeProfitVolatilityMultiple * stddev * 100
+	pct = math.Max(pct, c.cfg.TakeProfitMinPercent)
+	pct = math.Min(pct, c.cfg.TakeProfitMaxPercent)
+	d := decimal.NewFromFloat(pct).Round(4)
+	log.Printf("take profit of %v%% from a %.4f%% standard deviation of returns", d, stddev*100)
+	return &d
+}
+
+// volatilityBars returns the last n bars, whose returns the volatility is
+// measured over. The bars of the buy signal are used when there are enough of
+// them.
+func (c *client) volatilityBars(bars []alpaca.Bar, n int) []alpaca.Bar {
+	if len(bars) >= n {
+		return bars[len(bars)-n:]
+	}
+	if c.cfg.Backtest {
+		return c.fakeBars(n)
+	}
+	endDt := time.Now()
+	if f := symbolBarFeed(c.stockSymbol); f != nil && c.cfg.BarTimeframe == feedTimeframe {
+		if recent, ok := f.recent(n, endDt); ok {
+			return recent
+		}
+	}
+	lookback := c.cfg.barsLookback(n)
+	startDt := endDt.Add(-lookback)
+	recent, err := c.alpacaClient.GetSymbolBars(c.stockSymbol, alpaca.ListBarParams{
+		Timeframe: c.cfg.BarTimeframe,
+		StartDt:   &startDt,
+		EndDt:     &endDt,
+		Limit:     &n,
+	})
+	if err != nil {
+		log.Printf("unable to get bars to measure volatility: %v", err)
+		return nil
+	}
+	return recent
+}
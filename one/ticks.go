@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	// pennyTick is the price increment of prices of $1 or more.
+	pennyTick = decimal.New(1, -2)
+	// subPennyTick is the price increment of prices below $1.
+	subPennyTick = decimal.New(1, -4)
+)
+
+// tickSize returns the minimum price increment Alpaca accepts for the price.
+func tickSize(price decimal.Decimal) decimal.Decimal {
+	if price.LessThan(decimal.NewFromInt(1)) {
+		return subPennyTick
+	}
+	return pennyTick
+}
+
+// roundToTick rounds the price up or down to its tick size. Buy limits are
+// usually rounded down and sell limits up, so rounding never makes an order
+// more expensive.
+func roundToTick(price decimal.Decimal, up bool) decimal.Decimal {
+	tick := tickSize(price)
+	ticks := price.Div(tick)
+	if up {
+		return ticks.Ceil().Mul(tick)
+	}
+	return ticks.Floor().Mul(tick)
+}
+
+// checkTicks returns an error if any of the prices is not a multiple of its
+// tick size, as Alpaca rejects the order. Nil prices are ignored.
+func checkTicks(prices ...*decimal.Decimal) error {
+	for _, p := range prices {
+		if p != nil && !p.Equal(roundToTick(*p, false)) {
+			return fmt.Errorf("price $%v is not a multiple of the $%v tick size", p, tickSize(*p))
+		}
+	}
+	return nil
+}
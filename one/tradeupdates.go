@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	streamTradeUpdates = flag.Bool("stream_trade_updates", true, "If true, order updates are streamed from Alpaca's trade_updates stream and applied to the purchases as they happen, instead of requesting every in-progress order each tick. Orders are requested again while the stream is disconnected.")
+)
+
+const (
+	// tradeUpdatesRetryDelay is the first delay before reconnecting to the
+	// stream. The delay doubles after each failed connection, up to
+	// tradeUpdatesMaxRetryDelay.
+	tradeUpdatesRetryDelay    = 5 * time.Second
+	tradeUpdatesMaxRetryDelay = 2 * time.Minute
+
+	// tradeUpdatesPongWait is how long the stream may be silent, including
+	// the pongs to its pings, before it is considered disconnected.
+	tradeUpdatesPongWait     = time.Minute
+	tradeUpdatesPingInterval = 20 * time.Second
+)
+
+// orderStream applies the order updates of Alpaca's trade_updates stream to
+// the purchases of the clients, and reconnects when the stream disconnects.
+type orderStream struct {
+	url string
+
+	mu      sync.Mutex
+	clients []*client
+	// connectedAt is when the stream started listening. It is zero while the
+	// stream is disconnected.
+	connectedAt time.Time
+}
+
+// tradeUpdates is the stream of the running trader. It is nil when order
+// updates are not streamed, e.g. in backtests.
+var tradeUpdates *orderStream
+
+// streamMessage is a message of the trade_updates stream.
+type streamMessage struct {
+	Stream string          `json:"stream"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// startTradeUpdates starts streaming the order updates of the clients when
+// stream_trade_updates is set.
+func startTradeUpdates(clients []*client) {
+	if !*streamTradeUpdates {
+		return
+	}
+	u, err := tradeStreamURL(*apiEndpoint)
+	if err != nil {
+		log.Printf("unable to stream trade updates, orders are requested instead: %v", err)
+		return
+	}
+	tradeUpdates = &orderStream{url: u, clients: clients}
+	go tradeUpdates.run()
+}
+
+// tradeStreamURL returns the URL of the trade_updates stream of the REST API
+// endpoint, e.g. "wss://paper-api.alpaca.markets/stream".
+func tradeStreamURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse api_endpoint: %v", err)
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	default:
+		return "", fmt.Errorf("api_endpoint %q is not an http or https URL", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/stream"
+	return u.String(), nil
+}
+
+// setClients sets the clients whose orders are updated.
+func (s *orderStream) setClients(clients []*client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients = clients
+}
+
+// connectedSince returns when the stream started listening, or zero while it
+// is disconnected.
+func (s *orderStream) connectedSince() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connectedAt
+}
+
+func (s *orderStream) setConnectedAt(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connectedAt = t
+}
+
+// run listens to the stream, reconnecting with a growing delay while it
+// cannot connect.
+func (s *orderStream) run() {
+	delay := tradeUpdatesRetryDelay
+	for {
+		listened, err := s.listen()
+		s.setConnectedAt(time.Time{})
+		if listened {
+			delay = tradeUpdatesRetryDelay
+		}
+		log.Printf("trade updates stream disconnected, requesting orders until it reconnects in %v: %v", delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > tradeUpdatesMaxRetryDelay {
+			delay = tradeUpdatesMaxRetryDelay
+		}
+	}
+}
+
+// listen connects, authenticates and applies the streamed order updates until
+// the stream disconnects. It returns true if the stream was listened to.
+func (s *orderStream) listen() (bool, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(s.url, nil)
+	if err != nil {
+		return false, fmt.Errorf("unable to connect to %v: %v", s.url, err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(tradeUpdatesPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(tradeUpdatesPongWait))
+	})
+
+	creds := common.Credentials()
+	if err := s.request(conn, "authenticate", map[string]string{"key_id": creds.ID, "secret_key": creds.Secret}, "authorization"); err != nil {
+		return false, err
+	}
+	if err := s.request(conn, "listen", map[string][]string{"streams": {alpaca.TradeUpdates}}, "listening"); err != nil {
+		return false, err
+	}
+	s.setConnectedAt(time.Now())
+	log.Printf("streaming trade updates from %v", s.url)
+
+	// Pings keep the connection alive and detect a connection which silently
+	// dropped. WriteControl may be called while reading.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(tradeUpdatesPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					log.Printf("unable to ping trade updates stream: %v", err)
+				}
+			}
+		}
+	}()
+
+	for {
+		msg, err := s.read(conn)
+		if err != nil {
+			return true, err
+		}
+		conn.SetReadDeadline(time.Now().Add(tradeUpdatesPongWait))
+		if msg.Stream != alpaca.TradeUpdates {
+			continue
+		}
+		u := &alpaca.TradeUpdate{}
+		if err := json.Unmarshal(msg.Data, u); err != nil {
+			log.Printf("unable to parse trade update: %v", err)
+			continue
+		}
+		s.dispatch(u)
+	}
+}
+
+// request sends the action and waits for its reply on the stream.
+func (s *orderStream) request(conn *websocket.Conn, action string, data interface{}, reply string) error {
+	if err := conn.WriteJSON(map[string]interface{}{"action": action, "data": data}); err != nil {
+		return fmt.Errorf("unable to %v: %v", action, err)
+	}
+	msg, err := s.read(conn)
+	if err != nil {
+		return fmt.Errorf("no reply to %v: %v", action, err)
+	}
+	if msg.Stream != reply {
+		return fmt.Errorf("unexpected reply to %v: %s", action, msg.Data)
+	}
+	if reply == "authorization" {
+		status := struct {
+			Status string `json:"status"`
+		}{}
+		if err := json.Unmarshal(msg.Data, &status); err != nil || status.Status != "authorized" {
+			return fmt.Errorf("unable to authenticate: %s", msg.Data)
+		}
+	}
+	return nil
+}
+
+// read reads the next message. Messages are sent as text or binary frames.
+func (s *orderStream) read(conn *websocket.Conn) (*streamMessage, error) {
+	_, b, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	msg := &streamMessage{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, fmt.Errorf("unable to parse stream message: %v", err)
+	}
+	return msg, nil
+}
+
+// dispatch applies the update on the shard of each client trading the
+// order's symbol. Shadow clients simulate their orders, so they have no
+// updates.
+func (s *orderStream) dispatch(u *alpaca.TradeUpdate) {
+	s.mu.Lock()
+	clients := s.clients
+	s.mu.Unlock()
+	for _, c := range clients {
+		if c.shadow || c.stockSymbol != u.Order.Symbol {
+			continue
+		}
+		c := c
+		c.do(func() { c.applyTradeUpdate(u) })
+	}
+}
+
+// applyTradeUpdate applies the streamed order to the purchase it belongs to.
+// The stream reports each replacement and leg as a separate order, so the
+// purchase's order is requested instead when it was replaced or has legs.
+// TWAP and emulated OCO orders are made of several orders, and are still
+// updated each tick.
+func (c *client) applyTradeUpdate(u *alpaca.TradeUpdate) {
+	order := u.Order
+	for _, p := range c.purchases {
+		switch {
+		case p.BuyOrder != nil && !isTWAP(p.BuyOrder) && updatesOrder(p.BuyOrder, &order):
+			wasFilled := p.BuyFilled()
+			if !c.applyStreamedOrder(&p.BuyOrder, p, &order) {
+				return
+			}
+			log.Printf("streamed %v of buy order %v", u.Event, order.ID)
+			c.buyOrderUpdated(p, wasFilled)
+			c.endFailedEntries()
+			return
+		case p.SellOrder != nil && !isSyntheticOCO(p.SellOrder) && updatesOrder(p.SellOrder, &order):
+			wasFilled := p.SellFilled()
+			if !c.applyStreamedOrder(&p.SellOrder, p, &order) {
+				return
+			}
+			log.Printf("streamed %v of sell order %v", u.Event, order.ID)
+			c.sellOrderUpdated(p, wasFilled)
+			return
+		}
+	}
+}
+
+// updatesOrder returns whether the streamed order is the order, one of its
+// legs or its replacement.
+func updatesOrder(o, streamed *alpaca.Order) bool {
+	if o.ID == streamed.ID || (streamed.Replaces != nil && *streamed.Replaces == o.ID) {
+		return true
+	}
+	if o.Legs != nil {
+		for _, leg := range *o.Legs {
+			if leg.ID == streamed.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyStreamedOrder sets the purchase's order to the streamed order. The
+// order is requested when the streamed order is not the complete order. It
+// returns false if the order could not be requested.
+func (c *client) applyStreamedOrder(o **alpaca.Order, p *purchase.Purchase, streamed *alpaca.Order) bool {
+	if streamed.ID == (*o).ID && streamed.ReplacedBy == nil && (*o).Legs == nil {
+		*o = streamed
+		return true
+	}
+	order, chain := c.order((*o).ID)
+	if order == nil {
+		return false
+	}
+	*o = order
+	p.AddReplacements(chain...)
+	return true
+}
+
+// pollOrders returns whether the in-progress orders must be requested, which
+// they are unless their updates are streamed. The orders are requested once
+// after the stream connects, for the updates missed while it was down.
+func (c *client) pollOrders() bool {
+	if c.streamCurrent() {
+		return false
+	}
+	if tradeUpdates != nil && !c.cfg.Backtest && !c.shadow {
+		c.ordersPolledAt = time.Now()
+	}
+	return true
+}
+
+// streamCurrent returns whether the client's orders are kept up to date by
+// the stream, since it connected before the orders were last requested.
+func (c *client) streamCurrent() bool {
+	if tradeUpdates == nil || c.cfg.Backtest || c.shadow {
+		return false
+	}
+	connectedAt := tradeUpdates.connectedSince()
+	return !connectedAt.IsZero() && c.ordersPolledAt.After(connectedAt)
+}
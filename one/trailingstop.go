@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	sellMode            = flag.String("sell_mode", sellModeOCO, "How purchases are sold: \"oco\" (a take profit limit and a stop loss), \"trailing_stop\" (an Alpaca trailing stop order trailing the highest price by trailing_stop_percent) or \"trailing_stop_emulated\" (a stop order whose stop is replaced as the price rises). Can be set per strategy in shadow_params and experiments, and per symbol in the config file.")
+	trailingStopPercent = flag.Float64("trailing_stop_percent", 0.12, "How far below the highest price since the purchase the trailing stop of the trailing_stop sell modes is, in percent.")
+)
+
+// The sell modes of sell_mode.
+const (
+	sellModeOCO                  = "oco"
+	sellModeTrailingStop         = "trailing_stop"
+	sellModeEmulatedTrailingStop = "trailing_stop_emulated"
+)
+
+// validateSellMode returns an error if the sell mode flags are invalid.
+func validateSellMode() error {
+	switch *sellMode {
+	case sellModeOCO, sellModeTrailingStop, sellModeEmulatedTrailingStop:
+	default:
+		return fmt.Errorf("unknown sell_mode %q", *sellMode)
+	}
+	if *trailingStopPercent <= 0 || *trailingStopPercent >= 100 {
+		return fmt.Errorf("trailing_stop_percent must be between 0 and 100, not %v", *trailingStopPercent)
+	}
+	return nil
+}
+
+// trailingStopPrice returns the stop which trails the price by percent.
+func trailingStopPrice(price decimal.Decimal, percent float64) decimal.Decimal {
+	return roundToTick(price.Mul(decimal.NewFromFloat(1-percent/100)), false)
+}
+
+// placeTrailingStop places the sell order of the purchase in one of the
+// trailing stop sell modes. It returns false if the order could not be
+// placed.
+func (c *client) placeTrailingStop(p *purchase.Purchase, basePrice decimal.Decimal) bool {
+	percent := decimal.NewFromFloat(c.cfg.Params.trailingStopPercent)
+	stop := trailingStopPrice(basePrice, c.cfg.Params.trailingStopPercent)
+	req := &alpaca.PlaceOrderRequest{
+		Side:          alpaca.Sell,
+		AssetKey:      &c.stockSymbol,
+		Qty:           p.BuyOrder.FilledQty,
+		TimeInForce:   alpaca.GTC,
+		ClientOrderID: c.sellClientOrderID(p),
+	}
+	if c.cfg.Params.sellMode == sellModeTrailingStop {
+		req.Type = alpaca.TrailingStop
+		req.TrailPercent = &percent
+	} else {
+		req.Type = alpaca.Stop
+		req.StopPrice = &stop
+	}
+	var o *alpaca.Order
+	var err error
+	switch {
+	case c.cfg.Backtest:
+		o, err = c.fakeSellOrder(req)
+	case c.shadow:
+		o, err = c.shadowPlaceOrder(req)
+	default:
+		o, err = c.placeOrder(req)
+	}
+	if err != nil {
+		log.Printf("unable to place %v sell order: %v\npurchase:\nbuy:%+v\n", c.cfg.Params.sellMode, err, p.BuyOrder)
+		return false
+	}
+	p.SellOrder = o
+	log.Printf("%v sell order placed:\n%+v\n", c.cfg.Params.sellMode, p.SellOrder)
+	if o.StopPrice != nil {
+		stop = *o.StopPrice
+	}
+	c.narrateEntry(p, decimal.Zero, stop)
+
+	if err := c.dbClient.Update(p); err != nil {
+		log.Printf("unable to update for sell order:%v\n%+v", err, p)
+	}
+	return true
+}
+
+// raiseTrailingStop moves the high water mark of a simulated trailing stop
+// order up to the price, and its stop trail_percent below it. The stop never
+// moves down.
+func raiseTrailingStop(o *alpaca.Order, price decimal.Decimal) {
+	if o.Type != alpaca.TrailingStop || o.TrailPercent == nil {
+		return
+	}
+	if o.Hwm != nil && !price.GreaterThan(*o.Hwm) {
+		return
+	}
+	hwm := price
+	stop := hwm.Mul(decimal.NewFromInt(1).Sub(o.TrailPercent.Div(decimal.NewFromInt(100))))
+	o.Hwm, o.StopPrice = &hwm, &stop
+}
+
+// trailStops raises the stop of each stop order of the trailing_stop_emulated
+// sell mode to trailing_stop_percent below the price, once the price has
+// risen enough to move it by a tick.
+func (c *client) trailStops() {
+	if c.cfg.Params.sellMode != sellModeEmulatedTrailingStop {
+		return
+	}
+	var price *decimal.Decimal
+	for _, p := range c.inProgressSellOrders() {
+		o := p.SellOrder
+		if o.Type != alpaca.Stop || o.StopPrice == nil {
+			continue
+		}
+		if price == nil {
+			latest, err := c.trailPrice()
+			if err != nil {
+				log.Printf("unable to trail stops: %v", err)
+				return
+			}
+			price = &latest
+		}
+		stop := trailingStopPrice(*price, c.cfg.Params.trailingStopPercent)
+		if !stop.GreaterThan(*o.StopPrice) {
+			continue
+		}
+		if err := c.replaceTrailingStop(p, stop); err != nil {
+			log.Printf("unable to raise stop of sell order %q to $%v: %v", o.ID, stop, err)
+			continue
+		}
+		if err := c.dbClient.Update(p); err != nil {
+			log.Printf("unable to update for trailing stop:%v\n%+v", err, p)
+		}
+	}
+}
+
+// trailPrice returns the price the emulated trailing stops trail.
+func (c *client) trailPrice() (decimal.Decimal, error) {
+	if c.cfg.Backtest {
+		return c.fakeCurrentPrice().sellTriggerPrice(), nil
+	}
+	return c.latestPrice()
+}
+
+// replaceTrailingStop replaces the stop order of the purchase with one at the
+// higher stop. Simulated orders are changed in place.
+func (c *client) replaceTrailingStop(p *purchase.Purchase, stop decimal.Decimal) error {
+	log.Printf("raising stop of sell order %q from $%v to $%v", p.SellOrder.ID, p.SellOrder.StopPrice, stop)
+	if c.cfg.Backtest || c.shadow {
+		p.SellOrder.StopPrice = &stop
+		return nil
+	}
+	replaced, err := c.alpacaClient.ReplaceOrder(p.SellOrder.ID, alpaca.ReplaceOrderRequest{
+		StopPrice:   &stop,
+		TimeInForce: p.SellOrder.TimeInForce,
+	})
+	if err != nil {
+		return err
+	}
+	p.AddReplacements(purchase.NewReplacement(p.SellOrder, replaced.ID))
+	p.SellOrder = replaced
+	return nil
+}
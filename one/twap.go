@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	twapSlices   = flag.Int("twap_slices", 0, "When above 1, buys of at least twap_min_qty shares are split into this many market child orders spread evenly over twap_duration (TWAP). The child orders make up one purchase, bought at their average fill price. Requires the market entry_order_type.")
+	twapDuration = flag.Duration("twap_duration", 5*time.Minute, "The time a TWAP buy is spread over.")
+	twapMinQty   = flag.Float64("twap_min_qty", 0, "The smallest buy quantity which is split into TWAP child orders. Smaller buys are placed as a single order.")
+)
+
+const (
+	// twapIDPrefix is the prefix of the ID of a TWAP buy order. The order is
+	// not known to Alpaca, its child orders are.
+	twapIDPrefix = "twap-"
+	// twapScheduled is the status of a child order which is not placed yet.
+	twapScheduled = "scheduled"
+)
+
+// isTWAP returns true if the order is a TWAP buy order, whose child orders
+// are stored as its legs.
+func isTWAP(o *alpaca.Order) bool {
+	return o != nil && strings.HasPrefix(o.ID, twapIDPrefix)
+}
+
+// useTWAP returns true if the buy order is split into TWAP child orders.
+// Shadow clients fill market orders at once, so they are never split.
+func (c *client) useTWAP(req *alpaca.PlaceOrderRequest) bool {
+	return c.cfg.TWAPSlices > 1 && !c.shadow && req.Type == alpaca.Market &&
+		req.Qty.GreaterThanOrEqual(decimal.NewFromFloat(c.cfg.TWAPMinQty))
+}
+
+// startTWAP stores a new purchase whose buy is split into child orders over
+// twap_duration, and places the first child order. The rest are placed by
+// updateTWAP as they come due.
+func (c *client) startTWAP(req *alpaca.PlaceOrderRequest, takeProfit *decimal.Decimal) *purchase.Purchase {
+	now := c.now()
+	slices := splitTWAP(req.Qty, c.cfg.TWAPSlices)
+	interval := c.cfg.TWAPDuration / time.Duration(len(slices))
+	var children []alpaca.Order
+	for i, qty := range slices {
+		children = append(children, alpaca.Order{
+			ClientOrderID: fmt.Sprintf("%s-t%d", req.ClientOrderID, i+1),
+			Symbol:        c.stockSymbol,
+			Side:          alpaca.Buy,
+			Type:          alpaca.Market,
+			TimeInForce:   alpaca.Day,
+			Qty:           qty,
+			Status:        twapScheduled,
+			SubmittedAt:   now.Add(time.Duration(i) * interval),
+		})
+	}
+	o := &alpaca.Order{
+		ID:            twapIDPrefix + req.ClientOrderID,
+		ClientOrderID: req.ClientOrderID,
+		Symbol:        c.stockSymbol,
+		Side:          alpaca.Buy,
+		Type:          alpaca.Market,
+		TimeInForce:   alpaca.Day,
+		Qty:           req.Qty,
+		CreatedAt:     now,
+		SubmittedAt:   now,
+		Legs:          &children,
+	}
+	c.updateTWAP(o, now)
+	p := &purchase.Purchase{
+		BuyOrder:          o,
+		Strategy:          c.strategy,
+		TakeProfitPercent: takeProfit,
+	}
+	c.purchases = append(c.purchases, p)
+	log.Printf("TWAP buy of %v %v placed as %v child orders over %v", req.Qty, c.stockSymbol, len(slices), c.cfg.TWAPDuration)
+
+	if err := c.dbClient.Insert(p); err != nil {
+		log.Printf("unable to insert buy order in database: %v", err)
+	}
+	return p
+}
+
+// splitTWAP splits the quantity into at most n whole share child orders,
+// with any remainder added to the last one.
+func splitTWAP(qty decimal.Decimal, n int) []decimal.Decimal {
+	if whole := int(qty.IntPart()); whole < n {
+		n = whole
+	}
+	if n < 1 {
+		return []decimal.Decimal{qty}
+	}
+	slice := qty.Div(decimal.NewFromInt(int64(n))).Floor()
+	slices := make([]decimal.Decimal, n)
+	for i := range slices {
+		slices[i] = slice
+	}
+	slices[n-1] = qty.Sub(slice.Mul(decimal.NewFromInt(int64(n - 1))))
+	return slices
+}
+
+// updateTWAP refreshes the working child orders of the TWAP buy order and
+// places those which are due, then updates the totals of the order. Once
+// trading stops, the children which are not placed yet are cancelled.
+func (c *client) updateTWAP(o *alpaca.Order, now time.Time) {
+	wasBought := o.FilledQty.IsPositive()
+	for i := range *o.Legs {
+		child := &(*o.Legs)[i]
+		switch {
+		case child.Status == twapScheduled && !c.isTrading():
+			child.Status = "canceled"
+			child.CanceledAt = &now
+		case child.Status == twapScheduled && !child.SubmittedAt.After(now):
+			c.placeTWAPChild(child)
+		case child.Status != twapScheduled && !closedOrderStatuses[child.Status]:
+			if latest, _ := c.order(child.ID); latest != nil {
+				*child = *latest
+			}
+		}
+	}
+	twapTotals(o, now)
+	if c.cfg.Backtest && !wasBought && o.FilledQty.IsPositive() {
+		// A TWAP buy is one trade however many child orders fill.
+		c.backtestTrades++
+	}
+}
+
+// placeTWAPChild places the child order. A child order which cannot be placed
+// is rejected, and the TWAP buy carries on with the rest.
+func (c *client) placeTWAPChild(child *alpaca.Order) {
+	req := &alpaca.PlaceOrderRequest{
+		AssetKey:      &c.stockSymbol,
+		Qty:           child.Qty,
+		Side:          alpaca.Buy,
+		Type:          alpaca.Market,
+		TimeInForce:   alpaca.Day,
+		ClientOrderID: child.ClientOrderID,
+	}
+	if c.cfg.Backtest {
+		*child = *c.fakeBuyOrder(req)
+		return
+	}
+	placed, err := c.placeOrder(req)
+	if err != nil {
+		log.Printf("unable to place TWAP child order %q: %v", child.ClientOrderID, err)
+		now := time.Now()
+		child.Status = "rejected"
+		child.FailedAt = &now
+		return
+	}
+	*child = *placed
+}
+
+// cancelTWAP cancels the child orders of the TWAP buy order which are not
+// filled, and updates its totals.
+func (c *client) cancelTWAP(o *alpaca.Order, now time.Time) {
+	for i := range *o.Legs {
+		child := &(*o.Legs)[i]
+		switch {
+		case child.Status == twapScheduled:
+			child.Status = "canceled"
+			child.CanceledAt = &now
+		case closedOrderStatuses[child.Status]:
+		case c.cfg.Backtest:
+			c.fakeCancelOrder(child)
+		default:
+			if err := c.alpacaClient.CancelOrder(child.ID); err != nil {
+				log.Printf("unable to cancel %q: %v", child.ID, err)
+			}
+		}
+	}
+	twapTotals(o, now)
+}
+
+// twapTotals sets the status, filled quantity and average fill price of the
+// TWAP buy order from its child orders. The order is filled once every child
+// order has ended and some of them filled, even if not all of the quantity
+// was bought.
+func twapTotals(o *alpaca.Order, now time.Time) {
+	filledQty := decimal.Zero
+	cost := decimal.Zero
+	working := false
+	var filledAt *time.Time
+	for _, child := range *o.Legs {
+		if !closedOrderStatuses[child.Status] {
+			working = true
+		}
+		if !child.FilledQty.IsPositive() || child.FilledAvgPrice == nil {
+			continue
+		}
+		filledQty = filledQty.Add(child.FilledQty)
+		cost = cost.Add(child.FilledAvgPrice.Mul(child.FilledQty))
+		if child.FilledAt != nil && (filledAt == nil || child.FilledAt.After(*filledAt)) {
+			filledAt = child.FilledAt
+		}
+	}
+	o.FilledQty = filledQty
+	o.FilledAvgPrice = nil
+	if filledQty.IsPositive() {
+		avg := cost.Div(filledQty).Round(4)
+		o.FilledAvgPrice = &avg
+	}
+	switch {
+	case working && filledQty.IsPositive():
+		o.Status = "partially_filled"
+	case working:
+		o.Status = "new"
+	case filledQty.IsPositive():
+		o.Status = filled
+		if filledAt == nil {
+			filledAt = &now
+		}
+		o.FilledAt = filledAt
+	default:
+		o.Status = "canceled"
+		o.CanceledAt = &now
+	}
+	o.UpdatedAt = now
+}
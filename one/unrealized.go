@@ -0,0 +1,331 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/stream"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	unrealizedInterval = flag.Duration("unrealized_pl_interval", 5*time.Second, "How often the unrealized P/L of open purchases is recomputed.")
+	streamPrices       = flag.Bool("stream_prices", true, "If true, trades of held symbols are streamed to price open purchases, otherwise the latest trade is requested for each computation.")
+	maxStreamPriceAge  = flag.Duration("max_stream_price_age", 30*time.Second, "A streamed price older than this is not used, and the latest trade is requested instead.")
+	maxUnrealizedLoss  = flag.Float64("max_unrealized_loss_per_position", 0, "When positive, an alert is sent and no new purchases are made while the unrealized loss of any purchase exceeds this many dollars.")
+)
+
+// positionPL is the unrealized P/L of the shares held by a purchase.
+type positionPL struct {
+	purchase *purchase.Purchase
+	symbol   string
+	qty      decimal.Decimal
+	cost     decimal.Decimal
+	price    decimal.Decimal
+	pl       decimal.Decimal
+}
+
+// unrealizedPL is the unrealized P/L of a client's open purchases at a point
+// in time.
+type unrealizedPL struct {
+	time      time.Time
+	positions []positionPL
+	bySymbol  map[string]decimal.Decimal
+	total     decimal.Decimal
+}
+
+// symbols returns the held symbols in order.
+func (u *unrealizedPL) symbols() []string {
+	var symbols []string
+	for s := range u.bySymbol {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// streamedPrice is the price of the latest streamed trade of a symbol.
+type streamedPrice struct {
+	price decimal.Decimal
+	time  time.Time
+}
+
+// plTracker keeps the latest price of each held symbol and continuously
+// computes the unrealized P/L of each client's open purchases.
+type plTracker struct {
+	mu         sync.Mutex
+	clients    []*client
+	prices     map[string]streamedPrice
+	lows       map[*client]streamedPrice // The lowest trade streamed for each client since its purchases were last priced.
+	subscribed map[string]bool
+	latest     map[*client]*unrealizedPL
+	breached   map[int64]bool
+}
+
+// unrealized is the tracker of the running trader. It is nil in backtests.
+var unrealized *plTracker
+
+func newPLTracker(clients []*client) *plTracker {
+	return &plTracker{
+		clients:    clients,
+		prices:     map[string]streamedPrice{},
+		lows:       map[*client]streamedPrice{},
+		subscribed: map[string]bool{},
+		latest:     map[*client]*unrealizedPL{},
+		breached:   map[int64]bool{},
+	}
+}
+
+// startUnrealizedPL starts tracking the unrealized P/L of the clients.
+func startUnrealizedPL(clients []*client) {
+	unrealized = newPLTracker(clients)
+	go unrealized.run()
+}
+
+// setClients sets the clients whose purchases are tracked.
+func (t *plTracker) setClients(clients []*client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clients = clients
+}
+
+// run recomputes the unrealized P/L every unrealized_pl_interval.
+func (t *plTracker) run() {
+	ticker := time.NewTicker(*unrealizedInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.update()
+	}
+}
+
+// update subscribes to the symbols which are held and recomputes the
+// unrealized P/L of each client.
+func (t *plTracker) update() {
+	t.mu.Lock()
+	clients := t.clients
+	t.mu.Unlock()
+
+	held := map[string]bool{}
+	for _, c := range clients {
+		c.do(func() {
+			if len(heldPurchases(c.purchases)) > 0 {
+				held[c.stockSymbol] = true
+			}
+		})
+	}
+	if *streamPrices {
+		t.subscribe(held)
+	}
+	for _, c := range clients {
+		u, err := t.compute(c)
+		if err != nil {
+			log.Printf("unable to compute unrealized P/L for %v: %v", c.strategy, err)
+			continue
+		}
+		t.mu.Lock()
+		t.latest[c] = u
+		t.mu.Unlock()
+		if !c.shadow {
+			t.checkLossLimit(c, u)
+		}
+	}
+}
+
+// subscribe streams trades of the held symbols, and stops streaming trades
+// of symbols which are no longer held.
+func (t *plTracker) subscribe(held map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for symbol := range held {
+		if t.subscribed[symbol] {
+			continue
+		}
+		if err := stream.Register(tradeStream(symbol), t.handleTrade); err != nil {
+			log.Printf("unable to stream trades of %v: %v", symbol, err)
+			continue
+		}
+		t.subscribed[symbol] = true
+	}
+	for symbol := range t.subscribed {
+		if held[symbol] {
+			continue
+		}
+		if err := stream.Deregister(tradeStream(symbol)); err != nil {
+			log.Printf("unable to stop streaming trades of %v: %v", symbol, err)
+		}
+		delete(t.subscribed, symbol)
+		delete(t.prices, symbol)
+	}
+}
+
+// handleTrade records the price of a streamed trade. The lowest trade is
+// kept for each client of the symbol, so the lowest price of its purchases
+// includes the dips between computations. Purchases bought after the lowest
+// trade only record the latest price.
+func (t *plTracker) handleTrade(msg interface{}) {
+	trade, ok := msg.(alpaca.StreamTrade)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := streamedPrice{
+		price: decimal.NewFromFloat32(trade.Price),
+		time:  time.Unix(0, trade.Timestamp),
+	}
+	t.prices[trade.Symbol] = p
+	for _, c := range t.clients {
+		if c.stockSymbol != trade.Symbol {
+			continue
+		}
+		if low, ok := t.lows[c]; !ok || p.price.LessThan(low.price) {
+			t.lows[c] = p
+		}
+	}
+}
+
+// takeLow returns the lowest trade streamed for the client since the last
+// call, if any.
+func (t *plTracker) takeLow(c *client) (streamedPrice, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	low, ok := t.lows[c]
+	delete(t.lows, c)
+	return low, ok
+}
+
+// price returns the latest streamed price of the client's symbol, or the
+// latest trade if no recent trade was streamed.
+func (t *plTracker) price(c *client) (decimal.Decimal, error) {
+	t.mu.Lock()
+	p, ok := t.prices[c.stockSymbol]
+	t.mu.Unlock()
+	if ok && time.Since(p.time) <= *maxStreamPriceAge {
+		return p.price, nil
+	}
+	return c.latestPrice()
+}
+
+// compute returns the unrealized P/L of the client's open purchases.
+func (t *plTracker) compute(c *client) (*unrealizedPL, error) {
+	u := &unrealizedPL{
+		time:     time.Now(),
+		bySymbol: map[string]decimal.Decimal{},
+	}
+	var held []*purchase.Purchase
+	c.do(func() { held = heldPurchases(c.purchases) })
+	if len(held) == 0 {
+		return u, nil
+	}
+	// The price is requested outside of the client's shard, so the shard is
+	// not held up by the request.
+	price, err := t.price(c)
+	if err != nil {
+		return nil, err
+	}
+	low, streamedLow := t.takeLow(c)
+	c.do(func() {
+		for _, p := range held {
+			p.RecordPrice(price)
+			if streamedLow && p.BuyOrder.FilledAt != nil && !low.time.Before(*p.BuyOrder.FilledAt) {
+				p.RecordPrice(low.price)
+			}
+			pos := newPositionPL(p, price)
+			u.positions = append(u.positions, pos)
+			u.bySymbol[pos.symbol] = u.bySymbol[pos.symbol].Add(pos.pl)
+			u.total = u.total.Add(pos.pl)
+		}
+	})
+	return u, nil
+}
+
+// checkLossLimit alerts once for each purchase whose unrealized loss exceeds
+// max_unrealized_loss_per_position.
+func (t *plTracker) checkLossLimit(c *client, u *unrealizedPL) {
+	if *maxUnrealizedLoss <= 0 {
+		return
+	}
+	limit := decimal.NewFromFloat(-*maxUnrealizedLoss)
+	for _, pos := range u.positions {
+		if !pos.pl.LessThan(limit) {
+			continue
+		}
+		t.mu.Lock()
+		alerted := t.breached[pos.purchase.ID]
+		t.breached[pos.purchase.ID] = true
+		t.mu.Unlock()
+		if !alerted {
+			go c.alert(fmt.Sprintf("purchase %d of %v %v has an unrealized loss of $%v, more than the $%v limit",
+				pos.purchase.ID, pos.qty, pos.symbol, pos.pl.Neg().StringFixed(2), *maxUnrealizedLoss))
+		}
+	}
+}
+
+// overLossLimit returns true if any of the client's open purchases had an
+// unrealized loss above max_unrealized_loss_per_position when the unrealized
+// P/L was last computed.
+func (t *plTracker) overLossLimit(c *client) bool {
+	if *maxUnrealizedLoss <= 0 {
+		return false
+	}
+	u := t.snapshot(c)
+	if u == nil {
+		return false
+	}
+	limit := decimal.NewFromFloat(-*maxUnrealizedLoss)
+	for _, pos := range u.positions {
+		if pos.pl.LessThan(limit) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot returns the most recently computed unrealized P/L of the client,
+// or nil if it has not been computed yet.
+func (t *plTracker) snapshot(c *client) *unrealizedPL {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.latest[c]
+}
+
+// tradeStream returns the name of the stream of trades of the symbol.
+func tradeStream(symbol string) string {
+	return "T." + symbol
+}
+
+// heldPurchases returns the purchases which currently hold shares.
+func heldPurchases(purchases []*purchase.Purchase) []*purchase.Purchase {
+	var held []*purchase.Purchase
+	for _, p := range purchases {
+		if p.BuyOrder == nil || p.BuyOrder.FilledAvgPrice == nil || p.BuyOrder.FilledQty.IsZero() || p.SellFilled() {
+			continue
+		}
+		held = append(held, p)
+	}
+	return held
+}
+
+// newPositionPL returns the unrealized P/L of the shares held by the
+// purchase. Shares which were already sold are excluded.
+func newPositionPL(p *purchase.Purchase, price decimal.Decimal) positionPL {
+	qty := p.BuyOrder.FilledQty
+	if p.SellOrder != nil {
+		qty = qty.Sub(p.SellOrder.FilledQty)
+	}
+	cost := *p.BuyOrder.FilledAvgPrice
+	return positionPL{
+		purchase: p,
+		symbol:   p.BuyOrder.Symbol,
+		qty:      qty,
+		cost:     cost,
+		price:    price,
+		pl:       price.Sub(cost).Mul(qty),
+	}
+}
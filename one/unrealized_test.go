@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+func TestStreamedLowRecordsLowestPrice(t *testing.T) {
+	now := time.Now()
+	held := func(boughtAt time.Time) *purchase.Purchase {
+		bought := decimal.NewFromInt(100)
+		return &purchase.Purchase{BuyOrder: &alpaca.Order{
+			Status:         filled,
+			Qty:            decimal.NewFromInt(10),
+			FilledQty:      decimal.NewFromInt(10),
+			FilledAvgPrice: &bought,
+			FilledAt:       &boughtAt,
+		}}
+	}
+	p := held(now.Add(-time.Minute))
+	later := held(now.Add(-1500 * time.Millisecond))
+	c := &client{stockSymbol: "SPY", purchases: []*purchase.Purchase{p, later}}
+	tracker := newPLTracker([]*client{c})
+
+	trade := func(price float32, at time.Time) {
+		tracker.handleTrade(alpaca.StreamTrade{Symbol: "SPY", Price: price, Timestamp: at.UnixNano()})
+	}
+	trade(98, now.Add(-3*time.Second))
+	trade(97, now.Add(-2*time.Second))
+	trade(99, now.Add(-time.Second))
+	trade(101, now.Add(-time.Second))
+	if _, err := tracker.compute(c); err != nil {
+		t.Fatalf("compute() = %v", err)
+	}
+	if p.LowestPrice == nil || !p.LowestPrice.Equal(decimal.NewFromInt(97)) {
+		t.Errorf("lowest price = %v, want the 97 streamed while held between computations", p.LowestPrice)
+	}
+	if later.LowestPrice == nil || !later.LowestPrice.Equal(decimal.NewFromInt(101)) {
+		t.Errorf("lowest price of a purchase bought after the low = %v, want the latest price 101", later.LowestPrice)
+	}
+
+	// The low is only applied once.
+	p.LowestPrice = nil
+	if _, err := tracker.compute(c); err != nil {
+		t.Fatalf("compute() = %v", err)
+	}
+	if p.LowestPrice == nil || !p.LowestPrice.Equal(decimal.NewFromInt(101)) {
+		t.Errorf("lowest price = %v after a computation without new trades, want the latest price 101", p.LowestPrice)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+// validateCommand is the command which compares the daily profit/loss of the
+// purchases in the database with the portfolio history in Alpaca, e.g.
+// "one validate-pl -from 2020-12-01 -to 2020-12-31".
+const validateCommand = "validate-pl"
+
+// dailyPL is the profit/loss of a day.
+type dailyPL struct {
+	local  decimal.Decimal
+	alpaca decimal.Decimal
+	// heldOvernight is true when a purchase held over a close was open on the
+	// day, so Alpaca includes unrealized profit/loss which is not in the
+	// database.
+	heldOvernight bool
+	// inAlpaca is true when the portfolio history has the day.
+	inAlpaca bool
+}
+
+// validateProfitLoss reports the days on which the realized profit/loss of
+// the purchases in the database differs from the profit/loss in the
+// portfolio history of the account. A difference points to purchases which
+// were not stored or were stored with the wrong orders.
+func validateProfitLoss(args []string) error {
+	fs := flag.NewFlagSet(validateCommand, flag.ContinueOnError)
+	from := fs.String("from", "", "The first day to validate (format: 2006-01-02).")
+	to := fs.String("to", "", "The last day to validate (format: 2006-01-02). Defaults to yesterday.")
+	tolerance := fs.Float64("tolerance", 1, "The difference in dollars allowed before a day is reported.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("-from is required")
+	}
+	start, err := time.ParseInLocation("2006-01-02", *from, EST)
+	if err != nil {
+		return fmt.Errorf("unable to parse -from: %v", err)
+	}
+	now := time.Now().In(EST)
+	last := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, EST)
+	if *to != "" {
+		if last, err = time.ParseInLocation("2006-01-02", *to, EST); err != nil {
+			return fmt.Errorf("unable to parse -to: %v", err)
+		}
+	}
+	if last.Before(start) {
+		return fmt.Errorf("-to is before -from")
+	}
+	end := last.AddDate(0, 0, 1)
+
+	days := map[string]*dailyPL{}
+	day := func(d string) *dailyPL {
+		if days[d] == nil {
+			days[d] = &dailyPL{}
+		}
+		return days[d]
+	}
+
+	alpacaClient := alpaca.NewClient(common.Credentials())
+	period := fmt.Sprintf("%dD", int(math.Ceil(end.Sub(start).Hours()/24)))
+	timeframe := alpaca.Day1
+	history, err := alpacaClient.GetPortfolioHistory(&period, &timeframe, &last, false)
+	if err != nil {
+		return fmt.Errorf("unable to get portfolio history: %v", err)
+	}
+	// The profit/loss of the history is from the base value, so the profit/loss
+	// of a day is the change from the day before.
+	previous := decimal.Zero
+	for i, ts := range history.Timestamp {
+		if i >= len(history.ProfitLoss) {
+			break
+		}
+		t := time.Unix(ts, 0).In(EST)
+		pl := history.ProfitLoss[i]
+		if !t.Before(start) && t.Before(end) {
+			d := day(t.Format("2006-01-02"))
+			d.alpaca = pl.Sub(previous)
+			d.inAlpaca = true
+		}
+		previous = pl
+	}
+
+	db, err := database.NewInstance(*databaseName, *instanceName)
+	if err != nil {
+		return fmt.Errorf("unable to open db: %v", err)
+	}
+	purchases, err := db.PurchasesBetween(start.Add(-heldPurchasesLookback), end)
+	if err != nil {
+		return err
+	}
+	for _, p := range purchases {
+		if p.Shadow || !p.BuyFilled() {
+			continue
+		}
+		if p.SellFilled() && p.SellOrder.FilledAt != nil {
+			sold := p.SellOrder.FilledAt.In(EST)
+			if !sold.Before(start) && sold.Before(end) {
+				d := day(sold.Format("2006-01-02"))
+				d.local = d.local.Add(p.RealizedProfitLoss())
+			}
+		}
+		markHeldOvernight(p, start, end, day)
+	}
+
+	var dates []string
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		if days[d.Format("2006-01-02")] != nil {
+			dates = append(dates, d.Format("2006-01-02"))
+		}
+	}
+	max := decimal.NewFromFloat(*tolerance)
+	var validated, differ, explained int
+	fmt.Printf("%-10v  %12v  %12v  %12v\n", "day", "database", "alpaca", "difference")
+	for _, date := range dates {
+		d := days[date]
+		if !d.inAlpaca && d.local.IsZero() {
+			// A day the market was closed.
+			continue
+		}
+		validated++
+		diff := d.local.Sub(d.alpaca)
+		note := ""
+		switch {
+		case !d.inAlpaca:
+			note = "not in the portfolio history"
+			differ++
+		case diff.Abs().LessThanOrEqual(max):
+		case d.heldOvernight:
+			note = "held overnight, the portfolio history includes unrealized profit/loss"
+			explained++
+		default:
+			note = "DIFFERS"
+			differ++
+		}
+		fmt.Printf("%-10v  %12v  %12v  %12v  %v\n", date, d.local.StringFixed(2), d.alpaca.StringFixed(2), diff.StringFixed(2), note)
+	}
+	log.Printf("validated %v days, %v differ by more than $%v, %v more differ because purchases were held overnight", validated, differ, max.StringFixed(2), explained)
+	if differ > 0 {
+		return fmt.Errorf("%v days differ from the portfolio history", differ)
+	}
+	return nil
+}
+
+// markHeldOvernight marks the days in [start, end) from the day the purchase
+// was bought to the day it was sold, if it was held over a close.
+func markHeldOvernight(p *purchase.Purchase, start, end time.Time, day func(string) *dailyPL) {
+	if p.BuyOrder.FilledAt == nil {
+		return
+	}
+	sold := end
+	if p.SellFilled() && p.SellOrder.FilledAt != nil {
+		sold = p.SellOrder.FilledAt.In(EST)
+	}
+	b := p.BuyOrder.FilledAt.In(EST)
+	bought := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, EST)
+	if sold.Before(bought.AddDate(0, 0, 1)) {
+		return
+	}
+	for d := bought; d.Before(end) && !d.After(sold); d = d.AddDate(0, 0, 1) {
+		if !d.Before(start) {
+			day(d.Format("2006-01-02")).heldOvernight = true
+		}
+	}
+}
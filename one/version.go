@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Build information which is set at build time with:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// buildInfo describes the code that is running.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+}
+
+// currentBuildInfo returns the build information of the running binary.
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+	}
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("trader-one %s (commit %s, built %s)", b.Version, b.Commit, b.BuildTime)
+}
+
+// serveVersion serves the build information as JSON.
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentBuildInfo()); err != nil {
+		log.Printf("unable to encode build info: %v", err)
+	}
+}
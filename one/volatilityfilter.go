@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/trader/indicators"
+)
+
+var (
+	minVolatilityPercent = flag.Float64("min_volatility_percent", 0, "When positive, buy signals are skipped while the standard deviation of the returns of the last volatility_filter_bars bars is below this percentage, since the take profit is unlikely to be reached.")
+	maxVolatilityPercent = flag.Float64("max_volatility_percent", 0, "When positive, buy signals are skipped while the standard deviation of the returns of the last volatility_filter_bars bars is above this percentage, since the stop is likely to be hit by noise.")
+	volatilityFilterBars = flag.Int("volatility_filter_bars", 20, "The number of bar returns the volatility filter measures.")
+)
+
+// volatilityBlock returns the volatility_filter rule if the volatility of the
+// recent bars is outside of the allowed range, or nil if buying is allowed.
+// Buying is allowed when the volatility cannot be measured.
+func (c *client) volatilityBlock(bars []alpaca.Bar) *entryBlock {
+	if c.cfg.MinVolatilityPercent <= 0 && c.cfg.MaxVolatilityPercent <= 0 {
+		return nil
+	}
+	v, ok := indicators.Volatility(c.volatilityBars(bars, c.cfg.VolatilityFilterBars+1), 0)
+	if !ok {
+		log.Printf("unable to measure the volatility of %v, not filtering the buy signal", c.stockSymbol)
+		return nil
+	}
+	pct := v * 100
+	switch {
+	case c.cfg.MinVolatilityPercent > 0 && pct < c.cfg.MinVolatilityPercent:
+		return &entryBlock{ruleVolatility, fmt.Sprintf("volatility of %.4f%% is below %v%%", pct, c.cfg.MinVolatilityPercent)}
+	case c.cfg.MaxVolatilityPercent > 0 && pct > c.cfg.MaxVolatilityPercent:
+		return &entryBlock{ruleVolatility, fmt.Sprintf("volatility of %.4f%% is above %v%%", pct, c.cfg.MaxVolatilityPercent)}
+	}
+	return nil
+}
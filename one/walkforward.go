@@ -0,0 +1,226 @@
+// Example command line to run:
+// go run . -run_backtest=true -backtest_file=SPY_sample.txt -backtest_starttime="2020-01-02 04:00:00" -max_concurrent_purchases=20 -purchase_quanity=10 -backtest_sweep_min_slopes=0.5,1,1.3,2 -backtest_sweep_num_historical_bars=2,3,4,5 -backtest_walk_forward_in_sample_days=5 -backtest_walk_forward_out_of_sample_days=1
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	backtestWalkForwardInSampleDays    = flag.Int("backtest_walk_forward_in_sample_days", 0, "When positive, a walk-forward analysis is run instead of the backtest. The history is split into rolling windows, and on the in-sample trading days of each window the combination of backtest_sweep_min_slopes and backtest_sweep_num_historical_bars with the best profit is chosen. The chosen params are then evaluated on the following backtest_walk_forward_out_of_sample_days, and the windows roll forward by that many days.")
+	backtestWalkForwardOutOfSampleDays = flag.Int("backtest_walk_forward_out_of_sample_days", 1, "The number of trading days after each in-sample window on which the chosen params are evaluated.")
+	backtestWalkForwardOutput          = flag.String("backtest_walk_forward_output", "walkforward.csv", "The file the walk-forward windows are written to as CSV.")
+)
+
+// walkForwardWindow is the outcome of a walk-forward window. The params are
+// chosen on [inSampleStart, outOfSampleStart) and evaluated on
+// [outOfSampleStart, end).
+type walkForwardWindow struct {
+	inSampleStart     time.Time
+	outOfSampleStart  time.Time
+	end               time.Time
+	numHistoricalBars int
+	minSlope          float64
+	inSample          sweepResult
+	outOfSample       sweepResult
+}
+
+// walkForward runs a walk-forward analysis of the swept strategy params, and
+// prints and writes the outcome of each window and a summary.
+func walkForward(h *history, base ClientConfig) error {
+	inDays, outDays := *backtestWalkForwardInSampleDays, *backtestWalkForwardOutOfSampleDays
+	if outDays < 1 {
+		return fmt.Errorf("backtest_walk_forward_out_of_sample_days must be at least 1")
+	}
+	g, err := newSweepGrid(base)
+	if err != nil {
+		return err
+	}
+	start, err := backtestStart()
+	if err != nil {
+		return err
+	}
+	days := h.tradingDays(start)
+	if len(days) < inDays+outDays {
+		return fmt.Errorf("the history has %v trading days from the start, fewer than the %v of a window", len(days), inDays+outDays)
+	}
+	end := backtestStopTime
+	if end.IsZero() {
+		end = h.endTime.Add(time.Minute)
+	}
+
+	var windows []walkForwardWindow
+	for i := 0; i+inDays+outDays <= len(days); i += outDays {
+		w := walkForwardWindow{
+			inSampleStart:    days[i],
+			outOfSampleStart: days[i+inDays],
+			end:              end,
+		}
+		if i+inDays+outDays < len(days) {
+			w.end = days[i+inDays+outDays]
+		}
+		first := true
+		for _, bars := range g.numHistoricalBars {
+			for _, slope := range g.minSlopes {
+				cfg := base
+				cfg.Params.numHistoricalBars = bars
+				cfg.Params.minSlope = slope
+				log.Printf("walk-forward window %v is running num_historical_bars_to_use=%v min_slope_required_to_buy=%v in-sample", len(windows)+1, bars, slope)
+				r, err := runWindow(h, cfg, w.inSampleStart, w.outOfSampleStart)
+				if err != nil {
+					return err
+				}
+				if first || r.profitLoss.GreaterThan(w.inSample.profitLoss) {
+					w.numHistoricalBars, w.minSlope, w.inSample = bars, slope, r
+					first = false
+				}
+			}
+		}
+		cfg := base
+		cfg.Params.numHistoricalBars = w.numHistoricalBars
+		cfg.Params.minSlope = w.minSlope
+		if w.outOfSample, err = runWindow(h, cfg, w.outOfSampleStart, w.end); err != nil {
+			return err
+		}
+		fmt.Printf("Window %v: num_historical_bars_to_use=%v min_slope_required_to_buy=%v In-Sample %v to %v Profit/Loss: %v%% Trades: %v Out-Of-Sample to %v Profit/Loss: %v%% Trades: %v\n",
+			len(windows)+1, w.numHistoricalBars, w.minSlope,
+			w.inSampleStart.In(EST).Format(referenceTime), w.outOfSampleStart.In(EST).Format(referenceTime),
+			w.inSample.profitLoss.StringFixed(3), w.inSample.trades,
+			w.end.In(EST).Format(referenceTime), w.outOfSample.profitLoss.StringFixed(3), w.outOfSample.trades)
+		windows = append(windows, w)
+	}
+
+	printWalkForwardSummary(windows)
+	return writeWalkForwardCSV(*backtestWalkForwardOutput, windows)
+}
+
+// runWindow runs the backtest from start until end, when the shares still
+// held are valued at the last price.
+func runWindow(h *history, cfg ClientConfig, start, end time.Time) (sweepResult, error) {
+	c, err := newFakeAt(h, cfg, start)
+	if err != nil {
+		return sweepResult{}, err
+	}
+	c.backtestStopAt = end
+	c.simulate()
+	return sweepResult{
+		profitLoss: profitLossPercent(c.backtestCashStart, c.backtestEquity()),
+		trades:     c.backtestTrades,
+	}, nil
+}
+
+// tradingDays returns the first minute of each day of the history, from
+// start and before backtest_stop_at.
+func (h *history) tradingDays(start time.Time) []time.Time {
+	first := map[string]time.Time{}
+	for epoch := range h.epochToTickerData {
+		t := time.Unix(epoch, 0).In(EST)
+		if t.Before(start) || (!backtestStopTime.IsZero() && !t.Before(backtestStopTime)) {
+			continue
+		}
+		day := t.Format("2006-01-02")
+		if f, ok := first[day]; !ok || t.Before(f) {
+			first[day] = t
+		}
+	}
+	var days []time.Time
+	for _, t := range first {
+		days = append(days, t)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days
+}
+
+// printWalkForwardSummary prints the combined outcome of the out-of-sample
+// windows. The walk-forward efficiency is the average out-of-sample profit as
+// a percentage of the average in-sample profit; a low efficiency means the
+// chosen params were overfit to their in-sample days.
+func printWalkForwardSummary(windows []walkForwardWindow) {
+	hundred := decimal.NewFromFloat(100)
+	compounded := decimal.NewFromFloat(1)
+	inSampleSum, outOfSampleSum := decimal.Zero, decimal.Zero
+	trades, profitable := 0, 0
+	chosen := map[string]int{}
+	for _, w := range windows {
+		compounded = compounded.Mul(hundred.Add(w.outOfSample.profitLoss).Div(hundred))
+		inSampleSum = inSampleSum.Add(w.inSample.profitLoss)
+		outOfSampleSum = outOfSampleSum.Add(w.outOfSample.profitLoss)
+		trades += w.outOfSample.trades
+		if w.outOfSample.profitLoss.IsPositive() {
+			profitable++
+		}
+		chosen[fmt.Sprintf("num_historical_bars_to_use=%v min_slope_required_to_buy=%v", w.numHistoricalBars, w.minSlope)]++
+	}
+	n := decimal.NewFromInt(int64(len(windows)))
+	inSampleAvg, outOfSampleAvg := inSampleSum.Div(n), outOfSampleSum.Div(n)
+
+	fmt.Printf("Walk-Forward Windows: %v\n", len(windows))
+	fmt.Printf("Out-Of-Sample Profit/Loss: %v%%\n", compounded.Sub(decimal.NewFromFloat(1)).Mul(hundred).StringFixed(3))
+	fmt.Printf("Out-Of-Sample Trades: %v\n", trades)
+	fmt.Printf("Profitable Out-Of-Sample Windows: %v of %v\n", profitable, len(windows))
+	fmt.Printf("Average In-Sample Profit/Loss: %v%%\n", inSampleAvg.StringFixed(3))
+	fmt.Printf("Average Out-Of-Sample Profit/Loss: %v%%\n", outOfSampleAvg.StringFixed(3))
+	if inSampleAvg.IsPositive() {
+		fmt.Printf("Walk-Forward Efficiency: %v%%\n", outOfSampleAvg.Div(inSampleAvg).Mul(hundred).StringFixed(1))
+	} else {
+		fmt.Printf("Walk-Forward Efficiency: n/a, the in-sample windows were not profitable\n")
+	}
+	var params []string
+	for p := range chosen {
+		params = append(params, p)
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		fmt.Printf("Chosen In %v Windows: %v\n", chosen[p], p)
+	}
+}
+
+// writeWalkForwardCSV writes a row for each walk-forward window.
+func writeWalkForwardCSV(filename string, windows []walkForwardWindow) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create %q: %v", filename, err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	header := []string{"window", "in_sample_start", "out_of_sample_start", "end", "num_historical_bars_to_use", "min_slope_required_to_buy", "in_sample_pl_pct", "in_sample_trades", "out_of_sample_pl_pct", "out_of_sample_trades"}
+	if err := w.Write(header); err != nil {
+		return fmt.Errorf("unable to write %q: %v", filename, err)
+	}
+	for i, win := range windows {
+		record := []string{
+			strconv.Itoa(i + 1),
+			win.inSampleStart.In(EST).Format(referenceTime),
+			win.outOfSampleStart.In(EST).Format(referenceTime),
+			win.end.In(EST).Format(referenceTime),
+			strconv.Itoa(win.numHistoricalBars),
+			strconv.FormatFloat(win.minSlope, 'f', -1, 64),
+			win.inSample.profitLoss.StringFixed(3),
+			strconv.Itoa(win.inSample.trades),
+			win.outOfSample.profitLoss.StringFixed(3),
+			strconv.Itoa(win.outOfSample.trades),
+		}
+		if err := w.Write(record); err != nil {
+			return fmt.Errorf("unable to write %q: %v", filename, err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("unable to write %q: %v", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write %q: %v", filename, err)
+	}
+	log.Printf("wrote walk-forward windows to %v", filename)
+	return nil
+}
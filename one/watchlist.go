@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+)
+
+var (
+	watchlistName            = flag.String("watchlist", "", "When set, the symbols to trade are read from the Alpaca watchlist with this name instead of stock_symbol. Each symbol is traded by its own client with the same strategy.")
+	watchlistRefreshInterval = flag.Duration("watchlist_refresh_interval", 0, "When positive, the watchlist is read again at this interval, e.g. 1h. New symbols start trading and removed symbols stop buying, while their open purchases are still sold.")
+)
+
+// alpacaHTTPClient sends the requests to the Alpaca API which the Alpaca
+// client does not support.
+var alpacaHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// watchlist is the subset of an Alpaca watchlist which is used.
+type watchlist struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Assets []struct {
+		Symbol string `json:"symbol"`
+	} `json:"assets"`
+}
+
+// watchlistSymbols returns the symbols of the named watchlist.
+func watchlistSymbols(name string) ([]string, error) {
+	var lists []watchlist
+	if err := getAlpacaAPI("/v2/watchlists", &lists); err != nil {
+		return nil, err
+	}
+	for _, l := range lists {
+		if l.Name != name {
+			continue
+		}
+		// The list of watchlists does not include their assets.
+		w := &watchlist{}
+		if err := getAlpacaAPI("/v2/watchlists/"+l.ID, w); err != nil {
+			return nil, err
+		}
+		var symbols []string
+		for _, a := range w.Assets {
+			symbols = append(symbols, a.Symbol)
+		}
+		if len(symbols) == 0 {
+			return nil, fmt.Errorf("watchlist %q has no symbols", name)
+		}
+		return symbols, nil
+	}
+	return nil, fmt.Errorf("watchlist %q does not exist", name)
+}
+
+// getAlpacaAPI makes a GET request to the Alpaca API and decodes the JSON
+// response into out. The Alpaca client does not support watchlists, nor
+// listing the orders submitted after a time.
+func getAlpacaAPI(path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*apiEndpoint, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("APCA-API-KEY-ID", common.Credentials().ID)
+	req.Header.Set("APCA-API-SECRET-KEY", common.Credentials().Secret)
+	resp, err := alpacaHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to get %v: %v", path, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned %v: %s", path, resp.Status, b)
+	}
+	return json.Unmarshal(b, out)
+}
+
+// newWatchlistClients returns a client for each symbol of the watchlist.
+func newWatchlistClients(cfg ClientConfig) ([]*client, error) {
+	if *experimentArmB != "" {
+		return nil, fmt.Errorf("experiments cannot be run with a watchlist")
+	}
+	symbols, err := watchlistSymbols(*watchlistName)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("trading watchlist %q: %v", *watchlistName, strings.Join(symbols, ", "))
+	var clients []*client
+	for _, s := range symbols {
+		c, err := newSymbolClient(s, cfg)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+// newSymbolClient returns a client trading the symbol with the config.
+func newSymbolClient(symbol string, cfg ClientConfig) (*client, error) {
+	c, err := new(symbol, *strategyName, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkPromotion(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// refreshWatchlist reads the watchlist again. Clients are added for new
+// symbols, and clients whose symbol was removed are retired. The clients are
+// returned with any new clients appended.
+func refreshWatchlist(clients []*client, cfg ClientConfig) []*client {
+	symbols, err := watchlistSymbols(*watchlistName)
+	if err != nil {
+		log.Printf("unable to refresh watchlist %q: %v", *watchlistName, err)
+		return clients
+	}
+	listed := map[string]bool{}
+	for _, s := range symbols {
+		listed[s] = true
+	}
+	trading := map[string]bool{}
+	for _, c := range clients {
+		if c.shadow && !c.cfg.WatchOnly {
+			continue
+		}
+		trading[c.stockSymbol] = true
+		switch {
+		case !listed[c.stockSymbol] && !c.retired:
+			log.Printf("%v was removed from watchlist %q, no longer buying it", c.stockSymbol, *watchlistName)
+			c.do(func() { c.retired = true })
+		case listed[c.stockSymbol] && c.retired:
+			log.Printf("%v was added back to watchlist %q, buying it again", c.stockSymbol, *watchlistName)
+			c.do(func() { c.retired = false })
+		}
+	}
+	for _, s := range symbols {
+		if trading[s] {
+			continue
+		}
+		c, err := newSymbolClient(s, cfg)
+		if err != nil {
+			log.Printf("unable to start trading %v from watchlist %q: %v", s, *watchlistName, err)
+			continue
+		}
+		if err := c.adoptRecentOrders(); err != nil {
+			log.Printf("unable to adopt orders for %v: %v", s, err)
+		}
+		log.Printf("%v was added to watchlist %q, now trading it", s, *watchlistName)
+		clients = append(clients, c)
+	}
+	return clients
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	watchOnly             = flag.Bool("watch_only", false, "If true, the strategy is evaluated on live data but no orders are placed. Its buys and sells are simulated as a shadow strategy's are, and each one is sent as a \"would buy now\" or \"would sell now\" notification to watch_slack_webhook_url and watch_telegram_chat_id, for trading manually with the trader as a signal scanner. The purchases are stored with the strategy name suffixed by \"/watch\".")
+	watchSlackWebhookURL  = flag.String("watch_slack_webhook_url", "", "The Slack incoming webhook URL which watch_only notifications are posted to.")
+	watchTelegramBotToken = flag.String("watch_telegram_bot_token", "", "The token of the Telegram bot which sends watch_only notifications to watch_telegram_chat_id.")
+	watchTelegramChatID   = flag.String("watch_telegram_chat_id", "", "The Telegram chat which watch_only notifications are sent to.")
+)
+
+const (
+	// watchStrategySuffix is appended to the strategy name of watch-only
+	// clients, so their simulated purchases are kept apart from trading.
+	watchStrategySuffix = "/watch"
+
+	webhookWatchSignal = "watch_signal"
+)
+
+// telegramAPI is the endpoint of the Telegram bot API.
+var telegramAPI = "https://api.telegram.org"
+
+// watchEntry notifies that a watch-only client would buy now, with the take
+// profit and stop it would sell at.
+func (c *client) watchEntry(p *purchase.Purchase, takeProfit, stop decimal.Decimal) {
+	if !c.cfg.WatchOnly {
+		return
+	}
+	exit := fmt.Sprintf("take profit %v, stop %v", takeProfit.StringFixed(2), stop.StringFixed(2))
+	if takeProfit.IsZero() {
+		exit = fmt.Sprintf("trailing stop from %v", stop.StringFixed(2))
+	}
+	msg := fmt.Sprintf("would buy %v %v now @ %v; %v",
+		p.BuyOrder.FilledQty, c.stockSymbol, p.BuyOrder.FilledAvgPrice.StringFixed(2), exit)
+	if p.EntryReason != "" {
+		msg += " (" + p.EntryReason + ")"
+	}
+	c.sendWatchSignal(msg)
+}
+
+// watchExit notifies that a watch-only client would sell now.
+func (c *client) watchExit(p *purchase.Purchase) {
+	if !c.cfg.WatchOnly || !p.SellFilled() {
+		return
+	}
+	leg, _ := p.ExitLeg()
+	c.sendWatchSignal(fmt.Sprintf("would sell %v %v now @ %v (%v), P/L $%v",
+		p.SellOrder.FilledQty, c.stockSymbol, p.SellOrder.FilledAvgPrice.StringFixed(2), leg,
+		p.RealizedProfitLoss().StringFixed(2)))
+}
+
+// sendWatchSignal logs the notification and sends it to Slack and Telegram.
+// Delivery happens in the background so evaluation is not delayed.
+func (c *client) sendWatchSignal(msg string) {
+	msg = fmt.Sprintf("%v %v: %v", c.now().In(EST).Format("15:04"), strings.TrimSuffix(c.strategy, watchStrategySuffix), msg)
+	log.Printf("watch signal: %v", msg)
+	go func() {
+		if c.cfg.WatchSlackWebhookURL != "" {
+			if err := postWatchSignal(c.cfg.WatchSlackWebhookURL, map[string]string{"text": msg}); err != nil {
+				log.Printf("unable to send watch signal to Slack: %v", err)
+			}
+		}
+		if c.cfg.WatchTelegramBotToken != "" && c.cfg.WatchTelegramChatID != "" {
+			url := fmt.Sprintf("%v/bot%v/sendMessage", telegramAPI, c.cfg.WatchTelegramBotToken)
+			if err := postWatchSignal(url, map[string]string{"chat_id": c.cfg.WatchTelegramChatID, "text": msg}); err != nil {
+				log.Printf("unable to send watch signal to Telegram: %v", err)
+			}
+		}
+	}()
+}
+
+// postWatchSignal POSTs the JSON body to the URL, retrying as webhooks are.
+func postWatchSignal(url string, body map[string]string) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("unable to marshal watch signal: %v", err)
+	}
+	return sendWebhook(url, webhookWatchSignal, b)
+}
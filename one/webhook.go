@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+)
+
+var (
+	webhookURLs        = flag.String("webhook_urls", "", "A comma separated list of URLs which are sent a JSON POST for each buy fill, sell fill, end of day summary and alert.")
+	webhookSecret      = flag.String("webhook_secret", "", "When set, each webhook request is signed with an HMAC-SHA256 of the body using this secret. The hex signature is sent in the X-Trader-Signature header as \"sha256=<signature>\".")
+	webhookMaxAttempts = flag.Int("webhook_max_attempts", 4, "The maximum number of attempts to deliver each webhook.")
+	webhookRetryDelay  = flag.Duration("webhook_retry_delay", 2*time.Second, "The delay before the first webhook retry. The delay doubles after each attempt.")
+)
+
+const (
+	webhookBuyFilled  = "buy_filled"
+	webhookSellFilled = "sell_filled"
+	webhookDaySummary = "day_summary"
+	webhookAlert      = "alert"
+)
+
+// webhookEvent is the JSON body sent to webhooks.
+type webhookEvent struct {
+	Type       string             `json:"type"`
+	Time       time.Time          `json:"time"`
+	Symbol     string             `json:"symbol"`
+	Strategy   string             `json:"strategy"`
+	Shadow     bool               `json:"shadow,omitempty"`
+	PurchaseID int64              `json:"purchase_id,omitempty"`
+	Order      *alpaca.Order      `json:"order,omitempty"`
+	ProfitLoss string             `json:"profit_loss,omitempty"`
+	Summary    *webhookSummary    `json:"summary,omitempty"`
+	Digest     *webhookDigestBody `json:"digest,omitempty"`
+	Message    string             `json:"message,omitempty"`
+}
+
+// webhookSummary summarizes the completed purchases of a trading day.
+type webhookSummary struct {
+	Trades     int    `json:"trades"`
+	Wins       int    `json:"wins"`
+	ProfitLoss string `json:"profit_loss"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookSends tracks the webhooks being delivered in the background.
+var webhookSends sync.WaitGroup
+
+// webhooksEnabled returns true if events should be sent. Backtests never send
+// events.
+func webhooksEnabled() bool {
+	return (*webhookURLs != "" || *webhookDigestURLs != "") && !*runBacktest
+}
+
+// notifyFill sends a webhook for an order of the purchase which has just been
+// filled.
+func (c *client) notifyFill(eventType string, p *purchase.Purchase, o *alpaca.Order) {
+	if !webhooksEnabled() {
+		return
+	}
+	e := &webhookEvent{
+		Type:       eventType,
+		Time:       time.Now(),
+		Symbol:     c.stockSymbol,
+		Strategy:   c.strategy,
+		Shadow:     c.shadow,
+		PurchaseID: p.ID,
+		Order:      o,
+	}
+	if eventType == webhookSellFilled && p.BuyFilled() {
+		e.ProfitLoss = p.RealizedProfitLoss().StringFixed(2)
+	}
+	if digestEnabled() {
+		digest.add(c, eventType, p, o)
+	}
+	sendWebhooksInBackground(e)
+}
+
+// notifyDaySummary sends a webhook summarizing the trading day. It is sent
+// once the close out is done, so its fills are included, and closeOutTrading
+// waits for the delivery so the summary is not lost when trading ends with
+// the process.
+func (c *client) notifyDaySummary() {
+	if !webhooksEnabled() {
+		return
+	}
+	s := newArmStats(c.purchases)
+	sendWebhooksInBackground(&webhookEvent{
+		Type:     webhookDaySummary,
+		Time:     time.Now(),
+		Symbol:   c.stockSymbol,
+		Strategy: c.strategy,
+		Shadow:   c.shadow,
+		Summary: &webhookSummary{
+			Trades:     s.trades,
+			Wins:       s.wins,
+			ProfitLoss: s.profitLoss.StringFixed(2),
+		},
+	})
+}
+
+// notifyAlert sends a webhook for a problem which needs attention. It does
+// not wait for the delivery, which may take a while with retries, so the
+// caller is not held up. closeOutTrading waits for the alerts of the close out.
+func (c *client) notifyAlert(msg string) {
+	if !webhooksEnabled() {
+		return
+	}
+	sendWebhooksInBackground(&webhookEvent{
+		Type:     webhookAlert,
+		Time:     time.Now(),
+		Symbol:   c.stockSymbol,
+		Strategy: c.strategy,
+		Shadow:   c.shadow,
+		Message:  msg,
+	})
+}
+
+// sendWebhooksInBackground delivers the event without waiting for it. Use
+// webhookSends to wait for the delivery.
+func sendWebhooksInBackground(e *webhookEvent) {
+	webhookSends.Add(1)
+	go func() {
+		defer webhookSends.Done()
+		sendWebhooks(e)
+	}()
+}
+
+// sendWebhooks delivers the event to every webhook_urls URL. Alerts and day
+// summaries are also delivered to every webhook_digest_urls URL, which is
+// otherwise only sent digests.
+func sendWebhooks(e *webhookEvent) {
+	urls := *webhookURLs
+	if e.Type == webhookAlert || e.Type == webhookDaySummary {
+		urls += "," + *webhookDigestURLs
+	}
+	sendWebhooksTo(urls, e)
+}
+
+// sendWebhooksTo delivers the event to each of the comma separated URLs.
+func sendWebhooksTo(urls string, e *webhookEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("unable to marshal webhook event: %v", err)
+		return
+	}
+	for _, url := range strings.Split(urls, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		if err := sendWebhook(url, e.Type, body); err != nil {
+			log.Printf("unable to send %v webhook to %q: %v", e.Type, url, err)
+		}
+	}
+}
+
+// sendWebhook POSTs the body to the URL, retrying on network errors and
+// server errors with exponential backoff.
+func sendWebhook(url, eventType string, body []byte) error {
+	delay := *webhookRetryDelay
+	var err error
+	for attempt := 1; attempt <= *webhookMaxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var retry bool
+		retry, err = postWebhook(url, eventType, body)
+		if err == nil || !retry {
+			return err
+		}
+		log.Printf("webhook attempt %d to %q failed: %v", attempt, url, err)
+	}
+	return fmt.Errorf("giving up after %d attempts: %v", *webhookMaxAttempts, err)
+}
+
+// postWebhook makes a single delivery attempt. It returns true if a failed
+// attempt should be retried.
+func postWebhook(url, eventType string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Trader-Event", eventType)
+	if *webhookSecret != "" {
+		req.Header.Set("X-Trader-Signature", "sha256="+webhookSignature(*webhookSecret, body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %v", resp.Status)
+	}
+	return false, fmt.Errorf("status %v", resp.Status)
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of the body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
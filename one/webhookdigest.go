@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	webhookDigestURLs     = flag.String("webhook_digest_urls", "", "A comma separated list of URLs which are sent a digest of the fills every webhook_digest_interval, instead of an event for each fill. Alerts and end of day summaries are still sent right away, and narration is not sent.")
+	webhookDigestInterval = flag.Duration("webhook_digest_interval", 15*time.Minute, "How often a digest is sent to webhook_digest_urls. Nothing is sent when there were no fills.")
+)
+
+const webhookDigest = "digest"
+
+// webhookDigestBody consolidates the fills since the previous digest.
+type webhookDigestBody struct {
+	Since         time.Time    `json:"since"`
+	Fills         []digestFill `json:"fills"`
+	ProfitLoss    string       `json:"profit_loss"`
+	OpenPurchases int          `json:"open_purchases"`
+	OpenExposure  string       `json:"open_exposure"`
+}
+
+// digestFill is a fill in a digest.
+type digestFill struct {
+	Time       time.Time `json:"time"`
+	Symbol     string    `json:"symbol"`
+	Strategy   string    `json:"strategy"`
+	Shadow     bool      `json:"shadow,omitempty"`
+	Side       string    `json:"side"`
+	Qty        string    `json:"qty"`
+	Price      string    `json:"price"`
+	PurchaseID int64     `json:"purchase_id"`
+	ProfitLoss string    `json:"profit_loss,omitempty"`
+}
+
+// fillDigest collects the fills until the next digest is sent.
+type fillDigest struct {
+	mu         sync.Mutex
+	since      time.Time
+	fills      []digestFill
+	profitLoss decimal.Decimal
+}
+
+var digest = &fillDigest{since: time.Now()}
+
+// digestEnabled returns true if fills are batched into digests.
+func digestEnabled() bool {
+	return *webhookDigestURLs != "" && webhooksEnabled()
+}
+
+// add records a fill of the purchase for the next digest.
+func (d *fillDigest) add(c *client, eventType string, p *purchase.Purchase, o *alpaca.Order) {
+	f := digestFill{
+		Time:       time.Now(),
+		Symbol:     c.stockSymbol,
+		Strategy:   c.strategy,
+		Shadow:     c.shadow,
+		Side:       "buy",
+		Qty:        o.FilledQty.String(),
+		PurchaseID: p.ID,
+	}
+	if o.FilledAt != nil {
+		f.Time = *o.FilledAt
+	}
+	if o.FilledAvgPrice != nil {
+		f.Price = o.FilledAvgPrice.StringFixed(2)
+	}
+	var pl decimal.Decimal
+	if eventType == webhookSellFilled {
+		f.Side = "sell"
+		if p.BuyFilled() {
+			pl = p.RealizedProfitLoss()
+			f.ProfitLoss = pl.StringFixed(2)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fills = append(d.fills, f)
+	if !c.shadow {
+		d.profitLoss = d.profitLoss.Add(pl)
+	}
+}
+
+// take returns the fills since the previous digest and starts a new one.
+func (d *fillDigest) take(now time.Time) (time.Time, []digestFill, decimal.Decimal) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	since, fills, pl := d.since, d.fills, d.profitLoss
+	d.since, d.fills, d.profitLoss = now, nil, decimal.Zero
+	return since, fills, pl
+}
+
+// startWebhookDigest sends a digest to webhook_digest_urls every
+// webhook_digest_interval.
+func startWebhookDigest() {
+	if !digestEnabled() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(*webhookDigestInterval)
+		defer ticker.Stop()
+		for t := range ticker.C {
+			clients, _ := currentSession.snapshot()
+			sendDigest(clients, t)
+		}
+	}()
+}
+
+// sendDigest sends the fills since the previous digest along with the
+// purchases which are open now. It waits for delivery.
+func sendDigest(clients []*client, now time.Time) {
+	if !digestEnabled() {
+		return
+	}
+	since, fills, pl := digest.take(now)
+	if len(fills) == 0 {
+		return
+	}
+	var open int
+	exposure := decimal.Zero
+	for _, c := range clients {
+		if c.shadow {
+			continue
+		}
+		c.do(func() {
+			for _, p := range heldPurchases(c.purchases) {
+				pos := newPositionPL(p, *p.BuyOrder.FilledAvgPrice)
+				open++
+				exposure = exposure.Add(pos.cost.Mul(pos.qty))
+			}
+		})
+	}
+	sendWebhooksTo(*webhookDigestURLs, &webhookEvent{
+		Type: webhookDigest,
+		Time: now,
+		Digest: &webhookDigestBody{
+			Since:         since,
+			Fills:         fills,
+			ProfitLoss:    pl.StringFixed(2),
+			OpenPurchases: open,
+			OpenExposure:  exposure.StringFixed(2),
+		},
+		Message: fmt.Sprintf("%v fills since %v, realized P/L $%v, %v open purchases with $%v exposure",
+			len(fills), since.In(EST).Format("15:04"), pl.StringFixed(2), open, exposure.StringFixed(2)),
+	})
+}
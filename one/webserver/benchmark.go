@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+)
+
+var (
+	benchmarkSymbol = flag.String("benchmark_symbol", "SPY", "The symbol the account's daily returns are compared with on the dashboard. It may differ from the traded symbols.")
+)
+
+// benchmarkDays is how many days of returns are compared with the benchmark.
+const benchmarkDays = 14
+
+// benchmarkView writes the account's daily returns next to the benchmark's,
+// the cumulative excess return, and how much of the benchmark's up and down
+// days the account captured.
+func (ws *Webserver) benchmarkView(w io.Writer, r *http.Request) error {
+	symbol := *benchmarkSymbol
+	if s := r.URL.Query().Get("benchmark"); s != "" {
+		symbol = s
+	}
+	timePeriod := fmt.Sprintf("%vD", benchmarkDays)
+	timeFrame := alpaca.Day1
+	history, err := ws.alpacaClient.GetPortfolioHistory(
+		&timePeriod, &timeFrame, nil, false)
+	if err != nil {
+		return fmt.Errorf("unable to get daily account history: %v", err)
+	}
+	if len(history.Timestamp) < 2 {
+		fmt.Fprintf(w, "not enough account history\n")
+		return nil
+	}
+	// A few more days of bars are requested for the close before the first
+	// day, since weekends and holidays have no bars.
+	start := time.Unix(history.Timestamp[0], 0).AddDate(0, 0, -7)
+	limit := benchmarkDays + 7
+	bars, err := ws.alpacaClient.GetSymbolBars(symbol, alpaca.ListBarParams{
+		Timeframe: string(alpaca.Day1),
+		StartDt:   &start,
+		Limit:     &limit,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get bars of %v: %v", symbol, err)
+	}
+	closes := map[string]float64{}
+	for _, b := range bars {
+		closes[dayOf(b.Time)] = float64(b.Close)
+	}
+
+	fmt.Fprintf(w, "Benchmark: %v\n", symbol)
+	var days []dayReturn
+	var cumulative, cumulativeBenchmark float64 = 1, 1
+	for i := 1; i < len(history.Timestamp); i++ {
+		prevEquity, _ := history.Equity[i-1].Float64()
+		equity, _ := history.Equity[i].Float64()
+		prevClose, okPrev := closes[dayOf(history.Timestamp[i-1])]
+		lastClose, ok := closes[dayOf(history.Timestamp[i])]
+		if prevEquity == 0 || !okPrev || !ok || prevClose == 0 {
+			continue
+		}
+		d := dayReturn{
+			account:   100 * (equity/prevEquity - 1),
+			benchmark: 100 * (lastClose/prevClose - 1),
+		}
+		days = append(days, d)
+		cumulative *= 1 + d.account/100
+		cumulativeBenchmark *= 1 + d.benchmark/100
+		fmt.Fprintf(w, "%v: Account [%%%.3f], %v [%%%.3f], Excess [%%%.3f]\n",
+			dayOf(history.Timestamp[i]), d.account, symbol, d.benchmark, d.account-d.benchmark)
+	}
+	if len(days) == 0 {
+		fmt.Fprintf(w, "no days with both account history and %v bars\n", symbol)
+		return nil
+	}
+	fmt.Fprintf(w, "Cumulative: Account [%%%.3f], %v [%%%.3f], Excess [%%%.3f]\n",
+		100*(cumulative-1), symbol, 100*(cumulativeBenchmark-1), 100*(cumulative-cumulativeBenchmark))
+	up, upDays := captureRatio(days, func(b float64) bool { return b > 0 })
+	down, downDays := captureRatio(days, func(b float64) bool { return b < 0 })
+	fmt.Fprintf(w, "Up capture: %v (%v days), Down capture: %v (%v days)\n", up, upDays, down, downDays)
+	return nil
+}
+
+// dayReturn is the return of the account and the benchmark over a day, in
+// percent.
+type dayReturn struct {
+	account, benchmark float64
+}
+
+// captureRatio returns the account's average return on the days whose
+// benchmark return matches, as a percentage of the benchmark's average
+// return on those days, and the number of such days.
+func captureRatio(days []dayReturn, match func(benchmark float64) bool) (string, int) {
+	var account, benchmark float64
+	n := 0
+	for _, d := range days {
+		if match(d.benchmark) {
+			account += d.account
+			benchmark += d.benchmark
+			n++
+		}
+	}
+	if n == 0 {
+		return "n/a", 0
+	}
+	return fmt.Sprintf("%.1f%%", 100*account/benchmark), n
+}
+
+// dayOf returns the day of the Unix time in the bookkeeping timezone, e.g.
+// "2020-12-01".
+func dayOf(t int64) string {
+	return time.Unix(t, 0).In(BookkeepingTZ).Format("2006-01-02")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// cardsRefresh is the number of seconds after which the cards page reloads
+// itself, keeping the P/L current while it is left open on a phone.
+const cardsRefresh = 15
+
+// cardsPage is the data of the cards page.
+type cardsPage struct {
+	Page      page
+	Version   string
+	Error     string
+	Cards     []positionCard
+	TotalPL   string
+	TotalLoss bool
+}
+
+// positionCard is an open position shown as a card.
+type positionCard struct {
+	Symbol      string
+	Qty         string
+	Entry       string
+	Price       string
+	MarketValue string
+	PL          string
+	PLPercent   string
+	Loss        bool
+}
+
+// cards serves a compact page of the open positions with their unrealized
+// P/L, laid out as cards which fit a phone screen.
+func (ws *Webserver) cards(rw http.ResponseWriter, r *http.Request) {
+	data := cardsPage{Version: version}
+	data.Page = newPage(r, "Open Positions")
+	data.Page.Refresh = cardsRefresh
+
+	total := decimal.Zero
+	positions, err := ws.alpacaClient.ListPositions()
+	if err != nil {
+		data.Error = "unable to get account positions: " + err.Error()
+	}
+	sort.Slice(positions, func(i, j int) bool { return positions[i].Symbol < positions[j].Symbol })
+	for _, p := range positions {
+		total = total.Add(p.UnrealizedPL)
+		data.Cards = append(data.Cards, positionCard{
+			Symbol:      p.Symbol,
+			Qty:         p.Qty.String(),
+			Entry:       p.EntryPrice.StringFixed(2),
+			Price:       p.CurrentPrice.StringFixed(2),
+			MarketValue: p.MarketValue.StringFixed(2),
+			PL:          p.UnrealizedPL.StringFixed(2),
+			PLPercent:   p.UnrealizedPLPC.Mul(decimal.NewFromInt(100)).StringFixed(2),
+			Loss:        p.UnrealizedPL.IsNegative(),
+		})
+	}
+	data.TotalPL = total.StringFixed(2)
+	data.TotalLoss = total.IsNegative()
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.ExecuteTemplate(rw, "cards", data); err != nil {
+		log.Printf("unable to write cards page: %v", err)
+	}
+}
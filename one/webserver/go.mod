@@ -1,6 +1,10 @@
 module webserver.go
 
-go 1.15
+go 1.16
+
+replace github.com/ejbrever/trader/one/database => ../database
+
+replace github.com/ejbrever/trader/one/purchase => ../purchase
 
 require (
 	github.com/alpacahq/alpaca-trade-api-go v1.7.0
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+// instances serves the aggregate view of every trader instance sharing the
+// database.
+func (ws *Webserver) instances(rw http.ResponseWriter, r *http.Request) {
+	startPage(rw, r, "All Instances")
+	defer endPage(rw)
+	writeSection(escapeWriter{rw}, r, section{title: "All Instances", view: ws.instancesView})
+}
+
+// instancesView writes the heartbeats and today's traded purchases of each
+// instance, followed by the totals of every instance.
+func (ws *Webserver) instancesView(w io.Writer, r *http.Request) error {
+	heartbeats, err := ws.allDB.Heartbeats()
+	if err != nil {
+		return fmt.Errorf("unable to get heartbeats: %v", err)
+	}
+	allPurchases, err := ws.allDB.Purchases(time.Now().In(BookkeepingTZ).YearDay(), BookkeepingTZ)
+	if err != nil {
+		return fmt.Errorf("unable to get today's purchases from database: %v", err)
+	}
+
+	byInstance := map[string][]*purchase.Purchase{}
+	var names []string
+	add := func(name string) {
+		if _, ok := byInstance[name]; !ok {
+			byInstance[name] = nil
+			names = append(names, name)
+		}
+	}
+	for _, h := range heartbeats {
+		add(h.Instance)
+	}
+	for _, p := range withoutShadow(allPurchases) {
+		add(p.Instance)
+		byInstance[p.Instance] = append(byInstance[p.Instance], p)
+	}
+	sort.Strings(names)
+
+	var total instanceStats
+	for _, name := range names {
+		s := ws.newInstanceStats(byInstance[name])
+		total.purchases += s.purchases
+		total.open += s.open
+		total.trades += s.trades
+		total.wins += s.wins
+		total.profitLoss = total.profitLoss.Add(s.profitLoss)
+		fmt.Fprintf(w, "\n%v: %v\n", name, s)
+		for _, h := range heartbeats {
+			if h.Instance == name {
+				fmt.Fprintf(w, "  %v: %v\n", h.Name, heartbeatStatus(h))
+			}
+		}
+	}
+	fmt.Fprintf(w, "\nAll %v instances: %v\n", len(names), total)
+	return nil
+}
+
+// instanceStats summarizes today's traded purchases of an instance.
+type instanceStats struct {
+	purchases, open, trades, wins int
+	profitLoss                    decimal.Decimal
+}
+
+// newInstanceStats summarizes the purchases.
+func (ws *Webserver) newInstanceStats(purchases []*purchase.Purchase) instanceStats {
+	s := instanceStats{
+		purchases: len(purchases),
+		open:      len(ws.inProgressPurchases(purchases)),
+	}
+	for _, p := range ws.todaysCompletedPurchases(purchases) {
+		if !p.BuyFilled() {
+			continue
+		}
+		pl := p.RealizedProfitLoss()
+		s.trades++
+		if !pl.IsNegative() {
+			s.wins++
+		}
+		s.profitLoss = s.profitLoss.Add(pl)
+	}
+	return s
+}
+
+// String returns the summary, e.g.
+// "6 purchases, 1 open, 5 trades, 3 wins, P/L $12.40".
+func (s instanceStats) String() string {
+	return fmt.Sprintf("%v purchases, %v open, %v trades, %v wins, P/L $%v",
+		s.purchases, s.open, s.trades, s.wins, s.profitLoss.StringFixed(2))
+}
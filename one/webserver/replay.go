@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+// replayPadding is how much of the market before the buy order and after the
+// sell fill is replayed.
+const replayPadding = 30 * time.Minute
+
+// The size of the replay chart in SVG units. The chart scales to the page.
+const (
+	replayWidth  = 900
+	replayHeight = 360
+	// replayAxisWidth is the width right of the bars for the price axis.
+	replayAxisWidth = 60
+	// replayStripHeight is the height under the bars for the strip of signal
+	// evaluations.
+	replayStripHeight = 16
+	// replayMarkerSize is the size of the entry and exit markers.
+	replayMarkerSize = 7
+)
+
+// replayPage is the data of the trade replay page.
+type replayPage struct {
+	Page    page
+	Version string
+	Error   string
+	ID      int64
+	Width   int
+	Height  int
+	// PlotWidth and PlotHeight are the size of the area the bars are drawn in.
+	PlotWidth   int
+	PlotHeight  int
+	Prices      []replayPrice
+	Candles     []replayCandle
+	Levels      []replayLevel
+	Evaluations []replayEvaluation
+	Markers     []replayMarker
+	Summary     []string
+}
+
+// replayPrice is a label of the price axis.
+type replayPrice struct {
+	Y     float64
+	Label string
+}
+
+// replayCandle is a bar drawn as a candlestick.
+type replayCandle struct {
+	X, High, Low             float64
+	Left, Top, Width, Height float64
+	Up                       bool
+	Title                    string
+}
+
+// replayLevel is the price of a bracket leg while its order was open. Class
+// is "take-profit" or "stop", and "replaced" for the levels of replaced
+// orders.
+type replayLevel struct {
+	X1, X2, Y float64
+	Class     string
+	Title     string
+}
+
+// replayEvaluation is a buy signal evaluation. Class is "signal" for the
+// evaluation which made the purchase and "blocked" for a blocked signal.
+type replayEvaluation struct {
+	X     float64
+	Class string
+	Title string
+}
+
+// replayMarker is the entry or exit fill, drawn as a triangle.
+type replayMarker struct {
+	Points string
+	Class  string
+	Title  string
+}
+
+// replayScale maps times and prices to the chart.
+type replayScale struct {
+	start, end time.Time
+	low, high  float64
+	width      float64
+	height     float64
+}
+
+func (s replayScale) x(t time.Time) float64 {
+	return round1(float64(t.Sub(s.start)) / float64(s.end.Sub(s.start)) * s.width)
+}
+
+func (s replayScale) y(price float64) float64 {
+	return round1((s.high - price) / (s.high - s.low) * s.height)
+}
+
+// round1 rounds to one decimal place, which is precise enough for the chart.
+func round1(f float64) float64 {
+	return math.Round(f*10) / 10
+}
+
+// replay serves the replay of the purchase with the ID in the request: the
+// bars around the trade as the trader stored them, with the signal
+// evaluations, the entry fill, the bracket levels and the exit.
+func (ws *Webserver) replay(rw http.ResponseWriter, r *http.Request) {
+	data := replayPage{Version: version}
+	data.Page = newPage(r, "Trade Replay")
+	if err := ws.buildReplay(&data, r); err != nil {
+		data.Error = err.Error()
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.ExecuteTemplate(rw, "replay", data); err != nil {
+		log.Printf("unable to write replay page: %v", err)
+	}
+}
+
+// buildReplay fills in the replay of the purchase with the ID in the request.
+func (ws *Webserver) buildReplay(data *replayPage, r *http.Request) error {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid purchase ID %q", r.URL.Query().Get("id"))
+	}
+	data.ID = id
+	p, err := ws.db.Purchase(id)
+	if err != nil {
+		return fmt.Errorf("unable to get purchase %d: %v", id, err)
+	}
+	if !p.BuyFilled() || p.BuyOrder.FilledAt == nil || p.BuyOrder.FilledAvgPrice == nil {
+		return fmt.Errorf("purchase %d was never bought, so there is no trade to replay", id)
+	}
+	symbol := p.BuyOrder.Symbol
+	data.Page.Title = fmt.Sprintf("Trade Replay: %v purchase %d", symbol, id)
+
+	start := p.BuyOrder.SubmittedAt.Add(-replayPadding)
+	end := time.Now()
+	if p.SellFilled() && p.SellOrder.FilledAt != nil {
+		end = p.SellOrder.FilledAt.Add(replayPadding)
+	}
+	stored, err := ws.db.Bars(symbol, start, end)
+	if err != nil {
+		return fmt.Errorf("unable to get bars: %v", err)
+	}
+	bars, timeframe := latestBars(stored)
+	blocked, err := ws.db.BlockedSignals(start, end)
+	if err != nil {
+		return fmt.Errorf("unable to get blocked signals: %v", err)
+	}
+
+	scale := replayScale{
+		start:  start,
+		end:    end,
+		width:  replayWidth - replayAxisWidth,
+		height: replayHeight - replayStripHeight,
+	}
+	scale.low, scale.high = replayPriceRange(p, bars)
+	data.Width, data.Height = replayWidth, replayHeight
+	data.PlotWidth, data.PlotHeight = int(scale.width), int(scale.height)
+	for i := 0; i <= 4; i++ {
+		price := scale.low + (scale.high-scale.low)*float64(i)/4
+		data.Prices = append(data.Prices, replayPrice{Y: scale.y(price), Label: fmt.Sprintf("$%.2f", price)})
+	}
+
+	width := round1(0.7 * float64(barSpacing(bars)) / float64(end.Sub(start)) * scale.width)
+	if width < 1 {
+		width = 1
+	}
+	for _, b := range bars {
+		x := scale.x(b.GetTime())
+		top, bottom := math.Max(float64(b.Open), float64(b.Close)), math.Min(float64(b.Open), float64(b.Close))
+		c := replayCandle{
+			X:      x,
+			High:   scale.y(float64(b.High)),
+			Low:    scale.y(float64(b.Low)),
+			Left:   round1(x - width/2),
+			Top:    scale.y(top),
+			Width:  width,
+			Height: math.Max(scale.y(bottom)-scale.y(top), 0.5),
+			Up:     b.Close >= b.Open,
+			Title: fmt.Sprintf("%v O %.2f H %.2f L %.2f C %.2f V %v",
+				b.GetTime().In(BookkeepingTZ).Format("15:04"), b.Open, b.High, b.Low, b.Close, b.Volume),
+		}
+		data.Candles = append(data.Candles, c)
+	}
+
+	data.Levels = replayLevels(p, scale)
+
+	evaluations := evaluationTimes(stored, start, end)
+	// The purchase was made by the last evaluation before its buy order.
+	signal := -1
+	for i, t := range evaluations {
+		if !t.After(p.BuyOrder.SubmittedAt) {
+			signal = i
+		}
+	}
+	for i, t := range evaluations {
+		e := replayEvaluation{X: scale.x(t), Title: fmt.Sprintf("signal evaluated %v", t.In(BookkeepingTZ).Format("15:04:05"))}
+		if i == signal {
+			e.Class = "signal"
+			e.Title += ", which made the purchase"
+		}
+		data.Evaluations = append(data.Evaluations, e)
+	}
+	var blockedCount int
+	for _, s := range blocked {
+		if s.Symbol != symbol || s.Strategy != p.Strategy {
+			continue
+		}
+		blockedCount++
+		data.Evaluations = append(data.Evaluations, replayEvaluation{
+			X:     scale.x(s.Time),
+			Class: "blocked",
+			Title: fmt.Sprintf("signal blocked %v by %v: %v", s.Time.In(BookkeepingTZ).Format("15:04:05"), s.Rule, s.Detail),
+		})
+	}
+
+	buyX, buyY := scale.x(*p.BuyOrder.FilledAt), scale.y(p.BuyFilledAvgPriceFloat())
+	data.Markers = append(data.Markers, replayMarker{
+		Points: trianglePoints(buyX, buyY, replayMarkerSize),
+		Class:  "entry",
+		Title:  fmt.Sprintf("bought %v @ $%v", p.BuyOrder.FilledQty, p.BuyOrder.FilledAvgPrice.StringFixed(2)),
+	})
+	data.Summary = append(data.Summary,
+		fmt.Sprintf("strategy %q, %v of %v bars, %v signal evaluations, %v blocked signals", p.Strategy, len(bars), timeframe, len(evaluations), blockedCount))
+	if len(bars) == 0 {
+		data.Summary = append(data.Summary, fmt.Sprintf("no bars of %v were stored around the trade, they are stored when the trader runs with persist_bars", symbol))
+	}
+	if signal >= 0 {
+		data.Summary = append(data.Summary, fmt.Sprintf("signal: evaluated %v", evaluations[signal].In(BookkeepingTZ)))
+	}
+	data.Summary = append(data.Summary, fmt.Sprintf("entry: bought %v @ $%v at %v",
+		p.BuyOrder.FilledQty, p.BuyOrder.FilledAvgPrice.StringFixed(2), p.BuyOrder.FilledAt.In(BookkeepingTZ)))
+	if p.SellFilled() && p.SellOrder.FilledAt != nil && p.SellOrder.FilledAvgPrice != nil {
+		sellX, sellY := scale.x(*p.SellOrder.FilledAt), scale.y(p.SoldFilledAvgPriceFloat())
+		data.Markers = append(data.Markers, replayMarker{
+			Points: trianglePoints(sellX, sellY, -replayMarkerSize),
+			Class:  "exit",
+			Title:  fmt.Sprintf("sold %v @ $%v", p.SellOrder.FilledQty, p.SellOrder.FilledAvgPrice.StringFixed(2)),
+		})
+		data.Summary = append(data.Summary, fmt.Sprintf("exit: sold @ $%v at %v, %v, P/L $%v",
+			p.SellOrder.FilledAvgPrice.StringFixed(2), p.SellOrder.FilledAt.In(BookkeepingTZ), exitDetails(p), p.RealizedProfitLoss().StringFixed(2)))
+	} else {
+		data.Summary = append(data.Summary, "exit: not sold yet")
+	}
+	for _, l := range data.Levels {
+		data.Summary = append(data.Summary, l.Title)
+	}
+	return nil
+}
+
+// latestBars returns the bars of the most stored timeframe, one per bar time.
+// A bar is stored for each evaluation it was used in, and the latest version
+// of each bar is returned.
+func latestBars(stored []*database.Bar) ([]*database.Bar, string) {
+	counts := map[string]int{}
+	var timeframe string
+	for _, b := range stored {
+		counts[b.Timeframe]++
+		if counts[b.Timeframe] > counts[timeframe] {
+			timeframe = b.Timeframe
+		}
+	}
+	var bars []*database.Bar
+	for _, b := range stored {
+		if b.Timeframe != timeframe {
+			continue
+		}
+		// The bars are ordered by bar time and then by evaluation.
+		if n := len(bars); n > 0 && bars[n-1].Time == b.Time {
+			bars[n-1] = b
+			continue
+		}
+		bars = append(bars, b)
+	}
+	return bars, timeframe
+}
+
+// evaluationTimes returns the distinct times in [start, end] the bars were
+// evaluated at, in order.
+func evaluationTimes(stored []*database.Bar, start, end time.Time) []time.Time {
+	seen := map[time.Time]bool{}
+	var times []time.Time
+	for _, b := range stored {
+		t := b.EvaluatedAt.UTC()
+		if seen[t] || t.Before(start) || t.After(end) {
+			continue
+		}
+		seen[t] = true
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times
+}
+
+// barSpacing returns the shortest time between consecutive bars, which is the
+// width of a bar. A minute is returned when there are too few bars.
+func barSpacing(bars []*database.Bar) time.Duration {
+	spacing := time.Duration(0)
+	for i := 1; i < len(bars); i++ {
+		if d := time.Duration(bars[i].Time-bars[i-1].Time) * time.Second; d > 0 && (spacing == 0 || d < spacing) {
+			spacing = d
+		}
+	}
+	if spacing == 0 {
+		return time.Minute
+	}
+	return spacing
+}
+
+// replayPriceRange returns the prices at the bottom and top of the chart,
+// which include the bars, the fills and the bracket levels.
+func replayPriceRange(p *purchase.Purchase, bars []*database.Bar) (float64, float64) {
+	low, high := p.BuyFilledAvgPriceFloat(), p.BuyFilledAvgPriceFloat()
+	include := func(price float64) {
+		low, high = math.Min(low, price), math.Max(high, price)
+	}
+	for _, b := range bars {
+		include(float64(b.Low))
+		include(float64(b.High))
+	}
+	if p.SellFilled() && p.SellOrder.FilledAvgPrice != nil {
+		include(p.SoldFilledAvgPriceFloat())
+	}
+	for _, l := range bracketLevels(p) {
+		include(l.price)
+	}
+	pad := (high - low) * 0.05
+	if pad == 0 {
+		pad = high * 0.01
+	}
+	return low - pad, high + pad
+}
+
+// bracketLevel is the take profit or stop price of a sell order while it was
+// open. The end is zero while the order is open.
+type bracketLevel struct {
+	class      string
+	price      float64
+	start, end time.Time
+	replaced   bool
+}
+
+// bracketLevels returns the take profit and stop levels of the replaced sell
+// orders and the current sell order, oldest first.
+func bracketLevels(p *purchase.Purchase) []bracketLevel {
+	var levels []bracketLevel
+	add := func(limit, stop *decimal.Decimal, start, end time.Time, replaced bool) {
+		// The limit of a stop limit order is not a take profit.
+		if limit != nil && stop == nil {
+			f, _ := limit.Float64()
+			levels = append(levels, bracketLevel{class: "take-profit", price: f, start: start, end: end, replaced: replaced})
+		}
+		if stop != nil {
+			f, _ := stop.Float64()
+			levels = append(levels, bracketLevel{class: "stop", price: f, start: start, end: end, replaced: replaced})
+		}
+	}
+	start := *p.BuyOrder.FilledAt
+	for _, rp := range p.Replacements {
+		if rp.Side != alpaca.Sell || rp.ReplacedAt == nil {
+			continue
+		}
+		add(rp.LimitPrice, rp.StopPrice, start, *rp.ReplacedAt, true)
+		start = *rp.ReplacedAt
+	}
+	o := p.SellOrder
+	if o == nil {
+		return levels
+	}
+	var end time.Time
+	if o.FilledAt != nil {
+		end = *o.FilledAt
+	}
+	if o.Type != alpaca.Market {
+		add(o.LimitPrice, o.StopPrice, start, end, false)
+	}
+	if o.Legs != nil {
+		for _, leg := range *o.Legs {
+			add(nil, leg.StopPrice, start, end, false)
+		}
+	}
+	return levels
+}
+
+// replayLevels returns the bracket levels drawn on the chart.
+func replayLevels(p *purchase.Purchase, scale replayScale) []replayLevel {
+	var levels []replayLevel
+	for _, l := range bracketLevels(p) {
+		end := l.end
+		if end.IsZero() || end.After(scale.end) {
+			end = scale.end
+		}
+		name := "take profit"
+		if l.class == "stop" {
+			name = "stop"
+		}
+		class := l.class
+		title := fmt.Sprintf("%v $%.2f from %v", name, l.price, l.start.In(BookkeepingTZ).Format("15:04:05"))
+		if l.replaced {
+			class += " replaced"
+			title = fmt.Sprintf("replaced %v until %v", title, l.end.In(BookkeepingTZ).Format("15:04:05"))
+		}
+		levels = append(levels, replayLevel{
+			X1:    scale.x(l.start),
+			X2:    scale.x(end),
+			Y:     scale.y(l.price),
+			Class: class,
+			Title: title,
+		})
+	}
+	return levels
+}
+
+// trianglePoints returns the points of a triangle with its tip at (x, y),
+// pointing up when size is positive and down when it is negative.
+func trianglePoints(x, y, size float64) string {
+	return fmt.Sprintf("%v,%v %v,%v %v,%v", x, y, round1(x-size), round1(y+size*1.5), round1(x+size), round1(y+size*1.5))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// pageTemplate is the layout wrapped around every dashboard page.
+var pageTemplate = template.Must(template.New("page").Funcs(template.FuncMap{
+	"asset": assetURL,
+}).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html lang="en"{{with .Theme}} data-theme="{{.}}"{{end}}>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+{{with .Refresh}}<meta http-equiv="refresh" content="{{.}}">
+{{end}}<title>{{.Title}}</title>
+<link rel="icon" type="image/svg+xml" href="{{asset "favicon.svg"}}">
+<link rel="stylesheet" href="{{asset "style.css"}}">
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<nav>
+<a href="/">Dashboard</a>
+<a href="/cards">Positions</a>
+{{if eq .Theme "dark"}}<a href="/theme?set=light&amp;next={{.Path}}">Light theme</a>{{else}}<a href="/theme?set=dark&amp;next={{.Path}}">Dark theme</a>{{end}}
+</nav>
+</header>
+{{end}}
+
+{{define "foot"}}<footer>version {{.}}</footer>
+</body>
+</html>
+{{end}}
+
+{{define "start"}}{{template "head" .}}<pre>{{end}}
+
+{{define "end"}}</pre>
+{{template "foot" .}}{{end}}
+
+{{define "cards"}}{{template "head" .Page}}
+{{with .Error}}<p class="error">{{.}}</p>
+{{end}}<p class="total">{{len .Cards}} open positions, unrealized P/L <span class="{{if .TotalLoss}}loss{{else}}gain{{end}}">${{.TotalPL}}</span></p>
+<div class="cards">
+{{range .Cards}}<div class="card">
+<div class="symbol">{{.Symbol}}</div>
+<div class="pl {{if .Loss}}loss{{else}}gain{{end}}">${{.PL}} ({{.PLPercent}}%)</div>
+<div>{{.Qty}} @ ${{.Entry}}</div>
+<div>now ${{.Price}}, value ${{.MarketValue}}</div>
+</div>
+{{end}}</div>
+{{template "foot" .Version}}{{end}}
+
+{{define "replay"}}{{template "head" .Page}}
+{{with .Error}}<p class="error">{{.}}</p>
+{{end}}{{if .Width}}<svg class="replay" viewBox="0 0 {{.Width}} {{.Height}}" role="img">
+{{range .Prices}}<line class="grid" x1="0" x2="{{$.PlotWidth}}" y1="{{.Y}}" y2="{{.Y}}"/><text class="axis" x="{{$.PlotWidth}}" y="{{.Y}}" dx="4" dy="4">{{.Label}}</text>
+{{end}}{{range .Candles}}<g class="{{if .Up}}gain{{else}}loss{{end}}"><title>{{.Title}}</title><line x1="{{.X}}" x2="{{.X}}" y1="{{.High}}" y2="{{.Low}}"/><rect x="{{.Left}}" y="{{.Top}}" width="{{.Width}}" height="{{.Height}}"/></g>
+{{end}}{{range .Levels}}<line class="level {{.Class}}" x1="{{.X1}}" x2="{{.X2}}" y1="{{.Y}}" y2="{{.Y}}"><title>{{.Title}}</title></line>
+{{end}}{{range .Evaluations}}<line class="evaluation {{.Class}}" x1="{{.X}}" x2="{{.X}}" y1="{{$.PlotHeight}}" y2="{{$.Height}}"><title>{{.Title}}</title></line>
+{{end}}{{range .Markers}}<polygon class="marker {{.Class}}" points="{{.Points}}"><title>{{.Title}}</title></polygon>
+{{end}}</svg>
+{{end}}<pre>{{range .Summary}}{{.}}
+{{end}}
+trade detail: <a href="/trade?id={{.ID}}">/trade?id={{.ID}}</a></pre>
+{{template "foot" .Version}}{{end}}
+`))
+
+// themeCookie is the cookie which holds the chosen theme. Without it the
+// theme of the device is used.
+const themeCookie = "theme"
+
+// page is the data of the layout of a page.
+type page struct {
+	Title string
+	// Theme is "dark" or "light" when chosen, otherwise empty.
+	Theme string
+	// Path is the path of the page, to return to after changing the theme.
+	Path string
+	// Refresh is the number of seconds after which the page reloads itself.
+	// Zero never reloads.
+	Refresh int
+}
+
+// newPage returns the layout data of the page requested by r.
+func newPage(r *http.Request, title string) page {
+	p := page{Title: title, Path: r.URL.RequestURI()}
+	if c, err := r.Cookie(themeCookie); err == nil && (c.Value == "dark" || c.Value == "light") {
+		p.Theme = c.Value
+	}
+	return p
+}
+
+// setTheme stores the theme in the request in a cookie and returns to the
+// page the theme was changed on.
+func setTheme(w http.ResponseWriter, r *http.Request) {
+	theme := r.URL.Query().Get("set")
+	if theme != "dark" && theme != "light" {
+		http.Error(w, fmt.Sprintf("unknown theme %q", theme), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:    themeCookie,
+		Value:   theme,
+		Path:    "/",
+		Expires: time.Now().AddDate(1, 0, 0),
+	})
+	next := r.URL.Query().Get("next")
+	// Only return to pages of the dashboard.
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// assetURL returns the URL of a static asset. The URL includes the build
+// version so browsers fetch new assets after each deploy.
+func assetURL(name string) string {
+	return "/static/" + name + "?v=" + version
+}
+
+// staticHandler returns a handler serving the embedded static assets.
+func staticHandler() http.Handler {
+	sub, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		log.Fatalf("unable to load static files: %v", err)
+	}
+	fileServer := http.StripPrefix("/static/", http.FileServer(http.FS(sub)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Versioned URLs never change, so they can be cached indefinitely.
+		if r.URL.Query().Get("v") == version {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// favicon serves the favicon for browsers which request it directly.
+func favicon(w http.ResponseWriter, r *http.Request) {
+	b, err := staticFiles.ReadFile("static/favicon.svg")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(b)
+}
+
+// startPage writes the start of an HTML page. All text written between
+// startPage and endPage is displayed preformatted.
+func startPage(w http.ResponseWriter, r *http.Request, title string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.ExecuteTemplate(w, "start", newPage(r, title)); err != nil {
+		log.Printf("unable to write page start: %v", err)
+	}
+}
+
+// endPage writes the end of an HTML page.
+func endPage(w io.Writer) {
+	if err := pageTemplate.ExecuteTemplate(w, "end", version); err != nil {
+		log.Printf("unable to write page end: %v", err)
+	}
+}
+
+// escapeWriter HTML escapes all text written to it.
+type escapeWriter struct {
+	w io.Writer
+}
+
+func (e escapeWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(e.w, html.EscapeString(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
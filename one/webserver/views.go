@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+// view writes one section of a page. A view gets its own data, so an error
+// only affects its own section.
+type view func(w io.Writer, r *http.Request) error
+
+// section is a titled view.
+type section struct {
+	title string
+	path  string
+	view  view
+}
+
+// sections returns the sections of the main page, in order. Sections with a
+// path are also served on their own page.
+func (ws *Webserver) sections() []section {
+	s := []section{
+		{title: "", view: ws.summaryView},
+		{title: "Current Held Positions", path: "/positions", view: ws.positionsView},
+		{title: "Open Sell Orders", path: "/orders", view: ws.ordersView},
+		{title: "History - 14 Days", path: "/history", view: ws.historyView},
+		{title: "Benchmark - 14 Days", path: "/benchmark", view: ws.benchmarkView},
+		{title: "Today's Completed Wins/Losses", view: ws.completedView},
+		{title: "Recent Activity", path: "/activity", view: ws.activityView},
+		{title: "Deep dive of purchases", view: ws.purchasesView},
+	}
+	if ws.live != nil {
+		s = append(s, section{title: "Latest Signals", path: "/signals", view: ws.signalsView})
+		s = append(s, section{title: "Narration", path: "/narration", view: ws.narrationView})
+	}
+	return s
+}
+
+// handleSections adds a route for each section which has a path.
+func (ws *Webserver) handleSections(mux *http.ServeMux) {
+	for _, s := range ws.sections() {
+		if s.path == "" {
+			continue
+		}
+		s := s
+		mux.HandleFunc(s.path, func(rw http.ResponseWriter, r *http.Request) {
+			startPage(rw, r, s.title)
+			defer endPage(rw)
+			writeSection(escapeWriter{rw}, r, s)
+		})
+	}
+}
+
+// main serves the main page, which shows every section.
+func (ws *Webserver) main(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(rw, r)
+		return
+	}
+	startPage(rw, r, "Trader Dashboard")
+	defer endPage(rw)
+	w := escapeWriter{rw}
+	for _, s := range ws.sections() {
+		writeSection(w, r, s)
+	}
+}
+
+// writeSection writes the section's title and view. If the view fails, the
+// error is written in its place.
+func writeSection(w io.Writer, r *http.Request, s section) {
+	if s.title != "" {
+		fmt.Fprintf(w, "\n\n%v\n", s.title)
+	}
+	if err := s.view(w, r); err != nil {
+		fmt.Fprintf(w, "unable to show %q: %v\n", s.title, err)
+	}
+}
+
+// todaysPurchases returns today's purchases for the strategy in the request.
+// Shadow purchases are simulated, so are only included when their strategy is
+// requested.
+func (ws *Webserver) todaysPurchases(r *http.Request) ([]*purchase.Purchase, error) {
+	allPurchases, err := ws.allTodaysPurchases()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get today's purchases from database: %v", err)
+	}
+	if strategy := r.URL.Query().Get("strategy"); strategy != "" {
+		return filterByStrategy(allPurchases, strategy), nil
+	}
+	return withoutShadow(allPurchases), nil
+}
+
+// summaryView writes the trader status, the strategies traded today and the
+// account balances.
+func (ws *Webserver) summaryView(w io.Writer, r *http.Request) error {
+	fmt.Fprintf(w, "Instance: %v (every instance: /instances)\n", *instance)
+	fmt.Fprintf(w, "Trader: %v\n", ws.traderStatus())
+
+	allPurchases, err := ws.allTodaysPurchases()
+	if err != nil {
+		fmt.Fprintf(w, "unable to get today's purchases from database: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "Strategies today: %v\n", strategyCounts(allPurchases))
+		writeStrategyComparison(w, allPurchases)
+		if strategy := r.URL.Query().Get("strategy"); strategy != "" {
+			fmt.Fprintf(w, "Showing purchases for strategy %q\n", strategy)
+			allPurchases = filterByStrategy(allPurchases, strategy)
+		} else {
+			allPurchases = withoutShadow(allPurchases)
+		}
+		fmt.Fprintf(w, "Purchases open: %v/20\n", len(ws.inProgressPurchases(allPurchases)))
+	}
+
+	a, err := ws.alpacaClient.GetAccount()
+	if err != nil {
+		return fmt.Errorf("unable to get account info: %v", err)
+	}
+	fmt.Fprintf(w, "Equity: $%v\n", a.Equity.StringFixed(2))
+	fmt.Fprintf(w, "Cash: $%v\n", a.Cash.StringFixed(2))
+	return nil
+}
+
+// positionsView writes the positions currently held.
+func (ws *Webserver) positionsView(w io.Writer, r *http.Request) error {
+	positions, err := ws.alpacaClient.ListPositions()
+	if err != nil {
+		return fmt.Errorf("unable to get account positions: %v", err)
+	}
+	for _, p := range positions {
+		fmt.Fprintf(w, "\nSymbol: %v\n", p.Symbol)
+		fmt.Fprintf(w, "Qty: %v\n", p.Qty)
+		fmt.Fprintf(w, "CurrentPrice: $%v\n", p.CurrentPrice.StringFixed(2))
+		fmt.Fprintf(w, "Average entry price: $%v\n", p.EntryPrice.StringFixed(2))
+		fmt.Fprintf(w, "Market value: $%v\n", p.MarketValue.StringFixed(2))
+	}
+	return nil
+}
+
+// ordersView writes the open sell orders.
+func (ws *Webserver) ordersView(w io.Writer, r *http.Request) error {
+	sellOrders, err := ws.openSellOrders()
+	if err != nil {
+		return fmt.Errorf("unable to get sell orders: %v", err)
+	}
+	for _, o := range sellOrders {
+		var stopPriceStr, limitPriceStr string
+		if o.StopPrice != nil {
+			stopPriceStr = o.StopPrice.String()
+		}
+		if o.LimitPrice != nil {
+			limitPriceStr = o.LimitPrice.String()
+		}
+		fmt.Fprintf(w, "%v [%v] (%v), Stop Price ($%v), Limit Price ($%v)\n", o.Symbol, o.Qty, o.Type, stopPriceStr, limitPriceStr)
+	}
+	return nil
+}
+
+// historyView writes the daily account equity of the last 14 days.
+func (ws *Webserver) historyView(w io.Writer, r *http.Request) error {
+	timePeriod := "14D"
+	timeFrame := alpaca.Day1
+	history, err := ws.alpacaClient.GetPortfolioHistory(
+		&timePeriod, &timeFrame, nil, false)
+	if err != nil {
+		return fmt.Errorf("unable to get daily account history: %v", err)
+	}
+	for i, t := range history.Timestamp {
+		fmt.Fprintf(w, "%v: $%v, Profit: $%v [%%%v]\n",
+			time.Unix(t, 0),
+			history.Equity[i],
+			history.ProfitLoss[i],
+			history.ProfitLossPct[i].Mul(decimal.NewFromInt(100)).Round(3),
+		)
+	}
+	return nil
+}
+
+// completedView writes the purchases which were sold today.
+func (ws *Webserver) completedView(w io.Writer, r *http.Request) error {
+	allPurchases, err := ws.todaysPurchases(r)
+	if err != nil {
+		return err
+	}
+	for _, p := range ws.todaysCompletedPurchases(allPurchases) {
+		fmt.Fprintf(w, "Sold @ %v: %v, Qty: %v [$%v => $%v] %v, %v\n",
+			p.SellOrder.FilledAt.In(BookkeepingTZ),
+			p.SellOrder.Symbol,
+			p.SellOrder.Qty,
+			p.BuyOrder.FilledAvgPrice.StringFixed(2),
+			p.SellOrder.FilledAvgPrice.StringFixed(2),
+			winOrLoss(p),
+			exitDetails(p),
+		)
+	}
+	return nil
+}
+
+// exitDetails describes how a completed purchase ended: the leg of the sell
+// order which filled, the time in the trade and the slippage per share versus
+// the leg's intended price.
+func exitDetails(p *purchase.Purchase) string {
+	leg, intended := p.ExitLeg()
+	details := fmt.Sprintf("exit: %v", leg)
+	if intended != nil {
+		details += fmt.Sprintf(" @ $%v", intended.StringFixed(2))
+	}
+	if d := p.TimeInTrade(); d > 0 {
+		details += fmt.Sprintf(", held %v", d.Round(time.Second))
+	}
+	if slippage, ok := p.ExitSlippage(); ok {
+		details += fmt.Sprintf(", slippage $%v", slippage.StringFixed(2))
+	}
+	return details
+}
+
+// activityView writes the recent account activities.
+func (ws *Webserver) activityView(w io.Writer, r *http.Request) error {
+	activities, err := ws.alpacaClient.GetAccountActivities(nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to get account activities: %v", err)
+	}
+	fmt.Fprintf(w, "%v trades today\n", tradesToday(activities))
+	for _, a := range activities {
+		fmt.Fprintf(w, "%v: [%v] %v, %v @ $%v\n",
+			a.TransactionTime.In(BookkeepingTZ), a.Side, a.Symbol, a.Qty, a.Price)
+	}
+	return nil
+}
+
+// purchasesView writes the orders of each of today's purchases.
+func (ws *Webserver) purchasesView(w io.Writer, r *http.Request) error {
+	allPurchases, err := ws.todaysPurchases(r)
+	if err != nil {
+		return err
+	}
+	for _, p := range allPurchases {
+		fmt.Fprintf(w, "\npurchase %d: /trade?id=%d", p.ID, p.ID)
+		fmt.Fprintf(w, "\nbuy order: %+v", p.BuyOrder)
+		fmt.Fprintf(w, "sell order: %+v\n", p.SellOrder)
+	}
+	return nil
+}
+
+// signalsView writes the latest buy signals of the live state, newest first.
+func (ws *Webserver) signalsView(w io.Writer, r *http.Request) error {
+	state, err := ws.live.State()
+	if err != nil {
+		return err
+	}
+	for i := len(state.Signals) - 1; i >= 0; i-- {
+		s := state.Signals[i]
+		fmt.Fprintf(w, "%v: %v %v @ $%.2f (%v) %v\n",
+			s.Time.In(BookkeepingTZ), s.Decision, s.Symbol, s.Price, s.Strategy, s.Detail)
+	}
+	return nil
+}
+
+// narrationView writes the narration of the live state, oldest first, so it
+// reads as a story of the day.
+func (ws *Webserver) narrationView(w io.Writer, r *http.Request) error {
+	state, err := ws.live.State()
+	if err != nil {
+		return err
+	}
+	if len(state.Narration) == 0 {
+		fmt.Fprintf(w, "nothing has happened yet\n")
+	}
+	for _, l := range state.Narration {
+		fmt.Fprintf(w, "%v\n", l)
+	}
+	return nil
+}
+
+// trade serves the detail page of the purchase with the ID in the request.
+func (ws *Webserver) trade(rw http.ResponseWriter, r *http.Request) {
+	startPage(rw, r, "Trade Detail")
+	defer endPage(rw)
+	writeSection(escapeWriter{rw}, r, section{title: "Trade Detail", view: ws.tradeView})
+}
+
+// tradeView writes the orders of a purchase and the chain of orders which
+// were replaced along the way.
+func (ws *Webserver) tradeView(w io.Writer, r *http.Request) error {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid purchase ID %q", r.URL.Query().Get("id"))
+	}
+	p, err := ws.db.Purchase(id)
+	if err != nil {
+		return fmt.Errorf("unable to get purchase %d: %v", id, err)
+	}
+	fmt.Fprintf(w, "purchase %d, strategy %q, replay: /replay?id=%d\n", p.ID, p.Strategy, p.ID)
+	if p.TakeProfitPercent != nil {
+		fmt.Fprintf(w, "take profit chosen at entry: %%%v\n", p.TakeProfitPercent.StringFixed(2))
+	}
+	if p.BuyFilled() && p.SellFilled() {
+		fmt.Fprintf(w, "%v, P/L $%v, %v\n", winOrLoss(p), p.RealizedProfitLoss().StringFixed(2), exitDetails(p))
+	}
+	for _, f := range p.Fees {
+		fmt.Fprintf(w, "fee: $%v, %v\n", f.Amount.StringFixed(4), f.Description)
+	}
+	if mae, ok := p.MaxAdverseExcursion(); ok {
+		pct, _ := p.MaxAdverseExcursionPercent()
+		fmt.Fprintf(w, "max adverse excursion: $%v per share [%%%v], lowest price $%v\n", mae.StringFixed(2), pct.StringFixed(2), p.LowestPrice.StringFixed(2))
+	}
+	fmt.Fprintf(w, "\nbuy order: %+v\n", p.BuyOrder)
+	fmt.Fprintf(w, "\nsell order: %+v\n", p.SellOrder)
+	if len(p.Replacements) == 0 {
+		fmt.Fprintf(w, "\nno orders were replaced\n")
+		return nil
+	}
+	fmt.Fprintf(w, "\nreplaced orders:\n")
+	for _, rp := range p.Replacements {
+		fmt.Fprintf(w, "%v %v", rp.Side, rp.OrderID)
+		if rp.LimitPrice != nil {
+			fmt.Fprintf(w, " limit $%v", rp.LimitPrice.StringFixed(2))
+		}
+		if rp.StopPrice != nil {
+			fmt.Fprintf(w, " stop $%v", rp.StopPrice.StringFixed(2))
+		}
+		fmt.Fprintf(w, " => %v", rp.ReplacedBy)
+		if rp.ReplacedAt != nil {
+			fmt.Fprintf(w, " @ %v", rp.ReplacedAt.In(BookkeepingTZ))
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
@@ -15,45 +22,109 @@ import (
 )
 
 var (
-	// PST is the timezone for the Pacific time.
-	PST *time.Location
+	port                = flag.String("port", "", "The port to listen on. Defaults to the PORT env variable, or 8080 if unset.")
+	bindAddress         = flag.String("bind_address", "", "The address to bind to. Binds to all addresses when empty.")
+	dbName              = flag.String("db_name", "one", "The name of the MySQL database purchases are stored in. Should match the trader's db_name.")
+	instance            = flag.String("instance", database.DefaultInstance, "The trader instance whose purchases and heartbeat are shown. Should match the trader's instance. Every instance sharing the database is summarized on /instances.")
+	redisAddr           = flag.String("redis_addr", "", "When set, the trader's heartbeat, today's purchases, its latest signals and its narration are read from the live state the trader publishes to the Redis server at this address, instead of from the database. Should match the trader's redis_addr.")
+	redisPassword       = flag.String("redis_password", "", "The password of the Redis server at redis_addr.")
+	redisKeyPrefix      = flag.String("redis_key_prefix", "trader", "The prefix of the Redis keys the live state is read from. Should match the trader's redis_key_prefix.")
+	bookkeepingTimezone = flag.String("bookkeeping_timezone", "America/New_York", "The timezone whose midnight starts a new day, e.g. for which purchases are shown as today's. Should match the trader's bookkeeping_timezone.")
+)
+
+const (
+	// traderHeartbeatName is the name trader one reports heartbeats with.
+	traderHeartbeatName = "trader-one"
+
+	// maxHeartbeatAge is the longest time between heartbeats before the trader
+	// is considered to not be running.
+	maxHeartbeatAge = 5 * time.Minute
+)
+
+var (
+	// BookkeepingTZ is the timezone of the day boundary used for bookkeeping.
+	BookkeepingTZ *time.Location
 )
 
 // Webserver manages the webserver.
 type Webserver struct {
 	alpacaClient *alpaca.Client
 	db           database.Client
+	// allDB reads the rows of every instance.
+	allDB database.Client
+	// live reads the live state of the instance. It is nil unless redis_addr
+	// is set.
+	live *database.RedisState
 }
 
 // New creates a new webserver.
 func New() (*Webserver, error) {
-	db, err := database.New()
+	db, err := database.NewInstance(*dbName, *instance)
 	if err != nil {
 		return nil, fmt.Errorf("unable to open db: %v", err)
 	}
-	return &Webserver{
+	allDB, err := database.NewInstance(*dbName, database.AllInstances)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open db of all instances: %v", err)
+	}
+	ws := &Webserver{
 		alpacaClient: alpaca.NewClient(common.Credentials()),
 		db:           db,
-	}, nil
+		allDB:        allDB,
+	}
+	if *redisAddr != "" {
+		ws.live = database.NewRedisState(*redisAddr, *redisPassword, *redisKeyPrefix, *instance)
+	}
+	return ws, nil
 }
 
 // Start is a blocking call which starts the webserver.
 func (ws *Webserver) Start() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", ws.main)
+	ws.handleSections(mux)
+	mux.HandleFunc("/trade", ws.trade)
+	mux.HandleFunc("/replay", ws.replay)
+	mux.HandleFunc("/cards", ws.cards)
+	mux.HandleFunc("/instances", ws.instances)
+	mux.HandleFunc("/theme", setTheme)
+	mux.HandleFunc("/favicon.ico", favicon)
+	mux.HandleFunc("/api/version", serveVersion)
+	mux.Handle("/static/", staticHandler())
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-		fmt.Printf("defaulting to port %s\n", port)
+	p := *port
+	if p == "" {
+		p = os.Getenv("PORT")
+	}
+	if p == "" {
+		p = "8080"
+		fmt.Printf("defaulting to port %s\n", p)
 	}
 
-	fmt.Printf("listening on port %s\n", port)
-	if err := http.ListenAndServe(":"+port, mux); err != nil {
+	addr := net.JoinHostPort(*bindAddress, p)
+	l, err := listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("listening on %s\n", addr)
+	if err := http.Serve(l, mux); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// listen announces on the address, returning a clear error when the address
+// is already in use (e.g. by trader one on the same host).
+func listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("%s is already in use by another process, choose a different port with -port", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %v", addr, err)
+	}
+	return l, nil
+}
+
 // inProgressPurchases returns a slice of purchases where the buy is at any
 // valid stage (in progress or filled) and has not been entirely sold.
 func (ws *Webserver) inProgressPurchases(allPurchases []*purchase.Purchase) []*purchase.Purchase {
@@ -72,15 +143,15 @@ func (ws *Webserver) inProgressPurchases(allPurchases []*purchase.Purchase) []*p
 }
 
 // todaysCompletedPurchases returns all purchases in which the sell was
-// completed today in PST.
+// completed today.
 func (ws *Webserver) todaysCompletedPurchases(allPurchases []*purchase.Purchase) []*purchase.Purchase {
 	var today []*purchase.Purchase
-	todayYearDay := time.Now().In(PST).YearDay()
+	todayYearDay := time.Now().In(BookkeepingTZ).YearDay()
 	for _, p := range allPurchases {
 		if !p.SellFilled() {
 			continue
 		}
-		if p.GetSellFilledYearDay(PST) != todayYearDay {
+		if p.GetSellFilledYearDay(BookkeepingTZ) != todayYearDay {
 			continue
 		}
 		today = append(today, p)
@@ -109,99 +180,129 @@ func (ws *Webserver) openSellOrders() ([]*alpaca.Order, error) {
 	return sellOrders, nil
 }
 
-// main serves information for the main page.
-func (ws *Webserver) main(w http.ResponseWriter, r *http.Request) {
-	allPurchases, err := ws.db.Purchases(time.Now().In(PST).YearDay(), PST)
+// traderStatus returns a description of the trader based on its most recent
+// heartbeat, which is read from the live state when there is one.
+func (ws *Webserver) traderStatus() string {
+	if ws.live != nil {
+		state, err := ws.live.State()
+		if err != nil {
+			return fmt.Sprintf("unknown (%v)", err)
+		}
+		return heartbeatStatus(state.Heartbeat)
+	}
+	h, err := ws.db.Heartbeat(traderHeartbeatName)
 	if err != nil {
-		fmt.Fprintf(w, "unable to get today's purchases from database: %v\n", err)
-		return
+		return fmt.Sprintf("unknown (%v)", err)
 	}
+	return heartbeatStatus(h)
+}
 
-	a, err := ws.alpacaClient.GetAccount()
-	if err != nil {
-		fmt.Fprintf(w, "unable to get account info: %v\n", err)
-		return
+// allTodaysPurchases returns all of today's purchases, including shadow
+// purchases. They are read from the live state when there is one.
+func (ws *Webserver) allTodaysPurchases() ([]*purchase.Purchase, error) {
+	if ws.live != nil {
+		state, err := ws.live.State()
+		if err != nil {
+			return nil, err
+		}
+		return state.Purchases, nil
 	}
-	fmt.Fprintf(w, "Equity: $%v\n", a.Equity.StringFixed(2))
-	fmt.Fprintf(w, "Cash: $%v\n", a.Cash.StringFixed(2))
-	fmt.Fprintf(w, "Purchases open: %v/20\n", len(ws.inProgressPurchases(allPurchases)))
+	return ws.db.Purchases(time.Now().In(BookkeepingTZ).YearDay(), BookkeepingTZ)
+}
 
-	positions, err := ws.alpacaClient.ListPositions()
-	if err != nil {
-		fmt.Fprintf(w, "unable to get account positions: %v\n", err)
-		return
+// heartbeatStatus describes a trader based on its heartbeat.
+func heartbeatStatus(h *database.Heartbeat) string {
+	age := time.Since(h.Time).Round(time.Second)
+	if age > maxHeartbeatAge {
+		return fmt.Sprintf("NOT RESPONDING, last heartbeat %v ago", age)
 	}
-	fmt.Fprintf(w, "\n\nCurrent Held Positions\n")
-	for _, p := range positions {
-		fmt.Fprintf(w, "\nSymbol: %v\n", p.Symbol)
-		fmt.Fprintf(w, "Qty: %v\n", p.Qty)
-		fmt.Fprintf(w, "CurrentPrice: $%v\n", p.CurrentPrice.StringFixed(2))
-		fmt.Fprintf(w, "Average entry price: $%v\n", p.EntryPrice.StringFixed(2))
-		fmt.Fprintf(w, "Market value: $%v\n", p.MarketValue.StringFixed(2))
+	status := fmt.Sprintf("alive, last heartbeat %v ago (trading: %v, open purchases: %v)",
+		age, h.Trading, h.OpenPurchases)
+	if h.BreakerTripped {
+		status += ", DRAWDOWN BREAKER TRIPPED: no new purchases today"
 	}
+	return status
+}
 
-	fmt.Fprintf(w, "\n\nOpen Sell Orders\n")
-	sellOrders, err := ws.openSellOrders()
-	if err != nil {
-		fmt.Fprintf(w, "unable to get sell orders: %v\n", err)
-	}
-	for _, o := range sellOrders {
-		var stopPriceStr, limitPriceStr string
-		if o.StopPrice != nil {
-			stopPriceStr = o.StopPrice.String()
-		}
-		if o.LimitPrice != nil {
-			limitPriceStr = o.LimitPrice.String()
+// filterByStrategy returns the purchases made by the given strategy.
+func filterByStrategy(allPurchases []*purchase.Purchase, strategy string) []*purchase.Purchase {
+	var filtered []*purchase.Purchase
+	for _, p := range allPurchases {
+		if p.Strategy == strategy {
+			filtered = append(filtered, p)
 		}
-		fmt.Fprintf(w, "%v [%v] (%v), Stop Price ($%v), Limit Price ($%v)\n", o.Symbol, o.Qty, o.Type, stopPriceStr, limitPriceStr)
 	}
+	return filtered
+}
 
-	timePeriod := "14D"
-	timeFrame := alpaca.Day1
-	history, err := ws.alpacaClient.GetPortfolioHistory(
-		&timePeriod, &timeFrame, nil, false)
-	if err != nil {
-		fmt.Fprintf(w, "unable to get daily account history: %v", err)
-		return
+// withoutShadow returns the purchases which were actually traded.
+func withoutShadow(allPurchases []*purchase.Purchase) []*purchase.Purchase {
+	var traded []*purchase.Purchase
+	for _, p := range allPurchases {
+		if !p.Shadow {
+			traded = append(traded, p)
+		}
 	}
-	fmt.Fprintf(w, "\n\nHistory - 14 Days\n")
-	for i, t := range history.Timestamp {
-		fmt.Fprintf(w, "%v: $%v, Profit: $%v [%%%v]\n",
-			time.Unix(t, 0),
-			history.Equity[i],
-			history.ProfitLoss[i],
-			history.ProfitLossPct[i].Mul(decimal.NewFromInt(100)).Round(3),
-		)
-	}
-
-	fmt.Fprintf(w, "\n\nToday's Completed Wins/Losses\n")
-	for _, p := range ws.todaysCompletedPurchases(allPurchases) {
-		fmt.Fprintf(w, "Sold @ %v: %v, Qty: %v [$%v => $%v] %v\n",
-			p.SellOrder.FilledAt.In(PST),
-			p.SellOrder.Symbol,
-			p.SellOrder.Qty,
-			p.BuyOrder.FilledAvgPrice.StringFixed(2),
-			p.SellOrder.FilledAvgPrice.StringFixed(2),
-			winOrLoss(p),
-		)
-	}
-
-	activities, err := ws.alpacaClient.GetAccountActivities(nil, nil)
-	if err != nil {
-		fmt.Fprintf(w, "unable to get account activities: %v", err)
-		return
+	return traded
+}
+
+// strategyCounts returns a summary of the number of purchases made by each
+// strategy, e.g. "slope (4), slope-fast (2)".
+func strategyCounts(allPurchases []*purchase.Purchase) string {
+	counts := map[string]int{}
+	var strategies []string
+	for _, p := range allPurchases {
+		if counts[p.Strategy] == 0 {
+			strategies = append(strategies, p.Strategy)
+		}
+		counts[p.Strategy]++
 	}
-	fmt.Fprintf(w, "\n\nRecent Activity (%v trades today)\n", tradesToday(activities))
-	for _, a := range activities {
-		fmt.Fprintf(w, "%v: [%v] %v, %v @ $%v\n",
-			a.TransactionTime.In(PST), a.Side, a.Symbol, a.Qty, a.Price)
+	sort.Strings(strategies)
+	var summary []string
+	for _, s := range strategies {
+		summary = append(summary, fmt.Sprintf("%v (%v)", s, counts[s]))
 	}
+	return strings.Join(summary, ", ")
+}
 
-	fmt.Fprintf(w, "\n\nDeep dive of purchases\n")
+// writeStrategyComparison writes the completed trade statistics of each
+// strategy, allowing strategies run side by side (e.g. the arms of an A/B
+// experiment) to be compared.
+func writeStrategyComparison(w io.Writer, allPurchases []*purchase.Purchase) {
+	type stats struct {
+		trades, wins int
+		profitLoss   decimal.Decimal
+	}
+	byStrategy := map[string]*stats{}
+	var strategies []string
 	for _, p := range allPurchases {
-		fmt.Fprintf(w, "\nbuy order: %+v", p.BuyOrder)
-		fmt.Fprintf(w, "sell order: %+v\n", p.SellOrder)
+		if !p.BuyFilled() || !p.SellFilled() {
+			continue
+		}
+		s, ok := byStrategy[p.Strategy]
+		if !ok {
+			s = &stats{}
+			byStrategy[p.Strategy] = s
+			strategies = append(strategies, p.Strategy)
+		}
+		pl := p.RealizedProfitLoss()
+		s.trades++
+		if !pl.IsNegative() {
+			s.wins++
+		}
+		s.profitLoss = s.profitLoss.Add(pl)
+	}
+	if len(strategies) < 2 {
+		return
 	}
+	sort.Strings(strategies)
+	fmt.Fprintf(w, "\nStrategy Comparison\n")
+	for _, name := range strategies {
+		s := byStrategy[name]
+		fmt.Fprintf(w, "%v: %v trades, %v wins (%.1f%%), P/L $%v\n",
+			name, s.trades, s.wins, 100*float64(s.wins)/float64(s.trades), s.profitLoss.StringFixed(2))
+	}
+	fmt.Fprintf(w, "\n")
 }
 
 // winOrLoss returns a string of WIN when the sell price is greater than or
@@ -215,10 +316,10 @@ func winOrLoss(p *purchase.Purchase) string {
 }
 
 func tradesToday(activities []alpaca.AccountActivity) int {
-	yearDayToday := time.Now().In(PST).YearDay()
+	yearDayToday := time.Now().In(BookkeepingTZ).YearDay()
 	var count int
 	for _, a := range activities {
-		if yearDayToday == a.TransactionTime.In(PST).YearDay() {
+		if yearDayToday == a.TransactionTime.In(BookkeepingTZ).YearDay() {
 			count++
 		}
 	}
@@ -226,6 +327,16 @@ func tradesToday(activities []alpaca.AccountActivity) int {
 }
 
 func main() {
+	flag.Parse()
+	fmt.Println(currentBuildInfo())
+
+	var err error
+	BookkeepingTZ, err = time.LoadLocation(*bookkeepingTimezone)
+	if err != nil {
+		fmt.Printf("unable to load timezone location: %v", err)
+		os.Exit(1)
+	}
+
 	w, err := New()
 	if err != nil {
 		fmt.Printf("unable to create webserver: %v", err)
@@ -241,11 +352,4 @@ func init() {
 	log.Printf("Running w/ credentials [%v %v]\n", common.Credentials().ID, common.Credentials().Secret)
 
 	alpaca.SetBaseUrl("https://paper-api.alpaca.markets")
-
-	var err error
-	PST, err = time.LoadLocation("America/Los_Angeles")
-	if err != nil {
-		fmt.Printf("unable to load timezone location: %v", err)
-		os.Exit(1)
-	}
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlToJSON converts a YAML config file to JSON. Only the YAML the config
+// file needs is supported: nested mappings of scalars, with comments. Every
+// scalar becomes a JSON string, which flagValue accepts.
+func yamlToJSON(b []byte) ([]byte, error) {
+	type mapping struct {
+		indent int // The indent of the key which owns the mapping.
+		m      map[string]interface{}
+	}
+	root := map[string]interface{}{}
+	stack := []mapping{{indent: -1, m: root}}
+	for i, line := range strings.Split(string(b), "\n") {
+		n := i + 1
+		line = strings.TrimRight(stripYAMLComment(line), " \r")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || (len(stack) == 1 && content == "---") {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %v: tabs cannot indent YAML", n)
+		}
+		if strings.HasPrefix(content, "- ") || content == "-" {
+			return nil, fmt.Errorf("line %v: lists are not supported", n)
+		}
+		indent := len(line) - len(content)
+		for stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1].m
+
+		key, value, err := splitYAMLKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		if _, ok := parent[key]; ok {
+			return nil, fmt.Errorf("line %v: %q is repeated", n, key)
+		}
+		if value == "" {
+			child := map[string]interface{}{}
+			parent[key] = child
+			stack = append(stack, mapping{indent: indent, m: child})
+			continue
+		}
+		if parent[key], err = yamlScalar(value); err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+	}
+	return json.Marshal(root)
+}
+
+// stripYAMLComment returns the line without its comment, if any. A comment
+// starts with a # which begins the line or follows a space, outside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitYAMLKey splits "key: value" or "key:" into its key and value.
+func splitYAMLKey(content string) (string, string, error) {
+	var key, value string
+	switch i := strings.Index(content, ": "); {
+	case i >= 0:
+		key, value = content[:i], strings.TrimSpace(content[i+2:])
+	case strings.HasSuffix(content, ":"):
+		key = strings.TrimSuffix(content, ":")
+	default:
+		return "", "", fmt.Errorf("%q is not of the form key: value", content)
+	}
+	key, err := yamlScalar(strings.TrimSpace(key))
+	if err != nil {
+		return "", "", err
+	}
+	if key == "" {
+		return "", "", fmt.Errorf("%q has no key", content)
+	}
+	return key, value, nil
+}
+
+// yamlScalar returns the string of a plain, single quoted or double quoted
+// scalar.
+func yamlScalar(s string) (string, error) {
+	switch {
+	case s == "":
+		return "", nil
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid double quoted string %v", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("invalid single quoted string %v", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.ContainsAny(s[:1], "[{|>&*!%@`"):
+		return "", fmt.Errorf("%q is not supported, only mappings of scalars are", s)
+	}
+	return s, nil
+}
@@ -4,8 +4,15 @@ go 1.15
 
 replace github.com/alpacahq/alpaca-trade-api-go => /Users/ejbrever/go/src/github.com/alpacahq/alpaca-trade-api-go
 
+// The suite is built against the database and purchase packages in this tree,
+// which change together with the trader.
+replace github.com/ejbrever/trader/one/database => ../one/database
+
+replace github.com/ejbrever/trader/one/purchase => ../one/purchase
+
 require (
 	github.com/alpacahq/alpaca-trade-api-go v1.7.0
 	github.com/ejbrever/trader/one/database v0.0.0-20201225051459-6d2a9ec182ea
 	github.com/ejbrever/trader/one/purchase v0.0.0-20201225050709-fc4411689c45
+	github.com/shopspring/decimal v1.2.0
 )
@@ -0,0 +1,354 @@
+// Runs an integration suite against an Alpaca paper account, to catch drift
+// in the SDK and the API before it reaches the trader. A tiny limit order is
+// placed well below the market, polled, stored as a purchase, cancelled and
+// read back from the database.
+//
+// The suite is skipped unless TRADER_INTEGRATION=1, and the credentials are
+// read from APCA_API_KEY_ID and APCA_API_SECRET_KEY, e.g.
+// "TRADER_INTEGRATION=1 go test -v . -args -symbol SPY -database one".
+package test
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/ejbrever/trader/one/database"
+	"github.com/ejbrever/trader/one/purchase"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	symbol       = flag.String("symbol", "SPY", "The symbol of the test order.")
+	databaseName = flag.String("database", "one", "The database the test purchase is stored in. When empty, the database steps are skipped.")
+	pollTimeout  = flag.Duration("poll_timeout", 30*time.Second, "How long to wait for an order to reach an expected status.")
+)
+
+const (
+	integrationEnv = "TRADER_INTEGRATION"
+	paperEndpoint  = "https://paper-api.alpaca.markets"
+	testStrategy   = "integration-test"
+)
+
+// suite holds the state which is passed between the steps.
+type suite struct {
+	alpacaClient *alpaca.Client
+	dbClient     *database.MySQLClient
+
+	limitPrice    decimal.Decimal
+	clientOrderID string
+	order         *alpaca.Order
+	purchase      *purchase.Purchase
+}
+
+// step is a named part of the suite. The steps run in order and the suite
+// stops at the first which fails.
+type step struct {
+	name string
+	run  func() error
+}
+
+func TestPaperAccount(t *testing.T) {
+	if os.Getenv(integrationEnv) != "1" {
+		t.Skipf("skipping the integration suite, set %v=1 to run it against the paper account", integrationEnv)
+	}
+	if common.Credentials().ID == "" || common.Credentials().Secret == "" {
+		t.Fatalf("%v and %v must be set", common.EnvApiKeyID, common.EnvApiSecretKey)
+	}
+	// Orders are only ever placed with the paper account.
+	alpaca.SetBaseUrl(paperEndpoint)
+
+	s := &suite{alpacaClient: alpaca.NewClient(common.Credentials())}
+	if *databaseName != "" {
+		db, err := database.NewNamed(*databaseName)
+		if err != nil {
+			t.Fatalf("unable to open database %q: %v", *databaseName, err)
+		}
+		s.dbClient = db
+	}
+	// The order is cancelled however the suite ends, so it cannot fill later.
+	t.Cleanup(s.cleanup)
+
+	for _, st := range s.steps() {
+		st := st
+		ok := t.Run(st.name, func(t *testing.T) {
+			if err := st.run(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
+// steps returns the steps of the suite, in order.
+func (s *suite) steps() []step {
+	steps := []step{
+		{"account", s.checkAccount},
+		{"clock", s.checkClock},
+		{"price", s.priceOrder},
+		{"place order", s.placeOrder},
+		{"poll order", s.pollOrder},
+		{"order by client order ID", s.orderByClientOrderID},
+	}
+	if s.dbClient != nil {
+		steps = append(steps, step{"insert purchase", s.insertPurchase})
+	}
+	steps = append(steps,
+		step{"cancel order", s.cancelOrder},
+		step{"open orders", s.checkOpenOrders},
+	)
+	if s.dbClient != nil {
+		steps = append(steps, step{"update purchase", s.updatePurchase})
+	}
+	return steps
+}
+
+// checkAccount checks that the account can trade.
+func (s *suite) checkAccount() error {
+	a, err := s.alpacaClient.GetAccount()
+	if err != nil {
+		return fmt.Errorf("unable to get account: %v", err)
+	}
+	if a.TradingBlocked || a.AccountBlocked {
+		return fmt.Errorf("account %v is blocked", a.ID)
+	}
+	if !a.BuyingPower.IsPositive() {
+		return fmt.Errorf("account %v has no buying power", a.ID)
+	}
+	return nil
+}
+
+// checkClock checks that the market clock decodes.
+func (s *suite) checkClock() error {
+	clock, err := s.alpacaClient.GetClock()
+	if err != nil {
+		return fmt.Errorf("unable to get clock: %v", err)
+	}
+	if clock.Timestamp.IsZero() || clock.NextOpen.IsZero() || clock.NextClose.IsZero() {
+		return fmt.Errorf("clock has zero times: %+v", clock)
+	}
+	log.Printf("market open: %v, next open %v", clock.IsOpen, clock.NextOpen)
+	return nil
+}
+
+// priceOrder prices the limit order at half of the last daily close, so it
+// does not fill before it is cancelled.
+func (s *suite) priceOrder() error {
+	start := time.Now().AddDate(0, 0, -10)
+	bars, err := s.alpacaClient.GetSymbolBars(*symbol, alpaca.ListBarParams{
+		Timeframe: "1D",
+		StartDt:   &start,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get bars of %v: %v", *symbol, err)
+	}
+	if len(bars) == 0 {
+		return fmt.Errorf("no bars of %v were returned", *symbol)
+	}
+	last := bars[len(bars)-1]
+	if last.Close <= 0 {
+		return fmt.Errorf("last bar of %v has no close: %+v", *symbol, last)
+	}
+	s.limitPrice = decimal.NewFromFloat32(last.Close).Div(decimal.NewFromInt(2)).Round(2)
+	return nil
+}
+
+// placeOrder places a one share limit buy order and checks that the order
+// echoes the request.
+func (s *suite) placeOrder() error {
+	s.clientOrderID = fmt.Sprintf("%v-%v", testStrategy, time.Now().UnixNano())
+	o, err := s.alpacaClient.PlaceOrder(alpaca.PlaceOrderRequest{
+		AssetKey:      symbol,
+		Qty:           decimal.NewFromInt(1),
+		Side:          alpaca.Buy,
+		Type:          alpaca.Limit,
+		LimitPrice:    &s.limitPrice,
+		TimeInForce:   alpaca.Day,
+		ClientOrderID: s.clientOrderID,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to place order: %v", err)
+	}
+	s.order = o
+	return s.checkOrder(o)
+}
+
+// checkOrder checks that the order matches the placed order.
+func (s *suite) checkOrder(o *alpaca.Order) error {
+	var problems []string
+	if o.ID == "" {
+		problems = append(problems, "no ID")
+	}
+	if o.ClientOrderID != s.clientOrderID {
+		problems = append(problems, fmt.Sprintf("client order ID %q, want %q", o.ClientOrderID, s.clientOrderID))
+	}
+	if o.Symbol != *symbol {
+		problems = append(problems, fmt.Sprintf("symbol %q, want %q", o.Symbol, *symbol))
+	}
+	if !o.Qty.Equal(decimal.NewFromInt(1)) {
+		problems = append(problems, fmt.Sprintf("qty %v, want 1", o.Qty))
+	}
+	if o.Side != alpaca.Buy || o.Type != alpaca.Limit || o.TimeInForce != alpaca.Day {
+		problems = append(problems, fmt.Sprintf("%v %v %v, want buy limit day", o.Side, o.Type, o.TimeInForce))
+	}
+	if o.LimitPrice == nil || !o.LimitPrice.Equal(s.limitPrice) {
+		problems = append(problems, fmt.Sprintf("limit price %v, want %v", o.LimitPrice, s.limitPrice))
+	}
+	if o.SubmittedAt.IsZero() {
+		problems = append(problems, "no submitted time")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("order %v: %v", o.ID, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// pollOrder waits for the order to be accepted by the broker.
+func (s *suite) pollOrder() error {
+	o, err := s.waitForStatus("new", "accepted", "pending_new")
+	if err != nil {
+		return err
+	}
+	s.order = o
+	return s.checkOrder(o)
+}
+
+// orderByClientOrderID checks that the order can be found by the client order
+// ID, which is how the trader finds an order when placing it failed.
+func (s *suite) orderByClientOrderID() error {
+	o, err := s.alpacaClient.GetOrderByClientOrderID(s.clientOrderID)
+	if err != nil {
+		return fmt.Errorf("unable to get order %q: %v", s.clientOrderID, err)
+	}
+	if o.ID != s.order.ID {
+		return fmt.Errorf("client order ID %q has order %v, want %v", s.clientOrderID, o.ID, s.order.ID)
+	}
+	return nil
+}
+
+// insertPurchase stores the order as a purchase and reads it back.
+func (s *suite) insertPurchase() error {
+	s.purchase = &purchase.Purchase{
+		BuyOrder: s.order,
+		Strategy: testStrategy,
+	}
+	if err := s.dbClient.Insert(s.purchase); err != nil {
+		return fmt.Errorf("unable to insert purchase: %v", err)
+	}
+	if s.purchase.ID == 0 {
+		return fmt.Errorf("inserted purchase has no ID")
+	}
+	return s.checkStoredPurchase(s.order.Status)
+}
+
+// cancelOrder cancels the order and waits for the cancel to be done.
+func (s *suite) cancelOrder() error {
+	if err := s.alpacaClient.CancelOrder(s.order.ID); err != nil {
+		return fmt.Errorf("unable to cancel order %v: %v", s.order.ID, err)
+	}
+	o, err := s.waitForStatus("canceled")
+	if err != nil {
+		return err
+	}
+	if o.CanceledAt == nil {
+		return fmt.Errorf("cancelled order %v has no cancelled time", o.ID)
+	}
+	if !o.FilledQty.IsZero() {
+		return fmt.Errorf("order %v filled %v shares before it was cancelled", o.ID, o.FilledQty)
+	}
+	s.order = o
+	return nil
+}
+
+// checkOpenOrders checks that the cancelled order is no longer listed as
+// open.
+func (s *suite) checkOpenOrders() error {
+	status := "open"
+	orders, err := s.alpacaClient.ListOrders(&status, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to list open orders: %v", err)
+	}
+	for _, o := range orders {
+		if o.ID == s.order.ID {
+			return fmt.Errorf("cancelled order %v is still open", o.ID)
+		}
+	}
+	return nil
+}
+
+// updatePurchase stores the cancelled order and checks that the purchase
+// ended without a fill.
+func (s *suite) updatePurchase() error {
+	s.purchase.BuyOrder = s.order
+	if err := s.dbClient.Update(s.purchase); err != nil {
+		return fmt.Errorf("unable to update purchase %d: %v", s.purchase.ID, err)
+	}
+	if err := s.checkStoredPurchase("canceled"); err != nil {
+		return err
+	}
+	if !s.purchase.BuyEndedUnsuccessfully() {
+		return fmt.Errorf("purchase %d did not end unsuccessfully", s.purchase.ID)
+	}
+	return nil
+}
+
+// checkStoredPurchase reads the purchase from the database and checks that
+// its buy order has the status.
+func (s *suite) checkStoredPurchase(status string) error {
+	p, err := s.dbClient.Purchase(s.purchase.ID)
+	if err != nil {
+		return fmt.Errorf("unable to read purchase %d: %v", s.purchase.ID, err)
+	}
+	if p.BuyOrder == nil || p.BuyOrder.ID != s.order.ID {
+		return fmt.Errorf("purchase %d has buy order %+v, want %v", p.ID, p.BuyOrder, s.order.ID)
+	}
+	if p.BuyOrder.Status != status {
+		return fmt.Errorf("purchase %d has buy order status %q, want %q", p.ID, p.BuyOrder.Status, status)
+	}
+	if p.Strategy != testStrategy {
+		return fmt.Errorf("purchase %d has strategy %q, want %q", p.ID, p.Strategy, testStrategy)
+	}
+	return nil
+}
+
+// waitForStatus polls the order until it has one of the statuses.
+func (s *suite) waitForStatus(statuses ...string) (*alpaca.Order, error) {
+	deadline := time.Now().Add(*pollTimeout)
+	var last string
+	for time.Now().Before(deadline) {
+		o, err := s.alpacaClient.GetOrder(s.order.ID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get order %v: %v", s.order.ID, err)
+		}
+		for _, st := range statuses {
+			if o.Status == st {
+				return o, nil
+			}
+		}
+		last = o.Status
+		time.Sleep(time.Second)
+	}
+	return nil, fmt.Errorf("order %v has status %q after %v, want one of %v", s.order.ID, last, *pollTimeout, statuses)
+}
+
+// cleanup cancels the order if it may still be open. It is safe to call more
+// than once.
+func (s *suite) cleanup() {
+	if s.order == nil || s.order.Status == "canceled" {
+		return
+	}
+	if err := s.alpacaClient.CancelOrder(s.order.ID); err != nil {
+		log.Printf("unable to cancel order %v, cancel it by hand: %v", s.order.ID, err)
+		return
+	}
+	s.order.Status = "canceled"
+	log.Printf("cancelled order %v", s.order.ID)
+}